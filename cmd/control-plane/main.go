@@ -22,8 +22,16 @@ import (
 	_ "github.com/lib/pq"
 )
 
+// Build information, injected with -ldflags "-X main.version=...".
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
 func main() {
 	cfg := controlplane.LoadConfig()
+	cfg.Build = controlplane.BuildInfo{Version: version, Commit: commit, BuildTime: buildTime}
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "migrate":
@@ -72,7 +80,7 @@ func runMigrate(cfg controlplane.Config) error {
 }
 
 func runServe(cfg controlplane.Config) error {
-	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	db, err := store.OpenPostgres(cfg.DatabaseURL)
 	if err != nil {
 		return err
 	}
@@ -90,13 +98,33 @@ func runServe(cfg controlplane.Config) error {
 		return fmt.Errorf("database ping: %w", err)
 	}
 
+	cipher, err := store.NewTenantCipherFromSpec(cfg.EncryptionKeys, cfg.EncryptionActiveKey)
+	if err != nil {
+		return fmt.Errorf("encryption keys: %w", err)
+	}
 	repo := store.NewPostgresRepo(db)
+	repo.SetTenantCipher(cipher)
 	app, err := controlplane.NewApp(cfg, repo)
 	if err != nil {
 		return err
 	}
 	app.StartBackgroundWorkers(ctx)
 
+	// SIGHUP re-checks READ_ONLY_FILE to enter or leave read-only mode.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				app.ReloadReadOnly()
+			}
+		}
+	}()
+
 	// Start background audit verifier
 	stopVerifier := app.StartBackgroundVerifier(ctx)
 
@@ -112,6 +140,7 @@ func runServe(cfg controlplane.Config) error {
 			cfg.MaxPlansPerHeartbeat,
 			cfg.AgentCertTTL,
 		)
+		grpcServer.SetReadOnlyFunc(app.ReadOnly)
 		if err := grpcServer.Start(); err != nil {
 			log.Printf("[grpc] Failed to start server: %v", err)
 		} else {
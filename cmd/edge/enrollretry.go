@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+)
+
+const (
+	defaultEnrollRetryBackoff = 2 * time.Second
+	defaultEnrollRetryTimeout = 15 * time.Minute
+	maxEnrollRetryBackoff     = time.Minute
+)
+
+// enrollRetrier retries enrollment on transient failures (network errors,
+// 5xx) with exponential backoff until timeout has passed since the first
+// attempt. Permanent failures such as a rejected token end it at once.
+type enrollRetrier struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	now        func() time.Time
+	sleep      func(ctx context.Context, d time.Duration) error
+}
+
+func newEnrollRetrier(backoff, timeout time.Duration) *enrollRetrier {
+	if backoff <= 0 {
+		backoff = defaultEnrollRetryBackoff
+	}
+	if timeout <= 0 {
+		timeout = defaultEnrollRetryTimeout
+	}
+	return &enrollRetrier{
+		backoff:    backoff,
+		maxBackoff: maxEnrollRetryBackoff,
+		timeout:    timeout,
+		now:        time.Now,
+		sleep:      sleepContext,
+	}
+}
+
+// do calls attempt until it succeeds, fails permanently, or the next
+// attempt would start after the timeout.
+func (r *enrollRetrier) do(ctx context.Context, attempt func(context.Context) (enroll.EnrollResponse, error)) (enroll.EnrollResponse, error) {
+	deadline := r.now().Add(r.timeout)
+	delay := r.backoff
+	for n := 1; ; n++ {
+		resp, err := attempt(ctx)
+		if err == nil || !enroll.Retryable(err) || r.now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		log.Printf("[enroll] attempt %d failed: %v; retrying in %s", n, err, delay)
+		if err := r.sleep(ctx, delay); err != nil {
+			return enroll.EnrollResponse{}, err
+		}
+		delay = min(delay*2, r.maxBackoff)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+)
+
+func TestEnrollRetrierStopsOnTerminalErrors(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+	r := newEnrollRetrier(time.Second, time.Minute)
+	r.maxBackoff = 4 * time.Second
+	r.now = func() time.Time { return now }
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	// Transient failures are retried with doubling, capped delays.
+	calls := 0
+	resp, err := r.do(context.Background(), func(context.Context) (enroll.EnrollResponse, error) {
+		calls++
+		if calls < 5 {
+			return enroll.EnrollResponse{}, &enroll.EnrollError{StatusCode: 503}
+		}
+		return enroll.EnrollResponse{AgentID: "agent-1"}, nil
+	})
+	if err != nil || resp.AgentID != "agent-1" || calls != 5 {
+		t.Fatalf("expected success on the fifth attempt, got %+v (%v) after %d", resp, err, calls)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	if len(slept) != len(want) {
+		t.Fatalf("slept %v, want %v", slept, want)
+	}
+	for i := range want {
+		if slept[i] != want[i] {
+			t.Fatalf("slept %v, want %v", slept, want)
+		}
+	}
+
+	// A rejected token is not retried.
+	calls = 0
+	_, err = r.do(context.Background(), func(context.Context) (enroll.EnrollResponse, error) {
+		calls++
+		return enroll.EnrollResponse{}, &enroll.EnrollError{StatusCode: 401}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("expected one attempt for a 401, got %d (%v)", calls, err)
+	}
+
+	// Transient failures give up once the timeout has passed.
+	calls = 0
+	_, err = r.do(context.Background(), func(context.Context) (enroll.EnrollResponse, error) {
+		calls++
+		return enroll.EnrollResponse{}, &enroll.EnrollError{StatusCode: 502}
+	})
+	if err == nil || calls < 2 || calls > 20 {
+		t.Fatalf("expected retries bounded by the timeout, got %d attempts (%v)", calls, err)
+	}
+}
@@ -7,20 +7,24 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/kubedoio/n-kudo/internal/edge/cgroup"
 	edgecmd "github.com/kubedoio/n-kudo/internal/edge/cmd"
 	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/execlog"
 	"github.com/kubedoio/n-kudo/internal/edge/executor"
 	"github.com/kubedoio/n-kudo/internal/edge/hostfacts"
 	"github.com/kubedoio/n-kudo/internal/edge/logger"
+	"github.com/kubedoio/n-kudo/internal/edge/metadata"
 	"github.com/kubedoio/n-kudo/internal/edge/metrics"
 	"github.com/kubedoio/n-kudo/internal/edge/mtls"
 	"github.com/kubedoio/n-kudo/internal/edge/netbird"
@@ -28,15 +32,31 @@ import (
 	"github.com/kubedoio/n-kudo/internal/edge/providers/firecracker"
 	"github.com/kubedoio/n-kudo/internal/edge/securestate"
 	"github.com/kubedoio/n-kudo/internal/edge/state"
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var version = "dev"
 
 const (
-	defaultStateDir   = "/var/lib/nkudo-edge/state"
-	defaultPKIDir     = "/var/lib/nkudo-edge/pki"
-	defaultRuntimeDir = "/var/lib/nkudo-edge/vms"
-	defaultInterval   = 15 * time.Second
+	defaultStateDir    = "/var/lib/nkudo-edge/state"
+	defaultPKIDir      = "/var/lib/nkudo-edge/pki"
+	defaultRuntimeDir  = "/var/lib/nkudo-edge/vms"
+	defaultSnapshotDir = "/var/lib/nkudo-edge/snapshots"
+	defaultInterval    = 15 * time.Second
+
+	// defaultActionConcurrency keeps I/O heavy creates from holding up
+	// cheap actions of the plans leased alongside them.
+	defaultActionConcurrency = "MicroVMCreate=2,MicroVMStop=10,*=4"
+	// defaultGzipThreshold leaves small heartbeats uncompressed, where gzip
+	// would save little.
+	defaultGzipThreshold = 16 << 10
+
+	// maxPendingLogs bounds the log entries kept for another attempt after
+	// streaming them failed; the oldest are dropped first.
+	maxPendingLogs = 1000
+	// logFlushTimeout bounds the flush of pending log entries on shutdown.
+	logFlushTimeout = 5 * time.Second
 
 	providerCloudHypervisor = "cloud-hypervisor"
 	providerFirecracker     = "firecracker"
@@ -55,6 +75,10 @@ type StateStore interface {
 	ListMicroVMs() ([]state.MicroVM, error)
 	GetActionRecord(actionID string) (state.ActionRecord, bool, error)
 	PutActionRecord(record state.ActionRecord) error
+	PutPendingResult(result state.PendingResult) error
+	ListPendingResults() ([]state.PendingResult, error)
+	DeletePendingResult(executionID string) error
+	NextHeartbeatSeq() (int64, error)
 }
 
 // openState opens the state store, using securestate if NKUDO_STATE_KEY is set,
@@ -103,8 +127,22 @@ func autoDetectProvider() (string, string) {
 	return providerCloudHypervisor, "cloud-hypervisor"
 }
 
+// commandLogOptions controls the providers' on-host commands.log.
+type commandLogOptions struct {
+	Disabled   bool
+	RedactArgs []string
+}
+
+// vmmAPIOptions bounds the providers' calls to the VMM API socket; zero
+// fields use the provider defaults.
+type vmmAPIOptions struct {
+	Timeout          time.Duration
+	ConfigureTimeout time.Duration
+	Retries          int
+}
+
 // selectProvider creates the appropriate provider based on configuration.
-func selectProvider(providerName, chBin, fcBin string, st StateStore, runtimeDir string) (*providerSelection, error) {
+func selectProvider(providerName, chBin, fcBin string, st StateStore, runtimeDir string, cmdLog commandLogOptions, vmmAPI vmmAPIOptions, cgroups *cgroup.Manager) (*providerSelection, error) {
 	// Auto-detect if needed
 	if providerName == providerAuto || providerName == "" {
 		detected, bin := autoDetectProvider()
@@ -123,9 +161,13 @@ func selectProvider(providerName, chBin, fcBin string, st StateStore, runtimeDir
 			chBin = "cloud-hypervisor"
 		}
 		provider := &cloudhypervisor.Provider{
-			Binary:     chBin,
-			State:      st,
-			RuntimeDir: runtimeDir,
+			Binary:            chBin,
+			State:             st,
+			RuntimeDir:        runtimeDir,
+			DisableCommandLog: cmdLog.Disabled,
+			RedactArgs:        cmdLog.RedactArgs,
+			APITimeout:        vmmAPI.Timeout,
+			Cgroups:           cgroups,
 		}
 		return &providerSelection{
 			Name:     providerCloudHypervisor,
@@ -137,9 +179,15 @@ func selectProvider(providerName, chBin, fcBin string, st StateStore, runtimeDir
 			fcBin = "firecracker"
 		}
 		provider := &firecracker.Provider{
-			Binary:     fcBin,
-			State:      st,
-			RuntimeDir: runtimeDir,
+			Binary:            fcBin,
+			State:             st,
+			RuntimeDir:        runtimeDir,
+			DisableCommandLog: cmdLog.Disabled,
+			RedactArgs:        cmdLog.RedactArgs,
+			APITimeout:        vmmAPI.Timeout,
+			ConfigureTimeout:  vmmAPI.ConfigureTimeout,
+			APIRetries:        vmmAPI.Retries,
+			Cgroups:           cgroups,
 		}
 		return &providerSelection{
 			Name:     providerFirecracker,
@@ -160,7 +208,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := notifyShutdown(context.Background())
 	defer stop()
 
 	var err error
@@ -183,6 +231,8 @@ func main() {
 		err = edgecmd.RunUnenroll(os.Args[2:])
 	case "renew":
 		err = edgecmd.RunRenew(os.Args[2:])
+	case "logs":
+		err = edgecmd.RunLogs(os.Args[2:])
 	case "version":
 		fmt.Println(version)
 	case "--help", "-h", "help":
@@ -209,6 +259,7 @@ func usage() {
   check             Pre-flight check for requirements
   unenroll          Cleanly remove agent from site
   renew             Manual certificate renewal
+  logs              Show local logs for an execution
   version           Print binary version
 
 Use "edge <command> --help" for more information about a command.`)
@@ -225,6 +276,10 @@ func runEnroll(ctx context.Context, args []string) error {
 		hostname     = fs.String("hostname", "", "Requested hostname")
 		caFile       = fs.String("ca-file", "", "Bootstrap CA certificate PEM path")
 		insecure     = fs.Bool("insecure-skip-verify", false, "Skip TLS verification (dev only)")
+		proxy        = fs.String("proxy", "", "Proxy URL for control-plane requests (default: HTTPS_PROXY/NO_PROXY)")
+		retry        = fs.Bool("retry", false, "Retry enrollment on network errors and 5xx responses with exponential backoff; a rejected token still fails at once")
+		retryBackoff = fs.Duration("retry-backoff", defaultEnrollRetryBackoff, "Initial delay between enrollment attempts with --retry (doubles per attempt, up to 1m)")
+		retryTimeout = fs.Duration("retry-timeout", defaultEnrollRetryTimeout, "How long --retry keeps trying before giving up")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -259,12 +314,16 @@ func runEnroll(ctx context.Context, args []string) error {
 			return fmt.Errorf("read --ca-file: %w", err)
 		}
 	}
-	client, err := mtls.NewBootstrapTLSClient(bootstrapCA, *insecure)
+	proxyOpt, err := mtls.WithProxy(strings.TrimSpace(*proxy))
+	if err != nil {
+		return err
+	}
+	client, err := mtls.NewBootstrapTLSClient(bootstrapCA, *insecure, proxyOpt)
 	if err != nil {
 		return err
 	}
 	ec := enroll.Client{BaseURL: *controlPlane, HTTP: client}
-	resp, err := ec.Enroll(ctx, enroll.EnrollRequest{
+	req := enroll.EnrollRequest{
 		EnrollmentToken: token,
 		AgentVersion:    version,
 		RequestedHost:   resolvedHostname,
@@ -272,7 +331,14 @@ func runEnroll(ctx context.Context, args []string) error {
 		Fingerprint:     enroll.BuildFingerprint(),
 		BootstrapNonce:  enroll.NewNonce(),
 		Labels:          map[string]string{"arch": runtimeArch(), "os": runtimeOS()},
-	})
+	}
+	attempt := func(ctx context.Context) (enroll.EnrollResponse, error) { return ec.Enroll(ctx, req) }
+	var resp enroll.EnrollResponse
+	if *retry {
+		resp, err = newEnrollRetrier(*retryBackoff, *retryTimeout).do(ctx, attempt)
+	} else {
+		resp, err = attempt(ctx)
+	}
 	if err != nil {
 		return err
 	}
@@ -299,6 +365,9 @@ func runEnroll(ctx context.Context, args []string) error {
 	}
 
 	fmt.Printf("enrolled agent_id=%s site_id=%s host_id=%s\n", resp.AgentID, resp.SiteID, resp.HostID)
+	if resp.ServerVersion != "" {
+		fmt.Printf("control plane version %s (agent %s)\n", resp.ServerVersion, version)
+	}
 	fmt.Printf("pki written under %s\n", *pkiDir)
 	return nil
 }
@@ -327,6 +396,8 @@ func runApply(ctx context.Context, args []string) error {
 		fcBin      = fs.String("firecracker-bin", "firecracker", "Firecracker binary path")
 		logFormat  = fs.String("log-format", "text", "Log format: json or text")
 		logLevel   = fs.String("log-level", "info", "Log level: debug, info, warn, error")
+		noCmdLog   = fs.Bool("no-command-log", false, "Do not write provider commands to commands.log")
+		cmdRedact  = fs.String("command-log-redact", "", "Comma-separated extra flag/key names to mask in commands.log")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -348,7 +419,7 @@ func runApply(ctx context.Context, args []string) error {
 		return err
 	}
 
-	sel, err := selectProvider(*provider, *chBin, *fcBin, st, *runtimeDir)
+	sel, err := selectProvider(*provider, *chBin, *fcBin, st, *runtimeDir, commandLogOptions{Disabled: *noCmdLog, RedactArgs: splitList(*cmdRedact)}, vmmAPIOptions{}, nil)
 	if err != nil {
 		return err
 	}
@@ -357,7 +428,7 @@ func runApply(ctx context.Context, args []string) error {
 		"binary":   sel.Binary,
 	}).Info("Using VM provider")
 
-	exec := &executor.Executor{Store: st, Provider: sel.Provider, Logs: &stdoutSink{}}
+	exec := &executor.Executor{Store: st, Provider: sel.Provider, Logs: &stdoutSink{Local: execlog.New(execlog.DirFor(*runtimeDir))}}
 
 	plan, err := readPlan(*planFile)
 	if err != nil {
@@ -376,9 +447,13 @@ func runService(ctx context.Context, args []string) error {
 		stateDir            = fs.String("state-dir", defaultStateDir, "State directory")
 		pkiDir              = fs.String("pki-dir", defaultPKIDir, "PKI directory")
 		runtimeDir          = fs.String("runtime-dir", defaultRuntimeDir, "Runtime directory")
+		snapshotDir         = fs.String("snapshot-dir", defaultSnapshotDir, "Directory for VM and migration snapshots")
+		rsyncBin            = fs.String("rsync-bin", "rsync", "rsync binary used to transfer migration snapshots")
 		interval            = fs.Duration("heartbeat-interval", defaultInterval, "Heartbeat interval")
+		gzipThreshold       = fs.Int("heartbeat-gzip-threshold", defaultGzipThreshold, "Gzip heartbeat bodies of at least this many bytes (0 disables)")
 		once                = fs.Bool("once", false, "Run one loop then exit")
 		insecure            = fs.Bool("insecure-skip-verify", false, "Skip TLS verification (dev only)")
+		proxy               = fs.String("proxy", "", "Proxy URL for control-plane requests (default: HTTPS_PROXY/NO_PROXY)")
 		netbirdSetupKey     = fs.String("netbird-setup-key", "", "NetBird setup key used on first run")
 		netbirdBin          = fs.String("netbird-bin", "netbird", "NetBird binary")
 		netbirdEnabled      = fs.Bool("netbird-enabled", true, "Enable NetBird connectivity checks")
@@ -394,9 +469,36 @@ func runService(ctx context.Context, args []string) error {
 		providerName        = fs.String("provider", providerAuto, "VM provider: cloud-hypervisor, firecracker, auto")
 		chBin               = fs.String("cloud-hypervisor-bin", "cloud-hypervisor", "Cloud Hypervisor binary")
 		fcBin               = fs.String("firecracker-bin", "firecracker", "Firecracker binary")
+		vmmAPITimeout       = fs.Duration("vmm-api-timeout", 0, "Timeout of one VMM API call such as start or shutdown (0 uses the provider default)")
+		vmmConfigTimeout    = fs.Duration("vmm-configure-timeout", 0, "Timeout of the VMM API socket wait and each boot-source, drive and network setup call at create, Firecracker only (0 uses the default, 30s)")
+		vmCgroupsEnabled    = fs.Bool("vm-cgroups", false, "Limit each VM's VMM process to the VM's vCPUs and memory in a cgroup v2 group (skipped with a warning where cgroup v2 is unavailable)")
+		vmCgroupRoot        = fs.String("vm-cgroup-root", cgroup.DefaultRoot, "Parent cgroup of the per-VM groups")
+		vmCgroupOverhead    = fs.Int("vm-cgroup-memory-overhead", cgroup.DefaultMemoryOverheadMiB, "MiB a VMM may use beyond its guest's memory before the cgroup OOM-kills it")
+		vmmAPIRetries       = fs.Int("vmm-api-retries", 0, "Retries of a VM configuration call after a refused or dropped VMM API connection, Firecracker only (0 uses the default, 3; -1 disables)")
 		metricsAddr         = fs.String("metrics-addr", ":9090", "Metrics server address")
+		pushMetrics         = fs.Bool("push-metrics", false, "Send a compact metrics snapshot (VM counts, heartbeat and action totals, host CPU and memory) with each heartbeat, for hosts the control plane cannot scrape")
+		metadataAddr        = fs.String("metadata-addr", "", "Serve instance metadata and user-data to guests on this address, e.g. "+metadata.DefaultAddr+" (empty disables)")
 		logFormat           = fs.String("log-format", "text", "Log format: json or text")
 		logLevel            = fs.String("log-level", "info", "Log level: debug, info, warn, error")
+		vmWatchdogEnabled   = fs.Bool("vm-watchdog", false, "Restart VMs that should be running but crashed")
+		vmWatchdogBackoff   = fs.Duration("vm-watchdog-backoff", defaultWatchdogBackoff, "Initial delay between watchdog restarts of the same VM (doubles per attempt)")
+		vmWatchdogMax       = fs.Int("vm-watchdog-max-restarts", defaultWatchdogMaxRestarts, "Restarts before the watchdog gives up on a crashing VM")
+		noCommandLog        = fs.Bool("no-command-log", false, "Do not write provider commands to commands.log")
+		commandLogRedact    = fs.String("command-log-redact", "", "Comma-separated extra flag/key names to mask in commands.log")
+		maxDisksPerVM       = fs.Int("max-disks-per-vm", executor.DefaultMaxDisksPerVM, "Maximum extra data disks per VM")
+		maxNICsPerVM        = fs.Int("max-nics-per-vm", executor.DefaultMaxNICsPerVM, "Maximum network interfaces per VM")
+		actionConcurrency   = fs.String("action-concurrency", defaultActionConcurrency, "Comma-separated actionType=limit caps on concurrently running actions; * sets the limit of unlisted types")
+		upgradeCommand      = fs.String("upgrade-command", "", "Shell command run when the control plane requests another agent version (target in NKUDO_TARGET_AGENT_VERSION)")
+		upgradeTimeout      = fs.Duration("upgrade-timeout", defaultUpgradeTimeout, "Timeout for the upgrade command")
+		memoryReserve       = fs.Int("memory-reserve", 0, "MiB of host memory a VM create must leave free, or fail with INSUFFICIENT_RESOURCES (0 disables)")
+		cpuReserve          = fs.Int("cpu-reserve", 0, "CPU cores not taken by VM vCPUs that a VM create must leave free (0 disables)")
+		resultRetryBackoff  = fs.Duration("result-retry-backoff", defaultResultRetryBackoff, "Initial delay before resending a plan result the control plane did not acknowledge (doubles per attempt)")
+		resultMaxAge        = fs.Duration("result-max-age", defaultResultMaxAge, "Drop a plan result the control plane has not acknowledged this long after it was produced (0 retries forever)")
+		actionPreHook       = fs.String("action-pre-hook", "", "Executable run before each action, with the action in NKUDO_* environment variables")
+		actionPostHook      = fs.String("action-post-hook", "", "Executable run after each action, with the action and its outcome in NKUDO_* environment variables")
+		actionHookAllow     = fs.String("action-hook-allowlist", "", "Comma-separated absolute paths action hooks may run")
+		actionHookFail      = fs.Bool("action-hook-fail", false, "Fail the action with HOOK_FAILED when a hook fails; a failing pre-hook keeps the action from running")
+		actionHookTimeout   = fs.Duration("action-hook-timeout", executor.DefaultHookTimeout, "Timeout of one action hook run")
 	)
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -404,6 +506,20 @@ func runService(ctx context.Context, args []string) error {
 	if strings.TrimSpace(*controlPlane) == "" {
 		return errors.New("--control-plane is required")
 	}
+	concurrency, err := executor.ParseConcurrencyLimits(*actionConcurrency)
+	if err != nil {
+		return fmt.Errorf("--action-concurrency: %w", err)
+	}
+	hooks := executor.ActionHooks{
+		Pre:        strings.TrimSpace(*actionPreHook),
+		Post:       strings.TrimSpace(*actionPostHook),
+		Allowed:    splitList(*actionHookAllow),
+		FailAction: *actionHookFail,
+		Timeout:    *actionHookTimeout,
+	}
+	if err := hooks.Validate(); err != nil {
+		return fmt.Errorf("--action-pre-hook/--action-post-hook: %w", err)
+	}
 
 	// Initialize structured logger
 	logger.Init(*logFormat, *logLevel)
@@ -432,13 +548,29 @@ func runService(ctx context.Context, args []string) error {
 	}
 
 	pki := mtls.DefaultPKIPaths(*pkiDir)
-	httpClient, err := mtls.NewMutualTLSClient(pki, *insecure)
+	proxyOpt, err := mtls.WithProxy(strings.TrimSpace(*proxy))
+	if err != nil {
+		return err
+	}
+	certs, err := mtls.NewCertificateReloader(pki, 0)
+	if err != nil {
+		return err
+	}
+	httpClient, err := mtls.NewMutualTLSClient(pki, *insecure, proxyOpt, mtls.WithCertificateReloader(certs))
 	if err != nil {
 		return err
 	}
 
-	cp := &enroll.Client{BaseURL: *controlPlane, HTTP: httpClient}
-	sel, err := selectProvider(*providerName, *chBin, *fcBin, st, *runtimeDir)
+	cp := &enroll.Client{BaseURL: *controlPlane, HTTP: httpClient, HeartbeatGzipThreshold: *gzipThreshold}
+	var vmCgroups *cgroup.Manager
+	if *vmCgroupsEnabled {
+		vmCgroups = &cgroup.Manager{Root: *vmCgroupRoot, MemoryOverheadMiB: *vmCgroupOverhead}
+		if err := vmCgroups.Available(); err != nil {
+			logger.Warnf("VM cgroup limits disabled: %v", err)
+			vmCgroups = nil
+		}
+	}
+	sel, err := selectProvider(*providerName, *chBin, *fcBin, st, *runtimeDir, commandLogOptions{Disabled: *noCommandLog, RedactArgs: splitList(*commandLogRedact)}, vmmAPIOptions{Timeout: *vmmAPITimeout, ConfigureTimeout: *vmmConfigTimeout, Retries: *vmmAPIRetries}, vmCgroups)
 	if err != nil {
 		return err
 	}
@@ -448,11 +580,67 @@ func runService(ctx context.Context, args []string) error {
 	}).Info("Using VM provider")
 
 	nb := netbird.Client{Binary: *netbirdBin}
-	sink := &streamSink{Identity: id, Client: cp}
-	exec := &executor.Executor{Store: st, Provider: sel.Provider, Logs: sink}
+	sink := &streamSink{Identity: id, Client: cp, Local: execlog.New(execlog.DirFor(*runtimeDir))}
+	exec := &executor.Executor{
+		Store:       st,
+		Provider:    sel.Provider,
+		Logs:        sink,
+		Migrations:  &executor.DirMigrationDriver{RuntimeDir: *runtimeDir, SnapshotDir: *snapshotDir, RsyncBinary: *rsyncBin},
+		SnapshotDir: *snapshotDir,
+		Consoles:    cp,
+		DeviceLimits: executor.DeviceLimits{
+			MaxDisks: *maxDisksPerVM,
+			MaxNICs:  *maxNICsPerVM,
+		},
+		Concurrency: concurrency,
+		Reserve: executor.ResourceReserve{
+			MemoryMiB: *memoryReserve,
+			CPUCores:  *cpuReserve,
+		},
+		HostResources: collectHostResources(st),
+		Hooks:         hooks,
+	}
+
+	// peers holds the VM DNS records of the last heartbeat for the
+	// metadata server.
+	peers := &metadata.PeerTable{}
+	if addr := strings.TrimSpace(*metadataAddr); addr != "" {
+		md := &metadata.Server{VMs: st, Peers: peers.Peers}
+		if p, ok := sel.Provider.(interface{ UserData(string) ([]byte, error) }); ok {
+			md.UserData = p.UserData
+		}
+		go func() {
+			logger.WithFields(map[string]interface{}{
+				"address": addr,
+			}).Info("Starting metadata server")
+			if err := http.ListenAndServe(addr, md.Handler()); err != nil {
+				logger.Errorf("Metadata server error: %v", err)
+			}
+		}()
+	}
+
+	var watchdog *vmWatchdog
+	if *vmWatchdogEnabled {
+		watchdog = newVMWatchdog(st, sel.Provider, *vmWatchdogBackoff, *vmWatchdogMax)
+	}
+	upgrader := newAgentUpgrader(*upgradeCommand, version, *upgradeTimeout)
+	reporter := newResultReporter(st, cp.ReportPlanResult, *resultRetryBackoff, *resultMaxAge)
+
+	// A previous run that left its marker behind never sent a final
+	// heartbeat; tell the control plane on the first one of this run.
+	recoveryReason := ""
+	crashed, err := markRunning(*stateDir)
+	if err != nil {
+		return fmt.Errorf("mark agent running: %w", err)
+	}
+	if crashed {
+		logger.Warn("previous agent run ended without a clean shutdown")
+		recoveryReason = model.ShutdownCrashRecovery
+	}
+	upgraded := false
 
 	// Start certificate rotator
-	certRotator := mtls.NewCertRotator(pki, id, cp)
+	certRotator := mtls.NewCertRotator(pki, id, cp, mtls.WithReloader(certs))
 	if err := certRotator.Start(ctx); err != nil {
 		logger.WithFields(map[string]interface{}{
 			"error": err.Error(),
@@ -471,7 +659,9 @@ func runService(ctx context.Context, args []string) error {
 		hbStart := time.Now()
 
 		facts, factsErr := hostfacts.Collect()
+		factsErrMsg := ""
 		if factsErr != nil {
+			factsErrMsg = factsErr.Error()
 			logger.WithFields(map[string]interface{}{
 				"error": factsErr.Error(),
 			}).Warn("hostfacts collection warning")
@@ -511,19 +701,43 @@ func runService(ctx context.Context, args []string) error {
 		nbStatus.State = string(nbSnapshot.State)
 		nbStatus.Reason = nbSnapshot.Reason
 
+		if watchdog != nil {
+			watchdog.check(ctx)
+		}
+
 		// List VMs and update metrics
 		vms, _ := st.ListMicroVMs()
 		updateVMMetrics(vms)
 
+		var pushed map[string]float64
+		if *pushMetrics {
+			pushed = heartbeatMetrics(facts, factsErr)
+		}
+
+		// Without a sequence number the heartbeat is never dropped as stale,
+		// which beats not sending it.
+		hbSeq, seqErr := st.NextHeartbeatSeq()
+		if seqErr != nil {
+			logger.WithFields(map[string]interface{}{
+				"error": seqErr.Error(),
+			}).Warn("heartbeat sequence warning")
+		}
+
 		hbResp, err := cp.Heartbeat(ctx, enroll.HeartbeatRequest{
-			TenantID:      id.TenantID,
-			SiteID:        id.SiteID,
-			HostID:        id.HostID,
-			AgentID:       id.AgentID,
-			SentAt:        time.Now().UTC(),
-			HostFacts:     facts,
-			NetBirdStatus: nbStatus,
-			MicroVMs:      vms,
+			TenantID:       id.TenantID,
+			SiteID:         id.SiteID,
+			HostID:         id.HostID,
+			AgentID:        id.AgentID,
+			AgentVersion:   version,
+			HeartbeatSeq:   hbSeq,
+			SentAt:         time.Now().UTC(),
+			HostFacts:      facts,
+			FactsError:     factsErrMsg,
+			MetricsAddr:    *metricsAddr,
+			NetBirdStatus:  nbStatus,
+			MicroVMs:       vms,
+			ShutdownReason: recoveryReason,
+			Metrics:        pushed,
 		})
 
 		// Record heartbeat metrics
@@ -543,6 +757,42 @@ func runService(ctx context.Context, args []string) error {
 		logger.WithFields(map[string]interface{}{
 			"duration_ms": hbDuration.Milliseconds(),
 		}).Debug("Heartbeat sent successfully")
+		recoveryReason = ""
+
+		// Resend plan results an earlier loop could not deliver.
+		reporter.flush(ctx)
+
+		if hbResp.DNSRecords != nil {
+			peers.Set(metadataPeers(hbResp.DNSRecords))
+		}
+
+		if hbResp.Maintenance {
+			logger.Info("host in maintenance, stopping non-critical VMs")
+			if err := quiesceForMaintenance(ctx, st, sel.Provider); err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error": err.Error(),
+				}).Warn("error stopping VMs for maintenance")
+			}
+		}
+
+		if report, attempted := upgrader.upgrade(ctx, hbResp.TargetAgentVersion); attempted {
+			fields := map[string]interface{}{
+				"current_version": version,
+				"target_version":  report.TargetVersion,
+				"message":         report.Message,
+			}
+			if report.OK {
+				upgraded = true
+				logger.WithFields(fields).Info("agent upgrade command finished")
+			} else {
+				logger.WithFields(fields).Error("agent upgrade failed")
+			}
+			if err := cp.ReportAgentUpgrade(ctx, report); err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error": err.Error(),
+				}).Warn("agent upgrade report warning")
+			}
+		}
 
 		plans := hbResp.PendingPlans
 		if len(plans) == 0 {
@@ -551,21 +801,18 @@ func runService(ctx context.Context, args []string) error {
 			}
 		}
 
-		for _, plan := range plans {
-			if strings.TrimSpace(plan.ExecutionID) == "" {
-				plan.ExecutionID = fmt.Sprintf("exec-%d", time.Now().UTC().UnixNano())
+		for i := range plans {
+			if strings.TrimSpace(plans[i].ExecutionID) == "" {
+				plans[i].ExecutionID = fmt.Sprintf("exec-%d-%d", time.Now().UTC().UnixNano(), i)
 			}
 			logger.WithFields(map[string]interface{}{
-				"execution_id": plan.ExecutionID,
-				"plan_id":      plan.PlanID,
+				"execution_id": plans[i].ExecutionID,
+				"plan_id":      plans[i].PlanID,
 			}).Info("Plan execution started")
-			sink.Write(ctx, executor.LogEntry{ExecutionID: plan.ExecutionID, Level: "INFO", Message: "plan execution started"})
-			res, runErr := exec.ExecutePlan(ctx, plan)
-			if reportErr := cp.ReportPlanResult(ctx, res); reportErr != nil {
-				logger.WithFields(map[string]interface{}{
-					"error": reportErr.Error(),
-				}).Warn("plan result report warning")
-			}
+			sink.Write(ctx, executor.LogEntry{ExecutionID: plans[i].ExecutionID, Level: "INFO", Message: "plan execution started"})
+		}
+		exec.ExecutePlans(ctx, plans, func(plan executor.Plan, res executor.PlanResult, runErr error) {
+			_ = reporter.report(ctx, res)
 			if runErr != nil {
 				logger.WithFields(map[string]interface{}{
 					"execution_id": plan.ExecutionID,
@@ -578,7 +825,7 @@ func runService(ctx context.Context, args []string) error {
 				}).Info("Plan execution finished")
 				sink.Write(ctx, executor.LogEntry{ExecutionID: plan.ExecutionID, Level: "INFO", Message: "plan execution finished"})
 			}
-		}
+		})
 
 		if hbResp.NextHeartbeatSeconds > 0 {
 			*interval = time.Duration(hbResp.NextHeartbeatSeconds) * time.Second
@@ -587,11 +834,18 @@ func runService(ctx context.Context, args []string) error {
 	}
 
 	for {
+		wait := *interval
 		if err := loop(); err != nil {
 			log.Printf("loop error: %v", err)
+			// A busy control plane names a short, jittered delay; honour it
+			// for this round only so the fleet spreads out.
+			var busy *enroll.BusyError
+			if errors.As(err, &busy) {
+				wait = busy.RetryAfter
+			}
 		}
 		if *once {
-			return nil
+			return clearRunning(*stateDir)
 		}
 		select {
 		case <-ctx.Done():
@@ -605,17 +859,37 @@ func runService(ctx context.Context, args []string) error {
 				}).Warn("error stopping VMs during shutdown")
 			}
 
+			// Flush log entries that failed to stream so the last
+			// execution's logs reach the control plane
+			logger.Info("flushing pending logs...")
+			flushCtx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+			if err := sink.Flush(flushCtx); err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error":   err.Error(),
+					"pending": sink.Pending(),
+				}).Warn("failed to flush pending logs")
+			}
+			cancel()
+
 			// Send final heartbeat with shutdown status
-			logger.Info("sending final heartbeat...")
-			if err := sendFinalHeartbeat(context.Background(), cp, id, st, netbird.Status{Connected: false, State: "shutdown", Reason: "agent_shutdown"}); err != nil {
+			reason := shutdownReason(ctx, upgraded)
+			logger.WithFields(map[string]interface{}{
+				"reason": reason,
+			}).Info("sending final heartbeat...")
+			if err := sendFinalHeartbeat(context.Background(), cp, id, st, netbird.Status{Connected: false, State: "shutdown", Reason: "agent_shutdown"}, reason); err != nil {
 				logger.WithFields(map[string]interface{}{
 					"error": err.Error(),
 				}).Warn("failed to send final heartbeat")
 			}
+			if err := clearRunning(*stateDir); err != nil {
+				logger.WithFields(map[string]interface{}{
+					"error": err.Error(),
+				}).Warn("failed to clear running marker")
+			}
 
 			logger.Info("graceful shutdown complete")
 			return nil
-		case <-time.After(*interval):
+		case <-time.After(wait):
 		}
 	}
 }
@@ -721,23 +995,49 @@ func runtimeArch() string {
 	return facts.Arch
 }
 
-type stdoutSink struct{}
+type stdoutSink struct {
+	Local *execlog.Store
+}
 
-func (s *stdoutSink) Write(_ context.Context, entry executor.LogEntry) {
+func (s *stdoutSink) Write(ctx context.Context, entry executor.LogEntry) {
 	log.Printf("execution=%s action=%s level=%s msg=%s", entry.ExecutionID, entry.ActionID, entry.Level, entry.Message)
+	if s.Local != nil {
+		s.Local.Write(ctx, entry)
+	}
+}
+
+// logStreamer sends a log entry to the control plane.
+type logStreamer interface {
+	StreamLog(ctx context.Context, entry enroll.LogEntry) error
 }
 
+// streamSink streams execution logs to the control plane. Entries that fail
+// to stream are kept, up to maxPendingLogs, and sent again after the next
+// successful write or by Flush.
 type streamSink struct {
 	Identity state.Identity
-	Client   *enroll.Client
+	Client   logStreamer
+	Local    *execlog.Store
+
+	mu      sync.Mutex
+	pending []enroll.LogEntry
+	// head numbers pending[0] among all entries ever queued, so a flush
+	// can drop what it sent even when enqueue trimmed the queue meanwhile.
+	head uint64
+
+	// flushMu serializes flushes so no entry is sent twice.
+	flushMu sync.Mutex
 }
 
 func (s *streamSink) Write(ctx context.Context, entry executor.LogEntry) {
 	log.Printf("execution=%s action=%s level=%s msg=%s", entry.ExecutionID, entry.ActionID, entry.Level, entry.Message)
+	if s.Local != nil {
+		s.Local.Write(ctx, entry)
+	}
 	if s.Client == nil {
 		return
 	}
-	err := s.Client.StreamLog(ctx, enroll.LogEntry{
+	out := enroll.LogEntry{
 		TenantID:    s.Identity.TenantID,
 		SiteID:      s.Identity.SiteID,
 		AgentID:     s.Identity.AgentID,
@@ -745,10 +1045,89 @@ func (s *streamSink) Write(ctx context.Context, entry executor.LogEntry) {
 		ActionID:    entry.ActionID,
 		Level:       strings.ToUpper(entry.Level),
 		Message:     entry.Message,
-	})
-	if err != nil {
+		EmittedAt:   time.Now().UTC(),
+	}
+	// Behind pending entries the entry queues up so entries reach the
+	// control plane in the order they were written.
+	if s.Pending() > 0 {
+		s.enqueue(out)
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("log stream warning: %v", err)
+		}
+		return
+	}
+	if err := s.Client.StreamLog(ctx, out); err != nil {
 		log.Printf("log stream warning: %v", err)
+		s.enqueue(out)
+	}
+}
+
+func (s *streamSink) enqueue(entry enroll.LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, entry)
+	if over := len(s.pending) - maxPendingLogs; over > 0 {
+		s.pending = s.pending[over:]
+		s.head += uint64(over)
+	}
+}
+
+// Pending returns the number of entries waiting to be streamed.
+func (s *streamSink) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Flush streams pending entries in order. It stops at the first failure
+// and keeps that entry and the ones after it. Entries are sent from a
+// snapshot taken under the lock, so writers are not blocked on the network.
+func (s *streamSink) Flush(ctx context.Context) error {
+	if s.Client == nil {
+		return nil
+	}
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	for {
+		s.mu.Lock()
+		batch := append([]enroll.LogEntry(nil), s.pending...)
+		head := s.head
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		sent := 0
+		var err error
+		for _, entry := range batch {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if err = s.Client.StreamLog(ctx, entry); err != nil {
+				err = fmt.Errorf("flush %d pending log entries: %w", len(batch)-sent, err)
+				break
+			}
+			sent++
+		}
+		s.drop(head + uint64(sent))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drop removes the pending entries numbered below next.
+func (s *streamSink) drop(next uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if next <= s.head {
+		return
 	}
+	n := next - s.head
+	if n > uint64(len(s.pending)) {
+		n = uint64(len(s.pending))
+	}
+	s.pending = s.pending[n:]
+	s.head += n
 }
 
 func ensurePath(base, child string) string {
@@ -769,19 +1148,141 @@ func splitCommand(raw string) []string {
 	return strings.Fields(trimmed)
 }
 
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// stopPriorityLabel is the VM label that orders graceful shutdown. VMs with a
+// higher value are stopped before VMs with a lower one.
+const stopPriorityLabel = "stop_priority"
+
+// criticalLabel marks VMs that keep running while their host is in
+// maintenance mode.
+const criticalLabel = "critical"
+
 func stopAllVMsGracefully(ctx context.Context, st StateStore, provider executor.MicroVMProvider) error {
 	vms, err := st.ListMicroVMs()
 	if err != nil {
 		return fmt.Errorf("list VMs: %w", err)
 	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(vms))
+	var errs []error
+	for _, batch := range stopBatches(vms) {
+		_, batchErrs := stopVMBatch(ctx, provider, batch)
+		errs = append(errs, batchErrs...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("errors stopping VMs: %v", errs)
+	}
+	return nil
+}
+
+// quiesceForMaintenance stops running VMs that are not labelled critical,
+// in stop_priority order, and records them as stopped so later heartbeats
+// do not stop them again.
+func quiesceForMaintenance(ctx context.Context, st StateStore, provider executor.MicroVMProvider) error {
+	vms, err := st.ListMicroVMs()
+	if err != nil {
+		return fmt.Errorf("list VMs: %w", err)
+	}
+	nonCritical := make([]state.MicroVM, 0, len(vms))
+	byID := make(map[string]state.MicroVM, len(vms))
+	for _, vm := range vms {
+		if isCriticalVM(vm) {
+			continue
+		}
+		nonCritical = append(nonCritical, vm)
+		byID[vm.ID] = vm
+	}
+
+	var errs []error
+	for _, batch := range stopBatches(nonCritical) {
+		stopped, batchErrs := stopVMBatch(ctx, provider, batch)
+		errs = append(errs, batchErrs...)
+		for _, vmID := range stopped {
+			vm := byID[vmID]
+			vm.Status = "STOPPED"
+			vm.DesiredStatus = "STOPPED"
+			vm.UpdatedAt = time.Now().UTC()
+			if err := st.UpsertMicroVM(vm); err != nil {
+				errs = append(errs, fmt.Errorf("update VM %s: %w", vmID, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("errors stopping VMs: %v", errs)
+	}
+	return nil
+}
+
+func isCriticalVM(vm state.MicroVM) bool {
+	critical, err := strconv.ParseBool(strings.TrimSpace(vm.Labels[criticalLabel]))
+	return err == nil && critical
+}
 
+// stopBatches groups running VMs into ordered shutdown batches. Prioritized VMs
+// come first, highest priority first; VMs without a valid stop_priority label
+// form the final batch.
+func stopBatches(vms []state.MicroVM) [][]string {
+	byPriority := make(map[int][]string)
+	var priorities []int
+	var unprioritized []string
 	for _, vm := range vms {
-		if vm.Status != "running" {
+		if !strings.EqualFold(vm.Status, "running") {
 			continue
 		}
+		priority, ok := vmStopPriority(vm)
+		if !ok {
+			unprioritized = append(unprioritized, vm.ID)
+			continue
+		}
+		if _, seen := byPriority[priority]; !seen {
+			priorities = append(priorities, priority)
+		}
+		byPriority[priority] = append(byPriority[priority], vm.ID)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	batches := make([][]string, 0, len(priorities)+1)
+	for _, priority := range priorities {
+		batches = append(batches, byPriority[priority])
+	}
+	if len(unprioritized) > 0 {
+		batches = append(batches, unprioritized)
+	}
+	return batches
+}
+
+func vmStopPriority(vm state.MicroVM) (int, bool) {
+	raw, ok := vm.Labels[stopPriorityLabel]
+	if !ok {
+		return 0, false
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		logger.WithFields(map[string]interface{}{
+			"vm_id": vm.ID,
+			"value": raw,
+		}).Warn("ignoring invalid stop_priority label")
+		return 0, false
+	}
+	return priority, true
+}
+
+// stopVMBatch stops every VM in the batch concurrently and waits for all of
+// them. It returns the IDs that stopped cleanly and the errors for the rest.
+func stopVMBatch(ctx context.Context, provider executor.MicroVMProvider, vmIDs []string) ([]string, []error) {
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(vmIDs))
+	stoppedCh := make(chan string, len(vmIDs))
+
+	for _, vmID := range vmIDs {
 		wg.Add(1)
 		go func(vmID string) {
 			defer wg.Done()
@@ -790,40 +1291,56 @@ func stopAllVMsGracefully(ctx context.Context, st StateStore, provider executor.
 			}).Info("stopping VM gracefully")
 			if err := provider.Stop(ctx, vmID); err != nil {
 				errCh <- fmt.Errorf("stop VM %s: %w", vmID, err)
+				return
 			}
-		}(vm.ID)
+			stoppedCh <- vmID
+		}(vmID)
 	}
 
 	wg.Wait()
 	close(errCh)
+	close(stoppedCh)
 
+	var stopped []string
+	for vmID := range stoppedCh {
+		stopped = append(stopped, vmID)
+	}
 	var errs []error
 	for err := range errCh {
 		errs = append(errs, err)
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("errors stopping VMs: %v", errs)
+	return stopped, errs
+}
+
+// metadataPeers converts heartbeat DNS records to metadata server peers.
+func metadataPeers(records []enroll.DNSRecord) []metadata.Peer {
+	peers := make([]metadata.Peer, 0, len(records))
+	for _, r := range records {
+		peers = append(peers, metadata.Peer{NetworkID: r.NetworkID, VMID: r.VMID, Hostname: r.Hostname, IPAddress: r.IPAddress})
 	}
-	return nil
+	return peers
 }
 
-func sendFinalHeartbeat(ctx context.Context, cp *enroll.Client, id state.Identity, st StateStore, lastNBStatus netbird.Status) error {
+func sendFinalHeartbeat(ctx context.Context, cp *enroll.Client, id state.Identity, st StateStore, lastNBStatus netbird.Status, reason string) error {
 	vms, _ := st.ListMicroVMs()
+	seq, _ := st.NextHeartbeatSeq()
 
 	hbReq := enroll.HeartbeatRequest{
-		TenantID:  id.TenantID,
-		SiteID:    id.SiteID,
-		HostID:    id.HostID,
-		AgentID:   id.AgentID,
-		SentAt:    time.Now().UTC(),
-		HostFacts: hostfacts.Facts{OSType: runtimeOS(), Arch: runtimeArch()},
+		TenantID:     id.TenantID,
+		SiteID:       id.SiteID,
+		HostID:       id.HostID,
+		AgentID:      id.AgentID,
+		HeartbeatSeq: seq,
+		SentAt:       time.Now().UTC(),
+		HostFacts:    hostfacts.Facts{OSType: runtimeOS(), Arch: runtimeArch()},
 		NetBirdStatus: netbird.Status{
 			Connected: lastNBStatus.Connected,
 			State:     string(lastNBStatus.State),
 			Reason:    "agent_shutdown",
 		},
-		MicroVMs: vms,
-		Shutdown: true,
+		MicroVMs:       vms,
+		Shutdown:       true,
+		ShutdownReason: reason,
 	}
 
 	_, err := cp.Heartbeat(ctx, hbReq)
@@ -852,3 +1369,21 @@ func updateVMMetrics(vms []state.MicroVM) {
 	metrics.VMsTotal.WithLabelValues("running").Set(float64(runningCount))
 	metrics.VMsTotal.WithLabelValues("stopped").Set(float64(stoppedCount))
 }
+
+// heartbeatMetrics is the metrics snapshot pushed with a heartbeat: the
+// agent's own metrics plus the host's CPU and memory from facts.
+func heartbeatMetrics(facts hostfacts.Facts, factsErr error) map[string]float64 {
+	snapshot, err := metrics.Snapshot(prometheus.DefaultGatherer)
+	if err != nil {
+		logger.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Warn("metrics snapshot warning")
+		snapshot = map[string]float64{}
+	}
+	if factsErr == nil {
+		snapshot["host_cpu_cores"] = float64(facts.CPUCores)
+		snapshot["host_memory_total_bytes"] = float64(facts.MemoryTotal)
+		snapshot["host_memory_free_bytes"] = float64(facts.MemoryFree)
+	}
+	return snapshot
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/kubedoio/n-kudo/internal/edge/cmd"
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
 )
 
 func TestUsage(t *testing.T) {
@@ -20,6 +27,7 @@ func TestCommandHelpTexts(t *testing.T) {
 		{"check", cmd.CheckHelp},
 		{"unenroll", cmd.UnenrollHelp},
 		{"renew", cmd.RenewHelp},
+		{"logs", cmd.LogsHelp},
 	}
 
 	for _, tt := range tests {
@@ -120,3 +128,219 @@ func TestRunRenew_NotEnrolled(t *testing.T) {
 		t.Error("Expected error when running renew without enrollment")
 	}
 }
+
+type recordingProvider struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+func (p *recordingProvider) Create(ctx context.Context, params executor.MicroVMParams) error {
+	return nil
+}
+func (p *recordingProvider) Start(ctx context.Context, vmID string) error { return nil }
+func (p *recordingProvider) Stop(ctx context.Context, vmID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = append(p.stopped, vmID)
+	return nil
+}
+func (p *recordingProvider) Delete(ctx context.Context, vmID string) error { return nil }
+func (p *recordingProvider) GetProcessID(ctx context.Context, vmID string) (int, error) {
+	return 0, nil
+}
+func (p *recordingProvider) Capabilities() []string { return executor.AllCapabilities() }
+
+func TestStopAllVMsGracefully_RespectsStopPriority(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state: %v", err)
+	}
+	defer st.Close()
+
+	vms := []state.MicroVM{
+		{ID: "db", Status: "RUNNING", Labels: map[string]string{"stop_priority": "10"}},
+		{ID: "app-1", Status: "RUNNING", Labels: map[string]string{"stop_priority": "100"}},
+		{ID: "app-2", Status: "RUNNING", Labels: map[string]string{"stop_priority": "100"}},
+		{ID: "cache", Status: "RUNNING", Labels: map[string]string{"stop_priority": "50"}},
+		{ID: "misc", Status: "RUNNING"},
+		{ID: "bad-label", Status: "RUNNING", Labels: map[string]string{"stop_priority": "high"}},
+		{ID: "idle", Status: "STOPPED", Labels: map[string]string{"stop_priority": "1000"}},
+	}
+	for _, vm := range vms {
+		if err := st.UpsertMicroVM(vm); err != nil {
+			t.Fatalf("upsert %s: %v", vm.ID, err)
+		}
+	}
+
+	provider := &recordingProvider{}
+	if err := stopAllVMsGracefully(context.Background(), st, provider); err != nil {
+		t.Fatalf("stopAllVMsGracefully: %v", err)
+	}
+
+	position := make(map[string]int, len(provider.stopped))
+	for i, id := range provider.stopped {
+		position[id] = i
+	}
+	if len(provider.stopped) != 6 {
+		t.Fatalf("expected 6 stopped VMs, got %v", provider.stopped)
+	}
+	if _, ok := position["idle"]; ok {
+		t.Fatalf("stopped VM should not be stopped again: %v", provider.stopped)
+	}
+
+	before := [][2]string{
+		{"app-1", "cache"},
+		{"app-2", "cache"},
+		{"cache", "db"},
+		{"db", "misc"},
+		{"db", "bad-label"},
+	}
+	for _, pair := range before {
+		if position[pair[0]] > position[pair[1]] {
+			t.Errorf("expected %s to stop before %s, got order %v", pair[0], pair[1], provider.stopped)
+		}
+	}
+}
+
+func TestStopBatches_WithoutPrioritiesIsSingleBatch(t *testing.T) {
+	batches := stopBatches([]state.MicroVM{
+		{ID: "a", Status: "running"},
+		{ID: "b", Status: "RUNNING"},
+	})
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected one concurrent batch of 2 VMs, got %v", batches)
+	}
+}
+
+func TestQuiesceForMaintenance_KeepsCriticalVMs(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state: %v", err)
+	}
+	defer st.Close()
+
+	vms := []state.MicroVM{
+		{ID: "db", Status: "RUNNING", Labels: map[string]string{"critical": "true"}},
+		{ID: "app", Status: "RUNNING"},
+		{ID: "batch", Status: "RUNNING", Labels: map[string]string{"critical": "false"}},
+	}
+	for _, vm := range vms {
+		if err := st.UpsertMicroVM(vm); err != nil {
+			t.Fatalf("upsert %s: %v", vm.ID, err)
+		}
+	}
+
+	provider := &recordingProvider{}
+	if err := quiesceForMaintenance(context.Background(), st, provider); err != nil {
+		t.Fatalf("quiesceForMaintenance: %v", err)
+	}
+	if len(provider.stopped) != 2 {
+		t.Fatalf("expected 2 stopped VMs, got %v", provider.stopped)
+	}
+	for _, id := range provider.stopped {
+		if id == "db" {
+			t.Fatalf("critical VM was stopped: %v", provider.stopped)
+		}
+	}
+	if vm, _, _ := st.GetMicroVM("app"); vm.Status != "STOPPED" {
+		t.Fatalf("expected app recorded as STOPPED, got %q", vm.Status)
+	}
+
+	provider.stopped = nil
+	if err := quiesceForMaintenance(context.Background(), st, provider); err != nil {
+		t.Fatalf("second quiesceForMaintenance: %v", err)
+	}
+	if len(provider.stopped) != 0 {
+		t.Fatalf("expected no VMs stopped again, got %v", provider.stopped)
+	}
+}
+
+type flakyStreamer struct {
+	fail bool
+	sent []enroll.LogEntry
+}
+
+func (f *flakyStreamer) StreamLog(_ context.Context, entry enroll.LogEntry) error {
+	if f.fail {
+		return errors.New("control plane unavailable")
+	}
+	f.sent = append(f.sent, entry)
+	return nil
+}
+
+func TestStreamSink_FlushSendsPendingLogs(t *testing.T) {
+	streamer := &flakyStreamer{fail: true}
+	sink := &streamSink{Identity: state.Identity{AgentID: "agent-1"}, Client: streamer}
+
+	sink.Write(context.Background(), executor.LogEntry{ExecutionID: "exec-1", Level: "info", Message: "starting"})
+	sink.Write(context.Background(), executor.LogEntry{ExecutionID: "exec-1", Level: "error", Message: "boot failed"})
+	if sink.Pending() != 2 {
+		t.Fatalf("expected 2 pending entries, got %d", sink.Pending())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+	defer cancel()
+	if err := sink.Flush(ctx); err == nil {
+		t.Fatal("expected flush to fail while the control plane is unavailable")
+	}
+	if sink.Pending() != 2 {
+		t.Fatalf("failed flush must keep entries, got %d pending", sink.Pending())
+	}
+
+	streamer.fail = false
+	if err := sink.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if sink.Pending() != 0 {
+		t.Fatalf("expected no pending entries after flush, got %d", sink.Pending())
+	}
+	if len(streamer.sent) != 2 || streamer.sent[0].Message != "starting" || streamer.sent[1].Message != "boot failed" {
+		t.Fatalf("expected pending logs flushed in order, got %+v", streamer.sent)
+	}
+	if streamer.sent[1].Level != "ERROR" || streamer.sent[1].AgentID != "agent-1" || streamer.sent[1].EmittedAt.IsZero() {
+		t.Fatalf("unexpected flushed entry: %+v", streamer.sent[1])
+	}
+}
+
+func TestStreamSink_WriteKeepsOrderBehindPendingLogs(t *testing.T) {
+	streamer := &flakyStreamer{fail: true}
+	sink := &streamSink{Client: streamer}
+
+	sink.Write(context.Background(), executor.LogEntry{ExecutionID: "exec-1", Message: "first"})
+	streamer.fail = false
+	sink.Write(context.Background(), executor.LogEntry{ExecutionID: "exec-1", Message: "second"})
+
+	if sink.Pending() != 0 {
+		t.Fatalf("expected no pending entries, got %d", sink.Pending())
+	}
+	if len(streamer.sent) != 2 || streamer.sent[0].Message != "first" || streamer.sent[1].Message != "second" {
+		t.Fatalf("expected entries in write order, got %+v", streamer.sent)
+	}
+}
+
+func TestStreamSink_FlushStopsAtTimeout(t *testing.T) {
+	sink := &streamSink{Client: &flakyStreamer{}}
+	sink.enqueue(enroll.LogEntry{ExecutionID: "exec-1", Message: "late"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sink.Flush(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+	if sink.Pending() != 1 {
+		t.Fatalf("expected the entry to stay pending, got %d", sink.Pending())
+	}
+}
+
+func TestStreamSink_PendingIsBounded(t *testing.T) {
+	sink := &streamSink{Client: &flakyStreamer{fail: true}}
+	for i := 0; i < maxPendingLogs+10; i++ {
+		sink.Write(context.Background(), executor.LogEntry{ExecutionID: "exec-1", Message: strconv.Itoa(i)})
+	}
+	if sink.Pending() != maxPendingLogs {
+		t.Fatalf("expected %d pending entries, got %d", maxPendingLogs, sink.Pending())
+	}
+	if sink.pending[0].Message != "10" {
+		t.Fatalf("expected the oldest entries to be dropped, first is %q", sink.pending[0].Message)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/hostfacts"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// hostResources returns what the host has left for new VMs. Free memory is
+// the host's available memory less the memory of VMs that are not running
+// yet, which will claim it once started. Free CPU is the host's cores less
+// the vCPUs of every VM on it.
+func hostResources(facts hostfacts.Facts, vms []state.MicroVM) executor.HostResources {
+	res := executor.HostResources{
+		FreeMemoryMiB: int(facts.MemoryFree >> 20),
+		FreeCPUCores:  facts.CPUCores,
+	}
+	for _, vm := range vms {
+		res.FreeCPUCores -= vm.VCPU
+		if vm.Status != "RUNNING" {
+			res.FreeMemoryMiB -= vm.MemoryMiB
+		}
+	}
+	return res
+}
+
+// collectHostResources reads host facts and the VMs in st for admission
+// control of CREATEs.
+func collectHostResources(st StateStore) func() (executor.HostResources, error) {
+	return func() (executor.HostResources, error) {
+		facts, err := hostfacts.Collect()
+		if facts.MemoryTotal == 0 && err != nil {
+			return executor.HostResources{}, err
+		}
+		vms, err := st.ListMicroVMs()
+		if err != nil {
+			return executor.HostResources{}, err
+		}
+		return hostResources(facts, vms), nil
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/hostfacts"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestHostResourcesCountsVMsNotYetRunning(t *testing.T) {
+	facts := hostfacts.Facts{CPUCores: 16, MemoryFree: 8 << 30}
+	vms := []state.MicroVM{
+		// Running: its memory is already gone from MemAvailable.
+		{ID: "vm-running", Status: "RUNNING", VCPU: 4, MemoryMiB: 2048},
+		{ID: "vm-created", Status: "CREATED", VCPU: 2, MemoryMiB: 1024},
+		{ID: "vm-stopped", Status: "STOPPED", VCPU: 1, MemoryMiB: 512},
+	}
+	got := hostResources(facts, vms)
+	want := executor.HostResources{FreeMemoryMiB: 8192 - 1024 - 512, FreeCPUCores: 16 - 4 - 2 - 1}
+	if got != want {
+		t.Fatalf("hostResources = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+const (
+	defaultResultRetryBackoff = 5 * time.Second
+	maxResultRetryBackoff     = 5 * time.Minute
+	defaultResultMaxAge       = 24 * time.Hour
+)
+
+// pendingResultStore keeps plan results until the control plane has
+// acknowledged them.
+type pendingResultStore interface {
+	PutPendingResult(result state.PendingResult) error
+	ListPendingResults() ([]state.PendingResult, error)
+	DeletePendingResult(executionID string) error
+}
+
+// resultReporter delivers plan results to the control plane. A result is
+// persisted before it is sent and only forgotten once the send succeeded,
+// so results survive network blips and agent restarts. Failed sends are
+// retried by flush with exponential backoff until the result is maxAge
+// old; a result the control plane rejects with a 4xx other than 408 and
+// 429 is dropped at once, as resending it cannot succeed.
+type resultReporter struct {
+	store      pendingResultStore
+	send       func(ctx context.Context, result executor.PlanResult) error
+	backoff    time.Duration
+	maxBackoff time.Duration
+	maxAge     time.Duration // 0 retries forever
+	now        func() time.Time
+}
+
+func newResultReporter(st pendingResultStore, send func(context.Context, executor.PlanResult) error, backoff, maxAge time.Duration) *resultReporter {
+	if backoff <= 0 {
+		backoff = defaultResultRetryBackoff
+	}
+	return &resultReporter{
+		store:      st,
+		send:       send,
+		backoff:    backoff,
+		maxBackoff: maxResultRetryBackoff,
+		maxAge:     maxAge,
+		now:        time.Now,
+	}
+}
+
+// report sends a plan result, keeping it for flush to retry when the send
+// fails. Each action result gets an idempotency token that is persisted
+// with it, so the control plane ignores the resends it already applied.
+func (r *resultReporter) report(ctx context.Context, result executor.PlanResult) error {
+	result.Results = append([]executor.ActionResult(nil), result.Results...)
+	for i := range result.Results {
+		if result.Results[i].IdempotencyToken == "" {
+			result.Results[i].IdempotencyToken = uuid.NewString()
+		}
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	pending := state.PendingResult{
+		ExecutionID: result.ExecutionID,
+		Payload:     payload,
+		CreatedAt:   r.now().UTC(),
+	}
+	if err := r.store.PutPendingResult(pending); err != nil {
+		logger.WithFields(map[string]interface{}{
+			"execution_id": result.ExecutionID,
+			"error":        err.Error(),
+		}).Warn("Failed to persist plan result")
+	}
+	return r.attempt(ctx, pending, result)
+}
+
+// flush resends the persisted results whose retry is due. It returns the
+// number of results delivered.
+func (r *resultReporter) flush(ctx context.Context) int {
+	pending, err := r.store.ListPendingResults()
+	if err != nil {
+		logger.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Warn("Failed to list pending plan results")
+		return 0
+	}
+	now := r.now()
+	delivered := 0
+	for _, p := range pending {
+		if now.Before(p.NextAttemptAt) {
+			continue
+		}
+		var result executor.PlanResult
+		if err := json.Unmarshal(p.Payload, &result); err != nil {
+			logger.WithFields(map[string]interface{}{
+				"execution_id": p.ExecutionID,
+				"error":        err.Error(),
+			}).Warn("Dropping unreadable pending plan result")
+			_ = r.store.DeletePendingResult(p.ExecutionID)
+			continue
+		}
+		if r.attempt(ctx, p, result) == nil {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+func (r *resultReporter) attempt(ctx context.Context, pending state.PendingResult, result executor.PlanResult) error {
+	sendErr := r.send(ctx, result)
+	if sendErr == nil {
+		if err := r.store.DeletePendingResult(pending.ExecutionID); err != nil {
+			logger.WithFields(map[string]interface{}{
+				"execution_id": pending.ExecutionID,
+				"error":        err.Error(),
+			}).Warn("Failed to forget delivered plan result")
+		}
+		return nil
+	}
+
+	pending.Attempts++
+	if enroll.Rejected(sendErr) {
+		r.drop(pending, sendErr, "Dropping plan result the control plane rejected")
+		return sendErr
+	}
+	if r.maxAge > 0 && r.now().Sub(pending.CreatedAt) >= r.maxAge {
+		r.drop(pending, sendErr, "Dropping plan result past its maximum age")
+		return sendErr
+	}
+	pending.LastError = sendErr.Error()
+	pending.NextAttemptAt = r.now().Add(r.retryDelay(pending.Attempts))
+	if err := r.store.PutPendingResult(pending); err != nil {
+		logger.WithFields(map[string]interface{}{
+			"execution_id": pending.ExecutionID,
+			"error":        err.Error(),
+		}).Warn("Failed to persist plan result")
+	}
+	logger.WithFields(map[string]interface{}{
+		"execution_id": pending.ExecutionID,
+		"attempts":     pending.Attempts,
+		"retry_at":     pending.NextAttemptAt.UTC().Format(time.RFC3339),
+		"error":        sendErr.Error(),
+	}).Warn("plan result report warning")
+	return sendErr
+}
+
+// drop forgets a result that will not be resent.
+func (r *resultReporter) drop(pending state.PendingResult, sendErr error, msg string) {
+	if err := r.store.DeletePendingResult(pending.ExecutionID); err != nil {
+		logger.WithFields(map[string]interface{}{
+			"execution_id": pending.ExecutionID,
+			"error":        err.Error(),
+		}).Warn("Failed to forget dropped plan result")
+	}
+	logger.WithFields(map[string]interface{}{
+		"execution_id": pending.ExecutionID,
+		"attempts":     pending.Attempts,
+		"error":        sendErr.Error(),
+	}).Warn(msg)
+}
+
+// retryDelay doubles the backoff per failed attempt, capped at maxBackoff.
+func (r *resultReporter) retryDelay(attempts int) time.Duration {
+	delay := r.backoff
+	for i := 1; i < attempts && delay < r.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.maxBackoff {
+		delay = r.maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestResultReporterRetriesUntilDelivered(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	var delivered []executor.PlanResult
+	var tokens []string
+	failures := 2
+	send := func(_ context.Context, res executor.PlanResult) error {
+		tokens = append(tokens, res.Results[0].IdempotencyToken)
+		if failures > 0 {
+			failures--
+			return errors.New("connection reset by peer")
+		}
+		delivered = append(delivered, res)
+		return nil
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newResultReporter(st, send, time.Second, 0)
+	r.now = func() time.Time { return now }
+
+	res := executor.PlanResult{PlanID: "plan-1", ExecutionID: "exec-1", Results: []executor.ActionResult{{ActionID: "a1", OK: true}}}
+	if err := r.report(context.Background(), res); err == nil {
+		t.Fatal("expected the first report to fail")
+	}
+	pending, _ := st.ListPendingResults()
+	if len(pending) != 1 || pending[0].Attempts != 1 || !pending[0].NextAttemptAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected the result to be kept for a retry in 1s, got %+v", pending)
+	}
+
+	// Not due yet.
+	if n := r.flush(context.Background()); n != 0 || failures != 1 {
+		t.Fatalf("expected no resend before the backoff elapsed, delivered %d", n)
+	}
+
+	now = now.Add(time.Second)
+	if n := r.flush(context.Background()); n != 0 {
+		t.Fatalf("expected the second attempt to fail, delivered %d", n)
+	}
+	pending, _ = st.ListPendingResults()
+	if len(pending) != 1 || pending[0].Attempts != 2 || !pending[0].NextAttemptAt.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("expected the backoff to double, got %+v", pending)
+	}
+
+	now = now.Add(2 * time.Second)
+	if n := r.flush(context.Background()); n != 1 {
+		t.Fatalf("expected the result to be delivered, delivered %d", n)
+	}
+	if len(delivered) != 1 || delivered[0].PlanID != "plan-1" || len(delivered[0].Results) != 1 || delivered[0].Results[0].ActionID != "a1" {
+		t.Fatalf("unexpected delivered results %+v", delivered)
+	}
+	if pending, _ = st.ListPendingResults(); len(pending) != 0 {
+		t.Fatalf("expected the delivered result to be forgotten, got %+v", pending)
+	}
+	// Every resend carries the token of the first attempt.
+	if len(tokens) != 3 || tokens[0] == "" || tokens[1] != tokens[0] || tokens[2] != tokens[0] {
+		t.Fatalf("expected one idempotency token across attempts, got %q", tokens)
+	}
+}
+
+func TestResultReporterSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	st, err := state.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := newResultReporter(st, func(context.Context, executor.PlanResult) error { return errors.New("unreachable") }, time.Millisecond, 0)
+	_ = failing.report(context.Background(), executor.PlanResult{PlanID: "plan-1", ExecutionID: "exec-1"})
+	st.Close()
+
+	st, err = state.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var delivered []string
+	r := newResultReporter(st, func(_ context.Context, res executor.PlanResult) error {
+		delivered = append(delivered, res.ExecutionID)
+		return nil
+	}, time.Millisecond, 0)
+	r.now = func() time.Time { return time.Now().Add(time.Second) }
+	if n := r.flush(context.Background()); n != 1 || len(delivered) != 1 || delivered[0] != "exec-1" {
+		t.Fatalf("expected the persisted result to be delivered after a restart, got %v", delivered)
+	}
+}
+
+func TestResultReporterDropsRejectedAndExpiredResults(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	sendErr := error(&enroll.StatusError{Path: "/v1/executions/result", StatusCode: http.StatusConflict})
+	r := newResultReporter(st, func(context.Context, executor.PlanResult) error { return sendErr }, time.Millisecond, time.Hour)
+	if err := r.report(context.Background(), executor.PlanResult{PlanID: "plan-1", ExecutionID: "exec-1"}); err == nil {
+		t.Fatal("expected the rejected report to fail")
+	}
+	if pending, _ := st.ListPendingResults(); len(pending) != 0 {
+		t.Fatalf("expected a rejected result to be dropped, got %+v", pending)
+	}
+
+	// Throttling is retried, until the result is too old.
+	sendErr = &enroll.StatusError{Path: "/v1/executions/result", StatusCode: http.StatusTooManyRequests}
+	_ = r.report(context.Background(), executor.PlanResult{PlanID: "plan-2", ExecutionID: "exec-2"})
+	if pending, _ := st.ListPendingResults(); len(pending) != 1 {
+		t.Fatalf("expected a throttled result to be kept, got %+v", pending)
+	}
+	r.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n := r.flush(context.Background()); n != 0 {
+		t.Fatalf("expected nothing delivered, got %d", n)
+	}
+	if pending, _ := st.ListPendingResults(); len(pending) != 0 {
+		t.Fatalf("expected a result past its maximum age to be dropped, got %+v", pending)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// runningMarker is kept in the state directory while the agent runs.
+// Finding it at startup means the previous run ended without a final
+// heartbeat, which the agent reports as crash recovery.
+const runningMarker = "agent.running"
+
+// shutdownSignal is the cancel cause of the service context.
+type shutdownSignal struct {
+	sig os.Signal
+}
+
+func (s shutdownSignal) Error() string {
+	return "received " + s.sig.String()
+}
+
+// notifyShutdown returns a context cancelled on SIGINT, SIGTERM or SIGHUP.
+// The signal is kept as the cancel cause so shutdownReason can tell a
+// reload (SIGHUP, after which the service manager restarts the agent with
+// its new configuration) from a stop.
+func notifyShutdown(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		select {
+		case sig := <-ch:
+			cancel(shutdownSignal{sig: sig})
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel(context.Canceled)
+	}
+}
+
+// shutdownReason is the reason sent on the final heartbeat once ctx is
+// done. An agent whose upgrade hook succeeded is being restarted onto the
+// new version, whatever signal the hook used to do it.
+func shutdownReason(ctx context.Context, upgraded bool) string {
+	if upgraded {
+		return model.ShutdownUpgrade
+	}
+	var s shutdownSignal
+	if errors.As(context.Cause(ctx), &s) && s.sig == syscall.SIGHUP {
+		return model.ShutdownConfigReload
+	}
+	return model.ShutdownSignal
+}
+
+// markRunning writes the running marker to dir and reports whether the
+// previous run left one behind.
+func markRunning(dir string) (crashed bool, err error) {
+	path := filepath.Join(dir, runningMarker)
+	if _, err := os.Stat(path); err == nil {
+		crashed = true
+	}
+	return crashed, os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0o600)
+}
+
+// clearRunning removes the running marker after a clean exit.
+func clearRunning(dir string) error {
+	err := os.Remove(filepath.Join(dir, runningMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
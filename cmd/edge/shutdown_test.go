@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/netbird"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+func TestShutdownTriggersReportDistinctReasons(t *testing.T) {
+	stopped := func(sig syscall.Signal) context.Context {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(shutdownSignal{sig: sig})
+		return ctx
+	}
+	cases := []struct {
+		name     string
+		ctx      context.Context
+		upgraded bool
+		want     string
+	}{
+		{"sigterm", stopped(syscall.SIGTERM), false, model.ShutdownSignal},
+		{"sigint", stopped(syscall.SIGINT), false, model.ShutdownSignal},
+		{"sighup", stopped(syscall.SIGHUP), false, model.ShutdownConfigReload},
+		{"upgrade", stopped(syscall.SIGTERM), true, model.ShutdownUpgrade},
+	}
+	for _, c := range cases {
+		if got := shutdownReason(c.ctx, c.upgraded); got != c.want {
+			t.Fatalf("%s: shutdownReason = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// A real SIGHUP reaches the service context as a reload.
+	ctx, stop := notifyShutdown(context.Background())
+	defer stop()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("send SIGHUP: %v", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for SIGHUP to cancel the context")
+	}
+	if got := shutdownReason(ctx, false); got != model.ShutdownConfigReload {
+		t.Fatalf("expected SIGHUP to be a config reload, got %q", got)
+	}
+}
+
+func TestRunningMarkerDetectsUncleanExit(t *testing.T) {
+	dir := t.TempDir()
+	if crashed, err := markRunning(dir); err != nil || crashed {
+		t.Fatalf("first run: crashed=%v err=%v", crashed, err)
+	}
+	// The run exits without clearing the marker, as a crash would.
+	if crashed, err := markRunning(dir); err != nil || !crashed {
+		t.Fatalf("expected the leftover marker to be detected, crashed=%v err=%v", crashed, err)
+	}
+	if err := clearRunning(dir); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if crashed, err := markRunning(dir); err != nil || crashed {
+		t.Fatalf("expected a clean exit not to count as a crash, crashed=%v err=%v", crashed, err)
+	}
+	if err := clearRunning(dir); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+	if err := clearRunning(dir); err != nil {
+		t.Fatalf("clearing a missing marker should succeed: %v", err)
+	}
+}
+
+func TestFinalHeartbeatCarriesShutdownReason(t *testing.T) {
+	var got enroll.HeartbeatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(enroll.HeartbeatResponse{})
+	}))
+	defer srv.Close()
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state: %v", err)
+	}
+	defer st.Close()
+
+	cp := &enroll.Client{BaseURL: srv.URL, HTTP: srv.Client()}
+	if err := sendFinalHeartbeat(context.Background(), cp, state.Identity{AgentID: "agent-1"}, st, netbird.Status{}, model.ShutdownUpgrade); err != nil {
+		t.Fatalf("final heartbeat: %v", err)
+	}
+	if !got.Shutdown || got.ShutdownReason != model.ShutdownUpgrade {
+		t.Fatalf("expected a shutdown heartbeat with reason upgrade, got shutdown=%v reason=%q", got.Shutdown, got.ShutdownReason)
+	}
+}
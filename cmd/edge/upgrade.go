@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+)
+
+const (
+	defaultUpgradeTimeout = 10 * time.Minute
+	// upgradeOutputLimit bounds the hook output sent back with a report.
+	upgradeOutputLimit = 512
+)
+
+// agentUpgrader runs the operator's upgrade hook when the control plane asks
+// for an agent version other than the running one. The hook gets the target
+// in NKUDO_TARGET_AGENT_VERSION; it installs the new binary and arranges
+// for the agent to restart, whereupon the next heartbeat reports the new
+// version. Each target is attempted once per process so a failing hook is
+// not rerun on every heartbeat.
+type agentUpgrader struct {
+	command string
+	current string
+	timeout time.Duration
+	run     func(ctx context.Context, command string, env []string) ([]byte, error)
+
+	attempted string
+}
+
+func newAgentUpgrader(command, current string, timeout time.Duration) *agentUpgrader {
+	if timeout <= 0 {
+		timeout = defaultUpgradeTimeout
+	}
+	return &agentUpgrader{
+		command: strings.TrimSpace(command),
+		current: current,
+		timeout: timeout,
+		run:     runUpgradeCommand,
+	}
+}
+
+// upgrade runs the hook for target unless the agent already runs it or it
+// was attempted before. It returns the report to send and whether the
+// upgrade was attempted.
+func (u *agentUpgrader) upgrade(ctx context.Context, target string) (enroll.AgentUpgradeReport, bool) {
+	target = strings.TrimSpace(target)
+	if target == "" || target == u.current || target == u.attempted {
+		return enroll.AgentUpgradeReport{}, false
+	}
+	u.attempted = target
+	report := enroll.AgentUpgradeReport{TargetVersion: target}
+	if u.command == "" {
+		report.Message = "no upgrade command configured (--upgrade-command)"
+		return report, true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	out, err := u.run(ctx, u.command, []string{
+		"NKUDO_TARGET_AGENT_VERSION=" + target,
+		"NKUDO_AGENT_VERSION=" + u.current,
+	})
+	output := strings.TrimSpace(string(out))
+	if len(output) > upgradeOutputLimit {
+		output = output[len(output)-upgradeOutputLimit:]
+	}
+	if err != nil {
+		report.Message = fmt.Sprintf("upgrade command failed: %v", err)
+		if output != "" {
+			report.Message += ": " + output
+		}
+		return report, true
+	}
+	report.OK = true
+	report.Message = output
+	return report, true
+}
+
+func runUpgradeCommand(ctx context.Context, command string, env []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd.CombinedOutput()
+}
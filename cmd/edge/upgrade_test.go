@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAgentUpgrader_RunsHookOnVersionMismatch(t *testing.T) {
+	u := newAgentUpgrader("install-agent", "1.0.0", 0)
+	var calls []string
+	u.run = func(ctx context.Context, command string, env []string) ([]byte, error) {
+		calls = append(calls, command+" "+strings.Join(env, " "))
+		return []byte("installed\n"), nil
+	}
+
+	if _, attempted := u.upgrade(context.Background(), ""); attempted {
+		t.Fatal("no target should not upgrade")
+	}
+	if _, attempted := u.upgrade(context.Background(), "1.0.0"); attempted {
+		t.Fatal("target equal to the running version should not upgrade")
+	}
+
+	report, attempted := u.upgrade(context.Background(), "1.1.0")
+	if !attempted || !report.OK || report.TargetVersion != "1.1.0" || report.Message != "installed" {
+		t.Fatalf("unexpected report %+v (attempted %v)", report, attempted)
+	}
+	if len(calls) != 1 || !strings.Contains(calls[0], "NKUDO_TARGET_AGENT_VERSION=1.1.0") || !strings.Contains(calls[0], "NKUDO_AGENT_VERSION=1.0.0") {
+		t.Fatalf("unexpected hook calls %v", calls)
+	}
+
+	// The same target is not retried on later heartbeats.
+	if _, attempted := u.upgrade(context.Background(), "1.1.0"); attempted || len(calls) != 1 {
+		t.Fatal("hook should run once per target")
+	}
+	// A new target is.
+	if _, attempted := u.upgrade(context.Background(), "1.2.0"); !attempted || len(calls) != 2 {
+		t.Fatal("hook should run for a new target")
+	}
+}
+
+func TestAgentUpgrader_ReportsFailure(t *testing.T) {
+	u := newAgentUpgrader("install-agent", "1.0.0", 0)
+	u.run = func(ctx context.Context, command string, env []string) ([]byte, error) {
+		return []byte("checksum mismatch"), errors.New("exit status 1")
+	}
+	report, attempted := u.upgrade(context.Background(), "1.1.0")
+	if !attempted || report.OK {
+		t.Fatalf("expected a failed report, got %+v", report)
+	}
+	if !strings.Contains(report.Message, "exit status 1") || !strings.Contains(report.Message, "checksum mismatch") {
+		t.Fatalf("unexpected message %q", report.Message)
+	}
+
+	noHook := newAgentUpgrader("", "1.0.0", 0)
+	report, attempted = noHook.upgrade(context.Background(), "1.1.0")
+	if !attempted || report.OK || !strings.Contains(report.Message, "--upgrade-command") {
+		t.Fatalf("expected a failure without a hook, got %+v", report)
+	}
+}
+
+func TestRunUpgradeCommand(t *testing.T) {
+	out, err := runUpgradeCommand(context.Background(), `echo "to $NKUDO_TARGET_AGENT_VERSION"`, []string{"NKUDO_TARGET_AGENT_VERSION=1.1.0"})
+	if err != nil {
+		t.Fatalf("runUpgradeCommand: %v", err)
+	}
+	if strings.TrimSpace(string(out)) != "to 1.1.0" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
+	"github.com/kubedoio/n-kudo/internal/edge/metrics"
+)
+
+const (
+	defaultWatchdogBackoff     = 10 * time.Second
+	defaultWatchdogMaxRestarts = 5
+)
+
+// vmWatchdog restarts VMs whose desired status is RUNNING but whose process
+// has died. Restarts back off exponentially and stop after maxRestarts so a
+// VM that crashes on boot does not loop forever. A VM that stays up for
+// stableAfter gets its restart budget back.
+type vmWatchdog struct {
+	store       StateStore
+	provider    executor.MicroVMProvider
+	backoff     time.Duration
+	maxRestarts int
+	stableAfter time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	restarts map[string]*vmRestartState
+}
+
+type vmRestartState struct {
+	count       int
+	lastRestart time.Time
+	nextAttempt time.Time
+	gaveUp      bool
+}
+
+func newVMWatchdog(st StateStore, provider executor.MicroVMProvider, backoff time.Duration, maxRestarts int) *vmWatchdog {
+	if backoff <= 0 {
+		backoff = defaultWatchdogBackoff
+	}
+	if maxRestarts <= 0 {
+		maxRestarts = defaultWatchdogMaxRestarts
+	}
+	return &vmWatchdog{
+		store:       st,
+		provider:    provider,
+		backoff:     backoff,
+		maxRestarts: maxRestarts,
+		stableAfter: 10 * time.Minute,
+		now:         time.Now,
+		restarts:    make(map[string]*vmRestartState),
+	}
+}
+
+// check compares desired and actual state once and restarts crashed VMs
+// that are due. It returns the IDs of the VMs it restarted.
+func (w *vmWatchdog) check(ctx context.Context) []string {
+	vms, err := w.store.ListMicroVMs()
+	if err != nil {
+		logger.WithFields(map[string]interface{}{
+			"error": err.Error(),
+		}).Warn("watchdog: list VMs failed")
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	seen := make(map[string]bool, len(vms))
+	var restarted []string
+	for _, vm := range vms {
+		seen[vm.ID] = true
+		rs := w.restarts[vm.ID]
+		if vm.DesiredStatus != "RUNNING" {
+			delete(w.restarts, vm.ID)
+			continue
+		}
+		if vm.Status != "STOPPED" {
+			if rs != nil && !rs.gaveUp && now.Sub(rs.lastRestart) >= w.stableAfter {
+				delete(w.restarts, vm.ID)
+			}
+			continue
+		}
+
+		if rs == nil {
+			rs = &vmRestartState{}
+			w.restarts[vm.ID] = rs
+		}
+		if rs.gaveUp || now.Before(rs.nextAttempt) {
+			continue
+		}
+		if rs.count >= w.maxRestarts {
+			rs.gaveUp = true
+			metrics.VMRestarts.WithLabelValues(vm.ID, "gave_up").Inc()
+			logger.WithFields(map[string]interface{}{
+				"vm_id":    vm.ID,
+				"restarts": rs.count,
+			}).Error("watchdog: VM keeps crashing, giving up")
+			continue
+		}
+
+		rs.count++
+		rs.lastRestart = now
+		rs.nextAttempt = now.Add(w.backoff << (rs.count - 1))
+		if err := w.provider.Start(ctx, vm.ID); err != nil {
+			metrics.VMRestarts.WithLabelValues(vm.ID, "failure").Inc()
+			logger.WithFields(map[string]interface{}{
+				"vm_id":   vm.ID,
+				"attempt": rs.count,
+				"error":   err.Error(),
+			}).Warn("watchdog: VM restart failed")
+			continue
+		}
+		metrics.VMRestarts.WithLabelValues(vm.ID, "success").Inc()
+		logger.WithFields(map[string]interface{}{
+			"vm_id":   vm.ID,
+			"attempt": rs.count,
+		}).Info("watchdog: restarted crashed VM")
+		restarted = append(restarted, vm.ID)
+	}
+	for vmID := range w.restarts {
+		if !seen[vmID] {
+			delete(w.restarts, vmID)
+		}
+	}
+	return restarted
+}
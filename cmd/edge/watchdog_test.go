@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// crashingProvider records starts and reports the VM as running (or not)
+// in the state store, like the real providers do.
+type crashingProvider struct {
+	recordingProvider
+	st        *state.Store
+	started   []string
+	bootFails bool
+}
+
+func (p *crashingProvider) Start(ctx context.Context, vmID string) error {
+	p.started = append(p.started, vmID)
+	vm, _, _ := p.st.GetMicroVM(vmID)
+	if p.bootFails {
+		vm.Status = "STOPPED"
+	} else {
+		vm.Status = "RUNNING"
+	}
+	return p.st.UpsertMicroVM(state.MicroVM{ID: vm.ID, Status: vm.Status})
+}
+
+func TestVMWatchdogRestartsCrashedVMOnce(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state: %v", err)
+	}
+	defer st.Close()
+
+	vms := []state.MicroVM{
+		{ID: "crashed", Status: "STOPPED", DesiredStatus: "RUNNING"},
+		{ID: "stopped-on-purpose", Status: "STOPPED", DesiredStatus: "STOPPED"},
+		{ID: "healthy", Status: "RUNNING", DesiredStatus: "RUNNING"},
+		{ID: "unmanaged", Status: "STOPPED"},
+	}
+	for _, vm := range vms {
+		if err := st.UpsertMicroVM(vm); err != nil {
+			t.Fatalf("upsert %s: %v", vm.ID, err)
+		}
+	}
+
+	provider := &crashingProvider{st: st}
+	w := newVMWatchdog(st, provider, time.Second, 3)
+
+	restarted := w.check(context.Background())
+	if len(restarted) != 1 || restarted[0] != "crashed" {
+		t.Fatalf("expected only the crashed VM to be restarted, got %v", restarted)
+	}
+	vm, _, _ := st.GetMicroVM("crashed")
+	if vm.Status != "RUNNING" || vm.DesiredStatus != "RUNNING" {
+		t.Fatalf("unexpected VM after restart: %+v", vm)
+	}
+
+	if again := w.check(context.Background()); len(again) != 0 {
+		t.Fatalf("expected no further restarts, got %v", again)
+	}
+	if len(provider.started) != 1 {
+		t.Fatalf("expected exactly one start, got %v", provider.started)
+	}
+}
+
+func TestVMWatchdogBacksOffAndGivesUp(t *testing.T) {
+	st, err := state.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("open state: %v", err)
+	}
+	defer st.Close()
+	if err := st.UpsertMicroVM(state.MicroVM{ID: "flaky", Status: "STOPPED", DesiredStatus: "RUNNING"}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	provider := &crashingProvider{st: st, bootFails: true}
+	w := newVMWatchdog(st, provider, time.Second, 2)
+	now := time.Unix(1_700_000_000, 0)
+	w.now = func() time.Time { return now }
+
+	w.check(context.Background())
+	if len(provider.started) != 1 {
+		t.Fatalf("expected first restart, got %d", len(provider.started))
+	}
+
+	// Inside the backoff window nothing happens.
+	now = now.Add(500 * time.Millisecond)
+	w.check(context.Background())
+	if len(provider.started) != 1 {
+		t.Fatalf("expected restart to wait for backoff, got %d", len(provider.started))
+	}
+
+	now = now.Add(time.Second)
+	w.check(context.Background())
+	if len(provider.started) != 2 {
+		t.Fatalf("expected second restart after backoff, got %d", len(provider.started))
+	}
+
+	// The second backoff is doubled, and the budget of 2 is now spent.
+	now = now.Add(time.Hour)
+	w.check(context.Background())
+	now = now.Add(time.Hour)
+	w.check(context.Background())
+	if len(provider.started) != 2 {
+		t.Fatalf("expected watchdog to give up after max restarts, got %d", len(provider.started))
+	}
+}
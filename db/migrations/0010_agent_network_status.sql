@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Latest NetBird mesh status reported by each agent
+CREATE TABLE IF NOT EXISTS agent_network_status (
+    agent_id UUID PRIMARY KEY,
+    tenant_id UUID NOT NULL,
+    site_id UUID NOT NULL,
+    connected BOOLEAN NOT NULL DEFAULT FALSE,
+    state TEXT,
+    reason TEXT,
+    peer_id TEXT,
+    peer_ip TEXT,
+    network_id TEXT,
+    last_handshake_at TIMESTAMPTZ,
+    route_status TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (agent_id, tenant_id) REFERENCES agents(id, tenant_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_network_status_site
+  ON agent_network_status (tenant_id, site_id);
+
+COMMIT;
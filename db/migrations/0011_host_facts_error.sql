@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Last host facts collection error reported by the agent; NULL when healthy
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS facts_error TEXT;
+
+COMMIT;
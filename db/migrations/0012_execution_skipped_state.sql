@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Executions whose when_state guard did not match the VM state
+ALTER TYPE execution_state ADD VALUE IF NOT EXISTS 'SKIPPED';
+
+COMMIT;
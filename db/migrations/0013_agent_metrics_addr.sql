@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Metrics listen address reported by the agent in heartbeats
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS metrics_addr TEXT;
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Hosts in maintenance are not leased new plans
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS maintenance BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Resource requests (reserved for capacity accounting) and limits (VM size)
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS vcpu_request INTEGER;
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS vcpu_limit INTEGER;
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS memory_request_mib BIGINT;
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS memory_limit_mib BIGINT;
+
+ALTER TABLE microvms DROP CONSTRAINT IF EXISTS microvms_vcpu_request_le_limit;
+ALTER TABLE microvms ADD CONSTRAINT microvms_vcpu_request_le_limit
+  CHECK (vcpu_request IS NULL OR vcpu_limit IS NULL OR vcpu_request <= vcpu_limit);
+ALTER TABLE microvms DROP CONSTRAINT IF EXISTS microvms_memory_request_le_limit;
+ALTER TABLE microvms ADD CONSTRAINT microvms_memory_request_le_limit
+  CHECK (memory_request_mib IS NULL OR memory_limit_mib IS NULL OR memory_request_mib <= memory_limit_mib);
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Plans created by POST /sites/{siteID}/plans/{planID}/retry point back at
+-- the failed plan they re-drive.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS retried_from UUID REFERENCES plans(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_plans_retried_from ON plans (retried_from) WHERE retried_from IS NOT NULL;
+
+COMMIT;
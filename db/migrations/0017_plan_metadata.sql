@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Free-form operator metadata (ticket id, author, reason) attached to a plan.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS metadata JSONB;
+
+COMMIT;
@@ -0,0 +1,35 @@
+BEGIN;
+
+-- Plans pinned to a host are only leased by that host's agent; migration
+-- steps use this to run on the source or target host.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS host_id UUID REFERENCES hosts(id) ON DELETE CASCADE;
+
+ALTER TABLE executions DROP CONSTRAINT IF EXISTS executions_operation_type_check;
+ALTER TABLE executions ADD CONSTRAINT executions_operation_type_check
+  CHECK (operation_type IN ('CREATE', 'START', 'STOP', 'DELETE', 'MIGRATE'));
+
+ALTER TABLE plan_actions DROP CONSTRAINT IF EXISTS plan_actions_operation_type_check;
+ALTER TABLE plan_actions ADD CONSTRAINT plan_actions_operation_type_check
+  CHECK (operation_type IN ('CREATE', 'START', 'STOP', 'DELETE', 'MIGRATE'));
+
+CREATE TABLE IF NOT EXISTS vm_migrations (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  site_id UUID NOT NULL,
+  vm_id UUID NOT NULL,
+  source_host_id UUID NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+  target_host_id UUID NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+  state TEXT NOT NULL CHECK (state IN ('MIGRATING', 'ROLLING_BACK', 'SUCCEEDED', 'ROLLED_BACK', 'FAILED')),
+  step TEXT,
+  plan_id UUID REFERENCES plans(id) ON DELETE SET NULL,
+  error TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- At most one active migration per VM.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_vm_migrations_active
+  ON vm_migrations (vm_id) WHERE state IN ('MIGRATING', 'ROLLING_BACK');
+CREATE INDEX IF NOT EXISTS idx_vm_migrations_plan ON vm_migrations (plan_id) WHERE plan_id IS NOT NULL;
+
+COMMIT;
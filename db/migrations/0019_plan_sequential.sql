@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Sequential plans run their actions strictly in order and stop at the
+-- first failure. action_index records that order; created_at is the same
+-- for every action inserted in one transaction.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS sequential BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE plan_actions ADD COLUMN IF NOT EXISTS action_index INTEGER NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+-- Console log of the VM behind a failed CREATE or START, uploaded by the
+-- agent (truncated to its tail) so boot failures can be diagnosed centrally.
+CREATE TABLE IF NOT EXISTS execution_console_logs (
+  execution_id UUID PRIMARY KEY REFERENCES executions(id) ON DELETE CASCADE,
+  tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  agent_id UUID NOT NULL,
+  vm_id TEXT,
+  content TEXT NOT NULL,
+  truncated BOOLEAN NOT NULL DEFAULT false,
+  captured_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMIT;
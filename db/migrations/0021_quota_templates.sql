@@ -0,0 +1,19 @@
+BEGIN;
+
+-- Named quota limits ("small", "enterprise") that tenants reference at
+-- creation. A tenant's limits fall back to its template, then to the
+-- built-in defaults.
+CREATE TABLE IF NOT EXISTS quota_templates (
+  name TEXT PRIMARY KEY,
+  max_sites INTEGER NOT NULL,
+  max_agents_per_site INTEGER NOT NULL,
+  max_vms_per_agent INTEGER NOT NULL,
+  max_concurrent_plans INTEGER NOT NULL,
+  max_api_keys INTEGER NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS quota_template TEXT REFERENCES quota_templates(name);
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Tenant-wide agent inventory pages by id, optionally filtered by state.
+CREATE INDEX IF NOT EXISTS idx_agents_tenant_state_id
+  ON agents (tenant_id, state, id);
+
+COMMIT;
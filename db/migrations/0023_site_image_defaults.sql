@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Default VM images per host arch ({"amd64": {"kernel_path", "rootfs_path"}}),
+-- filled into CREATE actions that do not pin an image.
+ALTER TABLE sites ADD COLUMN IF NOT EXISTS image_defaults JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+COMMIT;
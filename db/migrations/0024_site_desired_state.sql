@@ -0,0 +1,7 @@
+BEGIN;
+
+-- The VM set last declared for the site through PUT /desired-state; NULL
+-- when the site is managed with plans only.
+ALTER TABLE sites ADD COLUMN IF NOT EXISTS desired_state JSONB;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Newest audit event verified to chain correctly from genesis. Background
+-- verification resumes from here instead of rescanning the whole log.
+CREATE TABLE IF NOT EXISTS audit_chain_checkpoint (
+  id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+  event_id BIGINT NOT NULL,
+  entry_hash TEXT NOT NULL,
+  verified_at TIMESTAMPTZ NOT NULL
+);
+
+COMMIT;
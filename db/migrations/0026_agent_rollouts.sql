@@ -0,0 +1,20 @@
+BEGIN;
+
+-- Agent version a site should run and how quickly agents move to it
+-- ({"target_version", "canary_count", "max_in_flight", "updated_at"}).
+ALTER TABLE sites ADD COLUMN IF NOT EXISTS agent_rollout JSONB NOT NULL DEFAULT '{}'::jsonb;
+
+-- Latest upgrade each agent was signaled for and its outcome.
+CREATE TABLE IF NOT EXISTS agent_upgrades (
+  agent_id UUID PRIMARY KEY REFERENCES agents(id) ON DELETE CASCADE,
+  site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+  from_version TEXT NOT NULL,
+  target_version TEXT NOT NULL,
+  state TEXT NOT NULL,
+  message TEXT NOT NULL DEFAULT '',
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_upgrades_site ON agent_upgrades (site_id, target_version, state);
+
+COMMIT;
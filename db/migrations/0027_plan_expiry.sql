@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Plans left PENDING past MAX_PLAN_PENDING_AGE, and their executions
+ALTER TYPE plan_status ADD VALUE IF NOT EXISTS 'EXPIRED';
+ALTER TYPE execution_state ADD VALUE IF NOT EXISTS 'EXPIRED';
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+-- HTTP endpoints that receive a tenant's events. An empty event_types
+-- delivers every event type.
+CREATE TABLE IF NOT EXISTS webhooks (
+  id UUID PRIMARY KEY,
+  tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  event_types TEXT[] NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_tenant ON webhooks (tenant_id, created_at);
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- Idempotency keys only deduplicate within PLAN_IDEMPOTENCY_WINDOW. Reusing
+-- a key after that releases it from the old plan, which keeps the key for
+-- reference, so uniqueness only holds among unreleased keys.
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS idempotency_released_at TIMESTAMPTZ;
+
+ALTER TABLE plans DROP CONSTRAINT IF EXISTS plans_tenant_id_idempotency_key_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_plans_idempotency_active
+  ON plans (tenant_id, idempotency_key)
+  WHERE idempotency_released_at IS NULL;
+
+COMMIT;
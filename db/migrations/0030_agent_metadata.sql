@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Operator-set agent metadata (rack, datacenter, role), kept apart from
+-- the facts agents report in heartbeats.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS agent_metadata JSONB;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+-- The plan action whose success last changed a VM's state. Not a foreign
+-- key: the plan may be pruned while the VM lives on.
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS last_plan_id UUID;
+ALTER TABLE microvms ADD COLUMN IF NOT EXISTS last_operation_id TEXT;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+-- The control plane allocates attachment addresses from the network CIDR;
+-- this backs its collision check against concurrent writers.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_vm_network_attachments_ip
+    ON vm_network_attachments(network_id, ip_address)
+    WHERE ip_address IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- One usage snapshot per tenant and UTC day, refreshed through the day
+-- by the control plane's usage recorder.
+CREATE TABLE IF NOT EXISTS tenant_usage_history (
+  tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  day DATE NOT NULL,
+  sites INT NOT NULL DEFAULT 0,
+  agents INT NOT NULL DEFAULT 0,
+  vms INT NOT NULL DEFAULT 0,
+  active_plans INT NOT NULL DEFAULT 0,
+  api_keys INT NOT NULL DEFAULT 0,
+  recorded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (tenant_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tenant_usage_history_day ON tenant_usage_history (day);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- Log entries below this severity are filtered at ingest; empty keeps all.
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS min_log_severity TEXT NOT NULL DEFAULT '';
+
+COMMIT;
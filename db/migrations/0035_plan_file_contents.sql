@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Large file contents of plan actions (cloud-init user-data and the like)
+-- are stored once, keyed by their SHA-256. The action payload refers to
+-- them by content_ref and they are put back when the plan is leased.
+CREATE TABLE IF NOT EXISTS plan_file_contents (
+  hash TEXT PRIMARY KEY,
+  content TEXT NOT NULL,
+  size_bytes INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+COMMIT;
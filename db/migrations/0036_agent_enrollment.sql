@@ -0,0 +1,15 @@
+BEGIN;
+
+-- Enrollment provenance: the token each agent consumed and what it sent
+-- when it enrolled. Agents enrolled before this migration are linked by
+-- the token hash they recorded.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS enrollment_token_id UUID REFERENCES enrollment_tokens(id) ON DELETE SET NULL;
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS enrollment_bootstrap JSONB;
+
+UPDATE agents a
+SET enrollment_token_id = t.id
+FROM enrollment_tokens t
+WHERE a.enrollment_token_id IS NULL
+  AND a.enrollment_token_hash = t.token_hash;
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+-- The latest metrics snapshot each agent pushed with its heartbeat, for
+-- hosts the control plane cannot scrape.
+CREATE TABLE IF NOT EXISTS agent_metrics (
+  agent_id UUID PRIMARY KEY REFERENCES agents(id) ON DELETE CASCADE,
+  tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  site_id UUID NOT NULL,
+  metrics JSONB NOT NULL,
+  reported_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_metrics_site ON agent_metrics (tenant_id, site_id);
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Opt-in per site: reject plans that CREATE a VM under a name already used
+-- in the site.
+ALTER TABLE sites ADD COLUMN IF NOT EXISTS unique_vm_names BOOLEAN NOT NULL DEFAULT false;
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+-- NetBird status transitions of each agent, recorded when a heartbeat
+-- reports a status that differs from the previous one.
+CREATE TABLE IF NOT EXISTS agent_connectivity_history (
+    id BIGSERIAL PRIMARY KEY,
+    agent_id UUID NOT NULL,
+    tenant_id UUID NOT NULL,
+    site_id UUID NOT NULL,
+    connected BOOLEAN NOT NULL,
+    state TEXT,
+    reason TEXT,
+    at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (agent_id, tenant_id) REFERENCES agents(id, tenant_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_connectivity_history_agent
+  ON agent_connectivity_history (tenant_id, agent_id, at);
+
+COMMIT;
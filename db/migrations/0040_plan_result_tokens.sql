@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Idempotency tokens of the action results applied to each plan, so a
+-- resent result report is not applied twice.
+CREATE TABLE IF NOT EXISTS plan_result_tokens (
+    plan_id UUID NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    token TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (plan_id, token)
+);
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Plan stats count a site's plans by status over a creation window.
+CREATE INDEX IF NOT EXISTS idx_plans_site_created
+  ON plans (tenant_id, site_id, created_at) INCLUDE (status);
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- DNS records map the hostname of a VM to its address on a VXLAN network.
+-- They are registered when the VM's CREATE succeeds and go with the VM,
+-- its attachment or the network.
+CREATE TABLE IF NOT EXISTS vm_dns_records (
+    network_id UUID NOT NULL REFERENCES vxlan_networks(id) ON DELETE CASCADE,
+    vm_id UUID NOT NULL REFERENCES microvms(id) ON DELETE CASCADE,
+    site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    hostname TEXT NOT NULL,
+    ip_address INET NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (network_id, vm_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_vm_dns_records_site
+  ON vm_dns_records (site_id, network_id, hostname);
+
+COMMIT;
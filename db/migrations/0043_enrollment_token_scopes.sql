@@ -0,0 +1,9 @@
+BEGIN;
+
+-- An enrollment token's scope (allowed operations, max VMs) is recorded at
+-- issuance and copied to the agent that enrolls with it. NULL is a full
+-- agent.
+ALTER TABLE enrollment_tokens ADD COLUMN IF NOT EXISTS scope JSONB;
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS scope JSONB;
+
+COMMIT;
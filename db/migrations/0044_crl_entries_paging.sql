@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Revoked certificates are paged newest first by (revoked_at, serial).
+CREATE INDEX IF NOT EXISTS idx_crl_entries_revoked_at_serial
+  ON crl_entries (revoked_at DESC, serial DESC);
+
+COMMIT;
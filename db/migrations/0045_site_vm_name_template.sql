@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Per-site default template naming the unnamed CREATEs of plans that do
+-- not bring their own.
+ALTER TABLE sites ADD COLUMN IF NOT EXISTS vm_name_template TEXT;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Why each agent last stopped, as it reported on its final heartbeat or on
+-- its first heartbeat after a crash.
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS last_shutdown_reason TEXT;
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS last_shutdown_at TIMESTAMPTZ;
+
+COMMIT;
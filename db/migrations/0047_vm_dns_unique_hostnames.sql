@@ -0,0 +1,18 @@
+BEGIN;
+
+-- A hostname names one VM per network. Later duplicates get the first
+-- eight characters of their VM ID appended, as the control plane does when
+-- it registers them.
+UPDATE vm_dns_records d
+SET hostname = left(d.hostname, 54) || '-' || left(d.vm_id::text, 8)
+WHERE EXISTS (
+  SELECT 1 FROM vm_dns_records o
+  WHERE o.network_id = d.network_id
+    AND o.hostname = d.hostname
+    AND (o.created_at, o.vm_id) < (d.created_at, d.vm_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_vm_dns_records_hostname
+  ON vm_dns_records (network_id, hostname);
+
+COMMIT;
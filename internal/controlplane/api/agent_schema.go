@@ -0,0 +1,206 @@
+package controlplane
+
+import (
+	"fmt"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// Payload schema versions understood by this control plane. Agents send
+// schema_version in enroll and heartbeat payloads; payloads without it
+// predate versioning and are decoded as version 1.
+//
+// Heartbeat version 1 carries host totals as flat fields (cpu_cores_total,
+// memory_bytes_total, ...) with host_facts only as a fallback, and a VM's
+// state in "state" or "status". Version 2 is what current agents send: host
+// facts nested under host_facts and the VM's state in "status".
+//
+// Enroll has a single version so far.
+const (
+	HeartbeatSchemaVersion    = 2
+	MinHeartbeatSchemaVersion = 1
+	EnrollSchemaVersion       = 1
+	MinEnrollSchemaVersion    = 1
+)
+
+// checkSchemaVersion rejects versions outside [minVersion, maxVersion] with
+// a hint on which side needs upgrading. Zero means the field was absent.
+func checkSchemaVersion(payload string, version, minVersion, maxVersion int) (int, error) {
+	if version == 0 {
+		return 1, nil
+	}
+	switch {
+	case version > maxVersion:
+		return 0, fmt.Errorf("unsupported %s schema_version %d: this control plane supports up to version %d; upgrade the control plane", payload, version, maxVersion)
+	case version < minVersion:
+		return 0, fmt.Errorf("unsupported %s schema_version %d: this control plane requires version %d or newer; upgrade the agent", payload, version, minVersion)
+	}
+	return version, nil
+}
+
+type heartbeatHostFacts struct {
+	CPUCores    int   `json:"cpu_cores"`
+	MemoryTotal int64 `json:"memory_total_bytes"`
+	Disks       []struct {
+		Mountpoint string `json:"mountpoint"`
+		TotalBytes int64  `json:"total_bytes"`
+		FreeBytes  int64  `json:"free_bytes"`
+	} `json:"disks"`
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	Kernel string `json:"kernel"`
+	KVM    struct {
+		Present  bool `json:"present"`
+		Readable bool `json:"readable"`
+		Writable bool `json:"writable"`
+	} `json:"kvm"`
+}
+
+type heartbeatVM struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Status     string    `json:"status"`
+	VCPUCount  int       `json:"vcpu_count"`
+	MemoryMiB  int64     `json:"memory_mib"`
+	KernelPath string    `json:"kernel_path"`
+	RootfsPath string    `json:"rootfs_path"`
+	TapIface   string    `json:"tap_iface"`
+	CHPID      int       `json:"ch_pid"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type heartbeatNetBirdStatus struct {
+	Connected       bool       `json:"connected"`
+	State           string     `json:"state"`
+	Reason          string     `json:"reason"`
+	PeerID          string     `json:"peer_id"`
+	IPv4            string     `json:"ipv4"`
+	NetworkID       string     `json:"network_id"`
+	LastHandshakeAt *time.Time `json:"last_handshake_at"`
+	RouteStatus     string     `json:"route_status"`
+}
+
+// heartbeatRequest is the union of all heartbeat schema versions. After
+// normalize the flat fields hold the host facts whichever version was sent.
+type heartbeatRequest struct {
+	SchemaVersion            int                     `json:"schema_version"`
+	AgentID                  string                  `json:"agent_id"`
+	HeartbeatSeq             int64                   `json:"heartbeat_seq"`
+	SentAt                   time.Time               `json:"sent_at"`
+	AgentVersion             string                  `json:"agent_version"`
+	OS                       string                  `json:"os"`
+	Arch                     string                  `json:"arch"`
+	KernelVersion            string                  `json:"kernel_version"`
+	Hostname                 string                  `json:"hostname"`
+	CPUCoresTotal            int                     `json:"cpu_cores_total"`
+	MemoryBytesTotal         int64                   `json:"memory_bytes_total"`
+	StorageBytesTotal        int64                   `json:"storage_bytes_total"`
+	KVMAvailable             bool                    `json:"kvm_available"`
+	CloudHypervisorAvailable bool                    `json:"cloud_hypervisor_available"`
+	FactsError               string                  `json:"facts_error"`
+	MetricsAddr              string                  `json:"metrics_addr"`
+	MicroVMs                 []heartbeatVM           `json:"microvms"`
+	ExecutionUpdates         []store.ExecutionUpdate `json:"execution_updates"`
+	HostFacts                heartbeatHostFacts      `json:"host_facts"`
+	NetBirdStatus            *heartbeatNetBirdStatus `json:"netbird_status"`
+	// Shutdown marks an agent's final heartbeat. ShutdownReason says why it
+	// stopped; agents that exited without a final heartbeat send
+	// crash_recovery on their first heartbeat after restarting.
+	Shutdown       bool   `json:"shutdown"`
+	ShutdownReason string `json:"shutdown_reason"`
+	// Metrics is a snapshot pushed by agents the control plane cannot
+	// scrape; names outside store.AgentMetricNames are dropped.
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// normalize checks the schema version and fills the flat fields the way
+// that version defines them.
+func (req *heartbeatRequest) normalize() error {
+	version, err := checkSchemaVersion("heartbeat", req.SchemaVersion, MinHeartbeatSchemaVersion, HeartbeatSchemaVersion)
+	if err != nil {
+		return err
+	}
+	req.SchemaVersion = version
+	switch version {
+	case 1:
+		req.normalizeV1()
+	case 2:
+		req.normalizeV2()
+	}
+	if !req.CloudHypervisorAvailable {
+		req.CloudHypervisorAvailable = req.KVMAvailable
+	}
+	if req.Hostname == "" {
+		req.Hostname = "unknown"
+	}
+	for i := range req.ExecutionUpdates {
+		upd := &req.ExecutionUpdates[i]
+		upd.ErrorCode, upd.ErrorMessage = store.NormalizeFailure(upd.ErrorCode, upd.ErrorMessage)
+	}
+	switch {
+	case req.ShutdownReason != "" && !model.ValidShutdownReason(req.ShutdownReason):
+		return fmt.Errorf("unknown shutdown_reason %q", req.ShutdownReason)
+	case req.Shutdown && req.ShutdownReason == "":
+		req.ShutdownReason = model.ShutdownUnspecified
+	}
+	return nil
+}
+
+// normalizeV1 prefers the flat fields and falls back to host_facts.
+func (req *heartbeatRequest) normalizeV1() {
+	facts := req.HostFacts
+	if req.CPUCoresTotal == 0 && facts.CPUCores > 0 {
+		req.CPUCoresTotal = facts.CPUCores
+	}
+	if req.MemoryBytesTotal == 0 && facts.MemoryTotal > 0 {
+		req.MemoryBytesTotal = facts.MemoryTotal
+	}
+	if req.StorageBytesTotal == 0 && len(facts.Disks) > 0 {
+		req.StorageBytesTotal = facts.totalDiskBytes()
+	}
+	if req.OS == "" {
+		req.OS = facts.OS
+	}
+	if req.Arch == "" {
+		req.Arch = facts.Arch
+	}
+	if req.KernelVersion == "" {
+		req.KernelVersion = facts.Kernel
+	}
+	if !req.KVMAvailable {
+		req.KVMAvailable = facts.kvmUsable()
+	}
+	for i := range req.MicroVMs {
+		req.MicroVMs[i].State = firstNonEmpty(req.MicroVMs[i].State, req.MicroVMs[i].Status)
+	}
+}
+
+// normalizeV2 takes host facts from host_facts only.
+func (req *heartbeatRequest) normalizeV2() {
+	facts := req.HostFacts
+	req.CPUCoresTotal = facts.CPUCores
+	req.MemoryBytesTotal = facts.MemoryTotal
+	req.StorageBytesTotal = facts.totalDiskBytes()
+	req.OS = facts.OS
+	req.Arch = facts.Arch
+	req.KernelVersion = facts.Kernel
+	req.KVMAvailable = facts.kvmUsable()
+	for i := range req.MicroVMs {
+		req.MicroVMs[i].State = req.MicroVMs[i].Status
+	}
+}
+
+func (f heartbeatHostFacts) totalDiskBytes() int64 {
+	var sum int64
+	for _, d := range f.Disks {
+		sum += d.TotalBytes
+	}
+	return sum
+}
+
+func (f heartbeatHostFacts) kvmUsable() bool {
+	return f.KVM.Present && f.KVM.Readable && f.KVM.Writable
+}
@@ -0,0 +1,36 @@
+package controlplane
+
+import (
+	"encoding/json"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// agentLabels resolves the labels delivered with the plans an agent
+// leases: the scalar values of its operator-set metadata, overridden by
+// the facts the agent reports (os, arch and kernel_version). Actions can
+// reference them as {label.NAME}; the agent expands them before running.
+func agentLabels(agent store.Agent) map[string]string {
+	labels := make(map[string]string)
+	var metadata map[string]any
+	if len(agent.Metadata) > 0 && json.Unmarshal(agent.Metadata, &metadata) == nil {
+		for k, v := range metadata {
+			switch v := v.(type) {
+			case string:
+				labels[k] = v
+			case float64, bool:
+				raw, _ := json.Marshal(v)
+				labels[k] = string(raw)
+			}
+		}
+	}
+	for k, v := range map[string]string{"os": agent.OS, "arch": agent.Arch, "kernel_version": agent.KernelVersion} {
+		if v != "" {
+			labels[k] = v
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
@@ -2,9 +2,7 @@ package controlplane
 
 import (
 	"log"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -237,41 +235,6 @@ func (ap *APIKeyProtector) cleanupStaleEntries() {
 	}
 }
 
-// getClientIP extracts the real client IP from the request
-// Checks X-Forwarded-For, X-Real-IP headers, then RemoteAddr
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (common for proxies)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			ip := strings.TrimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
-
-	// Check X-Real-IP header (common for nginx)
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		ip := strings.TrimSpace(xri)
-		if net.ParseIP(ip) != nil {
-			return ip
-		}
-	}
-
-	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// RemoteAddr might not have a port in some cases
-		if net.ParseIP(r.RemoteAddr) != nil {
-			return r.RemoteAddr
-		}
-		return "unknown"
-	}
-	return host
-}
-
 // Middleware returns an HTTP middleware that checks if the client is blocked
 // before allowing the request to proceed. This should be used BEFORE the
 // apiKeyAuth middleware.
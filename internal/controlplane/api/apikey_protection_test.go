@@ -177,6 +177,10 @@ func TestAPIKeyProtector_DifferentIPs(t *testing.T) {
 }
 
 func TestAPIKeyProtectionGetClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
 	tests := []struct {
 		name       string
 		remoteAddr string
@@ -199,7 +203,7 @@ func TestAPIKeyProtectionGetClientIP(t *testing.T) {
 			name:       "X-Forwarded-For multiple",
 			remoteAddr: "192.168.1.1:12345",
 			headers:    map[string]string{"X-Forwarded-For": "10.0.0.1, 10.0.0.2, 10.0.0.3"},
-			want:       "10.0.0.1",
+			want:       "10.0.0.3",
 		},
 		{
 			name:       "X-Real-IP",
@@ -223,7 +227,7 @@ func TestAPIKeyProtectionGetClientIP(t *testing.T) {
 				req.Header.Set(k, v)
 			}
 
-			got := getClientIP(req)
+			got := getClientIP(proxies.Resolve(req))
 			if got != tt.want {
 				t.Errorf("getClientIP() = %v, want %v", got, tt.want)
 			}
@@ -0,0 +1,107 @@
+package controlplane
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/controlplane/pki"
+)
+
+type caCertificateInfo struct {
+	Subject      string     `json:"subject"`
+	Serial       string     `json:"serial"`
+	NotAfter     time.Time  `json:"not_after"`
+	TrustedUntil *time.Time `json:"trusted_until,omitempty"`
+}
+
+func (a *App) caStatus() map[string]any {
+	current := a.ca.Certificate()
+	retired := make([]caCertificateInfo, 0)
+	for _, r := range a.ca.Retired() {
+		until := r.TrustedUntil
+		retired = append(retired, caCertificateInfo{
+			Subject:      r.Cert.Subject.CommonName,
+			Serial:       r.Cert.SerialNumber.String(),
+			NotAfter:     r.Cert.NotAfter,
+			TrustedUntil: &until,
+		})
+	}
+	return map[string]any{
+		"current": caCertificateInfo{
+			Subject:  current.Subject.CommonName,
+			Serial:   current.SerialNumber.String(),
+			NotAfter: current.NotAfter,
+		},
+		"ca_cert_pem": string(a.ca.CertPEM()),
+		"retired":     retired,
+	}
+}
+
+func (a *App) handleGetCA(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.caStatus())
+}
+
+// handleRotateCA switches agent certificate signing to a new CA. The old CA
+// stays trusted for CARotationOverlap; agents must renew within that window.
+func (a *App) handleRotateCA(w http.ResponseWriter, r *http.Request) {
+	if err := a.ca.Rotate(a.cfg.CACommonName, a.cfg.CALifetime, a.cfg.CARotationOverlap); err != nil {
+		log.Printf("ca rotation failed: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to rotate ca")
+		return
+	}
+	if err := a.crlManager.SetIssuer(a.ca.Certificate(), a.ca.Key()); err != nil {
+		log.Printf("warning: failed to re-sign crl after ca rotation: %v", err)
+	}
+	log.Printf("rotated internal ca, new serial %s", a.ca.Certificate().SerialNumber)
+	writeJSON(w, http.StatusOK, a.caStatus())
+}
+
+// loadCRL replaces the revocations in crl with those in the database and
+// re-signs it, so the CRL also carries revocations other replicas made. The
+// CRL's last update, which CRLMaxAge is measured from, is only moved on
+// success.
+func loadCRL(ctx context.Context, repo store.Repo, crl *pki.CRLManager) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	started := time.Now().UTC()
+	entries, err := repo.ListRevokedCertificates(ctx, store.RevokedCertificateQuery{})
+	if err != nil {
+		return 0, err
+	}
+	revoked := make([]pki.RevokedCertificate, 0, len(entries))
+	for _, entry := range entries {
+		revoked = append(revoked, pki.RevokedCertificate{
+			SerialNumber: entry.SerialNumber,
+			RevokedAt:    entry.RevokedAt,
+			Reason:       pki.RevocationReason(entry.Reason),
+			AgentID:      entry.AgentID,
+		})
+	}
+	return len(revoked), crl.Load(revoked, started)
+}
+
+// startCRLRefresh reloads the CRL from the database every
+// CRLRefreshInterval, keeping it fresh for CRLMaxAge and for the agents
+// that fetch it.
+func (a *App) startCRLRefresh(ctx context.Context) {
+	if a.cfg.CRLRefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.CRLRefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := loadCRL(ctx, a.repo, a.crlManager); err != nil {
+					log.Printf("crl refresh error: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies resolves the client IP of requests arriving through reverse
+// proxies. X-Forwarded-For and X-Real-IP are honoured only when the direct
+// peer is inside one of the configured networks; otherwise anyone could
+// spoof their address past the rate limiter and into the audit log.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or bare IPs.
+// An empty list trusts no proxy.
+func ParseTrustedProxies(spec string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+	return p, nil
+}
+
+func (p *TrustedProxies) trusted(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r. When the peer is
+// a trusted proxy, X-Forwarded-For is walked from the right and the first
+// hop that is not itself a trusted proxy is the client; X-Real-IP is used
+// when there is no X-Forwarded-For.
+func (p *TrustedProxies) ClientIP(r *http.Request) string {
+	peer := peerIP(r)
+	if !p.trusted(net.ParseIP(peer)) {
+		return peer
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !p.trusted(ip) {
+				break
+			}
+		}
+		return client
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// Resolve returns r carrying its resolved client IP for getClientIP.
+func (p *TrustedProxies) Resolve(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxClientIP{}, p.ClientIP(r)))
+}
+
+type ctxClientIP struct{}
+
+func (a *App) withClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, a.trustedProxies.Resolve(r))
+	})
+}
+
+// getClientIP returns the client IP resolved by withClientIP, or the direct
+// peer when the request did not pass through it.
+func getClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxClientIP{}).(string); ok && ip != "" {
+		return ip
+	}
+	return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// RemoteAddr might not have a port in some cases
+		if net.ParseIP(r.RemoteAddr) != nil {
+			return r.RemoteAddr
+		}
+		return "unknown"
+	}
+	return host
+}
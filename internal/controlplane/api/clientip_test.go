@@ -0,0 +1,92 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatalf("parse trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"untrusted peer ignores X-Forwarded-For", "198.51.100.9:4000", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "198.51.100.9"},
+		{"untrusted peer ignores X-Real-IP", "198.51.100.9:4000", map[string]string{"X-Real-IP": "203.0.113.1"}, "198.51.100.9"},
+		{"trusted cidr", "10.1.2.3:4000", map[string]string{"X-Forwarded-For": "203.0.113.1"}, "203.0.113.1"},
+		{"trusted single ip", "192.0.2.7:4000", map[string]string{"X-Real-IP": "203.0.113.2"}, "203.0.113.2"},
+		{"spoofed leftmost hop", "10.1.2.3:4000", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.1"}, "203.0.113.1"},
+		{"chained trusted proxies", "10.1.2.3:4000", map[string]string{"X-Forwarded-For": "203.0.113.1, 10.9.9.9"}, "203.0.113.1"},
+		{"garbage hop stops the walk", "10.1.2.3:4000", map[string]string{"X-Forwarded-For": "203.0.113.1, not-an-ip"}, "10.1.2.3"},
+		{"trusted peer without headers", "10.1.2.3:4000", nil, "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := proxies.ClientIP(req); got != tt.want {
+				t.Fatalf("ClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatalf("expected invalid cidr to be rejected")
+	}
+	if _, err := ParseTrustedProxies("proxy.local"); err == nil {
+		t.Fatalf("expected hostname to be rejected")
+	}
+}
+
+func TestAuditSourceIPBehindTrustedProxy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{"trusted proxy", "192.0.2.0/24", "203.0.113.50"},
+		{"untrusted proxy", "", "192.0.2.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tc.trusted)
+			app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/tenants/"+tenantID+"/api-keys", strings.NewReader(`{"name":"ci"}`))
+			req.RemoteAddr = "192.0.2.1:5555"
+			req.Header.Set("X-Admin-Key", "admin")
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Forwarded-For", "203.0.113.50")
+			rec := httptest.NewRecorder()
+			app.Handler().ServeHTTP(rec, req)
+			if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+				t.Fatalf("create api key status=%d body=%s", rec.Code, rec.Body.String())
+			}
+
+			events, err := repo.ListAuditEvents(context.Background(), tenantID, 10)
+			if err != nil {
+				t.Fatalf("list audit events: %v", err)
+			}
+			for _, e := range events {
+				if e.Action == "apikey.create" {
+					if e.SourceIP != tc.want {
+						t.Fatalf("expected audit source ip %s, got %s", tc.want, e.SourceIP)
+					}
+					return
+				}
+			}
+			t.Fatalf("apikey.create audit event not found in %+v", events)
+		})
+	}
+}
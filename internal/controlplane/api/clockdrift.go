@@ -0,0 +1,48 @@
+package controlplane
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clockDriftGauge keeps the last clock drift measured for each agent from
+// the sent_at timestamp of its heartbeats. Drift is agent time minus
+// control-plane time, so it includes the request's transit time.
+type clockDriftGauge struct {
+	mu     sync.Mutex
+	drifts map[string]time.Duration
+}
+
+func newClockDriftGauge() *clockDriftGauge {
+	return &clockDriftGauge{drifts: make(map[string]time.Duration)}
+}
+
+// observe records the drift between sentAt and now for an agent. Agents
+// that do not send sent_at are not measured and report false.
+func (g *clockDriftGauge) observe(agentID string, sentAt, now time.Time) (time.Duration, bool) {
+	if sentAt.IsZero() {
+		return 0, false
+	}
+	drift := sentAt.Sub(now)
+	g.mu.Lock()
+	g.drifts[agentID] = drift
+	g.mu.Unlock()
+	return drift, true
+}
+
+// writeMetrics writes one nkudo_agent_clock_drift_seconds sample per agent.
+func (g *clockDriftGauge) writeMetrics(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	agentIDs := make([]string, 0, len(g.drifts))
+	for id := range g.drifts {
+		agentIDs = append(agentIDs, id)
+	}
+	sort.Strings(agentIDs)
+	for _, id := range agentIDs {
+		fmt.Fprintf(w, "nkudo_agent_clock_drift_seconds{agent_id=%q} %.3f\n", id, g.drifts[id].Seconds())
+	}
+}
@@ -0,0 +1,109 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Paths the enrollment cloud-init snippet writes on the edge host.
+const (
+	cloudInitCAPath    = "/etc/nkudo/ca.pem"
+	cloudInitTokenPath = "/etc/nkudo/enrollment-token"
+)
+
+// handleEnrollmentCloudInit renders a #cloud-config snippet that installs
+// the edge agent and enrolls it with an enrollment token. Tokens are only
+// stored hashed, so the caller passes the plaintext it was issued in the
+// X-Enrollment-Token header; it must match the token ID in the path and the
+// token must still be unconsumed and unexpired.
+func (a *App) handleEnrollmentCloudInit(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	plainToken := strings.TrimSpace(r.Header.Get("X-Enrollment-Token"))
+	if plainToken == "" {
+		writeError(w, http.StatusBadRequest, "X-Enrollment-Token header is required")
+		return
+	}
+	tokens, err := a.repo.ListEnrollmentTokens(r.Context(), tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load enrollment token")
+		return
+	}
+	tokenID := r.PathValue("tokenID")
+	found := false
+	for _, t := range tokens {
+		if t.ID != tokenID {
+			continue
+		}
+		found = true
+		if !secureEqual(t.TokenHash, hashString(plainToken)) {
+			writeError(w, http.StatusForbidden, "enrollment token does not match")
+			return
+		}
+		if t.Consumed {
+			writeError(w, http.StatusConflict, "enrollment token already consumed")
+			return
+		}
+		if !t.ExpiresAt.After(time.Now().UTC()) {
+			writeError(w, http.StatusConflict, "enrollment token expired")
+			return
+		}
+		_ = a.writeAudit(r.Context(), tenantID, t.SiteID, "USER", "api-key", "enrollment_token.export_cloud_init", "enrollment_token", t.ID, requestID(r), sourceIP(r), nil)
+		break
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "enrollment token not found")
+		return
+	}
+
+	controlPlaneURL := a.cfg.AgentControlPlaneURL
+	if controlPlaneURL == "" {
+		controlPlaneURL = "https://" + r.Host
+	}
+	w.Header().Set("Content-Type", "text/cloud-config; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(enrollmentCloudInit(plainToken, controlPlaneURL, a.cfg.AgentInstallURL, string(a.ca.CertPEM()))))
+}
+
+// enrollmentCloudInit builds the cloud-config document. Scalars that come
+// from the request or config are JSON-quoted, which YAML reads as
+// double-quoted strings.
+func enrollmentCloudInit(token, controlPlaneURL, installURL, caPEM string) string {
+	var b strings.Builder
+	b.WriteString("#cloud-config\n")
+	b.WriteString("write_files:\n")
+	b.WriteString("  - path: " + cloudInitCAPath + "\n")
+	b.WriteString("    permissions: \"0644\"\n")
+	b.WriteString("    content: |\n")
+	for _, line := range strings.Split(strings.TrimRight(caPEM, "\n"), "\n") {
+		b.WriteString("      " + line + "\n")
+	}
+	b.WriteString("  - path: " + cloudInitTokenPath + "\n")
+	b.WriteString("    permissions: \"0600\"\n")
+	b.WriteString("    content: " + yamlQuote(token) + "\n")
+	b.WriteString("runcmd:\n")
+	for _, cmd := range []string{
+		"curl -fsSL " + shellQuote(installURL) + " | sh",
+		"nkudo-edge enroll --control-plane " + shellQuote(controlPlaneURL) + " --token-file " + cloudInitTokenPath + " --ca-file " + cloudInitCAPath,
+		"rm -f " + cloudInitTokenPath,
+		"systemctl enable --now nkudo-edge",
+	} {
+		b.WriteString("  - " + yamlQuote(cmd) + "\n")
+	}
+	return b.String()
+}
+
+func yamlQuote(s string) string {
+	out, _ := json.Marshal(s)
+	return string(out)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
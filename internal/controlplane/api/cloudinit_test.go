@@ -0,0 +1,81 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestEnrollmentCloudInit(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	h := app.Handler()
+
+	rec := doJSON(t, h, "POST", "/tenants/"+tenantID+"/enrollment-tokens", plainAPIKey, map[string]any{"site_id": siteID}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("issue token status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var issued struct {
+		TokenID string `json:"token_id"`
+		Token   string `json:"token"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &issued)
+	tokenID, token := issued.TokenID, issued.Token
+
+	getSnippet := func(tenant, id, apiKey, plain string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/tenants/"+tenant+"/enrollment-tokens/"+id+"/cloud-init", nil)
+		req.Host = "cp.example.com"
+		req.Header.Set("X-API-Key", apiKey)
+		if plain != "" {
+			req.Header.Set("X-Enrollment-Token", plain)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = getSnippet(tenantID, tokenID, plainAPIKey, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cloud-init status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	snippet := rec.Body.String()
+	for _, want := range []string{
+		"#cloud-config",
+		`content: "` + token + `"`,
+		"nkudo-edge enroll --control-plane 'https://cp.example.com' --token-file " + cloudInitTokenPath,
+		"BEGIN CERTIFICATE",
+	} {
+		if !strings.Contains(snippet, want) {
+			t.Fatalf("snippet missing %q:\n%s", want, snippet)
+		}
+	}
+
+	if rec := getSnippet(tenantID, tokenID, plainAPIKey, "wrong-token"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a token that does not match, got %d", rec.Code)
+	}
+	if rec := getSnippet(tenantID, uuid.NewString(), plainAPIKey, token); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown token, got %d", rec.Code)
+	}
+
+	otherTenantID := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: otherTenantID, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create other tenant: %v", err)
+	}
+	if rec := getSnippet(otherTenantID, tokenID, plainAPIKey, token); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another tenant, got %d", rec.Code)
+	}
+
+	enroll(t, app, token, makeCSR(t))
+	if rec := getSnippet(tenantID, tokenID, plainAPIKey, token); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 once the token is consumed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// desiredStateDiff returns the actions that reconcile the site's VMs with
+// desired, and a key identifying the VM set they were computed from. VMs
+// with a DELETE still pending count as gone, so repeating a declaration
+// while its plan runs generates nothing new.
+func (a *App) desiredStateDiff(ctx context.Context, tenantID, siteID string, desired []store.DesiredVM) ([]store.ApplyPlanAction, bool, string, error) {
+	vms, err := a.repo.ListVMs(ctx, tenantID, siteID)
+	if err != nil {
+		return nil, false, "", err
+	}
+	inFlight, err := a.repo.ListExecutions(ctx, tenantID, siteID, []string{"PENDING", "IN_PROGRESS"}, 1000)
+	if err != nil {
+		return nil, false, "", err
+	}
+	deleting := make(map[string]bool)
+	for _, e := range inFlight {
+		if strings.EqualFold(e.OperationType, "DELETE") {
+			deleting[e.VMID] = true
+		}
+	}
+	current := make([]store.MicroVM, 0, len(vms))
+	snapshot := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		if deleting[vm.ID] {
+			continue
+		}
+		current = append(current, vm)
+		snapshot = append(snapshot, vm.ID)
+	}
+	sort.Strings(snapshot)
+	actions, replaced := store.ReconcileActions(desired, current)
+
+	sum := sha256.New()
+	_ = json.NewEncoder(sum).Encode(map[string]any{"vms": snapshot, "actions": actions})
+	return actions, replaced, hex.EncodeToString(sum.Sum(nil))[:32], nil
+}
+
+func (a *App) handleGetDesiredState(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	state, err := a.repo.GetSiteDesiredState(r.Context(), tenantID, siteID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get desired state")
+		return
+	}
+	if state.UpdatedAt.IsZero() {
+		writeError(w, http.StatusNotFound, "no desired state declared for site")
+		return
+	}
+	actions, _, _, err := a.desiredStateDiff(r.Context(), tenantID, siteID, state.VMs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to diff desired state")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"site_id":         siteID,
+		"desired":         state,
+		"in_sync":         len(actions) == 0,
+		"pending_actions": actions,
+	})
+}
+
+// handleSetDesiredState records the VM set a site should run and applies a
+// plan that creates missing VMs, deletes undeclared ones and recreates VMs
+// whose size changed. Declaring a set the site already runs applies nothing.
+func (a *App) handleSetDesiredState(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	var req struct {
+		VMs []store.DesiredVM `json:"vms"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.VMs == nil {
+		writeError(w, http.StatusBadRequest, "vms is required; send an empty list to remove every VM")
+		return
+	}
+	if err := store.ValidateDesiredVMs(req.VMs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for i := range req.VMs {
+		req.VMs[i].Name = strings.TrimSpace(req.VMs[i].Name)
+	}
+	state := store.DesiredState{VMs: req.VMs, UpdatedAt: time.Now().UTC()}
+
+	// The plan is applied before the declaration is saved, so a set whose
+	// plan is refused is not recorded as the site's desired state.
+	actions, replaced, key, err := a.desiredStateDiff(r.Context(), tenantID, siteID, req.VMs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to diff desired state")
+		return
+	}
+	if len(actions) == 0 {
+		if err := a.repo.SetSiteDesiredState(r.Context(), tenantID, siteID, state); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save desired state")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"site_id": siteID, "desired": state, "in_sync": true, "actions": actions})
+		return
+	}
+	if err := a.validatePlanActions(actions); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.applyImageDefaults(r.Context(), tenantID, siteID, actions); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load site image defaults")
+		return
+	}
+	metadata, _ := json.Marshal(map[string]any{"source": "desired-state"})
+	result, err := a.repo.ApplyPlan(r.Context(), store.ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "desired-state-" + key,
+		Metadata:       metadata,
+		// A recreated VM must be deleted before its replacement is created.
+		Sequential: replaced,
+		Actions:    actions,
+	})
+	if err != nil {
+		writeApplyPlanError(w, err)
+		return
+	}
+	if err := a.repo.SetSiteDesiredState(r.Context(), tenantID, siteID, state); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save desired state")
+		return
+	}
+	auditMetadata, _ := json.Marshal(map[string]any{
+		"operations": json.RawMessage(result.Plan.OperationsJSON),
+		"metadata":   result.Plan.Metadata,
+	})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "plan.apply", "plan", result.Plan.ID, requestID(r), sourceIP(r), auditMetadata)
+	if !result.Deduplicated {
+		a.metrics.plansApplied.Add(1)
+		a.publishPlan(r.Context(), result.Plan)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"site_id": siteID,
+		"desired": state,
+		"in_sync": false,
+		"actions": actions,
+		"plan": map[string]any{
+			"plan_id":      result.Plan.ID,
+			"plan_version": result.Plan.PlanVersion,
+			"plan_status":  result.Plan.Status,
+			"sequential":   result.Plan.Sequential,
+			"deduplicated": result.Deduplicated,
+			"executions":   result.Executions,
+		},
+	})
+}
@@ -0,0 +1,140 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+type desiredStateResponse struct {
+	InSync  bool                    `json:"in_sync"`
+	Actions []store.ApplyPlanAction `json:"actions"`
+	Plan    *struct {
+		PlanID       string `json:"plan_id"`
+		Sequential   bool   `json:"sequential"`
+		Deduplicated bool   `json:"deduplicated"`
+	} `json:"plan"`
+}
+
+func TestDesiredStateReconcilesSite(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	path := "/sites/" + siteID + "/desired-state"
+	put := func(vms []map[string]any) desiredStateResponse {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"vms": vms}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("put desired state status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp desiredStateResponse
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+	ops := func(actions []store.ApplyPlanAction) []string {
+		out := make([]string, 0, len(actions))
+		for _, a := range actions {
+			out = append(out, a.Operation+" "+a.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	if rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before any declaration, got %d", rec.Code)
+	}
+
+	// Additions: an empty site gets both VMs created.
+	resp := put([]map[string]any{
+		{"name": "web", "vcpu_count": 2, "memory_mib": 512},
+		{"name": "db", "vcpu_count": 2, "memory_mib": 1024},
+	})
+	if resp.InSync || resp.Plan == nil || resp.Plan.Sequential {
+		t.Fatalf("expected a parallel plan, got %+v", resp)
+	}
+	if got := ops(resp.Actions); len(got) != 2 || got[0] != "CREATE db" || got[1] != "CREATE web" {
+		t.Fatalf("expected creates for db and web, got %v", got)
+	}
+
+	// No-op: declaring the same set again applies nothing.
+	resp = put([]map[string]any{
+		{"name": "web", "vcpu_count": 2, "memory_mib": 512},
+		{"name": "db", "vcpu_count": 2, "memory_mib": 1024},
+	})
+	if !resp.InSync || resp.Plan != nil || len(resp.Actions) != 0 {
+		t.Fatalf("expected no-op for an unchanged declaration, got %+v", resp)
+	}
+
+	// Deletion: db is no longer declared.
+	resp = put([]map[string]any{{"name": "web", "vcpu_count": 2, "memory_mib": 512}})
+	if got := ops(resp.Actions); len(got) != 1 || got[0] != "DELETE db" || resp.Plan == nil {
+		t.Fatalf("expected db to be deleted, got %v", got)
+	}
+	// While the delete is pending the site counts as in sync.
+	resp = put([]map[string]any{{"name": "web", "vcpu_count": 2, "memory_mib": 512}})
+	if !resp.InSync || resp.Plan != nil {
+		t.Fatalf("expected repeated declaration to be a no-op, got %+v", resp)
+	}
+
+	// Update: resizing web recreates it in a sequential plan.
+	resp = put([]map[string]any{{"name": "web", "vcpu_count": 4, "memory_mib": 512}})
+	if got := ops(resp.Actions); len(got) != 2 || got[0] != "CREATE web" || got[1] != "DELETE web" {
+		t.Fatalf("expected web to be recreated, got %v", got)
+	}
+	if resp.Plan == nil || !resp.Plan.Sequential || resp.Actions[0].Operation != "DELETE" {
+		t.Fatalf("expected the delete first in a sequential plan, got %+v", resp)
+	}
+
+	rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get desired state status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var got struct {
+		Desired store.DesiredState `json:"desired"`
+		InSync  bool               `json:"in_sync"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &got)
+	if len(got.Desired.VMs) != 1 || got.Desired.VMs[0].VCPUCount != 4 || !got.InSync {
+		t.Fatalf("unexpected desired state %+v", got)
+	}
+
+	for name, body := range map[string]map[string]any{
+		"missing vms":    {},
+		"duplicate name": {"vms": []map[string]any{{"name": "a"}, {"name": "a"}}},
+		"missing name":   {"vms": []map[string]any{{"vcpu_count": 1}}},
+	} {
+		if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, body, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := doJSON(t, app.Handler(), "PUT", "/sites/"+uuid.NewString()+"/desired-state", plainAPIKey, map[string]any{"vms": []any{}}, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for foreign site, got %d", rec.Code)
+	}
+}
+
+func TestDesiredStateIsNotSavedWhenItsPlanIsRefused(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	path := "/sites/" + siteID + "/desired-state"
+
+	// The generated CREATE is validated like a submitted plan.
+	app.cfg.MaxActionPayload = 16
+	rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{
+		"vms": []map[string]any{{"name": "web", "vcpu_count": 2, "memory_mib": 512}},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected the oversized action to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected a refused declaration not to be saved, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
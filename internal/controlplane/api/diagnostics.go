@@ -0,0 +1,163 @@
+package controlplane
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+const (
+	// maxDiagnosticsBytes bounds the uncompressed content of a plan
+	// diagnostics archive. Entries past the budget are cut short and listed
+	// in manifest.json.
+	maxDiagnosticsBytes = 32 << 20
+	// diagnosticsLogLimit is the number of log lines taken per execution.
+	diagnosticsLogLimit = 2000
+)
+
+type diagnosticsEntry struct {
+	name    string
+	content []byte
+}
+
+// diagnosticsBundle collects archive entries within a byte budget.
+type diagnosticsBundle struct {
+	entries   []diagnosticsEntry
+	remaining int
+	truncated []string
+}
+
+func (b *diagnosticsBundle) add(name string, content []byte) {
+	if len(content) > b.remaining {
+		content = content[:b.remaining]
+		b.truncated = append(b.truncated, name)
+	}
+	b.remaining -= len(content)
+	b.entries = append(b.entries, diagnosticsEntry{name: name, content: content})
+}
+
+func (b *diagnosticsBundle) addJSON(name string, v any) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	b.add(name, append(data, '\n'))
+}
+
+// handleGetPlanDiagnostics streams a tar.gz with a plan, its executions and,
+// per execution, its logs, command output and console log, for attaching to
+// support tickets.
+func (a *App) handleGetPlanDiagnostics(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	planID := r.PathValue("planID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	plan, err := a.repo.GetPlan(r.Context(), tenantID, planID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "plan not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get plan")
+		return
+	}
+	if plan.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "plan not found")
+		return
+	}
+	executions, err := a.repo.ListPlanExecutions(r.Context(), tenantID, planID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list executions")
+		return
+	}
+
+	// Everything is collected before the response starts so that lookup
+	// failures can still be reported with a status code.
+	bundle := &diagnosticsBundle{remaining: maxDiagnosticsBytes, truncated: []string{}}
+	bundle.addJSON("plan.json", plan)
+	bundle.addJSON("executions.json", executions)
+	for _, e := range executions {
+		dir := "executions/" + e.ID + "/"
+		logs, err := a.repo.ListExecutionLogs(r.Context(), tenantID, e.ID, diagnosticsLogLimit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to list execution logs")
+			return
+		}
+		if len(logs) > 0 {
+			var all, output strings.Builder
+			for _, l := range logs {
+				line := fmt.Sprintf("%s %s %s\n", l.EmittedAt.UTC().Format(time.RFC3339Nano), l.Severity, l.Message)
+				all.WriteString(line)
+				if strings.HasPrefix(l.Message, "stdout: ") || strings.HasPrefix(l.Message, "stderr: ") {
+					output.WriteString(line)
+				}
+			}
+			bundle.add(dir+"logs.txt", []byte(all.String()))
+			if output.Len() > 0 {
+				bundle.add(dir+"command-output.txt", []byte(output.String()))
+			}
+		}
+		console, err := a.repo.GetExecutionConsoleLog(r.Context(), tenantID, e.ID)
+		switch {
+		case err == nil:
+			bundle.add(dir+"console.log", []byte(console.Content))
+		case !errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusInternalServerError, "failed to get console log")
+			return
+		}
+	}
+	generatedAt := time.Now().UTC()
+	manifest := map[string]any{
+		"plan_id":      plan.ID,
+		"site_id":      plan.SiteID,
+		"generated_at": generatedAt,
+		"executions":   len(executions),
+		"max_bytes":    maxDiagnosticsBytes,
+		"truncated":    bundle.truncated,
+	}
+	bundle.remaining = 1 << 20 // the manifest itself is never cut short
+	bundle.addJSON("manifest.json", manifest)
+
+	prefix := "plan-" + plan.ID + "-diagnostics"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", prefix+".tar.gz"))
+	w.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, entry := range bundle.entries {
+		hdr := &tar.Header{
+			Name:    prefix + "/" + entry.name,
+			Mode:    0o644,
+			Size:    int64(len(entry.content)),
+			ModTime: generatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			log.Printf("write diagnostics archive for plan %s: %v", plan.ID, err)
+			return
+		}
+		if _, err := tw.Write(entry.content); err != nil {
+			log.Printf("write diagnostics archive for plan %s: %v", plan.ID, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("write diagnostics archive for plan %s: %v", plan.ID, err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Printf("write diagnostics archive for plan %s: %v", plan.ID, err)
+	}
+}
@@ -0,0 +1,164 @@
+package controlplane
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestPlanDiagnosticsArchive(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-diagnostics",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-diag-1", "name": "vm-diag-1"},
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-diag-1"},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var applyResp struct {
+		PlanID     string            `json:"plan_id"`
+		Executions []store.Execution `json:"executions"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &applyResp)
+	createExec := applyResp.Executions[0].ID
+	if applyResp.Executions[0].OperationID != "create-vm-1" {
+		createExec = applyResp.Executions[1].ID
+	}
+
+	for seq, msg := range []string{"creating vm", "stdout: hello from the guest"} {
+		logRec := doJSON(t, app.Handler(), "POST", "/v1/logs", "", map[string]any{
+			"execution_id": createExec,
+			"sequence":     seq + 1,
+			"level":        "INFO",
+			"message":      msg,
+			"emitted_at":   time.Now().UTC().Format(time.RFC3339Nano),
+			"tenant_id":    tenantID,
+			"action_id":    "create-vm-1",
+		}, agentTLS)
+		if logRec.Code != http.StatusAccepted {
+			t.Fatalf("log frame status=%d body=%s", logRec.Code, logRec.Body.String())
+		}
+	}
+	upload := map[string]any{
+		"execution_id": applyResp.PlanID,
+		"action_id":    "create-vm-1",
+		"vm_id":        "vm-diag-1",
+		"content":      "kernel panic\n",
+	}
+	if rec := doJSON(t, app.Handler(), "POST", "/v1/executions/console", "", upload, agentTLS); rec.Code != http.StatusAccepted {
+		t.Fatalf("upload status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	path := "/sites/" + siteID + "/plans/" + applyResp.PlanID + "/diagnostics"
+	rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("diagnostics status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/gzip" {
+		t.Fatalf("expected gzip content type, got %q", got)
+	}
+
+	entries := readTarGz(t, rec.Body.Bytes())
+	prefix := "plan-" + applyResp.PlanID + "-diagnostics/"
+	for _, name := range []string{
+		"plan.json",
+		"executions.json",
+		"manifest.json",
+		"executions/" + createExec + "/logs.txt",
+		"executions/" + createExec + "/command-output.txt",
+		"executions/" + createExec + "/console.log",
+	} {
+		if _, ok := entries[prefix+name]; !ok {
+			t.Fatalf("expected archive entry %s, got %v", name, archiveNames(entries))
+		}
+	}
+	if !strings.Contains(entries[prefix+"executions/"+createExec+"/command-output.txt"], "hello from the guest") ||
+		strings.Contains(entries[prefix+"executions/"+createExec+"/command-output.txt"], "creating vm") {
+		t.Fatalf("unexpected command output: %q", entries[prefix+"executions/"+createExec+"/command-output.txt"])
+	}
+	if entries[prefix+"executions/"+createExec+"/console.log"] != "kernel panic\n" {
+		t.Fatalf("unexpected console log: %q", entries[prefix+"executions/"+createExec+"/console.log"])
+	}
+	var executions []store.Execution
+	if err := json.Unmarshal([]byte(entries[prefix+"executions.json"]), &executions); err != nil || len(executions) != 2 {
+		t.Fatalf("expected 2 executions in executions.json, got %d (%v)", len(executions), err)
+	}
+
+	if rec := doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/plans/"+applyResp.PlanID+"/diagnostics", plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for foreign site, got %d", rec.Code)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+uuid.NewString()+"/diagnostics", plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown plan, got %d", rec.Code)
+	}
+}
+
+func TestDiagnosticsBundleBudget(t *testing.T) {
+	b := &diagnosticsBundle{remaining: 10, truncated: []string{}}
+	b.add("a", []byte("123456"))
+	b.add("b", []byte("123456"))
+	b.add("c", []byte("1"))
+	if got := string(b.entries[1].content); got != "1234" {
+		t.Fatalf("expected b cut to the budget, got %q", got)
+	}
+	if len(b.entries[2].content) != 0 {
+		t.Fatalf("expected c to be empty past the budget")
+	}
+	if strings.Join(b.truncated, ",") != "b,c" {
+		t.Fatalf("expected b and c reported as truncated, got %v", b.truncated)
+	}
+}
+
+func readTarGz(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	out := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		out[hdr.Name] = string(b)
+	}
+}
+
+func archiveNames(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -2,32 +2,105 @@ package controlplane
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"net/smtp"
+	"sort"
+	"sync"
 	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email delivery states reported by EmailService.Delivery.
+const (
+	EmailStatusQueued   = "QUEUED"
+	EmailStatusRetrying = "RETRYING"
+	EmailStatusSent     = "SENT"
+	EmailStatusFailed   = "FAILED"
 )
 
-// EmailService handles sending emails
+const (
+	emailQueueSize         = 256
+	emailMaxBackoff        = 10 * time.Minute
+	emailDeliveryRetention = 24 * time.Hour
+)
+
+// Mailer delivers a single plain text message.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// EmailDelivery tracks one queued message.
+type EmailDelivery struct {
+	ID            string     `json:"id"`
+	To            string     `json:"to"`
+	Subject       string     `json:"subject"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	body string
+}
+
+// EmailService handles sending emails. Messages are queued and delivered by
+// a background worker so a slow or failing SMTP provider never blocks the
+// request that triggered them.
 type EmailService struct {
-	enabled  bool
-	host     string
-	port     int
-	user     string
-	password string
-	from     string
-	baseURL  string
+	enabled bool
+	baseURL string
+	mailer  Mailer
+
+	maxAttempts int
+	backoff     time.Duration
+	breaker     *circuitBreaker
+
+	queue chan string
+
+	mu         sync.Mutex
+	deliveries map[string]*EmailDelivery
 }
 
 // NewEmailService creates a new email service
 func NewEmailService(cfg Config) *EmailService {
+	var mailer Mailer
+	if cfg.SMTPHost != "" {
+		mailer = &smtpMailer{
+			host:     cfg.SMTPHost,
+			port:     cfg.SMTPPort,
+			user:     cfg.SMTPUser,
+			password: cfg.SMTPPassword,
+			from:     cfg.SMTPFrom,
+		}
+	}
+	return newEmailService(cfg, mailer)
+}
+
+func newEmailService(cfg Config, mailer Mailer) *EmailService {
+	maxAttempts := cfg.EmailMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	backoff := cfg.EmailRetryBackoff
+	if backoff <= 0 {
+		backoff = 5 * time.Second
+	}
 	return &EmailService{
-		enabled:  cfg.SMTPHost != "",
-		host:     cfg.SMTPHost,
-		port:     cfg.SMTPPort,
-		user:     cfg.SMTPUser,
-		password: cfg.SMTPPassword,
-		from:     cfg.SMTPFrom,
-		baseURL:  cfg.AppBaseURL,
+		enabled:     mailer != nil,
+		baseURL:     cfg.AppBaseURL,
+		mailer:      mailer,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		breaker:     newCircuitBreaker(cfg.EmailBreakerThreshold, cfg.EmailBreakerCooldown),
+		queue:       make(chan string, emailQueueSize),
+		deliveries:  make(map[string]*EmailDelivery),
 	}
 }
 
@@ -36,6 +109,46 @@ func (s *EmailService) IsEnabled() bool {
 	return s.enabled
 }
 
+// Start runs the delivery worker until ctx is cancelled.
+func (s *EmailService) Start(ctx context.Context) {
+	if !s.enabled {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-s.queue:
+				s.deliver(ctx, id)
+			}
+		}
+	}()
+}
+
+// Delivery returns the current state of a queued message.
+func (s *EmailService) Delivery(id string) (EmailDelivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return EmailDelivery{}, false
+	}
+	return *d, true
+}
+
+// Deliveries returns all tracked messages, newest first.
+func (s *EmailService) Deliveries() []EmailDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]EmailDelivery, 0, len(s.deliveries))
+	for _, d := range s.deliveries {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
 // SendVerificationEmail sends an email verification link
 func (s *EmailService) SendVerificationEmail(to, token string) error {
 	if !s.enabled {
@@ -117,21 +230,225 @@ The N-Kudo Team
 	return s.sendEmail(to, subject, body)
 }
 
-// sendEmail sends a plain text email
+func (a *App) handleListEmailDeliveries(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"deliveries":   a.emailService.Deliveries(),
+		"breaker_open": a.emailService.breaker.open(time.Now()),
+	})
+}
+
+// sendEmail queues a plain text email for background delivery.
 func (s *EmailService) sendEmail(to, subject, body string) error {
+	_, err := s.enqueue(to, subject, body)
+	return err
+}
+
+func (s *EmailService) enqueue(to, subject, body string) (string, error) {
 	if !s.enabled {
-		return nil
+		return "", nil
+	}
+	now := time.Now().UTC()
+	d := &EmailDelivery{
+		ID:        uuid.NewString(),
+		To:        to,
+		Subject:   subject,
+		Status:    EmailStatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+		body:      body,
+	}
+
+	s.mu.Lock()
+	s.pruneLocked(now)
+	s.deliveries[d.ID] = d
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- d.ID:
+		return d.ID, nil
+	default:
+		s.finish(d.ID, EmailStatusFailed, "email queue full")
+		return d.ID, errors.New("email queue full")
+	}
+}
+
+func (s *EmailService) deliver(ctx context.Context, id string) {
+	s.mu.Lock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		s.mu.Unlock()
+		return
 	}
+	to, subject, body := d.To, d.Subject, d.body
+	s.mu.Unlock()
 
-	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	if wait := s.breaker.allow(time.Now()); wait > 0 {
+		// Breaker is open; hold the message without spending an attempt.
+		s.retryAfter(ctx, id, wait, "")
+		return
+	}
+
+	s.mu.Lock()
+	d.Attempts++
+	attempts := d.Attempts
+	s.mu.Unlock()
+
+	err := s.mailer.Send(to, subject, body)
+	if err == nil {
+		s.breaker.success()
+		s.finish(id, EmailStatusSent, "")
+		return
+	}
+	s.breaker.failure(time.Now())
+	if attempts >= s.maxAttempts {
+		log.Printf("email delivery %s to %s failed after %d attempts: %v", id, to, attempts, err)
+		s.finish(id, EmailStatusFailed, err.Error())
+		return
+	}
+	backoff := s.backoff << (attempts - 1)
+	if backoff <= 0 || backoff > emailMaxBackoff {
+		backoff = emailMaxBackoff
+	}
+	s.retryAfter(ctx, id, backoff, err.Error())
+}
+
+// retryAfter puts a delivery back on the queue once wait has elapsed.
+func (s *EmailService) retryAfter(ctx context.Context, id string, wait time.Duration, lastErr string) {
+	next := time.Now().UTC().Add(wait)
+	s.mu.Lock()
+	if d, ok := s.deliveries[id]; ok {
+		if d.Attempts > 0 {
+			d.Status = EmailStatusRetrying
+		}
+		if lastErr != "" {
+			d.LastError = lastErr
+		}
+		d.NextAttemptAt = &next
+		d.UpdatedAt = time.Now().UTC()
+	}
+	s.mu.Unlock()
+
+	time.AfterFunc(wait, func() {
+		select {
+		case <-ctx.Done():
+		case s.queue <- id:
+		default:
+			s.finish(id, EmailStatusFailed, "email queue full")
+		}
+	})
+}
+
+func (s *EmailService) finish(id, status, lastErr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return
+	}
+	d.Status = status
+	if lastErr != "" {
+		d.LastError = lastErr
+	}
+	d.NextAttemptAt = nil
+	d.UpdatedAt = time.Now().UTC()
+	d.body = ""
+}
+
+// pruneLocked drops finished deliveries older than the retention window.
+func (s *EmailService) pruneLocked(now time.Time) {
+	for id, d := range s.deliveries {
+		done := d.Status == EmailStatusSent || d.Status == EmailStatusFailed
+		if done && now.Sub(d.UpdatedAt) > emailDeliveryRetention {
+			delete(s.deliveries, id)
+		}
+	}
+}
+
+// smtpMailer sends mail through an SMTP relay.
+type smtpMailer struct {
+	host     string
+	port     int
+	user     string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	addr := fmt.Sprintf("%s:%d", m.host, m.port)
 	msg := []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s", to, subject, body))
 
 	var auth smtp.Auth
-	if s.user != "" && s.password != "" {
-		auth = smtp.PlainAuth("", s.user, s.password, s.host)
+	if m.user != "" && m.password != "" {
+		auth = smtp.PlainAuth("", m.user, m.password, m.host)
 	}
 
-	return smtp.SendMail(addr, auth, s.from, []string{to}, msg)
+	return smtp.SendMail(addr, auth, m.from, []string{to}, msg)
+}
+
+// circuitBreaker stops delivery attempts after repeated consecutive
+// failures. Once the cooldown has passed a single trial attempt is let
+// through; success closes the breaker and failure opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = time.Minute
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports how long the caller must wait before attempting; zero means
+// the attempt may proceed now.
+func (b *circuitBreaker) allow(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return 0
+	}
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	if b.trial {
+		// Another trial is in flight; check back after a full cooldown.
+		return b.cooldown
+	}
+	b.trial = true
+	return 0
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// open reports whether the breaker is currently rejecting attempts.
+func (b *circuitBreaker) open(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold && now.Before(b.openUntil)
 }
 
 // Email template cache
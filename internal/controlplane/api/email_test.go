@@ -0,0 +1,159 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakyMailer struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	sent     []string
+}
+
+func (m *flakyMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.calls <= m.failures {
+		return errors.New("smtp: 421 service not available")
+	}
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func (m *flakyMailer) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func waitForDelivery(t *testing.T, svc *EmailService, id string, cond func(EmailDelivery) bool) EmailDelivery {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		d, ok := svc.Delivery(id)
+		if ok && cond(d) {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for delivery %s, last state %+v", id, d)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestEmailServiceRetriesUntilDelivered(t *testing.T) {
+	mailer := &flakyMailer{failures: 2}
+	svc := newEmailService(Config{
+		AppBaseURL:            "https://app.example",
+		EmailMaxAttempts:      5,
+		EmailRetryBackoff:     time.Millisecond,
+		EmailBreakerThreshold: 10,
+	}, mailer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc.Start(ctx)
+
+	if err := svc.SendVerificationEmail("user@example.com", "tok"); err != nil {
+		t.Fatalf("send verification email: %v", err)
+	}
+	deliveries := svc.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 tracked delivery, got %d", len(deliveries))
+	}
+
+	d := waitForDelivery(t, svc, deliveries[0].ID, func(d EmailDelivery) bool { return d.Status == EmailStatusSent })
+	if d.Attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", d.Attempts)
+	}
+	if d.LastError == "" {
+		t.Fatalf("expected last error from failed attempts to be kept")
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0] != "user@example.com" {
+		t.Fatalf("unexpected sent messages: %v", mailer.sent)
+	}
+}
+
+func TestEmailServiceMarksFailedAfterMaxAttempts(t *testing.T) {
+	mailer := &flakyMailer{failures: 100}
+	svc := newEmailService(Config{
+		EmailMaxAttempts:      2,
+		EmailRetryBackoff:     time.Millisecond,
+		EmailBreakerThreshold: 10,
+	}, mailer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc.Start(ctx)
+
+	id, err := svc.enqueue("user@example.com", "subject", "body")
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	d := waitForDelivery(t, svc, id, func(d EmailDelivery) bool { return d.Status == EmailStatusFailed })
+	if d.Attempts != 2 || mailer.callCount() != 2 {
+		t.Fatalf("expected 2 attempts, got delivery=%d mailer=%d", d.Attempts, mailer.callCount())
+	}
+}
+
+func TestEmailServiceBreakerOpensAfterRepeatedFailures(t *testing.T) {
+	mailer := &flakyMailer{failures: 100}
+	svc := newEmailService(Config{
+		EmailMaxAttempts:      10,
+		EmailRetryBackoff:     time.Millisecond,
+		EmailBreakerThreshold: 3,
+		EmailBreakerCooldown:  time.Hour,
+	}, mailer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc.Start(ctx)
+
+	id, err := svc.enqueue("user@example.com", "subject", "body")
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	waitForDelivery(t, svc, id, func(d EmailDelivery) bool {
+		return d.Attempts == 3 && d.NextAttemptAt != nil && time.Until(*d.NextAttemptAt) > time.Minute
+	})
+	if !svc.breaker.open(time.Now()) {
+		t.Fatalf("expected breaker to be open after 3 consecutive failures")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if calls := mailer.callCount(); calls != 3 {
+		t.Fatalf("expected no attempts while breaker is open, got %d calls", calls)
+	}
+	d, _ := svc.Delivery(id)
+	if d.Status != EmailStatusRetrying {
+		t.Fatalf("expected delivery to stay RETRYING, got %s", d.Status)
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrial(t *testing.T) {
+	b := newCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	b.failure(now)
+	if wait := b.allow(now); wait != 0 {
+		t.Fatalf("breaker opened before threshold")
+	}
+	b.failure(now)
+	if wait := b.allow(now); wait <= 0 {
+		t.Fatalf("expected breaker to be open")
+	}
+
+	later := now.Add(2 * time.Minute)
+	if wait := b.allow(later); wait != 0 {
+		t.Fatalf("expected trial attempt after cooldown, got wait %s", wait)
+	}
+	if wait := b.allow(later); wait == 0 {
+		t.Fatalf("expected only one trial attempt while half-open")
+	}
+	b.success()
+	if wait := b.allow(later); wait != 0 || b.open(later) {
+		t.Fatalf("expected breaker closed after successful trial")
+	}
+}
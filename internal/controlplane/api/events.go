@@ -0,0 +1,254 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// Site event types pushed on /sites/{siteID}/events/stream.
+const (
+	siteEventPlanStatus = "plan.status"
+	siteEventVMState    = "vm.state"
+	siteEventAgentState = "agent.state"
+)
+
+const (
+	// siteEventBuffer is the number of events queued per subscriber; a
+	// subscriber that falls further behind loses events rather than
+	// slowing down the request that published them.
+	siteEventBuffer = 64
+	// siteEventKeepalive is how often an idle stream gets a comment line so
+	// proxies keep the connection open.
+	siteEventKeepalive = 15 * time.Second
+)
+
+// siteEvent is a change to a plan, VM or agent in a site.
+type siteEvent struct {
+	Type          string    `json:"type"`
+	SiteID        string    `json:"site_id"`
+	ResourceID    string    `json:"resource_id"`
+	State         string    `json:"state"`
+	PreviousState string    `json:"previous_state,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+type siteEventSub struct {
+	ch    chan siteEvent
+	types map[string]bool
+}
+
+// siteEventHub fans site events out to the streams subscribed to the site.
+// Events are only built when a site has subscribers, so publishers check
+// watched first.
+type siteEventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[*siteEventSub]struct{}
+}
+
+func newSiteEventHub() *siteEventHub {
+	return &siteEventHub{subs: make(map[string]map[*siteEventSub]struct{})}
+}
+
+// subscribe registers a subscriber for siteID. types limits the event types
+// delivered; empty means all. The returned func unsubscribes.
+func (h *siteEventHub) subscribe(siteID string, types map[string]bool) (*siteEventSub, func()) {
+	sub := &siteEventSub{ch: make(chan siteEvent, siteEventBuffer), types: types}
+	h.mu.Lock()
+	if h.subs[siteID] == nil {
+		h.subs[siteID] = make(map[*siteEventSub]struct{})
+	}
+	h.subs[siteID][sub] = struct{}{}
+	h.mu.Unlock()
+	return sub, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[siteID], sub)
+		if len(h.subs[siteID]) == 0 {
+			delete(h.subs, siteID)
+		}
+	}
+}
+
+// watched reports whether any stream is subscribed to siteID.
+func (h *siteEventHub) watched(siteID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[siteID]) > 0
+}
+
+func (h *siteEventHub) publish(e siteEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[e.SiteID] {
+		if len(sub.types) > 0 && !sub.types[e.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+// parseSiteEventTypes parses the ?types= filter of the events stream.
+func parseSiteEventTypes(raw string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		switch t {
+		case siteEventPlanStatus, siteEventVMState, siteEventAgentState:
+			types[t] = true
+		default:
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return types, nil
+}
+
+// handleSiteEventStream streams a site's plan, VM and agent events as
+// Server-Sent Events until the client disconnects.
+func (a *App) handleSiteEventStream(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	types, err := parseSiteEventTypes(r.URL.Query().Get("types"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	_ = rc.SetWriteDeadline(time.Time{})
+	sub, unsubscribe := a.events.subscribe(siteID, types)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(siteEventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.ch:
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// siteWatched reports whether a stream or a tenant webhook wants the
+// site's events.
+func (a *App) siteWatched(ctx context.Context, siteID string) bool {
+	return a.events.watched(siteID) || a.webhooks.watched(ctx, siteID)
+}
+
+// publish sends e to the site's streams and webhooks.
+func (a *App) publish(ctx context.Context, e siteEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	a.events.publish(e)
+	a.webhooks.dispatch(ctx, e)
+}
+
+// vmStatesBefore snapshots a site's VM states ahead of a heartbeat so the
+// transitions it causes can be published. It returns nil when nobody
+// watches the site.
+func (a *App) vmStatesBefore(r *http.Request, agent store.Agent) map[string]string {
+	if !a.siteWatched(r.Context(), agent.SiteID) {
+		return nil
+	}
+	vms, err := a.repo.ListVMs(r.Context(), agent.TenantID, agent.SiteID)
+	if err != nil {
+		return nil
+	}
+	states := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		states[vm.ID] = vm.State
+	}
+	return states
+}
+
+// publishHeartbeatEvents publishes the agent coming online and the VM
+// transitions reported by an applied heartbeat.
+func (a *App) publishHeartbeatEvents(ctx context.Context, agent store.Agent, before map[string]string, vms []store.MicroVMHeartbeat) {
+	if !a.siteWatched(ctx, agent.SiteID) {
+		return
+	}
+	if agent.State != "ONLINE" {
+		a.publish(ctx, siteEvent{Type: siteEventAgentState, SiteID: agent.SiteID, ResourceID: agent.ID, State: "ONLINE", PreviousState: agent.State})
+	}
+	if before == nil {
+		return
+	}
+	for _, vm := range vms {
+		state := strings.ToUpper(vm.State)
+		if vm.ID == "" || before[vm.ID] == state {
+			continue
+		}
+		a.publish(ctx, siteEvent{Type: siteEventVMState, SiteID: agent.SiteID, ResourceID: vm.ID, State: state, PreviousState: before[vm.ID]})
+	}
+}
+
+// publishPlan publishes a plan's status.
+func (a *App) publishPlan(ctx context.Context, plan store.Plan) {
+	a.publish(ctx, siteEvent{Type: siteEventPlanStatus, SiteID: plan.SiteID, ResourceID: plan.ID, State: plan.Status})
+}
+
+// publishPlanStatus loads and publishes a plan's status after an agent
+// reported results for it.
+func (a *App) publishPlanStatus(r *http.Request, tenantID, siteID, planID string) {
+	if planID == "" || !a.siteWatched(r.Context(), siteID) {
+		return
+	}
+	plan, err := a.repo.GetPlan(r.Context(), tenantID, planID)
+	if err != nil {
+		return
+	}
+	a.publishPlan(r.Context(), plan)
+}
+
+// publishAgentsOffline publishes agents marked offline by the sweeper.
+func (a *App) publishAgentsOffline(ctx context.Context, agents []store.Agent) {
+	for _, agent := range agents {
+		a.publish(ctx, siteEvent{Type: siteEventAgentState, SiteID: agent.SiteID, ResourceID: agent.ID, State: "OFFLINE", PreviousState: agent.State})
+	}
+}
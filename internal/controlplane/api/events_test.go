@@ -0,0 +1,100 @@
+package controlplane
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestSiteEventStreamDeliversVMTransitions(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+
+	srv := httptest.NewServer(app.Handler())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-API-Key", plainAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %s: %v", path, err)
+		}
+		return resp
+	}
+	if resp := get("/sites/" + siteID + "/events/stream?types=bogus"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown event type, got %d", resp.StatusCode)
+	}
+	if resp := get("/sites/" + uuid.NewString() + "/events/stream"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for another site, got %d", resp.StatusCode)
+	}
+
+	resp := get("/sites/" + siteID + "/events/stream?types=vm.state")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("unexpected stream response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for !app.events.watched(siteID) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The agent's first heartbeat also brings it online, but the stream
+	// only asked for VM events.
+	vmID := uuid.NewString()
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"agent_id": agentID,
+		"hostname": "edge-host-1",
+		"microvms": []map[string]any{{"id": vmID, "name": "web", "state": "RUNNING"}},
+	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var eventType string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			eventType = v
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if eventType != siteEventVMState {
+			t.Fatalf("expected only vm.state events, got %q", eventType)
+		}
+		var e siteEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			t.Fatalf("decode event: %v", err)
+		}
+		if e.SiteID != siteID || e.ResourceID != vmID || e.State != "RUNNING" {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+		return
+	}
+	t.Fatalf("stream ended without a vm.state event: %v", scanner.Err())
+}
@@ -0,0 +1,204 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/controlplane/cache"
+)
+
+// maxFederatedResponseBytes caps how much of a home-region response is
+// relayed and cached.
+const maxFederatedResponseBytes = 8 << 20
+
+// federatedAuthHeaders are the credentials relayed to the home region, which
+// authenticates the request itself.
+var federatedAuthHeaders = []string{"X-API-Key", "X-Admin-Key", "Authorization"}
+
+// ParseRegionEndpoints parses a comma-separated list of region=baseURL.
+func ParseRegionEndpoints(spec string) (map[string]*url.URL, error) {
+	out := make(map[string]*url.URL)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		region, raw, ok := strings.Cut(entry, "=")
+		region = strings.TrimSpace(region)
+		if !ok || region == "" {
+			return nil, fmt.Errorf("invalid region endpoint %q: want region=url", entry)
+		}
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid region endpoint %q: url must be http(s)://host", entry)
+		}
+		out[region] = u
+	}
+	return out, nil
+}
+
+// federatedResponse is a home-region response kept for FederationCacheTTL.
+type federatedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// federation proxies reads of tenants homed in another region to that
+// region's control plane.
+type federation struct {
+	region    string
+	endpoints map[string]*url.URL
+	ttl       time.Duration
+	client    *http.Client
+	cache     Cache
+}
+
+// newFederation returns nil when no local region is configured, which
+// serves every tenant locally.
+func newFederation(cfg Config) (*federation, error) {
+	if strings.TrimSpace(cfg.Region) == "" {
+		return nil, nil
+	}
+	endpoints, err := ParseRegionEndpoints(cfg.RegionEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	return &federation{
+		region:    strings.TrimSpace(cfg.Region),
+		endpoints: endpoints,
+		ttl:       cfg.FederationCacheTTL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		cache:     cache.New(cfg.FederationCacheTTL, time.Minute),
+	}, nil
+}
+
+// federated serves tenantID routes of tenants homed in another region:
+// reads are proxied to the home-region control plane and cached briefly,
+// writes are refused with 421 so that they only ever land in the home
+// region. Local tenants, and every tenant when federation is off, go to
+// next. It runs after authentication, and an API key of another tenant
+// also goes to next, so neither the existence nor the home region of a
+// tenant is revealed to callers who may not see it.
+func (a *App) federated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.federation == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenantID := r.PathValue("tenantID")
+		if caller, ok := r.Context().Value(ctxTenantID{}).(string); ok && caller != tenantID {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.serveFederated(w, r, tenantID, next)
+	})
+}
+
+// federatedSite is federated for siteID routes. A site in the local store
+// belongs to the tenant recorded there and is served locally. A site this
+// region does not know can only be read by the tenant of the caller's API
+// key, so that tenant's home region serves it.
+func (a *App) federatedSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.federation == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		caller, _ := r.Context().Value(ctxTenantID{}).(string)
+		if caller == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		local, err := a.repo.SiteBelongsToTenant(r.Context(), r.PathValue("siteID"), caller)
+		if err != nil || local {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.serveFederated(w, r, caller, next)
+	})
+}
+
+// serveFederated proxies r to the home region of tenantID, or passes it to
+// next when the tenant is homed here or unknown.
+func (a *App) serveFederated(w http.ResponseWriter, r *http.Request, tenantID string, next http.Handler) {
+	tenant, err := a.repo.GetTenantByID(r.Context(), tenantID)
+	if err != nil || tenant.PrimaryRegion == "" || tenant.PrimaryRegion == a.federation.region {
+		next.ServeHTTP(w, r)
+		return
+	}
+	home := tenant.PrimaryRegion
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMisdirectedRequest, fmt.Sprintf("tenant is homed in region %s; send writes to its control plane", home))
+		return
+	}
+	resp, err := a.federation.read(r.Context(), home, r)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if resp.contentType != "" {
+		w.Header().Set("Content-Type", resp.contentType)
+	}
+	w.Header().Set("X-Nkudo-Region", home)
+	w.WriteHeader(resp.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(resp.body)
+	}
+}
+
+// read fetches r from the home region's control plane, or from the cache.
+// The cache key covers the caller's credentials, so one caller never sees
+// a response another caller was allowed to read.
+func (f *federation) read(ctx context.Context, home string, r *http.Request) (federatedResponse, error) {
+	base, ok := f.endpoints[home]
+	if !ok {
+		return federatedResponse{}, fmt.Errorf("no control plane configured for region %s", home)
+	}
+	target := base.JoinPath(r.URL.Path)
+	target.RawQuery = r.URL.RawQuery
+
+	key := sha256.New()
+	key.Write([]byte(target.String()))
+	for _, h := range federatedAuthHeaders {
+		key.Write([]byte("\x00" + r.Header.Get(h)))
+	}
+	cacheKey := "federation:" + hex.EncodeToString(key.Sum(nil))
+	if cached, ok := f.cache.Get(cacheKey); ok {
+		return cached.(federatedResponse), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return federatedResponse{}, fmt.Errorf("build request for region %s: %w", home, err)
+	}
+	for _, h := range federatedAuthHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if v := r.Header.Get("X-Request-ID"); v != "" {
+		req.Header.Set("X-Request-ID", v)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return federatedResponse{}, fmt.Errorf("control plane of region %s unavailable", home)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxFederatedResponseBytes))
+	if err != nil {
+		return federatedResponse{}, fmt.Errorf("read response from region %s: %w", home, err)
+	}
+	out := federatedResponse{status: res.StatusCode, contentType: res.Header.Get("Content-Type"), body: body}
+	if f.ttl > 0 && res.StatusCode == http.StatusOK {
+		f.cache.Set(cacheKey, out, f.ttl)
+	}
+	return out, nil
+}
@@ -0,0 +1,172 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestFederatedTenantRead(t *testing.T) {
+	var calls atomic.Int32
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("X-API-Key") != "nk_remote_key" {
+			writeError(w, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": r.URL.Path, "limit": r.URL.Query().Get("limit")})
+	}))
+	defer remote.Close()
+
+	repo := store.NewMemoryRepo()
+	cfg := LoadConfig()
+	cfg.AdminKey = "admin"
+	cfg.Region = "eu-central-1"
+	cfg.RegionEndpoints = "us-east-1=" + remote.URL
+	cfg.FederationCacheTTL = time.Minute
+	app, err := NewApp(cfg, repo)
+	if err != nil {
+		t.Fatalf("new app: %v", err)
+	}
+	remoteTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: remoteTenant, Slug: "remote", Name: "Remote", PrimaryRegion: "us-east-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: remoteTenant, Name: "remote", KeyHash: hashString("nk_remote_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	path := "/tenants/" + remoteTenant + "/sites?limit=5"
+	rec := doJSON(t, app.Handler(), "GET", path, "nk_remote_key", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the read to be proxied, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got["path"] != "/tenants/"+remoteTenant+"/sites" || got["limit"] != "5" {
+		t.Fatalf("expected the home region to see the original request, got %v", got)
+	}
+	if rec.Header().Get("X-Nkudo-Region") != "us-east-1" {
+		t.Fatalf("expected the home region header, got %q", rec.Header().Get("X-Nkudo-Region"))
+	}
+
+	// A repeat read is served from the cache.
+	doJSON(t, app.Handler(), "GET", path, "nk_remote_key", nil, nil)
+	if calls.Load() != 1 {
+		t.Fatalf("expected the repeat read to be cached, got %d remote calls", calls.Load())
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/tenants/"+remoteTenant+"/sites", "nk_remote_key", map[string]any{"name": "site-1"}, nil)
+	if rec.Code != http.StatusMisdirectedRequest || calls.Load() != 1 {
+		t.Fatalf("expected writes to be refused locally, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Tenants homed here are served locally.
+	localTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: localTenant, Slug: "local", Name: "Local", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: localTenant, Name: "local", KeyHash: hashString("nk_local_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+localTenant+"/sites", "nk_local_key", nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Nkudo-Region") != "" || calls.Load() != 1 {
+		t.Fatalf("expected a local read, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Callers that may not see the remote tenant learn nothing about it.
+	for _, key := range []string{"", "nk_unknown_key", "nk_local_key"} {
+		rec = doJSON(t, app.Handler(), "GET", path, key, nil, nil)
+		if rec.Code == http.StatusOK || rec.Header().Get("X-Nkudo-Region") != "" || calls.Load() != 1 {
+			t.Fatalf("key %q: expected a local refusal, got %d after %d calls: %s", key, rec.Code, calls.Load(), rec.Body.String())
+		}
+	}
+}
+
+func TestFederatedSiteRead(t *testing.T) {
+	var calls atomic.Int32
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("X-API-Key") != "nk_remote_key" {
+			writeError(w, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"path": r.URL.Path})
+	}))
+	defer remote.Close()
+
+	repo := store.NewMemoryRepo()
+	cfg := LoadConfig()
+	cfg.AdminKey = "admin"
+	cfg.Region = "eu-central-1"
+	cfg.RegionEndpoints = "us-east-1=" + remote.URL
+	app, err := NewApp(cfg, repo)
+	if err != nil {
+		t.Fatalf("new app: %v", err)
+	}
+	ctx := context.Background()
+	remoteTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: remoteTenant, Slug: "remote", Name: "Remote", PrimaryRegion: "us-east-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: remoteTenant, Name: "remote", KeyHash: hashString("nk_remote_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	// The remote tenant's site only exists in its home region.
+	remoteSite := uuid.NewString()
+	rec := doJSON(t, app.Handler(), "GET", "/sites/"+remoteSite+"/vms", "nk_remote_key", nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Nkudo-Region") != "us-east-1" {
+		t.Fatalf("expected the site read to be proxied, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got["path"] != "/sites/"+remoteSite+"/vms" {
+		t.Fatalf("expected the home region to see the original request, got %v", got)
+	}
+
+	// Sites homed here are served locally, and other tenants' keys never
+	// reach the remote region.
+	localTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: localTenant, Slug: "local", Name: "Local", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: localTenant, Name: "local", KeyHash: hashString("nk_local_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	localSite, err := repo.CreateSite(ctx, store.Site{ID: uuid.NewString(), TenantID: localTenant, Name: "local"})
+	if err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+localSite.ID+"/vms", "nk_local_key", nil, nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Nkudo-Region") != "" || calls.Load() != 1 {
+		t.Fatalf("expected a local read, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+remoteSite+"/vms", "nk_local_key", nil, nil)
+	if rec.Code == http.StatusOK || rec.Header().Get("X-Nkudo-Region") != "" || calls.Load() != 1 {
+		t.Fatalf("expected a local refusal, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseRegionEndpoints(t *testing.T) {
+	got, err := ParseRegionEndpoints("us-east-1=https://us.example.com, ap-south-1=http://10.0.0.1:8443")
+	if err != nil || len(got) != 2 || got["us-east-1"].Host != "us.example.com" {
+		t.Fatalf("unexpected endpoints %v, %v", got, err)
+	}
+	for _, spec := range []string{"us-east-1", "=https://x", "us-east-1=ftp://x", "us-east-1=https://"} {
+		if _, err := ParseRegionEndpoints(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package controlplane
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+)
+
+// heartbeatGate bounds how many heartbeats do their database work at once.
+// A full gate does not queue: the agent is told to come back after a short
+// jittered delay, which spreads a reconnecting fleet out instead of piling
+// it onto the database.
+type heartbeatGate struct {
+	slots chan struct{}
+}
+
+// newHeartbeatGate returns a gate admitting limit concurrent heartbeats; a
+// limit of zero or less admits them all.
+func newHeartbeatGate(limit int) *heartbeatGate {
+	if limit <= 0 {
+		return &heartbeatGate{}
+	}
+	return &heartbeatGate{slots: make(chan struct{}, limit)}
+}
+
+// tryAcquire takes a slot without waiting.
+func (g *heartbeatGate) tryAcquire() (release func(), ok bool) {
+	if g.slots == nil {
+		return func() {}, true
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return func() { <-g.slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// writeHeartbeatBusy sheds a heartbeat with 503 and a next_heartbeat_seconds
+// drawn from [1, interval] so shed agents do not retry in lockstep.
+func writeHeartbeatBusy(w http.ResponseWriter, interval int) {
+	next := 1
+	if interval > 1 {
+		next += rand.IntN(interval)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(next))
+	writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+		"error":                  "control plane busy, retry heartbeat later",
+		"next_heartbeat_seconds": next,
+	})
+}
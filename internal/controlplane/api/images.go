@@ -0,0 +1,97 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func (a *App) handleGetSiteImageDefaults(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	images, err := a.repo.GetSiteImageDefaults(r.Context(), tenantID, siteID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get image defaults")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"site_id": siteID, "images": images})
+}
+
+// handleSetSiteImageDefaults replaces the site's per-arch default images.
+// Plans already submitted keep the defaults they were created with.
+func (a *App) handleSetSiteImageDefaults(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	var req struct {
+		Images map[string]store.VMImage `json:"images"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	images, err := store.NormalizeImageDefaults(req.Images)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.repo.SetSiteImageDefaults(r.Context(), tenantID, siteID, images); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to set image defaults")
+		return
+	}
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "site.image_defaults.update", "site", siteID, requestID(r), sourceIP(r), nil)
+	writeJSON(w, http.StatusOK, map[string]any{"site_id": siteID, "images": images})
+}
+
+// validateActionImage checks the pinned image of a CREATE action. Image
+// defaults are filled in by the control plane, never by clients.
+func validateActionImage(action store.ApplyPlanAction) error {
+	if len(action.ImageDefaults) > 0 {
+		return fmt.Errorf("action %s: image_defaults is set by the control plane; use kernel_path and rootfs_path", action.OperationID)
+	}
+	if action.KernelPath == "" && action.RootfsPath == "" {
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") {
+		return fmt.Errorf("action %s: kernel_path and rootfs_path are only supported on CREATE", action.OperationID)
+	}
+	if _, err := store.NormalizeImageDefaults(map[string]store.VMImage{"amd64": {KernelPath: action.KernelPath, RootfsPath: action.RootfsPath}}); err != nil {
+		return fmt.Errorf("action %s: %s", action.OperationID, strings.TrimPrefix(err.Error(), "amd64: "))
+	}
+	return nil
+}
+
+// applyImageDefaults attaches the site's per-arch default images to CREATE
+// actions that do not pin an image. The host, and so its arch, is only
+// known once an agent leases the plan, so the agent picks among them.
+func (a *App) applyImageDefaults(ctx context.Context, tenantID, siteID string, actions []store.ApplyPlanAction) error {
+	var defaults map[string]store.VMImage
+	for i := range actions {
+		action := &actions[i]
+		if !strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") || action.RootfsPath != "" {
+			continue
+		}
+		if defaults == nil {
+			var err error
+			if defaults, err = a.repo.GetSiteImageDefaults(ctx, tenantID, siteID); err != nil {
+				return err
+			}
+			if len(defaults) == 0 {
+				return nil
+			}
+		}
+		action.ImageDefaults = defaults
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestSiteImageDefaultsFlowToLeasedCreate(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	path := "/sites/" + siteID + "/image-defaults"
+	for name, images := range map[string]map[string]any{
+		"unknown arch":     {"riscv64": map[string]any{"rootfs_path": "/images/rootfs.ext4"}},
+		"missing rootfs":   {"amd64": map[string]any{"kernel_path": "/images/vmlinux"}},
+		"relative path":    {"amd64": map[string]any{"rootfs_path": "images/rootfs.ext4"}},
+		"duplicated alias": {"amd64": map[string]any{"rootfs_path": "/a"}, "x86_64": map[string]any{"rootfs_path": "/b"}},
+	} {
+		if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"images": images}, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+	rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"images": map[string]any{
+		"x86_64": map[string]any{"kernel_path": "/images/amd64/vmlinux", "rootfs_path": "/images/amd64/rootfs.ext4"},
+		"arm64":  map[string]any{"kernel_path": "/images/arm64/Image", "rootfs_path": "/images/arm64/rootfs.ext4"},
+	}}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put image defaults status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	var got struct {
+		Images map[string]store.VMImage `json:"images"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &got)
+	if got.Images["amd64"].RootfsPath != "/images/amd64/rootfs.ext4" || got.Images["arm64"].KernelPath != "/images/arm64/Image" {
+		t.Fatalf("unexpected image defaults %+v", got.Images)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/image-defaults", plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for foreign site, got %d", rec.Code)
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-image-defaults",
+		"actions": []map[string]any{
+			{"operation_id": "create-default", "operation": "CREATE", "vm_id": "vm-default", "name": "vm-default"},
+			{"operation_id": "create-pinned", "operation": "CREATE", "vm_id": "vm-pinned", "name": "vm-pinned", "rootfs_path": "/custom/rootfs.ext4"},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	payload := leasedPlansToAgentPayload(leased, time.Hour, nil)
+	if len(payload) != 1 || len(payload[0].Actions) != 2 {
+		t.Fatalf("expected two leased creates, got %+v", payload)
+	}
+	for _, action := range payload[0].Actions {
+		var params struct {
+			VMID          string                   `json:"vm_id"`
+			RootfsPath    string                   `json:"rootfs_path"`
+			ImageDefaults map[string]store.VMImage `json:"image_defaults"`
+		}
+		if err := json.Unmarshal(action.Params, &params); err != nil {
+			t.Fatalf("decode params: %v", err)
+		}
+		switch params.VMID {
+		case "vm-default":
+			if params.RootfsPath != "" || len(params.ImageDefaults) != 2 || params.ImageDefaults["arm64"].RootfsPath != "/images/arm64/rootfs.ext4" {
+				t.Fatalf("expected per-arch defaults for the agent to choose from, got %+v", params)
+			}
+		case "vm-pinned":
+			if params.RootfsPath != "/custom/rootfs.ext4" || len(params.ImageDefaults) != 0 {
+				t.Fatalf("expected pinned image without defaults, got %+v", params)
+			}
+		default:
+			t.Fatalf("unexpected vm %s", params.VMID)
+		}
+	}
+
+	for name, action := range map[string]map[string]any{
+		"client defaults": {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "image_defaults": map[string]any{"amd64": map[string]any{"rootfs_path": "/x"}}},
+		"relative rootfs": {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "rootfs_path": "rootfs.ext4"},
+		"not a create":    {"operation_id": "s", "operation": "START", "vm_id": "vm-2", "rootfs_path": "/x"},
+	} {
+		rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": "plan-bad-image-" + name,
+			"actions":         []map[string]any{action},
+		}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// LogIngestConfig bounds how much of the log write path one tenant or agent
+// can take. Each tenant may run TenantConcurrency writes at once, scaled by
+// its weight; all tenants together run at most MaxConcurrency. Keeping the
+// tenant share below the total leaves room for quiet tenants when a noisy
+// one is saturated.
+type LogIngestConfig struct {
+	MaxConcurrency    int
+	TenantConcurrency int
+	// TenantWeights is "tenantID=weight,..."; unlisted tenants weigh 1.
+	TenantWeights string
+	// Wait is how long a request may queue for a write slot before it is
+	// rejected with 429; agents keep rejected entries and resend them.
+	Wait time.Duration
+	// AgentRate limits log requests per agent, whatever its tenant.
+	AgentRate RateLimit
+}
+
+// ParseTenantWeights parses a comma-separated list of tenantID=weight.
+func ParseTenantWeights(spec string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, raw, ok := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid tenant weight %q: want tenantID=weight", entry)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || w <= 0 || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid tenant weight %q: weight must be a positive number", entry)
+		}
+		out[id] = w
+	}
+	return out, nil
+}
+
+// logIngestGate hands out log write slots per tenant and overall.
+type logIngestGate struct {
+	cfg     LogIngestConfig
+	weights map[string]float64
+	global  chan struct{}
+	agents  *KeyedRateLimiter
+
+	mu      sync.Mutex
+	tenants map[string]chan struct{}
+}
+
+func newLogIngestGate(cfg LogIngestConfig) (*logIngestGate, error) {
+	weights, err := ParseTenantWeights(cfg.TenantWeights)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = 16
+	}
+	if cfg.TenantConcurrency <= 0 {
+		cfg.TenantConcurrency = 4
+	}
+	return &logIngestGate{
+		cfg:     cfg,
+		weights: weights,
+		global:  make(chan struct{}, cfg.MaxConcurrency),
+		agents:  NewKeyedRateLimiter(cfg.AgentRate),
+		tenants: make(map[string]chan struct{}),
+	}, nil
+}
+
+// tenantSlots returns the semaphore of tenantID, sized by its weight and
+// capped at MaxConcurrency.
+func (g *logIngestGate) tenantSlots(tenantID string) chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	slots, ok := g.tenants[tenantID]
+	if !ok {
+		weight, ok := g.weights[tenantID]
+		if !ok {
+			weight = 1
+		}
+		n := int(math.Round(float64(g.cfg.TenantConcurrency) * weight))
+		n = max(1, min(n, g.cfg.MaxConcurrency))
+		slots = make(chan struct{}, n)
+		g.tenants[tenantID] = slots
+	}
+	return slots
+}
+
+// acquire waits up to cfg.Wait for a tenant slot and then a global slot.
+// The returned release must be called once the write is done.
+func (g *logIngestGate) acquire(ctx context.Context, tenantID string) (func(), bool) {
+	ctx, cancel := context.WithTimeout(ctx, g.cfg.Wait)
+	defer cancel()
+	tenant := g.tenantSlots(tenantID)
+	select {
+	case tenant <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false
+	}
+	select {
+	case g.global <- struct{}{}:
+	case <-ctx.Done():
+		<-tenant
+		return nil, false
+	}
+	return func() {
+		<-g.global
+		<-tenant
+	}, true
+}
+
+// limitLogIngest applies the per-agent rate and per-tenant concurrency
+// limits to a log ingestion handler behind agentMTLSAuth.
+func (a *App) limitLogIngest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent := r.Context().Value(ctxAgent{}).(store.Agent)
+		if !a.logIngest.agents.Allow(agent.ID) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "agent log rate limit exceeded")
+			return
+		}
+		release, ok := a.logIngest.acquire(r.Context(), agent.TenantID)
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "log ingestion busy for tenant, retry later")
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
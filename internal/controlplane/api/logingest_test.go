@@ -0,0 +1,114 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTenantWeights(t *testing.T) {
+	weights, err := ParseTenantWeights(" tenant-a=2, tenant-b=0.5 ,")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if weights["tenant-a"] != 2 || weights["tenant-b"] != 0.5 || len(weights) != 2 {
+		t.Fatalf("unexpected weights %v", weights)
+	}
+	for _, bad := range []string{"tenant-a", "=2", "tenant-a=0", "tenant-a=-1", "tenant-a=x"} {
+		if _, err := ParseTenantWeights(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLogIngestGateWeightsAndGlobalCap(t *testing.T) {
+	gate, err := newLogIngestGate(LogIngestConfig{MaxConcurrency: 3, TenantConcurrency: 1, TenantWeights: "heavy=2", Wait: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("new gate: %v", err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, ok := gate.acquire(ctx, "heavy"); !ok {
+			t.Fatalf("heavy tenant should get %d slots", i+1)
+		}
+	}
+	if _, ok := gate.acquire(ctx, "heavy"); ok {
+		t.Fatalf("heavy tenant should be capped at 2 slots")
+	}
+	release, ok := gate.acquire(ctx, "light")
+	if !ok {
+		t.Fatalf("light tenant should get the remaining slot")
+	}
+	if _, ok := gate.acquire(ctx, "other"); ok {
+		t.Fatalf("global cap of 3 should be reached")
+	}
+	release()
+	if _, ok := gate.acquire(ctx, "other"); !ok {
+		t.Fatalf("released slot should be reusable")
+	}
+}
+
+func TestLogIngestNoisyTenantDoesNotStarveOthers(t *testing.T) {
+	t.Setenv("LOG_INGEST_MAX_CONCURRENCY", "4")
+	t.Setenv("LOG_INGEST_TENANT_CONCURRENCY", "2")
+	t.Setenv("LOG_INGEST_WAIT", "20ms")
+	app, _, tenantID, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+	send := func() int {
+		return doJSON(t, app.Handler(), "POST", "/agents/logs", "", map[string]any{
+			"entries": []map[string]any{{"execution_id": "exec-missing", "sequence": 1, "severity": "INFO", "message": "hello"}},
+		}, agentTLS).Code
+	}
+
+	// A noisy tenant holding all of its write slots takes only half the
+	// global capacity; the quiet tenant's frames are still accepted.
+	for i := 0; i < 2; i++ {
+		if _, ok := app.logIngest.acquire(context.Background(), "noisy-tenant"); !ok {
+			t.Fatalf("noisy tenant slot %d", i)
+		}
+	}
+	if _, ok := app.logIngest.acquire(context.Background(), "noisy-tenant"); ok {
+		t.Fatalf("noisy tenant should be limited to its share")
+	}
+	for i := 0; i < 5; i++ {
+		if code := send(); code != http.StatusOK {
+			t.Fatalf("quiet tenant frame %d: expected 200, got %d", i, code)
+		}
+	}
+
+	// Once the quiet tenant is itself saturated, its requests are shed.
+	for i := 0; i < 2; i++ {
+		if _, ok := app.logIngest.acquire(context.Background(), tenantID); !ok {
+			t.Fatalf("tenant slot %d", i)
+		}
+	}
+	if code := send(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 with tenant slots exhausted, got %d", code)
+	}
+}
+
+func TestLogIngestAgentRateLimit(t *testing.T) {
+	t.Setenv("LOG_INGEST_AGENT_RATE_PER_SECOND", "1")
+	t.Setenv("LOG_INGEST_AGENT_BURST", "2")
+	app, _, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		rec := doJSON(t, app.Handler(), "POST", "/v1/logs", "", map[string]any{
+			"execution_id": "exec-missing",
+			"sequence":     i + 1,
+			"level":        "INFO",
+			"message":      "hello",
+		}, agentTLS)
+		codes = append(codes, rec.Code)
+	}
+	if codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("expected third frame over the agent burst to get 429, got %v", codes)
+	}
+}
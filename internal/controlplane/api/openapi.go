@@ -0,0 +1,508 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// Security schemes of the API, as named in the OpenAPI spec.
+const (
+	authNone   = ""
+	authAdmin  = "AdminKeyAuth"
+	authAPIKey = "ApiKeyAuth"
+	authUser   = "BearerAuth"
+	authAgent  = "AgentMTLS"
+)
+
+// apiOperation documents one route of registerRoutes. Request and Response
+// are values of the types the handler decodes and encodes; their JSON
+// schemas are derived from the struct fields and tags, so the spec follows
+// the structs. A nil Response is documented as a JSON object.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Auth     string
+	Request  any
+	Response any
+	// Status is the success status; 200 when zero.
+	Status int
+}
+
+type listSitesResponse struct {
+	Sites []store.Site `json:"sites"`
+}
+
+// revokedCertificatesResponse is a page of GET /admin/certificates/revoked;
+// NextCursor is set when more entries follow.
+type revokedCertificatesResponse struct {
+	Certificates []store.CRLEntry `json:"certificates"`
+	NextCursor   string           `json:"next_cursor,omitempty"`
+}
+
+type listTenantsResponse struct {
+	Tenants []store.Tenant `json:"tenants"`
+}
+
+type createAPIKeyResponse struct {
+	ID        string     `json:"id"`
+	TenantID  string     `json:"tenant_id"`
+	Name      string     `json:"name"`
+	APIKey    string     `json:"api_key"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type enrollmentTokenResponse struct {
+	TokenID   string            `json:"token_id"`
+	SiteID    string            `json:"site_id"`
+	Token     string            `json:"token"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	OneTime   bool              `json:"one_time"`
+	Scope     *store.AgentScope `json:"scope,omitempty"`
+}
+
+type enrollResponse struct {
+	TenantID             string `json:"tenant_id"`
+	SiteID               string `json:"site_id"`
+	HostID               string `json:"host_id"`
+	AgentID              string `json:"agent_id"`
+	ClientCertificatePEM string `json:"client_certificate_pem"`
+	CACertificatePEM     string `json:"ca_certificate_pem"`
+	RefreshToken         string `json:"refresh_token"`
+	HeartbeatEndpoint    string `json:"heartbeat_endpoint"`
+	HeartbeatIntervalSec int    `json:"heartbeat_interval_sec"`
+	HeartbeatSeconds     int    `json:"heartbeat_interval_seconds"`
+	ServerVersion        string `json:"server_version"`
+}
+
+type heartbeatResponse struct {
+	NextHeartbeatSeconds int                 `json:"next_heartbeat_seconds"`
+	PendingPlans         []leasedPlanPayload `json:"pending_plans"`
+	Maintenance          bool                `json:"maintenance"`
+	TargetAgentVersion   string              `json:"target_agent_version,omitempty"`
+	ClockDriftSeconds    float64             `json:"clock_drift_seconds,omitempty"`
+	ReadOnly             bool                `json:"read_only,omitempty"`
+	DroppedMetrics       int                 `json:"dropped_metrics,omitempty"`
+	Stale                bool                `json:"stale,omitempty"`
+	// DNSRecords is set, possibly empty, when VM DNS hostnames are on.
+	DNSRecords *[]store.VMDNSRecord `json:"dns_records,omitempty"`
+}
+
+type ingestLogsResponse struct {
+	AcceptedFrames int64 `json:"accepted_frames"`
+	DroppedFrames  int64 `json:"dropped_frames"`
+	FilteredFrames int64 `json:"filtered_frames"`
+}
+
+type applyPlanResponse struct {
+	PlanID       string             `json:"plan_id"`
+	PlanVersion  int64              `json:"plan_version"`
+	PlanStatus   string             `json:"plan_status"`
+	RetriedFrom  string             `json:"retried_from,omitempty"`
+	Metadata     json.RawMessage    `json:"metadata,omitempty"`
+	Sequential   bool               `json:"sequential"`
+	Deduplicated bool               `json:"deduplicated"`
+	Executions   []store.Execution  `json:"executions"`
+	Progress     store.PlanProgress `json:"progress"`
+}
+
+type getPlanResponse struct {
+	PlanID      string              `json:"plan_id"`
+	PlanVersion int64               `json:"plan_version"`
+	PlanStatus  string              `json:"plan_status"`
+	CreatedAt   time.Time           `json:"created_at"`
+	RetriedFrom string              `json:"retried_from"`
+	Metadata    json.RawMessage     `json:"metadata,omitempty"`
+	Sequential  bool                `json:"sequential"`
+	Progress    *store.PlanProgress `json:"progress"`
+}
+
+type listVMsResponse struct {
+	VMs []store.MicroVM `json:"vms"`
+}
+
+type listHostsResponse struct {
+	Hosts []store.Host `json:"hosts"`
+}
+
+type listExecutionLogsResponse struct {
+	Logs []store.ExecutionLog `json:"logs"`
+}
+
+type connectivityHistoryResponse struct {
+	AgentID     string                         `json:"agent_id"`
+	From        time.Time                      `json:"from"`
+	To          time.Time                      `json:"to"`
+	Transitions []store.ConnectivityTransition `json:"transitions"`
+}
+
+type vmDNSRecordsResponse struct {
+	NetworkID string              `json:"network_id"`
+	Records   []store.VMDNSRecord `json:"records"`
+}
+
+type listAgentMetricsResponse struct {
+	Agents []store.AgentMetrics `json:"agents"`
+}
+
+type nextPlansResponse struct {
+	Plans []leasedPlanPayload `json:"plans"`
+}
+
+// apiOperations lists every route the control plane serves. TestOpenAPI
+// checks it against registerRoutes.
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/healthz", Summary: "Liveness check"},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness check with dependency status and build version"},
+	{Method: "GET", Path: "/version", Summary: "Control-plane build", Response: BuildInfo{}},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics"},
+	{Method: "GET", Path: "/openapi.json", Summary: "This OpenAPI document"},
+
+	{Method: "POST", Path: "/auth/register", Summary: "Register a user", Request: RegisterRequest{}, Response: AuthResponse{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/auth/login", Summary: "Log in", Request: LoginRequest{}, Response: AuthResponse{}},
+	{Method: "GET", Path: "/auth/me", Summary: "Current user", Auth: authUser},
+	{Method: "GET", Path: "/auth/verify-email", Summary: "Verify an email address with the emailed token"},
+	{Method: "POST", Path: "/auth/resend-verification", Summary: "Resend the verification email", Auth: authUser},
+	{Method: "POST", Path: "/invitations", Summary: "Invite a user to the current project", Auth: authUser, Request: CreateInvitationRequest{}, Response: InvitationResponse{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/invitations", Summary: "List invitations of the current project", Auth: authUser},
+	{Method: "DELETE", Path: "/invitations/{invitationID}", Summary: "Cancel an invitation", Auth: authUser},
+	{Method: "GET", Path: "/my/invitations", Summary: "List invitations for the current user", Auth: authUser},
+	{Method: "POST", Path: "/invitations/accept", Summary: "Accept an invitation with its token"},
+	{Method: "GET", Path: "/projects", Summary: "List the current user's projects", Auth: authUser},
+	{Method: "POST", Path: "/projects", Summary: "Create a project", Auth: authUser, Request: CreateProjectRequest{}, Response: ProjectResponse{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/projects/{projectID}", Summary: "Get a project", Auth: authUser, Response: ProjectResponse{}},
+	{Method: "POST", Path: "/projects/{projectID}/switch", Summary: "Switch the current project", Auth: authUser},
+	{Method: "GET", Path: "/my/project", Summary: "Current project", Auth: authUser, Response: ProjectResponse{}},
+
+	{Method: "POST", Path: "/tenants", Summary: "Create a tenant", Auth: authAdmin, Request: createTenantRequest{}, Response: store.Tenant{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tenants", Summary: "List tenants", Auth: authAdmin, Response: listTenantsResponse{}},
+	{Method: "POST", Path: "/tenants/{tenantID}/api-keys", Summary: "Create an API key", Auth: authAdmin, Response: createAPIKeyResponse{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tenants/{tenantID}/api-keys", Summary: "List API keys", Auth: authAPIKey},
+	{Method: "DELETE", Path: "/tenants/{tenantID}/api-keys/{keyID}", Summary: "Delete an API key", Auth: authAPIKey, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/tenants/{tenantID}/sites", Summary: "Create a site", Auth: authAPIKey, Request: createSiteRequest{}, Response: store.Site{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tenants/{tenantID}/sites", Summary: "List sites", Auth: authAPIKey, Response: listSitesResponse{}},
+	{Method: "GET", Path: "/tenants/{tenantID}/agents", Summary: "List agents across all sites", Auth: authAPIKey},
+	{Method: "POST", Path: "/tenants/{tenantID}/enrollment-tokens", Summary: "Issue a one-time enrollment token", Auth: authAPIKey, Request: enrollmentTokenRequest{}, Response: enrollmentTokenResponse{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tenants/{tenantID}/enrollment-tokens", Summary: "List enrollment tokens", Auth: authAPIKey},
+	{Method: "GET", Path: "/tenants/{tenantID}/enrollment-tokens/{tokenID}/cloud-init", Summary: "cloud-config that installs and enrolls the agent", Auth: authAPIKey},
+	{Method: "GET", Path: "/tenants/{tenantID}/usage", Summary: "Tenant usage against quota", Auth: authAPIKey},
+	{Method: "PUT", Path: "/tenants/{tenantID}/log-severity", Summary: "Set the minimum ingested log severity", Auth: authAPIKey, Response: store.Tenant{}},
+	{Method: "GET", Path: "/tenants/{tenantID}/usage/history", Summary: "Daily usage snapshots", Auth: authAPIKey},
+	{Method: "GET", Path: "/tenants/{tenantID}/capacity", Summary: "Capacity across the tenant's sites", Auth: authAPIKey},
+	{Method: "GET", Path: "/tenants/{tenantID}/audit-events", Summary: "List the tenant's audit events", Auth: authAPIKey},
+	{Method: "POST", Path: "/tenants/{tenantID}/webhooks", Summary: "Create a webhook", Auth: authAPIKey, Response: store.Webhook{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/tenants/{tenantID}/webhooks", Summary: "List webhooks", Auth: authAPIKey},
+	{Method: "DELETE", Path: "/tenants/{tenantID}/webhooks/{webhookID}", Summary: "Delete a webhook", Auth: authAPIKey, Status: http.StatusNoContent},
+
+	{Method: "POST", Path: "/enroll", Summary: "Enroll an agent with a one-time token", Request: enrollRequest{}, Response: enrollResponse{}},
+	{Method: "POST", Path: "/v1/enroll", Summary: "Enroll an agent with a one-time token", Request: enrollRequest{}, Response: enrollResponse{}},
+	{Method: "POST", Path: "/agents/heartbeat", Summary: "Agent heartbeat; leases pending plans", Auth: authAgent, Request: heartbeatRequest{}, Response: heartbeatResponse{}},
+	{Method: "POST", Path: "/v1/heartbeat", Summary: "Agent heartbeat; leases pending plans", Auth: authAgent, Request: heartbeatRequest{}, Response: heartbeatResponse{}},
+	{Method: "POST", Path: "/agents/logs", Summary: "Ingest execution logs", Auth: authAgent, Request: store.LogIngest{}, Response: ingestLogsResponse{}},
+	{Method: "POST", Path: "/v1/logs", Summary: "Ingest one execution log line", Auth: authAgent, Status: http.StatusAccepted},
+	{Method: "GET", Path: "/v1/plans/next", Summary: "Lease pending plans", Auth: authAgent, Response: nextPlansResponse{}},
+	{Method: "POST", Path: "/v1/executions/result", Summary: "Report plan action results", Auth: authAgent},
+	{Method: "POST", Path: "/v1/executions/console", Summary: "Upload a VM console log", Auth: authAgent},
+	{Method: "POST", Path: "/v1/unenroll", Summary: "Unenroll the agent", Auth: authAgent},
+	{Method: "POST", Path: "/v1/renew", Summary: "Renew the agent certificate", Auth: authAgent},
+	{Method: "POST", Path: "/v1/agent-upgrade", Summary: "Report an agent upgrade outcome", Auth: authAgent},
+	{Method: "GET", Path: "/v1/crl", Summary: "Certificate revocation list (DER)"},
+	{Method: "GET", Path: "/v1/crl.pem", Summary: "Certificate revocation list (PEM)"},
+
+	{Method: "POST", Path: "/sites/{siteID}/plans", Summary: "Apply a plan", Auth: authAPIKey, Request: applyPlanRequest{}, Response: applyPlanResponse{}},
+	{Method: "POST", Path: "/sites/{siteID}/plans/estimate", Summary: "Estimate a plan's resources against quota and capacity", Auth: authAPIKey, Request: applyPlanRequest{}, Response: planEstimate{}},
+	{Method: "GET", Path: "/sites/{siteID}/plan-stats", Summary: "Counts of the site's plans created between from and to (RFC 3339, default the last 7 days) by outcome, with the success percentage", Auth: authAPIKey, Response: planStatsResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/plans/{planID}", Summary: "Get a plan", Auth: authAPIKey, Response: getPlanResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/plans/{planID}/graph", Summary: "Plan actions as a dependency graph", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/plans/{planID}/diagnostics", Summary: "Plan diagnostics bundle (tar.gz)", Auth: authAPIKey},
+	{Method: "POST", Path: "/sites/{siteID}/plans/{planID}/retry", Summary: "Retry a failed plan", Auth: authAPIKey, Response: applyPlanResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/desired-state", Summary: "Get the site's desired state", Auth: authAPIKey},
+	{Method: "PUT", Path: "/sites/{siteID}/desired-state", Summary: "Set the site's desired state", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/image-defaults", Summary: "Get the site's default images", Auth: authAPIKey},
+	{Method: "PUT", Path: "/sites/{siteID}/image-defaults", Summary: "Set the site's default images", Auth: authAPIKey},
+	{Method: "PUT", Path: "/sites/{siteID}/vm-name-policy", Summary: "Set the unique VM name enforcement and default name template of the site", Auth: authAPIKey, Request: vmNamePolicy{}, Response: vmNamePolicy{}},
+	{Method: "GET", Path: "/sites/{siteID}/agent-rollout", Summary: "Get the site's agent rollout", Auth: authAPIKey, Response: store.AgentRollout{}},
+	{Method: "PUT", Path: "/sites/{siteID}/agent-rollout", Summary: "Set the site's agent rollout", Auth: authAPIKey, Response: store.AgentRollout{}},
+	{Method: "GET", Path: "/sites/{siteID}/hosts", Summary: "List hosts", Auth: authAPIKey, Response: listHostsResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/capacity", Summary: "Site capacity", Auth: authAPIKey},
+	{Method: "POST", Path: "/sites/{siteID}/hosts/{hostID}/maintenance", Summary: "Put a host in or out of maintenance", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/vms", Summary: "List VMs", Auth: authAPIKey, Response: listVMsResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/events/stream", Summary: "Server-sent events for the site", Auth: authAPIKey},
+	{Method: "POST", Path: "/sites/{siteID}/vms/{vmID}/migrate", Summary: "Migrate a VM to another host", Auth: authAPIKey, Response: store.VMMigration{}},
+	{Method: "GET", Path: "/sites/{siteID}/migrations/{migrationID}", Summary: "Get a VM migration", Auth: authAPIKey, Response: store.VMMigration{}},
+	{Method: "GET", Path: "/sites/{siteID}/agents/{agentID}/network", Summary: "Agent network status", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/agents/{agentID}/connectivity-history", Summary: "NetBird status transitions of the agent between from and to (RFC 3339, default the last 7 days)", Auth: authAPIKey, Response: connectivityHistoryResponse{}},
+	{Method: "PUT", Path: "/sites/{siteID}/agents/{agentID}/metadata", Summary: "Set operator metadata of an agent", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/agents/{agentID}/leased-plans", Summary: "Plans leased by an agent", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/agents/{agentID}/enrollment", Summary: "Enrollment token an agent consumed and its bootstrap details", Auth: authAPIKey, Response: store.AgentEnrollment{}},
+	{Method: "GET", Path: "/sites/{siteID}/prometheus-targets", Summary: "Prometheus HTTP service discovery targets", Auth: authAPIKey},
+	{Method: "GET", Path: "/sites/{siteID}/agent-metrics", Summary: "Metrics snapshots pushed by the site's agents; ?format=prometheus for text exposition", Auth: authAPIKey, Response: listAgentMetricsResponse{}},
+	{Method: "GET", Path: "/sites/{siteID}/executions", Summary: "List executions", Auth: authAPIKey},
+	{Method: "GET", Path: "/executions/{executionID}/logs", Summary: "List execution logs", Auth: authAPIKey, Response: listExecutionLogsResponse{}},
+	{Method: "GET", Path: "/executions/{executionID}/logs/stats", Summary: "Execution log counts by severity", Auth: authAPIKey, Response: store.ExecutionLogStats{}},
+	{Method: "GET", Path: "/executions/{executionID}/console", Summary: "Execution console log", Auth: authAPIKey, Response: store.ExecutionConsoleLog{}},
+
+	{Method: "POST", Path: "/admin/audit/verify", Summary: "Verify the audit chain", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/audit/events", Summary: "List audit events", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/audit/chain-info", Summary: "Audit chain state", Auth: authAdmin},
+	{Method: "POST", Path: "/admin/tenants/{tenantID}/revoke-all-certs", Summary: "Revoke every agent certificate of a tenant", Auth: authAdmin},
+	{Method: "POST", Path: "/admin/agents/sweep-offline", Summary: "Mark stale agents offline now", Auth: authAdmin},
+	{Method: "POST", Path: "/admin/encryption/rotate", Summary: "Re-encrypt columns with the active key", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/email/deliveries", Summary: "List email deliveries", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/ca", Summary: "Agent CA state", Auth: authAdmin},
+	{Method: "POST", Path: "/admin/ca/rotate", Summary: "Rotate the agent CA", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/certificates/revoked", Summary: "List revoked certificates, newest first", Auth: authAdmin, Response: revokedCertificatesResponse{}},
+	{Method: "GET", Path: "/admin/quota-templates", Summary: "List quota templates", Auth: authAdmin},
+	{Method: "GET", Path: "/admin/quota-templates/{name}", Summary: "Get a quota template", Auth: authAdmin, Response: store.QuotaTemplate{}},
+	{Method: "PUT", Path: "/admin/quota-templates/{name}", Summary: "Create or replace a quota template", Auth: authAdmin, Response: store.QuotaTemplate{}},
+	{Method: "DELETE", Path: "/admin/quota-templates/{name}", Summary: "Delete a quota template", Auth: authAdmin, Status: http.StatusNoContent},
+
+	{Method: "POST", Path: "/sites/{siteID}/vxlan-networks", Summary: "Create a VXLAN network", Auth: authAPIKey, Response: store.VXLANNetwork{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/sites/{siteID}/vxlan-networks", Summary: "List VXLAN networks", Auth: authAPIKey},
+	{Method: "GET", Path: "/vxlan-networks/{networkID}", Summary: "Get a VXLAN network", Auth: authAPIKey, Response: store.VXLANNetwork{}},
+	{Method: "GET", Path: "/vxlan-networks/{networkID}/tunnels", Summary: "List a network's tunnels", Auth: authAPIKey},
+	{Method: "DELETE", Path: "/vxlan-networks/{networkID}", Summary: "Delete a VXLAN network", Auth: authAPIKey, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/vxlan-networks/{networkID}/dns-records", Summary: "List the DNS records of a network's VMs", Auth: authAPIKey, Response: vmDNSRecordsResponse{}},
+	{Method: "GET", Path: "/vms/{vmID}/networks", Summary: "List a VM's network attachments", Auth: authAPIKey},
+	{Method: "POST", Path: "/vms/{vmID}/networks", Summary: "Attach a VM to a network", Auth: authAPIKey, Response: store.VMNetworkAttachment{}, Status: http.StatusCreated},
+	{Method: "DELETE", Path: "/vms/{vmID}/networks/{networkID}", Summary: "Detach a VM from a network", Auth: authAPIKey, Status: http.StatusNoContent},
+}
+
+var pathParamRE = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// errorStatuses are the documented error responses and what they mean.
+var errorStatuses = map[int]string{
+	http.StatusBadRequest:          "Invalid request",
+	http.StatusUnauthorized:        "Missing or invalid credentials",
+	http.StatusForbidden:           "Credentials do not grant access to the resource",
+	http.StatusNotFound:            "Resource not found",
+	http.StatusInternalServerError: "Internal error",
+	http.StatusServiceUnavailable:  "Unavailable; READ_ONLY_MODE while the control plane refuses writes",
+}
+
+// buildOpenAPISpec renders apiOperations as an OpenAPI 3.1 document.
+func buildOpenAPISpec(version string) map[string]any {
+	schemas := &schemaSet{types: map[string]reflect.Type{}, schemas: map[string]any{
+		"Error": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"error": map[string]any{"type": "string"},
+				"code":  map[string]any{"type": "string", "description": "Machine-readable code, e.g. READ_ONLY_MODE"},
+			},
+			"required": []string{"error"},
+		},
+	}}
+	paths := map[string]any{}
+	for _, op := range apiOperations {
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = op.render(schemas)
+	}
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "n-kudo Control Plane API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				authAdmin:  map[string]any{"type": "apiKey", "in": "header", "name": "X-Admin-Key"},
+				authAPIKey: map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				authUser:   map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				authAgent:  map[string]any{"type": "mutualTLS", "description": "Agent client certificate issued at enrollment"},
+			},
+		},
+	}
+}
+
+func (op apiOperation) render(schemas *schemaSet) map[string]any {
+	out := map[string]any{"summary": op.Summary, "operationId": operationID(op)}
+	if op.Auth == authNone {
+		out["security"] = []any{}
+	} else {
+		out["security"] = []any{map[string]any{op.Auth: []string{}}}
+	}
+	var params []any
+	for _, m := range pathParamRE.FindAllStringSubmatch(op.Path, -1) {
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	if params != nil {
+		out["parameters"] = params
+	}
+	if op.Request != nil {
+		out["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if status != http.StatusNoContent {
+		schema := map[string]any{"type": "object"}
+		if op.Response != nil {
+			schema = schemaOf(reflect.TypeOf(op.Response), schemas)
+		}
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schema}}
+	}
+	responses := map[string]any{strconv.Itoa(status): success}
+	errorCodes := []int{http.StatusInternalServerError}
+	if op.Auth != authNone {
+		errorCodes = append(errorCodes, http.StatusUnauthorized)
+	}
+	if params != nil {
+		errorCodes = append(errorCodes, http.StatusForbidden, http.StatusNotFound)
+	}
+	if op.Request != nil || op.Method != http.MethodGet {
+		errorCodes = append(errorCodes, http.StatusBadRequest)
+	}
+	if isWriteRequest(&http.Request{Method: op.Method, URL: &url.URL{Path: op.Path}}) {
+		errorCodes = append(errorCodes, http.StatusServiceUnavailable)
+	}
+	for _, code := range errorCodes {
+		responses[strconv.Itoa(code)] = map[string]any{
+			"description": errorStatuses[code],
+			"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}}},
+		}
+	}
+	out["responses"] = responses
+	return out
+}
+
+// operationID derives a stable operation ID from the method and path, e.g.
+// post_sites_siteID_plans.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_", ".", "_").Replace(op.Path)
+	return strings.TrimSuffix(id, "_")
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+// schemaSet collects the named schemas of a spec and the Go type each was
+// derived from.
+type schemaSet struct {
+	schemas map[string]any
+	types   map[string]reflect.Type
+}
+
+// schemaOf returns the JSON schema of t as encoding/json renders it. Named
+// struct types are added to schemas and referenced. Schemas are named after
+// the bare Go type name, so two documented types of the same name in
+// different packages panic rather than silently sharing one schema.
+func schemaOf(t reflect.Type, schemas *schemaSet) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "integer", "description": "nanoseconds"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if prev, ok := schemas.types[name]; ok && prev != t {
+			panic(fmt.Sprintf("openapi: schema %s would describe both %s and %s", name, prev, t))
+		}
+		if _, ok := schemas.schemas[name]; !ok {
+			schemas.types[name] = t
+			schemas.schemas[name] = map[string]any{} // breaks cycles
+			schemas.schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func structSchema(t reflect.Type, schemas *schemaSet) map[string]any {
+	props := map[string]any{}
+	addStructFields(t, props, schemas)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// addStructFields adds the JSON fields of t to props, inlining embedded
+// structs as encoding/json does.
+func addStructFields(t reflect.Type, props map[string]any, schemas *schemaSet) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(ft, props, schemas)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// handleOpenAPI serves the OpenAPI document of the API.
+func (a *App) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.Marshal(buildOpenAPISpec(a.cfg.Build.withDefaults().Version))
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIJSON)
+}
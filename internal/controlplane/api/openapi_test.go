@@ -0,0 +1,155 @@
+package controlplane
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var updateOpenAPI = flag.Bool("update", false, "rewrite api/openapi.json from apiOperations")
+
+// openAPIFile is the checked-in copy of the spec the frontend client is
+// generated from.
+const openAPIFile = "../../../api/openapi.json"
+
+func TestOpenAPISpec(t *testing.T) {
+	app, _, _, _, _ := newTestAppWithEnrollmentToken(t)
+	rr := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	raw := rr.Body.Bytes()
+	var spec struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		t.Fatalf("spec is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("unexpected openapi version %q", spec.OpenAPI)
+	}
+
+	core := map[string]string{
+		"/tenants":                              "post",
+		"/tenants/{tenantID}/sites":             "post",
+		"/tenants/{tenantID}/api-keys":          "post",
+		"/enroll":                               "post",
+		"/agents/heartbeat":                     "post",
+		"/sites/{siteID}/plans":                 "post",
+		"/sites/{siteID}/plans/{planID}":        "get",
+		"/executions/{executionID}/logs":        "get",
+		"/tenants/{tenantID}/enrollment-tokens": "post",
+	}
+	for path, method := range core {
+		op, ok := spec.Paths[path][method]
+		if !ok {
+			t.Fatalf("spec is missing %s %s", method, path)
+		}
+		if _, ok := op["responses"].(map[string]any)["500"]; !ok {
+			t.Fatalf("%s %s documents no error response", method, path)
+		}
+	}
+	plan := spec.Paths["/sites/{siteID}/plans"]["post"]
+	if plan["security"].([]any)[0].(map[string]any)[authAPIKey] == nil {
+		t.Fatalf("expected plans to require an API key, got %v", plan["security"])
+	}
+	if _, ok := plan["responses"].(map[string]any)["503"]; !ok {
+		t.Fatal("expected writes to document 503 READ_ONLY_MODE")
+	}
+
+	// Request schemas follow the structs.
+	apply, ok := spec.Components.Schemas["ApplyPlanRequest"].(map[string]any)
+	if !ok {
+		t.Fatal("expected an ApplyPlanRequest schema")
+	}
+	for _, field := range []string{"idempotency_key", "actions", "sequential"} {
+		if _, ok := apply["properties"].(map[string]any)[field]; !ok {
+			t.Fatalf("ApplyPlanRequest schema is missing %s", field)
+		}
+	}
+
+	// Every reference resolves.
+	for _, m := range regexp.MustCompile(`"#/components/schemas/([^"]+)"`).FindAllStringSubmatch(string(raw), -1) {
+		if _, ok := spec.Components.Schemas[m[1]]; !ok {
+			t.Fatalf("dangling reference to %s", m[1])
+		}
+	}
+}
+
+// TestOpenAPICoversRoutes keeps apiOperations in step with registerRoutes.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	src, err := os.ReadFile("server.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		key := op.Method + " " + op.Path
+		if documented[key] {
+			t.Fatalf("%s is documented twice", key)
+		}
+		documented[key] = true
+	}
+	registered := regexp.MustCompile(`a\.mux\.Handle(?:Func)?\("([A-Z]+ [^"]+)"`).FindAllStringSubmatch(string(src), -1)
+	if len(registered) == 0 {
+		t.Fatal("found no routes in server.go")
+	}
+	for _, m := range registered {
+		if !documented[m[1]] {
+			t.Errorf("route %s is not in apiOperations", m[1])
+		}
+		delete(documented, m[1])
+	}
+	for key := range documented {
+		t.Errorf("apiOperations documents %s, which is not registered", key)
+	}
+}
+
+func TestOpenAPISchemaNameCollision(t *testing.T) {
+	schemas := &schemaSet{schemas: map[string]any{}, types: map[string]reflect.Type{}}
+	schemaOf(reflect.TypeOf(x509.Certificate{}), schemas)
+	schemaOf(reflect.TypeOf(&x509.Certificate{}), schemas)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected two types named Certificate to be refused")
+		}
+	}()
+	schemaOf(reflect.TypeOf(tls.Certificate{}), schemas)
+}
+
+// TestOpenAPIFile keeps api/openapi.json in step with apiOperations; run
+// with -update to regenerate it.
+func TestOpenAPIFile(t *testing.T) {
+	want, err := json.MarshalIndent(buildOpenAPISpec(BuildInfo{}.withDefaults().Version), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, '\n')
+	if *updateOpenAPI {
+		if err := os.WriteFile(openAPIFile, want, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	got, err := os.ReadFile(openAPIFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("api/openapi.json is out of date; run go test ./internal/controlplane/api -run TestOpenAPIFile -update")
+	}
+}
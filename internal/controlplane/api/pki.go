@@ -8,19 +8,60 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
+// DefaultCALifetime is the validity of a generated CA when no lifetime is
+// configured.
+const DefaultCALifetime = 10 * 365 * 24 * time.Hour
+
+// DefaultCARotationOverlap is how long a replaced CA stays trusted when no
+// transition window is configured. It must exceed the agent certificate
+// TTL so that every agent renews against the new CA before the old one is
+// dropped.
+const DefaultCARotationOverlap = 7 * 24 * time.Hour
+
+// trustedUntilHeader marks in CA_PREVIOUS_CERT_FILE when a retired CA stops
+// being trusted.
+const trustedUntilHeader = "Trusted-Until"
+
+// InternalCA signs agent certificates. After Rotate, certificates are
+// signed by the new CA while the retired ones stay in the trust pool until
+// their transition window ends.
 type InternalCA struct {
+	mu      sync.RWMutex
 	cert    *x509.Certificate
 	key     *rsa.PrivateKey
 	certPEM []byte
+	retired []RetiredCA
+
+	// crlURL is embedded as the CRL distribution point of agent certs.
+	crlURL string
+
+	// Set when the CA was loaded from files; Rotate writes the new CA back.
+	certFile     string
+	keyFile      string
+	previousFile string
 }
 
-func LoadOrCreateInternalCA(commonName string, requirePersistent bool) (*InternalCA, error) {
+// RetiredCA is a CA replaced by Rotate. Client certificates it signed keep
+// validating until TrustedUntil.
+type RetiredCA struct {
+	Cert         *x509.Certificate
+	TrustedUntil time.Time
+}
+
+// LoadOrCreateInternalCA loads the CA from CA_CERT_FILE and CA_KEY_FILE, or
+// generates one valid for lifetime. Retired CAs still in their transition
+// window are read from CA_PREVIOUS_CERT_FILE.
+func LoadOrCreateInternalCA(commonName string, lifetime time.Duration, requirePersistent bool) (*InternalCA, error) {
 	certFile := os.Getenv("CA_CERT_FILE")
 	keyFile := os.Getenv("CA_KEY_FILE")
 	if certFile != "" || keyFile != "" {
@@ -39,19 +80,45 @@ func LoadOrCreateInternalCA(commonName string, requirePersistent bool) (*Interna
 		if err != nil {
 			return nil, err
 		}
-		return &InternalCA{cert: cert, key: key, certPEM: certPEM}, nil
+		ca := &InternalCA{
+			cert:         cert,
+			key:          key,
+			certPEM:      certPEM,
+			certFile:     certFile,
+			keyFile:      keyFile,
+			previousFile: os.Getenv("CA_PREVIOUS_CERT_FILE"),
+		}
+		if ca.previousFile != "" {
+			retired, err := loadRetiredCAs(ca.previousFile)
+			if err != nil {
+				return nil, err
+			}
+			ca.retired = retired
+		}
+		return ca, nil
 	}
 	if requirePersistent {
 		return nil, errors.New("REQUIRE_PERSISTENT_PKI=true requires CA_CERT_FILE and CA_KEY_FILE")
 	}
 
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	cert, key, certPEM, err := generateCA(commonName, lifetime)
 	if err != nil {
 		return nil, err
 	}
+	return &InternalCA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+func generateCA(commonName string, lifetime time.Duration) (*x509.Certificate, *rsa.PrivateKey, []byte, error) {
+	if lifetime <= 0 {
+		lifetime = DefaultCALifetime
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	now := time.Now().UTC()
 	tmpl := &x509.Certificate{
@@ -61,7 +128,7 @@ func LoadOrCreateInternalCA(commonName string, requirePersistent bool) (*Interna
 			Organization: []string{"n-kudo"},
 		},
 		NotBefore:             now.Add(-5 * time.Minute),
-		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		NotAfter:              now.Add(lifetime),
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		BasicConstraintsValid: true,
 		IsCA:                  true,
@@ -69,37 +136,204 @@ func LoadOrCreateInternalCA(commonName string, requirePersistent bool) (*Interna
 	}
 	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	cert, err := x509.ParseCertificate(der)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
-	return &InternalCA{cert: cert, key: key, certPEM: certPEM}, nil
+	return cert, key, certPEM, nil
+}
+
+// loadRetiredCAs reads a PEM bundle written by Rotate. A missing file means
+// nothing has been rotated yet; entries past their window are dropped.
+func loadRetiredCAs(path string) ([]RetiredCA, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var retired []RetiredCA
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		until, err := time.Parse(time.RFC3339, block.Headers[trustedUntilHeader])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s header: %w", path, trustedUntilHeader, err)
+		}
+		if until.After(now) {
+			retired = append(retired, RetiredCA{Cert: cert, TrustedUntil: until})
+		}
+	}
+	return retired, nil
 }
 
 func (c *InternalCA) CertPEM() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return append([]byte(nil), c.certPEM...)
 }
 
 func (c *InternalCA) Certificate() *x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.cert
 }
 
 func (c *InternalCA) Key() *rsa.PrivateKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.key
 }
 
-// CertPool returns a new cert pool containing the CA certificate
+// Retired returns the replaced CAs that are still trusted.
+func (c *InternalCA) Retired() []RetiredCA {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.retiredLocked(time.Now())
+}
+
+func (c *InternalCA) retiredLocked(now time.Time) []RetiredCA {
+	var out []RetiredCA
+	for _, r := range c.retired {
+		if r.TrustedUntil.After(now) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// CertPool returns a new cert pool with the current CA and the retired CAs
+// still in their transition window.
 func (c *InternalCA) CertPool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(c.certPEM); !ok {
-		return nil
+	pool.AddCert(c.cert)
+	for _, r := range c.retiredLocked(time.Now()) {
+		pool.AddCert(r.Cert)
 	}
 	return pool
 }
 
+// Verify checks that cert is a client certificate chaining to a trusted CA.
+func (c *InternalCA) Verify(cert *x509.Certificate) error {
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:     c.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// Rotate replaces the signing CA with a new one valid for lifetime. The old
+// CA stays trusted for overlap so that agents can renew their certificates
+// against the new one. A CA loaded from files is written back, with the
+// retired CAs going to CA_PREVIOUS_CERT_FILE.
+func (c *InternalCA) Rotate(commonName string, lifetime, overlap time.Duration) error {
+	if overlap <= 0 {
+		overlap = DefaultCARotationOverlap
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.certFile != "" && c.previousFile == "" {
+		return errors.New("CA_PREVIOUS_CERT_FILE must be set to rotate a CA loaded from files")
+	}
+	cert, key, certPEM, err := generateCA(commonName, lifetime)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	until := now.Add(overlap)
+	if until.After(c.cert.NotAfter) {
+		until = c.cert.NotAfter
+	}
+	retired := append(c.retiredLocked(now), RetiredCA{Cert: c.cert, TrustedUntil: until.UTC()})
+	if c.certFile != "" {
+		if err := c.persistLocked(key, certPEM, retired); err != nil {
+			return err
+		}
+	}
+	c.cert, c.key, c.certPEM, c.retired = cert, key, certPEM, retired
+	return nil
+}
+
+// persistLocked writes the retired bundle before the new CA so that a
+// failure part way never leaves the old CA untrusted.
+func (c *InternalCA) persistLocked(key *rsa.PrivateKey, certPEM []byte, retired []RetiredCA) error {
+	var bundle []byte
+	for _, r := range retired {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{
+			Type:    "CERTIFICATE",
+			Headers: map[string]string{trustedUntilHeader: r.TrustedUntil.Format(time.RFC3339)},
+			Bytes:   r.Cert.Raw,
+		})...)
+	}
+	if err := writeFileAtomic(c.previousFile, bundle, 0o644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := writeFileAtomic(c.keyFile, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.certFile, certPEM, 0o644)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetCRLDistributionPoint makes agent certificates signed from now on name
+// crlURL as their CRL distribution point, so generic TLS stacks can check
+// revocation. An empty crlURL leaves the extension out.
+func (c *InternalCA) SetCRLDistributionPoint(crlURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crlURL = crlURL
+}
+
+// ValidateCRLURL checks that a CRL distribution point is an absolute
+// http(s) URL, the only scheme agents and generic clients fetch.
+func ValidateCRLURL(raw string) error {
+	if raw == "" {
+		return errors.New("CRL_DISTRIBUTION_POINT requires CRL_URL")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid CRL_URL %q: want an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
 func (c *InternalCA) SignAgentCSR(csrPEM []byte, agentID, tenantID, siteID string, ttl time.Duration) (certPEM []byte, serial string, err error) {
 	_ = tenantID
 	_ = siteID
@@ -119,10 +353,6 @@ func (c *InternalCA) SignAgentCSR(csrPEM []byte, agentID, tenantID, siteID strin
 		return nil, "", err
 	}
 	now := time.Now().UTC()
-
-	// Get CRL URL from environment
-	crlURL := os.Getenv("CRL_URL")
-
 	tmpl := &x509.Certificate{
 		SerialNumber: serialNum,
 		Subject: pkix.Name{
@@ -135,12 +365,12 @@ func (c *InternalCA) SignAgentCSR(csrPEM []byte, agentID, tenantID, siteID strin
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
-	// Add CRL Distribution Point if configured
-	if crlURL != "" {
-		tmpl.CRLDistributionPoints = []string{crlURL}
+	c.mu.RLock()
+	if c.crlURL != "" {
+		tmpl.CRLDistributionPoints = []string{c.crlURL}
 	}
-
 	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, csr.PublicKey, c.key)
+	c.mu.RUnlock()
 	if err != nil {
 		return nil, "", err
 	}
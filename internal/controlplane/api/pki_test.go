@@ -1,11 +1,24 @@
 package controlplane
 
-import "testing"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
 
 func TestLoadOrCreateInternalCARequirePersistent(t *testing.T) {
 	t.Setenv("CA_CERT_FILE", "")
 	t.Setenv("CA_KEY_FILE", "")
-	if _, err := LoadOrCreateInternalCA("test-ca", true); err == nil {
+	if _, err := LoadOrCreateInternalCA("test-ca", 0, true); err == nil {
 		t.Fatalf("expected error when persistent pki is required without files")
 	}
 }
@@ -17,3 +30,198 @@ func TestGenerateServerTLSCertRequirePersistent(t *testing.T) {
 		t.Fatalf("expected error when persistent pki is required without files")
 	}
 }
+
+func TestInternalCARotationTrustsOldAndNewCerts(t *testing.T) {
+	t.Setenv("CA_CERT_FILE", "")
+	t.Setenv("CA_KEY_FILE", "")
+	ca, err := LoadOrCreateInternalCA("test-ca", 48*time.Hour, false)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	if until := time.Until(ca.Certificate().NotAfter); until > 48*time.Hour || until < 47*time.Hour {
+		t.Fatalf("expected ca lifetime of 48h, expires in %s", until)
+	}
+
+	oldPEM, _, err := ca.SignAgentCSR(makeCSR(t), "agent-old", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("sign with old ca: %v", err)
+	}
+	oldCA := ca.Certificate()
+	if err := ca.Rotate("test-ca", 48*time.Hour, time.Hour); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if ca.Certificate().Equal(oldCA) {
+		t.Fatalf("expected a new ca after rotation")
+	}
+	newPEM, _, err := ca.SignAgentCSR(makeCSR(t), "agent-new", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("sign with new ca: %v", err)
+	}
+	oldCert, newCert := parseCert(t, oldPEM), parseCert(t, newPEM)
+	if err := newCert.CheckSignatureFrom(ca.Certificate()); err != nil {
+		t.Fatalf("expected new cert to chain to the current ca: %v", err)
+	}
+
+	if err := ca.Verify(oldCert); err != nil {
+		t.Fatalf("expected old cert to validate during the transition window: %v", err)
+	}
+	if err := ca.Verify(newCert); err != nil {
+		t.Fatalf("expected new cert to validate: %v", err)
+	}
+	retired := ca.Retired()
+	if len(retired) != 1 || !retired[0].Cert.Equal(oldCA) {
+		t.Fatalf("expected the old ca to be retired, got %+v", retired)
+	}
+
+	// End the transition window.
+	ca.retired[0].TrustedUntil = time.Now().Add(-time.Second)
+	if err := ca.Verify(oldCert); err == nil {
+		t.Fatalf("expected old cert to be rejected after the transition window")
+	}
+	if err := ca.Verify(newCert); err != nil {
+		t.Fatalf("expected new cert to validate after the transition window: %v", err)
+	}
+}
+
+func TestInternalCARotatePersistsToFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	previousFile := filepath.Join(dir, "ca-previous.crt")
+	_, key, certPEM, err := generateCA("test-ca", time.Hour)
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CA_CERT_FILE", certFile)
+	t.Setenv("CA_KEY_FILE", keyFile)
+	t.Setenv("CA_PREVIOUS_CERT_FILE", "")
+
+	ca, err := LoadOrCreateInternalCA("test-ca", 0, true)
+	if err != nil {
+		t.Fatalf("load ca: %v", err)
+	}
+	if err := ca.Rotate("test-ca", time.Hour, time.Hour); err == nil {
+		t.Fatalf("expected rotation of a file-backed ca to require CA_PREVIOUS_CERT_FILE")
+	}
+
+	t.Setenv("CA_PREVIOUS_CERT_FILE", previousFile)
+	ca, err = LoadOrCreateInternalCA("test-ca", 0, true)
+	if err != nil {
+		t.Fatalf("load ca: %v", err)
+	}
+	oldPEM, _, err := ca.SignAgentCSR(makeCSR(t), "agent-old", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("sign with old ca: %v", err)
+	}
+	if err := ca.Rotate("test-ca", time.Hour, 30*time.Minute); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	reloaded, err := LoadOrCreateInternalCA("test-ca", 0, true)
+	if err != nil {
+		t.Fatalf("reload ca: %v", err)
+	}
+	if !reloaded.Certificate().Equal(ca.Certificate()) {
+		t.Fatalf("expected the rotated ca to be persisted")
+	}
+	if err := reloaded.Verify(parseCert(t, oldPEM)); err != nil {
+		t.Fatalf("expected old cert to validate after reload: %v", err)
+	}
+	retired := reloaded.Retired()
+	if len(retired) != 1 || time.Until(retired[0].TrustedUntil) > 30*time.Minute {
+		t.Fatalf("expected the transition window to survive reload, got %+v", retired)
+	}
+}
+
+func TestIssuedAgentCertNamesCRLDistributionPoint(t *testing.T) {
+	t.Setenv("CA_CERT_FILE", "")
+	t.Setenv("CA_KEY_FILE", "")
+	cfg := LoadConfig()
+	cfg.CRLDistributionPoint = true
+	if _, err := NewApp(cfg, store.NewMemoryRepo()); err == nil {
+		t.Fatal("expected enabling the distribution point without CRL_URL to fail")
+	}
+	cfg.CRLURL = "ftp://cp.example.com/v1/crl"
+	if _, err := NewApp(cfg, store.NewMemoryRepo()); err == nil {
+		t.Fatal("expected a non-http CRL_URL to be rejected")
+	}
+
+	const crlURL = "https://cp.example.com/v1/crl"
+	cfg.CRLURL = crlURL
+	app, err := NewApp(cfg, store.NewMemoryRepo())
+	if err != nil {
+		t.Fatalf("new app: %v", err)
+	}
+	certPEM, _, err := app.ca.SignAgentCSR(makeCSR(t), "agent-1", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	cert := parseCert(t, certPEM)
+	if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != crlURL {
+		t.Fatalf("expected the CRL URL as distribution point, got %v", cert.CRLDistributionPoints)
+	}
+
+	app.ca.SetCRLDistributionPoint("")
+	certPEM, _, err = app.ca.SignAgentCSR(makeCSR(t), "agent-2", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if cert := parseCert(t, certPEM); len(cert.CRLDistributionPoints) != 0 {
+		t.Fatalf("expected no distribution point once disabled, got %v", cert.CRLDistributionPoints)
+	}
+}
+
+// revocationDownRepo fails every revocation lookup, as during a database
+// outage.
+type revocationDownRepo struct {
+	*store.MemoryRepo
+}
+
+func (revocationDownRepo) IsCertificateRevoked(context.Context, string) (bool, error) {
+	return false, errors.New("database unavailable")
+}
+
+func TestIndeterminateRevocationStatus(t *testing.T) {
+	app, repo, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	resp := enroll(t, app, enrollToken, makeCSR(t))
+	cert := parseCert(t, []byte(resp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	app.repo = revocationDownRepo{MemoryRepo: repo}
+	seq := 0
+	heartbeat := func() int {
+		seq++
+		return doJSON(t, app.Handler(), "POST", "/agents/heartbeat", "", map[string]any{
+			"agent_id":      resp["agent_id"],
+			"heartbeat_seq": seq,
+			"hostname":      "edge-host-1",
+		}, tlsState).Code
+	}
+
+	// Fail-open, the default, lets the agent in on the CRL check alone.
+	if code := heartbeat(); code != http.StatusOK {
+		t.Fatalf("expected fail-open to accept the agent, got %d", code)
+	}
+
+	// Fail-closed rejects it while the CRL is older than CRL_MAX_AGE ...
+	app.cfg.RevocationFailClosed = true
+	if code := heartbeat(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected fail-closed to reject the agent, got %d", code)
+	}
+	app.cfg.CRLMaxAge = time.Nanosecond
+	if code := heartbeat(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a stale CRL not to vouch for the agent, got %d", code)
+	}
+
+	// ... and trusts a CRL updated within it.
+	app.cfg.CRLMaxAge = time.Hour
+	if code := heartbeat(); code != http.StatusOK {
+		t.Fatalf("expected a fresh CRL to decide, got %d", code)
+	}
+}
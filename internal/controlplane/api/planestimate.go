@@ -0,0 +1,114 @@
+package controlplane
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/controlplane/tenant"
+)
+
+// planEstimate is what a plan would allocate if applied, and whether that
+// fits the tenant's quota and the site's free host capacity. Requests are
+// what capacity accounting reserves; limits are what the VMs are sized to.
+type planEstimate struct {
+	Actions          int            `json:"actions"`
+	Creates          int            `json:"creates"`
+	VCPURequest      int64          `json:"vcpu_request"`
+	VCPULimit        int64          `json:"vcpu_limit"`
+	MemoryRequestMiB int64          `json:"memory_request_mib"`
+	MemoryLimitMiB   int64          `json:"memory_limit_mib"`
+	DiskMiB          int64          `json:"disk_mib"`
+	Capacity         store.Capacity `json:"capacity"`
+	FitsCapacity     bool           `json:"fits_capacity"`
+	FitsQuota        bool           `json:"fits_quota"`
+	QuotaViolations  []string       `json:"quota_violations"`
+	Fits             bool           `json:"fits"`
+}
+
+// estimatePlan sums the resources the CREATE actions of actions allocate.
+// The actions must have gone through store.ResolveResources.
+func estimatePlan(actions []store.ApplyPlanAction) planEstimate {
+	est := planEstimate{Actions: len(actions), QuotaViolations: []string{}}
+	for _, action := range actions {
+		if !strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") {
+			continue
+		}
+		est.Creates++
+		est.VCPURequest += int64(action.VCPURequest)
+		est.VCPULimit += int64(action.VCPULimit)
+		est.MemoryRequestMiB += action.MemoryRequestMiB
+		est.MemoryLimitMiB += action.MemoryLimitMiB
+		for _, disk := range action.Disks {
+			est.DiskMiB += disk.SizeMiB
+		}
+	}
+	return est
+}
+
+// handleEstimatePlan is a dry run of handleApplyPlan: it takes the same
+// body, validates it the same way and reports what the plan would
+// allocate, without creating anything.
+func (a *App) handleEstimatePlan(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	var req struct {
+		Actions []store.ApplyPlanAction `json:"actions"`
+	}
+	if err := decodeJSONAllowUnknown(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Actions) == 0 {
+		writeError(w, http.StatusBadRequest, "actions are required")
+		return
+	}
+	if err := a.validatePlanActions(req.Actions); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	actions, err := store.ResolveResources(req.Actions)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	est := estimatePlan(actions)
+
+	est.Capacity, err = a.repo.GetCapacity(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get capacity")
+		return
+	}
+	est.FitsCapacity = est.VCPURequest <= est.Capacity.VCPUAvailable &&
+		est.MemoryRequestMiB*1024*1024 <= est.Capacity.MemoryBytesAvailable
+
+	for _, check := range []struct {
+		resource tenant.QuotaResourceType
+		count    int
+	}{
+		{tenant.QuotaResourcePlan, 1},
+		{tenant.QuotaResourceVM, est.Creates},
+	} {
+		err := a.quotaManager.CheckQuotaWithCount(r.Context(), tenantID, check.resource, check.count)
+		switch {
+		case errors.Is(err, tenant.ErrQuotaExceeded):
+			est.QuotaViolations = append(est.QuotaViolations, err.Error())
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, "failed to check quota")
+			return
+		}
+	}
+	est.FitsQuota = len(est.QuotaViolations) == 0
+	est.Fits = est.FitsCapacity && est.FitsQuota
+	writeJSON(w, http.StatusOK, est)
+}
@@ -0,0 +1,91 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/controlplane/tenant"
+)
+
+func TestEstimatePlan(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	apiKey := "nk_estimate_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "estimate", KeyHash: hashString(apiKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	// One 8-core, 16 GiB host.
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"agent_id":      enrollResp["agent_id"].(string),
+		"heartbeat_seq": 1,
+		"hostname":      "edge-estimate",
+		"host_facts":    map[string]any{"cpu_cores": 8, "memory_total_bytes": int64(16 * 1024 * 1024 * 1024)},
+	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	path := "/sites/" + siteID + "/plans/estimate"
+	body := map[string]any{
+		"idempotency_key": "estimate-1",
+		"actions": []map[string]any{
+			{"operation_id": "op-1", "operation": "CREATE", "vm_id": "vm-1", "name": "vm-1", "vcpu_request": 1, "vcpu_limit": 2, "memory_mib": 1024, "disks": []map[string]any{{"size_mib": 2048}}},
+			{"operation_id": "op-2", "operation": "CREATE", "vm_id": "vm-2", "name": "vm-2", "vcpu_count": 2, "memory_request": 512, "memory_limit": 2048},
+			{"operation_id": "op-3", "operation": "STOP", "vm_id": "vm-9"},
+		},
+	}
+	var est planEstimate
+	rec = doJSON(t, app.Handler(), "POST", path, apiKey, body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("estimate status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	mustDecode(t, rec.Body.Bytes(), &est)
+	want := planEstimate{Actions: 3, Creates: 2, VCPURequest: 3, VCPULimit: 4, MemoryRequestMiB: 1536, MemoryLimitMiB: 3072, DiskMiB: 2048}
+	if est.Actions != want.Actions || est.Creates != want.Creates || est.VCPURequest != want.VCPURequest || est.VCPULimit != want.VCPULimit ||
+		est.MemoryRequestMiB != want.MemoryRequestMiB || est.MemoryLimitMiB != want.MemoryLimitMiB || est.DiskMiB != want.DiskMiB {
+		t.Fatalf("estimate %+v does not match the actions, want %+v", est, want)
+	}
+	if !est.FitsCapacity || !est.FitsQuota || !est.Fits || est.Capacity.VCPUAvailable != 8 {
+		t.Fatalf("expected the plan to fit, got %+v", est)
+	}
+
+	// Nothing was created.
+	if usage, _ := repo.GetTenantUsage(context.Background(), tenantID); usage.ActivePlans != 0 || usage.VMs != 0 {
+		t.Fatalf("expected an estimate not to create anything, got %+v", usage)
+	}
+
+	// One VM allowed: the two creates exceed the quota.
+	limits := tenant.DefaultQuotaLimits()
+	limits.MaxVMsPerAgent = 1
+	app.quotaManager.SetLimits(tenantID, limits)
+	rec = doJSON(t, app.Handler(), "POST", path, apiKey, body, nil)
+	est = planEstimate{}
+	mustDecode(t, rec.Body.Bytes(), &est)
+	if est.FitsQuota || est.Fits || len(est.QuotaViolations) != 1 || !strings.Contains(est.QuotaViolations[0], "VMs") {
+		t.Fatalf("expected the plan to be flagged over quota, got %+v", est)
+	}
+	if !est.FitsCapacity {
+		t.Fatalf("expected capacity to be judged on its own, got %+v", est)
+	}
+
+	// More vCPUs than the host has free.
+	body["actions"] = []map[string]any{{"operation_id": "op-1", "operation": "CREATE", "vm_id": "vm-big", "name": "vm-big", "vcpu_count": 16, "memory_mib": 1024}}
+	rec = doJSON(t, app.Handler(), "POST", path, apiKey, body, nil)
+	est = planEstimate{}
+	mustDecode(t, rec.Body.Bytes(), &est)
+	if est.FitsCapacity || est.Fits {
+		t.Fatalf("expected the plan to exceed host capacity, got %+v", est)
+	}
+
+	body["actions"] = []map[string]any{{"operation_id": "op-1", "operation": "CREATE", "vm_id": "vm-bad", "name": "vm-bad", "vcpu_request": 4, "vcpu_limit": 2}}
+	if rec := doJSON(t, app.Handler(), "POST", path, apiKey, body, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid resources to be rejected, got %d", rec.Code)
+	}
+}
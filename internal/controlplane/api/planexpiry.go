@@ -0,0 +1,119 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// planPurgeInterval is how often ended plans are checked against
+// PlanRetention, and idempotency keys against IdempotencyWindow.
+const planPurgeInterval = time.Hour
+
+// startPlanExpiry runs expirePendingPlans every PlanExpiryInterval when
+// MaxPlanPendingAge is set.
+func (a *App) startPlanExpiry(ctx context.Context) {
+	if a.cfg.MaxPlanPendingAge <= 0 || a.cfg.PlanExpiryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.PlanExpiryInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if a.ReadOnly() {
+					continue
+				}
+				expired, err := a.expirePendingPlans(context.Background(), time.Now().UTC())
+				if err != nil {
+					log.Printf("plan expiry error: %v", err)
+					continue
+				}
+				if len(expired) > 0 {
+					log.Printf("plan expiry marked %d plans expired", len(expired))
+				}
+			}
+		}
+	}()
+}
+
+// expirePendingPlans expires the plans no agent has leased within
+// MaxPlanPendingAge of now, so a backlog for a site whose agents are gone
+// ends in a terminal state instead of waiting forever.
+func (a *App) expirePendingPlans(ctx context.Context, now time.Time) ([]store.Plan, error) {
+	cutoff := now.Add(-a.cfg.MaxPlanPendingAge)
+	expired, err := a.repo.ExpirePendingPlans(ctx, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	metadata, _ := json.Marshal(map[string]any{"cutoff": cutoff, "max_pending_age": a.cfg.MaxPlanPendingAge.String()})
+	for _, plan := range expired {
+		_ = a.writeAudit(ctx, plan.TenantID, plan.SiteID, "SYSTEM", "", "plan.expire", "plan", plan.ID, "", "", metadata)
+		a.publishPlan(ctx, plan)
+	}
+	return expired, nil
+}
+
+// startPlanPurge deletes the plans that ended more than PlanRetention ago
+// every planPurgeInterval, along with the stored file contents no other
+// plan refers to.
+func (a *App) startPlanPurge(ctx context.Context) {
+	if a.cfg.PlanRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(planPurgeInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			if !a.ReadOnly() {
+				purged, err := a.repo.PurgePlans(context.Background(), time.Now().UTC().Add(-a.cfg.PlanRetention))
+				if err != nil {
+					log.Printf("plan purge error: %v", err)
+				} else if purged > 0 {
+					log.Printf("plan purge deleted %d plans", purged)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// startIdempotencyRelease releases the idempotency keys of plans created
+// more than IdempotencyWindow ago every planPurgeInterval. ApplyPlan only
+// releases a key when it is reused, so without this the mappings of keys
+// never reused would be kept forever.
+func (a *App) startIdempotencyRelease(ctx context.Context) {
+	if a.cfg.IdempotencyWindow <= 0 {
+		return
+	}
+	ticker := time.NewTicker(planPurgeInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if a.ReadOnly() {
+					continue
+				}
+				released, err := a.repo.ReleaseIdempotencyKeys(context.Background(), time.Now().UTC().Add(-a.cfg.IdempotencyWindow))
+				if err != nil {
+					log.Printf("idempotency key release error: %v", err)
+				} else if released > 0 {
+					log.Printf("idempotency key release freed %d keys", released)
+				}
+			}
+		}
+	}()
+}
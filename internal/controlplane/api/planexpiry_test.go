@@ -0,0 +1,54 @@
+package controlplane
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestExpirePendingPlans(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	app.cfg.MaxPlanPendingAge = time.Hour
+	ctx := context.Background()
+	result, err := repo.ApplyPlan(ctx, store.ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "expire-1",
+		Actions: []store.ApplyPlanAction{
+			{OperationID: "op-1", Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128},
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	planID := result.Plan.ID
+
+	// Frozen clocks either side of the cutoff.
+	expired, err := app.expirePendingPlans(ctx, result.Plan.CreatedAt.Add(59*time.Minute))
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("expected a young plan to be kept, got %d, %v", len(expired), err)
+	}
+	expired, err = app.expirePendingPlans(ctx, result.Plan.CreatedAt.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("expire plans: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != planID {
+		t.Fatalf("expected the old plan to expire, got %+v", expired)
+	}
+
+	plan, err := repo.GetPlan(ctx, tenantID, planID)
+	if err != nil {
+		t.Fatalf("get plan: %v", err)
+	}
+	if plan.Status != "EXPIRED" {
+		t.Fatalf("expected EXPIRED plan, got %s", plan.Status)
+	}
+	if plan.Progress == nil || plan.Progress.StateCounts["EXPIRED"] != 1 {
+		t.Fatalf("expected the plan's execution to expire with it, got %+v", plan.Progress)
+	}
+	if expired, _ := app.expirePendingPlans(ctx, result.Plan.CreatedAt.Add(3*time.Hour)); len(expired) != 0 {
+		t.Fatalf("expected an expired plan to stay expired, got %+v", expired)
+	}
+}
@@ -0,0 +1,149 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// planGraphNode is one action of a plan graph with the state of its
+// execution.
+type planGraphNode struct {
+	OperationID string   `json:"operation_id"`
+	Operation   string   `json:"operation"`
+	VMID        string   `json:"vm_id,omitempty"`
+	ExecutionID string   `json:"execution_id,omitempty"`
+	State       string   `json:"state"`
+	DependsOn   []string `json:"depends_on"`
+	// BlockedBy lists the dependencies a PENDING action still waits on;
+	// Ready is set on PENDING actions that wait on none.
+	BlockedBy []string `json:"blocked_by,omitempty"`
+	Ready     bool     `json:"ready"`
+}
+
+type planGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// buildPlanGraph joins the plan's actions, in submission order, with their
+// executions. Dependencies are the declared depends_on plus, in sequential
+// plans, the previous action.
+func buildPlanGraph(plan store.Plan, executions []store.Execution) ([]planGraphNode, []planGraphEdge) {
+	var actions []store.ApplyPlanAction
+	_ = json.Unmarshal(plan.OperationsJSON, &actions)
+
+	byOperation := make(map[string]store.Execution, len(executions))
+	for _, e := range executions {
+		byOperation[e.OperationID] = e
+	}
+	used := make(map[string]bool, len(executions))
+	// Actions submitted without an operation_id got a generated one; they
+	// take the remaining executions of their operation in order.
+	nextUnnamed := func(operation string) (store.Execution, bool) {
+		for _, e := range executions {
+			if !used[e.OperationID] && strings.EqualFold(e.OperationType, operation) {
+				return e, true
+			}
+		}
+		return store.Execution{}, false
+	}
+	for _, action := range actions {
+		if _, ok := byOperation[action.OperationID]; ok {
+			used[action.OperationID] = true
+		}
+	}
+
+	nodes := make([]planGraphNode, 0, len(actions))
+	edges := make([]planGraphEdge, 0)
+	states := make(map[string]string, len(actions))
+	for i, action := range actions {
+		exec, ok := byOperation[action.OperationID]
+		if !ok {
+			exec, ok = nextUnnamed(action.Operation)
+		}
+		node := planGraphNode{
+			OperationID: action.OperationID,
+			Operation:   strings.ToUpper(action.Operation),
+			VMID:        action.VMID,
+			State:       "UNKNOWN",
+			DependsOn:   append([]string{}, action.DependsOn...),
+		}
+		if ok {
+			used[exec.OperationID] = true
+			node.OperationID = exec.OperationID
+			node.VMID = exec.VMID
+			node.ExecutionID = exec.ID
+			node.State = exec.State
+		}
+		if plan.Sequential && i > 0 {
+			if prev := nodes[i-1].OperationID; !slices.Contains(node.DependsOn, prev) {
+				node.DependsOn = append(node.DependsOn, prev)
+			}
+		}
+		for _, dep := range node.DependsOn {
+			edges = append(edges, planGraphEdge{From: dep, To: node.OperationID})
+		}
+		states[node.OperationID] = node.State
+		nodes = append(nodes, node)
+	}
+	for i := range nodes {
+		if nodes[i].State != "PENDING" {
+			continue
+		}
+		for _, dep := range nodes[i].DependsOn {
+			if states[dep] != "SUCCEEDED" {
+				nodes[i].BlockedBy = append(nodes[i].BlockedBy, dep)
+			}
+		}
+		nodes[i].Ready = len(nodes[i].BlockedBy) == 0
+	}
+	return nodes, edges
+}
+
+// handleGetPlanGraph returns a plan's actions as a dependency graph with
+// the state of each action, for rendering the plan as a DAG.
+func (a *App) handleGetPlanGraph(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	planID := r.PathValue("planID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	plan, err := a.repo.GetPlan(r.Context(), tenantID, planID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "plan not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get plan")
+		return
+	}
+	if plan.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "plan not found")
+		return
+	}
+	executions, err := a.repo.ListPlanExecutions(r.Context(), tenantID, planID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list executions")
+		return
+	}
+	nodes, edges := buildPlanGraph(plan, executions)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"plan_id":     plan.ID,
+		"plan_status": plan.Status,
+		"sequential":  plan.Sequential,
+		"nodes":       nodes,
+		"edges":       edges,
+	})
+}
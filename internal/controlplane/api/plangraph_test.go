@@ -0,0 +1,107 @@
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestPlanGraph(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-graph-bad",
+		"actions": []map[string]any{
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-1", "depends_on": []string{"create-vm-1"}},
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-1", "name": "vm-1"},
+		},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a dependency on a later action to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-graph",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-1", "name": "vm-1"},
+			{"operation_id": "create-vm-2", "operation": "CREATE", "vm_id": "vm-2", "name": "vm-2"},
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-1", "depends_on": []string{"create-vm-1"}},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var applyResp struct {
+		PlanID string `json:"plan_id"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &applyResp)
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+applyResp.PlanID+"/graph", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("graph status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var graph struct {
+		Nodes []planGraphNode `json:"nodes"`
+		Edges []planGraphEdge `json:"edges"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &graph)
+	if len(graph.Nodes) != 3 || graph.Nodes[2].OperationID != "start-vm-1" {
+		t.Fatalf("expected the actions in submission order, got %+v", graph.Nodes)
+	}
+	if !slices.Equal(graph.Edges, []planGraphEdge{{From: "create-vm-1", To: "start-vm-1"}}) {
+		t.Fatalf("expected the declared dependency as the only edge, got %+v", graph.Edges)
+	}
+	start := graph.Nodes[2]
+	if start.State != "PENDING" || start.Ready || !slices.Equal(start.BlockedBy, []string{"create-vm-1"}) || start.ExecutionID == "" {
+		t.Fatalf("expected start-vm-1 to be blocked on create-vm-1, got %+v", start)
+	}
+	if !graph.Nodes[0].Ready || !graph.Nodes[1].Ready {
+		t.Fatalf("expected the creates to be ready, got %+v", graph.Nodes[:2])
+	}
+
+	otherTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: otherTenant, Slug: "other", Name: "Other", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: otherTenant, Name: "other", KeyHash: hashString("nk_other_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+applyResp.PlanID+"/graph", "nk_other_key", nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another tenant's plan to be hidden, got %d", rec.Code)
+	}
+}
+
+func TestBuildPlanGraphStates(t *testing.T) {
+	ops, _ := json.Marshal([]store.ApplyPlanAction{
+		{OperationID: "create", Operation: "CREATE", VMID: "vm-1"},
+		{OperationID: "start", Operation: "START", VMID: "vm-1"},
+		{Operation: "STOP", VMID: "vm-1"},
+	})
+	plan := store.Plan{OperationsJSON: ops, Sequential: true}
+	executions := []store.Execution{
+		{ID: "e-3", OperationID: "generated", OperationType: "STOP", VMID: "vm-1", State: "PENDING"},
+		{ID: "e-2", OperationID: "start", OperationType: "START", VMID: "vm-1", State: "FAILED"},
+		{ID: "e-1", OperationID: "create", OperationType: "CREATE", VMID: "vm-1", State: "SUCCEEDED"},
+	}
+	nodes, edges := buildPlanGraph(plan, executions)
+	want := []planGraphEdge{{From: "create", To: "start"}, {From: "start", To: "generated"}}
+	if !slices.Equal(edges, want) {
+		t.Fatalf("expected sequential edges %+v, got %+v", want, edges)
+	}
+	if nodes[0].State != "SUCCEEDED" || nodes[1].State != "FAILED" || nodes[2].ExecutionID != "e-3" {
+		t.Fatalf("expected executions matched to their actions, got %+v", nodes)
+	}
+	if nodes[2].Ready || !slices.Equal(nodes[2].BlockedBy, []string{"start"}) {
+		t.Fatalf("expected the stop to be blocked by the failed start, got %+v", nodes[2])
+	}
+}
@@ -0,0 +1,69 @@
+package controlplane
+
+import (
+	"errors"
+	"net/http"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func (a *App) handleListQuotaTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := a.repo.ListQuotaTemplates(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list quota templates")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"templates": templates})
+}
+
+func (a *App) handleGetQuotaTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := a.repo.GetQuotaTemplate(r.Context(), r.PathValue("name"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "quota template not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get quota template")
+		return
+	}
+	writeJSON(w, http.StatusOK, template)
+}
+
+// handlePutQuotaTemplate creates or replaces a template. Tenants using the
+// template pick up the new limits unless limits were set for them directly.
+func (a *App) handlePutQuotaTemplate(w http.ResponseWriter, r *http.Request) {
+	var limits store.QuotaLimits
+	if err := decodeJSON(r.Body, &limits); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	template, err := a.repo.PutQuotaTemplate(r.Context(), store.QuotaTemplate{
+		Name:   r.PathValue("name"),
+		Limits: limits,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrInvalidQuotaTemplate) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to save quota template")
+		return
+	}
+	writeJSON(w, http.StatusOK, template)
+}
+
+func (a *App) handleDeleteQuotaTemplate(w http.ResponseWriter, r *http.Request) {
+	err := a.repo.DeleteQuotaTemplate(r.Context(), r.PathValue("name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "quota template not found")
+		case errors.Is(err, store.ErrConflict):
+			writeError(w, http.StatusConflict, "quota template is in use by tenants")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to delete quota template")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -121,39 +120,9 @@ func (rl *RateLimiter) getClientID(r *http.Request) string {
 	return "ip:" + rl.getClientIP(r)
 }
 
-// getClientIP extracts the real client IP from the request
-// Checks X-Forwarded-For, X-Real-IP headers, then RemoteAddr
+// getClientIP returns the client IP resolved from trusted proxy headers.
 func (rl *RateLimiter) getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (common for proxies)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// X-Forwarded-For can contain multiple IPs, take the first one
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			ip := strings.TrimSpace(ips[0])
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-	}
-
-	// Check X-Real-IP header (common for nginx)
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		ip := strings.TrimSpace(xri)
-		if net.ParseIP(ip) != nil {
-			return ip
-		}
-	}
-
-	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// RemoteAddr might not have a port in some cases
-		if net.ParseIP(r.RemoteAddr) != nil {
-			return r.RemoteAddr
-		}
-		return "unknown"
-	}
-	return host
+	return getClientIP(r)
 }
 
 // normalizeEndpoint normalizes the endpoint path for rate limiting
@@ -306,6 +275,42 @@ func (rl *RateLimiter) cleanupStaleLimiters() {
 	}
 }
 
+// KeyedRateLimiter is a token bucket per caller-chosen key, such as a site
+// ID, independent of client IP and endpoint.
+type KeyedRateLimiter struct {
+	limit    RateLimit
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewKeyedRateLimiter returns a limiter that allows limit.Rate events per
+// second for each key, with bursts of limit.Burst. A non-positive rate
+// disables limiting.
+func NewKeyedRateLimiter(limit RateLimit) *KeyedRateLimiter {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+	return &KeyedRateLimiter{
+		limit:    limit,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Allow reports whether an event for key may happen now.
+func (k *KeyedRateLimiter) Allow(key string) bool {
+	if k == nil || k.limit.Rate <= 0 {
+		return true
+	}
+	k.mu.Lock()
+	limiter, ok := k.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(k.limit.Rate), k.limit.Burst)
+		k.limiters[key] = limiter
+	}
+	k.mu.Unlock()
+	return limiter.Allow()
+}
+
 // RateLimitConfigFromEnv creates a RateLimitConfig from environment variables
 // Uses the defaults defined in the requirements
 func RateLimitConfigFromEnv() RateLimitConfig {
@@ -42,6 +42,10 @@ func TestRateLimiter_WithDefaults(t *testing.T) {
 
 func TestGetClientIP(t *testing.T) {
 	rl := NewRateLimiter(DefaultRateLimitConfig())
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	tests := []struct {
 		name       string
@@ -65,7 +69,7 @@ func TestGetClientIP(t *testing.T) {
 			name:       "X-Forwarded-For multiple",
 			remoteAddr: "10.0.0.1:12345",
 			headers:    map[string]string{"X-Forwarded-For": "203.0.113.1, 70.41.3.18, 150.172.238.178"},
-			want:       "203.0.113.1",
+			want:       "150.172.238.178",
 		},
 		{
 			name:       "X-Real-IP",
@@ -95,7 +99,7 @@ func TestGetClientIP(t *testing.T) {
 				req.Header.Set(k, v)
 			}
 
-			got := rl.getClientIP(req)
+			got := rl.getClientIP(proxies.Resolve(req))
 			if got != tt.want {
 				t.Errorf("getClientIP() = %v, want %v", got, tt.want)
 			}
@@ -555,3 +559,25 @@ func TestMiddleware_429ResponseBody(t *testing.T) {
 		t.Errorf("expected endpoint path in error message, got: %s", body)
 	}
 }
+
+func TestKeyedRateLimiter(t *testing.T) {
+	kl := NewKeyedRateLimiter(RateLimit{Rate: 1.0 / 3600, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if !kl.Allow("site-a") {
+			t.Fatalf("request %d within burst should be allowed", i+1)
+		}
+	}
+	if kl.Allow("site-a") {
+		t.Error("request over burst should be blocked")
+	}
+	if !kl.Allow("site-b") {
+		t.Error("other keys should have their own bucket")
+	}
+
+	disabled := NewKeyedRateLimiter(RateLimit{})
+	for i := 0; i < 100; i++ {
+		if !disabled.Allow("site-a") {
+			t.Fatal("zero rate should disable limiting")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package controlplane
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// readOnlyCode is the error code of writes refused in read-only mode.
+const readOnlyCode = "READ_ONLY_MODE"
+
+// ReadOnly reports whether the control plane refuses writes.
+func (a *App) ReadOnly() bool {
+	return a.readOnly.Load()
+}
+
+// SetReadOnly turns read-only mode on or off.
+func (a *App) SetReadOnly(on bool) {
+	if a.readOnly.Swap(on) != on {
+		log.Printf("read-only mode %s", map[bool]string{true: "enabled", false: "disabled"}[on])
+	}
+}
+
+// ReloadReadOnly re-evaluates read-only mode from the configuration:
+// READ_ONLY, or the presence of READ_ONLY_FILE. The control plane calls it
+// on SIGHUP, so operators can touch or remove the file around a migration.
+func (a *App) ReloadReadOnly() {
+	on := a.cfg.ReadOnly
+	if !on && a.cfg.ReadOnlyFile != "" {
+		_, err := os.Stat(a.cfg.ReadOnlyFile)
+		on = err == nil
+	}
+	a.SetReadOnly(on)
+}
+
+// isWriteRequest reports whether r may change state. Every request other
+// than GET, HEAD and OPTIONS is a write, except plan estimates, which only
+// read, and agent heartbeats, which handleHeartbeat answers without side
+// effects in read-only mode. GET /v1/plans/next leases plans, and so is
+// answered with no plans instead; GET /auth/verify-email consumes its
+// token and is a write.
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.URL.Path == "/auth/verify-email"
+	}
+	switch path := r.URL.Path; {
+	case path == "/agents/heartbeat", path == "/v1/heartbeat":
+		return false
+	case strings.HasPrefix(path, "/sites/") && strings.HasSuffix(path, "/plans/estimate"):
+		return false
+	}
+	return true
+}
+
+// withReadOnly refuses writes with 503 READ_ONLY_MODE while the control
+// plane is read-only.
+func (a *App) withReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.ReadOnly() && isWriteRequest(r) {
+			w.Header().Set("Retry-After", "60")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"error": "control plane is in read-only mode",
+				"code":  readOnlyCode,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
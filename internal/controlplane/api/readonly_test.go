@@ -0,0 +1,105 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestReadOnlyModeRefusesWritesAndServesReads(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	apiKey := "nk_readonly_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(apiKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+	plan := func(key string) map[string]any {
+		return map[string]any{
+			"idempotency_key": key,
+			"actions":         []map[string]any{{"operation_id": key, "operation": "CREATE", "vm_id": "vm-" + key, "name": key}},
+		}
+	}
+	if rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", apiKey, plan("before"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	flag := filepath.Join(t.TempDir(), "read-only")
+	app.cfg.ReadOnlyFile = flag
+	if err := os.WriteFile(flag, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	app.ReloadReadOnly()
+	if !app.ReadOnly() {
+		t.Fatal("expected the flag file to enable read-only mode")
+	}
+
+	writes := []struct {
+		method, path string
+		body         any
+	}{
+		{"POST", "/sites/" + siteID + "/plans", plan("during")},
+		{"POST", "/tenants/" + tenantID + "/sites", map[string]any{"name": "edge-2"}},
+		{"PUT", "/tenants/" + tenantID + "/log-severity", map[string]any{"min_severity": "INFO"}},
+		{"POST", "/enroll", map[string]any{"enrollment_token": "x"}},
+		{"GET", "/auth/verify-email?token=x", nil},
+	}
+	for _, w := range writes {
+		rec := doJSON(t, app.Handler(), w.method, w.path, apiKey, w.body, nil)
+		var body struct {
+			Code string `json:"code"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusServiceUnavailable || body.Code != readOnlyCode {
+			t.Fatalf("%s %s: expected 503 %s, got %d %s", w.method, w.path, readOnlyCode, rec.Code, rec.Body.String())
+		}
+	}
+
+	for _, path := range []string{"/tenants/" + tenantID + "/sites", "/sites/" + siteID + "/image-defaults"} {
+		if rec := doJSON(t, app.Handler(), "GET", path, apiKey, nil, nil); rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected reads to be served, got %d %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans/estimate", apiKey, plan("estimate"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected plan estimates to be served, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Heartbeats are answered, but nothing is recorded or leased.
+	before, _ := repo.GetAgentByID(ctx, agentID)
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1, "hostname": "edge-1"}, mtls)
+	var hb struct {
+		ReadOnly     bool             `json:"read_only"`
+		PendingPlans []map[string]any `json:"pending_plans"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hb)
+	if rec.Code != http.StatusOK || !hb.ReadOnly || len(hb.PendingPlans) != 0 {
+		t.Fatalf("expected a read-only heartbeat without plans, got %d %s", rec.Code, rec.Body.String())
+	}
+	if after, _ := repo.GetAgentByID(ctx, agentID); after.LastHeartbeatAt != before.LastHeartbeatAt {
+		t.Fatal("expected the read-only heartbeat not to be recorded")
+	}
+
+	// Removing the flag and reloading, as on SIGHUP, accepts writes again.
+	if err := os.Remove(flag); err != nil {
+		t.Fatal(err)
+	}
+	app.ReloadReadOnly()
+	if rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", apiKey, plan("after"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected writes after leaving read-only mode, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 2, "hostname": "edge-1"}, mtls)
+	hb.ReadOnly, hb.PendingPlans = false, nil
+	mustDecode(t, rec.Body.Bytes(), &hb)
+	if hb.ReadOnly || len(hb.PendingPlans) == 0 {
+		t.Fatalf("expected the pending plans to be leased again, got %s", rec.Body.String())
+	}
+}
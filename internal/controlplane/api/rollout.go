@@ -0,0 +1,128 @@
+package controlplane
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// agentRolloutStatus is the response body of the agent rollout endpoints.
+func agentRolloutStatus(siteID string, rollout store.AgentRollout, upgrades []store.AgentUpgrade) map[string]any {
+	byAgent := make(map[string]store.AgentUpgrade, len(upgrades))
+	counts := map[string]int{store.AgentUpgradeSignaled: 0, store.AgentUpgradeSucceeded: 0, store.AgentUpgradeFailed: 0}
+	current := make([]store.AgentUpgrade, 0, len(upgrades))
+	for _, u := range upgrades {
+		byAgent[u.AgentID] = u
+		if rollout.TargetVersion != "" && u.TargetVersion == rollout.TargetVersion {
+			counts[u.State]++
+			current = append(current, u)
+		}
+	}
+	return map[string]any{
+		"site_id":  siteID,
+		"rollout":  rollout,
+		"halted":   rollout.TargetVersion != "" && store.RolloutHalted(rollout, byAgent),
+		"counts":   counts,
+		"upgrades": current,
+	}
+}
+
+func (a *App) handleGetAgentRollout(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	rollout, err := a.repo.GetSiteAgentRollout(r.Context(), tenantID, siteID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get agent rollout")
+		return
+	}
+	upgrades, err := a.repo.ListSiteAgentUpgrades(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list agent upgrades")
+		return
+	}
+	writeJSON(w, http.StatusOK, agentRolloutStatus(siteID, rollout, upgrades))
+}
+
+// handleSetAgentRollout sets the agent version a site should run. Agents
+// learn the target from heartbeat responses, canaries first; saving the
+// rollout again after a failure resumes it.
+func (a *App) handleSetAgentRollout(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	var req store.AgentRollout
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rollout, err := store.ValidateAgentRollout(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rollout.UpdatedAt = time.Now().UTC()
+	if err := a.repo.SetSiteAgentRollout(r.Context(), tenantID, siteID, rollout); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to set agent rollout")
+		return
+	}
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "site.agent_rollout.update", "site", siteID, requestID(r), sourceIP(r), nil)
+	upgrades, err := a.repo.ListSiteAgentUpgrades(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list agent upgrades")
+		return
+	}
+	writeJSON(w, http.StatusOK, agentRolloutStatus(siteID, rollout, upgrades))
+}
+
+// handleReportAgentUpgrade records whether an agent's upgrade hook succeeded.
+// A failure halts the site's rollout.
+func (a *App) handleReportAgentUpgrade(w http.ResponseWriter, r *http.Request) {
+	agent := r.Context().Value(ctxAgent{}).(store.Agent)
+	type request struct {
+		TargetVersion string `json:"target_version"`
+		OK            bool   `json:"ok"`
+		Message       string `json:"message"`
+	}
+	var req request
+	if err := decodeJSONAllowUnknown(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.TargetVersion) == "" {
+		writeError(w, http.StatusBadRequest, "target_version is required")
+		return
+	}
+	message := strings.TrimSpace(req.Message)
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	err := a.repo.ReportAgentUpgrade(r.Context(), agent.ID, store.AgentUpgradeReport{
+		TargetVersion: strings.TrimSpace(req.TargetVersion),
+		OK:            req.OK,
+		Message:       message,
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "agent was not signaled to upgrade to this version")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to record agent upgrade")
+		return
+	}
+	action := "agent.upgrade.succeeded"
+	if !req.OK {
+		action = "agent.upgrade.failed"
+	}
+	_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "AGENT", agent.ID, action, "agent", agent.ID, requestID(r), sourceIP(r), nil)
+	w.WriteHeader(http.StatusAccepted)
+}
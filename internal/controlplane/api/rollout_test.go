@@ -0,0 +1,157 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestAgentRolloutSignalsAndGatesUpgrades(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	type edge struct {
+		id  string
+		tls *tls.ConnectionState
+	}
+	enrollEdge := func(token string) edge {
+		t.Helper()
+		resp := enroll(t, app, token, makeCSR(t))
+		cert := parseCert(t, []byte(resp["client_certificate_pem"].(string)))
+		return edge{id: resp["agent_id"].(string), tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}
+	}
+	edges := []edge{enrollEdge(enrollToken)}
+	for i := 0; i < 2; i++ {
+		token := uuid.NewString()
+		if _, err := repo.IssueEnrollmentToken(ctx, store.EnrollmentToken{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, TokenHash: hashString(token), ExpiresAt: time.Now().UTC().Add(time.Minute)}); err != nil {
+			t.Fatalf("issue token: %v", err)
+		}
+		edges = append(edges, enrollEdge(token))
+	}
+
+	heartbeat := func(e edge, version string) string {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+			"agent_id":      e.id,
+			"agent_version": version,
+		}, e.tls)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			TargetAgentVersion string `json:"target_agent_version"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp.TargetAgentVersion
+	}
+	report := func(e edge, target string, ok bool) int {
+		t.Helper()
+		return doJSON(t, app.Handler(), "POST", "/v1/agent-upgrade", "", map[string]any{
+			"target_version": target,
+			"ok":             ok,
+			"message":        "hook output",
+		}, e.tls).Code
+	}
+	setRollout := func(body map[string]any) map[string]any {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "PUT", "/sites/"+siteID+"/agent-rollout", plainAPIKey, body, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("set rollout status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp map[string]any
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// No rollout: nothing is signaled.
+	if got := heartbeat(edges[0], "0.1.0"); got != "" {
+		t.Fatalf("expected no target without a rollout, got %q", got)
+	}
+
+	setRollout(map[string]any{"target_version": "0.2.0", "canary_count": 1, "max_in_flight": 2})
+
+	// Canary phase: only the first agent to heartbeat is told to upgrade.
+	if got := heartbeat(edges[0], "0.1.0"); got != "0.2.0" {
+		t.Fatalf("canary should be signaled, got %q", got)
+	}
+	if got := heartbeat(edges[1], "0.1.0"); got != "" {
+		t.Fatalf("non-canary should wait for the canary, got %q", got)
+	}
+	// The canary keeps being signaled until it upgrades.
+	if got := heartbeat(edges[0], "0.1.0"); got != "0.2.0" {
+		t.Fatalf("canary should be signaled again, got %q", got)
+	}
+	if code := report(edges[1], "0.2.0", true); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an agent that was not signaled, got %d", code)
+	}
+	if code := report(edges[0], "0.2.0", true); code != http.StatusAccepted {
+		t.Fatalf("report status=%d", code)
+	}
+
+	// Once the canary runs the target, the rest go, max_in_flight at a time.
+	if got := heartbeat(edges[0], "0.2.0"); got != "" {
+		t.Fatalf("upgraded agent should not be signaled, got %q", got)
+	}
+	if got := heartbeat(edges[1], "0.1.0"); got != "0.2.0" {
+		t.Fatalf("second agent should be signaled after the canary, got %q", got)
+	}
+
+	// A failed upgrade halts the rollout for agents not yet signaled.
+	if code := report(edges[1], "0.2.0", false); code != http.StatusAccepted {
+		t.Fatalf("report status=%d", code)
+	}
+	if got := heartbeat(edges[2], "0.1.0"); got != "" {
+		t.Fatalf("halted rollout should not signal, got %q", got)
+	}
+	rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agent-rollout", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get rollout status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var status struct {
+		Halted   bool                 `json:"halted"`
+		Counts   map[string]int       `json:"counts"`
+		Upgrades []store.AgentUpgrade `json:"upgrades"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &status)
+	if !status.Halted || status.Counts[store.AgentUpgradeFailed] != 1 || status.Counts[store.AgentUpgradeSucceeded] != 1 || len(status.Upgrades) != 2 {
+		t.Fatalf("unexpected rollout status %+v", status)
+	}
+
+	// Saving the rollout again clears the failure and resumes it.
+	if resp := setRollout(map[string]any{"target_version": "0.2.0", "max_in_flight": 2}); resp["halted"] != false {
+		t.Fatalf("expected rollout to resume, got %v", resp)
+	}
+	if got := heartbeat(edges[2], "0.1.0"); got != "0.2.0" {
+		t.Fatalf("resumed rollout should signal, got %q", got)
+	}
+	if got := heartbeat(edges[1], "0.1.0"); got != "0.2.0" {
+		t.Fatalf("previously failed agent should be retried, got %q", got)
+	}
+}
+
+func TestAgentRolloutValidation(t *testing.T) {
+	app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	rec := doJSON(t, app.Handler(), "PUT", "/sites/"+uuid.NewString()+"/agent-rollout", plainAPIKey, map[string]any{"target_version": "0.2.0"}, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for foreign site, got %d", rec.Code)
+	}
+	sites, _ := repo.ListSites(context.Background(), tenantID)
+	rec = doJSON(t, app.Handler(), "PUT", "/sites/"+sites[0].ID+"/agent-rollout", plainAPIKey, map[string]any{"target_version": "0.2.0", "max_in_flight": -1}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative max_in_flight, got %d", rec.Code)
+	}
+}
@@ -1,12 +1,12 @@
 package controlplane
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
-	"crypto/x509"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
@@ -17,6 +17,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -43,6 +44,9 @@ type App struct {
 	healthChecker *health.Checker
 	emailService  *EmailService
 
+	// trustedProxies decides whose forwarding headers give the client IP
+	trustedProxies *TrustedProxies
+
 	// Metrics counters
 	metrics struct {
 		requestsTotal    atomic.Int64
@@ -55,6 +59,31 @@ type App struct {
 	// Rate limiter
 	rateLimiter *RateLimiter
 
+	// siteEnrollLimiter bounds enrollments per site
+	siteEnrollLimiter *KeyedRateLimiter
+
+	// logIngest shares log write capacity fairly between tenants
+	logIngest *logIngestGate
+
+	// heartbeats bounds concurrent heartbeat database work
+	heartbeats *heartbeatGate
+
+	// readOnly refuses writes, e.g. during schema migrations
+	readOnly atomic.Bool
+
+	// events fans plan, VM and agent changes out to site event streams
+	events *siteEventHub
+
+	// webhooks delivers plan, VM and agent events to tenant webhooks
+	webhooks *webhookDispatcher
+
+	// federation proxies reads of tenants homed in other regions; nil
+	// when no region is configured
+	federation *federation
+
+	// clockDrift holds the last clock drift measured for each agent
+	clockDrift *clockDriftGauge
+
 	// Quota manager for tenant resource limits
 	quotaManager *tenant.QuotaManager
 
@@ -74,7 +103,7 @@ type Cache interface {
 }
 
 func NewApp(cfg Config, repo store.Repo) (*App, error) {
-	ca, err := LoadOrCreateInternalCA(cfg.CACommonName, cfg.RequirePersistentPKI)
+	ca, err := LoadOrCreateInternalCA(cfg.CACommonName, cfg.CALifetime, cfg.RequirePersistentPKI)
 	if err != nil {
 		return nil, err
 	}
@@ -82,42 +111,77 @@ func NewApp(cfg Config, repo store.Repo) (*App, error) {
 	if err != nil {
 		return nil, err
 	}
+	trustedProxies, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	logIngest, err := newLogIngestGate(cfg.LogIngest)
+	if err != nil {
+		return nil, err
+	}
+	federation, err := newFederation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	leaseSteal, err := store.ParseLeaseStealPolicy(cfg.PlanLeaseStealGrace)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := repo.(interface{ SetLeaseStealPolicy(store.LeaseStealPolicy) }); ok {
+		r.SetLeaseStealPolicy(leaseSteal)
+	}
+	if r, ok := repo.(interface{ SetIdempotencyWindow(time.Duration) }); ok {
+		r.SetIdempotencyWindow(cfg.IdempotencyWindow)
+	}
+	if r, ok := repo.(interface{ SetMaxActionPayload(int) }); ok {
+		r.SetMaxActionPayload(cfg.MaxActionPayload)
+	}
+	if !store.ValidVMDNSHostnameMode(cfg.VMDNSHostnames) {
+		return nil, fmt.Errorf("VM_DNS_HOSTNAMES must be %q, %q or empty, got %q", store.VMDNSHostnameName, store.VMDNSHostnameID, cfg.VMDNSHostnames)
+	}
+	if r, ok := repo.(interface{ SetVMDNSHostnames(string) }); ok {
+		r.SetVMDNSHostnames(cfg.VMDNSHostnames)
+	}
+
+	if cfg.CRLDistributionPoint {
+		if err := ValidateCRLURL(cfg.CRLURL); err != nil {
+			return nil, err
+		}
+		ca.SetCRLDistributionPoint(cfg.CRLURL)
+	}
 
 	// Initialize CRL manager with CRL URL
-	crlURL := env("CRL_URL", "")
-	crlManager := pki.NewCRLManager(ca.Certificate(), ca.Key(), crlURL)
+	crlManager := pki.NewCRLManager(ca.Certificate(), ca.Key(), cfg.CRLURL)
 
 	// Load existing revoked certificates from database
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	revokedCerts, err := repo.ListRevokedCertificates(ctx)
-	cancel()
-	if err != nil {
+	if loaded, err := loadCRL(context.Background(), repo, crlManager); err != nil {
 		log.Printf("warning: failed to load revoked certificates: %v", err)
-	} else {
-		for _, entry := range revokedCerts {
-			if err := crlManager.Revoke(entry.SerialNumber, pki.RevocationReason(entry.Reason), entry.AgentID); err != nil {
-				log.Printf("warning: failed to load revoked cert %s: %v", entry.SerialNumber, err)
-			}
-		}
-		if len(revokedCerts) > 0 {
-			log.Printf("loaded %d revoked certificates into CRL", len(revokedCerts))
-		}
+	} else if loaded > 0 {
+		log.Printf("loaded %d revoked certificates into CRL", loaded)
 	}
 
 	// Initialize cache with 5 minute default expiration and 10 minute cleanup
 	appCache := cache.New(5*time.Minute, 10*time.Minute)
 
 	a := &App{
-		cfg:             cfg,
-		repo:            repo,
-		ca:              ca,
-		crlManager:      crlManager,
-		serverCert:      serverCert,
-		mux:             http.NewServeMux(),
-		cache:           appCache,
-		rateLimiter:     NewRateLimiter(cfg.RateLimit),
-		apiKeyProtector: NewAPIKeyProtector(DefaultAPIKeyProtectionConfig()),
-		emailService:    NewEmailService(cfg),
+		cfg:               cfg,
+		repo:              repo,
+		ca:                ca,
+		crlManager:        crlManager,
+		serverCert:        serverCert,
+		mux:               http.NewServeMux(),
+		cache:             appCache,
+		rateLimiter:       NewRateLimiter(cfg.RateLimit),
+		siteEnrollLimiter: NewKeyedRateLimiter(cfg.SiteEnrollRateLimit),
+		apiKeyProtector:   NewAPIKeyProtector(DefaultAPIKeyProtectionConfig()),
+		emailService:      NewEmailService(cfg),
+		trustedProxies:    trustedProxies,
+		logIngest:         logIngest,
+		heartbeats:        newHeartbeatGate(cfg.HeartbeatConcurrency),
+		events:            newSiteEventHub(),
+		webhooks:          newWebhookDispatcher(repo, cfg),
+		federation:        federation,
+		clockDrift:        newClockDriftGauge(),
 	}
 
 	// Initialize quota manager with adapter to convert store types to tenant types
@@ -140,13 +204,14 @@ func NewApp(cfg Config, repo store.Repo) (*App, error) {
 	// Initialize audit chain manager
 	a.auditChain = audit.NewChainManager(repo)
 
+	a.ReloadReadOnly()
 	a.registerRoutes()
 	return a, nil
 }
 
 // setupHealthChecker initializes and configures the health checker
 func (a *App) setupHealthChecker(repo store.Repo) {
-	a.healthChecker = health.NewChecker("dev") // Version can be injected at build time
+	a.healthChecker = health.NewChecker(a.cfg.Build.withDefaults().Version)
 
 	// Register database health check
 	a.healthChecker.Register("database", func(ctx context.Context) error {
@@ -175,11 +240,19 @@ func (a *App) setupHealthChecker(repo store.Repo) {
 }
 
 func (a *App) Handler() http.Handler {
-	// Apply rate limiting first, then request logging
-	return a.withRequestLogging(a.rateLimiter.Middleware()(a.mux))
+	// Resolve the client IP behind trusted proxies, then apply rate
+	// limiting and request logging
+	return a.withClientIP(a.withRequestLogging(a.rateLimiter.Middleware()(a.withReadOnly(a.mux))))
 }
 
 func (a *App) StartBackgroundWorkers(ctx context.Context) {
+	a.emailService.Start(ctx)
+	a.webhooks.Start(ctx)
+	a.startPlanExpiry(ctx)
+	a.startPlanPurge(ctx)
+	a.startIdempotencyRelease(ctx)
+	a.startCRLRefresh(ctx)
+	a.startUsageHistory(ctx)
 	if a.cfg.OfflineSweepInterval <= 0 {
 		return
 	}
@@ -191,31 +264,77 @@ func (a *App) StartBackgroundWorkers(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
+				if a.ReadOnly() {
+					// Heartbeats are not recorded, so every agent would look stale.
+					continue
+				}
 				cutoff := time.Now().UTC().Add(-a.cfg.OfflineAfter)
-				updated, err := a.repo.SweepOfflineAgents(context.Background(), cutoff)
+				marked, err := a.repo.SweepOfflineAgents(context.Background(), cutoff)
 				if err != nil {
 					log.Printf("offline sweeper error: %v", err)
 					continue
 				}
-				if updated > 0 {
-					log.Printf("offline sweeper marked %d agents offline", updated)
+				// Published unconditionally: tenant webhooks may want
+				// agent.offline even when no stream is open.
+				a.publishAgentsOffline(context.Background(), marked)
+				if len(marked) > 0 {
+					log.Printf("offline sweeper marked %d agents offline", len(marked))
 				}
 			}
 		}
 	}()
 }
 
-func (a *App) TLSConfig() (*tls.Config, error) {
-	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(a.ca.CertPEM()); !ok {
-		return nil, errors.New("failed to parse internal ca pem")
+// handleSweepOfflineAgents runs the offline sweep immediately with the
+// configured cutoff instead of waiting for the next background tick.
+func (a *App) handleSweepOfflineAgents(w http.ResponseWriter, r *http.Request) {
+	cutoff := time.Now().UTC().Add(-a.cfg.OfflineAfter)
+	marked, err := a.repo.SweepOfflineAgents(r.Context(), cutoff)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to sweep offline agents")
+		return
+	}
+	a.publishAgentsOffline(r.Context(), marked)
+	metadata, _ := json.Marshal(map[string]any{"cutoff": cutoff, "trigger": "admin"})
+	for _, agent := range marked {
+		_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "SYSTEM", "", "agent.mark_offline", "agent", agent.ID, requestID(r), sourceIP(r), metadata)
 	}
-	return &tls.Config{
+	writeJSON(w, http.StatusOK, map[string]any{"updated": len(marked), "cutoff": cutoff})
+}
+
+// handleRotateEncryption re-encrypts stored plan and audit metadata and
+// secrets with the active encryption key. Run it after changing ENCRYPTION_ACTIVE_KEY; the old
+// key can be removed from ENCRYPTION_KEYS once it reports nothing rewritten.
+func (a *App) handleRotateEncryption(w http.ResponseWriter, r *http.Request) {
+	rewrapped, err := a.repo.RotateTenantEncryption(r.Context())
+	if err != nil {
+		if errors.Is(err, store.ErrNoCipher) {
+			writeError(w, http.StatusConflict, "no encryption keys configured")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to rotate encryption")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"rewrapped": rewrapped})
+}
+
+// TLSConfig builds the server TLS config. Client certificates are checked
+// against the CA trust pool at each handshake so that a CA rotation takes
+// effect without a restart.
+func (a *App) TLSConfig() (*tls.Config, error) {
+	base := &tls.Config{
 		MinVersion:   tls.VersionTLS13,
 		Certificates: []tls.Certificate{a.serverCert},
-		ClientCAs:    pool,
+		ClientCAs:    a.ca.CertPool(),
 		ClientAuth:   tls.VerifyClientCertIfGiven,
-	}, nil
+	}
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = a.ca.CertPool()
+		return c, nil
+	}
+	return cfg, nil
 }
 
 // CA returns the internal CA instance
@@ -226,7 +345,9 @@ func (a *App) CA() *InternalCA {
 func (a *App) registerRoutes() {
 	a.mux.HandleFunc("GET /healthz", a.handleHealthz)
 	a.mux.HandleFunc("GET /readyz", a.handleReadyz)
+	a.mux.HandleFunc("GET /version", a.handleVersion)
 	a.mux.HandleFunc("GET /metrics", a.handleMetrics)
+	a.mux.HandleFunc("GET /openapi.json", a.handleOpenAPI)
 
 	// Public auth routes (no authentication required)
 	a.mux.HandleFunc("POST /auth/register", a.handleRegister)
@@ -256,49 +377,101 @@ func (a *App) registerRoutes() {
 	// Admin routes (require admin key)
 	a.mux.Handle("POST /tenants", a.adminAuth(http.HandlerFunc(a.handleCreateTenant)))
 	a.mux.Handle("GET /tenants", a.adminAuth(http.HandlerFunc(a.handleListTenants)))
-	a.mux.Handle("POST /tenants/{tenantID}/api-keys", a.adminAuth(http.HandlerFunc(a.handleCreateAPIKey)))
-	a.mux.Handle("GET /tenants/{tenantID}/api-keys", a.apiKeyAuth(http.HandlerFunc(a.handleListAPIKeys)))
-	a.mux.Handle("DELETE /tenants/{tenantID}/api-keys/{keyID}", a.apiKeyAuth(http.HandlerFunc(a.handleDeleteAPIKey)))
-
-	a.mux.Handle("POST /tenants/{tenantID}/sites", a.apiKeyAuth(http.HandlerFunc(a.handleCreateSite)))
-	a.mux.Handle("GET /tenants/{tenantID}/sites", a.apiKeyAuth(http.HandlerFunc(a.handleListSites)))
-	a.mux.Handle("POST /tenants/{tenantID}/enrollment-tokens", a.apiKeyAuth(http.HandlerFunc(a.handleIssueEnrollmentToken)))
-	a.mux.Handle("GET /tenants/{tenantID}/enrollment-tokens", a.apiKeyAuth(http.HandlerFunc(a.handleListEnrollmentTokens)))
-	a.mux.Handle("GET /tenants/{tenantID}/usage", a.apiKeyAuth(http.HandlerFunc(a.handleGetTenantUsage)))
+	a.mux.Handle("POST /tenants/{tenantID}/api-keys", a.adminAuth(a.federated(http.HandlerFunc(a.handleCreateAPIKey))))
+	a.mux.Handle("GET /tenants/{tenantID}/api-keys", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListAPIKeys))))
+	a.mux.Handle("DELETE /tenants/{tenantID}/api-keys/{keyID}", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleDeleteAPIKey))))
+
+	a.mux.Handle("POST /tenants/{tenantID}/sites", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleCreateSite))))
+	a.mux.Handle("GET /tenants/{tenantID}/sites", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListSites))))
+	a.mux.Handle("GET /tenants/{tenantID}/agents", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListTenantAgents))))
+	a.mux.Handle("POST /tenants/{tenantID}/enrollment-tokens", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleIssueEnrollmentToken))))
+	a.mux.Handle("GET /tenants/{tenantID}/enrollment-tokens", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListEnrollmentTokens))))
+	a.mux.Handle("GET /tenants/{tenantID}/enrollment-tokens/{tokenID}/cloud-init", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleEnrollmentCloudInit))))
+	a.mux.Handle("GET /tenants/{tenantID}/usage", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleGetTenantUsage))))
+	a.mux.Handle("PUT /tenants/{tenantID}/log-severity", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleSetTenantLogSeverity))))
+	a.mux.Handle("GET /tenants/{tenantID}/usage/history", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleGetTenantUsageHistory))))
+	a.mux.Handle("GET /tenants/{tenantID}/capacity", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleGetTenantCapacity))))
+	a.mux.Handle("GET /tenants/{tenantID}/audit-events", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListTenantAuditEvents))))
+	a.mux.Handle("POST /tenants/{tenantID}/webhooks", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleCreateWebhook))))
+	a.mux.Handle("GET /tenants/{tenantID}/webhooks", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleListWebhooks))))
+	a.mux.Handle("DELETE /tenants/{tenantID}/webhooks/{webhookID}", a.apiKeyAuth(a.federated(http.HandlerFunc(a.handleDeleteWebhook))))
 
 	a.mux.HandleFunc("POST /enroll", a.handleEnroll)
 	a.mux.HandleFunc("POST /v1/enroll", a.handleEnroll)
 	a.mux.Handle("POST /agents/heartbeat", a.agentMTLSAuth(http.HandlerFunc(a.handleHeartbeat)))
 	a.mux.Handle("POST /v1/heartbeat", a.agentMTLSAuth(http.HandlerFunc(a.handleHeartbeat)))
-	a.mux.Handle("POST /agents/logs", a.agentMTLSAuth(http.HandlerFunc(a.handleIngestLogs)))
-	a.mux.Handle("POST /v1/logs", a.agentMTLSAuth(http.HandlerFunc(a.handleIngestLogFrame)))
+	a.mux.Handle("POST /agents/logs", a.agentMTLSAuth(a.limitLogIngest(http.HandlerFunc(a.handleIngestLogs))))
+	a.mux.Handle("POST /v1/logs", a.agentMTLSAuth(a.limitLogIngest(http.HandlerFunc(a.handleIngestLogFrame))))
 	a.mux.Handle("GET /v1/plans/next", a.agentMTLSAuth(http.HandlerFunc(a.handleListPendingPlansV1)))
 	a.mux.Handle("POST /v1/executions/result", a.agentMTLSAuth(http.HandlerFunc(a.handleReportPlanResultV1)))
+	a.mux.Handle("POST /v1/executions/console", a.agentMTLSAuth(http.HandlerFunc(a.handleUploadConsoleLog)))
 	a.mux.Handle("POST /v1/unenroll", a.agentMTLSAuth(http.HandlerFunc(a.handleUnenroll)))
 	a.mux.Handle("POST /v1/renew", a.agentMTLSAuth(http.HandlerFunc(a.handleRenew)))
+	a.mux.Handle("POST /v1/agent-upgrade", a.agentMTLSAuth(http.HandlerFunc(a.handleReportAgentUpgrade)))
 
 	// CRL endpoints (public, no auth required)
 	a.mux.HandleFunc("GET /v1/crl", a.handleGetCRL)
 	a.mux.HandleFunc("GET /v1/crl.pem", a.handleGetCRLPEM)
 
 	a.mux.Handle("POST /sites/{siteID}/plans", a.apiKeyAuth(http.HandlerFunc(a.handleApplyPlan)))
-	a.mux.Handle("GET /sites/{siteID}/hosts", a.apiKeyAuth(http.HandlerFunc(a.handleListHosts)))
-	a.mux.Handle("GET /sites/{siteID}/vms", a.apiKeyAuth(http.HandlerFunc(a.handleListVMs)))
-	a.mux.Handle("GET /sites/{siteID}/executions", a.apiKeyAuth(http.HandlerFunc(a.handleListExecutions)))
+	a.mux.Handle("POST /sites/{siteID}/plans/estimate", a.apiKeyAuth(http.HandlerFunc(a.handleEstimatePlan)))
+	a.mux.Handle("GET /sites/{siteID}/plan-stats", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetPlanStats))))
+	a.mux.Handle("GET /sites/{siteID}/plans/{planID}", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetPlan))))
+	a.mux.Handle("GET /sites/{siteID}/plans/{planID}/graph", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetPlanGraph))))
+	a.mux.Handle("GET /sites/{siteID}/plans/{planID}/diagnostics", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetPlanDiagnostics))))
+	a.mux.Handle("POST /sites/{siteID}/plans/{planID}/retry", a.apiKeyAuth(http.HandlerFunc(a.handleRetryPlan)))
+	a.mux.Handle("GET /sites/{siteID}/desired-state", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetDesiredState))))
+	a.mux.Handle("PUT /sites/{siteID}/desired-state", a.apiKeyAuth(http.HandlerFunc(a.handleSetDesiredState)))
+	a.mux.Handle("GET /sites/{siteID}/image-defaults", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetSiteImageDefaults))))
+	a.mux.Handle("PUT /sites/{siteID}/image-defaults", a.apiKeyAuth(http.HandlerFunc(a.handleSetSiteImageDefaults)))
+	a.mux.Handle("PUT /sites/{siteID}/vm-name-policy", a.apiKeyAuth(http.HandlerFunc(a.handleSetVMNamePolicy)))
+	a.mux.Handle("GET /sites/{siteID}/agent-rollout", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetAgentRollout))))
+	a.mux.Handle("PUT /sites/{siteID}/agent-rollout", a.apiKeyAuth(http.HandlerFunc(a.handleSetAgentRollout)))
+	a.mux.Handle("GET /sites/{siteID}/hosts", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListHosts))))
+	a.mux.Handle("GET /sites/{siteID}/capacity", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetSiteCapacity))))
+	a.mux.Handle("POST /sites/{siteID}/hosts/{hostID}/maintenance", a.apiKeyAuth(http.HandlerFunc(a.handleSetHostMaintenance)))
+	a.mux.Handle("GET /sites/{siteID}/vms", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListVMs))))
+	a.mux.Handle("GET /sites/{siteID}/events/stream", a.apiKeyAuth(http.HandlerFunc(a.handleSiteEventStream)))
+	a.mux.Handle("POST /sites/{siteID}/vms/{vmID}/migrate", a.apiKeyAuth(http.HandlerFunc(a.handleMigrateVM)))
+	a.mux.Handle("GET /sites/{siteID}/migrations/{migrationID}", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetVMMigration))))
+	a.mux.Handle("GET /sites/{siteID}/agents/{agentID}/network", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetAgentNetwork))))
+	a.mux.Handle("GET /sites/{siteID}/agents/{agentID}/connectivity-history", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetAgentConnectivityHistory))))
+	a.mux.Handle("PUT /sites/{siteID}/agents/{agentID}/metadata", a.apiKeyAuth(http.HandlerFunc(a.handleSetAgentMetadata)))
+	a.mux.Handle("GET /sites/{siteID}/agents/{agentID}/leased-plans", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListAgentLeasedPlans))))
+	a.mux.Handle("GET /sites/{siteID}/agents/{agentID}/enrollment", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleGetAgentEnrollment))))
+	a.mux.Handle("GET /sites/{siteID}/prometheus-targets", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handlePrometheusTargets))))
+	a.mux.Handle("GET /sites/{siteID}/agent-metrics", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListAgentMetrics))))
+	a.mux.Handle("GET /sites/{siteID}/executions", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListExecutions))))
 	a.mux.Handle("GET /executions/{executionID}/logs", a.apiKeyAuth(http.HandlerFunc(a.handleListExecutionLogs)))
+	a.mux.Handle("GET /executions/{executionID}/logs/stats", a.apiKeyAuth(http.HandlerFunc(a.handleGetExecutionLogStats)))
+	a.mux.Handle("GET /executions/{executionID}/console", a.apiKeyAuth(http.HandlerFunc(a.handleGetExecutionConsoleLog)))
 
 	// Admin audit endpoints
 	a.mux.Handle("POST /admin/audit/verify", a.adminAuth(http.HandlerFunc(a.handleVerifyAuditChain)))
 	a.mux.Handle("GET /admin/audit/events", a.adminAuth(http.HandlerFunc(a.handleListAuditEvents)))
 	a.mux.Handle("GET /admin/audit/chain-info", a.adminAuth(http.HandlerFunc(a.handleAuditChainInfo)))
+	a.mux.Handle("POST /admin/tenants/{tenantID}/revoke-all-certs", a.adminAuth(a.federated(http.HandlerFunc(a.handleRevokeTenantCerts))))
+	a.mux.Handle("POST /admin/agents/sweep-offline", a.adminAuth(http.HandlerFunc(a.handleSweepOfflineAgents)))
+	a.mux.Handle("POST /admin/encryption/rotate", a.adminAuth(http.HandlerFunc(a.handleRotateEncryption)))
+	a.mux.Handle("GET /admin/email/deliveries", a.adminAuth(http.HandlerFunc(a.handleListEmailDeliveries)))
+	a.mux.Handle("GET /admin/ca", a.adminAuth(http.HandlerFunc(a.handleGetCA)))
+	a.mux.Handle("POST /admin/ca/rotate", a.adminAuth(http.HandlerFunc(a.handleRotateCA)))
+	a.mux.Handle("GET /admin/certificates/revoked", a.adminAuth(http.HandlerFunc(a.handleListRevokedCertificates)))
+	a.mux.Handle("GET /admin/quota-templates", a.adminAuth(http.HandlerFunc(a.handleListQuotaTemplates)))
+	a.mux.Handle("GET /admin/quota-templates/{name}", a.adminAuth(http.HandlerFunc(a.handleGetQuotaTemplate)))
+	a.mux.Handle("PUT /admin/quota-templates/{name}", a.adminAuth(http.HandlerFunc(a.handlePutQuotaTemplate)))
+	a.mux.Handle("DELETE /admin/quota-templates/{name}", a.adminAuth(http.HandlerFunc(a.handleDeleteQuotaTemplate)))
 
 	// VXLAN network endpoints
 	a.mux.Handle("POST /sites/{siteID}/vxlan-networks", a.apiKeyAuth(http.HandlerFunc(a.handleCreateVXLANNetwork)))
-	a.mux.Handle("GET /sites/{siteID}/vxlan-networks", a.apiKeyAuth(http.HandlerFunc(a.handleListVXLANNetworks)))
+	a.mux.Handle("GET /sites/{siteID}/vxlan-networks", a.apiKeyAuth(a.federatedSite(http.HandlerFunc(a.handleListVXLANNetworks))))
 	a.mux.Handle("GET /vxlan-networks/{networkID}", a.apiKeyAuth(http.HandlerFunc(a.handleGetVXLANNetwork)))
+	a.mux.Handle("GET /vxlan-networks/{networkID}/tunnels", a.apiKeyAuth(http.HandlerFunc(a.handleListVXLANTunnels)))
 	a.mux.Handle("DELETE /vxlan-networks/{networkID}", a.apiKeyAuth(http.HandlerFunc(a.handleDeleteVXLANNetwork)))
+	a.mux.Handle("GET /vxlan-networks/{networkID}/dns-records", a.apiKeyAuth(http.HandlerFunc(a.handleListVMDNSRecords)))
 
 	// VM network attachment endpoints
+	a.mux.Handle("GET /vms/{vmID}/networks", a.apiKeyAuth(http.HandlerFunc(a.handleListVMNetworks)))
 	a.mux.Handle("POST /vms/{vmID}/networks", a.apiKeyAuth(http.HandlerFunc(a.handleAttachVMToNetwork)))
 	a.mux.Handle("DELETE /vms/{vmID}/networks/{networkID}", a.apiKeyAuth(http.HandlerFunc(a.handleDetachVMFromNetwork)))
 }
@@ -408,6 +581,10 @@ func (a *App) agentMTLSAuth(next http.Handler) http.Handler {
 			writeError(w, http.StatusUnauthorized, "invalid client certificate")
 			return
 		}
+		if err := a.ca.Verify(cert); err != nil {
+			writeError(w, http.StatusUnauthorized, "untrusted client certificate")
+			return
+		}
 
 		// Check if certificate is revoked in CRL
 		serial := cert.SerialNumber.String()
@@ -420,7 +597,11 @@ func (a *App) agentMTLSAuth(next http.Handler) http.Handler {
 		isRevoked, err := a.repo.IsCertificateRevoked(r.Context(), serial)
 		if err != nil {
 			log.Printf("error checking certificate revocation: %v", err)
-			// Continue anyway, don't block on DB error
+			if a.cfg.RevocationFailClosed && !a.crlFresh(time.Now()) {
+				writeError(w, http.StatusServiceUnavailable, "certificate revocation status unavailable")
+				return
+			}
+			// Fail open: the CRL check above is the best we have
 		} else if isRevoked {
 			writeError(w, http.StatusUnauthorized, "certificate revoked")
 			return
@@ -440,17 +621,27 @@ func (a *App) agentMTLSAuth(next http.Handler) http.Handler {
 	})
 }
 
+// crlFresh reports whether the local CRL was updated within CRLMaxAge of
+// now, recently enough to decide revocation on its own.
+func (a *App) crlFresh(now time.Time) bool {
+	updated := a.crlManager.GetLastUpdated()
+	return a.cfg.CRLMaxAge > 0 && !updated.IsZero() && now.Sub(updated) <= a.cfg.CRLMaxAge
+}
+
 type ctxTenantID struct{}
 type ctxAgent struct{}
 
+// createTenantRequest is the body of POST /tenants.
+type createTenantRequest struct {
+	Slug              string `json:"slug"`
+	Name              string `json:"name"`
+	PrimaryRegion     string `json:"primary_region"`
+	DataRetentionDays int    `json:"data_retention_days"`
+	QuotaTemplate     string `json:"quota_template"`
+}
+
 func (a *App) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
-	type request struct {
-		Slug              string `json:"slug"`
-		Name              string `json:"name"`
-		PrimaryRegion     string `json:"primary_region"`
-		DataRetentionDays int    `json:"data_retention_days"`
-	}
-	var req request
+	var req createTenantRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
@@ -471,12 +662,17 @@ func (a *App) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
 		Name:          req.Name,
 		PrimaryRegion: req.PrimaryRegion,
 		RetentionDays: req.DataRetentionDays,
+		QuotaTemplate: strings.TrimSpace(req.QuotaTemplate),
 	})
 	if err != nil {
 		if errors.Is(err, store.ErrConflict) {
 			writeError(w, http.StatusConflict, "tenant slug already exists")
 			return
 		}
+		if errors.Is(err, store.ErrInvalidQuotaTemplate) {
+			writeError(w, http.StatusBadRequest, "unknown quota template")
+			return
+		}
 		writeError(w, http.StatusInternalServerError, "failed to create tenant")
 		return
 	}
@@ -490,7 +686,7 @@ func (a *App) handleListTenants(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to list tenants")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"tenants": tenants})
+	writeJSON(w, http.StatusOK, listTenantsResponse{Tenants: tenants})
 }
 
 func (a *App) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
@@ -554,12 +750,12 @@ func (a *App) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	_ = a.writeAudit(r.Context(), tenantID, "", "SYSTEM", "", "apikey.create", "api_key", created.ID, requestID(r), sourceIP(r), nil)
-	writeJSON(w, http.StatusCreated, map[string]any{
-		"id":         created.ID,
-		"tenant_id":  created.TenantID,
-		"name":       created.Name,
-		"api_key":    plainKey,
-		"expires_at": created.ExpiresAt,
+	writeJSON(w, http.StatusCreated, createAPIKeyResponse{
+		ID:        created.ID,
+		TenantID:  created.TenantID,
+		Name:      created.Name,
+		APIKey:    plainKey,
+		ExpiresAt: created.ExpiresAt,
 	})
 }
 
@@ -601,18 +797,21 @@ func (a *App) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// createSiteRequest is the body of POST /tenants/{tenantID}/sites.
+type createSiteRequest struct {
+	Name                string `json:"name"`
+	ExternalKey         string `json:"external_key"`
+	LocationCountryCode string `json:"location_country_code"`
+	UniqueVMNames       bool   `json:"unique_vm_names"`
+}
+
 func (a *App) handleCreateSite(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.PathValue("tenantID")
 	if !a.tenantAllowed(r.Context(), tenantID) {
 		writeError(w, http.StatusForbidden, "tenant mismatch")
 		return
 	}
-	type request struct {
-		Name                string `json:"name"`
-		ExternalKey         string `json:"external_key"`
-		LocationCountryCode string `json:"location_country_code"`
-	}
-	var req request
+	var req createSiteRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
@@ -638,6 +837,7 @@ func (a *App) handleCreateSite(w http.ResponseWriter, r *http.Request) {
 		Name:            req.Name,
 		ExternalKey:     req.ExternalKey,
 		LocationCountry: strings.ToUpper(req.LocationCountryCode),
+		UniqueVMNames:   req.UniqueVMNames,
 	})
 	if err != nil {
 		if errors.Is(err, store.ErrConflict) {
@@ -666,20 +866,102 @@ func (a *App) handleListSites(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to list sites")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"sites": sites})
+	writeJSON(w, http.StatusOK, listSitesResponse{Sites: sites})
 }
 
-func (a *App) handleIssueEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+// vmNamePolicy is the body of PUT /sites/{siteID}/vm-name-policy.
+type vmNamePolicy struct {
+	SiteID        string `json:"site_id,omitempty"`
+	UniqueVMNames bool   `json:"unique_vm_names"`
+	NameTemplate  string `json:"name_template,omitempty"`
+}
+
+// handleSetVMNamePolicy turns unique VM name enforcement of the site on or
+// off and sets the template naming unnamed CREATEs of plans without their
+// own. It applies to plans submitted afterwards.
+func (a *App) handleSetVMNamePolicy(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	var req vmNamePolicy
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.NameTemplate = strings.TrimSpace(req.NameTemplate)
+	if req.NameTemplate != "" {
+		if err := store.ValidateNameTemplate(req.NameTemplate); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := a.repo.SetSiteVMNamePolicy(r.Context(), tenantID, siteID, req.UniqueVMNames, req.NameTemplate); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "site not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to set vm name policy")
+		return
+	}
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "site.vm_name_policy.update", "site", siteID, requestID(r), sourceIP(r), nil)
+	writeJSON(w, http.StatusOK, vmNamePolicy{SiteID: siteID, UniqueVMNames: req.UniqueVMNames, NameTemplate: req.NameTemplate})
+}
+
+// handleListTenantAgents lists agents across all of the tenant's sites,
+// optionally filtered by state. Pages are ordered by agent ID; next_cursor
+// is set when more agents follow.
+func (a *App) handleListTenantAgents(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.PathValue("tenantID")
 	if !a.tenantAllowed(r.Context(), tenantID) {
 		writeError(w, http.StatusForbidden, "tenant mismatch")
 		return
 	}
-	type request struct {
-		SiteID           string `json:"site_id"`
-		ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	q := r.URL.Query()
+	state := strings.ToUpper(strings.TrimSpace(q.Get("state")))
+	if state != "" && !store.ValidAgentState(state) {
+		writeError(w, http.StatusBadRequest, "state must be ONLINE, DEGRADED or OFFLINE")
+		return
 	}
-	var req request
+	cursor := strings.TrimSpace(q.Get("cursor"))
+	if cursor != "" {
+		if _, err := uuid.Parse(cursor); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	agents, err := a.repo.ListTenantAgents(r.Context(), tenantID, store.TenantAgentQuery{State: state, Cursor: cursor, Limit: limit + 1})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list agents")
+		return
+	}
+	resp := map[string]any{}
+	if len(agents) > limit {
+		agents = agents[:limit]
+		resp["next_cursor"] = agents[limit-1].ID
+	}
+	resp["agents"] = agents
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// enrollmentTokenRequest is the body of POST /tenants/{tenantID}/enrollment-tokens.
+type enrollmentTokenRequest struct {
+	SiteID           string `json:"site_id"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	// Scope limits the agent that enrolls with the token; omitted enrolls
+	// a full agent.
+	Scope *store.AgentScope `json:"scope,omitempty"`
+}
+
+func (a *App) handleIssueEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	var req enrollmentTokenRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
@@ -688,6 +970,11 @@ func (a *App) handleIssueEnrollmentToken(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusBadRequest, "invalid site_id")
 		return
 	}
+	scope, err := store.NormalizeAgentScope(req.Scope)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid scope: "+err.Error())
+		return
+	}
 	ok, err := a.repo.SiteBelongsToTenant(r.Context(), req.SiteID, tenantID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "site lookup failed")
@@ -713,18 +1000,24 @@ func (a *App) handleIssueEnrollmentToken(w http.ResponseWriter, r *http.Request)
 		SiteID:    req.SiteID,
 		TokenHash: hashString(plainToken),
 		ExpiresAt: expiresAt,
+		Scope:     scope,
 	})
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to issue token")
 		return
 	}
-	_ = a.writeAudit(r.Context(), tenantID, req.SiteID, "USER", "api-key", "enrollment_token.issue", "enrollment_token", issued.ID, requestID(r), sourceIP(r), nil)
-	writeJSON(w, http.StatusCreated, map[string]any{
-		"token_id":   issued.ID,
-		"site_id":    issued.SiteID,
-		"token":      plainToken,
-		"expires_at": issued.ExpiresAt,
-		"one_time":   true,
+	var metadata []byte
+	if scope != nil {
+		metadata, _ = json.Marshal(map[string]any{"scope": scope})
+	}
+	_ = a.writeAudit(r.Context(), tenantID, req.SiteID, "USER", "api-key", "enrollment_token.issue", "enrollment_token", issued.ID, requestID(r), sourceIP(r), metadata)
+	writeJSON(w, http.StatusCreated, enrollmentTokenResponse{
+		TokenID:   issued.ID,
+		SiteID:    issued.SiteID,
+		Token:     plainToken,
+		ExpiresAt: issued.ExpiresAt,
+		OneTime:   true,
+		Scope:     scope,
 	})
 }
 
@@ -759,30 +1052,89 @@ func (a *App) handleGetTenantUsage(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, status)
 }
 
-func (a *App) handleEnroll(w http.ResponseWriter, r *http.Request) {
-	type request struct {
-		EnrollmentToken   string            `json:"enrollment_token"`
-		AgentVersion      string            `json:"agent_version"`
-		Hostname          string            `json:"hostname"`
-		RequestedHostname string            `json:"requested_hostname"`
-		OS                string            `json:"os"`
-		Arch              string            `json:"arch"`
-		KernelVersion     string            `json:"kernel_version"`
-		CSRPEM            string            `json:"csr_pem"`
-		Labels            map[string]string `json:"labels"`
-		BootstrapNonce    string            `json:"bootstrap_nonce"`
+func (a *App) handleGetTenantCapacity(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
 	}
-	var req request
+	capacity, err := a.repo.GetCapacity(r.Context(), tenantID, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get capacity")
+		return
+	}
+	writeJSON(w, http.StatusOK, capacity)
+}
+
+func (a *App) handleGetSiteCapacity(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	capacity, err := a.repo.GetCapacity(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get capacity")
+		return
+	}
+	writeJSON(w, http.StatusOK, capacity)
+}
+
+// enrollRequest is the body of POST /enroll.
+type enrollRequest struct {
+	EnrollmentToken   string            `json:"enrollment_token"`
+	AgentVersion      string            `json:"agent_version"`
+	Hostname          string            `json:"hostname"`
+	RequestedHostname string            `json:"requested_hostname"`
+	OS                string            `json:"os"`
+	Arch              string            `json:"arch"`
+	KernelVersion     string            `json:"kernel_version"`
+	CSRPEM            string            `json:"csr_pem"`
+	Labels            map[string]string `json:"labels"`
+	BootstrapNonce    string            `json:"bootstrap_nonce"`
+	SchemaVersion     int               `json:"schema_version"`
+}
+
+func (a *App) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	var req enrollRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if _, err := checkSchemaVersion("enroll", req.SchemaVersion, MinEnrollSchemaVersion, EnrollSchemaVersion); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	hostname := firstNonEmpty(req.Hostname, req.RequestedHostname)
 	if req.EnrollmentToken == "" || req.CSRPEM == "" || hostname == "" {
 		writeError(w, http.StatusBadRequest, "enrollment_token, hostname and csr_pem are required")
 		return
 	}
-	consume, err := a.repo.ConsumeEnrollmentToken(r.Context(), hashString(req.EnrollmentToken), time.Now().UTC())
+	// The token is what identifies the site: it is looked up without
+	// being consumed, so an enrollment the site limit turns away can be
+	// retried with the same token.
+	tokenHash := hashString(req.EnrollmentToken)
+	siteID, err := a.repo.EnrollmentTokenSite(r.Context(), tokenHash, time.Now().UTC())
+	if err != nil {
+		if errors.Is(err, store.ErrTokenInvalid) {
+			writeError(w, http.StatusUnauthorized, "invalid or expired enrollment token")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to validate enrollment token")
+		return
+	}
+	if !a.siteEnrollLimiter.Allow(siteID) {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusTooManyRequests, "enrollment rate limit exceeded for site")
+		return
+	}
+	consume, err := a.repo.ConsumeEnrollmentToken(r.Context(), tokenHash, time.Now().UTC())
 	if err != nil {
 		if errors.Is(err, store.ErrTokenInvalid) {
 			writeError(w, http.StatusUnauthorized, "invalid or expired enrollment token")
@@ -813,6 +1165,18 @@ func (a *App) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		OS:               valueOr(req.OS, "linux"),
 		Arch:             valueOr(req.Arch, "amd64"),
 		KernelVersion:    req.KernelVersion,
+		Scope:            consume.Scope,
+		Bootstrap: &store.EnrollmentBootstrap{
+			Hostname:          hostname,
+			RequestedHostname: req.RequestedHostname,
+			AgentVersion:      req.AgentVersion,
+			OS:                req.OS,
+			Arch:              req.Arch,
+			KernelVersion:     req.KernelVersion,
+			BootstrapNonce:    req.BootstrapNonce,
+			SchemaVersion:     req.SchemaVersion,
+			SourceIP:          sourceIP(r),
+		},
 	}, hostname)
 	if err != nil {
 		if errors.Is(err, store.ErrConflict) {
@@ -822,77 +1186,38 @@ func (a *App) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to create agent")
 		return
 	}
+	a.recordCertIssuance(r.Context(), agent.ID, certSerial)
 	_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "AGENT", agent.ID, "agent.enroll", "agent", agent.ID, requestID(r), sourceIP(r), nil)
 	a.metrics.enrollmentsTotal.Add(1)
 	heartbeatSeconds := int(a.cfg.HeartbeatInterval.Seconds())
 	if heartbeatSeconds <= 0 {
 		heartbeatSeconds = 15
 	}
-	writeJSON(w, http.StatusOK, map[string]any{
-		"tenant_id":                  agent.TenantID,
-		"site_id":                    agent.SiteID,
-		"host_id":                    agent.HostID,
-		"agent_id":                   agent.ID,
-		"client_certificate_pem":     string(certPEM),
-		"ca_certificate_pem":         string(a.ca.CertPEM()),
-		"refresh_token":              refreshToken,
-		"heartbeat_endpoint":         "/agents/heartbeat",
-		"heartbeat_interval_sec":     heartbeatSeconds,
-		"heartbeat_interval_seconds": heartbeatSeconds,
+	writeJSON(w, http.StatusOK, enrollResponse{
+		TenantID:             agent.TenantID,
+		SiteID:               agent.SiteID,
+		HostID:               agent.HostID,
+		AgentID:              agent.ID,
+		ClientCertificatePEM: string(certPEM),
+		CACertificatePEM:     string(a.ca.CertPEM()),
+		RefreshToken:         refreshToken,
+		HeartbeatEndpoint:    "/agents/heartbeat",
+		HeartbeatIntervalSec: heartbeatSeconds,
+		HeartbeatSeconds:     heartbeatSeconds,
+		ServerVersion:        a.cfg.Build.withDefaults().Version,
 	})
 }
 
 func (a *App) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	agent := r.Context().Value(ctxAgent{}).(store.Agent)
-	type hostFacts struct {
-		CPUCores    int   `json:"cpu_cores"`
-		MemoryTotal int64 `json:"memory_total_bytes"`
-		Disks       []struct {
-			Mountpoint string `json:"mountpoint"`
-			TotalBytes int64  `json:"total_bytes"`
-			FreeBytes  int64  `json:"free_bytes"`
-		} `json:"disks"`
-		OS     string `json:"os"`
-		Arch   string `json:"arch"`
-		Kernel string `json:"kernel"`
-		KVM    struct {
-			Present  bool `json:"present"`
-			Readable bool `json:"readable"`
-			Writable bool `json:"writable"`
-		} `json:"kvm"`
-	}
-	type vmCompat struct {
-		ID         string    `json:"id"`
-		Name       string    `json:"name"`
-		State      string    `json:"state"`
-		Status     string    `json:"status"`
-		VCPUCount  int       `json:"vcpu_count"`
-		MemoryMiB  int64     `json:"memory_mib"`
-		KernelPath string    `json:"kernel_path"`
-		RootfsPath string    `json:"rootfs_path"`
-		TapIface   string    `json:"tap_iface"`
-		CHPID      int       `json:"ch_pid"`
-		UpdatedAt  time.Time `json:"updated_at"`
-	}
-	type request struct {
-		AgentID                  string                  `json:"agent_id"`
-		HeartbeatSeq             int64                   `json:"heartbeat_seq"`
-		AgentVersion             string                  `json:"agent_version"`
-		OS                       string                  `json:"os"`
-		Arch                     string                  `json:"arch"`
-		KernelVersion            string                  `json:"kernel_version"`
-		Hostname                 string                  `json:"hostname"`
-		CPUCoresTotal            int                     `json:"cpu_cores_total"`
-		MemoryBytesTotal         int64                   `json:"memory_bytes_total"`
-		StorageBytesTotal        int64                   `json:"storage_bytes_total"`
-		KVMAvailable             bool                    `json:"kvm_available"`
-		CloudHypervisorAvailable bool                    `json:"cloud_hypervisor_available"`
-		MicroVMs                 []vmCompat              `json:"microvms"`
-		ExecutionUpdates         []store.ExecutionUpdate `json:"execution_updates"`
-		HostFacts                hostFacts               `json:"host_facts"`
+	body, err := decodedBody(r)
+	if err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
 	}
-	var req request
-	if err := decodeJSONAllowUnknown(r.Body, &req); err != nil {
+	defer body.Close()
+	var req heartbeatRequest
+	if err := decodeJSONAllowUnknown(body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -900,43 +1225,16 @@ func (a *App) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "agent_id mismatch")
 		return
 	}
-	if req.CPUCoresTotal == 0 && req.HostFacts.CPUCores > 0 {
-		req.CPUCoresTotal = req.HostFacts.CPUCores
-	}
-	if req.MemoryBytesTotal == 0 && req.HostFacts.MemoryTotal > 0 {
-		req.MemoryBytesTotal = req.HostFacts.MemoryTotal
-	}
-	if req.StorageBytesTotal == 0 && len(req.HostFacts.Disks) > 0 {
-		var sum int64
-		for _, d := range req.HostFacts.Disks {
-			sum += d.TotalBytes
-		}
-		req.StorageBytesTotal = sum
-	}
-	if req.OS == "" {
-		req.OS = req.HostFacts.OS
-	}
-	if req.Arch == "" {
-		req.Arch = req.HostFacts.Arch
-	}
-	if req.KernelVersion == "" {
-		req.KernelVersion = req.HostFacts.Kernel
-	}
-	if !req.KVMAvailable {
-		req.KVMAvailable = req.HostFacts.KVM.Present && req.HostFacts.KVM.Readable && req.HostFacts.KVM.Writable
-	}
-	if !req.CloudHypervisorAvailable {
-		req.CloudHypervisorAvailable = req.KVMAvailable
-	}
-	if req.Hostname == "" {
-		req.Hostname = "unknown"
+	if err := req.normalize(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 	vms := make([]store.MicroVMHeartbeat, 0, len(req.MicroVMs))
 	for _, vm := range req.MicroVMs {
 		if strings.TrimSpace(vm.ID) == "" {
 			continue
 		}
-		state := firstNonEmpty(vm.State, vm.Status)
+		state := vm.State
 		if state == "" {
 			state = "CREATING"
 		}
@@ -957,7 +1255,41 @@ func (a *App) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 			UpdatedAt: vm.UpdatedAt,
 		})
 	}
-	err := a.repo.IngestHeartbeat(r.Context(), store.Heartbeat{
+	var netbird *store.AgentNetworkStatus
+	if nb := req.NetBirdStatus; nb != nil {
+		netbird = &store.AgentNetworkStatus{
+			Connected:       nb.Connected,
+			State:           nb.State,
+			Reason:          nb.Reason,
+			PeerID:          nb.PeerID,
+			PeerIP:          nb.IPv4,
+			NetworkID:       nb.NetworkID,
+			LastHandshakeAt: nb.LastHandshakeAt,
+			RouteStatus:     nb.RouteStatus,
+		}
+	}
+	heartbeatSeconds := int(a.cfg.HeartbeatInterval.Seconds())
+	if heartbeatSeconds <= 0 {
+		heartbeatSeconds = 15
+	}
+	if a.ReadOnly() {
+		// Nothing is recorded or leased; the agent keeps its cadence.
+		writeJSON(w, http.StatusOK, heartbeatResponse{
+			NextHeartbeatSeconds: heartbeatSeconds,
+			PendingPlans:         []leasedPlanPayload{},
+			ReadOnly:             true,
+		})
+		return
+	}
+	release, ok := a.heartbeats.tryAcquire()
+	if !ok {
+		writeHeartbeatBusy(w, heartbeatSeconds)
+		return
+	}
+	defer release()
+	vmStates := a.vmStatesBefore(r, agent)
+	pushedMetrics, droppedMetrics := store.FilterAgentMetrics(req.Metrics)
+	err = a.repo.IngestHeartbeat(r.Context(), store.Heartbeat{
 		AgentID:                  agent.ID,
 		HeartbeatSeq:             req.HeartbeatSeq,
 		AgentVersion:             valueOr(req.AgentVersion, agent.AgentVersion),
@@ -970,28 +1302,82 @@ func (a *App) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		StorageBytesTotal:        req.StorageBytesTotal,
 		KVMAvailable:             req.KVMAvailable,
 		CloudHypervisorAvailable: req.CloudHypervisorAvailable,
+		FactsError:               strings.TrimSpace(req.FactsError),
+		MetricsAddr:              strings.TrimSpace(req.MetricsAddr),
 		MicroVMs:                 vms,
 		ExecutionUpdates:         req.ExecutionUpdates,
+		NetBird:                  netbird,
+		Metrics:                  pushedMetrics,
+		ShutdownReason:           req.ShutdownReason,
 	})
+	if errors.Is(err, store.ErrStaleHeartbeat) {
+		// A newer heartbeat was already applied; its response carried the
+		// plans, so this one only tells the agent it was dropped.
+		writeJSON(w, http.StatusOK, heartbeatResponse{
+			Stale:                true,
+			NextHeartbeatSeconds: heartbeatSeconds,
+			PendingPlans:         []leasedPlanPayload{},
+		})
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to ingest heartbeat")
 		return
 	}
 	a.metrics.heartbeatsTotal.Add(1)
+	a.publishHeartbeatEvents(r.Context(), agent, vmStates, vms)
+	if req.ShutdownReason != "" {
+		// The audit log is the agent's history: it records why the agent
+		// went offline next to its enrollment and upgrades.
+		metadata, _ := json.Marshal(map[string]any{"reason": req.ShutdownReason, "final_heartbeat": req.Shutdown})
+		_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "AGENT", agent.ID, "agent.shutdown", "agent", agent.ID, requestID(r), sourceIP(r), metadata)
+	}
+	drift, hasDrift := a.clockDrift.observe(agent.ID, req.SentAt, time.Now().UTC())
 
 	pending, err := a.repo.LeasePendingPlans(r.Context(), agent.ID, a.cfg.MaxPlansPerHeartbeat, a.cfg.PlanLeaseTTL)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to lease plans")
 		return
 	}
-	heartbeatSeconds := int(a.cfg.HeartbeatInterval.Seconds())
-	if heartbeatSeconds <= 0 {
-		heartbeatSeconds = 15
+	maintenance, err := a.repo.AgentHostInMaintenance(r.Context(), agent.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load host maintenance state")
+		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{
-		"next_heartbeat_seconds": heartbeatSeconds,
-		"pending_plans":          leasedPlansToAgentPayload(pending),
-	})
+	targetVersion, err := a.repo.ClaimAgentUpgrade(r.Context(), agent.ID, valueOr(req.AgentVersion, agent.AgentVersion))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to check agent rollout")
+		return
+	}
+	// Label the plans with the facts of this heartbeat, not the last one.
+	labeled := agent
+	labeled.OS = valueOr(req.OS, agent.OS)
+	labeled.Arch = valueOr(req.Arch, agent.Arch)
+	labeled.KernelVersion = valueOr(req.KernelVersion, agent.KernelVersion)
+	resp := heartbeatResponse{
+		NextHeartbeatSeconds: heartbeatSeconds,
+		PendingPlans:         leasedPlansToAgentPayload(pending, a.cfg.ActionResultTTL, agentLabels(labeled)),
+		Maintenance:          maintenance,
+		TargetAgentVersion:   targetVersion,
+		DroppedMetrics:       droppedMetrics,
+	}
+	if a.cfg.VMDNSHostnames != "" {
+		// The agent's metadata server answers guests' peer lookups from
+		// these, so the full set is sent even when it is empty.
+		records, err := a.repo.ListVMDNSRecords(r.Context(), agent.SiteID, "")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load VM DNS records")
+			return
+		}
+		if records == nil {
+			records = []store.VMDNSRecord{}
+		}
+		resp.DNSRecords = &records
+	}
+	if hasDrift && a.cfg.ClockDriftThreshold > 0 && drift.Abs() > a.cfg.ClockDriftThreshold {
+		resp.ClockDriftSeconds = drift.Seconds()
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (a *App) handleIngestLogFrame(w http.ResponseWriter, r *http.Request) {
@@ -1037,22 +1423,30 @@ func (a *App) handleIngestLogFrame(w http.ResponseWriter, r *http.Request) {
 
 func (a *App) handleListPendingPlansV1(w http.ResponseWriter, r *http.Request) {
 	agent := r.Context().Value(ctxAgent{}).(store.Agent)
+	if a.ReadOnly() {
+		writeJSON(w, http.StatusOK, nextPlansResponse{Plans: []leasedPlanPayload{}})
+		return
+	}
 	pending, err := a.repo.LeasePendingPlans(r.Context(), agent.ID, a.cfg.MaxPlansPerHeartbeat, a.cfg.PlanLeaseTTL)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to lease plans")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"plans": leasedPlansToAgentPayload(pending)})
+	writeJSON(w, http.StatusOK, nextPlansResponse{Plans: leasedPlansToAgentPayload(pending, a.cfg.ActionResultTTL, agentLabels(agent))})
 }
 
 func (a *App) handleReportPlanResultV1(w http.ResponseWriter, r *http.Request) {
 	agent := r.Context().Value(ctxAgent{}).(store.Agent)
 	type actionResult struct {
-		ActionID   string    `json:"action_id"`
-		OK         bool      `json:"ok"`
-		ErrorCode  string    `json:"error_code"`
-		Message    string    `json:"message"`
-		FinishedAt time.Time `json:"finished_at"`
+		ActionID         string    `json:"action_id"`
+		OK               bool      `json:"ok"`
+		ErrorCode        string    `json:"error_code"`
+		Message          string    `json:"message"`
+		FinishedAt       time.Time `json:"finished_at"`
+		IdempotencyToken string    `json:"idempotency_token"`
+		// Sent by agents along with each result; not stored.
+		ExecutionID string    `json:"execution_id"`
+		StartedAt   time.Time `json:"started_at"`
 	}
 	type request struct {
 		PlanID      string         `json:"plan_id"`
@@ -1066,12 +1460,14 @@ func (a *App) handleReportPlanResultV1(w http.ResponseWriter, r *http.Request) {
 	}
 	items := make([]store.PlanActionResultItem, 0, len(req.Results))
 	for _, result := range req.Results {
+		errorCode, message := store.NormalizeFailure(result.ErrorCode, strings.TrimSpace(result.Message))
 		items = append(items, store.PlanActionResultItem{
-			ActionID:   strings.TrimSpace(result.ActionID),
-			OK:         result.OK,
-			ErrorCode:  strings.TrimSpace(result.ErrorCode),
-			Message:    strings.TrimSpace(result.Message),
-			FinishedAt: result.FinishedAt,
+			ActionID:         strings.TrimSpace(result.ActionID),
+			OK:               result.OK,
+			ErrorCode:        errorCode,
+			Message:          message,
+			FinishedAt:       result.FinishedAt,
+			IdempotencyToken: strings.TrimSpace(result.IdempotencyToken),
 		})
 	}
 	if len(items) == 0 {
@@ -1083,6 +1479,12 @@ func (a *App) handleReportPlanResultV1(w http.ResponseWriter, r *http.Request) {
 		ExecutionID: strings.TrimSpace(req.ExecutionID),
 		Results:     items,
 	})
+	if errors.Is(err, store.ErrDuplicateReport) {
+		// A resend of a report already applied: acknowledge it so the agent
+		// forgets it, without transitioning or publishing anything again.
+		writeJSON(w, http.StatusAccepted, map[string]any{"status": "duplicate"})
+		return
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, store.ErrNotFound):
@@ -1095,9 +1497,52 @@ func (a *App) handleReportPlanResultV1(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	a.metrics.executionsTotal.Add(1)
+	a.publishPlanStatus(r, agent.TenantID, agent.SiteID, firstNonEmpty(strings.TrimSpace(req.PlanID), strings.TrimSpace(req.ExecutionID)))
 	writeJSON(w, http.StatusAccepted, map[string]any{"status": "accepted"})
 }
 
+// handleUploadConsoleLog stores the console log of a VM whose CREATE or
+// START failed. The store keeps only the tail, up to
+// store.MaxConsoleLogBytes.
+func (a *App) handleUploadConsoleLog(w http.ResponseWriter, r *http.Request) {
+	agent := r.Context().Value(ctxAgent{}).(store.Agent)
+	type request struct {
+		ExecutionID string `json:"execution_id"`
+		ActionID    string `json:"action_id"`
+		VMID        string `json:"vm_id"`
+		Content     string `json:"content"`
+		Truncated   bool   `json:"truncated"`
+	}
+	var req request
+	if err := decodeJSONAllowUnknown(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.ExecutionID) == "" || strings.TrimSpace(req.ActionID) == "" {
+		writeError(w, http.StatusBadRequest, "execution_id and action_id are required")
+		return
+	}
+	_, err := a.repo.PutExecutionConsoleLog(r.Context(), agent.ID, store.ConsoleLogUpload{
+		ExecutionID: req.ExecutionID,
+		ActionID:    req.ActionID,
+		VMID:        req.VMID,
+		Content:     req.Content,
+		Truncated:   req.Truncated,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "execution not found")
+		case errors.Is(err, store.ErrUnauthorized):
+			writeError(w, http.StatusForbidden, "agent does not own plan")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to store console log")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (a *App) handleIngestLogs(w http.ResponseWriter, r *http.Request) {
 	agent := r.Context().Value(ctxAgent{}).(store.Agent)
 	type request struct {
@@ -1118,68 +1563,791 @@ func (a *App) handleIngestLogs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to ingest logs")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"accepted_frames": accepted, "dropped_frames": dropped})
+	// Entries neither accepted nor dropped were below the tenant's minimum
+	// severity.
+	filtered := int64(len(req.Entries)) - accepted - dropped
+	writeJSON(w, http.StatusOK, ingestLogsResponse{AcceptedFrames: accepted, DroppedFrames: dropped, FilteredFrames: filtered})
 }
 
-func (a *App) handleApplyPlan(w http.ResponseWriter, r *http.Request) {
-	tenantID := r.Context().Value(ctxTenantID{}).(string)
-	siteID := r.PathValue("siteID")
-	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "site lookup failed")
-		return
-	}
-	if !ok {
-		writeError(w, http.StatusNotFound, "site not found")
+// handleSetTenantLogSeverity sets the minimum severity of the execution
+// log entries stored for the tenant; agents may keep sending everything.
+func (a *App) handleSetTenantLogSeverity(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
 		return
 	}
-	type request struct {
-		IdempotencyKey  string                  `json:"idempotency_key"`
-		ClientRequestID string                  `json:"client_request_id"`
-		Actions         []store.ApplyPlanAction `json:"actions"`
+	var req struct {
+		MinSeverity string `json:"min_severity"`
 	}
-	var req request
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if strings.TrimSpace(req.IdempotencyKey) == "" {
-		writeError(w, http.StatusBadRequest, "idempotency_key is required")
+	severity := strings.ToUpper(strings.TrimSpace(req.MinSeverity))
+	t, err := a.repo.SetTenantLogSeverity(r.Context(), tenantID, severity)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidLogSeverity):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "tenant not found")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to set log severity")
+		}
+		return
+	}
+	metadata, _ := json.Marshal(map[string]any{"min_severity": severity})
+	_ = a.writeAudit(r.Context(), tenantID, "", "USER", "api-key", "tenant.set_log_severity", "tenant", tenantID, requestID(r), sourceIP(r), metadata)
+	writeJSON(w, http.StatusOK, t)
+}
+
+// applyPlanRequest is the body of POST /sites/{siteID}/plans.
+type applyPlanRequest struct {
+	IdempotencyKey  string                  `json:"idempotency_key"`
+	ClientRequestID string                  `json:"client_request_id"`
+	NameTemplate    string                  `json:"name_template"`
+	Metadata        json.RawMessage         `json:"metadata"`
+	Sequential      bool                    `json:"sequential"`
+	Actions         []store.ApplyPlanAction `json:"actions"`
+}
+
+func (a *App) handleApplyPlan(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	var req applyPlanRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.IdempotencyKey) == "" {
+		writeError(w, http.StatusBadRequest, "idempotency_key is required")
 		return
 	}
 	if len(req.Actions) == 0 {
 		writeError(w, http.StatusBadRequest, "actions are required")
 		return
 	}
-	result, err := a.repo.ApplyPlan(r.Context(), store.ApplyPlanInput{
-		TenantID:        tenantID,
-		SiteID:          siteID,
-		IdempotencyKey:  req.IdempotencyKey,
-		ClientRequestID: req.ClientRequestID,
-		Actions:         req.Actions,
-	})
-	if err != nil {
-		if errors.Is(err, store.ErrUnauthorized) {
-			writeError(w, http.StatusForbidden, "tenant mismatch")
-			return
+	if err := a.validatePlanActions(req.Actions); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.applyImageDefaults(r.Context(), tenantID, siteID, req.Actions); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load site image defaults")
+		return
+	}
+	req.NameTemplate = strings.TrimSpace(req.NameTemplate)
+	if req.NameTemplate != "" {
+		if err := store.ValidateNameTemplate(req.NameTemplate); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := store.ValidatePlanMetadata(req.Metadata); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := a.repo.ApplyPlan(r.Context(), store.ApplyPlanInput{
+		TenantID:        tenantID,
+		SiteID:          siteID,
+		IdempotencyKey:  req.IdempotencyKey,
+		ClientRequestID: req.ClientRequestID,
+		NameTemplate:    req.NameTemplate,
+		Metadata:        req.Metadata,
+		Sequential:      req.Sequential,
+		Actions:         req.Actions,
+	})
+	if err != nil {
+		writeApplyPlanError(w, err)
+		return
+	}
+	auditMetadata, _ := json.Marshal(map[string]any{
+		"operations": json.RawMessage(result.Plan.OperationsJSON),
+		"metadata":   result.Plan.Metadata,
+	})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "plan.apply", "plan", result.Plan.ID, requestID(r), sourceIP(r), auditMetadata)
+	a.metrics.plansApplied.Add(1)
+	if !result.Deduplicated {
+		a.publishPlan(r.Context(), result.Plan)
+	}
+	writeJSON(w, http.StatusOK, applyPlanResponse{
+		PlanID:       result.Plan.ID,
+		PlanVersion:  result.Plan.PlanVersion,
+		PlanStatus:   result.Plan.Status,
+		Metadata:     result.Plan.Metadata,
+		Sequential:   result.Plan.Sequential,
+		Deduplicated: result.Deduplicated,
+		Executions:   result.Executions,
+		Progress:     store.PlanProgressFromExecutions(result.Executions),
+	})
+}
+
+// writeApplyPlanError answers a failed Repo.ApplyPlan.
+func writeApplyPlanError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrUnauthorized):
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+	case errors.Is(err, store.ErrConflict):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, store.ErrInvalidResources) || errors.Is(err, store.ErrInvalidMetadata) ||
+		errors.Is(err, store.ErrPayloadTooLarge) || errors.Is(err, store.ErrInvalidNameTemplate):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "failed to apply plan")
+	}
+}
+
+// validatePlanActions checks the actions of a plan submitted by a client.
+func (a *App) validatePlanActions(actions []store.ApplyPlanAction) error {
+	for _, action := range actions {
+		if strings.EqualFold(strings.TrimSpace(action.Operation), "MIGRATE") {
+			return errors.New("MIGRATE actions are not accepted in plans; use POST /sites/{siteID}/vms/{vmID}/migrate")
+		}
+		if err := validateWhenState(action); err != nil {
+			return err
+		}
+		if err := validateActionFiles(action); err != nil {
+			return err
+		}
+		if err := validateActionStop(action); err != nil {
+			return err
+		}
+		if err := a.validateActionDevices(action); err != nil {
+			return err
+		}
+		if err := validateActionImage(action); err != nil {
+			return err
+		}
+	}
+	if err := store.CheckActionPayloads(actions, a.cfg.MaxActionPayload); err != nil {
+		return err
+	}
+	if err := validateActionDependencies(actions); err != nil {
+		return err
+	}
+	return store.ValidateBootOrder(actions)
+}
+
+// validateActionFiles checks the files of a CREATE action; other
+// operations cannot carry files.
+func validateActionFiles(action store.ApplyPlanAction) error {
+	if len(action.Files) == 0 {
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") {
+		return fmt.Errorf("action %s: files are only supported on CREATE", action.OperationID)
+	}
+	if err := store.ValidateFileSpecs(action.Files); err != nil {
+		return fmt.Errorf("action %s: %w", action.OperationID, err)
+	}
+	return nil
+}
+
+// validateActionStop checks the optional stop_method and grace_period of
+// a STOP action; other operations cannot carry them.
+func validateActionStop(action store.ApplyPlanAction) error {
+	if action.StopMethod == "" && action.GracePeriod == 0 {
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(action.Operation), "STOP") {
+		return fmt.Errorf("action %s: stop_method and grace_period are only supported on STOP", action.OperationID)
+	}
+	if action.StopMethod != "" && !slices.Contains(store.StopMethods, action.StopMethod) {
+		return fmt.Errorf("action %s: invalid stop_method %q: want one of %s", action.OperationID, action.StopMethod, strings.Join(store.StopMethods, ", "))
+	}
+	if action.GracePeriod < 0 || action.GracePeriod > store.MaxStopGracePeriod {
+		return fmt.Errorf("action %s: grace_period must be between 0 and %d seconds", action.OperationID, store.MaxStopGracePeriod)
+	}
+	return nil
+}
+
+// validateActionDevices checks the extra disks and NICs of a CREATE action
+// against the per-VM caps; other operations cannot carry them.
+func (a *App) validateActionDevices(action store.ApplyPlanAction) error {
+	if len(action.Disks) == 0 && len(action.Networks) == 0 {
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") {
+		return fmt.Errorf("action %s: disks and networks are only supported on CREATE", action.OperationID)
+	}
+	if err := store.ValidateVMDevices(action.Disks, action.Networks, a.cfg.MaxDisksPerVM, a.cfg.MaxNICsPerVM); err != nil {
+		return fmt.Errorf("action %s: %w", action.OperationID, err)
+	}
+	return nil
+}
+
+// validateActionDependencies checks that depends_on only names the
+// operation IDs of earlier actions. Actions run in order, so this also rules
+// out cycles.
+func validateActionDependencies(actions []store.ApplyPlanAction) error {
+	seen := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		for _, dep := range action.DependsOn {
+			if !seen[dep] {
+				return fmt.Errorf("action %s: depends_on %q must name an earlier action's operation_id", action.OperationID, dep)
+			}
+		}
+		if id := strings.TrimSpace(action.OperationID); id != "" {
+			seen[id] = true
+		}
+	}
+	return nil
+}
+
+// validateWhenState checks the optional when_state guard of a plan action.
+func validateWhenState(action store.ApplyPlanAction) error {
+	want := strings.ToUpper(strings.TrimSpace(action.WhenState))
+	if want == "" {
+		return nil
+	}
+	switch strings.ToUpper(strings.TrimSpace(action.Operation)) {
+	case "START", "STOP", "DELETE":
+	default:
+		return errors.New("when_state is only supported for START, STOP and DELETE actions")
+	}
+	if strings.TrimSpace(action.VMID) == "" {
+		return errors.New("when_state requires vm_id")
+	}
+	for _, state := range store.VMStates {
+		if want == state {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid when_state %q", action.WhenState)
+}
+
+func (a *App) handleGetPlan(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	planID := r.PathValue("planID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	plan, err := a.repo.GetPlan(r.Context(), tenantID, planID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "plan not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get plan")
+		return
+	}
+	if plan.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "plan not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, getPlanResponse{
+		PlanID:      plan.ID,
+		PlanVersion: plan.PlanVersion,
+		PlanStatus:  plan.Status,
+		CreatedAt:   plan.CreatedAt,
+		RetriedFrom: plan.RetriedFrom,
+		Metadata:    plan.Metadata,
+		Sequential:  plan.Sequential,
+		Progress:    plan.Progress,
+	})
+}
+
+// handleRetryPlan creates a new plan from a failed plan's actions, or only
+// its failed ones when failed_only is set. The body is optional.
+func (a *App) handleRetryPlan(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	planID := r.PathValue("planID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	var req struct {
+		FailedOnly bool `json:"failed_only"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	plan, err := a.repo.GetPlan(r.Context(), tenantID, planID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "plan not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get plan")
+		return
+	}
+	if plan.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "plan not found")
+		return
+	}
+	result, err := a.repo.RetryPlan(r.Context(), tenantID, planID, req.FailedOnly)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "plan not found")
+		case errors.Is(err, store.ErrPlanNotFailed), errors.Is(err, store.ErrConflict):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, store.ErrInvalidResources):
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to retry plan")
+		}
+		return
+	}
+	metadata, _ := json.Marshal(map[string]any{"retried_from": planID, "failed_only": req.FailedOnly})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "plan.retry", "plan", result.Plan.ID, requestID(r), sourceIP(r), metadata)
+	a.metrics.plansApplied.Add(1)
+	writeJSON(w, http.StatusOK, applyPlanResponse{
+		PlanID:       result.Plan.ID,
+		PlanVersion:  result.Plan.PlanVersion,
+		PlanStatus:   result.Plan.Status,
+		RetriedFrom:  planID,
+		Metadata:     result.Plan.Metadata,
+		Sequential:   result.Plan.Sequential,
+		Deduplicated: result.Deduplicated,
+		Executions:   result.Executions,
+		Progress:     store.PlanProgressFromExecutions(result.Executions),
+	})
+}
+
+func (a *App) handleMigrateVM(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	vmID := r.PathValue("vmID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	var req struct {
+		TargetHostID string `json:"target_host_id"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.TargetHostID) == "" {
+		writeError(w, http.StatusBadRequest, "target_host_id is required")
+		return
+	}
+	mig, err := a.repo.MigrateVM(r.Context(), tenantID, siteID, vmID, req.TargetHostID)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrUnauthorized):
+			writeError(w, http.StatusForbidden, "tenant mismatch")
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, store.ErrConflict):
+			writeError(w, http.StatusConflict, "vm already has a migration in progress")
+		case errors.Is(err, store.ErrInsufficientCapacity):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, store.ErrInvalidMigration):
+			writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to migrate vm")
+		}
+		return
+	}
+	metadata, _ := json.Marshal(map[string]any{
+		"migration_id":   mig.ID,
+		"source_host_id": mig.SourceHostID,
+		"target_host_id": mig.TargetHostID,
+	})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "vm.migrate", "microvm", vmID, requestID(r), sourceIP(r), metadata)
+	writeJSON(w, http.StatusAccepted, mig)
+}
+
+func (a *App) handleGetVMMigration(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	mig, err := a.repo.GetVMMigration(r.Context(), tenantID, r.PathValue("migrationID"))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "migration not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get migration")
+		return
+	}
+	if mig.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "migration not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, mig)
+}
+
+func (a *App) handleListHosts(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	hosts, err := a.repo.ListHosts(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list hosts")
+		return
+	}
+	writeJSON(w, http.StatusOK, listHostsResponse{Hosts: hosts})
+}
+
+func (a *App) handleSetHostMaintenance(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	hostID := r.PathValue("hostID")
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "enabled required")
+		return
+	}
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	host, err := a.repo.SetHostMaintenance(r.Context(), tenantID, siteID, hostID, *req.Enabled)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "host not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to update host maintenance")
+		return
+	}
+	metadata, _ := json.Marshal(map[string]any{"maintenance": host.Maintenance})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "host.maintenance", "host", host.ID, requestID(r), sourceIP(r), metadata)
+	writeJSON(w, http.StatusOK, host)
+}
+
+// prometheusTargetGroup is one entry of a Prometheus file_sd_configs file.
+type prometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func (a *App) handlePrometheusTargets(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	targets, err := a.repo.ListPrometheusTargets(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list prometheus targets")
+		return
+	}
+	groups := make([]prometheusTargetGroup, 0, len(targets))
+	for _, t := range targets {
+		addr, ok := prometheusTargetAddr(t)
+		if !ok {
+			continue
+		}
+		groups = append(groups, prometheusTargetGroup{
+			Targets: []string{addr},
+			Labels: map[string]string{
+				"tenant_id": tenantID,
+				"site_id":   siteID,
+				"agent_id":  t.AgentID,
+				"host_id":   t.HostID,
+				"hostname":  t.Hostname,
+			},
+		})
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// handleListAgentMetrics returns the metrics snapshots the site's agents
+// pushed with their heartbeats, as JSON or, with ?format=prometheus, in
+// the Prometheus text format for scraping through the control plane.
+func (a *App) handleListAgentMetrics(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	snapshots, err := a.repo.ListAgentMetrics(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list agent metrics")
+		return
+	}
+	if r.URL.Query().Get("format") != "prometheus" {
+		writeJSON(w, http.StatusOK, listAgentMetricsResponse{Agents: snapshots})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range store.AgentMetricNames {
+		fmt.Fprintf(w, "# TYPE nkudo_agent_%s gauge\n", name)
+		for _, snapshot := range snapshots {
+			if v, ok := snapshot.Metrics[name]; ok {
+				fmt.Fprintf(w, "nkudo_agent_%s{site_id=%q,agent_id=%q} %g %d\n", name, siteID, snapshot.AgentID, v, snapshot.ReportedAt.UnixMilli())
+			}
+		}
+	}
+}
+
+// prometheusTargetAddr builds the scrape address for an agent. The NetBird
+// mesh IP is preferred; the host part of the reported metrics address is only
+// used when it names a specific interface.
+func prometheusTargetAddr(t store.PrometheusTarget) (string, bool) {
+	host, port, err := net.SplitHostPort(t.MetricsAddr)
+	if err != nil || port == "" {
+		return "", false
+	}
+	if peer := strings.TrimSpace(t.PeerIP); peer != "" {
+		if i := strings.IndexByte(peer, '/'); i >= 0 {
+			peer = peer[:i]
+		}
+		if ip := net.ParseIP(peer); ip != nil {
+			return net.JoinHostPort(ip.String(), port), true
+		}
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+func (a *App) handleListVMs(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	vms, err := a.repo.ListVMs(r.Context(), tenantID, siteID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list microvms")
+		return
+	}
+	writeJSON(w, http.StatusOK, listVMsResponse{VMs: vms})
+}
+
+func (a *App) handleGetAgentNetwork(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	agentID := r.PathValue("agentID")
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	status, err := a.repo.GetAgentNetworkStatus(r.Context(), tenantID, agentID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "agent network status not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get agent network status")
+		return
+	}
+	if status.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "agent network status not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+const (
+	// defaultConnectivityHistoryRange is the span of history returned when
+	// the request gives no from.
+	defaultConnectivityHistoryRange = 7 * 24 * time.Hour
+	// maxConnectivityHistory caps the transitions returned at once.
+	maxConnectivityHistory = 1000
+)
+
+// handleGetAgentConnectivityHistory returns the agent's NetBird status
+// transitions between the from and to query parameters, RFC 3339 times
+// defaulting to the last seven days.
+func (a *App) handleGetAgentConnectivityHistory(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	agentID := r.PathValue("agentID")
+	from, to, err := parseTimeRange(r, defaultConnectivityHistoryRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	agent, err := a.repo.GetAgentByID(r.Context(), agentID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		writeError(w, http.StatusInternalServerError, "agent lookup failed")
+		return
+	}
+	if err != nil || agent.TenantID != tenantID || agent.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "agent not found")
+		return
+	}
+	history, err := a.repo.ListAgentConnectivityHistory(r.Context(), tenantID, agentID, from, to, maxConnectivityHistory)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get connectivity history")
+		return
+	}
+	writeJSON(w, http.StatusOK, connectivityHistoryResponse{
+		AgentID:     agentID,
+		From:        from,
+		To:          to,
+		Transitions: history,
+	})
+}
+
+// defaultPlanStatsRange is the window of plan stats when the request gives
+// no from.
+const defaultPlanStatsRange = 7 * 24 * time.Hour
+
+// handleGetPlanStats counts the site's plans created between the from and
+// to query parameters by outcome, with their success percentage.
+func (a *App) handleGetPlanStats(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	from, to, err := parseTimeRange(r, defaultPlanStatsRange)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	stats, err := a.repo.GetPlanStats(r.Context(), tenantID, siteID, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get plan stats")
+		return
+	}
+	writeJSON(w, http.StatusOK, planStatsResponse{SiteID: siteID, From: from, To: to, PlanStats: stats})
+}
+
+// planStatsResponse is the body of GET /sites/{siteID}/plan-stats.
+type planStatsResponse struct {
+	SiteID string    `json:"site_id"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	store.PlanStats
+}
+
+// parseTimeRange reads the from and to query parameters, RFC 3339 times.
+// to defaults to now and from to def before to.
+func parseTimeRange(r *http.Request, def time.Duration) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if raw := r.URL.Query().Get("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	from = to.Add(-def)
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		if from, err = time.Parse(time.RFC3339, raw); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if from.After(to) {
+		return from, to, errors.New("from must not be after to")
+	}
+	return from, to, nil
+}
+
+// handleSetAgentMetadata replaces the operator-set metadata of an agent with
+// the JSON object in the body; null clears it.
+func (a *App) handleSetAgentMetadata(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	siteID := r.PathValue("siteID")
+	agentID := r.PathValue("agentID")
+	var metadata json.RawMessage
+	if err := decodeJSON(r.Body, &metadata); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "site lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "site not found")
+		return
+	}
+	if err := a.repo.SetAgentMetadata(r.Context(), tenantID, siteID, agentID, metadata); err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidMetadata):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "agent not found")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to set agent metadata")
 		}
-		writeError(w, http.StatusInternalServerError, "failed to apply plan")
 		return
 	}
-	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "plan.apply", "plan", result.Plan.ID, requestID(r), sourceIP(r), result.Plan.OperationsJSON)
-	a.metrics.plansApplied.Add(1)
-	writeJSON(w, http.StatusOK, map[string]any{
-		"plan_id":      result.Plan.ID,
-		"plan_version": result.Plan.PlanVersion,
-		"plan_status":  result.Plan.Status,
-		"deduplicated": result.Deduplicated,
-		"executions":   result.Executions,
-	})
+	_ = a.writeAudit(r.Context(), tenantID, siteID, "USER", "api-key", "agent.metadata", "agent", agentID, requestID(r), sourceIP(r), metadata)
+	writeJSON(w, http.StatusOK, map[string]any{"agent_id": agentID, "metadata": metadata})
 }
 
-func (a *App) handleListHosts(w http.ResponseWriter, r *http.Request) {
+// handleListAgentLeasedPlans shows the plans an agent currently holds, in
+// the form the agent received them, without leasing anything.
+func (a *App) handleListAgentLeasedPlans(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value(ctxTenantID{}).(string)
 	siteID := r.PathValue("siteID")
+	agentID := r.PathValue("agentID")
 	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "site lookup failed")
@@ -1189,17 +2357,39 @@ func (a *App) handleListHosts(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "site not found")
 		return
 	}
-	hosts, err := a.repo.ListHosts(r.Context(), tenantID, siteID)
+	agent, err := a.repo.GetAgentByID(r.Context(), agentID)
+	if err != nil || agent.TenantID != tenantID || agent.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "agent not found")
+		return
+	}
+	leased, err := a.repo.ListLeasedPlans(r.Context(), tenantID, agentID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to list hosts")
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "agent not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to list leased plans")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"hosts": hosts})
+	type leasedPlanView struct {
+		leasedPlanPayload
+		LeaseExpiresAt time.Time `json:"lease_expires_at"`
+	}
+	plans := make([]leasedPlanView, 0, len(leased))
+	for _, plan := range leased {
+		for _, payload := range leasedPlansToAgentPayload([]store.LeasedPlan{plan}, a.cfg.ActionResultTTL, agentLabels(agent)) {
+			plans = append(plans, leasedPlanView{leasedPlanPayload: payload, LeaseExpiresAt: plan.LeaseExpiresAt})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"agent_id": agentID, "plans": plans})
 }
 
-func (a *App) handleListVMs(w http.ResponseWriter, r *http.Request) {
+// handleGetAgentEnrollment returns which enrollment token an agent
+// consumed, when, and what the agent sent when it enrolled.
+func (a *App) handleGetAgentEnrollment(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value(ctxTenantID{}).(string)
 	siteID := r.PathValue("siteID")
+	agentID := r.PathValue("agentID")
 	ok, err := a.repo.SiteBelongsToTenant(r.Context(), siteID, tenantID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "site lookup failed")
@@ -1209,12 +2399,20 @@ func (a *App) handleListVMs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, "site not found")
 		return
 	}
-	vms, err := a.repo.ListVMs(r.Context(), tenantID, siteID)
+	enrollment, err := a.repo.GetAgentEnrollment(r.Context(), agentID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to list microvms")
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "agent not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get agent enrollment")
+		return
+	}
+	if enrollment.TenantID != tenantID || enrollment.SiteID != siteID {
+		writeError(w, http.StatusNotFound, "agent not found")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"vms": vms})
+	writeJSON(w, http.StatusOK, enrollment)
 }
 
 func (a *App) handleListExecutionLogs(w http.ResponseWriter, r *http.Request) {
@@ -1239,7 +2437,57 @@ func (a *App) handleListExecutionLogs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to list logs")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"logs": logs})
+	writeJSON(w, http.StatusOK, listExecutionLogsResponse{Logs: logs})
+}
+
+// handleGetExecutionLogStats counts an execution's log entries so clients
+// can decide whether to page before fetching them.
+func (a *App) handleGetExecutionLogStats(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	executionID := r.PathValue("executionID")
+	ok, err := a.repo.ExecutionBelongsToTenant(r.Context(), executionID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "execution lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "execution not found")
+		return
+	}
+	stats, err := a.repo.GetExecutionLogStats(r.Context(), tenantID, executionID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "execution not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to count logs")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *App) handleGetExecutionConsoleLog(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	executionID := r.PathValue("executionID")
+	ok, err := a.repo.ExecutionBelongsToTenant(r.Context(), executionID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "execution lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "execution not found")
+		return
+	}
+	console, err := a.repo.GetExecutionConsoleLog(r.Context(), tenantID, executionID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "console log not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to get console log")
+		return
+	}
+	writeJSON(w, http.StatusOK, console)
 }
 
 func (a *App) handleListExecutions(w http.ResponseWriter, r *http.Request) {
@@ -1304,6 +2552,23 @@ func decodeJSONAllowUnknown(body io.Reader, v any) error {
 	return decodeJSONWithMode(body, v, false)
 }
 
+// decodedBody returns the request body with its Content-Encoding undone.
+// Only gzip is accepted; the JSON decoders cap what is read from it.
+func decodedBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
 func decodeJSONWithMode(body io.Reader, v any, disallowUnknown bool) error {
 	dec := json.NewDecoder(io.LimitReader(body, 1<<20))
 	if disallowUnknown {
@@ -1355,6 +2620,10 @@ type leasedPlanPayload struct {
 	PlanID      string              `json:"plan_id"`
 	ExecutionID string              `json:"execution_id"`
 	Actions     []leasedActionEntry `json:"actions"`
+	ResultTTL   int64               `json:"result_ttl,omitempty"`
+	Sequential  bool                `json:"sequential,omitempty"`
+	// Labels are the leasing agent's labels; see agentLabels.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type leasedActionEntry struct {
@@ -1362,9 +2631,27 @@ type leasedActionEntry struct {
 	Type          string          `json:"type"`
 	Params        json.RawMessage `json:"params"`
 	TimeoutSecond int             `json:"timeout"`
+	DependsOn     []string        `json:"depends_on,omitempty"`
+	BootOrder     int             `json:"boot_order,omitempty"`
+	BootDelay     int             `json:"boot_delay_seconds,omitempty"`
 }
 
-func leasedPlansToAgentPayload(in []store.LeasedPlan) []leasedPlanPayload {
+// actionSequencing returns the depends_on, boot_order and
+// boot_delay_seconds of a plan action's payload.
+func actionSequencing(action store.PlanAction) (dependsOn []string, bootOrder, bootDelay int) {
+	var payload struct {
+		DependsOn        []string `json:"depends_on"`
+		BootOrder        int      `json:"boot_order"`
+		BootDelaySeconds int      `json:"boot_delay_seconds"`
+	}
+	_ = json.Unmarshal(action.PayloadJSON, &payload)
+	return payload.DependsOn, payload.BootOrder, payload.BootDelaySeconds
+}
+
+// leasedPlansToAgentPayload converts leased plans to the agent wire format.
+// resultTTL tells the agent how long to keep action records for idempotent
+// replays and labels are the leasing agent's labels.
+func leasedPlansToAgentPayload(in []store.LeasedPlan, resultTTL time.Duration, labels map[string]string) []leasedPlanPayload {
 	out := make([]leasedPlanPayload, 0, len(in))
 	for _, plan := range in {
 		actions := make([]leasedActionEntry, 0, len(plan.Actions))
@@ -1373,6 +2660,7 @@ func leasedPlansToAgentPayload(in []store.LeasedPlan) []leasedPlanPayload {
 			if !ok {
 				continue
 			}
+			entry.DependsOn, entry.BootOrder, entry.BootDelay = actionSequencing(action)
 			actions = append(actions, entry)
 		}
 		if len(actions) == 0 {
@@ -1382,17 +2670,49 @@ func leasedPlansToAgentPayload(in []store.LeasedPlan) []leasedPlanPayload {
 			PlanID:      plan.PlanID,
 			ExecutionID: firstNonEmpty(plan.ExecutionID, plan.PlanID),
 			Actions:     actions,
+			ResultTTL:   int64(resultTTL / time.Second),
+			Sequential:  plan.Sequential,
+			Labels:      labels,
 		})
 	}
 	return out
 }
 
+// toAgentNetworks renders NICs in the agent's network interface format.
+// The agent fills in tap names and bridges left empty.
+func toAgentNetworks(in []store.VMNetworkSpec) []map[string]any {
+	out := make([]map[string]any, 0, len(in))
+	for i, n := range in {
+		nic := map[string]any{"id": fmt.Sprintf("eth%d", i)}
+		if n.Bridge != "" {
+			nic["bridge"] = n.Bridge
+		}
+		if n.MacAddr != "" {
+			nic["mac"] = n.MacAddr
+		}
+		if n.IPAddress != "" {
+			nic["ip_config"] = map[string]any{"address": n.IPAddress}
+		}
+		out = append(out, nic)
+	}
+	return out
+}
+
 func toLeasedActionEntry(action store.PlanAction) (leasedActionEntry, bool) {
 	type applyPayload struct {
-		VMID      string `json:"vm_id"`
-		Name      string `json:"name"`
-		VCPUCount int    `json:"vcpu_count"`
-		MemoryMiB int64  `json:"memory_mib"`
+		VMID          string                   `json:"vm_id"`
+		Name          string                   `json:"name"`
+		VCPUCount     int                      `json:"vcpu_count"`
+		MemoryMiB     int64                    `json:"memory_mib"`
+		Labels        map[string]string        `json:"labels"`
+		Files         []store.FileSpec         `json:"files"`
+		Disks         []store.VMDiskSpec       `json:"disks"`
+		Networks      []store.VMNetworkSpec    `json:"networks"`
+		KernelPath    string                   `json:"kernel_path"`
+		RootfsPath    string                   `json:"rootfs_path"`
+		ImageDefaults map[string]store.VMImage `json:"image_defaults"`
+		StopMethod    string                   `json:"stop_method"`
+		GracePeriod   int                      `json:"grace_period"`
 	}
 	var payload applyPayload
 	if len(action.PayloadJSON) > 0 {
@@ -1406,12 +2726,31 @@ func toLeasedActionEntry(action store.PlanAction) (leasedActionEntry, bool) {
 		if vmID == "" {
 			return leasedActionEntry{}, false
 		}
-		params, _ := json.Marshal(map[string]any{
+		createParams := map[string]any{
 			"vm_id":      vmID,
 			"name":       firstNonEmpty(payload.Name, vmID),
 			"vcpu":       maxInt(payload.VCPUCount, 1),
 			"memory_mib": maxInt64(payload.MemoryMiB, 128),
-		})
+		}
+		if len(payload.Labels) > 0 {
+			createParams["labels"] = payload.Labels
+		}
+		if len(payload.Files) > 0 {
+			createParams["files"] = payload.Files
+		}
+		if len(payload.Disks) > 0 {
+			createParams["disks"] = payload.Disks
+		}
+		if payload.RootfsPath != "" {
+			createParams["kernel_path"] = payload.KernelPath
+			createParams["rootfs_path"] = payload.RootfsPath
+		} else if len(payload.ImageDefaults) > 0 {
+			createParams["image_defaults"] = payload.ImageDefaults
+		}
+		if len(payload.Networks) > 0 {
+			createParams["networks"] = toAgentNetworks(payload.Networks)
+		}
+		params, _ := json.Marshal(createParams)
 		return leasedActionEntry{
 			ActionID:      action.OperationID,
 			Type:          "MicroVMCreate",
@@ -1435,7 +2774,16 @@ func toLeasedActionEntry(action store.PlanAction) (leasedActionEntry, bool) {
 		if operation == "RESUME" {
 			actionType = "MicroVMResume"
 		}
-		params, _ := json.Marshal(map[string]any{"vm_id": vmID})
+		vmParams := map[string]any{"vm_id": vmID}
+		if operation == "STOP" {
+			if payload.StopMethod != "" {
+				vmParams["method"] = payload.StopMethod
+			}
+			if payload.GracePeriod > 0 {
+				vmParams["grace_period"] = payload.GracePeriod
+			}
+		}
+		params, _ := json.Marshal(vmParams)
 		return leasedActionEntry{
 			ActionID:      action.OperationID,
 			Type:          actionType,
@@ -1456,13 +2804,39 @@ func toLeasedActionEntry(action store.PlanAction) (leasedActionEntry, bool) {
 			Params:        params,
 			TimeoutSecond: 300, // Snapshot may take longer
 		}, true
+	case "MIGRATE":
+		var migratePayload struct {
+			Migration *store.MigrationStep `json:"migration"`
+		}
+		if len(action.PayloadJSON) > 0 {
+			_ = json.Unmarshal(action.PayloadJSON, &migratePayload)
+		}
+		if vmID == "" || migratePayload.Migration == nil {
+			return leasedActionEntry{}, false
+		}
+		step := migratePayload.Migration
+		params, _ := json.Marshal(map[string]any{
+			"vm_id":         vmID,
+			"migration_id":  step.MigrationID,
+			"step":          step.Step,
+			"snapshot_name": step.SnapshotName,
+			"target_host":   step.TargetHost,
+		})
+		return leasedActionEntry{
+			ActionID:      action.OperationID,
+			Type:          "MicroVMMigrate",
+			Params:        params,
+			TimeoutSecond: 600, // Transfers copy the whole VM disk
+		}, true
 	case "EXECUTE":
 		// For EXECUTE, we need the command in the payload
 		var executePayload struct {
-			Command string   `json:"command"`
-			Args    []string `json:"args"`
-			Timeout int      `json:"timeout_seconds"`
-			Dir     string   `json:"working_dir"`
+			Command           string            `json:"command"`
+			Args              []string          `json:"args"`
+			Timeout           int               `json:"timeout_seconds"`
+			Dir               string            `json:"working_dir"`
+			Env               map[string]string `json:"env"`
+			AllowPathOverride bool              `json:"allow_path_override"`
 		}
 		if len(action.PayloadJSON) > 0 {
 			_ = json.Unmarshal(action.PayloadJSON, &executePayload)
@@ -1470,12 +2844,19 @@ func toLeasedActionEntry(action store.PlanAction) (leasedActionEntry, bool) {
 		if executePayload.Command == "" {
 			return leasedActionEntry{}, false
 		}
-		params, _ := json.Marshal(map[string]any{
+		executeParams := map[string]any{
 			"command":         executePayload.Command,
 			"args":            executePayload.Args,
 			"timeout_seconds": executePayload.Timeout,
 			"working_dir":     executePayload.Dir,
-		})
+		}
+		if len(executePayload.Env) > 0 {
+			executeParams["env"] = executePayload.Env
+		}
+		if executePayload.AllowPathOverride {
+			executeParams["allow_path_override"] = true
+		}
+		params, _ := json.Marshal(executeParams)
 		timeout := 30
 		if executePayload.Timeout > 0 {
 			timeout = executePayload.Timeout
@@ -1513,11 +2894,10 @@ func requestID(r *http.Request) string {
 }
 
 func sourceIP(r *http.Request) string {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return ""
+	if ip := getClientIP(r); ip != "unknown" {
+		return ip
 	}
-	return host
+	return ""
 }
 
 func (a *App) handleUnenroll(w http.ResponseWriter, r *http.Request) {
@@ -1563,10 +2943,73 @@ func (a *App) handleUnenroll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "AGENT", agent.ID, "agent.unenroll", "agent", agent.ID, requestID(r), sourceIP(r), nil)
+	// The agent can no longer report, so its leased plans would otherwise
+	// sit IN_PROGRESS until their leases expire.
+	var metadata []byte
+	if !a.cfg.UnenrollKeepLeases {
+		planIDs, err := a.repo.ReleaseAgentPlans(r.Context(), agent.ID)
+		if err != nil {
+			log.Printf("error releasing plans of unenrolled agent %s: %v", agent.ID, err)
+		}
+		for _, planID := range planIDs {
+			a.publishPlanStatus(r, agent.TenantID, agent.SiteID, planID)
+		}
+		if len(planIDs) > 0 {
+			metadata, _ = json.Marshal(map[string]any{"released_plans": planIDs})
+		}
+	}
+
+	_ = a.writeAudit(r.Context(), agent.TenantID, agent.SiteID, "AGENT", agent.ID, "agent.unenroll", "agent", agent.ID, requestID(r), sourceIP(r), metadata)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleRevokeTenantCerts revokes every active agent certificate in a tenant
+// and unenrolls the agents. Repeating the call revokes nothing new.
+func (a *App) handleRevokeTenantCerts(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if _, err := uuid.Parse(tenantID); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid tenant id")
+		return
+	}
+	type request struct {
+		Reason string `json:"reason"`
+	}
+	var req request
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if _, err := a.repo.GetTenantByID(r.Context(), tenantID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "tenant not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "tenant lookup failed")
+		return
+	}
+
+	reason := pki.ReasonCessationOfOperation
+	if req.Reason == "compromised" {
+		reason = pki.ReasonKeyCompromise
+	}
+	agents, err := a.repo.RevokeTenantAgentCertificates(r.Context(), tenantID, int(reason))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to revoke certificates")
+		return
+	}
+
+	for _, agent := range agents {
+		if err := a.crlManager.Revoke(agent.CertSerial, reason, agent.ID); err != nil {
+			log.Printf("error revoking certificate in CRL: %v", err)
+		}
+		metadata, _ := json.Marshal(map[string]any{"serial": agent.CertSerial, "reason": req.Reason})
+		_ = a.writeAudit(r.Context(), tenantID, agent.SiteID, "SYSTEM", "", "agent.cert_revoke", "agent", agent.ID, requestID(r), sourceIP(r), metadata)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"tenant_id": tenantID, "revoked": len(agents)})
+}
+
 func (a *App) handleRenew(w http.ResponseWriter, r *http.Request) {
 	agent := r.Context().Value(ctxAgent{}).(store.Agent)
 	type request struct {
@@ -1614,7 +3057,7 @@ func (a *App) handleRenew(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expiresAt := time.Now().UTC().Add(a.cfg.AgentCertTTL)
+	expiresAt := a.recordCertIssuance(r.Context(), agent.ID, certSerial)
 	writeJSON(w, http.StatusOK, map[string]any{
 		"client_certificate_pem": string(certPEM),
 		"ca_certificate_pem":     string(a.ca.CertPEM()),
@@ -1623,6 +3066,22 @@ func (a *App) handleRenew(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// recordCertIssuance adds a certificate history entry for a newly signed
+// agent certificate and returns its expiry. Failures are ignored like audit
+// writes; the entry only feeds inventory and history views.
+func (a *App) recordCertIssuance(ctx context.Context, agentID, serial string) time.Time {
+	now := time.Now().UTC()
+	expiresAt := now.Add(a.cfg.AgentCertTTL)
+	_ = a.repo.RecordCertificateIssuance(ctx, store.CertificateHistory{
+		ID:        uuid.NewString(),
+		AgentID:   agentID,
+		Serial:    serial,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+	})
+	return expiresAt
+}
+
 // handleMetrics returns Prometheus-style metrics
 func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -1647,6 +3106,11 @@ func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE nkudo_executions_total counter\n")
 	fmt.Fprintf(w, "nkudo_executions_total %d\n\n", a.metrics.executionsTotal.Load())
 
+	fmt.Fprintf(w, "# HELP nkudo_agent_clock_drift_seconds Agent clock minus control-plane clock at the last heartbeat\n")
+	fmt.Fprintf(w, "# TYPE nkudo_agent_clock_drift_seconds gauge\n")
+	a.clockDrift.writeMetrics(w)
+	fmt.Fprintf(w, "\n")
+
 	// Rate limiting metrics
 	hits, blocks := a.rateLimiter.GetMetrics()
 	fmt.Fprintf(w, "# HELP nkudo_rate_limit_hits_total Total number of rate limiter hits (allowed requests)\n")
@@ -1683,7 +3147,21 @@ func (a *App) handleVerifyAuditChain(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) handleListAuditEvents(w http.ResponseWriter, r *http.Request) {
-	tenantID := r.URL.Query().Get("tenant_id")
+	a.listAuditEvents(w, r, r.URL.Query().Get("tenant_id"))
+}
+
+// handleListTenantAuditEvents is the API-key counterpart of
+// handleListAuditEvents, pinned to the caller's own tenant.
+func (a *App) handleListTenantAuditEvents(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	a.listAuditEvents(w, r, tenantID)
+}
+
+func (a *App) listAuditEvents(w http.ResponseWriter, r *http.Request, tenantID string) {
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	if limit <= 0 || limit > 1000 {
 		limit = 100
@@ -1718,10 +3196,10 @@ func (a *App) StartBackgroundVerifier(ctx context.Context) (stop func()) {
 		return func() {}
 	}
 
-	verifier := audit.NewBackgroundVerifier(a.auditChain, a.cfg.AuditVerifyInterval)
+	verifier := audit.NewBackgroundVerifier(a.auditChain, a.cfg.AuditVerifyInterval, a.cfg.AuditFullVerifyInterval)
 	go verifier.Start(ctx)
 
-	log.Printf("[audit] Background verifier started with interval %v", a.cfg.AuditVerifyInterval)
+	log.Printf("[audit] Background verifier started with interval %v (full every %v)", a.cfg.AuditVerifyInterval, a.cfg.AuditFullVerifyInterval)
 
 	return func() {
 		log.Println("[audit] Stopping background verifier...")
@@ -1781,6 +3259,64 @@ func (a *App) handleGetCRLPEM(w http.ResponseWriter, r *http.Request) {
 	w.Write(crlPEM)
 }
 
+// handleListRevokedCertificates pages the revoked certificates newest
+// first, optionally filtered by agent_id and a from/to revocation time
+// range.
+func (a *App) handleListRevokedCertificates(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := store.RevokedCertificateQuery{
+		AgentID: strings.TrimSpace(q.Get("agent_id")),
+		Cursor:  strings.TrimSpace(q.Get("cursor")),
+	}
+	if query.AgentID != "" {
+		if _, err := uuid.Parse(query.AgentID); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid agent_id")
+			return
+		}
+	}
+	if query.Cursor != "" {
+		if _, _, err := store.ParseCRLCursor(query.Cursor); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		raw := q.Get(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, bound.name+" must be an RFC 3339 time")
+			return
+		}
+		*bound.dst = t
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && query.From.After(query.To) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query.Limit = limit + 1
+	entries, err := a.repo.ListRevokedCertificates(r.Context(), query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list revoked certificates")
+		return
+	}
+	resp := revokedCertificatesResponse{Certificates: entries}
+	if len(entries) > limit {
+		resp.Certificates = entries[:limit]
+		resp.NextCursor = store.CRLCursor(entries[limit-1])
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 // writeAudit is a helper to write audit events
 func (a *App) writeAudit(ctx context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error {
 	return a.repo.WriteAudit(ctx, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP, metadata)
@@ -1842,6 +3378,13 @@ func (a *App) handleCreateVXLANNetwork(w http.ResponseWriter, r *http.Request) {
 	created, err := a.repo.CreateVXLANNetwork(r.Context(), tenantID, siteID, network)
 	if err != nil {
 		if errors.Is(err, store.ErrConflict) {
+			// Creating a network identical to an existing one is a retry,
+			// like a plan resubmitted with its idempotency key.
+			existing, lookupErr := a.repo.GetVXLANNetworkByVNI(r.Context(), tenantID, req.VNI)
+			if lookupErr == nil && sameVXLANNetwork(existing, siteID, network) {
+				writeJSON(w, http.StatusOK, existing)
+				return
+			}
 			writeError(w, http.StatusConflict, "VXLAN network with this VNI or name already exists")
 			return
 		}
@@ -1853,6 +3396,17 @@ func (a *App) handleCreateVXLANNetwork(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, created)
 }
 
+// sameVXLANNetwork reports whether existing has the definition of a
+// network being created in siteID.
+func sameVXLANNetwork(existing store.VXLANNetwork, siteID string, want store.VXLANNetwork) bool {
+	return existing.SiteID == siteID &&
+		existing.Name == want.Name &&
+		existing.VNI == want.VNI &&
+		existing.CIDR == want.CIDR &&
+		existing.Gateway == want.Gateway &&
+		existing.MTU == want.MTU
+}
+
 func (a *App) handleListVXLANNetworks(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value(ctxTenantID{}).(string)
 	siteID := r.PathValue("siteID")
@@ -1891,6 +3445,76 @@ func (a *App) handleGetVXLANNetwork(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, network)
 }
 
+// vxlanTunnelStatus is a tunnel with its status reduced to pending, up or
+// error, whatever state name the host reported.
+type vxlanTunnelStatus struct {
+	store.VXLANTunnel
+	State string `json:"state"`
+}
+
+func vxlanTunnelState(status string) string {
+	switch strings.ToLower(status) {
+	case "up", "active":
+		return "up"
+	case "error", "failed":
+		return "error"
+	}
+	return "pending"
+}
+
+// handleListVXLANTunnels shows which hosts have established a network's
+// overlay.
+func (a *App) handleListVXLANTunnels(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	networkID := r.PathValue("networkID")
+	ok, err := a.repo.VXLANNetworkBelongsToTenant(r.Context(), networkID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "network lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "VXLAN network not found")
+		return
+	}
+
+	tunnels, err := a.repo.ListVXLANTunnels(r.Context(), networkID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list VXLAN tunnels")
+		return
+	}
+	out := make([]vxlanTunnelStatus, 0, len(tunnels))
+	counts := map[string]int{"pending": 0, "up": 0, "error": 0}
+	for _, t := range tunnels {
+		state := vxlanTunnelState(t.Status)
+		counts[state]++
+		out = append(out, vxlanTunnelStatus{VXLANTunnel: t, State: state})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"network_id": networkID, "tunnels": out, "counts": counts})
+}
+
+// handleListVMDNSRecords lists the hostnames VMs on a network are
+// registered under; see Config.VMDNSHostnames.
+func (a *App) handleListVMDNSRecords(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	networkID := r.PathValue("networkID")
+	ok, err := a.repo.VXLANNetworkBelongsToTenant(r.Context(), networkID, tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "network lookup failed")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "VXLAN network not found")
+		return
+	}
+
+	records, err := a.repo.ListVMDNSRecords(r.Context(), "", networkID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list VM DNS records")
+		return
+	}
+	writeJSON(w, http.StatusOK, vmDNSRecordsResponse{NetworkID: networkID, Records: records})
+}
+
 func (a *App) handleDeleteVXLANNetwork(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value(ctxTenantID{}).(string)
 	networkID := r.PathValue("networkID")
@@ -1949,13 +3573,21 @@ func (a *App) handleAttachVMToNetwork(w http.ResponseWriter, r *http.Request) {
 		MACAddress: req.MACAddress,
 	}
 
+	// An omitted ip_address is allocated from the network's CIDR.
 	created, err := a.repo.AttachVMToNetwork(r.Context(), attachment)
 	if err != nil {
-		if errors.Is(err, store.ErrConflict) {
+		switch {
+		case errors.Is(err, store.ErrConflict):
 			writeError(w, http.StatusConflict, "VM already attached to this network")
-			return
+		case errors.Is(err, store.ErrAddressInUse), errors.Is(err, store.ErrAddressesExhausted):
+			writeError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, store.ErrInvalidAddress):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "network not found")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to attach VM to network")
 		}
-		writeError(w, http.StatusInternalServerError, "failed to attach VM to network")
 		return
 	}
 
@@ -1963,6 +3595,22 @@ func (a *App) handleAttachVMToNetwork(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, created)
 }
 
+func (a *App) handleListVMNetworks(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value(ctxTenantID{}).(string)
+	vmID := r.PathValue("vmID")
+
+	networks, err := a.repo.ListVMNetworks(r.Context(), tenantID, vmID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "vm not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to list VM networks")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"networks": networks})
+}
+
 func (a *App) handleDetachVMFromNetwork(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value(ctxTenantID{}).(string)
 	vmID := r.PathValue("vmID")
@@ -2,6 +2,7 @@ package controlplane
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -10,14 +11,22 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
+	"maps"
+	"math"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/shared/model"
 )
 
 func TestEnrollmentHappyPath(t *testing.T) {
@@ -124,6 +133,343 @@ func TestHeartbeatIngest(t *testing.T) {
 	}
 }
 
+// TestHeartbeatDNSRecords checks that dns_records is absent while VM DNS is
+// off and an empty list, not null, when it is on with no records, so the
+// agent clears its peers.
+func TestHeartbeatDNSRecords(t *testing.T) {
+	app, _, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	for i, mode := range []string{"", store.VMDNSHostnameName} {
+		app.cfg.VMDNSHostnames = mode
+		rec := doJSON(t, app.Handler(), "POST", "/agents/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": i + 1}, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode heartbeat: %v", err)
+		}
+		records, ok := resp["dns_records"]
+		if mode == "" && ok {
+			t.Fatalf("expected no dns_records while VM DNS is off, got %s", records)
+		}
+		if mode != "" && string(records) != "[]" {
+			t.Fatalf("expected an empty dns_records list, got %q", records)
+		}
+	}
+}
+
+func TestHeartbeatGzipBody(t *testing.T) {
+	hbPayload := map[string]any{
+		"heartbeat_seq":      1,
+		"hostname":           "edge-host-1",
+		"agent_version":      "0.1.0",
+		"cpu_cores_total":    8,
+		"memory_bytes_total": int64(8 * 1024 * 1024 * 1024),
+		"kvm_available":      true,
+		"microvms":           []map[string]any{{"id": "vm-1", "name": "vm-1", "state": "RUNNING", "vcpu_count": 2, "memory_mib": 512}},
+	}
+	// ingest sends the heartbeat to a fresh control plane, gzipped or not,
+	// and returns what it recorded.
+	ingest := func(gzipped bool) (int, store.Host, []store.MicroVM) {
+		app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+		enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+		cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+		body, _ := json.Marshal(hbPayload)
+		if gzipped {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(body)
+			zw.Close()
+			body = buf.Bytes()
+		}
+		req := httptest.NewRequest("POST", "/v1/heartbeat", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		rec := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rec, req)
+		hosts, err := repo.ListHosts(context.Background(), tenantID, siteID)
+		if err != nil || len(hosts) != 1 {
+			t.Fatalf("list hosts: %v, %d", err, len(hosts))
+		}
+		vms, err := repo.ListVMs(context.Background(), tenantID, siteID)
+		if err != nil {
+			t.Fatalf("list vms: %v", err)
+		}
+		return rec.Code, hosts[0], vms
+	}
+
+	plainCode, plainHost, plainVMs := ingest(false)
+	gzipCode, gzipHost, gzipVMs := ingest(true)
+	if plainCode != http.StatusOK || gzipCode != http.StatusOK {
+		t.Fatalf("expected both heartbeats to be accepted, got %d and %d", plainCode, gzipCode)
+	}
+	if gzipHost.Hostname != plainHost.Hostname || gzipHost.CPUCoresTotal != plainHost.CPUCoresTotal || gzipHost.KVMAvailable != plainHost.KVMAvailable || gzipHost.CPUCoresTotal != 8 {
+		t.Fatalf("expected the same host facts, got %+v and %+v", plainHost, gzipHost)
+	}
+	if len(plainVMs) != 1 || len(gzipVMs) != 1 || gzipVMs[0].State != plainVMs[0].State || gzipVMs[0].VCPUCount != plainVMs[0].VCPUCount {
+		t.Fatalf("expected the same VMs, got %+v and %+v", plainVMs, gzipVMs)
+	}
+
+	app, _, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	cert := parseCert(t, []byte(enroll(t, app, enrollToken, makeCSR(t))["client_certificate_pem"].(string)))
+	req := httptest.NewRequest("POST", "/v1/heartbeat", strings.NewReader("{}"))
+	req.Header.Set("Content-Encoding", "br")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	rec := httptest.NewRecorder()
+	app.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected an unsupported encoding to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestHeartbeatFactsErrorMarksHostDegraded(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	listHosts := func() []store.Host {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/hosts", plainAPIKey, nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list hosts status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Hosts []store.Host `json:"hosts"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		if len(resp.Hosts) != 1 {
+			t.Fatalf("expected 1 host, got %d", len(resp.Hosts))
+		}
+		return resp.Hosts
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"agent_id":    agentID,
+		"host_facts":  map[string]any{"cpu_cores": 4, "memory_total_bytes": int64(4 << 30)},
+		"facts_error": "read disk stats: permission denied",
+	}, tlsState)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	host := listHosts()[0]
+	if !host.FactsDegraded || host.FactsError != "read disk stats: permission denied" {
+		t.Fatalf("expected degraded facts, got %+v", host)
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"agent_id":   agentID,
+		"host_facts": map[string]any{"cpu_cores": 4, "memory_total_bytes": int64(4 << 30)},
+	}, tlsState)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if host := listHosts()[0]; host.FactsDegraded || host.FactsError != "" {
+		t.Fatalf("expected facts to recover, got %+v", host)
+	}
+}
+
+func TestHeartbeatDropsOutOfOrderSequence(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	vmID := uuid.NewString()
+	heartbeat := func(seq int, hostname, vmState string) map[string]any {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+			"agent_id":      agentID,
+			"heartbeat_seq": seq,
+			"hostname":      hostname,
+			"microvms":      []map[string]any{{"id": vmID, "name": "web", "state": vmState}},
+		}, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat %d status=%d body=%s", seq, rec.Code, rec.Body.String())
+		}
+		var resp map[string]any
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	if resp := heartbeat(2, "edge-new", "RUNNING"); resp["stale"] != nil {
+		t.Fatalf("expected heartbeat 2 to apply, got %+v", resp)
+	}
+	if resp := heartbeat(1, "edge-old", "CREATING"); resp["stale"] != true {
+		t.Fatalf("expected delayed heartbeat 1 to be reported stale, got %+v", resp)
+	}
+
+	hosts, err := repo.ListHosts(context.Background(), tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list hosts: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "edge-new" {
+		t.Fatalf("expected newer facts to be preserved, got %+v", hosts)
+	}
+	vms, err := repo.ListVMs(context.Background(), tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list vms: %v", err)
+	}
+	if len(vms) != 1 || vms[0].State != "RUNNING" {
+		t.Fatalf("expected newer VM state to be preserved, got %+v", vms)
+	}
+}
+
+func TestHeartbeatReportsClockDrift(t *testing.T) {
+	app, _, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	heartbeat := func(sentAt time.Time) map[string]any {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+			"agent_id": agentID,
+			"hostname": "edge-host-1",
+			"sent_at":  sentAt,
+		}, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp map[string]any
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	if resp := heartbeat(time.Now().UTC()); resp["clock_drift_seconds"] != nil {
+		t.Fatalf("expected no drift warning for a synced clock, got %+v", resp)
+	}
+	resp := heartbeat(time.Now().UTC().Add(-5 * time.Minute))
+	drift, ok := resp["clock_drift_seconds"].(float64)
+	if !ok || drift > -299 || drift < -301 {
+		t.Fatalf("expected about -300s of drift, got %+v", resp)
+	}
+
+	rec := doJSON(t, app.Handler(), "GET", "/metrics", "", nil, nil)
+	if !strings.Contains(rec.Body.String(), `nkudo_agent_clock_drift_seconds{agent_id="`+agentID+`"} -3`) {
+		t.Fatalf("expected a drift sample for the agent, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestHeartbeatShedsLoadBeyondConcurrencyLimit(t *testing.T) {
+	app, _, _, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	app.heartbeats = newHeartbeatGate(1)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	payload := map[string]any{"agent_id": agentID, "hostname": "edge-host-1"}
+
+	// Hold the only slot, as a slow heartbeat in flight would.
+	release, ok := app.heartbeats.tryAcquire()
+	if !ok {
+		t.Fatal("expected an idle gate to admit a heartbeat")
+	}
+	interval := int(app.cfg.HeartbeatInterval.Seconds())
+	for i := 0; i < 5; i++ {
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", payload, tlsState)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 beyond the limit, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			NextHeartbeatSeconds int `json:"next_heartbeat_seconds"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		if resp.NextHeartbeatSeconds < 1 || resp.NextHeartbeatSeconds > interval {
+			t.Fatalf("expected a backoff within [1, %d], got %d", interval, resp.NextHeartbeatSeconds)
+		}
+		if rec.Header().Get("Retry-After") != strconv.Itoa(resp.NextHeartbeatSeconds) {
+			t.Fatalf("expected Retry-After to match the backoff, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	release()
+	if rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", payload, tlsState); rec.Code != http.StatusOK {
+		t.Fatalf("expected a freed slot to admit the heartbeat, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHeartbeatRecordsShutdownReasons(t *testing.T) {
+	app, repo, tenantID, _, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	heartbeat := func(payload map[string]any) int {
+		t.Helper()
+		payload["agent_id"] = agentID
+		payload["hostname"] = "edge-host-1"
+		return doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", payload, tlsState).Code
+	}
+
+	if code := heartbeat(map[string]any{"shutdown": true, "shutdown_reason": "power_cut"}); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown reason to be rejected, got %d", code)
+	}
+	heartbeats := []map[string]any{
+		{},
+		{"shutdown": true, "shutdown_reason": model.ShutdownSignal},
+		{"shutdown": true, "shutdown_reason": model.ShutdownConfigReload},
+		{"shutdown": true, "shutdown_reason": model.ShutdownUpgrade},
+		{"shutdown_reason": model.ShutdownCrashRecovery},
+		{"shutdown": true},
+		{},
+	}
+	for _, payload := range heartbeats {
+		if code := heartbeat(payload); code != http.StatusOK {
+			t.Fatalf("heartbeat %v status=%d", payload, code)
+		}
+	}
+
+	// The last reason stays on the agent across later heartbeats.
+	agents, err := repo.ListTenantAgents(context.Background(), tenantID, store.TenantAgentQuery{})
+	if err != nil || len(agents) != 1 {
+		t.Fatalf("list agents: %d (%v)", len(agents), err)
+	}
+	if agents[0].LastShutdownReason != model.ShutdownUnspecified || agents[0].LastShutdownAt == nil {
+		t.Fatalf("expected the last shutdown recorded on the agent, got %q at %v", agents[0].LastShutdownReason, agents[0].LastShutdownAt)
+	}
+
+	events, err := repo.ListAuditEvents(context.Background(), tenantID, 100)
+	if err != nil {
+		t.Fatalf("list audit events: %v", err)
+	}
+	var reasons []string
+	for _, e := range events {
+		if e.Action != "agent.shutdown" || e.ResourceID != agentID {
+			continue
+		}
+		var meta struct {
+			Reason         string `json:"reason"`
+			FinalHeartbeat bool   `json:"final_heartbeat"`
+		}
+		mustDecode(t, e.MetadataJSON, &meta)
+		if meta.FinalHeartbeat == (meta.Reason == model.ShutdownCrashRecovery) {
+			t.Fatalf("unexpected final_heartbeat for reason %q", meta.Reason)
+		}
+		reasons = append(reasons, meta.Reason)
+	}
+	slices.Sort(reasons)
+	want := []string{model.ShutdownConfigReload, model.ShutdownCrashRecovery, model.ShutdownSignal, model.ShutdownUnspecified, model.ShutdownUpgrade}
+	if !slices.Equal(reasons, want) {
+		t.Fatalf("expected recorded reasons %v, got %v", want, reasons)
+	}
+}
+
 func TestHeartbeatV1HostFactsCompatibility(t *testing.T) {
 	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
 	plainAPIKey := "nk_test_key"
@@ -197,362 +543,2913 @@ func TestHeartbeatV1HostFactsCompatibility(t *testing.T) {
 	}
 }
 
-func TestPlanSubmissionAndLogs(t *testing.T) {
+func TestPrometheusTargetsFileSD(t *testing.T) {
 	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
 	plainAPIKey := "nk_test_key"
 	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
 	if err != nil {
 		t.Fatalf("create api key: %v", err)
 	}
+	secondToken := "enroll-token-2"
+	_, err = repo.IssueEnrollmentToken(context.Background(), store.EnrollmentToken{
+		ID:        uuid.NewString(),
+		TenantID:  tenantID,
+		SiteID:    siteID,
+		TokenHash: hashString(secondToken),
+		ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
 
-	csrPEM := makeCSR(t)
-	enrollResp := enroll(t, app, enrollToken, csrPEM)
-	agentID := enrollResp["agent_id"].(string)
-	certPEM := enrollResp["client_certificate_pem"].(string)
-	cert := parseCert(t, []byte(certPEM))
-
-	planPayload := map[string]any{
-		"idempotency_key": "plan-123",
-		"actions": []map[string]any{
-			{"operation": "CREATE", "name": "vm-1", "vcpu_count": 2, "memory_mib": 512},
-		},
+	wantTargets := map[string]string{}
+	for i, token := range []string{enrollToken, secondToken} {
+		resp := enroll(t, app, token, makeCSR(t))
+		agentID := resp["agent_id"].(string)
+		cert := parseCert(t, []byte(resp["client_certificate_pem"].(string)))
+		peerIP := fmt.Sprintf("100.64.0.%d", i+5)
+		hbPayload := map[string]any{
+			"agent_id":      agentID,
+			"heartbeat_seq": 1,
+			"hostname":      fmt.Sprintf("edge-host-%d", i+1),
+			"metrics_addr":  ":9090",
+			"netbird_status": map[string]any{
+				"connected": true,
+				"ipv4":      peerIP + "/16",
+			},
+		}
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", hbPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		wantTargets[agentID] = peerIP + ":9090"
 	}
-	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
+
+	rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/prometheus-targets", plainAPIKey, nil, nil)
 	if rec.Code != http.StatusOK {
-		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+		t.Fatalf("prometheus targets status=%d body=%s", rec.Code, rec.Body.String())
 	}
-	var planResp struct {
-		Executions []store.Execution `json:"executions"`
+	var groups []struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
 	}
-	mustDecode(t, rec.Body.Bytes(), &planResp)
-	if len(planResp.Executions) != 1 {
-		t.Fatalf("expected 1 execution, got %d", len(planResp.Executions))
+	mustDecode(t, rec.Body.Bytes(), &groups)
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 target groups, got %d: %s", len(groups), rec.Body.String())
+	}
+	for _, g := range groups {
+		agentID := g.Labels["agent_id"]
+		want, ok := wantTargets[agentID]
+		if !ok {
+			t.Fatalf("unexpected agent_id label: %+v", g)
+		}
+		if len(g.Targets) != 1 || g.Targets[0] != want {
+			t.Fatalf("agent %s targets=%v want [%s]", agentID, g.Targets, want)
+		}
+		if g.Labels["tenant_id"] != tenantID || g.Labels["site_id"] != siteID || g.Labels["host_id"] == "" {
+			t.Fatalf("missing labels: %+v", g.Labels)
+		}
 	}
-	execID := planResp.Executions[0].ID
 
-	logsPayload := map[string]any{
-		"agent_id": agentID,
-		"entries": []map[string]any{
-			{"execution_id": execID, "sequence": 1, "severity": "INFO", "message": "start", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
-			{"execution_id": execID, "sequence": 2, "severity": "INFO", "message": "done", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
-			{"execution_id": execID, "sequence": 2, "severity": "INFO", "message": "dup", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
-		},
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/prometheus-targets", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown site, got %d", rec.Code)
 	}
-	logRec := doJSON(t, app.Handler(), "POST", "/agents/logs", "", logsPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
-	if logRec.Code != http.StatusOK {
-		t.Fatalf("ingest logs status=%d body=%s", logRec.Code, logRec.Body.String())
+}
+
+func TestCapacityEndpoints(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
 	}
-	var ingestResp map[string]any
-	mustDecode(t, logRec.Body.Bytes(), &ingestResp)
-	if ingestResp["accepted_frames"].(float64) != 2 {
-		t.Fatalf("expected accepted_frames=2, got %v", ingestResp["accepted_frames"])
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	hbPayload := map[string]any{
+		"agent_id":      enrollResp["agent_id"].(string),
+		"heartbeat_seq": 1,
+		"hostname":      "edge-capacity",
+		"host_facts": map[string]any{
+			"cpu_cores":          8,
+			"memory_total_bytes": int64(16 * 1024 * 1024 * 1024),
+		},
+		"microvms": []map[string]any{
+			{"id": "vm-cap-1", "name": "vm-cap-1", "state": "RUNNING", "vcpu_count": 2, "memory_mib": 2048},
+			{"id": "vm-cap-2", "name": "vm-cap-2", "state": "STOPPED", "vcpu_count": 1, "memory_mib": 1024},
+		},
 	}
-	if ingestResp["dropped_frames"].(float64) != 1 {
-		t.Fatalf("expected dropped_frames=1, got %v", ingestResp["dropped_frames"])
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", hbPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
 	}
 
-	logsRec := doJSON(t, app.Handler(), "GET", "/executions/"+execID+"/logs", plainAPIKey, nil, nil)
-	if logsRec.Code != http.StatusOK {
-		t.Fatalf("list logs status=%d body=%s", logsRec.Code, logsRec.Body.String())
-	}
-	var logsResp struct {
-		Logs []store.ExecutionLog `json:"logs"`
+	for _, path := range []string{"/sites/" + siteID + "/capacity", "/tenants/" + tenantID + "/capacity"} {
+		rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s status=%d body=%s", path, rec.Code, rec.Body.String())
+		}
+		var capacity store.Capacity
+		mustDecode(t, rec.Body.Bytes(), &capacity)
+		if capacity.Hosts != 1 || capacity.VCPUTotal != 8 || capacity.VCPUUsed != 3 || capacity.VCPUAvailable != 5 {
+			t.Fatalf("%s unexpected vcpu capacity: %+v", path, capacity)
+		}
+		if capacity.MemoryBytesAvailable != 13*1024*1024*1024 {
+			t.Fatalf("%s unexpected memory headroom: %+v", path, capacity)
+		}
 	}
-	mustDecode(t, logsRec.Body.Bytes(), &logsResp)
-	if len(logsResp.Logs) != 2 {
-		t.Fatalf("expected 2 logs, got %d", len(logsResp.Logs))
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+uuid.NewString()+"/capacity", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for other tenant, got %d", rec.Code)
 	}
 }
 
-func TestStrictDecodeStillEnforcedForAdminEndpoints(t *testing.T) {
-	app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+func TestApplyPlanRejectsRequestAboveLimit(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
 	plainAPIKey := "nk_test_key"
-	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)})
 	if err != nil {
 		t.Fatalf("create api key: %v", err)
 	}
 
-	rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/sites", plainAPIKey, map[string]any{
-		"name":        "strict-site",
-		"extra_field": "must-fail",
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-invalid-resources",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-res-1", "name": "vm-res-1", "vcpu_request": 4, "vcpu_limit": 2},
+		},
 	}, nil)
 	if rec.Code != http.StatusBadRequest {
-		t.Fatalf("expected strict decoder 400, got %d body=%s", rec.Code, rec.Body.String())
+		t.Fatalf("expected 400 for vcpu_request above vcpu_limit, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-burstable",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-2", "operation": "CREATE", "vm_id": "vm-res-2", "name": "vm-res-2", "vcpu_request": 1, "memory_request": 256, "memory_limit": 1024},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	vms, err := repo.ListVMs(context.Background(), tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list vms: %v", err)
+	}
+	if len(vms) != 1 || vms[0].VCPULimit != 1 || vms[0].MemoryRequestMiB != 256 || vms[0].MemoryMiB != 1024 {
+		t.Fatalf("unexpected vms: %+v", vms)
 	}
 }
 
-func TestHeartbeatPlanDeliveryAndResultPersistence(t *testing.T) {
-	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+func TestApplyPlanEnforcesUniqueVMNamesWhenEnabled(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
 	plainAPIKey := "nk_test_key"
-	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)})
 	if err != nil {
 		t.Fatalf("create api key: %v", err)
 	}
+	createWeb := func(key string) *httptest.ResponseRecorder {
+		return doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": key,
+			"actions":         []map[string]any{{"operation": "CREATE", "name": "web", "vcpu_count": 1, "memory_mib": 256}},
+		}, nil)
+	}
 
-	csrPEM := makeCSR(t)
-	enrollResp := enroll(t, app, enrollToken, csrPEM)
-	agentID := enrollResp["agent_id"].(string)
-	certPEM := enrollResp["client_certificate_pem"].(string)
-	cert := parseCert(t, []byte(certPEM))
+	if rec := createWeb("unique-off-1"); rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := createWeb("unique-off-2"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a duplicate name to be allowed with the flag off, got %d body=%s", rec.Code, rec.Body.String())
+	}
 
-	planPayload := map[string]any{
-		"idempotency_key": "plan-run-once",
-		"actions": []map[string]any{
-			{
-				"operation_id": "create-vm-1",
-				"operation":    "CREATE",
-				"vm_id":        "vm-runonce-1",
-				"name":         "vm-runonce-1",
-				"vcpu_count":   1,
-				"memory_mib":   256,
-			},
-			{
-				"operation_id": "start-vm-1",
-				"operation":    "START",
-				"vm_id":        "vm-runonce-1",
-			},
-		},
+	rec := doJSON(t, app.Handler(), "PUT", "/sites/"+siteID+"/vm-name-policy", plainAPIKey, map[string]any{"unique_vm_names": true}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set vm name policy status=%d body=%s", rec.Code, rec.Body.String())
 	}
-	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
-	if applyRec.Code != http.StatusOK {
-		t.Fatalf("apply plan status=%d body=%s", applyRec.Code, applyRec.Body.String())
+	if rec := createWeb("unique-on"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `\"web\"`) {
+		t.Fatalf("expected 409 for a name used in the site, got %d body=%s", rec.Code, rec.Body.String())
 	}
-	var applyResp struct {
-		PlanID     string            `json:"plan_id"`
-		Executions []store.Execution `json:"executions"`
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/sites", plainAPIKey, nil, nil)
+	var listed struct {
+		Sites []store.Site `json:"sites"`
 	}
-	mustDecode(t, applyRec.Body.Bytes(), &applyResp)
-	if len(applyResp.Executions) != 2 {
-		t.Fatalf("expected 2 executions, got %d", len(applyResp.Executions))
+	mustDecode(t, rec.Body.Bytes(), &listed)
+	if len(listed.Sites) != 1 || !listed.Sites[0].UniqueVMNames {
+		t.Fatalf("expected the site to report unique_vm_names, got %+v", listed.Sites)
 	}
+	rec = doJSON(t, app.Handler(), "PUT", "/sites/"+uuid.NewString()+"/vm-name-policy", plainAPIKey, map[string]any{"unique_vm_names": true}, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown site to be 404, got %d", rec.Code)
+	}
+}
 
+func TestReportPlanResultIgnoresResentTokens(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-result-tokens",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-tok-1", "name": "vm-tok-1", "vcpu_count": 1, "memory_mib": 256},
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-tok-1"},
+		},
+	}, nil)
+	var applyResp struct {
+		PlanID string `json:"plan_id"`
+	}
+	mustDecode(t, applyRec.Body.Bytes(), &applyResp)
+	if hbRec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1, "hostname": "edge-tok"}, mtls); hbRec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", hbRec.Code, hbRec.Body.String())
+	}
+
+	// Results are shaped as the agent sends them.
+	report := func(actionID string, ok bool, token string) map[string]any {
+		t.Helper()
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		rec := doJSON(t, app.Handler(), "POST", "/v1/executions/result", "", map[string]any{
+			"plan_id":      applyResp.PlanID,
+			"execution_id": applyResp.PlanID,
+			"results": []map[string]any{{
+				"execution_id": applyResp.PlanID, "action_id": actionID, "ok": ok, "message": "done",
+				"started_at": now, "finished_at": now, "idempotency_token": token,
+			}},
+		}, mtls)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("report result status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp map[string]any
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+	planStatus := func() string {
+		plan, err := repo.GetPlan(context.Background(), tenantID, applyResp.PlanID)
+		if err != nil {
+			t.Fatalf("get plan: %v", err)
+		}
+		return plan.Status
+	}
+
+	if resp := report("create-vm-1", true, "tok-create"); resp["status"] != "accepted" {
+		t.Fatalf("expected the first report to apply, got %v", resp)
+	}
+	if resp := report("create-vm-1", false, "tok-create"); resp["status"] != "duplicate" {
+		t.Fatalf("expected the resend to be a duplicate, got %v", resp)
+	}
+	if got := planStatus(); got != "IN_PROGRESS" {
+		t.Fatalf("expected the duplicate to leave the plan IN_PROGRESS, got %s", got)
+	}
+	if resp := report("start-vm-1", true, "tok-start"); resp["status"] != "accepted" {
+		t.Fatalf("expected a new token to apply, got %v", resp)
+	}
+	if got := planStatus(); got != "SUCCEEDED" {
+		t.Fatalf("expected the plan to succeed, got %s", got)
+	}
+}
+
+func TestPlanStatsMatchPlanOutcomes(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agentID := enroll(t, app, enrollToken, makeCSR(t))["agent_id"].(string)
+
+	for i, ok := range []bool{true, false, true} {
+		rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": fmt.Sprintf("plan-stats-%d", i),
+			"actions":         []map[string]any{{"operation_id": "create", "operation": "CREATE", "name": fmt.Sprintf("vm-stats-%d", i), "vcpu_count": 1, "memory_mib": 256}},
+		}, nil)
+		var applied struct {
+			PlanID string `json:"plan_id"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &applied)
+		if err := repo.ReportPlanResult(context.Background(), agentID, store.PlanResultReport{
+			PlanID:  applied.PlanID,
+			Results: []store.PlanActionResultItem{{ActionID: "create", OK: ok}},
+		}); err != nil {
+			t.Fatalf("report result: %v", err)
+		}
+	}
+	// A plan no agent has reported on yet.
+	doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-stats-pending",
+		"actions":         []map[string]any{{"operation": "CREATE", "name": "vm-stats-pending", "vcpu_count": 1, "memory_mib": 256}},
+	}, nil)
+
+	rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plan-stats", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("plan stats status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var stats planStatsResponse
+	mustDecode(t, rec.Body.Bytes(), &stats)
+	if stats.Total != 4 || stats.Succeeded != 2 || stats.Failed != 1 || stats.Other != 1 {
+		t.Fatalf("unexpected plan stats %+v", stats)
+	}
+	if want := 200.0 / 3; math.Abs(stats.SuccessPercent-want) > 1e-9 {
+		t.Fatalf("expected a success percentage of %v, got %v", want, stats.SuccessPercent)
+	}
+
+	from := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plan-stats?from="+from+"&to="+from, plainAPIKey, nil, nil)
+	mustDecode(t, rec.Body.Bytes(), &stats)
+	if rec.Code != http.StatusOK || stats.Total != 0 {
+		t.Fatalf("expected no plans in a later window, got %d %+v", rec.Code, stats)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plan-stats?to=2020-01-01", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a malformed to to be 400, got %d", rec.Code)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/plan-stats", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown site to be 404, got %d", rec.Code)
+	}
+}
+
+func TestRetryFailedPlan(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-retry",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-retry-1", "name": "vm-retry-1", "vcpu_count": 1, "memory_mib": 256},
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-retry-1"},
+		},
+	}, nil)
+	if applyRec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", applyRec.Code, applyRec.Body.String())
+	}
+	var applyResp struct {
+		PlanID string `json:"plan_id"`
+	}
+	mustDecode(t, applyRec.Body.Bytes(), &applyResp)
+	retryPath := "/sites/" + siteID + "/plans/" + applyResp.PlanID + "/retry"
+
+	rec := doJSON(t, app.Handler(), "POST", retryPath, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 retrying a pending plan, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	hbRec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1, "hostname": "edge-retry"}, mtls)
+	if hbRec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", hbRec.Code, hbRec.Body.String())
+	}
+	var hbResp struct {
+		PendingPlans []struct {
+			PlanID      string `json:"plan_id"`
+			ExecutionID string `json:"execution_id"`
+		} `json:"pending_plans"`
+	}
+	mustDecode(t, hbRec.Body.Bytes(), &hbResp)
+	if len(hbResp.PendingPlans) != 1 {
+		t.Fatalf("expected 1 pending plan, got %d", len(hbResp.PendingPlans))
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	resultRec := doJSON(t, app.Handler(), "POST", "/v1/executions/result", "", map[string]any{
+		"plan_id":      hbResp.PendingPlans[0].PlanID,
+		"execution_id": hbResp.PendingPlans[0].ExecutionID,
+		"results": []map[string]any{
+			{"action_id": "create-vm-1", "ok": true, "message": "ok", "finished_at": now},
+			{"action_id": "start-vm-1", "ok": false, "error_code": "BOOT_FAILED", "message": "boot failed", "finished_at": now},
+		},
+	}, mtls)
+	if resultRec.Code != http.StatusAccepted {
+		t.Fatalf("report result status=%d body=%s", resultRec.Code, resultRec.Body.String())
+	}
+
+	type retryResponse struct {
+		PlanID       string            `json:"plan_id"`
+		RetriedFrom  string            `json:"retried_from"`
+		Deduplicated bool              `json:"deduplicated"`
+		Executions   []store.Execution `json:"executions"`
+	}
+	retry := func(body any) retryResponse {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", retryPath, plainAPIKey, body, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("retry status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp retryResponse
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	failedOnly := retry(map[string]any{"failed_only": true})
+	if failedOnly.PlanID == applyResp.PlanID || failedOnly.RetriedFrom != applyResp.PlanID {
+		t.Fatalf("unexpected retry plan: %+v", failedOnly)
+	}
+	if len(failedOnly.Executions) != 1 || failedOnly.Executions[0].OperationID != "start-vm-1" || failedOnly.Executions[0].VMID != "vm-retry-1" {
+		t.Fatalf("expected only the failed START action, got %+v", failedOnly.Executions)
+	}
+	if again := retry(map[string]any{"failed_only": true}); !again.Deduplicated || again.PlanID != failedOnly.PlanID {
+		t.Fatalf("expected repeated retry to be deduplicated, got %+v", again)
+	}
+
+	full := retry(nil)
+	if full.PlanID == failedOnly.PlanID || len(full.Executions) != 2 {
+		t.Fatalf("expected full retry with 2 actions, got %+v", full)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+failedOnly.PlanID, plainAPIKey, nil, nil)
+	var planResp struct {
+		RetriedFrom string `json:"retried_from"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &planResp)
+	if planResp.RetriedFrom != applyResp.PlanID {
+		t.Fatalf("expected retried_from %s, got %q", applyResp.PlanID, planResp.RetriedFrom)
+	}
+
+	otherSite := uuid.NewString()
+	if _, err := repo.CreateSite(context.Background(), store.Site{ID: otherSite, TenantID: tenantID, Name: "other"}); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+otherSite+"/plans/"+applyResp.PlanID+"/retry", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 retrying through another site, got %d", rec.Code)
+	}
+}
+
+func TestHeartbeatPersistsAgentNetworkStatus(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	csrPEM := makeCSR(t)
+	enrollResp := enroll(t, app, enrollToken, csrPEM)
+	agentID := enrollResp["agent_id"].(string)
+	certPEM := enrollResp["client_certificate_pem"].(string)
+	cert := parseCert(t, []byte(certPEM))
+
+	networkPath := "/sites/" + siteID + "/agents/" + agentID + "/network"
+	rec := doJSON(t, app.Handler(), "GET", networkPath, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before first heartbeat, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	handshake := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
 	hbPayload := map[string]any{
+		"agent_id":      agentID,
+		"heartbeat_seq": 1,
+		"hostname":      "edge-host-1",
+		"netbird_status": map[string]any{
+			"connected":         true,
+			"state":             "Connected",
+			"peer_id":           "peer-123",
+			"ipv4":              "100.95.1.20",
+			"network_id":        "nw-01",
+			"last_handshake_at": handshake.Format(time.RFC3339),
+			"route_status":      "2/2 routes active",
+		},
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", hbPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", networkPath, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get agent network status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var status store.AgentNetworkStatus
+	mustDecode(t, rec.Body.Bytes(), &status)
+	if !status.Connected || status.PeerID != "peer-123" || status.PeerIP != "100.95.1.20" || status.NetworkID != "nw-01" {
+		t.Fatalf("unexpected peer details: %+v", status)
+	}
+	if status.RouteStatus != "2/2 routes active" {
+		t.Fatalf("unexpected route status: %q", status.RouteStatus)
+	}
+	if status.LastHandshakeAt == nil || !status.LastHandshakeAt.Equal(handshake) {
+		t.Fatalf("unexpected last handshake: %v", status.LastHandshakeAt)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/agents/"+agentID+"/network", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for foreign site, got %d", rec.Code)
+	}
+}
+
+func TestPlanSubmissionAndLogs(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	csrPEM := makeCSR(t)
+	enrollResp := enroll(t, app, enrollToken, csrPEM)
+	agentID := enrollResp["agent_id"].(string)
+	certPEM := enrollResp["client_certificate_pem"].(string)
+	cert := parseCert(t, []byte(certPEM))
+
+	planPayload := map[string]any{
+		"idempotency_key": "plan-123",
+		"actions": []map[string]any{
+			{"operation": "CREATE", "name": "vm-1", "vcpu_count": 2, "memory_mib": 512},
+		},
+	}
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var planResp struct {
+		PlanID     string             `json:"plan_id"`
+		Executions []store.Execution  `json:"executions"`
+		Progress   store.PlanProgress `json:"progress"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &planResp)
+	if len(planResp.Executions) != 1 {
+		t.Fatalf("expected 1 execution, got %d", len(planResp.Executions))
+	}
+	if planResp.Progress.Total != 1 || planResp.Progress.StateCounts["PENDING"] != 1 {
+		t.Fatalf("unexpected apply progress: %+v", planResp.Progress)
+	}
+	execID := planResp.Executions[0].ID
+
+	getRec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+planResp.PlanID, plainAPIKey, nil, nil)
+	if getRec.Code != http.StatusOK {
+		t.Fatalf("get plan status=%d body=%s", getRec.Code, getRec.Body.String())
+	}
+	var getResp struct {
+		PlanStatus string             `json:"plan_status"`
+		Progress   store.PlanProgress `json:"progress"`
+	}
+	mustDecode(t, getRec.Body.Bytes(), &getResp)
+	if getResp.PlanStatus != "PENDING" || getResp.Progress.Total != 1 || getResp.Progress.Percent != 0 {
+		t.Fatalf("unexpected get plan response: %+v", getResp)
+	}
+
+	logsPayload := map[string]any{
+		"agent_id": agentID,
+		"entries": []map[string]any{
+			{"execution_id": execID, "sequence": 1, "severity": "INFO", "message": "start", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
+			{"execution_id": execID, "sequence": 2, "severity": "INFO", "message": "done", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
+			{"execution_id": execID, "sequence": 2, "severity": "INFO", "message": "dup", "emitted_at": time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	}
+	logRec := doJSON(t, app.Handler(), "POST", "/agents/logs", "", logsPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if logRec.Code != http.StatusOK {
+		t.Fatalf("ingest logs status=%d body=%s", logRec.Code, logRec.Body.String())
+	}
+	var ingestResp map[string]any
+	mustDecode(t, logRec.Body.Bytes(), &ingestResp)
+	if ingestResp["accepted_frames"].(float64) != 2 {
+		t.Fatalf("expected accepted_frames=2, got %v", ingestResp["accepted_frames"])
+	}
+	if ingestResp["dropped_frames"].(float64) != 1 {
+		t.Fatalf("expected dropped_frames=1, got %v", ingestResp["dropped_frames"])
+	}
+
+	logsRec := doJSON(t, app.Handler(), "GET", "/executions/"+execID+"/logs", plainAPIKey, nil, nil)
+	if logsRec.Code != http.StatusOK {
+		t.Fatalf("list logs status=%d body=%s", logsRec.Code, logsRec.Body.String())
+	}
+	var logsResp struct {
+		Logs []store.ExecutionLog `json:"logs"`
+	}
+	mustDecode(t, logsRec.Body.Bytes(), &logsResp)
+	if len(logsResp.Logs) != 2 {
+		t.Fatalf("expected 2 logs, got %d", len(logsResp.Logs))
+	}
+}
+
+func TestExecutionLogStatsMatchIngestedLogs(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-stats",
+		"actions":         []map[string]any{{"operation": "CREATE", "name": "vm-1"}},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var planResp struct {
+		Executions []store.Execution `json:"executions"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &planResp)
+	execID := planResp.Executions[0].ID
+
+	path := "/executions/" + execID + "/logs/stats"
+	rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	var stats store.ExecutionLogStats
+	mustDecode(t, rec.Body.Bytes(), &stats)
+	if rec.Code != http.StatusOK || stats.Total != 0 || stats.BySeverity["ERROR"] != 0 || len(stats.BySeverity) != 4 {
+		t.Fatalf("expected empty stats, got %d %+v", rec.Code, stats)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	entries := []map[string]any{}
+	for i, severity := range []string{"INFO", "INFO", "WARN", "ERROR", "INFO", "DEBUG"} {
+		entries = append(entries, map[string]any{"execution_id": execID, "sequence": i + 1, "severity": severity, "message": "line", "emitted_at": now})
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/agents/logs", "", map[string]any{"agent_id": agentID, "entries": entries}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ingest logs status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("log stats status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	stats = store.ExecutionLogStats{}
+	mustDecode(t, rec.Body.Bytes(), &stats)
+	want := map[string]int64{"DEBUG": 1, "INFO": 3, "WARN": 1, "ERROR": 1}
+	if stats.ExecutionID != execID || stats.Total != 6 || !maps.Equal(stats.BySeverity, want) {
+		t.Fatalf("expected 6 entries split %v, got %+v", want, stats)
+	}
+
+	otherTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenant, Slug: "other", Name: "Other", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: otherTenant, Name: "other", KeyHash: hashString("nk_other_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", path, "nk_other_key", nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another tenant's execution to be hidden, got %d", rec.Code)
+	}
+}
+
+func TestLogIngestFiltersBelowTenantMinimumSeverity(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-severity",
+		"actions":         []map[string]any{{"operation": "CREATE", "name": "vm-1"}},
+	}, nil)
+	var planResp struct {
+		Executions []store.Execution `json:"executions"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &planResp)
+	execID := planResp.Executions[0].ID
+
+	path := "/tenants/" + tenantID + "/log-severity"
+	if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"min_severity": "verbose"}, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown severity to be rejected, got %d", rec.Code)
+	}
+	rec = doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"min_severity": "info"}, nil)
+	var updated store.Tenant
+	mustDecode(t, rec.Body.Bytes(), &updated)
+	if rec.Code != http.StatusOK || updated.MinLogSeverity != "INFO" {
+		t.Fatalf("set log severity: %d %+v", rec.Code, updated)
+	}
+
+	entries := []map[string]any{}
+	for i, severity := range []string{"DEBUG", "INFO", "DEBUG", "WARN", "ERROR"} {
+		entries = append(entries, map[string]any{"execution_id": execID, "sequence": i + 1, "severity": severity, "message": "line"})
+	}
+	// A duplicate is still dropped, not filtered.
+	entries = append(entries, map[string]any{"execution_id": execID, "sequence": 2, "severity": "INFO", "message": "again"})
+	rec = doJSON(t, app.Handler(), "POST", "/agents/logs", "", map[string]any{"agent_id": agentID, "entries": entries}, agentTLS)
+	var counts struct {
+		Accepted int64 `json:"accepted_frames"`
+		Dropped  int64 `json:"dropped_frames"`
+		Filtered int64 `json:"filtered_frames"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &counts)
+	if rec.Code != http.StatusOK || counts.Accepted != 3 || counts.Dropped != 1 || counts.Filtered != 2 {
+		t.Fatalf("expected 3 accepted, 1 dropped and 2 filtered, got %d %+v", rec.Code, counts)
+	}
+	stats, err := repo.GetExecutionLogStats(ctx, tenantID, execID)
+	if err != nil {
+		t.Fatalf("log stats: %v", err)
+	}
+	if stats.BySeverity["DEBUG"] != 0 || stats.BySeverity["INFO"] != 1 || stats.BySeverity["WARN"] != 1 || stats.BySeverity["ERROR"] != 1 {
+		t.Fatalf("expected only entries at or above INFO stored, got %v", stats.BySeverity)
+	}
+
+	// Clearing the minimum stores everything again.
+	if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, map[string]any{"min_severity": ""}, nil); rec.Code != http.StatusOK {
+		t.Fatalf("clear log severity: %d", rec.Code)
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/agents/logs", "", map[string]any{"agent_id": agentID, "entries": []map[string]any{
+		{"execution_id": execID, "sequence": 10, "severity": "DEBUG", "message": "kept"},
+	}}, agentTLS)
+	mustDecode(t, rec.Body.Bytes(), &counts)
+	if counts.Accepted != 1 || counts.Filtered != 0 {
+		t.Fatalf("expected DEBUG to be accepted without a minimum, got %+v", counts)
+	}
+}
+
+func TestStrictDecodeStillEnforcedForAdminEndpoints(t *testing.T) {
+	app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/sites", plainAPIKey, map[string]any{
+		"name":        "strict-site",
+		"extra_field": "must-fail",
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected strict decoder 400, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRevokeAllTenantCerts(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	secondToken := "enroll-token-2"
+	_, err := repo.IssueEnrollmentToken(context.Background(), store.EnrollmentToken{
+		ID:        uuid.NewString(),
+		TenantID:  tenantID,
+		SiteID:    siteID,
+		TokenHash: hashString(secondToken),
+		ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+
+	var agentIDs []string
+	var certs []*x509.Certificate
+	for _, token := range []string{enrollToken, secondToken} {
+		resp := enroll(t, app, token, makeCSR(t))
+		agentIDs = append(agentIDs, resp["agent_id"].(string))
+		certs = append(certs, parseCert(t, []byte(resp["client_certificate_pem"].(string))))
+	}
+
+	revoke := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/tenants/"+tenantID+"/revoke-all-certs", nil)
+		req.Header.Set("X-Admin-Key", "admin")
+		rec := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := revoke()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoke status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Revoked int `json:"revoked"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if resp.Revoked != 2 {
+		t.Fatalf("expected 2 revoked certs, got %d", resp.Revoked)
+	}
+
+	for i, agentID := range agentIDs {
+		agent, err := repo.GetAgentByID(context.Background(), agentID)
+		if err != nil {
+			t.Fatalf("get agent: %v", err)
+		}
+		if agent.State != "UNENROLLED" || agent.CertSerial != "" {
+			t.Fatalf("agent %s not unenrolled: %+v", agentID, agent)
+		}
+		serial := certs[i].SerialNumber.String()
+		if !app.crlManager.IsRevoked(serial) {
+			t.Fatalf("serial %s missing from CRL", serial)
+		}
+		revoked, err := repo.IsCertificateRevoked(context.Background(), serial)
+		if err != nil || !revoked {
+			t.Fatalf("serial %s not revoked in store: revoked=%v err=%v", serial, revoked, err)
+		}
+		hb := doJSON(t, app.Handler(), "POST", "/agents/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certs[i]}})
+		if hb.Code == http.StatusOK {
+			t.Fatalf("expected heartbeat with revoked cert to fail")
+		}
+	}
+
+	events, err := repo.ListAuditEvents(context.Background(), tenantID, 50)
+	if err != nil {
+		t.Fatalf("list audit events: %v", err)
+	}
+	var revokeEvents int
+	for _, ev := range events {
+		if ev.Action == "agent.cert_revoke" {
+			revokeEvents++
+		}
+	}
+	if revokeEvents != 2 {
+		t.Fatalf("expected 2 revoke audit events, got %d", revokeEvents)
+	}
+
+	rec = revoke()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second revoke status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if resp.Revoked != 0 {
+		t.Fatalf("expected idempotent revoke to report 0, got %d", resp.Revoked)
+	}
+}
+
+// TestUnenrollFailsTheAgentLeasedWork unenrolls an agent that leased a plan
+// over a heartbeat, as the edge agent does: its executions are still
+// PENDING, and they must fail rather than be leased to another agent.
+func TestUnenrollFailsTheAgentLeasedWork(t *testing.T) {
+	for _, keepLeases := range []bool{false, true} {
+		app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+		app.cfg.UnenrollKeepLeases = keepLeases
+		enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+		agentID := enrollResp["agent_id"].(string)
+		cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+		tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+		applied, err := repo.ApplyPlan(context.Background(), store.ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: "unenroll-" + uuid.NewString(),
+			Actions:        []store.ApplyPlanAction{{OperationID: "create", Operation: "CREATE", VMID: uuid.NewString(), Name: "web", VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID}, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var hb struct {
+			PendingPlans []leasedPlanPayload `json:"pending_plans"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &hb)
+		if len(hb.PendingPlans) != 1 {
+			t.Fatalf("expected the heartbeat to lease the plan, got %+v", hb.PendingPlans)
+		}
+
+		rec = doJSON(t, app.Handler(), "POST", "/v1/unenroll", "", map[string]any{"agent_id": agentID}, tlsState)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("unenroll status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		plan, err := repo.GetPlan(context.Background(), tenantID, applied.Plan.ID)
+		if err != nil {
+			t.Fatalf("get plan: %v", err)
+		}
+		execs, err := repo.ListExecutions(context.Background(), tenantID, siteID, nil, 10)
+		if err != nil || len(execs) != 1 {
+			t.Fatalf("list executions: %v %+v", err, execs)
+		}
+		if keepLeases {
+			if plan.Status != "IN_PROGRESS" || execs[0].State != "PENDING" {
+				t.Fatalf("expected the plan to wait for lease expiry, got %s/%s", plan.Status, execs[0].State)
+			}
+			continue
+		}
+		if plan.Status != "FAILED" || execs[0].State != "FAILED" || execs[0].ErrorCode == nil || *execs[0].ErrorCode != store.ErrorCodeAgentUnenrolled {
+			t.Fatalf("expected the plan to fail with %s, got %s/%+v", store.ErrorCodeAgentUnenrolled, plan.Status, execs[0])
+		}
+		if leased, err := repo.LeasePendingPlans(context.Background(), agentID, 1, time.Minute); err != nil || len(leased) != 0 {
+			t.Fatalf("expected nothing left to lease, got %v %+v", err, leased)
+		}
+	}
+}
+
+func TestListRevokedCertificatesPages(t *testing.T) {
+	app, repo, _, _, _ := newTestAppWithEnrollmentToken(t)
+	agentA, agentB := uuid.NewString(), uuid.NewString()
+	for _, rev := range []struct{ serial, agentID string }{{"101", agentA}, {"102", agentB}, {"103", agentA}} {
+		if err := repo.RevokeCertificate(context.Background(), rev.serial, 1, rev.agentID); err != nil {
+			t.Fatalf("revoke: %v", err)
+		}
+	}
+	list := func(query, adminKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/certificates/revoked?"+query, nil)
+		req.Header.Set("X-Admin-Key", adminKey)
+		rec := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	page := func(query string) revokedCertificatesResponse {
+		t.Helper()
+		rec := list(query, "admin")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list %q status=%d body=%s", query, rec.Code, rec.Body.String())
+		}
+		var resp revokedCertificatesResponse
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	seen := map[string]bool{}
+	first := page("limit=2")
+	if len(first.Certificates) != 2 || first.NextCursor == "" {
+		t.Fatalf("expected a full first page with a cursor, got %+v", first)
+	}
+	second := page("limit=2&cursor=" + first.NextCursor)
+	if len(second.Certificates) != 1 || second.NextCursor != "" {
+		t.Fatalf("expected a last page without a cursor, got %+v", second)
+	}
+	for _, e := range append(first.Certificates, second.Certificates...) {
+		seen[e.SerialNumber] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected every serial once across the pages, got %v", seen)
+	}
+
+	if got := page("agent_id=" + agentA); len(got.Certificates) != 2 {
+		t.Fatalf("expected agent A's two revocations, got %+v", got.Certificates)
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if got := page("from=" + future); len(got.Certificates) != 0 {
+		t.Fatalf("expected nothing revoked after %s, got %+v", future, got.Certificates)
+	}
+	if got := page("to=" + future); len(got.Certificates) != 3 {
+		t.Fatalf("expected everything revoked before %s, got %+v", future, got.Certificates)
+	}
+
+	for _, bad := range []string{"from=yesterday", "cursor=%25%25", "agent_id=nope", "from=" + future + "&to=2020-01-01T00:00:00Z"} {
+		if rec := list(bad, "admin"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected %q to be 400, got %d", bad, rec.Code)
+		}
+	}
+	if rec := list("", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong admin key to be 401, got %d", rec.Code)
+	}
+}
+
+func TestAdminSweepOfflineMarksStaleAgent(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	agent, err := repo.GetAgentByID(context.Background(), agentID)
+	if err != nil {
+		t.Fatalf("get agent: %v", err)
+	}
+	if agent.State != "ONLINE" {
+		t.Fatalf("expected agent ONLINE after heartbeat, got %s", agent.State)
+	}
+
+	sweep := func(adminKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/agents/sweep-offline", nil)
+		req.Header.Set("X-Admin-Key", adminKey)
+		rec := httptest.NewRecorder()
+		app.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := sweep("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without admin key, got %d", rec.Code)
+	}
+
+	app.cfg.OfflineAfter = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	rec = sweep("admin")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("sweep status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Updated int64 `json:"updated"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if resp.Updated != 1 {
+		t.Fatalf("expected 1 agent swept, got %d", resp.Updated)
+	}
+
+	hosts, err := repo.ListHosts(context.Background(), tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list hosts: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].AgentState != "OFFLINE" {
+		t.Fatalf("expected host agent_state OFFLINE, got %+v", hosts)
+	}
+
+	events, err := repo.ListAuditEvents(context.Background(), tenantID, 50)
+	if err != nil {
+		t.Fatalf("list audit events: %v", err)
+	}
+	var audited bool
+	for _, ev := range events {
+		if ev.Action == "agent.mark_offline" && ev.ResourceID == agentID {
+			audited = true
+		}
+	}
+	if !audited {
+		t.Fatal("expected agent.mark_offline audit event")
+	}
+}
+
+func TestApplyPlanValidatesWhenState(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		action map[string]any
+		want   int
+	}{
+		{"create not guardable", map[string]any{"operation": "CREATE", "when_state": "STOPPED"}, http.StatusBadRequest},
+		{"unknown state", map[string]any{"operation": "START", "vm_id": uuid.NewString(), "when_state": "PAUSED"}, http.StatusBadRequest},
+		{"missing vm", map[string]any{"operation": "STOP", "when_state": "RUNNING"}, http.StatusBadRequest},
+		{"valid guard", map[string]any{"operation": "START", "vm_id": uuid.NewString(), "when_state": "STOPPED"}, http.StatusOK},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+				"idempotency_key": fmt.Sprintf("when-state-%d", i),
+				"actions":         []map[string]any{tt.action},
+			}, nil)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestApplyPlanValidatesStopOptions(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		action map[string]any
+		want   int
+	}{
+		{"start cannot carry a method", map[string]any{"operation": "START", "vm_id": uuid.NewString(), "stop_method": "force"}, http.StatusBadRequest},
+		{"unknown method", map[string]any{"operation": "STOP", "vm_id": uuid.NewString(), "stop_method": "reboot"}, http.StatusBadRequest},
+		{"grace period too long", map[string]any{"operation": "STOP", "vm_id": uuid.NewString(), "grace_period": store.MaxStopGracePeriod + 1}, http.StatusBadRequest},
+		{"valid options", map[string]any{"operation": "STOP", "vm_id": uuid.NewString(), "stop_method": "acpi", "grace_period": 120}, http.StatusOK},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+				"idempotency_key": fmt.Sprintf("stop-options-%d", i),
+				"actions":         []map[string]any{tt.action},
+			}, nil)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	payload, _ := json.Marshal(store.ApplyPlanAction{Operation: "STOP", VMID: "vm-1", StopMethod: "signal", GracePeriod: 90})
+	entry, ok := toLeasedActionEntry(store.PlanAction{OperationID: "stop-1", OperationType: "STOP", VMID: "vm-1", PayloadJSON: payload})
+	if !ok || entry.Type != "MicroVMStop" {
+		t.Fatalf("expected a MicroVMStop entry, got %+v, %v", entry, ok)
+	}
+	var params map[string]any
+	if err := json.Unmarshal(entry.Params, &params); err != nil {
+		t.Fatalf("decode params: %v", err)
+	}
+	if params["method"] != "signal" || params["grace_period"] != float64(90) {
+		t.Fatalf("expected the stop options in the agent params, got %v", params)
+	}
+}
+
+func TestPlanActionPayloadLimitAndLargeFileDelivery(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	userData := strings.Repeat("#cloud-config\n", 1000)
+	plan := func(key string) map[string]any {
+		return map[string]any{
+			"idempotency_key": key,
+			"actions": []map[string]any{{
+				"operation_id": key, "operation": "CREATE", "vm_id": "vm-" + key, "name": key,
+				"files": []map[string]any{{"path": "/var/lib/cloud/user-data", "content": userData}},
+			}},
+		}
+	}
+
+	app.cfg.MaxActionPayload = 4 << 10
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, plan("too-big"), nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "at most 4096 allowed") {
+		t.Fatalf("expected an oversized action to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	app.cfg.MaxActionPayload = 0
+	if rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, plan("user-data"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1, "hostname": "edge-1"}, mtls)
+	var hb struct {
+		PendingPlans []struct {
+			Actions []struct {
+				Params struct {
+					Files []store.FileSpec `json:"files"`
+				} `json:"params"`
+			} `json:"actions"`
+		} `json:"pending_plans"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hb)
+	if len(hb.PendingPlans) != 1 || len(hb.PendingPlans[0].Actions) != 1 {
+		t.Fatalf("expected one leased action, got %s", rec.Body.String())
+	}
+	files := hb.PendingPlans[0].Actions[0].Params.Files
+	if len(files) != 1 || files[0].Content != userData || files[0].ContentRef != "" {
+		t.Fatalf("expected the agent to receive the full user-data, got %d files", len(files))
+	}
+}
+
+func TestLeasedPlansCarryAgentLabels(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	rec := doJSON(t, app.Handler(), "PUT", "/sites/"+siteID+"/agents/"+agentID+"/metadata", plainAPIKey, map[string]any{"rack": "r12", "gpu": true, "tags": []string{"ignored"}}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set metadata status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-labels",
+		"actions": []map[string]any{{
+			"operation_id": "create-1", "operation": "CREATE", "vm_id": "vm-labels-1", "name": "web-{label.rack}",
+			"kernel_path": "/images/{label.arch}/vmlinux", "rootfs_path": "/images/{label.arch}/rootfs.ext4",
+		}},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": 1, "hostname": "edge-1", "os": "linux", "arch": "arm64"}, mtls)
+	var hb struct {
+		PendingPlans []struct {
+			Labels  map[string]string `json:"labels"`
+			Actions []struct {
+				Params struct {
+					Name       string `json:"name"`
+					RootfsPath string `json:"rootfs_path"`
+				} `json:"params"`
+			} `json:"actions"`
+		} `json:"pending_plans"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hb)
+	if len(hb.PendingPlans) != 1 {
+		t.Fatalf("expected one leased plan, got %s", rec.Body.String())
+	}
+	want := map[string]string{"os": "linux", "arch": "arm64", "rack": "r12", "gpu": "true"}
+	if got := hb.PendingPlans[0].Labels; !reflect.DeepEqual(got, want) {
+		t.Fatalf("labels = %v, want %v", got, want)
+	}
+	// Placeholders travel as-is; the agent expands them with the labels.
+	if params := hb.PendingPlans[0].Actions[0].Params; params.Name != "web-{label.rack}" || params.RootfsPath != "/images/{label.arch}/rootfs.ext4" {
+		t.Fatalf("unexpected params %+v", params)
+	}
+}
+
+func TestAgentEnrollmentLinksBackToToken(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	tokens, err := repo.ListEnrollmentTokens(context.Background(), tenantID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("expected one token, got %d (%v)", len(tokens), err)
+	}
+	agentID := enroll(t, app, enrollToken, makeCSR(t))["agent_id"].(string)
+
+	rec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agents/"+agentID+"/enrollment", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get enrollment status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var enrollment store.AgentEnrollment
+	mustDecode(t, rec.Body.Bytes(), &enrollment)
+	if enrollment.TokenID != tokens[0].ID || enrollment.AgentID != agentID || enrollment.TokenConsumedAt == nil {
+		t.Fatalf("expected the agent to link back to token %s, got %+v", tokens[0].ID, enrollment)
+	}
+	if b := enrollment.Bootstrap; b == nil || b.Hostname != "edge-host-1" || b.AgentVersion != "0.1.0" || b.Arch != "amd64" {
+		t.Fatalf("unexpected bootstrap details %+v", enrollment.Bootstrap)
+	}
+
+	// The token list links forward to the same agent.
+	tokens, _ = repo.ListEnrollmentTokens(context.Background(), tenantID)
+	if tokens[0].ConsumedByAgentID == nil || *tokens[0].ConsumedByAgentID != agentID {
+		t.Fatalf("expected the token to be consumed by %s, got %v", agentID, tokens[0].ConsumedByAgentID)
+	}
+
+	// Another tenant's key cannot see the agent, nor can a wrong site.
+	otherTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: otherTenant, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: otherTenant, Name: "other", KeyHash: hashString("nk_other_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agents/"+agentID+"/enrollment", "nk_other_key", nil, nil)
+	if rec.Code != http.StatusNotFound && rec.Code != http.StatusForbidden {
+		t.Fatalf("expected another tenant to be refused, got %d", rec.Code)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/agents/"+agentID+"/enrollment", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown site to be 404, got %d", rec.Code)
+	}
+}
+
+func TestScopedEnrollmentTokenScopesTheAgent(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	h := app.Handler()
+
+	rec := doJSON(t, h, "POST", "/tenants/"+tenantID+"/enrollment-tokens", plainAPIKey, map[string]any{"site_id": siteID, "scope": map[string]any{"operations": []string{"DESTROY"}}}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown operation to be 400, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, h, "POST", "/tenants/"+tenantID+"/enrollment-tokens", plainAPIKey, map[string]any{"site_id": siteID, "scope": map[string]any{"operations": []string{"start", "stop"}, "max_vms": 4}}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("issue token status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var issued enrollmentTokenResponse
+	mustDecode(t, rec.Body.Bytes(), &issued)
+	if issued.Scope == nil || len(issued.Scope.Operations) != 2 || issued.Scope.Operations[0] != "START" || issued.Scope.MaxVMs != 4 {
+		t.Fatalf("expected the normalized scope in the response, got %+v", issued.Scope)
+	}
+
+	agentID := enroll(t, app, issued.Token, makeCSR(t))["agent_id"].(string)
+	agent, err := repo.GetAgentByID(context.Background(), agentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !agent.Scope.AllowsOperation("STOP") || agent.Scope.AllowsOperation("CREATE") || agent.Scope.MaxVMs != 4 {
+		t.Fatalf("expected the token scope on the agent, got %+v", agent.Scope)
+	}
+}
+
+func TestHeartbeatPushedMetricsAreStoredPerSite(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"agent_id":      agentID,
+		"heartbeat_seq": 1,
+		"metrics": map[string]any{
+			"vms_running":           3,
+			"heartbeats_sent_total": 42,
+			"process_open_fds":      17,
+		},
+	}, tlsState)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var hb map[string]any
+	mustDecode(t, rec.Body.Bytes(), &hb)
+	if hb["dropped_metrics"] != float64(1) {
+		t.Fatalf("expected the unknown metric to be dropped, got %v", hb["dropped_metrics"])
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agent-metrics", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("agent metrics status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Agents []store.AgentMetrics `json:"agents"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if len(resp.Agents) != 1 || resp.Agents[0].AgentID != agentID {
+		t.Fatalf("expected metrics for agent %s, got %+v", agentID, resp.Agents)
+	}
+	got := resp.Agents[0].Metrics
+	if len(got) != 2 || got["vms_running"] != 3 || got["heartbeats_sent_total"] != 42 {
+		t.Fatalf("unexpected stored metrics %v", got)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agent-metrics?format=prometheus", plainAPIKey, nil, nil)
+	want := fmt.Sprintf(`nkudo_agent_vms_running{site_id=%q,agent_id=%q} 3 `, siteID, agentID)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("expected %q in the exposition, got %d %s", want, rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+uuid.NewString()+"/agent-metrics", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown site to be 404, got %d", rec.Code)
+	}
+}
+
+func TestConnectivityHistoryRecordsOnlyTransitions(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	// The repeated heartbeats carry no transition.
+	for seq, connected := range []bool{true, true, false, false, true} {
+		status := map[string]any{"connected": connected, "state": "connected"}
+		if !connected {
+			status = map[string]any{"connected": false, "state": "disconnected", "reason": "management unreachable"}
+		}
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+			"agent_id":       agentID,
+			"heartbeat_seq":  seq + 1,
+			"netbird_status": status,
+		}, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+
+	path := "/sites/" + siteID + "/agents/" + agentID + "/connectivity-history"
+	rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("connectivity history status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Transitions []store.ConnectivityTransition `json:"transitions"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if len(resp.Transitions) != 3 {
+		t.Fatalf("expected 3 transitions, got %+v", resp.Transitions)
+	}
+	for i, want := range []bool{true, false, true} {
+		if got := resp.Transitions[i]; got.Connected != want || got.AgentID != agentID {
+			t.Fatalf("transition %d: got %+v, want connected=%v", i, got, want)
+		}
+	}
+	if resp.Transitions[1].Reason != "management unreachable" {
+		t.Fatalf("expected the disconnect reason to be kept, got %+v", resp.Transitions[1])
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", path+"?to="+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), plainAPIKey, nil, nil)
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || len(resp.Transitions) != 0 {
+		t.Fatalf("expected no transitions before to, got %d %+v", rec.Code, resp.Transitions)
+	}
+	rec = doJSON(t, app.Handler(), "GET", path+"?from=yesterday", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a malformed from to be 400, got %d", rec.Code)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/agents/"+uuid.NewString()+"/connectivity-history", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown agent to be 404, got %d", rec.Code)
+	}
+}
+
+func TestHostMaintenanceStopsPlanLeasing(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	agent, err := repo.GetAgentByID(context.Background(), agentID)
+	if err != nil {
+		t.Fatalf("get agent: %v", err)
+	}
+	mtls := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	maintenancePath := "/sites/" + siteID + "/hosts/" + agent.HostID + "/maintenance"
+	rec := doJSON(t, app.Handler(), "POST", maintenancePath, plainAPIKey, map[string]any{"enabled": true}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enable maintenance status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-maintenance",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-maint-1", "name": "vm-maint-1", "vcpu_count": 1, "memory_mib": 256},
+		},
+	}, nil)
+	if applyRec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", applyRec.Code, applyRec.Body.String())
+	}
+
+	type heartbeatResponse struct {
+		Maintenance  bool             `json:"maintenance"`
+		PendingPlans []map[string]any `json:"pending_plans"`
+	}
+	heartbeat := func(seq int) heartbeatResponse {
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "heartbeat_seq": seq, "hostname": "edge-maint"}, mtls)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp heartbeatResponse
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	hb := heartbeat(1)
+	if !hb.Maintenance || len(hb.PendingPlans) != 0 {
+		t.Fatalf("expected maintenance and no leased plans, got %+v", hb)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/v1/plans/next", "", nil, mtls)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("next plans status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var next struct {
+		Plans []map[string]any `json:"plans"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &next)
+	if len(next.Plans) != 0 {
+		t.Fatalf("expected no plans leased to host in maintenance, got %d", len(next.Plans))
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/hosts", plainAPIKey, nil, nil)
+	var hostsResp struct {
+		Hosts []store.Host `json:"hosts"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hostsResp)
+	if len(hostsResp.Hosts) != 1 || !hostsResp.Hosts[0].Maintenance {
+		t.Fatalf("expected host listed in maintenance, got %+v", hostsResp.Hosts)
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", maintenancePath, plainAPIKey, map[string]any{"enabled": false}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("disable maintenance status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	hb = heartbeat(2)
+	if hb.Maintenance || len(hb.PendingPlans) != 1 {
+		t.Fatalf("expected plan leased after maintenance, got %+v", hb)
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/hosts/"+uuid.NewString()+"/maintenance", plainAPIKey, map[string]any{"enabled": true}, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown host, got %d", rec.Code)
+	}
+}
+
+func TestLeasedExecuteActionCarriesEnv(t *testing.T) {
+	payload, _ := json.Marshal(map[string]any{
+		"command": "deploy.sh",
+		"env":     map[string]string{"APP_ENV": "staging"},
+	})
+	entry, ok := toLeasedActionEntry(store.PlanAction{OperationID: "exec-1", OperationType: "EXECUTE", PayloadJSON: payload})
+	if !ok {
+		t.Fatalf("expected EXECUTE action to be leased")
+	}
+	var params struct {
+		Command string            `json:"command"`
+		Env     map[string]string `json:"env"`
+	}
+	mustDecode(t, entry.Params, &params)
+	if entry.Type != "CommandExecute" || params.Env["APP_ENV"] != "staging" {
+		t.Fatalf("env not threaded to agent params: type=%s params=%s", entry.Type, entry.Params)
+	}
+}
+
+func TestHeartbeatPlanDeliveryAndResultPersistence(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	_, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	csrPEM := makeCSR(t)
+	enrollResp := enroll(t, app, enrollToken, csrPEM)
+	agentID := enrollResp["agent_id"].(string)
+	certPEM := enrollResp["client_certificate_pem"].(string)
+	cert := parseCert(t, []byte(certPEM))
+
+	planPayload := map[string]any{
+		"idempotency_key": "plan-run-once",
+		"actions": []map[string]any{
+			{
+				"operation_id": "create-vm-1",
+				"operation":    "CREATE",
+				"vm_id":        "vm-runonce-1",
+				"name":         "vm-runonce-1",
+				"vcpu_count":   1,
+				"memory_mib":   256,
+			},
+			{
+				"operation_id": "start-vm-1",
+				"operation":    "START",
+				"vm_id":        "vm-runonce-1",
+			},
+		},
+	}
+	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
+	if applyRec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", applyRec.Code, applyRec.Body.String())
+	}
+	var applyResp struct {
+		PlanID     string            `json:"plan_id"`
+		Executions []store.Execution `json:"executions"`
+	}
+	mustDecode(t, applyRec.Body.Bytes(), &applyResp)
+	if len(applyResp.Executions) != 2 {
+		t.Fatalf("expected 2 executions, got %d", len(applyResp.Executions))
+	}
+
+	hbPayload := map[string]any{
+		"agent_id":        agentID,
+		"heartbeat_seq":   1,
+		"tenant_id":       tenantID,
+		"site_id":         siteID,
+		"host_id":         "host-runonce",
+		"sent_at":         time.Now().UTC().Format(time.RFC3339Nano),
+		"extra_heartbeat": "ignored",
+		"host_facts": map[string]any{
+			"cpu_cores":          2,
+			"memory_total_bytes": int64(2 * 1024 * 1024 * 1024),
+			"disks": []map[string]any{
+				{"mountpoint": "/", "total_bytes": int64(50 * 1024 * 1024 * 1024)},
+			},
+			"os":     "linux",
+			"arch":   "amd64",
+			"kernel": "6.8.0",
+			"kvm": map[string]any{
+				"present":  true,
+				"readable": true,
+				"writable": true,
+			},
+		},
+		"netbird_status": map[string]any{"connected": true},
+	}
+	hbRec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", hbPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if hbRec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", hbRec.Code, hbRec.Body.String())
+	}
+	var hbResp struct {
+		PendingPlans []struct {
+			PlanID      string `json:"plan_id"`
+			ExecutionID string `json:"execution_id"`
+			Actions     []struct {
+				ActionID string `json:"action_id"`
+				Type     string `json:"type"`
+			} `json:"actions"`
+			ResultTTL int64 `json:"result_ttl"`
+		} `json:"pending_plans"`
+	}
+	mustDecode(t, hbRec.Body.Bytes(), &hbResp)
+	if len(hbResp.PendingPlans) != 1 {
+		t.Fatalf("expected 1 pending plan, got %d", len(hbResp.PendingPlans))
+	}
+	if hbResp.PendingPlans[0].PlanID != applyResp.PlanID {
+		t.Fatalf("expected pending plan id %s, got %s", applyResp.PlanID, hbResp.PendingPlans[0].PlanID)
+	}
+	if len(hbResp.PendingPlans[0].Actions) != 2 {
+		t.Fatalf("expected 2 leased actions, got %d", len(hbResp.PendingPlans[0].Actions))
+	}
+	if hbResp.PendingPlans[0].ResultTTL <= 0 {
+		t.Fatalf("expected result_ttl hint in leased plan, got %d", hbResp.PendingPlans[0].ResultTTL)
+	}
+
+	logRec := doJSON(t, app.Handler(), "POST", "/v1/logs", "", map[string]any{
+		"execution_id": applyResp.Executions[0].ID,
+		"sequence":     1,
+		"level":        "INFO",
+		"message":      "run once started",
+		"emitted_at":   time.Now().UTC().Format(time.RFC3339Nano),
+		"tenant_id":    tenantID,
+		"action_id":    "create-vm-1",
+	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if logRec.Code != http.StatusAccepted {
+		t.Fatalf("log frame status=%d body=%s", logRec.Code, logRec.Body.String())
+	}
+
+	results := make([]map[string]any, 0, len(hbResp.PendingPlans[0].Actions))
+	for _, action := range hbResp.PendingPlans[0].Actions {
+		results = append(results, map[string]any{
+			"action_id":   action.ActionID,
+			"ok":          true,
+			"message":     "ok",
+			"finished_at": time.Now().UTC().Format(time.RFC3339Nano),
+		})
+	}
+	resultRec := doJSON(t, app.Handler(), "POST", "/v1/executions/result", "", map[string]any{
+		"plan_id":      hbResp.PendingPlans[0].PlanID,
+		"execution_id": hbResp.PendingPlans[0].ExecutionID,
+		"results":      results,
+	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if resultRec.Code != http.StatusAccepted {
+		t.Fatalf("report result status=%d body=%s", resultRec.Code, resultRec.Body.String())
+	}
+
+	dedupRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
+	if dedupRec.Code != http.StatusOK {
+		t.Fatalf("dedupe plan status=%d body=%s", dedupRec.Code, dedupRec.Body.String())
+	}
+	var dedupResp struct {
+		PlanStatus string `json:"plan_status"`
+	}
+	mustDecode(t, dedupRec.Body.Bytes(), &dedupResp)
+	if dedupResp.PlanStatus != "SUCCEEDED" {
+		t.Fatalf("expected final plan status SUCCEEDED, got %s", dedupResp.PlanStatus)
+	}
+
+	vmsRec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/vms", plainAPIKey, nil, nil)
+	if vmsRec.Code != http.StatusOK {
+		t.Fatalf("list vms status=%d body=%s", vmsRec.Code, vmsRec.Body.String())
+	}
+	var vmsResp struct {
+		VMs []store.MicroVM `json:"vms"`
+	}
+	mustDecode(t, vmsRec.Body.Bytes(), &vmsResp)
+	if len(vmsResp.VMs) == 0 {
+		t.Fatalf("expected at least one vm")
+	}
+
+	logsRec := doJSON(t, app.Handler(), "GET", "/executions/"+applyResp.Executions[0].ID+"/logs", plainAPIKey, nil, nil)
+	if logsRec.Code != http.StatusOK {
+		t.Fatalf("list logs status=%d body=%s", logsRec.Code, logsRec.Body.String())
+	}
+	var logsResp struct {
+		Logs []store.ExecutionLog `json:"logs"`
+	}
+	mustDecode(t, logsRec.Body.Bytes(), &logsResp)
+	if len(logsResp.Logs) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(logsResp.Logs))
+	}
+}
+
+func newTestAppWithEnrollmentToken(t *testing.T) (*App, *store.MemoryRepo, string, string, string) {
+	t.Helper()
+	repo := store.NewMemoryRepo()
+	cfg := LoadConfig()
+	cfg.AdminKey = "admin"
+	app, err := NewApp(cfg, repo)
+	if err != nil {
+		t.Fatalf("new app: %v", err)
+	}
+	tenantID := uuid.NewString()
+	siteID := uuid.NewString()
+	_, err = repo.CreateTenant(context.Background(), store.Tenant{ID: tenantID, Slug: "acme", Name: "Acme", PrimaryRegion: "eu-central-1", RetentionDays: 30})
+	if err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	_, err = repo.CreateSite(context.Background(), store.Site{ID: siteID, TenantID: tenantID, Name: "site-1"})
+	if err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	enrollToken := "enroll-token-1"
+	_, err = repo.IssueEnrollmentToken(context.Background(), store.EnrollmentToken{
+		ID:        uuid.NewString(),
+		TenantID:  tenantID,
+		SiteID:    siteID,
+		TokenHash: hashString(enrollToken),
+		ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	return app, repo, tenantID, siteID, enrollToken
+}
+
+func doJSON(t *testing.T, h http.Handler, method, path, apiKey string, body any, tlsState *tls.ConnectionState) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf []byte
+	if body != nil {
+		var err error
+		buf, err = json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	req.TLS = tlsState
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func enroll(t *testing.T, app *App, enrollToken string, csrPEM []byte) map[string]any {
+	t.Helper()
+	rec := doJSON(t, app.Handler(), "POST", "/enroll", "", map[string]any{
+		"enrollment_token": enrollToken,
+		"hostname":         "edge-host-1",
+		"agent_version":    "0.1.0",
+		"os":               "linux",
+		"arch":             "amd64",
+		"csr_pem":          string(csrPEM),
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enroll status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp map[string]any
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	return resp
+}
+
+func mustDecode(t *testing.T, b []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatalf("decode json: %v body=%s", err, string(b))
+	}
+}
+
+func makeCSR(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tpl := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName: "pending-agent",
+		},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, key)
+	if err != nil {
+		t.Fatalf("create csr: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("failed to decode cert pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	if cert.SerialNumber.Cmp(big.NewInt(0)) <= 0 {
+		t.Fatalf("invalid serial")
+	}
+	return cert
+}
+
+func TestTenantAuditEventsAreTenantScoped(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "compliance", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	otherTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenant, Slug: "other-" + otherTenant[:8], Name: "Other", PrimaryRegion: "eu-west-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := repo.WriteAudit(ctx, tenantID, siteID, "USER", "api-key", "vm.create", "vm", fmt.Sprintf("vm-%d", i), "", "", nil); err != nil {
+			t.Fatalf("write audit: %v", err)
+		}
+		if err := repo.WriteAudit(ctx, otherTenant, "", "USER", "api-key", "secret.read", "secret", fmt.Sprintf("other-%d", i), "", "", nil); err != nil {
+			t.Fatalf("write audit: %v", err)
+		}
+	}
+
+	rec := doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/audit-events", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list audit events status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Events []store.AuditEvent `json:"events"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if len(resp.Events) < 3 {
+		t.Fatalf("expected at least 3 events, got %d", len(resp.Events))
+	}
+	for _, event := range resp.Events {
+		if event.TenantID != tenantID {
+			t.Fatalf("cross-tenant event returned: %+v", event)
+		}
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/audit-events?limit=2", plainAPIKey, nil, nil)
+	mustDecode(t, rec.Body.Bytes(), &resp)
+	if len(resp.Events) != 2 {
+		t.Fatalf("expected limit to apply, got %d events", len(resp.Events))
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+otherTenant+"/audit-events", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another tenant's audit events, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/audit-events", "", nil, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without api key, got %d", rec.Code)
+	}
+}
+
+func TestPlanMetadataRoundTrip(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	metadata := map[string]any{"ticket": "OPS-1234", "author": "alice", "reason": "capacity bump"}
+	planAction := []map[string]any{{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-meta-1", "name": "vm-meta-1"}}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-metadata",
+		"metadata":        metadata,
+		"actions":         planAction,
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var applyResp struct {
+		PlanID   string         `json:"plan_id"`
+		Metadata map[string]any `json:"metadata"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &applyResp)
+	if !reflect.DeepEqual(applyResp.Metadata, metadata) {
+		t.Fatalf("apply metadata = %v, want %v", applyResp.Metadata, metadata)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/plans/"+applyResp.PlanID, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var getResp struct {
+		Metadata map[string]any `json:"metadata"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &getResp)
+	if !reflect.DeepEqual(getResp.Metadata, metadata) {
+		t.Fatalf("read metadata = %v, want %v", getResp.Metadata, metadata)
+	}
+
+	events, err := repo.ListAuditEvents(context.Background(), tenantID, 100)
+	if err != nil {
+		t.Fatalf("list audit events: %v", err)
+	}
+	var found bool
+	for _, event := range events {
+		if event.Action != "plan.apply" || event.ResourceID != applyResp.PlanID {
+			continue
+		}
+		var payload struct {
+			Metadata map[string]any `json:"metadata"`
+		}
+		if err := json.Unmarshal(event.MetadataJSON, &payload); err != nil {
+			t.Fatalf("decode audit metadata: %v", err)
+		}
+		found = reflect.DeepEqual(payload.Metadata, metadata)
+	}
+	if !found {
+		t.Fatalf("expected plan.apply audit event to carry plan metadata")
+	}
+
+	for name, bad := range map[string]any{
+		"not an object": []string{"a", "b"},
+		"too large":     map[string]any{"blob": strings.Repeat("x", store.MaxPlanMetadataBytes)},
+	} {
+		rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": "plan-bad-metadata",
+			"metadata":        bad,
+			"actions":         planAction,
+		}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestMigrateVMEndpoint(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	hostIDs := make([]string, 0, 2)
+	for i, hostname := range []string{"edge-a", "edge-b"} {
+		agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, hostname)
+		if err != nil {
+			t.Fatalf("create agent: %v", err)
+		}
+		hb := store.Heartbeat{AgentID: agent.ID, Hostname: hostname, CPUCoresTotal: 2, MemoryBytesTotal: 4 << 30}
+		if i == 0 {
+			hb.MicroVMs = []store.MicroVMHeartbeat{{ID: "vm-1", Name: "vm-1", State: "RUNNING", VCPUCount: 2, MemoryMiB: 1024}}
+		}
+		if err := repo.IngestHeartbeat(ctx, hb); err != nil {
+			t.Fatalf("heartbeat: %v", err)
+		}
+		hostIDs = append(hostIDs, agent.HostID)
+	}
+	migratePath := "/sites/" + siteID + "/vms/vm-1/migrate"
+
+	for name, tc := range map[string]struct {
+		body any
+		want int
+	}{
+		"missing target": {map[string]any{}, http.StatusBadRequest},
+		"same host":      {map[string]any{"target_host_id": hostIDs[0]}, http.StatusBadRequest},
+		"unknown host":   {map[string]any{"target_host_id": uuid.NewString()}, http.StatusNotFound},
+	} {
+		if rec := doJSON(t, app.Handler(), "POST", migratePath, plainAPIKey, tc.body, nil); rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d body=%s", name, tc.want, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", migratePath, plainAPIKey, map[string]any{"target_host_id": hostIDs[1]}, nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("migrate status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var mig store.VMMigration
+	mustDecode(t, rec.Body.Bytes(), &mig)
+	if mig.State != store.MigrationStateMigrating || mig.Step != store.MigrationStepSnapshot || mig.SourceHostID != hostIDs[0] {
+		t.Fatalf("unexpected migration: %+v", mig)
+	}
+	if rec := doJSON(t, app.Handler(), "POST", migratePath, plainAPIKey, map[string]any{"target_host_id": hostIDs[1]}, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a second migration, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/migrations/"+mig.ID, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get migration status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	plan, err := repo.GetPlan(ctx, tenantID, mig.PlanID)
+	if err != nil {
+		t.Fatalf("get step plan: %v", err)
+	}
+	if plan.HostID != hostIDs[0] {
+		t.Fatalf("snapshot step should be pinned to the source host, got %q", plan.HostID)
+	}
+	var actions []store.ApplyPlanAction
+	mustDecode(t, plan.OperationsJSON, &actions)
+	payload, _ := json.Marshal(actions[0])
+	entry, ok := toLeasedActionEntry(store.PlanAction{OperationID: actions[0].OperationID, OperationType: "MIGRATE", VMID: "vm-1", PayloadJSON: payload})
+	if !ok || entry.Type != "MicroVMMigrate" {
+		t.Fatalf("expected a MicroVMMigrate action, got %+v ok=%v", entry, ok)
+	}
+	var params struct {
+		Step         string `json:"step"`
+		SnapshotName string `json:"snapshot_name"`
+	}
+	mustDecode(t, entry.Params, &params)
+	if params.Step != store.MigrationStepSnapshot || params.SnapshotName != mig.SnapshotName() {
+		t.Fatalf("unexpected migrate params: %s", entry.Params)
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "sneaky-migrate",
+		"actions":         []map[string]any{{"operation": "MIGRATE", "vm_id": "vm-1"}},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a MIGRATE plan action, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEnrollSiteRateLimit(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	app.siteEnrollLimiter = NewKeyedRateLimiter(RateLimit{Rate: 1.0 / 3600, Burst: 2})
+	otherSiteID := uuid.NewString()
+	if _, err := repo.CreateSite(context.Background(), store.Site{ID: otherSiteID, TenantID: tenantID, Name: "site-2"}); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	enrollHost := func(siteID, hostname string) int {
+		token := "token-" + hostname
+		if _, err := repo.IssueEnrollmentToken(context.Background(), store.EnrollmentToken{
+			ID:        uuid.NewString(),
+			TenantID:  tenantID,
+			SiteID:    siteID,
+			TokenHash: hashString(token),
+			ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
+		}); err != nil {
+			t.Fatalf("issue token: %v", err)
+		}
+		rec := doJSON(t, app.Handler(), "POST", "/enroll", "", map[string]any{
+			"enrollment_token": token,
+			"hostname":         hostname,
+			"csr_pem":          string(makeCSR(t)),
+		}, nil)
+		return rec.Code
+	}
+
+	for _, hostname := range []string{"edge-1", "edge-2"} {
+		if code := enrollHost(siteID, hostname); code != http.StatusOK {
+			t.Fatalf("enroll %s under the limit: status=%d", hostname, code)
+		}
+	}
+	if code := enrollHost(siteID, "edge-3"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the site limit, got %d", code)
+	}
+	if code := enrollHost(otherSiteID, "edge-4"); code != http.StatusOK {
+		t.Fatalf("other sites should not share the limit, got %d", code)
+	}
+
+	// The throttled enrollment did not spend its token.
+	if _, err := repo.EnrollmentTokenSite(context.Background(), hashString("token-edge-3"), time.Now().UTC()); err != nil {
+		t.Fatalf("expected the throttled token to stay usable, got %v", err)
+	}
+	app.siteEnrollLimiter = NewKeyedRateLimiter(RateLimit{Rate: 1.0 / 3600, Burst: 2})
+	rec := doJSON(t, app.Handler(), "POST", "/enroll", "", map[string]any{
+		"enrollment_token": "token-edge-3",
+		"hostname":         "edge-3",
+		"csr_pem":          string(makeCSR(t)),
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the throttled token to enroll once allowed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListVMNetworksEndpoint(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+	if err := repo.IngestHeartbeat(ctx, store.Heartbeat{
+		AgentID:  agent.ID,
+		Hostname: "edge-a",
+		MicroVMs: []store.MicroVMHeartbeat{{ID: "vm-1", Name: "vm-1", State: "RUNNING", VCPUCount: 1, MemoryMiB: 512}},
+	}); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "GET", "/vms/vm-1/networks", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"networks":[]`) {
+		t.Fatalf("expected an empty list, got status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	network, err := repo.CreateVXLANNetwork(ctx, tenantID, siteID, store.VXLANNetwork{ID: uuid.NewString(), Name: "backend", VNI: 4100, CIDR: "10.20.0.0/24", MTU: 1450})
+	if err != nil {
+		t.Fatalf("create network: %v", err)
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/vms/vm-1/networks", plainAPIKey, map[string]any{"network_id": network.ID, "ip_address": "10.20.0.5"}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("attach status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/vms/vm-1/networks", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Networks []store.VMNetworkAttachmentWithNetwork `json:"networks"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &out)
+	if len(out.Networks) != 1 {
+		t.Fatalf("expected one attachment, got %+v", out.Networks)
+	}
+	got := out.Networks[0]
+	if got.NetworkID != network.ID || got.NetworkName != "backend" || got.VNI != 4100 || got.CIDR != "10.20.0.0/24" || got.IPAddress != "10.20.0.5" {
+		t.Fatalf("unexpected attachment: %+v", got)
+	}
+
+	otherTenantID := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenantID, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	otherAPIKey := "nk_other_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: otherTenantID, Name: "ops", KeyHash: hashString(otherAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", "/vms/vm-1/networks", otherAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another tenant's VM, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := doJSON(t, app.Handler(), "GET", "/vms/vm-missing/networks", plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown VM, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListVXLANTunnels(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	network, err := repo.CreateVXLANNetwork(ctx, tenantID, siteID, store.VXLANNetwork{ID: uuid.NewString(), Name: "backend", VNI: 4200, CIDR: "10.30.0.0/24", MTU: 1450})
+	if err != nil {
+		t.Fatalf("create network: %v", err)
+	}
+	for host, status := range map[string]string{"host-a": "active", "host-b": "pending", "host-c": "failed"} {
+		tunnel, err := repo.CreateVXLANTunnel(ctx, store.VXLANTunnel{ID: uuid.NewString(), NetworkID: network.ID, HostID: host, LocalIP: "192.0.2.1", VTEPName: "vxlan4200"})
+		if err != nil {
+			t.Fatalf("create tunnel: %v", err)
+		}
+		if err := repo.UpdateVXLANTunnelStatus(ctx, tunnel.ID, status); err != nil {
+			t.Fatalf("update tunnel: %v", err)
+		}
+	}
+
+	path := "/vxlan-networks/" + network.ID + "/tunnels"
+	rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list tunnels status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Tunnels []struct {
+			HostID string `json:"host_id"`
+			Status string `json:"status"`
+			State  string `json:"state"`
+		} `json:"tunnels"`
+		Counts map[string]int `json:"counts"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &out)
+	states := map[string]string{}
+	for _, tun := range out.Tunnels {
+		states[tun.HostID] = tun.State
+	}
+	if len(out.Tunnels) != 3 || states["host-a"] != "up" || states["host-b"] != "pending" || states["host-c"] != "error" {
+		t.Fatalf("unexpected tunnels: %+v", out.Tunnels)
+	}
+	if out.Counts["up"] != 1 || out.Counts["pending"] != 1 || out.Counts["error"] != 1 {
+		t.Fatalf("unexpected counts: %+v", out.Counts)
+	}
+
+	otherTenantID := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenantID, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	otherAPIKey := "nk_other_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: otherTenantID, Name: "ops", KeyHash: hashString(otherAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", path, otherAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another tenant's network, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateVXLANNetworkIsIdempotent(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	path := "/sites/" + siteID + "/vxlan-networks"
+	body := map[string]any{"name": "backend", "vni": 4300, "cidr": "10.40.0.0/24"}
+
+	rec := doJSON(t, app.Handler(), "POST", path, plainAPIKey, body, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var created store.VXLANNetwork
+	mustDecode(t, rec.Body.Bytes(), &created)
+
+	rec = doJSON(t, app.Handler(), "POST", path, plainAPIKey, body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected identical recreate to return 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var again store.VXLANNetwork
+	mustDecode(t, rec.Body.Bytes(), &again)
+	if again.ID != created.ID {
+		t.Fatalf("expected the existing network %s, got %s", created.ID, again.ID)
+	}
+
+	for _, conflicting := range []map[string]any{
+		{"name": "backend", "vni": 4300, "cidr": "10.41.0.0/24"},
+		{"name": "backend", "vni": 4301, "cidr": "10.40.0.0/24"},
+		{"name": "frontend", "vni": 4300, "cidr": "10.40.0.0/24"},
+	} {
+		if rec := doJSON(t, app.Handler(), "POST", path, plainAPIKey, conflicting, nil); rec.Code != http.StatusConflict {
+			t.Fatalf("expected 409 for %v, got %d body=%s", conflicting, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSequentialPlanIsLeasedInOrder(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-sequential",
+		"sequential":      true,
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-seq-1", "name": "vm-seq-1"},
+			{"operation_id": "start-vm-1", "operation": "START", "vm_id": "vm-seq-1"},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var applyResp struct {
+		PlanID     string `json:"plan_id"`
+		Sequential bool   `json:"sequential"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &applyResp)
+	if !applyResp.Sequential {
+		t.Fatalf("expected a sequential plan, body=%s", rec.Body.String())
+	}
+
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	payload := leasedPlansToAgentPayload(leased, time.Hour, nil)
+	if len(payload) != 1 || !payload[0].Sequential {
+		t.Fatalf("expected one sequential plan for the agent, got %+v", payload)
+	}
+	if got := payload[0].Actions; len(got) != 2 || got[0].ActionID != "create-vm-1" || got[1].ActionID != "start-vm-1" {
+		t.Fatalf("actions out of order: %+v", got)
+	}
+}
+
+func TestCreatePlanWithFiles(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	files := []map[string]any{{"path": "/etc/app.conf", "content": "port=8080\n", "permissions": "0640", "owner": "root:app"}}
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-files",
+		"actions": []map[string]any{
+			{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-files-1", "name": "vm-files-1", "files": files},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	payload := leasedPlansToAgentPayload(leased, time.Hour, nil)
+	if len(payload) != 1 || len(payload[0].Actions) != 1 {
+		t.Fatalf("expected one leased create, got %+v", payload)
+	}
+	var params struct {
+		Files []store.FileSpec `json:"files"`
+	}
+	if err := json.Unmarshal(payload[0].Actions[0].Params, &params); err != nil {
+		t.Fatalf("decode params: %v", err)
+	}
+	want := store.FileSpec{Path: "/etc/app.conf", Content: "port=8080\n", Permissions: "0640", Owner: "root:app"}
+	if len(params.Files) != 1 || params.Files[0] != want {
+		t.Fatalf("expected files in create params, got %+v", params.Files)
+	}
+
+	for name, action := range map[string]map[string]any{
+		"relative path":  {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "files": []map[string]any{{"path": "etc/x", "content": "x"}}},
+		"setuid":         {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "files": []map[string]any{{"path": "/x", "content": "x", "permissions": "4755"}}},
+		"too large":      {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "files": []map[string]any{{"path": "/x", "content": strings.Repeat("x", store.MaxVMFilesBytes+1)}}},
+		"not a create":   {"operation_id": "s", "operation": "START", "vm_id": "vm-2", "files": []map[string]any{{"path": "/x", "content": "x"}}},
+		"duplicate path": {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "files": []map[string]any{{"path": "/x", "content": "a"}, {"path": "/x", "content": "b"}}},
+	} {
+		rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": "plan-bad-files-" + name,
+			"actions":         []map[string]any{action},
+		}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestApplyPlanCarriesBootOrderToTheAgent(t *testing.T) {
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-boot",
+		"actions": []map[string]any{
+			{"operation_id": "start-app", "operation": "START", "vm_id": "vm-app", "boot_order": 2, "boot_delay_seconds": 15},
+			{"operation_id": "start-db", "operation": "START", "vm_id": "vm-db", "boot_order": 1},
+		},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	payload := leasedPlansToAgentPayload(leased, time.Hour, nil)
+	if len(payload) != 1 || len(payload[0].Actions) != 2 {
+		t.Fatalf("expected two leased starts, got %+v", payload)
+	}
+	for _, action := range payload[0].Actions {
+		if action.ActionID == "start-app" && (action.BootOrder != 2 || action.BootDelay != 15) {
+			t.Fatalf("expected the app start to carry its boot order and delay, got %+v", action)
+		}
+		if action.ActionID == "start-db" && action.BootOrder != 1 {
+			t.Fatalf("expected the db start to carry its boot order, got %+v", action)
+		}
+	}
+
+	rec = doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-boot-inconsistent",
+		"actions": []map[string]any{
+			{"operation_id": "start-db", "operation": "START", "vm_id": "vm-db", "boot_order": 2},
+			{"operation_id": "start-app", "operation": "START", "vm_id": "vm-app", "boot_order": 1, "depends_on": []string{"start-db"}},
+		},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a boot order against depends_on to be 400, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreatePlanDeviceLimits(t *testing.T) {
+	t.Setenv("MAX_DISKS_PER_VM", "1")
+	t.Setenv("MAX_NICS_PER_VM", "2")
+	app, repo, tenantID, siteID, _ := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agent, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: siteID, HostID: uuid.NewString()}, "edge-a")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-devices",
+		"actions": []map[string]any{{
+			"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-devices-1", "name": "vm-devices-1",
+			"disks":    []map[string]any{{"size_mib": 1024}},
+			"networks": []map[string]any{{"bridge": "br-data"}, {"mac": "02:00:00:00:00:09", "ip_address": "10.0.0.9/24"}},
+		}},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	payload := leasedPlansToAgentPayload(leased, time.Hour, nil)
+	if len(payload) != 1 || len(payload[0].Actions) != 1 {
+		t.Fatalf("expected one leased create, got %+v", payload)
+	}
+	var params struct {
+		Disks    []store.VMDiskSpec `json:"disks"`
+		Networks []struct {
+			ID       string `json:"id"`
+			Bridge   string `json:"bridge"`
+			MacAddr  string `json:"mac"`
+			IPConfig struct {
+				Address string `json:"address"`
+			} `json:"ip_config"`
+		} `json:"networks"`
+	}
+	if err := json.Unmarshal(payload[0].Actions[0].Params, &params); err != nil {
+		t.Fatalf("decode params: %v", err)
+	}
+	if len(params.Disks) != 1 || params.Disks[0].SizeMiB != 1024 {
+		t.Fatalf("expected disks in create params, got %+v", params.Disks)
+	}
+	if len(params.Networks) != 2 || params.Networks[0].ID != "eth0" || params.Networks[0].Bridge != "br-data" ||
+		params.Networks[1].MacAddr != "02:00:00:00:00:09" || params.Networks[1].IPConfig.Address != "10.0.0.9/24" {
+		t.Fatalf("expected networks in create params, got %+v", params.Networks)
+	}
+
+	for name, action := range map[string]map[string]any{
+		"too many disks": {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "disks": []map[string]any{{"size_mib": 1}, {"size_mib": 1}}},
+		"too many nics":  {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "networks": []map[string]any{{}, {}, {}}},
+		"zero size disk": {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "disks": []map[string]any{{"size_mib": 0}}},
+		"bad mac":        {"operation_id": "c", "operation": "CREATE", "vm_id": "vm-2", "networks": []map[string]any{{"mac": "nope"}}},
+		"not a create":   {"operation_id": "s", "operation": "START", "vm_id": "vm-2", "disks": []map[string]any{{"size_mib": 1}}},
+	} {
+		rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": "plan-bad-devices-" + name,
+			"actions":         []map[string]any{action},
+		}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d body=%s", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestExecutionConsoleLogUpload(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+
+	rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "plan-console",
+		"actions":         []map[string]any{{"operation_id": "create-vm-1", "operation": "CREATE", "vm_id": "vm-console-1", "name": "vm-console-1"}},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var applyResp struct {
+		PlanID     string            `json:"plan_id"`
+		Executions []store.Execution `json:"executions"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &applyResp)
+	consolePath := "/executions/" + applyResp.Executions[0].ID + "/console"
+
+	if rec := doJSON(t, app.Handler(), "GET", consolePath, plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before upload, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	upload := map[string]any{
+		"execution_id": applyResp.PlanID,
+		"action_id":    "create-vm-1",
+		"vm_id":        "vm-console-1",
+		"content":      strings.Repeat("x", store.MaxConsoleLogBytes) + "kernel panic\n",
+	}
+	if rec := doJSON(t, app.Handler(), "POST", "/v1/executions/console", "", upload, agentTLS); rec.Code != http.StatusAccepted {
+		t.Fatalf("upload status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	upload["action_id"] = "missing-action"
+	if rec := doJSON(t, app.Handler(), "POST", "/v1/executions/console", "", upload, agentTLS); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown action, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", consolePath, plainAPIKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get console status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var console store.ExecutionConsoleLog
+	mustDecode(t, rec.Body.Bytes(), &console)
+	if console.VMID != "vm-console-1" || !console.Truncated || len(console.Content) != store.MaxConsoleLogBytes || !strings.HasSuffix(console.Content, "kernel panic\n") {
+		t.Fatalf("unexpected console log: vm=%s truncated=%v len=%d", console.VMID, console.Truncated, len(console.Content))
+	}
+
+	otherTenantID := uuid.NewString()
+	if _, err := repo.CreateTenant(context.Background(), store.Tenant{ID: otherTenantID, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	otherAPIKey := "nk_other_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: otherTenantID, Name: "ops", KeyHash: hashString(otherAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", consolePath, otherAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another tenant, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateTenantWithQuotaTemplate(t *testing.T) {
+	app, repo, _, _, _ := newTestAppWithEnrollmentToken(t)
+	h := app.Handler()
+
+	admin := func(method, path string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("X-Admin-Key", "admin")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	small := store.QuotaLimits{MaxSites: 1, MaxAgentsPerSite: 2, MaxVMsPerAgent: 3, MaxConcurrentPlans: 4, MaxAPIKeys: 5}
+	rec := admin("PUT", "/admin/quota-templates/small", small)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("put template status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = admin("PUT", "/admin/quota-templates/Not_Valid", small)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid template name, got %d", rec.Code)
+	}
+
+	rec = admin("POST", "/tenants", map[string]any{"slug": "tiny", "name": "Tiny", "quota_template": "small"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create tenant status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var created store.Tenant
+	mustDecode(t, rec.Body.Bytes(), &created)
+	if created.QuotaTemplate != "small" {
+		t.Fatalf("expected quota_template small, got %q", created.QuotaTemplate)
+	}
+	limits, err := repo.GetTenantLimits(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("get tenant limits: %v", err)
+	}
+	if *limits != small {
+		t.Fatalf("expected template limits %+v, got %+v", small, *limits)
+	}
+
+	rec = admin("POST", "/tenants", map[string]any{"slug": "other", "name": "Other", "quota_template": "missing"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown template, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec = admin("DELETE", "/admin/quota-templates/small", nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting a template in use, got %d", rec.Code)
+	}
+
+	rec = admin("GET", "/admin/quota-templates", nil)
+	var listed struct {
+		Templates []store.QuotaTemplate `json:"templates"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &listed)
+	if len(listed.Templates) != 1 || listed.Templates[0].Name != "small" {
+		t.Fatalf("unexpected templates: %+v", listed.Templates)
+	}
+}
+
+func TestHeartbeatSchemaVersions(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+	tlsState := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	heartbeat := func(payload map[string]any) store.Host {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", payload, tlsState)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		hosts, err := repo.ListHosts(context.Background(), tenantID, siteID)
+		if err != nil || len(hosts) != 1 {
+			t.Fatalf("list hosts: %v %+v", err, hosts)
+		}
+		return hosts[0]
+	}
+
+	// An agent from before schema_version existed: flat totals, VM "state".
+	host := heartbeat(map[string]any{
+		"agent_id":           agentID,
+		"heartbeat_seq":      1,
+		"cpu_cores_total":    8,
+		"memory_bytes_total": int64(8 << 30),
+		"kvm_available":      true,
+		"microvms":           []map[string]any{{"id": "vm-old", "state": "RUNNING"}},
+	})
+	if host.CPUCoresTotal != 8 || host.MemoryBytesTotal != 8<<30 || !host.KVMAvailable {
+		t.Fatalf("version 1 facts not ingested: %+v", host)
+	}
+
+	// The current shape: host facts only come from host_facts.
+	host = heartbeat(map[string]any{
+		"schema_version":  HeartbeatSchemaVersion,
 		"agent_id":        agentID,
-		"heartbeat_seq":   1,
-		"tenant_id":       tenantID,
-		"site_id":         siteID,
-		"host_id":         "host-runonce",
-		"sent_at":         time.Now().UTC().Format(time.RFC3339Nano),
-		"extra_heartbeat": "ignored",
+		"heartbeat_seq":   2,
+		"cpu_cores_total": 99,
 		"host_facts": map[string]any{
-			"cpu_cores":          2,
-			"memory_total_bytes": int64(2 * 1024 * 1024 * 1024),
-			"disks": []map[string]any{
-				{"mountpoint": "/", "total_bytes": int64(50 * 1024 * 1024 * 1024)},
-			},
-			"os":     "linux",
-			"arch":   "amd64",
-			"kernel": "6.8.0",
-			"kvm": map[string]any{
-				"present":  true,
-				"readable": true,
-				"writable": true,
-			},
+			"cpu_cores":          16,
+			"memory_total_bytes": int64(32 << 30),
+			"kernel":             "6.8.0",
+			"kvm":                map[string]any{"present": true, "readable": true, "writable": false},
 		},
-		"netbird_status": map[string]any{"connected": true},
+		"microvms": []map[string]any{{"id": "vm-new", "status": "STOPPED"}},
+	})
+	if host.CPUCoresTotal != 16 || host.MemoryBytesTotal != 32<<30 || host.KVMAvailable {
+		t.Fatalf("version 2 facts not ingested from host_facts: %+v", host)
 	}
-	hbRec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", hbPayload, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
-	if hbRec.Code != http.StatusOK {
-		t.Fatalf("heartbeat status=%d body=%s", hbRec.Code, hbRec.Body.String())
+	vms, err := repo.ListVMs(context.Background(), tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list vms: %v", err)
 	}
-	var hbResp struct {
-		PendingPlans []struct {
-			PlanID      string `json:"plan_id"`
-			ExecutionID string `json:"execution_id"`
-			Actions     []struct {
-				ActionID string `json:"action_id"`
-				Type     string `json:"type"`
-			} `json:"actions"`
-		} `json:"pending_plans"`
+	states := map[string]string{}
+	for _, vm := range vms {
+		states[vm.ID] = vm.State
 	}
-	mustDecode(t, hbRec.Body.Bytes(), &hbResp)
-	if len(hbResp.PendingPlans) != 1 {
-		t.Fatalf("expected 1 pending plan, got %d", len(hbResp.PendingPlans))
+	if states["vm-new"] != "STOPPED" {
+		t.Fatalf("expected vm-new STOPPED from status, got %+v", states)
 	}
-	if hbResp.PendingPlans[0].PlanID != applyResp.PlanID {
-		t.Fatalf("expected pending plan id %s, got %s", applyResp.PlanID, hbResp.PendingPlans[0].PlanID)
+
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{
+		"schema_version": HeartbeatSchemaVersion + 1,
+		"agent_id":       agentID,
+	}, tlsState)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "upgrade the control plane") {
+		t.Fatalf("expected unsupported version rejection, got %d body=%s", rec.Code, rec.Body.String())
 	}
-	if len(hbResp.PendingPlans[0].Actions) != 2 {
-		t.Fatalf("expected 2 leased actions, got %d", len(hbResp.PendingPlans[0].Actions))
+
+	rec = doJSON(t, app.Handler(), "POST", "/v1/enroll", "", map[string]any{
+		"schema_version":   EnrollSchemaVersion + 1,
+		"enrollment_token": enrollToken,
+		"hostname":         "edge-host-2",
+		"csr_pem":          string(makeCSR(t)),
+	}, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "schema_version") {
+		t.Fatalf("expected unsupported enroll version rejection, got %d body=%s", rec.Code, rec.Body.String())
 	}
+}
 
-	logRec := doJSON(t, app.Handler(), "POST", "/v1/logs", "", map[string]any{
-		"execution_id": applyResp.Executions[0].ID,
-		"sequence":     1,
-		"level":        "INFO",
-		"message":      "run once started",
-		"emitted_at":   time.Now().UTC().Format(time.RFC3339Nano),
-		"tenant_id":    tenantID,
-		"action_id":    "create-vm-1",
-	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
-	if logRec.Code != http.StatusAccepted {
-		t.Fatalf("log frame status=%d body=%s", logRec.Code, logRec.Body.String())
+func TestListTenantAgentsSpansSites(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "dashboard", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
 	}
 
-	results := make([]map[string]any, 0, len(hbResp.PendingPlans[0].Actions))
-	for _, action := range hbResp.PendingPlans[0].Actions {
-		results = append(results, map[string]any{
-			"action_id":   action.ActionID,
-			"ok":          true,
-			"message":     "ok",
-			"finished_at": time.Now().UTC().Format(time.RFC3339Nano),
-		})
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	onlineID := enrollResp["agent_id"].(string)
+	cert := parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))
+
+	site2 := uuid.NewString()
+	if _, err := repo.CreateSite(ctx, store.Site{ID: site2, TenantID: tenantID, Name: "site-2"}); err != nil {
+		t.Fatalf("create site: %v", err)
 	}
-	resultRec := doJSON(t, app.Handler(), "POST", "/v1/executions/result", "", map[string]any{
-		"plan_id":      hbResp.PendingPlans[0].PlanID,
-		"execution_id": hbResp.PendingPlans[0].ExecutionID,
-		"results":      results,
-	}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
-	if resultRec.Code != http.StatusAccepted {
-		t.Fatalf("report result status=%d body=%s", resultRec.Code, resultRec.Body.String())
+	offline, err := repo.CreateAgentFromEnrollment(ctx, "", store.Agent{ID: uuid.NewString(), TenantID: tenantID, SiteID: site2, HostID: uuid.NewString(), AgentVersion: "0.1.0", OS: "linux", Arch: "arm64"}, "edge-host-2")
+	if err != nil {
+		t.Fatalf("create agent: %v", err)
 	}
-
-	dedupRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, planPayload, nil)
-	if dedupRec.Code != http.StatusOK {
-		t.Fatalf("dedupe plan status=%d body=%s", dedupRec.Code, dedupRec.Body.String())
+	if _, err := repo.SweepOfflineAgents(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("sweep: %v", err)
 	}
-	var dedupResp struct {
-		PlanStatus string `json:"plan_status"`
+	rec := doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": onlineID}, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
 	}
-	mustDecode(t, dedupRec.Body.Bytes(), &dedupResp)
-	if dedupResp.PlanStatus != "SUCCEEDED" {
-		t.Fatalf("expected final plan status SUCCEEDED, got %s", dedupResp.PlanStatus)
+
+	type page struct {
+		Agents     []store.TenantAgent `json:"agents"`
+		NextCursor string              `json:"next_cursor"`
+	}
+	list := func(query string) page {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/agents"+query, plainAPIKey, nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list agents%s status=%d body=%s", query, rec.Code, rec.Body.String())
+		}
+		var p page
+		mustDecode(t, rec.Body.Bytes(), &p)
+		return p
 	}
 
-	vmsRec := doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/vms", plainAPIKey, nil, nil)
-	if vmsRec.Code != http.StatusOK {
-		t.Fatalf("list vms status=%d body=%s", vmsRec.Code, vmsRec.Body.String())
+	all := list("")
+	if len(all.Agents) != 2 || all.NextCursor != "" {
+		t.Fatalf("expected 2 agents on one page, got %+v", all)
 	}
-	var vmsResp struct {
-		VMs []store.MicroVM `json:"vms"`
+	bySite := map[string]store.TenantAgent{}
+	for _, a := range all.Agents {
+		bySite[a.SiteID] = a
 	}
-	mustDecode(t, vmsRec.Body.Bytes(), &vmsResp)
-	if len(vmsResp.VMs) == 0 {
-		t.Fatalf("expected at least one vm")
+	if got := bySite[siteID]; got.ID != onlineID || got.SiteName != "site-1" || got.CertExpiresAt == nil || got.LastHeartbeatAt == nil {
+		t.Fatalf("unexpected enrolled agent: %+v", got)
+	}
+	if got := bySite[site2]; got.ID != offline.ID || got.Hostname != "edge-host-2" || got.Arch != "arm64" {
+		t.Fatalf("unexpected second-site agent: %+v", got)
 	}
 
-	logsRec := doJSON(t, app.Handler(), "GET", "/executions/"+applyResp.Executions[0].ID+"/logs", plainAPIKey, nil, nil)
-	if logsRec.Code != http.StatusOK {
-		t.Fatalf("list logs status=%d body=%s", logsRec.Code, logsRec.Body.String())
+	if online := list("?state=online"); len(online.Agents) != 1 || online.Agents[0].ID != onlineID || online.Agents[0].State != "ONLINE" {
+		t.Fatalf("expected only the online agent, got %+v", online.Agents)
 	}
-	var logsResp struct {
-		Logs []store.ExecutionLog `json:"logs"`
+	if off := list("?state=OFFLINE"); len(off.Agents) != 1 || off.Agents[0].ID != offline.ID {
+		t.Fatalf("expected only the offline agent, got %+v", off.Agents)
 	}
-	mustDecode(t, logsRec.Body.Bytes(), &logsResp)
-	if len(logsResp.Logs) != 1 {
-		t.Fatalf("expected 1 log entry, got %d", len(logsResp.Logs))
+
+	first := list("?limit=1")
+	if len(first.Agents) != 1 || first.NextCursor != first.Agents[0].ID {
+		t.Fatalf("expected a first page with a cursor, got %+v", first)
+	}
+	second := list("?limit=1&cursor=" + first.NextCursor)
+	if len(second.Agents) != 1 || second.NextCursor != "" || second.Agents[0].ID == first.Agents[0].ID {
+		t.Fatalf("unexpected second page: %+v", second)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/agents?state=BROKEN", plainAPIKey, nil, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown state, got %d", rec.Code)
 	}
 }
 
-func newTestAppWithEnrollmentToken(t *testing.T) (*App, *store.MemoryRepo, string, string, string) {
-	t.Helper()
-	repo := store.NewMemoryRepo()
-	cfg := LoadConfig()
-	cfg.AdminKey = "admin"
-	app, err := NewApp(cfg, repo)
-	if err != nil {
-		t.Fatalf("new app: %v", err)
+func TestAgentMetadataIsTenantScoped(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
 	}
-	tenantID := uuid.NewString()
-	siteID := uuid.NewString()
-	_, err = repo.CreateTenant(context.Background(), store.Tenant{ID: tenantID, Slug: "acme", Name: "Acme", PrimaryRegion: "eu-central-1", RetentionDays: 30})
-	if err != nil {
+	otherTenant := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenant, Slug: "other", Name: "Other", RetentionDays: 30}); err != nil {
 		t.Fatalf("create tenant: %v", err)
 	}
-	_, err = repo.CreateSite(context.Background(), store.Site{ID: siteID, TenantID: tenantID, Name: "site-1"})
-	if err != nil {
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: otherTenant, Name: "other", KeyHash: hashString("nk_other_key")}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	otherSite := uuid.NewString()
+	if _, err := repo.CreateSite(ctx, store.Site{ID: otherSite, TenantID: otherTenant, Name: "other-site"}); err != nil {
 		t.Fatalf("create site: %v", err)
 	}
-	enrollToken := "enroll-token-1"
-	_, err = repo.IssueEnrollmentToken(context.Background(), store.EnrollmentToken{
-		ID:        uuid.NewString(),
-		TenantID:  tenantID,
-		SiteID:    siteID,
-		TokenHash: hashString(enrollToken),
-		ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
-	})
-	if err != nil {
-		t.Fatalf("issue token: %v", err)
+
+	agentID := enroll(t, app, enrollToken, makeCSR(t))["agent_id"].(string)
+	path := "/sites/" + siteID + "/agents/" + agentID + "/metadata"
+	metadata := map[string]any{"rack": "r12", "datacenter": "fra1", "role": "gpu"}
+
+	if rec := doJSON(t, app.Handler(), "PUT", path, "nk_other_key", metadata, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another tenant's site to be hidden, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doJSON(t, app.Handler(), "PUT", "/sites/"+otherSite+"/agents/"+agentID+"/metadata", "nk_other_key", metadata, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected the agent to be hidden from another tenant's site, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, []string{"rack"}, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected non-object metadata to be rejected, got %d", rec.Code)
+	}
+	if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, metadata, nil); rec.Code != http.StatusOK {
+		t.Fatalf("set metadata status=%d body=%s", rec.Code, rec.Body.String())
 	}
-	return app, repo, tenantID, siteID, enrollToken
-}
 
-func doJSON(t *testing.T, h http.Handler, method, path, apiKey string, body any, tlsState *tls.ConnectionState) *httptest.ResponseRecorder {
-	t.Helper()
-	var buf []byte
-	if body != nil {
-		var err error
-		buf, err = json.Marshal(body)
-		if err != nil {
-			t.Fatalf("marshal body: %v", err)
-		}
+	rec := doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/agents", plainAPIKey, nil, nil)
+	var agents struct {
+		Agents []store.TenantAgent `json:"agents"`
 	}
-	req := httptest.NewRequest(method, path, bytes.NewReader(buf))
-	req.Header.Set("Content-Type", "application/json")
-	if apiKey != "" {
-		req.Header.Set("X-API-Key", apiKey)
+	mustDecode(t, rec.Body.Bytes(), &agents)
+	var got map[string]string
+	if len(agents.Agents) != 1 || json.Unmarshal(agents.Agents[0].Metadata, &got) != nil || got["rack"] != "r12" || got["role"] != "gpu" {
+		t.Fatalf("expected the metadata in the agent list, got %+v", agents.Agents)
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/sites/"+siteID+"/hosts", plainAPIKey, nil, nil)
+	var hosts struct {
+		Hosts []store.Host `json:"hosts"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hosts)
+	got = nil
+	if len(hosts.Hosts) != 1 || json.Unmarshal(hosts.Hosts[0].AgentMetadata, &got) != nil || got["datacenter"] != "fra1" {
+		t.Fatalf("expected the metadata in the host list, got %+v", hosts.Hosts)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+otherTenant+"/agents", "nk_other_key", nil, nil)
+	mustDecode(t, rec.Body.Bytes(), &agents)
+	if len(agents.Agents) != 0 {
+		t.Fatalf("expected no agents for the other tenant, got %+v", agents.Agents)
+	}
+
+	if rec := doJSON(t, app.Handler(), "PUT", path, plainAPIKey, json.RawMessage("null"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("clear metadata status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/agents", plainAPIKey, nil, nil)
+	agents.Agents = nil
+	mustDecode(t, rec.Body.Bytes(), &agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].Metadata != nil {
+		t.Fatalf("expected the metadata to be cleared, got %+v", agents.Agents)
 	}
-	req.TLS = tlsState
-	rec := httptest.NewRecorder()
-	h.ServeHTTP(rec, req)
-	return rec
 }
 
-func enroll(t *testing.T, app *App, enrollToken string, csrPEM []byte) map[string]any {
-	t.Helper()
-	rec := doJSON(t, app.Handler(), "POST", "/enroll", "", map[string]any{
-		"enrollment_token": enrollToken,
-		"hostname":         "edge-host-1",
-		"agent_version":    "0.1.0",
-		"os":               "linux",
-		"arch":             "amd64",
-		"csr_pem":          string(csrPEM),
+func TestListAgentLeasedPlansReflectsLease(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	ctx := context.Background()
+	plainAPIKey := "nk_leased_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	agentID := enroll(t, app, enrollToken, makeCSR(t))["agent_id"].(string)
+
+	applyRec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+		"idempotency_key": "leased-plans",
+		"actions": []map[string]any{
+			{"operation_id": "create-1", "operation": "CREATE", "vm_id": "vm-leased-1", "name": "vm-leased-1", "vcpu_count": 1, "memory_mib": 256},
+		},
 	}, nil)
+	if applyRec.Code != http.StatusOK {
+		t.Fatalf("apply plan status=%d body=%s", applyRec.Code, applyRec.Body.String())
+	}
+	var applied struct {
+		PlanID string `json:"plan_id"`
+	}
+	mustDecode(t, applyRec.Body.Bytes(), &applied)
+
+	path := "/sites/" + siteID + "/agents/" + agentID + "/leased-plans"
+	type leasedResponse struct {
+		Plans []struct {
+			PlanID  string `json:"plan_id"`
+			Actions []struct {
+				ActionID string `json:"action_id"`
+				Type     string `json:"type"`
+			} `json:"actions"`
+			LeaseExpiresAt time.Time `json:"lease_expires_at"`
+		} `json:"plans"`
+	}
+	var before leasedResponse
+	rec := doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
 	if rec.Code != http.StatusOK {
-		t.Fatalf("enroll status=%d body=%s", rec.Code, rec.Body.String())
+		t.Fatalf("leased plans status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	mustDecode(t, rec.Body.Bytes(), &before)
+	if len(before.Plans) != 0 {
+		t.Fatalf("expected no leased plans before leasing, got %+v", before.Plans)
 	}
-	var resp map[string]any
-	mustDecode(t, rec.Body.Bytes(), &resp)
-	return resp
-}
 
-func mustDecode(t *testing.T, b []byte, v any) {
-	t.Helper()
-	if err := json.Unmarshal(b, v); err != nil {
-		t.Fatalf("decode json: %v body=%s", err, string(b))
+	leased, err := repo.LeasePendingPlans(ctx, agentID, 1, time.Minute)
+	if err != nil || len(leased) != 1 {
+		t.Fatalf("lease plans: %v (%d plans)", err, len(leased))
 	}
-}
 
-func makeCSR(t *testing.T) []byte {
-	t.Helper()
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		t.Fatalf("generate key: %v", err)
+	var got leasedResponse
+	for i := 0; i < 2; i++ {
+		rec = doJSON(t, app.Handler(), "GET", path, plainAPIKey, nil, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("leased plans status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		mustDecode(t, rec.Body.Bytes(), &got)
+		if len(got.Plans) != 1 || got.Plans[0].PlanID != applied.PlanID {
+			t.Fatalf("expected leased plan %s, got %+v", applied.PlanID, got.Plans)
+		}
+		if len(got.Plans[0].Actions) != 1 || got.Plans[0].Actions[0].Type != "MicroVMCreate" {
+			t.Fatalf("expected the CREATE action, got %+v", got.Plans[0].Actions)
+		}
+		// Reading the leases must not extend them.
+		if !got.Plans[0].LeaseExpiresAt.Equal(leased[0].LeaseExpiresAt) {
+			t.Fatalf("expected lease expiry %s, got %s", leased[0].LeaseExpiresAt, got.Plans[0].LeaseExpiresAt)
+		}
 	}
-	tpl := &x509.CertificateRequest{
-		Subject: pkix.Name{
-			CommonName: "pending-agent",
-		},
+
+	otherTenantID := uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, store.Tenant{ID: otherTenantID, Slug: "other", Name: "Other", PrimaryRegion: "eu-central-1", RetentionDays: 30}); err != nil {
+		t.Fatalf("create tenant: %v", err)
 	}
-	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, key)
-	if err != nil {
-		t.Fatalf("create csr: %v", err)
+	otherKey := "nk_other_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: otherTenantID, Name: "other", KeyHash: hashString(otherKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	if rec := doJSON(t, app.Handler(), "GET", path, otherKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected other tenant to get 404, got %d", rec.Code)
+	}
+	wrongSite := "/sites/" + uuid.NewString() + "/agents/" + agentID + "/leased-plans"
+	if rec := doJSON(t, app.Handler(), "GET", wrongSite, plainAPIKey, nil, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown site to get 404, got %d", rec.Code)
 	}
-	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
 }
 
-func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
-	t.Helper()
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		t.Fatalf("failed to decode cert pem")
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+func TestVersionReportsInjectedBuild(t *testing.T) {
+	cfg := LoadConfig()
+	cfg.Build = BuildInfo{Version: "v1.4.2", Commit: "abc1234", BuildTime: "2026-10-01T12:00:00Z"}
+	app, err := NewApp(cfg, store.NewMemoryRepo())
 	if err != nil {
-		t.Fatalf("parse cert: %v", err)
+		t.Fatalf("new app: %v", err)
 	}
-	if cert.SerialNumber.Cmp(big.NewInt(0)) <= 0 {
-		t.Fatalf("invalid serial")
+
+	rec := doJSON(t, app.Handler(), "GET", "/version", "", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var got BuildInfo
+	mustDecode(t, rec.Body.Bytes(), &got)
+	if got != cfg.Build {
+		t.Fatalf("expected %+v, got %+v", cfg.Build, got)
+	}
+
+	rec = doJSON(t, app.Handler(), "GET", "/readyz", "", nil, nil)
+	var ready struct {
+		Version string `json:"version"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &ready)
+	if ready.Version != "v1.4.2" {
+		t.Fatalf("expected /readyz to report v1.4.2, got %q", ready.Version)
 	}
-	return cert
 }
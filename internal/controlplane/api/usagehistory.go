@@ -0,0 +1,119 @@
+package controlplane
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// defaultUsageHistoryRange is the span of history returned when the
+// request gives no from.
+const defaultUsageHistoryRange = 30 * 24 * time.Hour
+
+// startUsageHistory records every tenant's usage each UsageHistoryInterval,
+// keeping the last snapshot of each day, and prunes snapshots older than
+// UsageHistoryTTL.
+func (a *App) startUsageHistory(ctx context.Context) {
+	if a.cfg.UsageHistoryInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.cfg.UsageHistoryInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			if !a.ReadOnly() {
+				if err := a.recordUsageHistory(context.Background(), time.Now().UTC()); err != nil {
+					log.Printf("usage history error: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// recordUsageHistory snapshots the usage of every tenant homed in this
+// region as of now.
+func (a *App) recordUsageHistory(ctx context.Context, now time.Time) error {
+	tenants, err := a.repo.ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tenant := range tenants {
+		// Tenants homed in another region are recorded by their own
+		// control plane.
+		if a.federation != nil && tenant.PrimaryRegion != "" && tenant.PrimaryRegion != a.federation.region {
+			continue
+		}
+		usage, err := a.repo.GetTenantUsage(ctx, tenant.ID)
+		if err != nil {
+			return err
+		}
+		if err := a.repo.RecordTenantUsage(ctx, tenant.ID, now, *usage); err != nil {
+			return err
+		}
+	}
+	if a.cfg.UsageHistoryTTL > 0 {
+		if _, err := a.repo.PruneTenantUsageHistory(ctx, now.Add(-a.cfg.UsageHistoryTTL)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleGetTenantUsageHistory returns the tenant's daily usage snapshots
+// between the from and to query parameters, each a date (2006-01-02) or
+// an RFC 3339 time. to defaults to today and from to 30 days before it.
+func (a *App) handleGetTenantUsageHistory(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	to, ok := parseUsageDay(r.URL.Query().Get("to"), time.Now().UTC())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "to must be a date or RFC 3339 time")
+		return
+	}
+	from, ok := parseUsageDay(r.URL.Query().Get("from"), to.Add(-defaultUsageHistoryRange))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "from must be a date or RFC 3339 time")
+		return
+	}
+	if from.After(to) {
+		writeError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	history, err := a.repo.ListTenantUsageHistory(r.Context(), tenantID, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to get tenant usage history")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"from":    from.Format(time.DateOnly),
+		"to":      to.Format(time.DateOnly),
+		"history": history,
+	})
+}
+
+// parseUsageDay parses a history bound as a date or RFC 3339 time and
+// returns its UTC day; an empty value yields the day of def.
+func parseUsageDay(raw string, def time.Time) (time.Time, bool) {
+	if raw == "" {
+		return store.UsageDay(def), true
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t, true
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return store.UsageDay(t), true
+}
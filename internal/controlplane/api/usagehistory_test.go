@@ -0,0 +1,79 @@
+package controlplane
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+func TestUsageHistoryAccumulatesDailySnapshots(t *testing.T) {
+	app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+	app.cfg.UsageHistoryTTL = 90 * 24 * time.Hour
+	ctx := context.Background()
+	apiKey := "nk_usage_key"
+	if _, err := repo.CreateAPIKey(ctx, store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "usage", KeyHash: hashString(apiKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	day1 := time.Date(2026, 3, 1, 6, 0, 0, 0, time.UTC)
+	if err := app.recordUsageHistory(ctx, day1); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if _, err := repo.CreateSite(ctx, store.Site{ID: uuid.NewString(), TenantID: tenantID, Name: "site-2"}); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	// A later run on the same day replaces that day's snapshot.
+	if err := app.recordUsageHistory(ctx, day1.Add(12*time.Hour)); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if _, err := repo.CreateSite(ctx, store.Site{ID: uuid.NewString(), TenantID: tenantID, Name: "site-3"}); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+	for _, at := range []time.Time{day1.AddDate(0, 0, 1), day1.AddDate(0, 0, 2)} {
+		if err := app.recordUsageHistory(ctx, at); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	var got struct {
+		From    string                      `json:"from"`
+		To      string                      `json:"to"`
+		History []store.TenantUsageSnapshot `json:"history"`
+	}
+	rec := doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/usage/history?from=2026-03-01&to=2026-03-02T23:00:00Z", apiKey, nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	mustDecode(t, rec.Body.Bytes(), &got)
+	if got.From != "2026-03-01" || got.To != "2026-03-02" || len(got.History) != 2 {
+		t.Fatalf("expected two days in range, got %s..%s %+v", got.From, got.To, got.History)
+	}
+	if got.History[0].Sites != 2 || got.History[1].Sites != 3 {
+		t.Fatalf("expected the day's last snapshot and growth, got %d then %d sites", got.History[0].Sites, got.History[1].Sites)
+	}
+	if !got.History[0].Day.Equal(store.UsageDay(day1)) || got.History[0].TenantID != tenantID {
+		t.Fatalf("unexpected first snapshot %+v", got.History[0])
+	}
+
+	for _, query := range []string{"?from=yesterday", "?from=2026-03-03&to=2026-03-01"} {
+		if rec := doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/usage/history"+query, apiKey, nil, nil); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+
+	// Retention drops snapshots older than the TTL on the next run.
+	if err := app.recordUsageHistory(ctx, day1.AddDate(0, 0, 91)); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	history, err := repo.ListTenantUsageHistory(ctx, tenantID, day1, day1.AddDate(0, 0, 91))
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(history) != 3 || !history[0].Day.Equal(store.UsageDay(day1.AddDate(0, 0, 1))) {
+		t.Fatalf("expected only the snapshot past retention pruned, got %+v", history)
+	}
+}
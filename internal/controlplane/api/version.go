@@ -0,0 +1,31 @@
+package controlplane
+
+import "net/http"
+
+// BuildInfo identifies the control-plane build. The binary's main package
+// fills it from variables injected with -ldflags at build time.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// withDefaults marks fields that were not injected at build time.
+func (b BuildInfo) withDefaults() BuildInfo {
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildTime == "" {
+		b.BuildTime = "unknown"
+	}
+	return b
+}
+
+// handleVersion reports the control-plane build so operators and agents
+// can track compatibility.
+func (a *App) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.cfg.Build.withDefaults())
+}
@@ -0,0 +1,419 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+const (
+	webhookQueueSize = 256
+	// webhookIdleTimeout is how long an endpoint's delivery workers wait
+	// for work before exiting; they are started again by the next event.
+	webhookIdleTimeout = time.Minute
+	// webhookSiteCacheTTL bounds how long a site's webhooks are cached;
+	// changes made through another control plane replica show up within
+	// it.
+	webhookSiteCacheTTL = 30 * time.Second
+)
+
+// webhookEvent is the JSON body POSTed to a webhook.
+type webhookEvent struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	TenantID      string    `json:"tenant_id"`
+	SiteID        string    `json:"site_id"`
+	ResourceID    string    `json:"resource_id"`
+	State         string    `json:"state"`
+	PreviousState string    `json:"previous_state,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+type webhookDelivery struct {
+	hook  store.Webhook
+	event webhookEvent
+}
+
+type cachedSiteWebhooks struct {
+	hooks   []store.Webhook
+	expires time.Time
+}
+
+// webhookEndpoint queues the deliveries of one webhook. Each endpoint has
+// its own queue and workers, so a slow or unreachable endpoint only
+// delays and drops its own events.
+type webhookEndpoint struct {
+	queue   chan webhookDelivery
+	workers int
+}
+
+// webhookDispatcher delivers site events to the webhooks of the site's
+// tenant. Deliveries are queued per webhook and sent by up to concurrency
+// workers per webhook, once and best effort; events are dropped when a
+// webhook's queue is full.
+type webhookDispatcher struct {
+	repo        store.Repo
+	client      *http.Client
+	concurrency int
+
+	mu        sync.Mutex
+	ctx       context.Context
+	endpoints map[string]*webhookEndpoint
+	bySite    map[string]cachedSiteWebhooks
+}
+
+func newWebhookDispatcher(repo store.Repo, cfg Config) *webhookDispatcher {
+	timeout := cfg.WebhookTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if !cfg.WebhookAllowPrivateTargets {
+		dialer.Control = webhookDialControl
+	}
+	return &webhookDispatcher{
+		repo: repo,
+		client: &http.Client{
+			Timeout: timeout,
+			// No proxy: the dial guard must see the webhook's own address.
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+		},
+		concurrency: max(cfg.WebhookConcurrency, 1),
+		endpoints:   make(map[string]*webhookEndpoint),
+		bySite:      make(map[string]cachedSiteWebhooks),
+	}
+}
+
+// Start lets the delivery workers run until ctx is done. Events queued
+// before it are delivered once it is called.
+func (d *webhookDispatcher) Start(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx = ctx
+	for hookID, ep := range d.endpoints {
+		d.startWorkersLocked(hookID, ep)
+	}
+}
+
+// startWorkersLocked tops the endpoint up to its worker count.
+func (d *webhookDispatcher) startWorkersLocked(hookID string, ep *webhookEndpoint) {
+	if d.ctx == nil {
+		return
+	}
+	for ; ep.workers < d.concurrency; ep.workers++ {
+		go d.work(d.ctx, hookID, ep)
+	}
+}
+
+// work delivers the endpoint's queued events until ctx is done or the
+// queue has been idle for webhookIdleTimeout.
+func (d *webhookDispatcher) work(ctx context.Context, hookID string, ep *webhookEndpoint) {
+	idle := time.NewTimer(webhookIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case delivery := <-ep.queue:
+			d.deliver(ctx, delivery)
+			idle.Reset(webhookIdleTimeout)
+		case <-idle.C:
+			d.mu.Lock()
+			if len(ep.queue) > 0 {
+				d.mu.Unlock()
+				idle.Reset(webhookIdleTimeout)
+				continue
+			}
+			ep.workers--
+			if ep.workers == 0 && d.endpoints[hookID] == ep {
+				delete(d.endpoints, hookID)
+			}
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// enqueue queues delivery on its webhook's endpoint.
+func (d *webhookDispatcher) enqueue(delivery webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ep, ok := d.endpoints[delivery.hook.ID]
+	if !ok {
+		ep = &webhookEndpoint{queue: make(chan webhookDelivery, webhookQueueSize)}
+		d.endpoints[delivery.hook.ID] = ep
+	}
+	select {
+	case ep.queue <- delivery:
+	default:
+		log.Printf("webhooks: queue full, dropping %s event for webhook %s", delivery.event.Type, delivery.hook.ID)
+		return
+	}
+	d.startWorkersLocked(delivery.hook.ID, ep)
+}
+
+// siteWebhooks returns the webhooks of the tenant owning siteID.
+func (d *webhookDispatcher) siteWebhooks(ctx context.Context, siteID string) []store.Webhook {
+	d.mu.Lock()
+	cached, ok := d.bySite[siteID]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.hooks
+	}
+	hooks, err := d.repo.ListSiteWebhooks(ctx, siteID)
+	if err != nil {
+		log.Printf("webhooks: list webhooks of site %s: %v", siteID, err)
+		return nil
+	}
+	d.mu.Lock()
+	d.bySite[siteID] = cachedSiteWebhooks{hooks: hooks, expires: time.Now().Add(webhookSiteCacheTTL)}
+	d.mu.Unlock()
+	return hooks
+}
+
+// watched reports whether the site's tenant has any webhook.
+func (d *webhookDispatcher) watched(ctx context.Context, siteID string) bool {
+	return len(d.siteWebhooks(ctx, siteID)) > 0
+}
+
+// invalidate drops the cached webhooks after a webhook is added or removed.
+func (d *webhookDispatcher) invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.bySite)
+}
+
+// dispatch queues e for every webhook that subscribed to its event type.
+func (d *webhookDispatcher) dispatch(ctx context.Context, e siteEvent) {
+	eventType := webhookEventType(e)
+	if eventType == "" {
+		return
+	}
+	for _, hook := range d.siteWebhooks(ctx, e.SiteID) {
+		if !hook.Wants(eventType) {
+			continue
+		}
+		d.enqueue(webhookDelivery{hook: hook, event: webhookEvent{
+			ID:            uuid.NewString(),
+			Type:          eventType,
+			TenantID:      hook.TenantID,
+			SiteID:        e.SiteID,
+			ResourceID:    e.ResourceID,
+			State:         e.State,
+			PreviousState: e.PreviousState,
+			At:            e.At,
+		}})
+	}
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("webhooks: build request for webhook %s: %v", delivery.hook.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nkudo-Event", delivery.event.Type)
+	req.Header.Set("X-Nkudo-Signature", "sha256="+signWebhookBody(delivery.hook.Secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		log.Printf("webhooks: deliver %s to webhook %s: %v", delivery.event.Type, delivery.hook.ID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("webhooks: deliver %s to webhook %s: status %d", delivery.event.Type, delivery.hook.ID, resp.StatusCode)
+	}
+}
+
+// signWebhookBody returns the hex HMAC-SHA256 of body keyed by the
+// webhook's secret, sent as X-Nkudo-Signature so receivers can verify it.
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// errWebhookTarget is returned for webhook URLs on loopback, link-local,
+// private or otherwise internal addresses.
+var errWebhookTarget = errors.New("webhook url must not target a loopback, link-local or private address")
+
+// blockedWebhookIP reports whether ip is an address webhooks must not
+// reach: a request to it from the control plane could hit internal
+// services or cloud metadata endpoints.
+func blockedWebhookIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), internal
+// to the provider like the private ranges.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkWebhookTarget rejects a webhook URL whose host is localhost or a
+// blocked IP literal. Host names are checked when they are dialed.
+func checkWebhookTarget(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil // ValidateWebhook reports malformed URLs
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errWebhookTarget
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && blockedWebhookIP(ip) {
+		return errWebhookTarget
+	}
+	return nil
+}
+
+// webhookDialControl refuses connections to blocked addresses once a
+// webhook's host name is resolved, so DNS names and redirects cannot
+// point deliveries at internal services.
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("webhook dial %s: %w", address, err)
+	}
+	if blockedWebhookIP(ap.Addr()) {
+		return fmt.Errorf("webhook dial %s: %w", address, errWebhookTarget)
+	}
+	return nil
+}
+
+// webhookEventType maps a site event to the webhook event type it raises,
+// or "" when webhooks are not told about it.
+func webhookEventType(e siteEvent) string {
+	switch {
+	case e.Type == siteEventPlanStatus && e.State == "SUCCEEDED":
+		return store.WebhookEventPlanSucceeded
+	case e.Type == siteEventPlanStatus && e.State == "FAILED":
+		return store.WebhookEventPlanFailed
+	case e.Type == siteEventAgentState && e.State == "OFFLINE":
+		return store.WebhookEventAgentOffline
+	case e.Type == siteEventVMState && e.State == "ERROR":
+		return store.WebhookEventVMError
+	}
+	return ""
+}
+
+func (a *App) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	var req struct {
+		URL        string   `json:"url"`
+		EventTypes []string `json:"event_types"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	eventTypes := make([]string, 0, len(req.EventTypes))
+	for _, t := range req.EventTypes {
+		eventTypes = append(eventTypes, strings.TrimSpace(t))
+	}
+	if !a.cfg.WebhookAllowPrivateTargets {
+		if err := checkWebhookTarget(strings.TrimSpace(req.URL)); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate webhook secret")
+		return
+	}
+	hook, err := a.repo.CreateWebhook(r.Context(), store.Webhook{
+		ID:         uuid.NewString(),
+		TenantID:   tenantID,
+		URL:        strings.TrimSpace(req.URL),
+		Secret:     secret,
+		EventTypes: eventTypes,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrInvalidWebhook):
+			writeError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, store.ErrNotFound):
+			writeError(w, http.StatusNotFound, "tenant not found")
+		default:
+			writeError(w, http.StatusInternalServerError, "failed to create webhook")
+		}
+		return
+	}
+	a.webhooks.invalidate()
+	_ = a.writeAudit(r.Context(), tenantID, "", "USER", "api-key", "webhook.create", "webhook", hook.ID, requestID(r), sourceIP(r), nil)
+	// The secret is only returned here.
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":          hook.ID,
+		"tenant_id":   hook.TenantID,
+		"url":         hook.URL,
+		"event_types": hook.EventTypes,
+		"created_at":  hook.CreatedAt,
+		"secret":      secret,
+	})
+}
+
+func (a *App) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	hooks, err := a.repo.ListWebhooks(r.Context(), tenantID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"webhooks": hooks})
+}
+
+func (a *App) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.PathValue("tenantID")
+	if !a.tenantAllowed(r.Context(), tenantID) {
+		writeError(w, http.StatusForbidden, "tenant mismatch")
+		return
+	}
+	webhookID := r.PathValue("webhookID")
+	if _, err := uuid.Parse(webhookID); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+	if err := a.repo.DeleteWebhook(r.Context(), tenantID, webhookID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "webhook not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to delete webhook")
+		return
+	}
+	a.webhooks.invalidate()
+	_ = a.writeAudit(r.Context(), tenantID, "", "USER", "api-key", "webhook.delete", "webhook", webhookID, requestID(r), sourceIP(r), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,284 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+)
+
+// webhookReceiver records the events POSTed to it.
+type webhookReceiver struct {
+	*httptest.Server
+	secret string
+
+	mu     sync.Mutex
+	events []webhookEvent
+	bad    []string
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	rcv := &webhookReceiver{}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var e webhookEvent
+		_ = json.Unmarshal(body, &e)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		if r.Header.Get("X-Nkudo-Signature") != "sha256="+signWebhookBody(rcv.secret, body) || r.Header.Get("X-Nkudo-Event") != e.Type {
+			rcv.bad = append(rcv.bad, e.Type)
+		}
+		rcv.events = append(rcv.events, e)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) received() ([]webhookEvent, []string) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]webhookEvent{}, rcv.events...), append([]string{}, rcv.bad...)
+}
+
+func TestWebhookEventTypeFilter(t *testing.T) {
+	app, repo, tenantID, siteID, enrollToken := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	// The receivers listen on loopback.
+	app.cfg.WebhookAllowPrivateTargets = true
+	app.webhooks = newWebhookDispatcher(repo, app.cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	app.StartBackgroundWorkers(ctx)
+
+	rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/webhooks", plainAPIKey, map[string]any{
+		"url":         "https://hooks.example.com/nkudo",
+		"event_types": []string{"plan.failed", "plan.bogus"},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown event type to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	register := func(rcv *webhookReceiver, eventTypes []string) {
+		t.Helper()
+		rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/webhooks", plainAPIKey, map[string]any{
+			"url":         rcv.URL,
+			"event_types": eventTypes,
+		}, nil)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create webhook status=%d body=%s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Secret string `json:"secret"`
+		}
+		mustDecode(t, rec.Body.Bytes(), &resp)
+		rcv.secret = resp.Secret
+	}
+	failuresOnly := newWebhookReceiver(t)
+	register(failuresOnly, []string{"plan.failed"})
+	everything := newWebhookReceiver(t)
+	register(everything, nil)
+
+	rec = doJSON(t, app.Handler(), "GET", "/tenants/"+tenantID+"/webhooks", plainAPIKey, nil, nil)
+	var listResp struct {
+		Webhooks []store.Webhook `json:"webhooks"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &listResp)
+	if len(listResp.Webhooks) != 2 || listResp.Webhooks[0].EventTypes[0] != "plan.failed" {
+		t.Fatalf("unexpected webhooks %+v", listResp.Webhooks)
+	}
+
+	enrollResp := enroll(t, app, enrollToken, makeCSR(t))
+	agentID := enrollResp["agent_id"].(string)
+	agentTLS := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parseCert(t, []byte(enrollResp["client_certificate_pem"].(string)))}}
+	for _, vmID := range []string{"vm-ok", "vm-broken"} {
+		rec := doJSON(t, app.Handler(), "POST", "/sites/"+siteID+"/plans", plainAPIKey, map[string]any{
+			"idempotency_key": "create-" + vmID,
+			"actions":         []map[string]any{{"operation": "CREATE", "vm_id": vmID, "name": vmID}},
+		}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("apply plan status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+	rec = doJSON(t, app.Handler(), "POST", "/v1/heartbeat", "", map[string]any{"agent_id": agentID, "hostname": "edge-host-1"}, agentTLS)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat status=%d body=%s", rec.Code, rec.Body.String())
+	}
+	var hbResp struct {
+		PendingPlans []struct {
+			PlanID      string `json:"plan_id"`
+			ExecutionID string `json:"execution_id"`
+			Actions     []struct {
+				ActionID string          `json:"action_id"`
+				Params   json.RawMessage `json:"params"`
+			} `json:"actions"`
+		} `json:"pending_plans"`
+	}
+	mustDecode(t, rec.Body.Bytes(), &hbResp)
+	if len(hbResp.PendingPlans) != 2 {
+		t.Fatalf("expected 2 leased plans, got %d", len(hbResp.PendingPlans))
+	}
+	planStatus := map[string]string{}
+	for _, plan := range hbResp.PendingPlans {
+		var params struct {
+			VMID string `json:"vm_id"`
+		}
+		_ = json.Unmarshal(plan.Actions[0].Params, &params)
+		ok := params.VMID == "vm-ok"
+		planStatus[plan.PlanID] = "FAILED"
+		if ok {
+			planStatus[plan.PlanID] = "SUCCEEDED"
+		}
+		rec := doJSON(t, app.Handler(), "POST", "/v1/executions/result", "", map[string]any{
+			"plan_id":      plan.PlanID,
+			"execution_id": plan.ExecutionID,
+			"results": []map[string]any{{
+				"action_id":   plan.Actions[0].ActionID,
+				"ok":          ok,
+				"message":     "done",
+				"finished_at": time.Now().UTC().Format(time.RFC3339Nano),
+			}},
+		}, agentTLS)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("report result status=%d body=%s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// Each webhook is delivered to by its own worker; wait for both to see
+	// the plan events they subscribed to.
+	waitPlanEvents := func(rcv *webhookReceiver, want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			events, _ := rcv.received()
+			planEvents := 0
+			for _, e := range events {
+				if e.Type == store.WebhookEventPlanSucceeded || e.Type == store.WebhookEventPlanFailed {
+					planEvents++
+				}
+			}
+			if planEvents == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for plan events, got %+v", events)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitPlanEvents(everything, 2)
+	waitPlanEvents(failuresOnly, 1)
+
+	events, bad := failuresOnly.received()
+	if len(events) != 1 || events[0].Type != store.WebhookEventPlanFailed || planStatus[events[0].ResourceID] != "FAILED" {
+		t.Fatalf("expected only the failed plan on the failures-only webhook, got %+v", events)
+	}
+	if events[0].TenantID != tenantID || events[0].SiteID != siteID {
+		t.Fatalf("unexpected event scope %+v", events[0])
+	}
+	if _, everythingBad := everything.received(); len(bad) > 0 || len(everythingBad) > 0 {
+		t.Fatalf("expected signed deliveries, got bad signatures on %v %v", bad, everythingBad)
+	}
+}
+
+func TestWebhookRejectsInternalTargets(t *testing.T) {
+	app, repo, tenantID, _, _ := newTestAppWithEnrollmentToken(t)
+	plainAPIKey := "nk_test_key"
+	if _, err := repo.CreateAPIKey(context.Background(), store.APIKey{ID: uuid.NewString(), TenantID: tenantID, Name: "ops", KeyHash: hashString(plainAPIKey)}); err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+	} {
+		rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/webhooks", plainAPIKey, map[string]any{"url": target}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be rejected, got %d: %s", target, rec.Code, rec.Body.String())
+		}
+	}
+	rec := doJSON(t, app.Handler(), "POST", "/tenants/"+tenantID+"/webhooks", plainAPIKey, map[string]any{"url": "https://hooks.example.com/nkudo"}, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected a public host to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A host name resolving to loopback is refused when it is dialed.
+	rcv := newWebhookReceiver(t)
+	d := newWebhookDispatcher(repo, app.cfg)
+	d.deliver(context.Background(), webhookDelivery{
+		hook:  store.Webhook{ID: "hook-1", URL: strings.Replace(rcv.URL, "127.0.0.1", "localhost", 1)},
+		event: webhookEvent{Type: store.WebhookEventPlanFailed},
+	})
+	if events, _ := rcv.received(); len(events) != 0 {
+		t.Fatalf("expected no delivery to loopback, got %+v", events)
+	}
+}
+
+func TestWebhookSlowEndpointDoesNotBlockOthers(t *testing.T) {
+	cfg := LoadConfig()
+	cfg.WebhookAllowPrivateTargets = true
+	d := newWebhookDispatcher(store.NewMemoryRepo(), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.Start(ctx)
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := newWebhookReceiver(t)
+
+	event := webhookEvent{Type: store.WebhookEventPlanFailed}
+	for range 3 {
+		d.enqueue(webhookDelivery{hook: store.Webhook{ID: "slow", URL: slow.URL}, event: event})
+	}
+	d.enqueue(webhookDelivery{hook: store.Webhook{ID: "fast", URL: fast.URL}, event: event})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if events, _ := fast.received(); len(events) == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a slow webhook held up delivery to another webhook")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookEventType(t *testing.T) {
+	cases := []struct {
+		event siteEvent
+		want  string
+	}{
+		{siteEvent{Type: siteEventPlanStatus, State: "SUCCEEDED"}, store.WebhookEventPlanSucceeded},
+		{siteEvent{Type: siteEventPlanStatus, State: "FAILED"}, store.WebhookEventPlanFailed},
+		{siteEvent{Type: siteEventPlanStatus, State: "IN_PROGRESS"}, ""},
+		{siteEvent{Type: siteEventAgentState, State: "OFFLINE"}, store.WebhookEventAgentOffline},
+		{siteEvent{Type: siteEventAgentState, State: "ONLINE"}, ""},
+		{siteEvent{Type: siteEventVMState, State: "ERROR"}, store.WebhookEventVMError},
+		{siteEvent{Type: siteEventVMState, State: "RUNNING"}, ""},
+	}
+	for _, c := range cases {
+		if got := webhookEventType(c.event); got != c.want {
+			t.Fatalf("webhookEventType(%+v) = %q, want %q", c.event, got, c.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"time"
 
 	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
@@ -15,12 +16,19 @@ import (
 // GenesisHash is the hash used for the first entry in the chain (or when no previous entry exists).
 const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
 
+// incrementalBatchSize is the number of events read per page during
+// incremental verification.
+const incrementalBatchSize = 1000
+
 // ChainVerificationResult represents the result of a chain verification operation.
 type ChainVerificationResult struct {
 	Valid      bool  `json:"valid"`       // True if entire chain is valid
 	Total      int   `json:"total"`       // Total number of events checked
 	Invalid    int   `json:"invalid"`     // Number of invalid events found
 	FirstValid int64 `json:"first_valid"` // ID of the first valid event (or 0 if none)
+	// Incremental is set when only events after the checkpoint at Since were checked.
+	Incremental bool  `json:"incremental"`
+	Since       int64 `json:"since,omitempty"`
 }
 
 // ChainManager handles audit event chain integrity operations.
@@ -152,6 +160,7 @@ func (cm *ChainManager) calculateHash(event *store.AuditEvent) string {
 // 1. Each event's EntryHash matches the calculated hash
 // 2. Each event's PrevHash matches the previous event's EntryHash
 // 3. The chain starts with a valid GenesisHash reference
+// A valid chain moves the verification checkpoint to its last event.
 func (cm *ChainManager) VerifyChain(ctx context.Context) (*ChainVerificationResult, error) {
 	// Get all audit events ordered by ID
 	events, err := cm.repo.ListAuditEvents(ctx, "", 0) // Empty tenantID = all events, 0 = no limit
@@ -159,33 +168,63 @@ func (cm *ChainManager) VerifyChain(ctx context.Context) (*ChainVerificationResu
 		return nil, fmt.Errorf("failed to list audit events: %w", err)
 	}
 
-	result := &ChainVerificationResult{
-		Valid:   true,
-		Total:   len(events),
-		Invalid: 0,
+	result := &ChainVerificationResult{Valid: true}
+	lastHash := cm.verifyEvents(ctx, events, GenesisHash, result)
+	if result.Valid && len(events) > 0 {
+		cm.saveCheckpoint(ctx, events[len(events)-1].ID, lastHash)
 	}
+	return result, nil
+}
 
-	if len(events) == 0 {
-		return result, nil
+// VerifyChainIncremental verifies only the events appended after the
+// verification checkpoint, linking the first of them to the checkpoint's
+// hash. The checkpoint only advances over valid events, so a broken link
+// keeps being reported until it is repaired. Tampering with events before
+// the checkpoint is caught by VerifyChain.
+func (cm *ChainManager) VerifyChainIncremental(ctx context.Context) (*ChainVerificationResult, error) {
+	checkpoint, err := cm.repo.GetAuditCheckpoint(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit checkpoint: %w", err)
+	}
+	prevHash := GenesisHash
+	if checkpoint.EventID > 0 {
+		prevHash = checkpoint.EntryHash
 	}
 
-	var prevHash string
-	var firstValidFound bool
+	result := &ChainVerificationResult{Valid: true, Incremental: true, Since: checkpoint.EventID}
+	afterID := checkpoint.EventID
+	for {
+		events, err := cm.repo.ListAuditEventsAfter(ctx, afterID, incrementalBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list audit events: %w", err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		prevHash = cm.verifyEvents(ctx, events, prevHash, result)
+		afterID = events[len(events)-1].ID
+		if result.Valid {
+			cm.saveCheckpoint(ctx, afterID, prevHash)
+		}
+		if len(events) < incrementalBatchSize {
+			break
+		}
+	}
+	return result, nil
+}
 
-	for i, event := range events {
+// verifyEvents checks events in order, the first of which must reference
+// prevHash, and adds the outcome to result. It returns the EntryHash of the
+// last event for the next segment to link to.
+func (cm *ChainManager) verifyEvents(ctx context.Context, events []store.AuditEvent, prevHash string, result *ChainVerificationResult) string {
+	for _, event := range events {
+		result.Total++
 		isValid := true
 
-		// Check if this is the first event
-		if i == 0 {
-			// First event should reference GenesisHash
-			if event.PrevHash != GenesisHash {
-				isValid = false
-			}
-		} else {
-			// Subsequent events should reference the previous event's hash
-			if event.PrevHash != prevHash {
-				isValid = false
-			}
+		// Each event must reference the previous event's hash, or the
+		// GenesisHash for the first event of the chain.
+		if event.PrevHash != prevHash {
+			isValid = false
 		}
 
 		// Verify the entry hash
@@ -206,15 +245,22 @@ func (cm *ChainManager) VerifyChain(ctx context.Context) (*ChainVerificationResu
 		if !isValid {
 			result.Valid = false
 			result.Invalid++
-		} else if !firstValidFound {
+		} else if result.FirstValid == 0 {
 			result.FirstValid = event.ID
-			firstValidFound = true
 		}
 
 		prevHash = event.EntryHash
 	}
+	return prevHash
+}
 
-	return result, nil
+// saveCheckpoint records id as verified. Failing to save only costs the next
+// incremental run a longer scan, so the error is logged and dropped.
+func (cm *ChainManager) saveCheckpoint(ctx context.Context, id int64, entryHash string) {
+	checkpoint := store.AuditCheckpoint{EventID: id, EntryHash: entryHash, VerifiedAt: time.Now().UTC()}
+	if err := cm.repo.SetAuditCheckpoint(ctx, checkpoint); err != nil {
+		log.Printf("[audit] Failed to save verification checkpoint at event %d: %v", id, err)
+	}
 }
 
 // VerifyEvent verifies a single audit event's integrity.
@@ -2,6 +2,7 @@ package audit
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
@@ -18,6 +19,8 @@ type mockRepo struct {
 	updateErr    error
 	lastWrite    *store.AuditEvent
 	validityUpdates map[int64]bool
+	checkpoint      store.AuditCheckpoint
+	scanned         int // events returned by ListAuditEventsAfter
 }
 
 func newMockRepo() *mockRepo {
@@ -82,6 +85,32 @@ func (m *mockRepo) ListAuditEvents(ctx context.Context, tenantID string, limit i
 	return filtered, nil
 }
 
+func (m *mockRepo) ListAuditEventsAfter(ctx context.Context, afterID int64, limit int) ([]store.AuditEvent, error) {
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+	var out []store.AuditEvent
+	for _, e := range m.events {
+		if e.ID > afterID {
+			out = append(out, e)
+		}
+	}
+	if limit > 0 && limit < len(out) {
+		out = out[:limit]
+	}
+	m.scanned += len(out)
+	return out, nil
+}
+
+func (m *mockRepo) GetAuditCheckpoint(ctx context.Context) (store.AuditCheckpoint, error) {
+	return m.checkpoint, nil
+}
+
+func (m *mockRepo) SetAuditCheckpoint(ctx context.Context, checkpoint store.AuditCheckpoint) error {
+	m.checkpoint = checkpoint
+	return nil
+}
+
 // Required interface methods - not used in tests
 func (m *mockRepo) CreateTenant(ctx context.Context, t store.Tenant) (store.Tenant, error) { return t, nil }
 func (m *mockRepo) CreateAPIKey(ctx context.Context, key store.APIKey) (store.APIKey, error) { return key, nil }
@@ -89,18 +118,23 @@ func (m *mockRepo) ValidateAPIKey(ctx context.Context, keyHash string) (store.AP
 func (m *mockRepo) CreateSite(ctx context.Context, site store.Site) (store.Site, error) { return site, nil }
 func (m *mockRepo) ListSites(ctx context.Context, tenantID string) ([]store.Site, error) { return nil, nil }
 func (m *mockRepo) IssueEnrollmentToken(ctx context.Context, token store.EnrollmentToken) (store.EnrollmentToken, error) { return token, nil }
+func (m *mockRepo) EnrollmentTokenSite(ctx context.Context, tokenHash string, now time.Time) (string, error) { return "", nil }
 func (m *mockRepo) ConsumeEnrollmentToken(ctx context.Context, tokenHash string, now time.Time) (store.TokenConsumeResult, error) { return store.TokenConsumeResult{}, nil }
 func (m *mockRepo) CreateAgentFromEnrollment(ctx context.Context, tokenID string, agent store.Agent, hostname string) (store.Agent, error) { return agent, nil }
 func (m *mockRepo) GetAgentByID(ctx context.Context, agentID string) (store.Agent, error) { return store.Agent{}, nil }
+func (m *mockRepo) GetAgentEnrollment(ctx context.Context, agentID string) (store.AgentEnrollment, error) { return store.AgentEnrollment{}, nil }
 func (m *mockRepo) IngestHeartbeat(ctx context.Context, hb store.Heartbeat) error { return nil }
 func (m *mockRepo) ApplyPlan(ctx context.Context, input store.ApplyPlanInput) (store.ApplyPlanResult, error) { return store.ApplyPlanResult{}, nil }
 func (m *mockRepo) LeasePendingPlans(ctx context.Context, agentID string, limit int, leaseTTL time.Duration) ([]store.LeasedPlan, error) { return nil, nil }
 func (m *mockRepo) ReportPlanResult(ctx context.Context, agentID string, report store.PlanResultReport) error { return nil }
 func (m *mockRepo) IngestLogs(ctx context.Context, req store.LogIngest) (accepted int64, dropped int64, err error) { return 0, 0, nil }
-func (m *mockRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) (int64, error) { return 0, nil }
+func (m *mockRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) ([]store.Agent, error) { return nil, nil }
 func (m *mockRepo) ListHosts(ctx context.Context, tenantID, siteID string) ([]store.Host, error) { return nil, nil }
 func (m *mockRepo) ListVMs(ctx context.Context, tenantID, siteID string) ([]store.MicroVM, error) { return nil, nil }
 func (m *mockRepo) ListExecutionLogs(ctx context.Context, tenantID, executionID string, limit int) ([]store.ExecutionLog, error) { return nil, nil }
+func (m *mockRepo) GetExecutionLogStats(ctx context.Context, tenantID, executionID string) (store.ExecutionLogStats, error) {
+	return store.ExecutionLogStats{}, nil
+}
 func (m *mockRepo) WriteAudit(ctx context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error { return nil }
 func (m *mockRepo) SiteBelongsToTenant(ctx context.Context, siteID, tenantID string) (bool, error) { return true, nil }
 func (m *mockRepo) ExecutionBelongsToTenant(ctx context.Context, executionID, tenantID string) (bool, error) { return true, nil }
@@ -109,10 +143,11 @@ func (m *mockRepo) ListExecutions(ctx context.Context, tenantID, siteID string,
 func (m *mockRepo) ListAPIKeys(ctx context.Context, tenantID string) ([]store.APIKey, error) { return nil, nil }
 func (m *mockRepo) DeleteAPIKey(ctx context.Context, tenantID, keyID string) error { return nil }
 func (m *mockRepo) UnenrollAgent(ctx context.Context, agentID string) error { return nil }
+func (m *mockRepo) ReleaseAgentPlans(ctx context.Context, agentID string) ([]string, error) { return nil, nil }
 func (m *mockRepo) UpdateAgentCertificate(ctx context.Context, agentID, certSerial, refreshTokenHash string) error { return nil }
 func (m *mockRepo) IsCertificateRevoked(ctx context.Context, serial string) (bool, error) { return false, nil }
 func (m *mockRepo) RevokeCertificate(ctx context.Context, serial string, reason int, agentID string) error { return nil }
-func (m *mockRepo) ListRevokedCertificates(ctx context.Context) ([]store.CRLEntry, error) { return nil, nil }
+func (m *mockRepo) ListRevokedCertificates(ctx context.Context, query store.RevokedCertificateQuery) ([]store.CRLEntry, error) { return nil, nil }
 func (m *mockRepo) ListCertificateHistory(ctx context.Context, agentID string, limit int) ([]store.CertificateHistory, error) { return nil, nil }
 func (m *mockRepo) RecordCertificateIssuance(ctx context.Context, history store.CertificateHistory) error { return nil }
 func (m *mockRepo) Close() error { return nil }
@@ -190,6 +225,147 @@ func (m *mockRepo) ListVMNetworkAttachments(ctx context.Context, vmID string) ([
 func (m *mockRepo) ListNetworkVMAttachments(ctx context.Context, networkID string) ([]store.VMNetworkAttachment, error) {
 	return nil, nil
 }
+func (m *mockRepo) GetAgentNetworkStatus(ctx context.Context, tenantID, agentID string) (store.AgentNetworkStatus, error) {
+	return store.AgentNetworkStatus{}, store.ErrNotFound
+}
+func (m *mockRepo) ListAgentMetrics(ctx context.Context, tenantID, siteID string) ([]store.AgentMetrics, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListAgentConnectivityHistory(ctx context.Context, tenantID, agentID string, from, to time.Time, limit int) ([]store.ConnectivityTransition, error) {
+	return nil, nil
+}
+func (m *mockRepo) GetPlanStats(ctx context.Context, tenantID, siteID string, from, to time.Time) (store.PlanStats, error) {
+	return store.PlanStats{}, nil
+}
+func (m *mockRepo) GetPlan(ctx context.Context, tenantID, planID string) (store.Plan, error) {
+	return store.Plan{}, store.ErrNotFound
+}
+func (m *mockRepo) RevokeTenantAgentCertificates(ctx context.Context, tenantID string, reason int) ([]store.Agent, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListPrometheusTargets(ctx context.Context, tenantID, siteID string) ([]store.PrometheusTarget, error) {
+	return nil, nil
+}
+func (m *mockRepo) SetHostMaintenance(ctx context.Context, tenantID, siteID, hostID string, maintenance bool) (store.Host, error) {
+	return store.Host{}, nil
+}
+func (m *mockRepo) SetAgentMetadata(ctx context.Context, tenantID, siteID, agentID string, metadata json.RawMessage) error {
+	return nil
+}
+func (m *mockRepo) AgentHostInMaintenance(ctx context.Context, agentID string) (bool, error) {
+	return false, nil
+}
+func (m *mockRepo) GetCapacity(ctx context.Context, tenantID, siteID string) (store.Capacity, error) {
+	return store.Capacity{}, nil
+}
+func (m *mockRepo) SetTenantLogSeverity(ctx context.Context, tenantID, severity string) (store.Tenant, error) {
+	return store.Tenant{}, nil
+}
+func (m *mockRepo) RecordTenantUsage(ctx context.Context, tenantID string, at time.Time, usage store.TenantUsage) error {
+	return nil
+}
+func (m *mockRepo) ListTenantUsageHistory(ctx context.Context, tenantID string, from, to time.Time) ([]store.TenantUsageSnapshot, error) {
+	return nil, nil
+}
+func (m *mockRepo) PruneTenantUsageHistory(ctx context.Context, cutoff time.Time) (int64, error) {
+	return 0, nil
+}
+func (m *mockRepo) RetryPlan(ctx context.Context, tenantID, planID string, failedOnly bool) (store.ApplyPlanResult, error) {
+	return store.ApplyPlanResult{}, nil
+}
+func (m *mockRepo) MigrateVM(ctx context.Context, tenantID, siteID, vmID, targetHostID string) (store.VMMigration, error) {
+	return store.VMMigration{}, nil
+}
+func (m *mockRepo) GetVMMigration(ctx context.Context, tenantID, migrationID string) (store.VMMigration, error) {
+	return store.VMMigration{}, nil
+}
+func (m *mockRepo) ListVMNetworks(ctx context.Context, tenantID, vmID string) ([]store.VMNetworkAttachmentWithNetwork, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListVMDNSRecords(ctx context.Context, siteID, networkID string) ([]store.VMDNSRecord, error) {
+	return nil, nil
+}
+func (m *mockRepo) PutExecutionConsoleLog(ctx context.Context, agentID string, upload store.ConsoleLogUpload) (store.ExecutionConsoleLog, error) {
+	return store.ExecutionConsoleLog{}, nil
+}
+func (m *mockRepo) GetExecutionConsoleLog(ctx context.Context, tenantID, executionID string) (store.ExecutionConsoleLog, error) {
+	return store.ExecutionConsoleLog{}, nil
+}
+func (m *mockRepo) PutQuotaTemplate(ctx context.Context, template store.QuotaTemplate) (store.QuotaTemplate, error) {
+	return template, nil
+}
+func (m *mockRepo) GetQuotaTemplate(ctx context.Context, name string) (store.QuotaTemplate, error) {
+	return store.QuotaTemplate{}, nil
+}
+func (m *mockRepo) ListQuotaTemplates(ctx context.Context) ([]store.QuotaTemplate, error) {
+	return nil, nil
+}
+func (m *mockRepo) DeleteQuotaTemplate(ctx context.Context, name string) error {
+	return nil
+}
+func (m *mockRepo) CreateWebhook(ctx context.Context, webhook store.Webhook) (store.Webhook, error) {
+	return webhook, nil
+}
+func (m *mockRepo) ListWebhooks(ctx context.Context, tenantID string) ([]store.Webhook, error) {
+	return nil, nil
+}
+func (m *mockRepo) DeleteWebhook(ctx context.Context, tenantID, webhookID string) error {
+	return nil
+}
+func (m *mockRepo) ListSiteWebhooks(ctx context.Context, siteID string) ([]store.Webhook, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListTenantAgents(ctx context.Context, tenantID string, query store.TenantAgentQuery) ([]store.TenantAgent, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListLeasedPlans(ctx context.Context, tenantID, agentID string) ([]store.LeasedPlan, error) {
+	return nil, nil
+}
+func (m *mockRepo) ListPlanExecutions(ctx context.Context, tenantID, planID string) ([]store.Execution, error) {
+	return nil, nil
+}
+func (m *mockRepo) GetSiteImageDefaults(ctx context.Context, tenantID, siteID string) (map[string]store.VMImage, error) {
+	return nil, nil
+}
+func (m *mockRepo) SetSiteImageDefaults(ctx context.Context, tenantID, siteID string, images map[string]store.VMImage) error {
+	return nil
+}
+func (m *mockRepo) SetSiteVMNamePolicy(ctx context.Context, tenantID, siteID string, uniqueNames bool, nameTemplate string) error {
+	return nil
+}
+func (m *mockRepo) GetSiteDesiredState(ctx context.Context, tenantID, siteID string) (store.DesiredState, error) {
+	return store.DesiredState{}, nil
+}
+func (m *mockRepo) SetSiteDesiredState(ctx context.Context, tenantID, siteID string, state store.DesiredState) error {
+	return nil
+}
+func (m *mockRepo) GetSiteAgentRollout(ctx context.Context, tenantID, siteID string) (store.AgentRollout, error) {
+	return store.AgentRollout{}, nil
+}
+func (m *mockRepo) SetSiteAgentRollout(ctx context.Context, tenantID, siteID string, rollout store.AgentRollout) error {
+	return nil
+}
+func (m *mockRepo) ClaimAgentUpgrade(ctx context.Context, agentID, version string) (string, error) {
+	return "", nil
+}
+func (m *mockRepo) ReportAgentUpgrade(ctx context.Context, agentID string, report store.AgentUpgradeReport) error {
+	return nil
+}
+func (m *mockRepo) ListSiteAgentUpgrades(ctx context.Context, tenantID, siteID string) ([]store.AgentUpgrade, error) {
+	return nil, nil
+}
+func (m *mockRepo) RotateTenantEncryption(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+func (m *mockRepo) ExpirePendingPlans(ctx context.Context, createdBefore time.Time) ([]store.Plan, error) {
+	return nil, nil
+}
+func (m *mockRepo) PurgePlans(ctx context.Context, createdBefore time.Time) (int64, error) {
+	return 0, nil
+}
+func (m *mockRepo) ReleaseIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int64, error) {
+	return 0, nil
+}
 
 func TestNewChainManager(t *testing.T) {
 	repo := newMockRepo()
@@ -583,6 +759,152 @@ func TestGetChainInfo(t *testing.T) {
 	}
 }
 
+func appendTestEvents(t *testing.T, cm *ChainManager, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := cm.CreateAuditEvent(context.Background(), store.AuditEventInput{
+			TenantID:     "tenant-1",
+			ActorType:    "USER",
+			Action:       "test.action",
+			ResourceType: "test",
+			ResourceID:   "res-" + string(rune('a'+i)),
+		})
+		if err != nil {
+			t.Fatalf("CreateAuditEvent failed: %v", err)
+		}
+	}
+}
+
+func TestVerifyChainIncremental_FromGenesis(t *testing.T) {
+	repo := newMockRepo()
+	cm := NewChainManager(repo)
+	ctx := context.Background()
+	appendTestEvents(t, cm, 3)
+
+	result, err := cm.VerifyChainIncremental(ctx)
+	if err != nil {
+		t.Fatalf("VerifyChainIncremental failed: %v", err)
+	}
+	if !result.Valid || !result.Incremental || result.Total != 3 || result.Since != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if repo.checkpoint.EventID != 3 || repo.checkpoint.EntryHash != repo.events[2].EntryHash {
+		t.Fatalf("checkpoint not advanced to the head: %+v", repo.checkpoint)
+	}
+
+	// Nothing appended since: nothing to check.
+	repo.scanned = 0
+	result, err = cm.VerifyChainIncremental(ctx)
+	if err != nil {
+		t.Fatalf("VerifyChainIncremental failed: %v", err)
+	}
+	if !result.Valid || result.Total != 0 || result.Since != 3 || repo.scanned != 0 {
+		t.Fatalf("expected an empty incremental run, got %+v (scanned %d)", result, repo.scanned)
+	}
+}
+
+func TestVerifyChainIncremental_DetectsAppendedCorruption(t *testing.T) {
+	repo := newMockRepo()
+	cm := NewChainManager(repo)
+	ctx := context.Background()
+	appendTestEvents(t, cm, 50)
+
+	// A full run sets the checkpoint at the head of the chain.
+	if result, err := cm.VerifyChain(ctx); err != nil || !result.Valid {
+		t.Fatalf("VerifyChain = %+v, %v", result, err)
+	}
+	if repo.checkpoint.EventID != 50 {
+		t.Fatalf("expected checkpoint at 50, got %d", repo.checkpoint.EventID)
+	}
+
+	appendTestEvents(t, cm, 2)
+	repo.events[len(repo.events)-1].Action = "tampered"
+	repo.scanned = 0
+
+	result, err := cm.VerifyChainIncremental(ctx)
+	if err != nil {
+		t.Fatalf("VerifyChainIncremental failed: %v", err)
+	}
+	if result.Valid {
+		t.Fatal("incremental verification should detect the corrupted event")
+	}
+	if result.Total != 2 || result.Invalid != 1 || result.Since != 50 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if repo.scanned != 2 {
+		t.Fatalf("expected only the 2 new events to be scanned, got %d", repo.scanned)
+	}
+	if valid, ok := repo.validityUpdates[52]; !ok || valid {
+		t.Fatal("corrupted event should be marked invalid")
+	}
+	if repo.checkpoint.EventID != 50 {
+		t.Fatalf("checkpoint must not advance past a broken chain, got %d", repo.checkpoint.EventID)
+	}
+
+	// The corruption keeps being reported on later runs.
+	result, err = cm.VerifyChainIncremental(ctx)
+	if err != nil || result.Valid {
+		t.Fatalf("expected the corruption to be reported again, got %+v, %v", result, err)
+	}
+}
+
+func TestVerifyChainIncremental_DetectsBrokenLinkToCheckpoint(t *testing.T) {
+	repo := newMockRepo()
+	cm := NewChainManager(repo)
+	ctx := context.Background()
+	appendTestEvents(t, cm, 3)
+	if _, err := cm.VerifyChainIncremental(ctx); err != nil {
+		t.Fatalf("VerifyChainIncremental failed: %v", err)
+	}
+
+	// An event whose own hash is consistent but which does not link to the
+	// last verified event.
+	event := &store.AuditEvent{
+		ID:           4,
+		TenantID:     "tenant-1",
+		ActorType:    "USER",
+		Action:       "test.action",
+		ResourceType: "test",
+		ResourceID:   "res-x",
+		OccurredAt:   time.Now().UTC(),
+		PrevHash:     GenesisHash,
+		ChainValid:   true,
+	}
+	event.EntryHash = cm.calculateHash(event)
+	repo.events = append(repo.events, *event)
+
+	result, err := cm.VerifyChainIncremental(ctx)
+	if err != nil {
+		t.Fatalf("VerifyChainIncremental failed: %v", err)
+	}
+	if result.Valid || result.Invalid != 1 {
+		t.Fatalf("expected the broken link to be detected, got %+v", result)
+	}
+}
+
+func TestBackgroundVerifier_FullVerificationCadence(t *testing.T) {
+	repo := newMockRepo()
+	cm := NewChainManager(repo)
+	appendTestEvents(t, cm, 3)
+	bv := NewBackgroundVerifier(cm, time.Minute, time.Hour)
+	ctx := context.Background()
+
+	bv.lastFull = time.Now()
+	bv.runVerification(ctx)
+	if r := bv.GetLastResult(); r == nil || !r.Incremental {
+		t.Fatalf("expected an incremental run, got %+v", r)
+	}
+
+	bv.lastFull = time.Now().Add(-2 * time.Hour)
+	bv.runVerification(ctx)
+	if r := bv.GetLastResult(); r == nil || r.Incremental || r.Total != 3 {
+		t.Fatalf("expected a full run over 3 events, got %+v", r)
+	}
+	if time.Since(bv.lastFull) > time.Minute {
+		t.Fatal("full run should reset the cadence")
+	}
+}
+
 func TestGenesisHash(t *testing.T) {
 	// Verify GenesisHash constant
 	expected := "0000000000000000000000000000000000000000000000000000000000000000"
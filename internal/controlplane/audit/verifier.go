@@ -8,24 +8,33 @@ import (
 )
 
 // BackgroundVerifier runs periodic chain integrity checks in the background.
+// Each run checks only the events appended since the last verified one; the
+// whole chain is rescanned every fullInterval.
 type BackgroundVerifier struct {
 	chainManager *ChainManager
 	interval     time.Duration
+	fullInterval time.Duration
+	lastFull     time.Time
 	stopCh       chan struct{}
 	lastResult   *ChainVerificationResult
 	running      bool
 }
 
 // NewBackgroundVerifier creates a new background verifier.
-// The interval parameter specifies how often to run verification checks.
-func NewBackgroundVerifier(chainManager *ChainManager, interval time.Duration) *BackgroundVerifier {
+// The interval parameter specifies how often to run incremental checks and
+// fullInterval how often to verify the whole chain.
+func NewBackgroundVerifier(chainManager *ChainManager, interval, fullInterval time.Duration) *BackgroundVerifier {
 	if interval <= 0 {
 		interval = 5 * time.Minute // Default interval
 	}
+	if fullInterval <= 0 {
+		fullInterval = 24 * time.Hour // Default full verification interval
+	}
 
 	return &BackgroundVerifier{
 		chainManager: chainManager,
 		interval:     interval,
+		fullInterval: fullInterval,
 		stopCh:       make(chan struct{}),
 		running:      false,
 	}
@@ -44,6 +53,10 @@ func (bv *BackgroundVerifier) Start(ctx context.Context) {
 
 	log.Println("[audit] Background verifier started")
 
+	// The checkpoint persists across restarts, so startup only verifies
+	// what was appended since; the first full pass is a fullInterval away.
+	bv.lastFull = time.Now()
+
 	// Run initial verification
 	bv.runVerification(ctx)
 
@@ -81,10 +94,18 @@ func (bv *BackgroundVerifier) GetLastResult() *ChainVerificationResult {
 	return bv.lastResult
 }
 
-// runVerification performs a single verification run.
+// runVerification performs a single verification run, full if fullInterval
+// has passed since the last full run and incremental otherwise.
 func (bv *BackgroundVerifier) runVerification(ctx context.Context) {
 	start := time.Now()
-	result, err := bv.chainManager.VerifyChain(ctx)
+	var result *ChainVerificationResult
+	var err error
+	if start.Sub(bv.lastFull) >= bv.fullInterval {
+		result, err = bv.chainManager.VerifyChain(ctx)
+		bv.lastFull = start
+	} else {
+		result, err = bv.chainManager.VerifyChainIncremental(ctx)
+	}
 	if err != nil {
 		log.Printf("[audit] Chain verification failed: %v", err)
 		return
@@ -97,12 +118,12 @@ func (bv *BackgroundVerifier) runVerification(ctx context.Context) {
 		log.Printf("[audit] WARNING: Chain integrity check FAILED - %d/%d events invalid (first valid: %d, took %v)",
 			result.Invalid, result.Total, result.FirstValid, duration)
 	} else {
-		log.Printf("[audit] Chain integrity check PASSED - %d events verified (took %v)",
-			result.Total, duration)
+		log.Printf("[audit] Chain integrity check PASSED - %d events verified (incremental: %t, took %v)",
+			result.Total, result.Incremental, duration)
 	}
 }
 
-// VerifyOnDemand performs an on-demand verification and returns the result.
+// VerifyOnDemand performs an on-demand full verification and returns the result.
 // This can be called independently of the background verification.
 func (bv *BackgroundVerifier) VerifyOnDemand(ctx context.Context) (*ChainVerificationResult, error) {
 	return bv.chainManager.VerifyChain(ctx)
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// AgentMetricNames are the metrics agents may push with heartbeats. Other
+// names are dropped, so the stored snapshot of an agent stays bounded.
+var AgentMetricNames = []string{
+	"vms_running",
+	"vms_stopped",
+	"heartbeats_sent_total",
+	"heartbeat_failures_total",
+	"heartbeat_duration_seconds_sum",
+	"heartbeat_duration_seconds_count",
+	"actions_executed_total",
+	"vm_restarts_total",
+	"host_cpu_cores",
+	"host_memory_total_bytes",
+	"host_memory_free_bytes",
+	"host_memory_usage_bytes",
+}
+
+// AgentMetrics is the latest metrics snapshot an agent pushed.
+type AgentMetrics struct {
+	AgentID    string             `json:"agent_id"`
+	TenantID   string             `json:"-"`
+	SiteID     string             `json:"site_id"`
+	Metrics    map[string]float64 `json:"metrics"`
+	ReportedAt time.Time          `json:"reported_at"`
+}
+
+// FilterAgentMetrics keeps the known metrics of a pushed snapshot with
+// finite values and returns how many it dropped.
+func FilterAgentMetrics(pushed map[string]float64) (map[string]float64, int) {
+	if pushed == nil {
+		return nil, 0
+	}
+	kept := make(map[string]float64, len(pushed))
+	for name, v := range pushed {
+		if slices.Contains(AgentMetricNames, name) && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			kept[name] = v
+		}
+	}
+	return kept, len(pushed) - len(kept)
+}
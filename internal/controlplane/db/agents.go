@@ -0,0 +1,45 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ValidAgentState reports whether s is one of the agent_state values.
+func ValidAgentState(s string) bool {
+	switch s {
+	case "ONLINE", "DEGRADED", "OFFLINE":
+		return true
+	}
+	return false
+}
+
+// TenantAgent is one agent in a tenant's inventory, with the site and host
+// it runs on and the expiry of its current client certificate.
+type TenantAgent struct {
+	ID              string          `json:"id"`
+	SiteID          string          `json:"site_id"`
+	SiteName        string          `json:"site_name"`
+	HostID          string          `json:"host_id"`
+	Hostname        string          `json:"hostname"`
+	State           string          `json:"state"`
+	AgentVersion    string          `json:"agent_version"`
+	OS              string          `json:"os"`
+	Arch            string          `json:"arch"`
+	LastHeartbeatAt *time.Time      `json:"last_heartbeat_at,omitempty"`
+	CertExpiresAt   *time.Time      `json:"cert_expires_at,omitempty"`
+	Metadata        json.RawMessage `json:"metadata,omitempty"`
+	// LastShutdownReason says why the agent last stopped, as reported on
+	// its final heartbeat or after a crash; LastShutdownAt is when it was
+	// recorded.
+	LastShutdownReason string     `json:"last_shutdown_reason,omitempty"`
+	LastShutdownAt     *time.Time `json:"last_shutdown_at,omitempty"`
+}
+
+// TenantAgentQuery filters and pages ListTenantAgents. Agents are ordered
+// by ID; Cursor is the last ID of the previous page.
+type TenantAgentQuery struct {
+	State  string
+	Cursor string
+	Limit  int
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxBootDelay is the longest ApplyPlanAction.BootDelaySeconds; the agent
+// enforces the same bound.
+const MaxBootDelay = model.MaxBootDelay
+
+// BootSequence returns the actions in the order the agent runs them:
+// actions with a BootOrder run by ascending BootOrder, ties in plan order,
+// in the positions the plan gave them; the others keep their place.
+func BootSequence(actions []ApplyPlanAction) []ApplyPlanAction {
+	out := make([]ApplyPlanAction, 0, len(actions))
+	for _, i := range bootSequenceIndexes(actions) {
+		out = append(out, actions[i])
+	}
+	return out
+}
+
+// bootSequenceIndexes returns the plan indexes of the actions in boot
+// sequence.
+func bootSequenceIndexes(actions []ApplyPlanAction) []int {
+	orders := make([]int, len(actions))
+	for i, a := range actions {
+		orders[i] = a.BootOrder
+	}
+	return model.BootSequence(orders)
+}
+
+// ValidateBootOrder checks the boot_order and boot_delay_seconds of a
+// plan's actions: only CREATE and START carry them, within bounds, and the
+// boot sequence must keep every depends_on and every VM's actions in plan
+// order.
+func ValidateBootOrder(actions []ApplyPlanAction) error {
+	ordered := false
+	for _, a := range actions {
+		if a.BootOrder == 0 && a.BootDelaySeconds == 0 {
+			continue
+		}
+		switch strings.ToUpper(strings.TrimSpace(a.Operation)) {
+		case "CREATE", "START":
+		default:
+			return fmt.Errorf("action %s: boot_order and boot_delay_seconds are only supported on CREATE and START", a.OperationID)
+		}
+		if a.BootOrder < 0 {
+			return fmt.Errorf("action %s: boot_order must not be negative", a.OperationID)
+		}
+		if a.BootDelaySeconds < 0 || a.BootDelaySeconds > MaxBootDelay {
+			return fmt.Errorf("action %s: boot_delay_seconds must be between 0 and %d", a.OperationID, MaxBootDelay)
+		}
+		ordered = ordered || a.BootOrder > 0
+	}
+	if !ordered {
+		return nil
+	}
+
+	ran := make(map[string]bool, len(actions))
+	lastOfVM := make(map[string]int, len(actions))
+	for _, i := range bootSequenceIndexes(actions) {
+		a := actions[i]
+		for _, dep := range a.DependsOn {
+			if !ran[dep] {
+				return fmt.Errorf("action %s: boot_order runs it before its dependency %s", a.OperationID, dep)
+			}
+		}
+		if vmID := strings.TrimSpace(a.VMID); vmID != "" {
+			if last, ok := lastOfVM[vmID]; ok && last > i {
+				return fmt.Errorf("action %s: boot_order runs it before an earlier action on vm %s", a.OperationID, vmID)
+			}
+			lastOfVM[vmID] = i
+		}
+		if id := strings.TrimSpace(a.OperationID); id != "" {
+			ran[id] = true
+		}
+	}
+	return nil
+}
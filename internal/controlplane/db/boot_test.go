@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBootSequenceAndValidateBootOrder(t *testing.T) {
+	action := func(id, op, vmID string, order int, deps ...string) ApplyPlanAction {
+		return ApplyPlanAction{OperationID: id, Operation: op, VMID: vmID, BootOrder: order, DependsOn: deps}
+	}
+	ids := func(actions []ApplyPlanAction) string {
+		var out []string
+		for _, a := range actions {
+			out = append(out, a.OperationID)
+		}
+		return fmt.Sprint(out)
+	}
+
+	plan := []ApplyPlanAction{
+		action("web", "START", "vm-web", 3),
+		action("net", "STOP", "vm-old", 0),
+		action("db", "START", "vm-db", 1),
+		action("api", "START", "vm-api", 2, "db"),
+	}
+	if got := ids(BootSequence(plan)); got != "[db net api web]" {
+		t.Fatalf("unexpected boot sequence %s", got)
+	}
+	if err := ValidateBootOrder(plan); err != nil {
+		t.Fatalf("expected a consistent plan to validate: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		actions []ApplyPlanAction
+		want    string
+	}{
+		"stop":     {[]ApplyPlanAction{action("a", "STOP", "vm-a", 1)}, "only supported on CREATE and START"},
+		"delay":    {[]ApplyPlanAction{{OperationID: "a", Operation: "START", VMID: "vm-a", BootDelaySeconds: MaxBootDelay + 1}}, "boot_delay_seconds"},
+		"negative": {[]ApplyPlanAction{action("a", "START", "vm-a", -1)}, "must not be negative"},
+		"dependency": {[]ApplyPlanAction{
+			action("db", "START", "vm-db", 2),
+			action("api", "START", "vm-api", 1, "db"),
+		}, "before its dependency db"},
+		"same vm": {[]ApplyPlanAction{
+			action("create", "CREATE", "vm-a", 2),
+			action("start", "START", "vm-a", 1),
+		}, "before an earlier action on vm vm-a"},
+	} {
+		err := ValidateBootOrder(tc.actions)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected an error containing %q, got %v", name, tc.want, err)
+		}
+	}
+}
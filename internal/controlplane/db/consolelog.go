@@ -0,0 +1,43 @@
+package store
+
+import (
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxConsoleLogBytes bounds the console log kept per execution. Agents
+// truncate before uploading; the store enforces the bound again.
+const MaxConsoleLogBytes = model.MaxConsoleLogBytes
+
+// ConsoleLogUpload is a VM console log sent by the agent after a failed
+// CREATE or START. ExecutionID is the plan execution the agent ran and
+// ActionID the failed action's operation ID.
+type ConsoleLogUpload struct {
+	ExecutionID string
+	ActionID    string
+	VMID        string
+	Content     string
+	Truncated   bool
+}
+
+// ExecutionConsoleLog is the console log of the VM behind a failed
+// execution.
+type ExecutionConsoleLog struct {
+	ExecutionID string    `json:"execution_id"`
+	TenantID    string    `json:"tenant_id"`
+	AgentID     string    `json:"agent_id"`
+	VMID        string    `json:"vm_id,omitempty"`
+	Content     string    `json:"content"`
+	Truncated   bool      `json:"truncated"`
+	CapturedAt  time.Time `json:"captured_at"`
+}
+
+// truncateConsoleLog keeps the tail of content, where a boot failure is
+// reported; see model.TruncateConsoleLog.
+func truncateConsoleLog(content string, truncated bool) (string, bool) {
+	if tail, cut := model.TruncateConsoleLog([]byte(content)); cut {
+		return string(tail), true
+	}
+	return content, truncated
+}
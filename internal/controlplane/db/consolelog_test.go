@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMemoryRepoConsoleLogUploadRequiresTheLease(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	owner := newAgent(t, repo, tenantID, siteID, "host-a")
+	other := newAgent(t, repo, tenantID, siteID, "host-b")
+	applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "console-lease",
+		Actions:        []ApplyPlanAction{{OperationID: "create-1", Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased, err := repo.LeasePendingPlans(ctx, owner.ID, 1, time.Minute); err != nil || len(leased) != 1 {
+		t.Fatalf("lease: %v (%d plans)", err, len(leased))
+	}
+
+	upload := ConsoleLogUpload{ExecutionID: applied.Plan.ID, ActionID: "create-1", VMID: "vm-1", Content: "x" + strings.Repeat("é", MaxConsoleLogBytes)}
+	if _, err := repo.PutExecutionConsoleLog(ctx, other.ID, upload); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected another agent to be refused while the lease is held, got %v", err)
+	}
+	got, err := repo.PutExecutionConsoleLog(ctx, owner.ID, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Truncated || len(got.Content) > MaxConsoleLogBytes || !utf8.ValidString(got.Content) {
+		t.Fatalf("expected the tail cut on a rune boundary, truncated=%v len=%d", got.Truncated, len(got.Content))
+	}
+}
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RevokedCertificateQuery filters and pages ListRevokedCertificates.
+// Entries are ordered newest first by revocation time, then serial, so
+// revocations made while paging land before the first page rather than
+// shifting later ones. Cursor is the CRLCursor of the last entry of the
+// previous page. The zero query lists every entry.
+type RevokedCertificateQuery struct {
+	AgentID string
+	// From and To bound the revocation time; From is inclusive, To
+	// exclusive and a zero bound is open.
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
+}
+
+// CRLCursor returns the cursor that pages past e.
+func CRLCursor(e CRLEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(e.RevokedAt.UTC().Format(time.RFC3339Nano) + "|" + e.SerialNumber))
+}
+
+// ParseCRLCursor returns the revocation time and serial a CRLCursor
+// points at.
+func ParseCRLCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+	at, serial, ok := strings.Cut(string(raw), "|")
+	if !ok || serial == "" {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return time.Time{}, "", errors.New("invalid cursor")
+	}
+	return t, serial, nil
+}
+
+// crlEntryBefore reports whether a sorts before b, newest first.
+func crlEntryBefore(a, b CRLEntry) bool {
+	if !a.RevokedAt.Equal(b.RevokedAt) {
+		return a.RevokedAt.After(b.RevokedAt)
+	}
+	return a.SerialNumber > b.SerialNumber
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepoPagesRevokedCertificates(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepo()
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	repo.crlEntries = map[string]*CRLEntry{}
+	for i := 0; i < 5; i++ {
+		serial := fmt.Sprintf("%02x", i)
+		agentID := "agent-a"
+		if i%2 == 1 {
+			agentID = "agent-b"
+		}
+		// Serials 03 and 04 share a revocation time, so the serial breaks the tie.
+		at := base.Add(time.Duration(min(i, 3)) * time.Hour)
+		repo.crlEntries[serial] = &CRLEntry{SerialNumber: serial, RevokedAt: at, AgentID: agentID}
+	}
+
+	var serials []string
+	query := RevokedCertificateQuery{Limit: 2}
+	for page := 0; ; page++ {
+		entries, err := repo.ListRevokedCertificates(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			serials = append(serials, e.SerialNumber)
+		}
+		if len(entries) < query.Limit {
+			break
+		}
+		// A revocation made while paging lands before the first page.
+		if page == 0 {
+			repo.crlEntries["ff"] = &CRLEntry{SerialNumber: "ff", RevokedAt: base.Add(time.Hour * 24)}
+		}
+		query.Cursor = CRLCursor(entries[len(entries)-1])
+	}
+	if got := fmt.Sprint(serials); got != "[04 03 02 01 00]" {
+		t.Fatalf("expected every entry once, newest first, got %s", got)
+	}
+
+	entries, err := repo.ListRevokedCertificates(ctx, RevokedCertificateQuery{From: base.Add(time.Hour), To: base.Add(3 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(crlSerials(entries)); got != "[02 01]" {
+		t.Fatalf("expected From inclusive and To exclusive, got %s", got)
+	}
+	entries, err = repo.ListRevokedCertificates(ctx, RevokedCertificateQuery{AgentID: "agent-b", From: base.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(crlSerials(entries)); got != "[03]" {
+		t.Fatalf("expected agent-b's entries from the bound, got %s", got)
+	}
+	if _, err := repo.ListRevokedCertificates(ctx, RevokedCertificateQuery{Cursor: "not-a-cursor"}); err == nil {
+		t.Fatal("expected an invalid cursor to fail")
+	}
+}
+
+func crlSerials(entries []CRLEntry) []string {
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, e.SerialNumber)
+	}
+	return out
+}
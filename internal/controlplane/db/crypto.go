@@ -0,0 +1,262 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// encryptedPrefix marks a column value sealed by TenantCipher. The key ID
+// and the base64 nonce and ciphertext follow it, colon separated.
+const encryptedPrefix = "nkenc:v1:"
+
+// ErrNoCipher is returned when an encrypted value is read without the
+// tenant cipher configured.
+var ErrNoCipher = errors.New("value is encrypted but no tenant encryption keys are configured")
+
+// TenantCipher encrypts sensitive column values with AES-256-GCM under a
+// key derived per tenant from a master key, so one tenant's key never
+// opens another tenant's data. The tenant ID is also bound as additional
+// data, so a value copied to another tenant's row fails to decrypt.
+//
+// Several master keys may be configured for rotation: new values are
+// sealed with the active key, and values sealed with any configured key
+// can be read.
+type TenantCipher struct {
+	active  string
+	masters map[string][]byte
+
+	mu      sync.Mutex
+	derived map[string]cipher.AEAD
+}
+
+// ParseEncryptionKeys parses a comma-separated list of keyID:base64key
+// master keys. Keys must be 32 bytes.
+func ParseEncryptionKeys(spec string) (map[string][]byte, []string, error) {
+	keys := make(map[string][]byte)
+	var order []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" || strings.Contains(id, ":") {
+			return nil, nil, fmt.Errorf("invalid encryption key entry: want keyID:base64key")
+		}
+		if _, dup := keys[id]; dup {
+			return nil, nil, fmt.Errorf("encryption key %q is listed more than once", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, nil, fmt.Errorf("encryption key %q: invalid base64", id)
+		}
+		if len(key) != 32 {
+			return nil, nil, fmt.Errorf("encryption key %q: want 32 bytes, got %d", id, len(key))
+		}
+		keys[id] = key
+		order = append(order, id)
+	}
+	return keys, order, nil
+}
+
+// NewTenantCipherFromSpec builds a TenantCipher from ParseEncryptionKeys
+// syntax. activeID defaults to the last key listed. An empty spec returns
+// a nil cipher, which leaves values unencrypted.
+func NewTenantCipherFromSpec(spec, activeID string) (*TenantCipher, error) {
+	keys, order, err := ParseEncryptionKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if strings.TrimSpace(activeID) != "" {
+			return nil, fmt.Errorf("active encryption key %q set but no encryption keys configured", activeID)
+		}
+		return nil, nil
+	}
+	activeID = strings.TrimSpace(activeID)
+	if activeID == "" {
+		activeID = order[len(order)-1]
+	}
+	return NewTenantCipher(keys, activeID)
+}
+
+// NewTenantCipher returns a cipher sealing new values with masters[activeID].
+func NewTenantCipher(masters map[string][]byte, activeID string) (*TenantCipher, error) {
+	if _, ok := masters[activeID]; !ok {
+		return nil, fmt.Errorf("active encryption key %q is not configured", activeID)
+	}
+	return &TenantCipher{active: activeID, masters: masters, derived: make(map[string]cipher.AEAD)}, nil
+}
+
+// ActiveKeyID returns the ID of the master key new values are sealed with.
+func (c *TenantCipher) ActiveKeyID() string {
+	return c.active
+}
+
+func (c *TenantCipher) aead(keyID, tenantID string) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cacheKey := keyID + "/" + tenantID
+	if aead, ok := c.derived[cacheKey]; ok {
+		return aead, nil
+	}
+	master, ok := c.masters[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q is not configured", keyID)
+	}
+	key, err := hkdf.Key(sha256.New, master, nil, "n-kudo tenant column key "+tenantID, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.derived[cacheKey] = aead
+	return aead, nil
+}
+
+// Encrypt seals plaintext for tenantID with the active key.
+func (c *TenantCipher) Encrypt(tenantID string, plaintext []byte) (string, error) {
+	if tenantID == "" {
+		return "", fmt.Errorf("tenant id required to encrypt")
+	}
+	aead, err := c.aead(c.active, tenantID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(tenantID))
+	return encryptedPrefix + c.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt for tenantID.
+func (c *TenantCipher) Decrypt(tenantID, value string) ([]byte, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !ok || !IsEncrypted(value) {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	aead, err := c.aead(keyID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted value")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(tenantID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt value for tenant %s: %w", tenantID, err)
+	}
+	return plaintext, nil
+}
+
+// IsEncrypted reports whether value was sealed by a TenantCipher.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// encryptedKeyID returns the master key ID value was sealed with.
+func encryptedKeyID(value string) string {
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	return id
+}
+
+// sealJSON encrypts a JSON column value, storing it as a JSON string so
+// the column stays valid JSON. Empty values, a nil cipher and rows without
+// a tenant are stored as they are.
+func (c *TenantCipher) sealJSON(tenantID string, raw []byte) ([]byte, error) {
+	if c == nil || len(raw) == 0 || tenantID == "" {
+		return raw, nil
+	}
+	sealed, err := c.Encrypt(tenantID, raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// openJSON reverses sealJSON. Values written before encryption was
+// enabled are returned unchanged.
+func (c *TenantCipher) openJSON(tenantID string, raw []byte) ([]byte, error) {
+	sealed, ok := sealedJSONString(raw)
+	if !ok {
+		return raw, nil
+	}
+	if c == nil {
+		return nil, ErrNoCipher
+	}
+	return c.Decrypt(tenantID, sealed)
+}
+
+// sealedJSONString returns the encrypted value held in a JSON column.
+func sealedJSONString(raw []byte) (string, bool) {
+	if len(raw) == 0 || raw[0] != '"' {
+		return "", false
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil || !IsEncrypted(s) {
+		return "", false
+	}
+	return s, true
+}
+
+// sealString encrypts a text column value. Empty values, a nil cipher and
+// rows without a tenant are stored as they are.
+func (c *TenantCipher) sealString(tenantID, value string) (string, error) {
+	if c == nil || value == "" || tenantID == "" {
+		return value, nil
+	}
+	return c.Encrypt(tenantID, []byte(value))
+}
+
+// openString reverses sealString. Values written before encryption was
+// enabled are returned unchanged.
+func (c *TenantCipher) openString(tenantID, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if c == nil {
+		return "", ErrNoCipher
+	}
+	plaintext, err := c.Decrypt(tenantID, value)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// openAgent decrypts the secret columns of an agent read from the
+// database.
+func (c *TenantCipher) openAgent(a *Agent) error {
+	var err error
+	a.RefreshTokenHash, err = c.openString(a.TenantID, a.RefreshTokenHash)
+	return err
+}
+
+// openUser decrypts the secret columns of a user read from the database.
+func (c *TenantCipher) openUser(u *User) error {
+	var err error
+	u.PasswordHash, err = c.openString(u.TenantID, u.PasswordHash)
+	return err
+}
@@ -0,0 +1,217 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKeySpec(ids ...string) string {
+	var entries []string
+	for i, id := range ids {
+		key := bytes.Repeat([]byte{byte(i + 1)}, 32)
+		entries = append(entries, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+	return strings.Join(entries, ",")
+}
+
+func TestTenantCipherRoundTrip(t *testing.T) {
+	c, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	secret := []byte(`{"password":"hunter2"}`)
+	sealed, err := c.Encrypt("tenant-a", secret)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !IsEncrypted(sealed) || strings.Contains(sealed, "hunter2") {
+		t.Fatalf("expected opaque encrypted value, got %q", sealed)
+	}
+	got, err := c.Decrypt("tenant-a", sealed)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("expected %q, got %q", secret, got)
+	}
+}
+
+func TestTenantCipherSeparatesTenants(t *testing.T) {
+	c, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	secret := []byte("same secret")
+	a, err := c.Encrypt("tenant-a", secret)
+	if err != nil {
+		t.Fatalf("encrypt a: %v", err)
+	}
+	b, err := c.Encrypt("tenant-b", secret)
+	if err != nil {
+		t.Fatalf("encrypt b: %v", err)
+	}
+	if a == b {
+		t.Fatal("expected ciphertext to differ across tenants")
+	}
+	if _, err := c.Decrypt("tenant-b", a); err == nil {
+		t.Fatal("expected tenant-b to be unable to decrypt tenant-a's value")
+	}
+}
+
+func TestTenantCipherRotation(t *testing.T) {
+	old, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("old cipher: %v", err)
+	}
+	sealed, err := old.Encrypt("tenant-a", []byte("v1"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	rotated, err := NewTenantCipherFromSpec(testKeySpec("k1", "k2"), "")
+	if err != nil {
+		t.Fatalf("rotated cipher: %v", err)
+	}
+	if rotated.ActiveKeyID() != "k2" {
+		t.Fatalf("expected last key to be active, got %q", rotated.ActiveKeyID())
+	}
+	got, err := rotated.Decrypt("tenant-a", sealed)
+	if err != nil || string(got) != "v1" {
+		t.Fatalf("expected old value to decrypt after rotation, got %q, %v", got, err)
+	}
+	fresh, err := rotated.Encrypt("tenant-a", []byte("v2"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if encryptedKeyID(fresh) != "k2" {
+		t.Fatalf("expected new value sealed with k2, got %q", encryptedKeyID(fresh))
+	}
+
+	retired, err := NewTenantCipherFromSpec(testKeySpec("k2"), "")
+	if err != nil {
+		t.Fatalf("retired cipher: %v", err)
+	}
+	if _, err := retired.Decrypt("tenant-a", sealed); err == nil {
+		t.Fatal("expected value sealed with a removed key to fail")
+	}
+}
+
+func TestTenantCipherJSONColumns(t *testing.T) {
+	raw := []byte(`{"note":"plain"}`)
+
+	var none *TenantCipher
+	out, err := none.sealJSON("tenant-a", raw)
+	if err != nil || !bytes.Equal(out, raw) {
+		t.Fatalf("expected nil cipher to store plaintext, got %q, %v", out, err)
+	}
+
+	c, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	sealed, err := c.sealJSON("tenant-a", raw)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if _, ok := sealedJSONString(sealed); !ok {
+		t.Fatalf("expected sealed JSON string, got %q", sealed)
+	}
+	opened, err := c.openJSON("tenant-a", sealed)
+	if err != nil || !bytes.Equal(opened, raw) {
+		t.Fatalf("expected %q, got %q, %v", raw, opened, err)
+	}
+	if plain, err := c.openJSON("tenant-a", raw); err != nil || !bytes.Equal(plain, raw) {
+		t.Fatalf("expected plaintext to pass through, got %q, %v", plain, err)
+	}
+	if _, err := none.openJSON("tenant-a", sealed); !errors.Is(err, ErrNoCipher) {
+		t.Fatalf("expected ErrNoCipher, got %v", err)
+	}
+}
+
+func TestTenantCipherTextColumns(t *testing.T) {
+	c, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	sealed, err := c.sealString("tenant-a", "webhook-secret")
+	if err != nil || !IsEncrypted(sealed) {
+		t.Fatalf("expected a sealed secret, got %q, %v", sealed, err)
+	}
+	if opened, err := c.openString("tenant-a", sealed); err != nil || opened != "webhook-secret" {
+		t.Fatalf("expected the secret back, got %q, %v", opened, err)
+	}
+	if _, err := c.openString("tenant-b", sealed); err == nil {
+		t.Fatal("expected another tenant's key not to open the secret")
+	}
+	if plain, err := c.openString("tenant-a", "legacy-secret"); err != nil || plain != "legacy-secret" {
+		t.Fatalf("expected plaintext to pass through, got %q, %v", plain, err)
+	}
+	var none *TenantCipher
+	if _, err := none.openString("tenant-a", sealed); !errors.Is(err, ErrNoCipher) {
+		t.Fatalf("expected ErrNoCipher, got %v", err)
+	}
+}
+
+func TestTenantCipherSecretColumns(t *testing.T) {
+	c, err := NewTenantCipherFromSpec(testKeySpec("k1"), "")
+	if err != nil {
+		t.Fatalf("new cipher: %v", err)
+	}
+	const refreshHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	sealedA, err := c.sealString("tenant-a", refreshHash)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	sealedB, err := c.sealString("tenant-b", refreshHash)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if sealedA == sealedB || strings.Contains(sealedA, refreshHash) {
+		t.Fatalf("expected opaque ciphertext that differs across tenants, got %q and %q", sealedA, sealedB)
+	}
+
+	agent := Agent{ID: "agent-1", TenantID: "tenant-a", RefreshTokenHash: sealedA}
+	if err := c.openAgent(&agent); err != nil || agent.RefreshTokenHash != refreshHash {
+		t.Fatalf("expected the refresh token hash back, got %q, %v", agent.RefreshTokenHash, err)
+	}
+	moved := Agent{ID: "agent-2", TenantID: "tenant-b", RefreshTokenHash: sealedA}
+	if err := c.openAgent(&moved); err == nil {
+		t.Fatal("expected a secret copied to another tenant's row not to open")
+	}
+
+	sealedPassword, err := c.sealString("tenant-a", "$2a$10$hash")
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	user := User{ID: "user-1", TenantID: "tenant-a", PasswordHash: sealedPassword}
+	if err := c.openUser(&user); err != nil || user.PasswordHash != "$2a$10$hash" {
+		t.Fatalf("expected the password hash back, got %q, %v", user.PasswordHash, err)
+	}
+	legacy := User{ID: "user-2", TenantID: "tenant-a", PasswordHash: "$2a$10$legacy"}
+	if err := c.openUser(&legacy); err != nil || legacy.PasswordHash != "$2a$10$legacy" {
+		t.Fatalf("expected a plaintext hash to pass through, got %q, %v", legacy.PasswordHash, err)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, spec := range []string{
+		"nokey",
+		"k1:not-base64!",
+		"k1:" + short,
+		testKeySpec("k1") + "," + testKeySpec("k1"),
+	} {
+		if _, _, err := ParseEncryptionKeys(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+	if c, err := NewTenantCipherFromSpec("", ""); err != nil || c != nil {
+		t.Fatalf("expected nil cipher for empty spec, got %v, %v", c, err)
+	}
+	if _, err := NewTenantCipherFromSpec(testKeySpec("k1"), "k9"); err == nil {
+		t.Fatal("expected error for unknown active key")
+	}
+}
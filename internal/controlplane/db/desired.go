@@ -0,0 +1,108 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DesiredVM is one VM of a site's declared VM set, identified by Name.
+// VCPUCount and MemoryMiB are compared with the running VM when set; Labels
+// only apply when the VM is created, as they are not tracked afterwards.
+type DesiredVM struct {
+	Name      string            `json:"name"`
+	VCPUCount int               `json:"vcpu_count,omitempty"`
+	MemoryMiB int64             `json:"memory_mib,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// DesiredState is the VM set an operator declared for a site. A zero
+// UpdatedAt means none has been declared.
+type DesiredState struct {
+	VMs       []DesiredVM `json:"vms"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// ValidateDesiredVMs checks that every VM has a unique name and that sizes
+// are not negative.
+func ValidateDesiredVMs(vms []DesiredVM) error {
+	seen := make(map[string]bool, len(vms))
+	for i, vm := range vms {
+		name := strings.TrimSpace(vm.Name)
+		if name == "" {
+			return fmt.Errorf("vms[%d]: name is required", i)
+		}
+		if seen[name] {
+			return fmt.Errorf("vm %q is declared more than once", name)
+		}
+		seen[name] = true
+		if vm.VCPUCount < 0 || vm.MemoryMiB < 0 {
+			return fmt.Errorf("vm %q: vcpu_count and memory_mib must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// ReconcileActions returns the plan actions that turn current into desired:
+// CREATE for missing VMs, DELETE for VMs not declared, and DELETE then
+// CREATE for VMs whose size changed, as VMs cannot be resized in place.
+// Deletes come first, then creates, each ordered by name. VMs already being
+// deleted are ignored. replaced reports whether any VM is recreated, in
+// which case the plan must run sequentially.
+func ReconcileActions(desired []DesiredVM, current []MicroVM) (actions []ApplyPlanAction, replaced bool) {
+	byName := make(map[string][]MicroVM)
+	for _, vm := range current {
+		if vm.State == "DELETING" {
+			continue
+		}
+		byName[vm.Name] = append(byName[vm.Name], vm)
+	}
+	wanted := make(map[string]DesiredVM, len(desired))
+	for _, d := range desired {
+		wanted[strings.TrimSpace(d.Name)] = d
+	}
+
+	var deletes, creates []ApplyPlanAction
+	deleteVM := func(vm MicroVM) {
+		deletes = append(deletes, ApplyPlanAction{OperationID: "delete-" + vm.ID, Operation: "DELETE", VMID: vm.ID, Name: vm.Name})
+	}
+	for name, vms := range byName {
+		sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+		d, ok := wanted[name]
+		if !ok {
+			for _, vm := range vms {
+				deleteVM(vm)
+			}
+			continue
+		}
+		// Duplicates of a declared name are extra VMs.
+		for _, vm := range vms[1:] {
+			deleteVM(vm)
+		}
+		if (d.VCPUCount > 0 && d.VCPUCount != vms[0].VCPUCount) || (d.MemoryMiB > 0 && d.MemoryMiB != vms[0].MemoryMiB) {
+			deleteVM(vms[0])
+			replaced = true
+			continue
+		}
+		delete(wanted, name)
+	}
+	for name, d := range wanted {
+		creates = append(creates, ApplyPlanAction{
+			OperationID: "create-" + name,
+			Operation:   "CREATE",
+			Name:        name,
+			VCPUCount:   d.VCPUCount,
+			MemoryMiB:   d.MemoryMiB,
+			Labels:      d.Labels,
+		})
+	}
+	sort.Slice(deletes, func(i, j int) bool {
+		if deletes[i].Name != deletes[j].Name {
+			return deletes[i].Name < deletes[j].Name
+		}
+		return deletes[i].VMID < deletes[j].VMID
+	})
+	sort.Slice(creates, func(i, j int) bool { return creates[i].Name < creates[j].Name })
+	return append(deletes, creates...), replaced
+}
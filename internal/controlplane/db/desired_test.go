@@ -0,0 +1,61 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReconcileActions(t *testing.T) {
+	current := []MicroVM{
+		{ID: "vm-web", Name: "web", VCPUCount: 2, MemoryMiB: 512, State: "RUNNING"},
+		{ID: "vm-db", Name: "db", VCPUCount: 2, MemoryMiB: 1024, State: "RUNNING"},
+		{ID: "vm-old", Name: "old", VCPUCount: 1, MemoryMiB: 256, State: "STOPPED"},
+		{ID: "vm-gone", Name: "gone", State: "DELETING"},
+	}
+	desired := []DesiredVM{
+		{Name: "web"}, // unchanged: sizes not declared
+		{Name: "db", VCPUCount: 4, MemoryMiB: 1024}, // resized: recreated
+		{Name: "cache", VCPUCount: 1, MemoryMiB: 256, Labels: map[string]string{"tier": "cache"}},
+	}
+	actions, replaced := ReconcileActions(desired, current)
+	if !replaced {
+		t.Fatalf("expected db to be replaced")
+	}
+	got := make([]string, 0, len(actions))
+	for _, a := range actions {
+		got = append(got, a.Operation+" "+a.Name+" "+a.VMID)
+	}
+	want := []string{"DELETE db vm-db", "DELETE old vm-old", "CREATE cache ", "CREATE db "}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if actions[2].Labels["tier"] != "cache" || actions[3].VCPUCount != 4 {
+		t.Fatalf("expected create actions to carry the declared spec, got %+v", actions[2:])
+	}
+
+	inSync := []DesiredVM{{Name: "web", VCPUCount: 2, MemoryMiB: 512}}
+	if actions, replaced := ReconcileActions(inSync, current[:1]); len(actions) != 0 || replaced {
+		t.Fatalf("expected no actions for a site in sync, got %+v", actions)
+	}
+
+	dups := []MicroVM{{ID: "b", Name: "web"}, {ID: "a", Name: "web"}}
+	actions, _ = ReconcileActions([]DesiredVM{{Name: "web"}}, dups)
+	if len(actions) != 1 || actions[0].Operation != "DELETE" || actions[0].VMID != "b" {
+		t.Fatalf("expected the duplicate web to be deleted, got %+v", actions)
+	}
+}
+
+func TestValidateDesiredVMs(t *testing.T) {
+	for name, vms := range map[string][]DesiredVM{
+		"missing name": {{Name: " "}},
+		"duplicate":    {{Name: "web"}, {Name: "web"}},
+		"negative":     {{Name: "web", MemoryMiB: -1}},
+	} {
+		if err := ValidateDesiredVMs(vms); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if err := ValidateDesiredVMs([]DesiredVM{{Name: "web"}, {Name: "db"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
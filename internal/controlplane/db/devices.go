@@ -0,0 +1,46 @@
+package store
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// Default caps on the extra devices one CREATE may request.
+const (
+	DefaultMaxDisksPerVM = model.DefaultMaxDisksPerVM
+	DefaultMaxNICsPerVM  = model.DefaultMaxNICsPerVM
+)
+
+// VMDiskSpec is an extra, empty data disk attached at CREATE.
+type VMDiskSpec = model.DiskSpec
+
+// VMNetworkSpec is a network interface attached at CREATE. Bridge defaults
+// to the agent's bridge and MacAddr is derived from the VM ID when empty.
+type VMNetworkSpec struct {
+	Bridge    string `json:"bridge,omitempty"`
+	MacAddr   string `json:"mac,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// ValidateVMDevices checks the extra disks and NICs of a CREATE against the
+// per-VM caps with model.ValidateDevices, then the NIC addresses.
+func ValidateVMDevices(disks []VMDiskSpec, nics []VMNetworkSpec, maxDisks, maxNICs int) error {
+	if err := model.ValidateDevices(disks, len(nics), maxDisks, maxNICs); err != nil {
+		return err
+	}
+	for i, n := range nics {
+		if n.MacAddr != "" {
+			if _, err := net.ParseMAC(n.MacAddr); err != nil {
+				return fmt.Errorf("networks[%d]: invalid mac: %w", i, err)
+			}
+		}
+		if n.IPAddress != "" {
+			if _, _, err := net.ParseCIDR(n.IPAddress); err != nil {
+				return fmt.Errorf("networks[%d]: ip_address must be in CIDR notation", i)
+			}
+		}
+	}
+	return nil
+}
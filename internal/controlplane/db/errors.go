@@ -7,4 +7,29 @@ var (
 	ErrConflict     = errors.New("conflict")
 	ErrUnauthorized = errors.New("unauthorized")
 	ErrTokenInvalid = errors.New("token invalid")
+	// ErrPlanNotFailed is returned when retrying a plan that has not failed.
+	ErrPlanNotFailed = errors.New("plan has not failed")
+	// ErrStaleHeartbeat is returned when a heartbeat's sequence number is not
+	// above the last one applied for the agent; nothing is written.
+	ErrStaleHeartbeat = errors.New("stale heartbeat")
+	// ErrDuplicateReport is returned when every result of a plan result
+	// report carries an idempotency token that was already applied; nothing
+	// is written.
+	ErrDuplicateReport = errors.New("duplicate result report")
+
+	ErrInvalidNameTemplate  = errors.New("invalid name template")
+	ErrInvalidResources     = errors.New("invalid resources")
+	ErrInvalidMetadata      = errors.New("invalid metadata")
+	ErrPayloadTooLarge      = errors.New("payload too large")
+	ErrInvalidQuotaTemplate = errors.New("invalid quota template")
+	ErrInvalidWebhook       = errors.New("invalid webhook")
+	ErrInvalidLogSeverity   = errors.New("invalid log severity")
+
+	ErrInvalidMigration     = errors.New("invalid migration")
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+
+	// Overlay address management on VM network attachments.
+	ErrInvalidAddress     = errors.New("invalid address")
+	ErrAddressInUse       = errors.New("address in use")
+	ErrAddressesExhausted = errors.New("no free address")
 )
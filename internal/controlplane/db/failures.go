@@ -0,0 +1,60 @@
+package store
+
+import "strings"
+
+// Execution failure categories. Agents report one of these as error_code;
+// the set matches the executor's categories on the edge. ACTION_FAILED is
+// the category of last resort.
+const (
+	FailureImagePull             = "IMAGE_PULL"
+	FailureKVMUnavailable        = "KVM_UNAVAILABLE"
+	FailureHypervisor            = "HYPERVISOR_UNAVAILABLE"
+	FailureNetworkSetup          = "NETWORK_SETUP"
+	FailureTimeout               = "TIMEOUT"
+	FailureInvalidParams         = "INVALID_PARAMS"
+	FailureVMNotFound            = "VM_NOT_FOUND"
+	FailureUnsupportedOperation  = "UNSUPPORTED_OPERATION"
+	FailureInsufficientResources = "INSUFFICIENT_RESOURCES"
+	FailureHook                  = "HOOK_FAILED"
+	FailureSkipped               = "SKIPPED"
+	FailureActionFailed          = "ACTION_FAILED"
+)
+
+var failureCategories = map[string]bool{
+	FailureImagePull:             true,
+	FailureKVMUnavailable:        true,
+	FailureHypervisor:            true,
+	FailureNetworkSetup:          true,
+	FailureTimeout:               true,
+	FailureInvalidParams:         true,
+	FailureVMNotFound:            true,
+	FailureUnsupportedOperation:  true,
+	FailureInsufficientResources: true,
+	FailureHook:                  true,
+	FailureSkipped:               true,
+	FailureActionFailed:          true,
+}
+
+// ValidFailureCategory reports whether code is a canonical failure category.
+func ValidFailureCategory(code string) bool {
+	return failureCategories[code]
+}
+
+// NormalizeFailure canonicalises a reported error code. Case and spacing
+// are folded; a code outside the canonical set becomes ACTION_FAILED and is
+// kept as a prefix of the message so that it is not lost. An empty code
+// stays empty.
+func NormalizeFailure(code, message string) (string, string) {
+	raw := strings.TrimSpace(code)
+	if raw == "" {
+		return "", message
+	}
+	normalized := strings.ToUpper(strings.NewReplacer("-", "_", " ", "_").Replace(raw))
+	if failureCategories[normalized] {
+		return normalized, message
+	}
+	if message == "" {
+		return FailureActionFailed, raw
+	}
+	return FailureActionFailed, raw + ": " + message
+}
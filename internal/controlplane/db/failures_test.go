@@ -0,0 +1,27 @@
+package store
+
+import "testing"
+
+func TestNormalizeFailure(t *testing.T) {
+	tests := []struct {
+		code, message     string
+		wantCode, wantMsg string
+	}{
+		{"", "ok", "", "ok"},
+		{"IMAGE_PULL", "cache base image: no such file", "IMAGE_PULL", "cache base image: no such file"},
+		{" kvm_unavailable ", "open /dev/kvm: permission denied", "KVM_UNAVAILABLE", "open /dev/kvm: permission denied"},
+		{"network-setup", "setup tap: exit status 2", "NETWORK_SETUP", "setup tap: exit status 2"},
+		{"SKIPPED", "skipped: action a failed", "SKIPPED", "skipped: action a failed"},
+		{"START_FAILED", "failed", "ACTION_FAILED", "START_FAILED: failed"},
+		{"E42", "", "ACTION_FAILED", "E42"},
+	}
+	for _, tt := range tests {
+		code, msg := NormalizeFailure(tt.code, tt.message)
+		if code != tt.wantCode || msg != tt.wantMsg {
+			t.Errorf("NormalizeFailure(%q, %q) = %q, %q; want %q, %q", tt.code, tt.message, code, msg, tt.wantCode, tt.wantMsg)
+		}
+		if code != "" && !ValidFailureCategory(code) {
+			t.Errorf("NormalizeFailure(%q) returned non-canonical code %q", tt.code, code)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxVMFilesBytes bounds the total content of the files in one CREATE
+// action.
+const MaxVMFilesBytes = model.MaxFilesBytes
+
+// FileSpec is a file written into a VM at first boot; see model.FileSpec.
+type FileSpec = model.FileSpec
+
+// ValidateFileSpecs checks files submitted by a client with
+// model.ValidateFiles; clients cannot set ContentRef.
+func ValidateFileSpecs(files []FileSpec) error {
+	for _, f := range files {
+		if f.ContentRef != "" {
+			return fmt.Errorf("file %s: content_ref cannot be set by clients", f.Path)
+		}
+	}
+	return model.ValidateFiles(files)
+}
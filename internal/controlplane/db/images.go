@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// VMImage is the kernel and root filesystem a VM boots from.
+type VMImage = model.Image
+
+// SupportedArches are the host architectures site image defaults may name,
+// in Go's GOARCH spelling as reported by agent host facts.
+var SupportedArches = []string{"amd64", "arm64"}
+
+// NormalizeImageDefaults validates per-arch site image defaults and returns
+// them keyed by normalized arch.
+func NormalizeImageDefaults(images map[string]VMImage) (map[string]VMImage, error) {
+	out := make(map[string]VMImage, len(images))
+	for rawArch, img := range images {
+		arch := model.NormalizeArch(rawArch)
+		supported := false
+		for _, a := range SupportedArches {
+			supported = supported || a == arch
+		}
+		if !supported {
+			return nil, fmt.Errorf("unsupported arch %q, want one of %s", rawArch, strings.Join(SupportedArches, ", "))
+		}
+		if _, dup := out[arch]; dup {
+			return nil, fmt.Errorf("arch %s is listed more than once", arch)
+		}
+		if err := validateImagePath("rootfs_path", img.RootfsPath, true); err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		if err := validateImagePath("kernel_path", img.KernelPath, false); err != nil {
+			return nil, fmt.Errorf("%s: %w", arch, err)
+		}
+		out[arch] = img
+	}
+	return out, nil
+}
+
+// ImageArches returns the arches of images, sorted.
+func ImageArches(images map[string]VMImage) []string {
+	out := make([]string, 0, len(images))
+	for arch := range images {
+		out = append(out, arch)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func validateImagePath(field, p string, required bool) error {
+	if p == "" {
+		if required {
+			return fmt.Errorf("%s is required", field)
+		}
+		return nil
+	}
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p || strings.ContainsAny(p, "\x00\n\r") {
+		return fmt.Errorf("%s %q must be a clean absolute path", field, p)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// reservedAddresses returns the addresses of prefix that are never handed
+// to VMs: the network address, the IPv4 broadcast address and the gateway.
+func reservedAddresses(prefix netip.Prefix, gateway string) map[netip.Addr]bool {
+	reserved := map[netip.Addr]bool{prefix.Addr(): true}
+	if prefix.Addr().Is4() {
+		reserved[lastAddr(prefix)] = true
+	}
+	if gw, err := netip.ParseAddr(gateway); err == nil {
+		reserved[gw.Unmap()] = true
+	}
+	return reserved
+}
+
+// lastAddr returns the highest address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// allocateAddress picks the address a VM attached to network gets. A
+// requested address must lie in the network's CIDR, not be reserved and
+// not be held by another attachment; an empty one takes the lowest free
+// address. used holds the addresses of the network's other attachments.
+func allocateAddress(network VXLANNetwork, requested string, used []string) (string, error) {
+	prefix, err := netip.ParsePrefix(network.CIDR)
+	if err != nil {
+		return "", fmt.Errorf("%w: network %s has invalid cidr %q", ErrInvalidAddress, network.ID, network.CIDR)
+	}
+	prefix = prefix.Masked()
+	reserved := reservedAddresses(prefix, network.Gateway)
+	taken := make(map[netip.Addr]bool, len(used))
+	for _, u := range used {
+		if addr, err := netip.ParseAddr(u); err == nil {
+			taken[addr.Unmap()] = true
+		}
+	}
+
+	if requested != "" {
+		addr, err := netip.ParseAddr(requested)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q is not an IP address", ErrInvalidAddress, requested)
+		}
+		addr = addr.Unmap()
+		switch {
+		case !prefix.Contains(addr):
+			return "", fmt.Errorf("%w: %s is outside %s", ErrInvalidAddress, addr, prefix)
+		case reserved[addr]:
+			return "", fmt.Errorf("%w: %s is reserved in %s", ErrInvalidAddress, addr, prefix)
+		case taken[addr]:
+			return "", fmt.Errorf("%w: %s", ErrAddressInUse, addr)
+		}
+		return addr.String(), nil
+	}
+
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		if !reserved[addr] && !taken[addr] {
+			return addr.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: network %s (%s)", ErrAddressesExhausted, network.ID, prefix)
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryRepoAllocatesAttachmentAddresses(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepo()
+	// A /29 has six host addresses; the gateway takes one of them.
+	network, err := repo.CreateVXLANNetwork(ctx, "tenant-1", "site-1", VXLANNetwork{ID: "net-1", Name: "backend", VNI: 4200, CIDR: "10.30.0.0/29", Gateway: "10.30.0.1"})
+	if err != nil {
+		t.Fatalf("create network: %v", err)
+	}
+	attach := func(vmID, ip string) (VMNetworkAttachment, error) {
+		return repo.AttachVMToNetwork(ctx, VMNetworkAttachment{ID: "att-" + vmID, VMID: vmID, NetworkID: network.ID, IPAddress: ip})
+	}
+
+	// Sequential allocation skips the network address and the gateway.
+	for i, want := range []string{"10.30.0.2", "10.30.0.3", "10.30.0.4"} {
+		a, err := attach(string(rune('a'+i)), "")
+		if err != nil || a.IPAddress != want {
+			t.Fatalf("attachment %d: got %q (%v), want %s", i, a.IPAddress, err, want)
+		}
+	}
+	if _, err := attach("x", "10.30.0.3"); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("expected an allocated address to be refused, got %v", err)
+	}
+	for _, ip := range []string{"10.30.0.1", "10.30.0.7", "10.30.0.0", "10.31.0.2", "not-an-ip"} {
+		if _, err := attach("x", ip); !errors.Is(err, ErrInvalidAddress) {
+			t.Fatalf("expected %s to be refused as invalid, got %v", ip, err)
+		}
+	}
+	if a, err := attach("d", "10.30.0.6"); err != nil || a.IPAddress != "10.30.0.6" {
+		t.Fatalf("expected a free requested address to be kept, got %q (%v)", a.IPAddress, err)
+	}
+
+	// Detaching releases the address for the next allocation.
+	if err := repo.DetachVMFromNetwork(ctx, "b", network.ID); err != nil {
+		t.Fatalf("detach: %v", err)
+	}
+	if a, err := attach("e", ""); err != nil || a.IPAddress != "10.30.0.3" {
+		t.Fatalf("expected the released address to be reused, got %q (%v)", a.IPAddress, err)
+	}
+	if a, err := attach("f", ""); err != nil || a.IPAddress != "10.30.0.5" {
+		t.Fatalf("expected the last free address, got %q (%v)", a.IPAddress, err)
+	}
+
+	// The broadcast address is never handed out.
+	if _, err := attach("g", ""); !errors.Is(err, ErrAddressesExhausted) {
+		t.Fatalf("expected the network to be exhausted, got %v", err)
+	}
+	if _, err := attach("a", ""); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a second attachment of the same VM to conflict, got %v", err)
+	}
+}
+
+func TestAllocateAddressIPv6(t *testing.T) {
+	network := VXLANNetwork{ID: "net-6", CIDR: "fd00:10::/126", Gateway: "fd00:10::1"}
+	got, err := allocateAddress(network, "", []string{"fd00:10::2"})
+	if err != nil || got != "fd00:10::3" {
+		t.Fatalf("got %q (%v), want fd00:10::3", got, err)
+	}
+	if _, err := allocateAddress(network, "", []string{"fd00:10::2", "fd00:10::3"}); !errors.Is(err, ErrAddressesExhausted) {
+		t.Fatalf("expected exhaustion, got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorCodeAgentUnenrolled fails the executions an agent was running when
+// it unenrolled.
+const ErrorCodeAgentUnenrolled = "AGENT_UNENROLLED"
+
+// DefaultLeaseStealGrace is the lease steal policy used unless configured:
+// a CREATE may have half-finished on the silent agent, so another agent
+// waits three lease TTLs past expiry before taking it over.
+const DefaultLeaseStealGrace = "CREATE=3"
+
+// LeaseStealPolicy decides how long after a plan lease expires another
+// agent may take the plan over. Idempotent operations are safe to rerun
+// and are stolen as soon as the lease expires; for the others the lease
+// must have been expired for GraceMultiples[op] lease TTLs, giving the
+// silent agent time to come back and finish what it started. The agent
+// holding the lease can always renew it.
+type LeaseStealPolicy struct {
+	GraceMultiples map[string]int
+}
+
+// ParseLeaseStealPolicy parses a comma-separated list of OPERATION=multiple
+// entries, such as "CREATE=3,DELETE=1". Operations not listed are stolen on
+// expiry.
+func ParseLeaseStealPolicy(spec string) (LeaseStealPolicy, error) {
+	policy := LeaseStealPolicy{GraceMultiples: map[string]int{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		op, value, ok := strings.Cut(entry, "=")
+		op = strings.ToUpper(strings.TrimSpace(op))
+		if !ok || op == "" {
+			return LeaseStealPolicy{}, fmt.Errorf("invalid lease steal grace %q: want OPERATION=multiple", entry)
+		}
+		multiple, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || multiple < 0 {
+			return LeaseStealPolicy{}, fmt.Errorf("invalid lease steal grace %q: multiple must be a non-negative integer", entry)
+		}
+		policy.GraceMultiples[op] = multiple
+	}
+	return policy, nil
+}
+
+// grace returns how long past expiry a lease on a plan with the given
+// unfinished operation types must wait before another agent takes it.
+func (p LeaseStealPolicy) grace(leaseTTL time.Duration, operationTypes []string) time.Duration {
+	multiple := 0
+	for _, op := range operationTypes {
+		multiple = max(multiple, p.GraceMultiples[strings.ToUpper(op)])
+	}
+	return time.Duration(multiple) * leaseTTL
+}
+
+// graceSecondsJSON encodes the grace of each listed operation in seconds
+// for the lease query.
+func (p LeaseStealPolicy) graceSecondsJSON(leaseTTL time.Duration) []byte {
+	seconds := make(map[string]float64, len(p.GraceMultiples))
+	for op, multiple := range p.GraceMultiples {
+		seconds[op] = (time.Duration(multiple) * leaseTTL).Seconds()
+	}
+	raw, _ := json.Marshal(seconds)
+	return raw
+}
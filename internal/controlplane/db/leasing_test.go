@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLeaseStealPolicy(t *testing.T) {
+	p, err := ParseLeaseStealPolicy(" create=3, DELETE=1 ")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if p.GraceMultiples["CREATE"] != 3 || p.GraceMultiples["DELETE"] != 1 {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+	if got := p.grace(time.Minute, []string{"START", "create"}); got != 3*time.Minute {
+		t.Fatalf("expected the largest grace of the plan's operations, got %s", got)
+	}
+	if got := p.grace(time.Minute, []string{"STOP"}); got != 0 {
+		t.Fatalf("expected unlisted operations to be stolen on expiry, got %s", got)
+	}
+	for _, spec := range []string{"CREATE", "CREATE=x", "CREATE=-1", "=2"} {
+		if _, err := ParseLeaseStealPolicy(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestMemoryRepoLeaseStealingByOperation(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name      string
+		operation string
+		expiredBy time.Duration
+		stolen    bool
+	}{
+		{name: "idempotent op on expiry", operation: "START", expiredBy: time.Second, stolen: true},
+		{name: "create within grace", operation: "CREATE", expiredBy: 2 * ttl, stolen: false},
+		{name: "create past grace", operation: "CREATE", expiredBy: 3*ttl + time.Second, stolen: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+			repo.SetLeaseStealPolicy(LeaseStealPolicy{GraceMultiples: map[string]int{"CREATE": 3}})
+			ctx := context.Background()
+			owner := newAgent(t, repo, tenantID, siteID, "host-a")
+			other := newAgent(t, repo, tenantID, siteID, "host-b")
+
+			if _, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+				TenantID:       tenantID,
+				SiteID:         siteID,
+				IdempotencyKey: "steal-" + tc.operation,
+				Actions: []ApplyPlanAction{
+					{OperationID: "op-1", Operation: tc.operation, VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128},
+				},
+			}); err != nil {
+				t.Fatalf("apply plan: %v", err)
+			}
+			leased, err := repo.LeasePendingPlans(ctx, owner.ID, 1, ttl)
+			if err != nil || len(leased) != 1 {
+				t.Fatalf("expected owner to lease the plan, got %d, %v", len(leased), err)
+			}
+			planID := leased[0].PlanID
+			lease := repo.planLeases[planID]
+			lease.ExpiresAt = time.Now().UTC().Add(-tc.expiredBy)
+			repo.planLeases[planID] = lease
+
+			stolen, err := repo.LeasePendingPlans(ctx, other.ID, 1, ttl)
+			if err != nil {
+				t.Fatalf("lease plans (other): %v", err)
+			}
+			if got := len(stolen) == 1; got != tc.stolen {
+				t.Fatalf("expected stolen=%v, got %d plans", tc.stolen, len(stolen))
+			}
+			if !tc.stolen {
+				renewed, err := repo.LeasePendingPlans(ctx, owner.ID, 1, ttl)
+				if err != nil || len(renewed) != 1 {
+					t.Fatalf("expected owner to renew its expired lease, got %d, %v", len(renewed), err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRepoReleaseAgentPlansFailsInProgressWork(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	leaving := newAgent(t, repo, tenantID, siteID, "leaving")
+	staying := newAgent(t, repo, tenantID, siteID, "staying")
+
+	apply := func(key string) string {
+		t.Helper()
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions: []ApplyPlanAction{
+				{OperationID: key + "-create", Operation: "CREATE", VMID: key + "-vm", Name: key, VCPUCount: 1, MemoryMiB: 128},
+				{OperationID: key + "-start", Operation: "START", VMID: key + "-vm"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		return applied.Plan.ID
+	}
+	// lease hands the plan to agentID and marks its first action running.
+	lease := func(agentID, planID string) {
+		t.Helper()
+		if _, err := repo.LeasePendingPlans(ctx, agentID, 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if repo.planLeases[planID].AgentID != agentID {
+			t.Fatalf("expected %s to lease plan %s", agentID, planID)
+		}
+		for id, exec := range repo.executions {
+			if exec.PlanID == planID && exec.OperationType == "CREATE" {
+				exec.State = "IN_PROGRESS"
+				repo.executions[id] = exec
+			}
+		}
+	}
+	leftPlan := apply("left")
+	lease(leaving.ID, leftPlan)
+	keptPlan := apply("kept")
+	lease(staying.ID, keptPlan)
+
+	released, err := repo.ReleaseAgentPlans(ctx, leaving.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0] != leftPlan {
+		t.Fatalf("expected only the leaving agent's plan to be released, got %v", released)
+	}
+	if _, ok := repo.planLeases[leftPlan]; ok {
+		t.Fatal("expected the leaving agent's lease to be dropped")
+	}
+	if got := repo.plans[leftPlan].Status; got != "FAILED" {
+		t.Fatalf("expected the released plan to fail, got %s", got)
+	}
+	for _, exec := range repo.executions {
+		switch {
+		case exec.PlanID == leftPlan && exec.OperationType == "CREATE":
+			if exec.State != "FAILED" || exec.ErrorCode != ErrorCodeAgentUnenrolled || exec.CompletedAt == nil {
+				t.Fatalf("expected the in-progress CREATE to fail with %s, got %+v", ErrorCodeAgentUnenrolled, exec)
+			}
+		case exec.PlanID == leftPlan:
+			if exec.State != "FAILED" || exec.ErrorCode != ErrorCodeAgentUnenrolled {
+				t.Fatalf("expected the START that never ran to fail rather than be re-leased, got %+v", exec)
+			}
+		case exec.OperationType == "CREATE" && exec.State != "IN_PROGRESS":
+			t.Fatalf("expected the other agent's work to be untouched, got %+v", exec)
+		}
+	}
+	if got := repo.microVMs["left-vm"].State; got != "ERROR" {
+		t.Fatalf("expected the VM whose CREATE was cut off to be ERROR, got %s", got)
+	}
+	if repo.planLeases[keptPlan].AgentID != staying.ID || repo.plans[keptPlan].Status != "IN_PROGRESS" {
+		t.Fatalf("expected the other agent to keep its plan, got %+v", repo.plans[keptPlan])
+	}
+}
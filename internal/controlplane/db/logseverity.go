@@ -0,0 +1,27 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// LogSeverities lists execution log severities from least to most severe.
+var LogSeverities = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// ValidateLogSeverity checks a minimum ingest severity; empty means none.
+func ValidateLogSeverity(severity string) error {
+	if severity != "" && !slices.Contains(LogSeverities, severity) {
+		return fmt.Errorf("%w: invalid log severity %q: want one of %s", ErrInvalidLogSeverity, severity, strings.Join(LogSeverities, ", "))
+	}
+	return nil
+}
+
+// belowMinSeverity reports whether an entry of severity is filtered by
+// the minimum severity min. Nothing is filtered without a minimum.
+func belowMinSeverity(severity, min string) bool {
+	if min == "" {
+		return false
+	}
+	return slices.Index(LogSeverities, normalizeSeverity(severity)) < slices.Index(LogSeverities, min)
+}
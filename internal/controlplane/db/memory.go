@@ -3,6 +3,8 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"maps"
 	"sort"
 	"strings"
 	"sync"
@@ -22,17 +24,55 @@ type MemoryRepo struct {
 	apiKeysByHash map[string]APIKey
 	tokensByHash  map[string]EnrollmentToken
 	tokenUsed     map[string]bool
+	tokenUsedAt   map[string]time.Time
 	tokenCreated  map[string]time.Time
+	enrollments   map[string]AgentEnrollment
 
 	plans             map[string]Plan
 	planActions       map[string][]PlanAction
 	planLeases        map[string]planLease
 	planByIdempotency map[string]string
+	siteImageDefaults map[string]map[string]VMImage
+	siteDesiredState  map[string]DesiredState
+	siteAgentRollout  map[string]AgentRollout
+	agentUpgrades     map[string]AgentUpgrade
 	executions        map[string]Execution
 	executionLogs     map[string][]ExecutionLog
 	microVMs          map[string]MicroVM
 	audits            []AuditRecord
+	auditCheckpoint   AuditCheckpoint
 	crlEntries        map[string]*CRLEntry
+	agentNetwork      map[string]AgentNetworkStatus
+	connectivity      map[string][]ConnectivityTransition
+	// resultTokens holds the applied result idempotency tokens, keyed by
+	// plan ID and token.
+	resultTokens map[string]bool
+	agentMetrics      map[string]AgentMetrics
+	heartbeatSeqs     map[string]int64
+	// agentShutdowns holds the last shutdown of each agent.
+	agentShutdowns map[string]agentShutdown
+	leaseSteal        LeaseStealPolicy
+	idempotencyWindow time.Duration
+	maxActionPayload  int
+	vmMigrations      map[string]VMMigration
+	consoleLogs       map[string]ExecutionConsoleLog
+	tenantLimits      map[string]QuotaLimits
+	quotaTemplates    map[string]QuotaTemplate
+	webhooks          map[string]Webhook
+	usageHistory      map[string]TenantUsageSnapshot
+	fileContents      map[string]string
+
+	vxlanNetworks        map[string]VXLANNetwork
+	vxlanTunnels         map[string]VXLANTunnel
+	vmNetworkAttachments map[string]VMNetworkAttachment
+	// vmDNS holds the VM DNS records, keyed by network ID and VM ID.
+	vmDNS                map[string]VMDNSRecord
+	vmDNSHostnames       string
+}
+
+type agentShutdown struct {
+	Reason string
+	At     time.Time
 }
 
 type planLease struct {
@@ -62,16 +102,40 @@ func NewMemoryRepo() *MemoryRepo {
 		apiKeysByHash:     map[string]APIKey{},
 		tokensByHash:      map[string]EnrollmentToken{},
 		tokenUsed:         map[string]bool{},
+		tokenUsedAt:       map[string]time.Time{},
 		tokenCreated:      map[string]time.Time{},
+		enrollments:       map[string]AgentEnrollment{},
 		plans:             map[string]Plan{},
 		planActions:       map[string][]PlanAction{},
 		planLeases:        map[string]planLease{},
 		planByIdempotency: map[string]string{},
+		siteImageDefaults: map[string]map[string]VMImage{},
+		siteDesiredState:  map[string]DesiredState{},
+		siteAgentRollout:  map[string]AgentRollout{},
+		agentUpgrades:     map[string]AgentUpgrade{},
 		executions:        map[string]Execution{},
 		executionLogs:     map[string][]ExecutionLog{},
 		microVMs:          map[string]MicroVM{},
 		audits:            []AuditRecord{},
 		crlEntries:        map[string]*CRLEntry{},
+		agentNetwork:      map[string]AgentNetworkStatus{},
+		connectivity:      map[string][]ConnectivityTransition{},
+		resultTokens:      map[string]bool{},
+		agentMetrics:      map[string]AgentMetrics{},
+		heartbeatSeqs:     map[string]int64{},
+		agentShutdowns:    map[string]agentShutdown{},
+		vmMigrations:      map[string]VMMigration{},
+		consoleLogs:       map[string]ExecutionConsoleLog{},
+		tenantLimits:      map[string]QuotaLimits{},
+		quotaTemplates:    map[string]QuotaTemplate{},
+		webhooks:          map[string]Webhook{},
+		usageHistory:      map[string]TenantUsageSnapshot{},
+		fileContents:      map[string]string{},
+
+		vxlanNetworks:        map[string]VXLANNetwork{},
+		vxlanTunnels:         map[string]VXLANTunnel{},
+		vmNetworkAttachments: map[string]VMNetworkAttachment{},
+		vmDNS:                map[string]VMDNSRecord{},
 	}
 }
 
@@ -88,6 +152,11 @@ func (m *MemoryRepo) CreateTenant(_ context.Context, t Tenant) (Tenant, error) {
 			return Tenant{}, ErrConflict
 		}
 	}
+	if t.QuotaTemplate != "" {
+		if _, ok := m.quotaTemplates[t.QuotaTemplate]; !ok {
+			return Tenant{}, fmt.Errorf("%w: unknown quota template %q", ErrInvalidQuotaTemplate, t.QuotaTemplate)
+		}
+	}
 	now := time.Now().UTC()
 	t.CreatedAt = now
 	t.UpdatedAt = now
@@ -197,6 +266,16 @@ func (m *MemoryRepo) IssueEnrollmentToken(_ context.Context, token EnrollmentTok
 	return token, nil
 }
 
+func (m *MemoryRepo) EnrollmentTokenSite(_ context.Context, tokenHash string, now time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokensByHash[tokenHash]
+	if !ok || token.ExpiresAt.Before(now) || m.tokenUsed[token.ID] {
+		return "", ErrTokenInvalid
+	}
+	return token.SiteID, nil
+}
+
 func (m *MemoryRepo) ConsumeEnrollmentToken(_ context.Context, tokenHash string, now time.Time) (TokenConsumeResult, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -208,10 +287,11 @@ func (m *MemoryRepo) ConsumeEnrollmentToken(_ context.Context, tokenHash string,
 		return TokenConsumeResult{}, ErrTokenInvalid
 	}
 	m.tokenUsed[token.ID] = true
-	return TokenConsumeResult{TokenID: token.ID, TenantID: token.TenantID, SiteID: token.SiteID}, nil
+	m.tokenUsedAt[token.ID] = now
+	return TokenConsumeResult{TokenID: token.ID, TenantID: token.TenantID, SiteID: token.SiteID, Scope: token.Scope}, nil
 }
 
-func (m *MemoryRepo) CreateAgentFromEnrollment(_ context.Context, _ string, agent Agent, hostname string) (Agent, error) {
+func (m *MemoryRepo) CreateAgentFromEnrollment(_ context.Context, tokenID string, agent Agent, hostname string) (Agent, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	var hostID string
@@ -233,6 +313,11 @@ func (m *MemoryRepo) CreateAgentFromEnrollment(_ context.Context, _ string, agen
 	agent.State = "ONLINE"
 	agent.LastHeartbeatAt = &now
 	m.agents[agent.ID] = agent
+	enrollment := AgentEnrollment{AgentID: agent.ID, TenantID: agent.TenantID, SiteID: agent.SiteID, TokenID: tokenID, EnrolledAt: now, Bootstrap: agent.Bootstrap}
+	if usedAt, ok := m.tokenUsedAt[tokenID]; ok {
+		enrollment.TokenConsumedAt = &usedAt
+	}
+	m.enrollments[agent.ID] = enrollment
 	site := m.sites[agent.SiteID]
 	site.ConnectivityState = "ONLINE"
 	site.LastHeartbeatAt = &now
@@ -240,6 +325,16 @@ func (m *MemoryRepo) CreateAgentFromEnrollment(_ context.Context, _ string, agen
 	return agent, nil
 }
 
+func (m *MemoryRepo) GetAgentEnrollment(_ context.Context, agentID string) (AgentEnrollment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	enrollment, ok := m.enrollments[agentID]
+	if !ok {
+		return AgentEnrollment{}, ErrNotFound
+	}
+	return enrollment, nil
+}
+
 func (m *MemoryRepo) GetAgentByID(_ context.Context, agentID string) (Agent, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -257,9 +352,22 @@ func (m *MemoryRepo) IngestHeartbeat(_ context.Context, hb Heartbeat) error {
 	if !ok {
 		return ErrNotFound
 	}
+	if hb.HeartbeatSeq > 0 {
+		if hb.HeartbeatSeq <= m.heartbeatSeqs[agent.ID] {
+			return ErrStaleHeartbeat
+		}
+		m.heartbeatSeqs[agent.ID] = hb.HeartbeatSeq
+	}
 	now := time.Now().UTC()
 	agent.State = "ONLINE"
 	agent.LastHeartbeatAt = &now
+	agent.MetricsAddr = hb.MetricsAddr
+	if hb.ShutdownReason != "" {
+		m.agentShutdowns[agent.ID] = agentShutdown{Reason: hb.ShutdownReason, At: now}
+	}
+	if hb.AgentVersion != "" {
+		agent.AgentVersion = hb.AgentVersion
+	}
 	m.agents[agent.ID] = agent
 
 	host := m.hosts[agent.HostID]
@@ -269,6 +377,8 @@ func (m *MemoryRepo) IngestHeartbeat(_ context.Context, hb Heartbeat) error {
 	host.StorageBytesTotal = hb.StorageBytesTotal
 	host.KVMAvailable = hb.KVMAvailable
 	host.CloudHypervisorAvailable = hb.CloudHypervisorAvailable
+	host.FactsError = hb.FactsError
+	host.FactsDegraded = hb.FactsError != ""
 	host.LastFactsAt = &now
 	m.hosts[host.ID] = host
 
@@ -277,6 +387,33 @@ func (m *MemoryRepo) IngestHeartbeat(_ context.Context, hb Heartbeat) error {
 	site.LastHeartbeatAt = &now
 	m.sites[site.ID] = site
 
+	if hb.NetBird != nil {
+		status := *hb.NetBird
+		status.AgentID = agent.ID
+		status.TenantID = agent.TenantID
+		status.SiteID = agent.SiteID
+		status.UpdatedAt = now
+		var prev *AgentNetworkStatus
+		if last, ok := m.agentNetwork[agent.ID]; ok {
+			prev = &last
+		}
+		if connectivityChanged(prev, status) {
+			m.connectivity[agent.ID] = append(m.connectivity[agent.ID], ConnectivityTransition{
+				AgentID:   agent.ID,
+				TenantID:  agent.TenantID,
+				SiteID:    agent.SiteID,
+				Connected: status.Connected,
+				State:     status.State,
+				Reason:    status.Reason,
+				At:        now,
+			})
+		}
+		m.agentNetwork[agent.ID] = status
+	}
+	if hb.Metrics != nil {
+		m.agentMetrics[agent.ID] = AgentMetrics{AgentID: agent.ID, TenantID: agent.TenantID, SiteID: agent.SiteID, Metrics: maps.Clone(hb.Metrics), ReportedAt: now}
+	}
+
 	for _, vm := range hb.MicroVMs {
 		if vm.ID == "" {
 			continue
@@ -325,6 +462,66 @@ func (m *MemoryRepo) IngestHeartbeat(_ context.Context, hb Heartbeat) error {
 	return nil
 }
 
+func (m *MemoryRepo) ListPrometheusTargets(_ context.Context, tenantID, siteID string) ([]PrometheusTarget, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]PrometheusTarget, 0)
+	for _, agent := range m.agents {
+		if agent.TenantID != tenantID || agent.SiteID != siteID || agent.State != "ONLINE" || agent.MetricsAddr == "" {
+			continue
+		}
+		out = append(out, PrometheusTarget{
+			AgentID:     agent.ID,
+			HostID:      agent.HostID,
+			Hostname:    m.hosts[agent.HostID].Hostname,
+			PeerIP:      m.agentNetwork[agent.ID].PeerIP,
+			MetricsAddr: agent.MetricsAddr,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AgentID < out[j].AgentID })
+	return out, nil
+}
+
+func (m *MemoryRepo) ListAgentMetrics(_ context.Context, tenantID, siteID string) ([]AgentMetrics, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]AgentMetrics, 0)
+	for _, snapshot := range m.agentMetrics {
+		if snapshot.TenantID == tenantID && snapshot.SiteID == siteID {
+			snapshot.Metrics = maps.Clone(snapshot.Metrics)
+			out = append(out, snapshot)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AgentID < out[j].AgentID })
+	return out, nil
+}
+
+func (m *MemoryRepo) GetAgentNetworkStatus(_ context.Context, tenantID, agentID string) (AgentNetworkStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.agentNetwork[agentID]
+	if !ok || status.TenantID != tenantID {
+		return AgentNetworkStatus{}, ErrNotFound
+	}
+	return status, nil
+}
+
+func (m *MemoryRepo) ListAgentConnectivityHistory(_ context.Context, tenantID, agentID string, from, to time.Time, limit int) ([]ConnectivityTransition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]ConnectivityTransition, 0)
+	for _, t := range m.connectivity[agentID] {
+		if t.TenantID != tenantID || t.At.Before(from) || !t.At.Before(to) {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
 func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPlanResult, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -332,7 +529,22 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 	if !ok || s.TenantID != input.TenantID {
 		return ApplyPlanResult{}, ErrUnauthorized
 	}
+	if err := ValidatePlanMetadata(input.Metadata); err != nil {
+		return ApplyPlanResult{}, err
+	}
+	if err := CheckActionPayloads(input.Actions, m.maxActionPayload); err != nil {
+		return ApplyPlanResult{}, err
+	}
+	resolved, err := ResolveResources(input.Actions)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	input.Actions = resolved
 	key := input.TenantID + ":" + input.IdempotencyKey
+	if planID, ok := m.planByIdempotency[key]; ok && m.idempotencyWindow > 0 &&
+		m.plans[planID].CreatedAt.Before(time.Now().UTC().Add(-m.idempotencyWindow)) {
+		delete(m.planByIdempotency, key)
+	}
 	if planID, ok := m.planByIdempotency[key]; ok {
 		plan := m.plans[planID]
 		execs := make([]Execution, 0)
@@ -345,13 +557,40 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 		return ApplyPlanResult{Plan: plan, Executions: execs, Deduplicated: true}, nil
 	}
 
-	planVersion := int64(1)
-	for _, p := range m.plans {
-		if p.SiteID == input.SiteID && p.PlanVersion >= planVersion {
-			planVersion = p.PlanVersion + 1
+	planVersion := m.nextPlanVersionLocked(input.SiteID)
+	tmpl := input.NameTemplate
+	if tmpl == "" {
+		tmpl = s.NameTemplate
+	}
+	var namer *vmNamer
+	if tmpl != "" {
+		if err := ValidateNameTemplate(tmpl); err != nil {
+			return ApplyPlanResult{}, err
+		}
+		existing := make([]string, 0)
+		for _, vm := range m.microVMs {
+			if vm.SiteID == input.SiteID {
+				existing = append(existing, vm.Name)
+			}
+		}
+		namer = newVMNamer(tmpl, s.Name, planVersion, existing)
+	}
+	inputActions, err := prepareActions(input.Actions, namer, uuid.NewString)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	if s.UniqueVMNames {
+		existing := make(map[string]string)
+		for _, vm := range m.microVMs {
+			if vm.SiteID == input.SiteID {
+				existing[vm.ID] = vm.Name
+			}
+		}
+		if err := checkUniqueVMNames(inputActions, existing); err != nil {
+			return ApplyPlanResult{}, err
 		}
 	}
-	opsJSON, _ := json.Marshal(input.Actions)
+	opsJSON, _ := json.Marshal(inputActions)
 	plan := Plan{
 		ID:             uuid.NewString(),
 		TenantID:       input.TenantID,
@@ -361,19 +600,41 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 		Status:         "PENDING",
 		OperationsJSON: opsJSON,
 		CreatedAt:      time.Now().UTC(),
+		RetriedFrom:    input.RetriedFrom,
+		Metadata:       normalizePlanMetadata(input.Metadata),
+		Sequential:     input.Sequential,
 	}
 	m.plans[plan.ID] = plan
 	m.planByIdempotency[key] = plan.ID
-	execs := make([]Execution, 0, len(input.Actions))
-	actions := make([]PlanAction, 0, len(input.Actions))
-	for _, action := range input.Actions {
+	execs := make([]Execution, 0, len(inputActions))
+	actions := make([]PlanAction, 0, len(inputActions))
+	skipped := false
+	for _, action := range inputActions {
 		opID := action.OperationID
-		if opID == "" {
-			opID = uuid.NewString()
-		}
 		vmID := action.VMID
-		if strings.ToUpper(action.Operation) == "CREATE" && vmID == "" {
-			vmID = uuid.NewString()
+		currentState := ""
+		if vm, ok := m.microVMs[vmID]; ok && vm.SiteID == input.SiteID {
+			currentState = vm.State
+		}
+		if reason := whenStateMismatch(action, currentState); reason != "" {
+			now := time.Now().UTC()
+			e := Execution{
+				ID:            uuid.NewString(),
+				TenantID:      input.TenantID,
+				SiteID:        input.SiteID,
+				PlanID:        plan.ID,
+				VMID:          vmID,
+				OperationID:   opID,
+				OperationType: strings.ToUpper(action.Operation),
+				State:         "SKIPPED",
+				ErrorMessage:  reason,
+				CompletedAt:   &now,
+				UpdatedAt:     now,
+			}
+			m.executions[e.ID] = e
+			execs = append(execs, e)
+			skipped = true
+			continue
 		}
 		if vmID != "" {
 			vm := m.microVMs[vmID]
@@ -390,6 +651,14 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 			if action.MemoryMiB > 0 {
 				vm.MemoryMiB = action.MemoryMiB
 			}
+			if action.VCPURequest > 0 {
+				vm.VCPURequest = action.VCPURequest
+				vm.VCPULimit = action.VCPULimit
+			}
+			if action.MemoryRequestMiB > 0 {
+				vm.MemoryRequestMiB = action.MemoryRequestMiB
+				vm.MemoryLimitMiB = action.MemoryLimitMiB
+			}
 			vm.UpdatedAt = time.Now().UTC()
 			m.microVMs[vmID] = vm
 		}
@@ -407,7 +676,11 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 		m.executions[e.ID] = e
 		execs = append(execs, e)
 
-		payload, _ := json.Marshal(action)
+		stored, contents := offloadFileContents(action)
+		for ref, content := range contents {
+			m.fileContents[ref] = content
+		}
+		payload, _ := json.Marshal(stored)
 		actions = append(actions, PlanAction{
 			ID:            uuid.NewString(),
 			PlanID:        plan.ID,
@@ -418,9 +691,262 @@ func (m *MemoryRepo) ApplyPlan(_ context.Context, input ApplyPlanInput) (ApplyPl
 		})
 	}
 	m.planActions[plan.ID] = actions
+	if skipped {
+		m.rollupPlanLocked(plan.ID, time.Now().UTC())
+		plan = m.plans[plan.ID]
+	}
 	return ApplyPlanResult{Plan: plan, Executions: execs}, nil
 }
 
+func (m *MemoryRepo) GetPlanStats(_ context.Context, tenantID, siteID string, from, to time.Time) (PlanStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int64)
+	for _, plan := range m.plans {
+		if plan.TenantID != tenantID || plan.SiteID != siteID || plan.CreatedAt.Before(from) || !plan.CreatedAt.Before(to) {
+			continue
+		}
+		counts[plan.Status]++
+	}
+	return NewPlanStats(counts), nil
+}
+
+func (m *MemoryRepo) GetPlan(_ context.Context, tenantID, planID string) (Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plan, ok := m.plans[planID]
+	if !ok || plan.TenantID != tenantID {
+		return Plan{}, ErrNotFound
+	}
+	counts := make(map[string]int)
+	for _, e := range m.executions {
+		if e.PlanID == planID {
+			counts[e.State]++
+		}
+	}
+	progress := NewPlanProgress(counts)
+	plan.Progress = &progress
+	return plan, nil
+}
+
+func (m *MemoryRepo) RetryPlan(ctx context.Context, tenantID, planID string, failedOnly bool) (ApplyPlanResult, error) {
+	m.mu.Lock()
+	plan, ok := m.plans[planID]
+	if !ok || plan.TenantID != tenantID {
+		m.mu.Unlock()
+		return ApplyPlanResult{}, ErrNotFound
+	}
+	execs := make([]Execution, 0)
+	for _, e := range m.executions {
+		if e.PlanID == planID {
+			execs = append(execs, e)
+		}
+	}
+	actions := make([]PlanAction, 0, len(m.planActions[planID]))
+	for _, action := range m.planActions[planID] {
+		payload, err := resolveFileContents(action.PayloadJSON, m.fileContents)
+		if err != nil {
+			m.mu.Unlock()
+			return ApplyPlanResult{}, err
+		}
+		action.PayloadJSON = payload
+		actions = append(actions, action)
+	}
+	m.mu.Unlock()
+
+	input, err := retryPlanInput(plan, actions, execs, failedOnly)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	return m.ApplyPlan(ctx, input)
+}
+
+func (m *MemoryRepo) MigrateVM(_ context.Context, tenantID, siteID, vmID, targetHostID string) (VMMigration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sites[siteID]; !ok || s.TenantID != tenantID {
+		return VMMigration{}, ErrUnauthorized
+	}
+	vm, ok := m.microVMs[vmID]
+	if !ok || vm.SiteID != siteID {
+		return VMMigration{}, ErrNotFound
+	}
+	target, ok := m.hosts[targetHostID]
+	if !ok || target.SiteID != siteID {
+		return VMMigration{}, fmt.Errorf("%w: target host %s", ErrNotFound, targetHostID)
+	}
+	for _, mig := range m.vmMigrations {
+		if mig.VMID == vmID && mig.Active() {
+			return VMMigration{}, ErrConflict
+		}
+	}
+	placed := make([]MicroVM, 0)
+	for _, p := range m.microVMs {
+		if p.HostID == targetHostID {
+			placed = append(placed, p)
+		}
+	}
+	if err := validateVMMigration(vm, target, placed); err != nil {
+		return VMMigration{}, err
+	}
+
+	now := time.Now().UTC()
+	mig := VMMigration{
+		ID:           uuid.NewString(),
+		TenantID:     tenantID,
+		SiteID:       siteID,
+		VMID:         vmID,
+		SourceHostID: vm.HostID,
+		TargetHostID: targetHostID,
+		State:        MigrationStateMigrating,
+		Step:         MigrationStepSnapshot,
+		CreatedAt:    now,
+	}
+	mig = m.scheduleMigrationStepLocked(mig, now)
+	m.vmMigrations[mig.ID] = mig
+	return mig, nil
+}
+
+func (m *MemoryRepo) GetVMMigration(_ context.Context, tenantID, migrationID string) (VMMigration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mig, ok := m.vmMigrations[migrationID]
+	if !ok || mig.TenantID != tenantID {
+		return VMMigration{}, ErrNotFound
+	}
+	return mig, nil
+}
+
+// SetLeaseStealPolicy sets when another agent may take over a plan whose
+// lease expired.
+func (m *MemoryRepo) SetLeaseStealPolicy(p LeaseStealPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leaseSteal = p
+}
+
+// SetIdempotencyWindow sets how long a plan's idempotency key keeps
+// deduplicating; once it passed, the key applies a new plan. Zero never
+// frees keys.
+func (m *MemoryRepo) SetIdempotencyWindow(window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotencyWindow = window
+}
+
+// SetMaxActionPayload bounds the encoded size of each action ApplyPlan
+// accepts; zero means DefaultMaxActionPayloadBytes.
+func (m *MemoryRepo) SetMaxActionPayload(limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxActionPayload = limit
+}
+
+// SetVMDNSHostnames sets how VMs are named in the DNS records registered
+// when their CREATE succeeds; see VMDNSHostname. An empty mode registers
+// none.
+func (m *MemoryRepo) SetVMDNSHostnames(mode string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.vmDNSHostnames = mode
+}
+
+func (m *MemoryRepo) ExpirePendingPlans(_ context.Context, createdBefore time.Time) ([]Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	out := make([]Plan, 0)
+	for id, plan := range m.plans {
+		if plan.Status != "PENDING" || !plan.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		plan.Status = "EXPIRED"
+		m.plans[id] = plan
+		delete(m.planLeases, id)
+		for execID, exec := range m.executions {
+			if exec.PlanID != id || exec.State != "PENDING" {
+				continue
+			}
+			exec.State = "EXPIRED"
+			exec.ErrorMessage = planExpiredMessage
+			exec.CompletedAt = &now
+			exec.UpdatedAt = now
+			m.executions[execID] = exec
+		}
+		out = append(out, plan)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *MemoryRepo) ReleaseIdempotencyKeys(_ context.Context, createdBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var released int64
+	for key, planID := range m.planByIdempotency {
+		if plan, ok := m.plans[planID]; !ok || plan.CreatedAt.Before(createdBefore) {
+			delete(m.planByIdempotency, key)
+			released++
+		}
+	}
+	return released, nil
+}
+
+func (m *MemoryRepo) PurgePlans(_ context.Context, createdBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for id, plan := range m.plans {
+		if isRunnablePlanStatus(plan.Status) || !plan.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		delete(m.plans, id)
+		delete(m.planActions, id)
+		delete(m.planLeases, id)
+		if key := plan.TenantID + ":" + plan.IdempotencyKey; m.planByIdempotency[key] == id {
+			delete(m.planByIdempotency, key)
+		}
+		for execID, exec := range m.executions {
+			if exec.PlanID == id {
+				delete(m.executions, execID)
+				delete(m.executionLogs, execID)
+				delete(m.consoleLogs, execID)
+			}
+		}
+		for token := range m.resultTokens {
+			if strings.HasPrefix(token, id+"/") {
+				delete(m.resultTokens, token)
+			}
+		}
+		purged++
+	}
+	for id, plan := range m.plans {
+		if plan.RetriedFrom != "" {
+			if _, ok := m.plans[plan.RetriedFrom]; !ok {
+				plan.RetriedFrom = ""
+				m.plans[id] = plan
+			}
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for _, actions := range m.planActions {
+		for _, action := range actions {
+			for _, ref := range fileContentRefs(action.PayloadJSON) {
+				referenced[ref] = true
+			}
+		}
+	}
+	for ref := range m.fileContents {
+		if !referenced[ref] {
+			delete(m.fileContents, ref)
+		}
+	}
+	return purged, nil
+}
+
 func (m *MemoryRepo) LeasePendingPlans(_ context.Context, agentID string, limit int, leaseTTL time.Duration) ([]LeasedPlan, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -429,6 +955,7 @@ func (m *MemoryRepo) LeasePendingPlans(_ context.Context, agentID string, limit
 	if !ok {
 		return nil, ErrNotFound
 	}
+	maintenance := m.hosts[agent.HostID].Maintenance
 	if limit <= 0 {
 		limit = 1
 	}
@@ -445,22 +972,58 @@ func (m *MemoryRepo) LeasePendingPlans(_ context.Context, agentID string, limit
 		if !isRunnablePlanStatus(plan.Status) {
 			continue
 		}
-		lease, leased := m.planLeases[plan.ID]
-		if leased && lease.AgentID != agentID && lease.ExpiresAt.After(now) {
+		if plan.HostID != "" && plan.HostID != agent.HostID {
+			continue
+		}
+		// Hosts in maintenance only run plans pinned to them, such as the
+		// migration steps that move VMs off the host.
+		if maintenance && plan.HostID == "" {
 			continue
 		}
+		lease, leased := m.planLeases[plan.ID]
+		if leased && lease.AgentID != agentID {
+			grace := m.leaseSteal.grace(leaseTTL, m.pendingOperationTypesLocked(plan.ID))
+			if lease.ExpiresAt.Add(grace).After(now) {
+				continue
+			}
+		}
 		if !m.planHasPendingExecutionsLocked(plan.ID) {
 			continue
 		}
+		// A scoped agent leaves plans outside its scope to other agents.
+		if !agent.Scope.allowsOperations(m.pendingOperationTypesLocked(plan.ID)) {
+			continue
+		}
 		candidates = append(candidates, plan)
 	}
 	sort.Slice(candidates, func(i, j int) bool { return candidates[i].CreatedAt.Before(candidates[j].CreatedAt) })
 
+	// Under max_vms the CREATEs of plans the agent already holds count
+	// against its host, and the CREATEs of the plans leased here are
+	// added in lease order so one call cannot overshoot the cap. A plan
+	// that does not fit holds back the CREATEs queued behind it, so a
+	// large plan is not starved by smaller ones.
+	hostVMs := 0
+	if agent.Scope != nil && agent.Scope.MaxVMs > 0 {
+		hostVMs = m.agentHostVMsLocked(agent)
+	}
 	out := make([]LeasedPlan, 0, min(limit, len(candidates)))
 	for _, plan := range candidates {
 		if len(out) >= limit {
 			break
 		}
+		if lease, held := m.planLeases[plan.ID]; !held || lease.AgentID != agentID {
+			if creates := countCreates(m.pendingOperationTypesLocked(plan.ID)); creates > 0 {
+				hostVMs += creates
+				if !agent.Scope.fitsVMs(hostVMs) {
+					continue
+				}
+			}
+		}
+		actions, err := m.leasedPlanActionsLocked(plan.ID)
+		if err != nil {
+			return nil, err
+		}
 		m.planLeases[plan.ID] = planLease{
 			AgentID:   agentID,
 			ExpiresAt: now.Add(leaseTTL),
@@ -469,39 +1032,110 @@ func (m *MemoryRepo) LeasePendingPlans(_ context.Context, agentID string, limit
 			plan.Status = "IN_PROGRESS"
 			m.plans[plan.ID] = plan
 		}
+		if len(actions) == 0 {
+			continue
+		}
+		out = append(out, LeasedPlan{
+			PlanID:         plan.ID,
+			ExecutionID:    plan.ID,
+			Actions:        actions,
+			Sequential:     plan.Sequential,
+			LeaseExpiresAt: now.Add(leaseTTL),
+		})
+	}
 
-		operationIDs := make(map[string]struct{})
-		for _, exec := range m.executions {
-			if exec.PlanID != plan.ID {
-				continue
-			}
-			if exec.State == "PENDING" || exec.State == "IN_PROGRESS" {
-				operationIDs[exec.OperationID] = struct{}{}
-			}
+	return out, nil
+}
+
+func (m *MemoryRepo) ListPlanExecutions(_ context.Context, tenantID, planID string) ([]Execution, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plan, ok := m.plans[planID]
+	if !ok || plan.TenantID != tenantID {
+		return nil, ErrNotFound
+	}
+	out := make([]Execution, 0)
+	for _, e := range m.executions {
+		if e.PlanID == planID {
+			out = append(out, e)
 		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.Before(out[j].UpdatedAt) })
+	return out, nil
+}
 
-		actions := make([]PlanAction, 0)
-		for _, action := range m.planActions[plan.ID] {
-			if _, ok := operationIDs[action.OperationID]; !ok {
-				continue
-			}
-			copied := action
-			copied.PayloadJSON = append([]byte(nil), action.PayloadJSON...)
-			actions = append(actions, copied)
+func (m *MemoryRepo) ListLeasedPlans(_ context.Context, tenantID, agentID string) ([]LeasedPlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agent, ok := m.agents[agentID]
+	if !ok || agent.TenantID != tenantID {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	plans := make([]Plan, 0)
+	for planID, lease := range m.planLeases {
+		if lease.AgentID != agentID || !lease.ExpiresAt.After(now) {
+			continue
+		}
+		plan, ok := m.plans[planID]
+		if !ok || plan.TenantID != tenantID || !isRunnablePlanStatus(plan.Status) {
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].CreatedAt.Before(plans[j].CreatedAt) })
+
+	out := make([]LeasedPlan, 0, len(plans))
+	for _, plan := range plans {
+		actions, err := m.leasedPlanActionsLocked(plan.ID)
+		if err != nil {
+			return nil, err
 		}
 		if len(actions) == 0 {
 			continue
 		}
 		out = append(out, LeasedPlan{
-			PlanID:      plan.ID,
-			ExecutionID: plan.ID,
-			Actions:     actions,
+			PlanID:         plan.ID,
+			ExecutionID:    plan.ID,
+			Actions:        actions,
+			Sequential:     plan.Sequential,
+			LeaseExpiresAt: m.planLeases[plan.ID].ExpiresAt,
 		})
 	}
-
 	return out, nil
 }
 
+// leasedPlanActionsLocked returns copies of the plan's actions whose
+// executions are still PENDING or IN_PROGRESS, with their file contents
+// put back; a content that is missing fails the lease, as in Postgres.
+func (m *MemoryRepo) leasedPlanActionsLocked(planID string) ([]PlanAction, error) {
+	operationIDs := make(map[string]struct{})
+	for _, exec := range m.executions {
+		if exec.PlanID != planID {
+			continue
+		}
+		if exec.State == "PENDING" || exec.State == "IN_PROGRESS" {
+			operationIDs[exec.OperationID] = struct{}{}
+		}
+	}
+
+	actions := make([]PlanAction, 0)
+	for _, action := range m.planActions[planID] {
+		if _, ok := operationIDs[action.OperationID]; !ok {
+			continue
+		}
+		copied := action
+		resolved, err := resolveFileContents(action.PayloadJSON, m.fileContents)
+		if err != nil {
+			return nil, err
+		}
+		copied.PayloadJSON = append([]byte(nil), resolved...)
+		actions = append(actions, copied)
+	}
+	return actions, nil
+}
+
 func (m *MemoryRepo) ReportPlanResult(_ context.Context, agentID string, report PlanResultReport) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -522,13 +1156,35 @@ func (m *MemoryRepo) ReportPlanResult(_ context.Context, agentID string, report
 	if !ok {
 		return ErrNotFound
 	}
+	// A plan of another tenant or site is not found, so its existence is
+	// not revealed.
 	if plan.TenantID != agent.TenantID || plan.SiteID != agent.SiteID {
-		return ErrUnauthorized
+		return ErrNotFound
 	}
 
 	now := time.Now().UTC()
+	// Only the agent holding the lease may report, unless the lease expired.
+	if lease, ok := m.planLeases[planID]; ok && lease.AgentID != agent.ID && lease.ExpiresAt.After(now) {
+		return ErrUnauthorized
+	}
+	results, duplicates := make([]PlanActionResultItem, 0, len(report.Results)), 0
 	for _, result := range report.Results {
-		actionID := strings.TrimSpace(result.ActionID)
+		if token := strings.TrimSpace(result.IdempotencyToken); token != "" {
+			if m.resultTokens[planID+"/"+token] {
+				duplicates++
+				continue
+			}
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 && duplicates > 0 {
+		return ErrDuplicateReport
+	}
+	for _, result := range results {
+		if token := strings.TrimSpace(result.IdempotencyToken); token != "" {
+			m.resultTokens[planID+"/"+token] = true
+		}
+		actionID := strings.TrimSpace(result.ActionID)
 		if actionID == "" {
 			continue
 		}
@@ -537,6 +1193,9 @@ func (m *MemoryRepo) ReportPlanResult(_ context.Context, agentID string, report
 			continue
 		}
 		exec := m.executions[execID]
+		if !agent.Scope.AllowsOperation(exec.OperationType) {
+			continue
+		}
 		updatedAt := result.FinishedAt
 		if updatedAt.IsZero() {
 			updatedAt = now
@@ -562,9 +1221,11 @@ func (m *MemoryRepo) ReportPlanResult(_ context.Context, agentID string, report
 		exec.CompletedAt = &completed
 		m.executions[execID] = exec
 		m.updateVMStateFromExecutionLocked(exec, updatedAt)
+		m.updateVMDNSFromExecutionLocked(exec, updatedAt)
 	}
 
 	m.rollupPlanLocked(planID, now)
+	m.advanceVMMigrationLocked(planID, now)
 	return nil
 }
 
@@ -575,7 +1236,11 @@ func (m *MemoryRepo) IngestLogs(_ context.Context, req LogIngest) (accepted int6
 	if !ok {
 		return 0, 0, ErrNotFound
 	}
+	minSeverity := m.tenants[agent.TenantID].MinLogSeverity
 	for _, entry := range req.Entries {
+		if belowMinSeverity(entry.Severity, minSeverity) {
+			continue
+		}
 		exec, ok := m.executions[entry.ExecutionID]
 		if !ok || exec.TenantID != agent.TenantID {
 			dropped++
@@ -607,11 +1272,59 @@ func (m *MemoryRepo) IngestLogs(_ context.Context, req LogIngest) (accepted int6
 	return accepted, dropped, nil
 }
 
-func (m *MemoryRepo) SweepOfflineAgents(_ context.Context, staleBefore time.Time) (int64, error) {
+func (m *MemoryRepo) PutExecutionConsoleLog(_ context.Context, agentID string, upload ConsoleLogUpload) (ExecutionConsoleLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agent, ok := m.agents[agentID]
+	if !ok {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	planID := m.resolvePlanIDLocked(upload.ExecutionID)
+	plan, ok := m.plans[planID]
+	if !ok {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	if plan.TenantID != agent.TenantID || plan.SiteID != agent.SiteID {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	// Only the agent holding the lease may upload, unless the lease expired.
+	if lease, ok := m.planLeases[planID]; ok && lease.AgentID != agent.ID && lease.ExpiresAt.After(time.Now().UTC()) {
+		return ExecutionConsoleLog{}, ErrUnauthorized
+	}
+	execID := m.executionIDByOperationLocked(planID, strings.TrimSpace(upload.ActionID))
+	if execID == "" {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	content, truncated := truncateConsoleLog(upload.Content, upload.Truncated)
+	out := ExecutionConsoleLog{
+		ExecutionID: execID,
+		TenantID:    agent.TenantID,
+		AgentID:     agent.ID,
+		VMID:        upload.VMID,
+		Content:     content,
+		Truncated:   truncated,
+		CapturedAt:  time.Now().UTC(),
+	}
+	m.consoleLogs[execID] = out
+	return out, nil
+}
+
+func (m *MemoryRepo) GetExecutionConsoleLog(_ context.Context, tenantID, executionID string) (ExecutionConsoleLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out, ok := m.consoleLogs[executionID]
+	if !ok || out.TenantID != tenantID {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	return out, nil
+}
+
+func (m *MemoryRepo) SweepOfflineAgents(_ context.Context, staleBefore time.Time) ([]Agent, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	var updated int64
+	marked := make([]Agent, 0)
 	for id, agent := range m.agents {
 		if agent.LastHeartbeatAt == nil {
 			continue
@@ -619,14 +1332,15 @@ func (m *MemoryRepo) SweepOfflineAgents(_ context.Context, staleBefore time.Time
 		if agent.LastHeartbeatAt.After(staleBefore) || agent.State == "OFFLINE" {
 			continue
 		}
+		marked = append(marked, agent)
 		agent.State = "OFFLINE"
 		m.agents[id] = agent
-		updated++
 	}
 	for siteID := range m.sites {
 		m.refreshSiteConnectivityLocked(siteID)
 	}
-	return updated, nil
+	sort.Slice(marked, func(i, j int) bool { return marked[i].ID < marked[j].ID })
+	return marked, nil
 }
 
 func (m *MemoryRepo) ListHosts(_ context.Context, tenantID, siteID string) ([]Host, error) {
@@ -640,6 +1354,7 @@ func (m *MemoryRepo) ListHosts(_ context.Context, tenantID, siteID string) ([]Ho
 				if a.HostID == h.ID {
 					host.AgentState = normalizeAgentState(a.State)
 					host.AgentLastHeartbeatAt = a.LastHeartbeatAt
+					host.AgentMetadata = a.Metadata
 					break
 				}
 			}
@@ -653,6 +1368,94 @@ func (m *MemoryRepo) ListHosts(_ context.Context, tenantID, siteID string) ([]Ho
 	return out, nil
 }
 
+func (m *MemoryRepo) ListTenantAgents(_ context.Context, tenantID string, query TenantAgentQuery) ([]TenantAgent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]TenantAgent, 0)
+	for _, a := range m.agents {
+		state := normalizeAgentState(a.State)
+		if a.TenantID != tenantID || (query.State != "" && state != query.State) || (query.Cursor != "" && a.ID <= query.Cursor) {
+			continue
+		}
+		item := TenantAgent{
+			ID:              a.ID,
+			SiteID:          a.SiteID,
+			SiteName:        m.sites[a.SiteID].Name,
+			HostID:          a.HostID,
+			Hostname:        m.hosts[a.HostID].Hostname,
+			State:           state,
+			AgentVersion:    a.AgentVersion,
+			OS:              a.OS,
+			Arch:            a.Arch,
+			LastHeartbeatAt: a.LastHeartbeatAt,
+			CertExpiresAt:   currentCertExpiry(a),
+			Metadata:        a.Metadata,
+		}
+		if shutdown, ok := m.agentShutdowns[a.ID]; ok {
+			at := shutdown.At
+			item.LastShutdownReason, item.LastShutdownAt = shutdown.Reason, &at
+		}
+		out = append(out, item)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	if query.Limit > 0 && len(out) > query.Limit {
+		out = out[:query.Limit]
+	}
+	return out, nil
+}
+
+// currentCertExpiry returns the expiry recorded for the agent's current
+// certificate serial.
+func currentCertExpiry(a Agent) *time.Time {
+	certHistoryStore.Lock()
+	defer certHistoryStore.Unlock()
+	entries := certHistoryStore.entries[a.ID]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Serial == a.CertSerial {
+			expires := entries[i].ExpiresAt
+			return &expires
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepo) SetHostMaintenance(_ context.Context, tenantID, siteID, hostID string, maintenance bool) (Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	host, ok := m.hosts[hostID]
+	if !ok || host.TenantID != tenantID || host.SiteID != siteID {
+		return Host{}, ErrNotFound
+	}
+	host.Maintenance = maintenance
+	m.hosts[hostID] = host
+	return host, nil
+}
+
+func (m *MemoryRepo) SetAgentMetadata(_ context.Context, tenantID, siteID, agentID string, metadata json.RawMessage) error {
+	if err := ValidateAgentMetadata(metadata); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, ok := m.agents[agentID]
+	if !ok || agent.TenantID != tenantID || agent.SiteID != siteID {
+		return ErrNotFound
+	}
+	agent.Metadata = normalizePlanMetadata(metadata)
+	m.agents[agentID] = agent
+	return nil
+}
+
+func (m *MemoryRepo) AgentHostInMaintenance(_ context.Context, agentID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, ok := m.agents[agentID]
+	if !ok {
+		return false, ErrNotFound
+	}
+	return m.hosts[agent.HostID].Maintenance, nil
+}
+
 func (m *MemoryRepo) ListVMs(_ context.Context, tenantID, siteID string) ([]MicroVM, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -681,6 +1484,24 @@ func (m *MemoryRepo) ListExecutionLogs(_ context.Context, tenantID, executionID
 	return entries, nil
 }
 
+func (m *MemoryRepo) GetExecutionLogStats(_ context.Context, tenantID, executionID string) (ExecutionLogStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exec, ok := m.executions[executionID]
+	if !ok || exec.TenantID != tenantID {
+		return ExecutionLogStats{}, ErrNotFound
+	}
+	stats := ExecutionLogStats{
+		ExecutionID: executionID,
+		BySeverity:  map[string]int64{"DEBUG": 0, "INFO": 0, "WARN": 0, "ERROR": 0},
+	}
+	for _, l := range m.executionLogs[executionID] {
+		stats.Total++
+		stats.BySeverity[l.Severity]++
+	}
+	return stats, nil
+}
+
 func (m *MemoryRepo) WriteAudit(_ context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -706,6 +1527,170 @@ func (m *MemoryRepo) SiteBelongsToTenant(_ context.Context, siteID, tenantID str
 	return ok && s.TenantID == tenantID, nil
 }
 
+func (m *MemoryRepo) GetSiteImageDefaults(_ context.Context, tenantID, siteID string) (map[string]VMImage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return nil, ErrNotFound
+	}
+	out := make(map[string]VMImage, len(m.siteImageDefaults[siteID]))
+	for arch, img := range m.siteImageDefaults[siteID] {
+		out[arch] = img
+	}
+	return out, nil
+}
+
+func (m *MemoryRepo) SetSiteImageDefaults(_ context.Context, tenantID, siteID string, images map[string]VMImage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return ErrNotFound
+	}
+	stored := make(map[string]VMImage, len(images))
+	for arch, img := range images {
+		stored[arch] = img
+	}
+	m.siteImageDefaults[siteID] = stored
+	return nil
+}
+
+func (m *MemoryRepo) SetSiteVMNamePolicy(_ context.Context, tenantID, siteID string, uniqueNames bool, nameTemplate string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return ErrNotFound
+	}
+	s.UniqueVMNames = uniqueNames
+	s.NameTemplate = nameTemplate
+	m.sites[siteID] = s
+	return nil
+}
+
+func (m *MemoryRepo) GetSiteDesiredState(_ context.Context, tenantID, siteID string) (DesiredState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return DesiredState{}, ErrNotFound
+	}
+	out := m.siteDesiredState[siteID]
+	out.VMs = append([]DesiredVM(nil), out.VMs...)
+	return out, nil
+}
+
+func (m *MemoryRepo) SetSiteDesiredState(_ context.Context, tenantID, siteID string, state DesiredState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return ErrNotFound
+	}
+	state.VMs = append([]DesiredVM(nil), state.VMs...)
+	m.siteDesiredState[siteID] = state
+	return nil
+}
+
+func (m *MemoryRepo) GetSiteAgentRollout(_ context.Context, tenantID, siteID string) (AgentRollout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return AgentRollout{}, ErrNotFound
+	}
+	return m.siteAgentRollout[siteID], nil
+}
+
+func (m *MemoryRepo) SetSiteAgentRollout(_ context.Context, tenantID, siteID string, rollout AgentRollout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sites[siteID]
+	if !ok || s.TenantID != tenantID {
+		return ErrNotFound
+	}
+	m.siteAgentRollout[siteID] = rollout
+	for id, u := range m.agentUpgrades {
+		if u.SiteID == siteID && u.State == AgentUpgradeFailed {
+			delete(m.agentUpgrades, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepo) ClaimAgentUpgrade(_ context.Context, agentID, version string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, ok := m.agents[agentID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	rollout := m.siteAgentRollout[agent.SiteID]
+	now := time.Now().UTC()
+	if u, ok := m.agentUpgrades[agentID]; ok && u.TargetVersion == version && u.State != AgentUpgradeSucceeded {
+		u.State = AgentUpgradeSucceeded
+		u.UpdatedAt = now
+		m.agentUpgrades[agentID] = u
+	}
+	versions := make(map[string]string)
+	upgrades := make(map[string]AgentUpgrade)
+	for id, a := range m.agents {
+		if a.SiteID != agent.SiteID || a.State == "UNENROLLED" {
+			continue
+		}
+		versions[id] = a.AgentVersion
+		if u, ok := m.agentUpgrades[id]; ok {
+			upgrades[id] = u
+		}
+	}
+	versions[agentID] = version
+	if !ShouldSignalUpgrade(rollout, agentID, version, versions, upgrades) {
+		return "", nil
+	}
+	if u, ok := upgrades[agentID]; !ok || u.TargetVersion != rollout.TargetVersion {
+		m.agentUpgrades[agentID] = AgentUpgrade{
+			AgentID:       agentID,
+			SiteID:        agent.SiteID,
+			FromVersion:   version,
+			TargetVersion: rollout.TargetVersion,
+			State:         AgentUpgradeSignaled,
+			UpdatedAt:     now,
+		}
+	}
+	return rollout.TargetVersion, nil
+}
+
+func (m *MemoryRepo) ReportAgentUpgrade(_ context.Context, agentID string, report AgentUpgradeReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.agentUpgrades[agentID]
+	if !ok || u.TargetVersion != report.TargetVersion {
+		return ErrNotFound
+	}
+	u.State = AgentUpgradeFailed
+	if report.OK {
+		u.State = AgentUpgradeSucceeded
+	}
+	u.Message = report.Message
+	u.UpdatedAt = time.Now().UTC()
+	m.agentUpgrades[agentID] = u
+	return nil
+}
+
+func (m *MemoryRepo) ListSiteAgentUpgrades(_ context.Context, tenantID, siteID string) ([]AgentUpgrade, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]AgentUpgrade, 0)
+	for _, u := range m.agentUpgrades {
+		if u.SiteID == siteID && m.sites[siteID].TenantID == tenantID {
+			out = append(out, u)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AgentID < out[j].AgentID })
+	return out, nil
+}
+
 func (m *MemoryRepo) ExecutionBelongsToTenant(_ context.Context, executionID, tenantID string) (bool, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -784,15 +1769,17 @@ func (m *MemoryRepo) ListEnrollmentTokens(_ context.Context, tenantID string) ([
 			CreatedAt: m.tokenCreated[token.ID],
 			ExpiresAt: token.ExpiresAt,
 			Consumed:  m.tokenUsed[token.ID],
+			Scope:     token.Scope,
+			TokenHash: token.TokenHash,
 		}
 
-		// Find consumed_at and agent_id by looking up agents
-		for _, agent := range m.agents {
-			if agent.SiteID == token.SiteID {
-				t.ConsumedByAgentID = &agent.ID
-				if agent.LastHeartbeatAt != nil {
-					t.ConsumedAt = agent.LastHeartbeatAt
-				}
+		if usedAt, ok := m.tokenUsedAt[token.ID]; ok {
+			t.ConsumedAt = &usedAt
+		}
+		for _, enrollment := range m.enrollments {
+			if enrollment.TokenID == token.ID {
+				agentID := enrollment.AgentID
+				t.ConsumedByAgentID = &agentID
 				break
 			}
 		}
@@ -804,6 +1791,125 @@ func (m *MemoryRepo) ListEnrollmentTokens(_ context.Context, tenantID string) ([
 	return out, nil
 }
 
+func (m *MemoryRepo) nextPlanVersionLocked(siteID string) int64 {
+	planVersion := int64(1)
+	for _, p := range m.plans {
+		if p.SiteID == siteID && p.PlanVersion >= planVersion {
+			planVersion = p.PlanVersion + 1
+		}
+	}
+	return planVersion
+}
+
+// scheduleMigrationStepLocked queues a plan, pinned to the host that runs
+// it, for the current step of mig.
+func (m *MemoryRepo) scheduleMigrationStepLocked(mig VMMigration, now time.Time) VMMigration {
+	action := mig.stepAction(m.hosts[mig.TargetHostID].Hostname)
+	opsJSON, _ := json.Marshal([]ApplyPlanAction{action})
+	plan := Plan{
+		ID:             uuid.NewString(),
+		TenantID:       mig.TenantID,
+		SiteID:         mig.SiteID,
+		IdempotencyKey: mig.stepIdempotencyKey(),
+		PlanVersion:    m.nextPlanVersionLocked(mig.SiteID),
+		Status:         "PENDING",
+		OperationsJSON: opsJSON,
+		CreatedAt:      now,
+		HostID:         mig.stepHostID(),
+	}
+	m.plans[plan.ID] = plan
+	m.planByIdempotency[plan.TenantID+":"+plan.IdempotencyKey] = plan.ID
+
+	payload, _ := json.Marshal(action)
+	m.planActions[plan.ID] = []PlanAction{{
+		ID:            uuid.NewString(),
+		PlanID:        plan.ID,
+		OperationID:   action.OperationID,
+		OperationType: action.Operation,
+		VMID:          mig.VMID,
+		PayloadJSON:   payload,
+	}}
+	e := Execution{
+		ID:            uuid.NewString(),
+		TenantID:      mig.TenantID,
+		SiteID:        mig.SiteID,
+		PlanID:        plan.ID,
+		VMID:          mig.VMID,
+		OperationID:   action.OperationID,
+		OperationType: action.Operation,
+		State:         "PENDING",
+		UpdatedAt:     now,
+	}
+	m.executions[e.ID] = e
+
+	mig.PlanID = plan.ID
+	mig.UpdatedAt = now
+	return mig
+}
+
+// advanceVMMigrationLocked moves on the migration whose current step ran
+// as planID once that plan has finished, and schedules its next step.
+func (m *MemoryRepo) advanceVMMigrationLocked(planID string, now time.Time) {
+	plan := m.plans[planID]
+	if plan.Status != "SUCCEEDED" && plan.Status != "FAILED" {
+		return
+	}
+	for id, mig := range m.vmMigrations {
+		if mig.PlanID != planID || !mig.Active() {
+			continue
+		}
+		message := ""
+		for _, e := range m.executions {
+			if e.PlanID == planID && e.State == "FAILED" {
+				message = e.ErrorMessage
+			}
+		}
+		ok := plan.Status == "SUCCEEDED"
+		if ok && mig.Step == MigrationStepRestore {
+			vm := m.microVMs[mig.VMID]
+			vm.HostID = mig.TargetHostID
+			vm.UpdatedAt = now
+			m.microVMs[mig.VMID] = vm
+		}
+		mig = advanceVMMigration(mig, ok, message)
+		mig.UpdatedAt = now
+		if mig.Active() {
+			mig = m.scheduleMigrationStepLocked(mig, now)
+		}
+		m.vmMigrations[id] = mig
+	}
+}
+
+func (m *MemoryRepo) pendingOperationTypesLocked(planID string) []string {
+	var ops []string
+	for _, exec := range m.executions {
+		if exec.PlanID == planID && (exec.State == "PENDING" || exec.State == "IN_PROGRESS") {
+			ops = append(ops, exec.OperationType)
+		}
+	}
+	return ops
+}
+
+// agentHostVMsLocked counts the VMs on the agent's host together with
+// the VMs still being created by plans the agent holds.
+func (m *MemoryRepo) agentHostVMsLocked(agent Agent) int {
+	vms := make(map[string]bool)
+	for _, vm := range m.microVMs {
+		if agent.HostID != "" && vm.HostID == agent.HostID {
+			vms[vm.ID] = true
+		}
+	}
+	for _, exec := range m.executions {
+		if exec.OperationType != "CREATE" || exec.VMID == "" || (exec.State != "PENDING" && exec.State != "IN_PROGRESS") {
+			continue
+		}
+		if lease, held := m.planLeases[exec.PlanID]; held && lease.AgentID == agent.ID {
+			vms[exec.VMID] = true
+		}
+	}
+	return len(vms)
+}
+
 func (m *MemoryRepo) planHasPendingExecutionsLocked(planID string) bool {
 	for _, exec := range m.executions {
 		if exec.PlanID != planID {
@@ -860,7 +1966,7 @@ func (m *MemoryRepo) rollupPlanLocked(planID string, now time.Time) {
 		case "IN_PROGRESS":
 			active = true
 			inProgress = true
-		case "SUCCEEDED":
+		case "SUCCEEDED", "SKIPPED":
 			completed = true
 		}
 	}
@@ -888,6 +1994,10 @@ func (m *MemoryRepo) updateVMStateFromExecutionLocked(exec Execution, at time.Ti
 	if strings.TrimSpace(exec.VMID) == "" {
 		return
 	}
+	// Migration steps move the VM through advanceVMMigrationLocked.
+	if strings.EqualFold(exec.OperationType, "MIGRATE") {
+		return
+	}
 	if !at.IsZero() {
 		t := at
 		vm, ok := m.microVMs[exec.VMID]
@@ -909,13 +2019,17 @@ func (m *MemoryRepo) updateVMStateFromExecutionLocked(exec Execution, at time.Ti
 			m.microVMs[exec.VMID] = vm
 			return
 		case "SUCCEEDED":
+			// The VM lives on the host that ran it, as in the Postgres repo.
+			if exec.HostID != "" {
+				vm.HostID = exec.HostID
+			}
 			switch strings.ToUpper(exec.OperationType) {
-			case "CREATE":
+			case "CREATE", "STOP":
 				vm.State = "STOPPED"
+				vm.LastPlanID, vm.LastOperationID = exec.PlanID, exec.OperationID
 			case "START":
 				vm.State = "RUNNING"
-			case "STOP":
-				vm.State = "STOPPED"
+				vm.LastPlanID, vm.LastOperationID = exec.PlanID, exec.OperationID
 			case "DELETE":
 				delete(m.microVMs, exec.VMID)
 				return
@@ -925,6 +2039,45 @@ func (m *MemoryRepo) updateVMStateFromExecutionLocked(exec Execution, at time.Ti
 	}
 }
 
+// updateVMDNSFromExecutionLocked registers the DNS records of a VM whose
+// CREATE succeeded and removes those of a deleted VM.
+func (m *MemoryRepo) updateVMDNSFromExecutionLocked(exec Execution, at time.Time) {
+	if exec.State != "SUCCEEDED" || strings.TrimSpace(exec.VMID) == "" {
+		return
+	}
+	switch strings.ToUpper(exec.OperationType) {
+	case "CREATE":
+		m.registerVMDNSLocked(exec.VMID, at)
+	case "DELETE":
+		for key, rec := range m.vmDNS {
+			if rec.VMID == exec.VMID {
+				delete(m.vmDNS, key)
+			}
+		}
+	}
+}
+
+// registerVMDNSLocked records the DNS records of a created VM on the
+// networks it is attached to, keeping hostnames unique per network.
+func (m *MemoryRepo) registerVMDNSLocked(vmID string, at time.Time) {
+	vm, ok := m.microVMs[vmID]
+	if !ok || m.vmDNSHostnames == "" {
+		return
+	}
+	taken := func(networkID, hostname string) bool {
+		for _, rec := range m.vmDNS {
+			if rec.NetworkID == networkID && rec.Hostname == hostname && rec.VMID != vmID {
+				return true
+			}
+		}
+		return false
+	}
+	attachments := m.listAttachmentsLocked(func(a VMNetworkAttachment) bool { return a.VMID == vmID })
+	for _, rec := range vmDNSRecords(m.vmDNSHostnames, vm, attachments, at, taken) {
+		m.vmDNS[rec.NetworkID+"/"+rec.VMID] = rec
+	}
+}
+
 func (m *MemoryRepo) refreshSiteConnectivityLocked(siteID string) {
 	site, ok := m.sites[siteID]
 	if !ok {
@@ -992,6 +2145,87 @@ func (m *MemoryRepo) UnenrollAgent(_ context.Context, agentID string) error {
 	return nil
 }
 
+func (m *MemoryRepo) ReleaseAgentPlans(_ context.Context, agentID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.agents[agentID]; !ok {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	planIDs := map[string]struct{}{}
+	for planID, lease := range m.planLeases {
+		if lease.AgentID == agentID {
+			delete(m.planLeases, planID)
+			planIDs[planID] = struct{}{}
+		}
+	}
+	for id, exec := range m.executions {
+		// Leasing leaves a plan's executions PENDING, so every unfinished
+		// execution of a released plan fails: handing the plan to another
+		// agent could run a CREATE twice.
+		_, released := planIDs[exec.PlanID]
+		switch {
+		case exec.State == "PENDING" && released:
+		case exec.State == "IN_PROGRESS" && (released || exec.AgentID == agentID):
+		default:
+			continue
+		}
+		// Executions of a plan another agent now holds are its to finish.
+		if lease, ok := m.planLeases[exec.PlanID]; ok && lease.AgentID != agentID {
+			continue
+		}
+		exec.State = "FAILED"
+		exec.ErrorCode = ErrorCodeAgentUnenrolled
+		exec.ErrorMessage = "agent unenrolled before the action completed"
+		exec.UpdatedAt = now
+		exec.CompletedAt = &now
+		m.executions[id] = exec
+		m.updateVMStateFromExecutionLocked(exec, now)
+		planIDs[exec.PlanID] = struct{}{}
+	}
+	out := make([]string, 0, len(planIDs))
+	for planID := range planIDs {
+		m.rollupPlanLocked(planID, now)
+		m.advanceVMMigrationLocked(planID, now)
+		out = append(out, planID)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// RevokeTenantAgentCertificates revokes the certificate of every enrolled
+// agent in the tenant and unenrolls it. Agents are returned with the serial
+// that was revoked; already unenrolled agents are skipped.
+func (m *MemoryRepo) RevokeTenantAgentCertificates(_ context.Context, tenantID string, reason int) ([]Agent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.crlEntries == nil {
+		m.crlEntries = make(map[string]*CRLEntry)
+	}
+	now := time.Now().UTC()
+	out := make([]Agent, 0)
+	for id, agent := range m.agents {
+		if agent.TenantID != tenantID || agent.CertSerial == "" || agent.State == "UNENROLLED" {
+			continue
+		}
+		if _, exists := m.crlEntries[agent.CertSerial]; !exists {
+			m.crlEntries[agent.CertSerial] = &CRLEntry{
+				SerialNumber: agent.CertSerial,
+				RevokedAt:    now,
+				Reason:       reason,
+				AgentID:      id,
+			}
+		}
+		out = append(out, agent)
+		agent.State = "UNENROLLED"
+		agent.CertSerial = ""
+		agent.RefreshTokenHash = ""
+		m.agents[id] = agent
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
 func (m *MemoryRepo) UpdateAgentCertificate(_ context.Context, agentID, certSerial, refreshTokenHash string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -1079,36 +2313,169 @@ func (m *MemoryRepo) IsCertificateRevoked(_ context.Context, serial string) (boo
 	return exists, nil
 }
 
-// ListRevokedCertificates returns all revoked certificates
-func (m *MemoryRepo) ListRevokedCertificates(_ context.Context) ([]CRLEntry, error) {
+// ListRevokedCertificates returns the revoked certificates matching query,
+// newest first.
+func (m *MemoryRepo) ListRevokedCertificates(_ context.Context, query RevokedCertificateQuery) ([]CRLEntry, error) {
+	var after *CRLEntry
+	if query.Cursor != "" {
+		at, serial, err := ParseCRLCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = &CRLEntry{RevokedAt: at, SerialNumber: serial}
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	out := make([]CRLEntry, 0, len(m.crlEntries))
 	for _, entry := range m.crlEntries {
+		if query.AgentID != "" && entry.AgentID != query.AgentID {
+			continue
+		}
+		if (!query.From.IsZero() && entry.RevokedAt.Before(query.From)) || (!query.To.IsZero() && !entry.RevokedAt.Before(query.To)) {
+			continue
+		}
+		if after != nil && !crlEntryBefore(*after, *entry) {
+			continue
+		}
 		out = append(out, *entry)
 	}
+	sort.Slice(out, func(i, j int) bool { return crlEntryBefore(out[i], out[j]) })
+	if query.Limit > 0 && len(out) > query.Limit {
+		out = out[:query.Limit]
+	}
 	return out, nil
 }
 
-// GetTenantLimits returns the quota limits for a tenant
+// GetTenantLimits returns the limits set for the tenant, else those of its
+// quota template, else DefaultQuotaLimits.
 func (m *MemoryRepo) GetTenantLimits(_ context.Context, tenantID string) (*QuotaLimits, error) {
-	// MemoryRepo returns default limits
-	defaultLimits := QuotaLimits{
-		MaxSites:           10,
-		MaxAgentsPerSite:   100,
-		MaxVMsPerAgent:     50,
-		MaxConcurrentPlans: 100,
-		MaxAPIKeys:         20,
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limits, ok := m.tenantLimits[tenantID]; ok {
+		return &limits, nil
 	}
-	return &defaultLimits, nil
+	if tmpl, ok := m.quotaTemplates[m.tenants[tenantID].QuotaTemplate]; ok {
+		limits := tmpl.Limits
+		return &limits, nil
+	}
+	limits := DefaultQuotaLimits
+	return &limits, nil
 }
 
 // SetTenantLimits sets the quota limits for a tenant
 func (m *MemoryRepo) SetTenantLimits(_ context.Context, tenantID string, limits QuotaLimits) error {
-	// MemoryRepo stores limits in memory - for now just accept the call
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tenantLimits[tenantID] = limits
 	return nil
 }
 
+func (m *MemoryRepo) PutQuotaTemplate(_ context.Context, template QuotaTemplate) (QuotaTemplate, error) {
+	if err := ValidateQuotaTemplate(template); err != nil {
+		return QuotaTemplate{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	template.CreatedAt = now
+	if existing, ok := m.quotaTemplates[template.Name]; ok {
+		template.CreatedAt = existing.CreatedAt
+	}
+	template.UpdatedAt = now
+	m.quotaTemplates[template.Name] = template
+	return template, nil
+}
+
+func (m *MemoryRepo) GetQuotaTemplate(_ context.Context, name string) (QuotaTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tmpl, ok := m.quotaTemplates[name]
+	if !ok {
+		return QuotaTemplate{}, ErrNotFound
+	}
+	return tmpl, nil
+}
+
+func (m *MemoryRepo) ListQuotaTemplates(_ context.Context) ([]QuotaTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]QuotaTemplate, 0, len(m.quotaTemplates))
+	for _, tmpl := range m.quotaTemplates {
+		out = append(out, tmpl)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// DeleteQuotaTemplate returns ErrConflict while a tenant references the
+// template.
+func (m *MemoryRepo) DeleteQuotaTemplate(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.quotaTemplates[name]; !ok {
+		return ErrNotFound
+	}
+	for _, t := range m.tenants {
+		if t.QuotaTemplate == name {
+			return ErrConflict
+		}
+	}
+	delete(m.quotaTemplates, name)
+	return nil
+}
+
+func (m *MemoryRepo) CreateWebhook(_ context.Context, webhook Webhook) (Webhook, error) {
+	if err := ValidateWebhook(webhook); err != nil {
+		return Webhook{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tenants[webhook.TenantID]; !ok {
+		return Webhook{}, ErrNotFound
+	}
+	webhook.CreatedAt = time.Now().UTC()
+	m.webhooks[webhook.ID] = webhook
+	return webhook, nil
+}
+
+func (m *MemoryRepo) ListWebhooks(_ context.Context, tenantID string) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tenantWebhooks(tenantID), nil
+}
+
+func (m *MemoryRepo) DeleteWebhook(_ context.Context, tenantID, webhookID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hook, ok := m.webhooks[webhookID]; !ok || hook.TenantID != tenantID {
+		return ErrNotFound
+	}
+	delete(m.webhooks, webhookID)
+	return nil
+}
+
+func (m *MemoryRepo) ListSiteWebhooks(_ context.Context, siteID string) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	site, ok := m.sites[siteID]
+	if !ok {
+		return []Webhook{}, nil
+	}
+	return m.tenantWebhooks(site.TenantID), nil
+}
+
+// tenantWebhooks returns tenantID's webhooks oldest first. m.mu must be held.
+func (m *MemoryRepo) tenantWebhooks(tenantID string) []Webhook {
+	out := make([]Webhook, 0)
+	for _, hook := range m.webhooks {
+		if hook.TenantID == tenantID {
+			out = append(out, hook)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
 // GetTenantUsage returns current resource usage counts for a tenant
 func (m *MemoryRepo) GetTenantUsage(_ context.Context, tenantID string) (*TenantUsage, error) {
 	m.mu.Lock()
@@ -1154,6 +2521,71 @@ func (m *MemoryRepo) GetTenantUsage(_ context.Context, tenantID string) (*Tenant
 	return usage, nil
 }
 
+func (m *MemoryRepo) RecordTenantUsage(_ context.Context, tenantID string, at time.Time, usage TenantUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	day := UsageDay(at)
+	m.usageHistory[tenantID+"/"+day.Format(time.DateOnly)] = TenantUsageSnapshot{
+		TenantID:    tenantID,
+		Day:         day,
+		TenantUsage: usage,
+		RecordedAt:  at.UTC(),
+	}
+	return nil
+}
+
+func (m *MemoryRepo) ListTenantUsageHistory(_ context.Context, tenantID string, from, to time.Time) ([]TenantUsageSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to = UsageDay(from), UsageDay(to)
+	out := make([]TenantUsageSnapshot, 0)
+	for _, snap := range m.usageHistory {
+		if snap.TenantID == tenantID && !snap.Day.Before(from) && !snap.Day.After(to) {
+			out = append(out, snap)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Day.Before(out[j].Day) })
+	return out, nil
+}
+
+func (m *MemoryRepo) PruneTenantUsageHistory(_ context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff = UsageDay(cutoff)
+	var pruned int64
+	for key, snap := range m.usageHistory {
+		if snap.Day.Before(cutoff) {
+			delete(m.usageHistory, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (m *MemoryRepo) GetCapacity(_ context.Context, tenantID, siteID string) (Capacity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out Capacity
+	for _, h := range m.hosts {
+		if h.TenantID != tenantID || (siteID != "" && h.SiteID != siteID) {
+			continue
+		}
+		out.Hosts++
+		out.VCPUTotal += int64(h.CPUCoresTotal)
+		out.MemoryBytesTotal += h.MemoryBytesTotal
+	}
+	for _, vm := range m.microVMs {
+		if vm.TenantID != tenantID || (siteID != "" && vm.SiteID != siteID) || vm.State == "DELETING" {
+			continue
+		}
+		out.VCPUUsed += int64(firstPositive(vm.VCPURequest, vm.VCPUCount))
+		out.MemoryBytesUsed += firstPositive(vm.MemoryRequestMiB, vm.MemoryMiB) * 1024 * 1024
+	}
+	out.finalize()
+	return out, nil
+}
+
 // GetLastAuditEvent returns the last audit event for chain integrity
 func (m *MemoryRepo) GetLastAuditEvent(_ context.Context) (*AuditEvent, error) {
 	m.mu.Lock()
@@ -1220,6 +2652,33 @@ func (m *MemoryRepo) ListAuditEvents(_ context.Context, tenantID string, limit i
 	return events, nil
 }
 
+// ListAuditEventsAfter returns no events; MemoryRepo does not keep the
+// audit chain.
+func (m *MemoryRepo) ListAuditEventsAfter(_ context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	return []AuditEvent{}, nil
+}
+
+// RotateTenantEncryption has nothing to do; MemoryRepo keeps values in
+// plaintext.
+func (m *MemoryRepo) RotateTenantEncryption(_ context.Context) (int64, error) {
+	return 0, nil
+}
+
+// GetAuditCheckpoint returns the last checkpoint set.
+func (m *MemoryRepo) GetAuditCheckpoint(_ context.Context) (AuditCheckpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.auditCheckpoint, nil
+}
+
+// SetAuditCheckpoint records the audit verification checkpoint.
+func (m *MemoryRepo) SetAuditCheckpoint(_ context.Context, checkpoint AuditCheckpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.auditCheckpoint = checkpoint
+	return nil
+}
+
 // User authentication methods (stub implementations for testing)
 func (m *MemoryRepo) CreateUser(_ context.Context, user User) (User, error) { return user, nil }
 func (m *MemoryRepo) GetUserByEmail(_ context.Context, email string) (User, error) { return User{}, ErrNotFound }
@@ -1231,8 +2690,41 @@ func (m *MemoryRepo) EmailExists(_ context.Context, email string) (bool, error)
 func (m *MemoryRepo) CreateEmailVerificationToken(_ context.Context, userID, tenantID, tokenHash string, expiresAt time.Time) error { return nil }
 func (m *MemoryRepo) VerifyEmailToken(_ context.Context, tokenHash string) (userID, tenantID string, err error) { return "", "", ErrNotFound }
 func (m *MemoryRepo) MarkEmailVerified(_ context.Context, tenantID, userID string) error { return nil }
-func (m *MemoryRepo) ListTenants(_ context.Context) ([]Tenant, error) { return nil, nil }
-func (m *MemoryRepo) GetTenantByID(_ context.Context, tenantID string) (Tenant, error) { return Tenant{}, ErrNotFound }
+func (m *MemoryRepo) ListTenants(_ context.Context) ([]Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Tenant, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+func (m *MemoryRepo) SetTenantLogSeverity(_ context.Context, tenantID, severity string) (Tenant, error) {
+	if err := ValidateLogSeverity(severity); err != nil {
+		return Tenant{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tenants[tenantID]
+	if !ok {
+		return Tenant{}, ErrNotFound
+	}
+	t.MinLogSeverity = severity
+	t.UpdatedAt = time.Now().UTC()
+	m.tenants[tenantID] = t
+	return t, nil
+}
+
+func (m *MemoryRepo) GetTenantByID(_ context.Context, tenantID string) (Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tenants[tenantID]
+	if !ok {
+		return Tenant{}, ErrNotFound
+	}
+	return t, nil
+}
 
 // Team invitation methods (stub implementations for testing)
 func (m *MemoryRepo) CreateInvitation(_ context.Context, invitation ProjectInvitation) error { return nil }
@@ -1245,53 +2737,254 @@ func (m *MemoryRepo) CancelInvitation(_ context.Context, tenantID, invitationID
 func (m *MemoryRepo) GetInvitationByID(_ context.Context, tenantID, invitationID string) (*ProjectInvitation, error) { return nil, ErrNotFound }
 
 
-// VXLAN network methods (stub implementations for testing)
+// VXLAN network methods
 func (m *MemoryRepo) CreateVXLANNetwork(_ context.Context, tenantID, siteID string, network VXLANNetwork) (VXLANNetwork, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range m.vxlanNetworks {
+		if n.VNI == network.VNI || (n.TenantID == tenantID && n.SiteID == siteID && n.Name == network.Name) {
+			return VXLANNetwork{}, ErrConflict
+		}
+	}
+	now := time.Now().UTC()
+	network.TenantID = tenantID
+	network.SiteID = siteID
+	network.CreatedAt = now
+	network.UpdatedAt = now
+	m.vxlanNetworks[network.ID] = network
 	return network, nil
 }
 func (m *MemoryRepo) ListVXLANNetworks(_ context.Context, tenantID, siteID string) ([]VXLANNetwork, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []VXLANNetwork{}
+	for _, n := range m.vxlanNetworks {
+		if n.TenantID == tenantID && n.SiteID == siteID {
+			out = append(out, n)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
 }
 func (m *MemoryRepo) GetVXLANNetwork(_ context.Context, tenantID, networkID string) (VXLANNetwork, error) {
-	return VXLANNetwork{}, ErrNotFound
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.vxlanNetworks[networkID]
+	if !ok || n.TenantID != tenantID {
+		return VXLANNetwork{}, ErrNotFound
+	}
+	return n, nil
 }
 func (m *MemoryRepo) GetVXLANNetworkByVNI(_ context.Context, tenantID string, vni int) (VXLANNetwork, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range m.vxlanNetworks {
+		if n.TenantID == tenantID && n.VNI == vni {
+			return n, nil
+		}
+	}
 	return VXLANNetwork{}, ErrNotFound
 }
 func (m *MemoryRepo) DeleteVXLANNetwork(_ context.Context, tenantID, networkID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.vxlanNetworks[networkID]
+	if !ok || n.TenantID != tenantID {
+		return ErrNotFound
+	}
+	delete(m.vxlanNetworks, networkID)
+	for id, t := range m.vxlanTunnels {
+		if t.NetworkID == networkID {
+			delete(m.vxlanTunnels, id)
+		}
+	}
+	for id, a := range m.vmNetworkAttachments {
+		if a.NetworkID == networkID {
+			delete(m.vmNetworkAttachments, id)
+		}
+	}
+	for key, rec := range m.vmDNS {
+		if rec.NetworkID == networkID {
+			delete(m.vmDNS, key)
+		}
+	}
 	return nil
 }
 func (m *MemoryRepo) VXLANNetworkBelongsToTenant(_ context.Context, networkID, tenantID string) (bool, error) {
-	return false, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.vxlanNetworks[networkID]
+	return ok && n.TenantID == tenantID, nil
 }
 
-// VXLAN tunnel methods (stub implementations for testing)
+// VXLAN tunnel methods
 func (m *MemoryRepo) CreateVXLANTunnel(_ context.Context, tunnel VXLANTunnel) (VXLANTunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.vxlanTunnels {
+		if t.NetworkID == tunnel.NetworkID && t.HostID == tunnel.HostID {
+			return VXLANTunnel{}, ErrConflict
+		}
+	}
+	if tunnel.Status == "" {
+		tunnel.Status = "pending"
+	}
+	now := time.Now().UTC()
+	tunnel.CreatedAt = now
+	tunnel.UpdatedAt = now
+	m.vxlanTunnels[tunnel.ID] = tunnel
 	return tunnel, nil
 }
 func (m *MemoryRepo) ListVXLANTunnels(_ context.Context, networkID string) ([]VXLANTunnel, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []VXLANTunnel
+	for _, t := range m.vxlanTunnels {
+		if t.NetworkID == networkID {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
 }
 func (m *MemoryRepo) GetVXLANTunnel(_ context.Context, networkID, hostID string) (VXLANTunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.vxlanTunnels {
+		if t.NetworkID == networkID && t.HostID == hostID {
+			return t, nil
+		}
+	}
 	return VXLANTunnel{}, ErrNotFound
 }
 func (m *MemoryRepo) UpdateVXLANTunnelStatus(_ context.Context, tunnelID string, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.vxlanTunnels[tunnelID]
+	if !ok {
+		return nil
+	}
+	t.Status = status
+	t.UpdatedAt = time.Now().UTC()
+	m.vxlanTunnels[tunnelID] = t
 	return nil
 }
 func (m *MemoryRepo) DeleteVXLANTunnel(_ context.Context, tunnelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.vxlanTunnels[tunnelID]; !ok {
+		return ErrNotFound
+	}
+	delete(m.vxlanTunnels, tunnelID)
 	return nil
 }
 
-// VM network attachment methods (stub implementations for testing)
+// VM network attachment methods
 func (m *MemoryRepo) AttachVMToNetwork(_ context.Context, attachment VMNetworkAttachment) (VMNetworkAttachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	network, ok := m.vxlanNetworks[attachment.NetworkID]
+	if !ok {
+		return VMNetworkAttachment{}, ErrNotFound
+	}
+	var used []string
+	for _, a := range m.vmNetworkAttachments {
+		if a.NetworkID != attachment.NetworkID {
+			continue
+		}
+		if a.VMID == attachment.VMID {
+			return VMNetworkAttachment{}, ErrConflict
+		}
+		used = append(used, a.IPAddress)
+	}
+	ip, err := allocateAddress(network, attachment.IPAddress, used)
+	if err != nil {
+		return VMNetworkAttachment{}, err
+	}
+	attachment.IPAddress = ip
+	attachment.CreatedAt = time.Now().UTC()
+	m.vmNetworkAttachments[attachment.ID] = attachment
+	// A VM attached after its CREATE succeeded is registered right away.
+	if vm, ok := m.microVMs[attachment.VMID]; ok && vm.LastOperationID != "" {
+		m.registerVMDNSLocked(attachment.VMID, attachment.CreatedAt)
+	}
 	return attachment, nil
 }
 func (m *MemoryRepo) DetachVMFromNetwork(_ context.Context, vmID, networkID string) error {
-	return nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, a := range m.vmNetworkAttachments {
+		if a.VMID == vmID && a.NetworkID == networkID {
+			delete(m.vmNetworkAttachments, id)
+			delete(m.vmDNS, networkID+"/"+vmID)
+			return nil
+		}
+	}
+	return ErrNotFound
 }
 func (m *MemoryRepo) ListVMNetworkAttachments(_ context.Context, vmID string) ([]VMNetworkAttachment, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listAttachmentsLocked(func(a VMNetworkAttachment) bool { return a.VMID == vmID }), nil
 }
 func (m *MemoryRepo) ListNetworkVMAttachments(_ context.Context, networkID string) ([]VMNetworkAttachment, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.listAttachmentsLocked(func(a VMNetworkAttachment) bool { return a.NetworkID == networkID }), nil
+}
+func (m *MemoryRepo) ListVMNetworks(_ context.Context, tenantID, vmID string) ([]VMNetworkAttachmentWithNetwork, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vm, ok := m.microVMs[vmID]
+	if !ok || vm.TenantID != tenantID {
+		return nil, ErrNotFound
+	}
+	out := []VMNetworkAttachmentWithNetwork{}
+	for _, a := range m.listAttachmentsLocked(func(a VMNetworkAttachment) bool { return a.VMID == vmID }) {
+		n, ok := m.vxlanNetworks[a.NetworkID]
+		if !ok || n.TenantID != tenantID {
+			continue
+		}
+		out = append(out, VMNetworkAttachmentWithNetwork{
+			VMNetworkAttachment: a,
+			NetworkName:         n.Name,
+			VNI:                 n.VNI,
+			CIDR:                n.CIDR,
+			Gateway:             n.Gateway,
+			MTU:                 n.MTU,
+		})
+	}
+	return out, nil
+}
+
+func (m *MemoryRepo) ListVMDNSRecords(_ context.Context, siteID, networkID string) ([]VMDNSRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []VMDNSRecord{}
+	for _, rec := range m.vmDNS {
+		if (siteID != "" && rec.SiteID != siteID) || (networkID != "" && rec.NetworkID != networkID) {
+			continue
+		}
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].NetworkID != out[j].NetworkID {
+			return out[i].NetworkID < out[j].NetworkID
+		}
+		return out[i].Hostname < out[j].Hostname
+	})
+	return out, nil
+}
+
+// listAttachmentsLocked returns the attachments matching keep, newest first
+// like the Postgres queries.
+func (m *MemoryRepo) listAttachmentsLocked(keep func(VMNetworkAttachment) bool) []VMNetworkAttachment {
+	var out []VMNetworkAttachment
+	for _, a := range m.vmNetworkAttachments {
+		if keep(a) {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
 }
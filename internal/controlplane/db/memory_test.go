@@ -2,6 +2,9 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -95,6 +98,466 @@ func TestMemoryRepoReportPlanResultRollsPlanState(t *testing.T) {
 	}
 }
 
+func TestMemoryRepoReportPlanResultIgnoresAppliedTokens(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	applied, err := repo.ApplyPlan(context.Background(), ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "token-test",
+		Actions: []ApplyPlanAction{
+			{OperationID: "create-a", Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128},
+			{OperationID: "start-a", Operation: "START", VMID: "vm-1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	report := func(results ...PlanActionResultItem) error {
+		return repo.ReportPlanResult(context.Background(), agent.ID, PlanResultReport{PlanID: applied.Plan.ID, Results: results})
+	}
+	state := func(operationID string) string {
+		return repo.executions[repo.executionIDByOperationLocked(applied.Plan.ID, operationID)].State
+	}
+
+	if err := report(PlanActionResultItem{ActionID: "create-a", OK: true, IdempotencyToken: "tok-1"}); err != nil {
+		t.Fatalf("report result: %v", err)
+	}
+	// A resend with the same token is a no-op, even if its content differs.
+	if err := report(PlanActionResultItem{ActionID: "create-a", OK: false, ErrorCode: "BOOT_FAILED", IdempotencyToken: "tok-1"}); !errors.Is(err, ErrDuplicateReport) {
+		t.Fatalf("expected ErrDuplicateReport, got %v", err)
+	}
+	if got := state("create-a"); got != "SUCCEEDED" {
+		t.Fatalf("expected the duplicate not to re-transition the execution, got %s", got)
+	}
+
+	// A report mixing an applied token with a new one applies the new one.
+	if err := report(
+		PlanActionResultItem{ActionID: "create-a", OK: true, IdempotencyToken: "tok-1"},
+		PlanActionResultItem{ActionID: "start-a", OK: true, IdempotencyToken: "tok-2"},
+	); err != nil {
+		t.Fatalf("report result: %v", err)
+	}
+	if got := state("start-a"); got != "SUCCEEDED" {
+		t.Fatalf("expected the new result to apply, got %s", got)
+	}
+	if got := repo.plans[applied.Plan.ID].Status; got != "SUCCEEDED" {
+		t.Fatalf("expected plan status SUCCEEDED, got %s", got)
+	}
+}
+
+func TestMemoryRepoGetPlanStats(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	ctx := context.Background()
+
+	outcomes := []string{"SUCCEEDED", "SUCCEEDED", "SUCCEEDED", "FAILED", "PENDING", "SUCCEEDED"}
+	planIDs := make([]string, len(outcomes))
+	for i, outcome := range outcomes {
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: fmt.Sprintf("stats-%d", i),
+			Actions:        []ApplyPlanAction{{OperationID: "op", Operation: "CREATE", Name: fmt.Sprintf("vm-%d", i), VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply plan: %v", err)
+		}
+		planIDs[i] = applied.Plan.ID
+		if outcome == "PENDING" {
+			continue
+		}
+		if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{
+			PlanID:  applied.Plan.ID,
+			Results: []PlanActionResultItem{{ActionID: "op", OK: outcome == "SUCCEEDED"}},
+		}); err != nil {
+			t.Fatalf("report result: %v", err)
+		}
+	}
+	// The last plan falls outside the window.
+	old := repo.plans[planIDs[5]]
+	old.CreatedAt = time.Now().UTC().Add(-48 * time.Hour)
+	repo.plans[old.ID] = old
+
+	now := time.Now().UTC()
+	stats, err := repo.GetPlanStats(ctx, tenantID, siteID, now.Add(-24*time.Hour), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("get plan stats: %v", err)
+	}
+	if stats.Total != 5 || stats.Succeeded != 3 || stats.Failed != 1 || stats.Other != 1 || stats.StatusCounts["PENDING"] != 1 {
+		t.Fatalf("unexpected plan stats %+v", stats)
+	}
+	if stats.SuccessPercent != 75 {
+		t.Fatalf("expected 3 of 4 finished plans to be a 75%% success rate, got %v", stats.SuccessPercent)
+	}
+
+	stats, err = repo.GetPlanStats(ctx, tenantID, siteID, now.Add(time.Hour), now.Add(2*time.Hour))
+	if err != nil || stats.Total != 0 || stats.SuccessPercent != 0 {
+		t.Fatalf("expected an empty window to count nothing, got %+v (%v)", stats, err)
+	}
+}
+
+func TestMemoryRepoVMRecordsLastSuccessfulOperation(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	ctx := context.Background()
+
+	run := func(key, operationID, operation string, ok bool) string {
+		t.Helper()
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: operationID, Operation: operation, VMID: "vm-1", Name: "vm-1"}},
+		})
+		if err != nil {
+			t.Fatalf("apply plan %s: %v", key, err)
+		}
+		if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{
+			PlanID:  applied.Plan.ID,
+			Results: []PlanActionResultItem{{ActionID: operationID, OK: ok, Message: "done", FinishedAt: time.Now().UTC()}},
+		}); err != nil {
+			t.Fatalf("report result %s: %v", key, err)
+		}
+		return applied.Plan.ID
+	}
+	vm := func() MicroVM {
+		t.Helper()
+		vms, err := repo.ListVMs(ctx, tenantID, siteID)
+		if err != nil || len(vms) != 1 {
+			t.Fatalf("list vms: %v %+v", err, vms)
+		}
+		return vms[0]
+	}
+
+	createPlan := run("create", "create-vm-1", "CREATE", true)
+	if got := vm(); got.LastPlanID != createPlan || got.LastOperationID != "create-vm-1" {
+		t.Fatalf("expected the create to be recorded, got %+v", got)
+	}
+	startPlan := run("start", "start-vm-1", "START", true)
+	if got := vm(); got.State != "RUNNING" || got.LastPlanID != startPlan || got.LastOperationID != "start-vm-1" {
+		t.Fatalf("expected the start to be recorded, got %+v", got)
+	}
+	// A failed stop leaves the VM in ERROR but is not a successful change.
+	run("stop", "stop-vm-1", "STOP", false)
+	if got := vm(); got.State != "ERROR" || got.LastPlanID != startPlan || got.LastOperationID != "start-vm-1" {
+		t.Fatalf("expected the failed stop to keep the start recorded, got %+v", got)
+	}
+}
+
+func TestMemoryRepoGetPlanReportsProgress(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+
+	applied, err := repo.ApplyPlan(context.Background(), ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "progress-test",
+		Actions: []ApplyPlanAction{
+			{OperationID: "create-a", Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128},
+			{OperationID: "start-a", Operation: "START", VMID: "vm-1"},
+			{OperationID: "create-b", Operation: "CREATE", VMID: "vm-2", Name: "vm-2", VCPUCount: 1, MemoryMiB: 128},
+			{OperationID: "start-b", Operation: "START", VMID: "vm-2"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+
+	plan, err := repo.GetPlan(context.Background(), tenantID, applied.Plan.ID)
+	if err != nil {
+		t.Fatalf("get plan: %v", err)
+	}
+	if plan.Progress == nil || plan.Progress.Total != 4 || plan.Progress.Percent != 0 {
+		t.Fatalf("expected 0/4 progress before results, got %+v", plan.Progress)
+	}
+
+	if err := repo.ReportPlanResult(context.Background(), agent.ID, PlanResultReport{
+		PlanID:      applied.Plan.ID,
+		ExecutionID: applied.Plan.ID,
+		Results: []PlanActionResultItem{
+			{ActionID: "create-a", OK: true, FinishedAt: time.Now().UTC()},
+			{ActionID: "start-a", OK: true, FinishedAt: time.Now().UTC()},
+		},
+	}); err != nil {
+		t.Fatalf("report result: %v", err)
+	}
+
+	plan, err = repo.GetPlan(context.Background(), tenantID, applied.Plan.ID)
+	if err != nil {
+		t.Fatalf("get plan: %v", err)
+	}
+	progress := plan.Progress
+	if progress.Total != 4 || progress.Succeeded != 2 || progress.Percent != 50 {
+		t.Fatalf("expected 2/4 = 50%% progress, got %+v", progress)
+	}
+	if progress.StateCounts["SUCCEEDED"] != 2 || progress.StateCounts["PENDING"] != 2 {
+		t.Fatalf("unexpected state counts: %+v", progress.StateCounts)
+	}
+
+	if _, err := repo.GetPlan(context.Background(), uuid.NewString(), applied.Plan.ID); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for other tenant, got %v", err)
+	}
+}
+
+func TestMemoryRepoApplyPlanNameTemplate(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+
+	apply := func(key string, actions ...ApplyPlanAction) (ApplyPlanResult, error) {
+		return repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			NameTemplate:   "web-{index}-{site}",
+			Actions:        actions,
+		})
+	}
+
+	res, err := apply("naming-1",
+		ApplyPlanAction{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256},
+		ApplyPlanAction{Operation: "CREATE", Name: "web-2-site-a", VCPUCount: 1, MemoryMiB: 256},
+		ApplyPlanAction{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256},
+	)
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	res2, err := apply("naming-2", ApplyPlanAction{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256})
+	if err != nil {
+		t.Fatalf("apply second plan: %v", err)
+	}
+
+	want := []string{"web-1-site-a", "web-2-site-a", "web-3-site-a", "web-4-site-a"}
+	for i, e := range append(res.Executions, res2.Executions...) {
+		if got := repo.microVMs[e.VMID].Name; got != want[i] {
+			t.Fatalf("vm %d: got name %q, want %q", i, got, want[i])
+		}
+	}
+
+	_, err = repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "naming-3",
+		NameTemplate:   "web-1-{site}",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256}},
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for duplicate rendered name, got %v", err)
+	}
+	if len(repo.plans) != 2 {
+		t.Fatalf("rejected plan must not be stored, have %d plans", len(repo.plans))
+	}
+}
+
+func TestMemoryRepoApplyPlanRecordsRenderedActions(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	if err := repo.SetSiteVMNamePolicy(ctx, tenantID, siteID, false, "db-{index}"); err != nil {
+		t.Fatalf("set name policy: %v", err)
+	}
+
+	res, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "rendered-1",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256}},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	var ops []ApplyPlanAction
+	if err := json.Unmarshal(res.Plan.OperationsJSON, &ops); err != nil {
+		t.Fatalf("decode operations: %v", err)
+	}
+	e := res.Executions[0]
+	if len(ops) != 1 || ops[0].Name != "db-1" || ops[0].VMID != e.VMID || ops[0].OperationID != e.OperationID {
+		t.Fatalf("expected the plan to record the site template's name and the assigned IDs, got %+v for %+v", ops, e)
+	}
+	if got := repo.microVMs[e.VMID].Name; got != "db-1" {
+		t.Fatalf("expected the site template to name the VM, got %q", got)
+	}
+
+	// A plan's own template wins over the site's.
+	res, err = repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "rendered-2",
+		NameTemplate:   "web-{index}",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256}},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	if got := repo.microVMs[res.Executions[0].VMID].Name; got != "web-1" {
+		t.Fatalf("expected the plan template to name the VM, got %q", got)
+	}
+}
+
+func TestMemoryRepoApplyPlanUniqueVMNames(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+
+	apply := func(key string, actions ...ApplyPlanAction) (ApplyPlanResult, error) {
+		return repo.ApplyPlan(ctx, ApplyPlanInput{TenantID: tenantID, SiteID: siteID, IdempotencyKey: key, Actions: actions})
+	}
+	create := ApplyPlanAction{Operation: "CREATE", Name: "web", VCPUCount: 1, MemoryMiB: 256}
+
+	// Without the flag, duplicates are allowed.
+	if _, err := apply("unique-1", create); err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	if _, err := apply("unique-2", create); err != nil {
+		t.Fatalf("expected a duplicate name to be allowed with the flag off, got %v", err)
+	}
+
+	if err := repo.SetSiteVMNamePolicy(ctx, tenantID, siteID, true, ""); err != nil {
+		t.Fatalf("set unique vm names: %v", err)
+	}
+	if _, err := apply("unique-3", create); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a name used in the site, got %v", err)
+	}
+	other := ApplyPlanAction{Operation: "CREATE", Name: "db", VCPUCount: 1, MemoryMiB: 256}
+	if _, err := apply("unique-4", other, other); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a name used twice in the plan, got %v", err)
+	}
+	if len(repo.plans) != 2 {
+		t.Fatalf("rejected plans must not be stored, have %d plans", len(repo.plans))
+	}
+
+	// A plan that deletes every VM named web may recreate it.
+	actions := []ApplyPlanAction{create}
+	for _, vm := range repo.microVMs {
+		actions = append(actions, ApplyPlanAction{Operation: "DELETE", VMID: vm.ID})
+	}
+	if _, err := apply("unique-5", actions...); err != nil {
+		t.Fatalf("expected deleted names to be reusable, got %v", err)
+	}
+	if err := repo.SetSiteVMNamePolicy(ctx, uuid.NewString(), siteID, true, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for another tenant, got %v", err)
+	}
+}
+
+func TestMemoryRepoApplyPlanIdempotencyWindow(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	repo.SetIdempotencyWindow(time.Hour)
+	ctx := context.Background()
+	apply := func() ApplyPlanResult {
+		t.Helper()
+		res, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: "nightly-rebuild",
+			Actions:        []ApplyPlanAction{{Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply plan: %v", err)
+		}
+		return res
+	}
+
+	first := apply()
+	if again := apply(); !again.Deduplicated || again.Plan.ID != first.Plan.ID {
+		t.Fatalf("expected reuse within the window to return plan %s, got %+v", first.Plan.ID, again.Plan)
+	}
+
+	old := repo.plans[first.Plan.ID]
+	old.CreatedAt = old.CreatedAt.Add(-2 * time.Hour)
+	repo.plans[first.Plan.ID] = old
+	second := apply()
+	if second.Deduplicated || second.Plan.ID == first.Plan.ID {
+		t.Fatalf("expected reuse past the window to apply a new plan, got %+v", second.Plan)
+	}
+	if repo.plans[first.Plan.ID].IdempotencyKey != "nightly-rebuild" {
+		t.Fatal("expected the old plan to keep its key")
+	}
+	if again := apply(); !again.Deduplicated || again.Plan.ID != second.Plan.ID {
+		t.Fatalf("expected the key to deduplicate to the new plan, got %+v", again.Plan)
+	}
+
+	repo.SetIdempotencyWindow(0)
+	old = repo.plans[second.Plan.ID]
+	old.CreatedAt = old.CreatedAt.Add(-365 * 24 * time.Hour)
+	repo.plans[second.Plan.ID] = old
+	if again := apply(); !again.Deduplicated || again.Plan.ID != second.Plan.ID {
+		t.Fatalf("expected a zero window to keep keys forever, got %+v", again.Plan)
+	}
+}
+
+func TestMemoryRepoReleaseIdempotencyKeys(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	for _, key := range []string{"old-key", "new-key"} {
+		if _, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{Operation: "CREATE", VMID: "vm-" + key, Name: "vm-" + key, VCPUCount: 1, MemoryMiB: 128}},
+		}); err != nil {
+			t.Fatalf("apply plan: %v", err)
+		}
+	}
+	oldID := repo.planByIdempotency[tenantID+":old-key"]
+	old := repo.plans[oldID]
+	old.CreatedAt = old.CreatedAt.Add(-2 * time.Hour)
+	repo.plans[oldID] = old
+
+	released, err := repo.ReleaseIdempotencyKeys(ctx, time.Now().UTC().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 1 {
+		t.Fatalf("expected one key released, got %d", released)
+	}
+	if _, ok := repo.planByIdempotency[tenantID+":old-key"]; ok {
+		t.Fatal("expected the old key's mapping to be dropped")
+	}
+	if _, ok := repo.planByIdempotency[tenantID+":new-key"]; !ok {
+		t.Fatal("expected the new key's mapping to be kept")
+	}
+}
+
+func TestMemoryRepoApplyPlanWhenStateGuard(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	vmID := uuid.NewString()
+	repo.microVMs[vmID] = MicroVM{ID: vmID, TenantID: tenantID, SiteID: siteID, Name: "vm-a", State: "STOPPED"}
+
+	tests := []struct {
+		name       string
+		whenState  string
+		wantState  string
+		wantLeased bool
+		wantPlan   string
+	}{
+		{name: "skip when mismatch", whenState: "RUNNING", wantState: "SKIPPED", wantLeased: false, wantPlan: "SUCCEEDED"},
+		{name: "run when match", whenState: "stopped", wantState: "PENDING", wantLeased: true, wantPlan: "PENDING"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+				TenantID:       tenantID,
+				SiteID:         siteID,
+				IdempotencyKey: fmt.Sprintf("guard-%d", i),
+				Actions: []ApplyPlanAction{
+					{OperationID: "start", Operation: "START", VMID: vmID, WhenState: tt.whenState},
+				},
+			})
+			if err != nil {
+				t.Fatalf("apply plan: %v", err)
+			}
+			if len(res.Executions) != 1 || res.Executions[0].State != tt.wantState {
+				t.Fatalf("expected execution state %s, got %+v", tt.wantState, res.Executions)
+			}
+			if res.Plan.Status != tt.wantPlan {
+				t.Fatalf("expected plan status %s, got %s", tt.wantPlan, res.Plan.Status)
+			}
+			if leased := len(repo.planActions[res.Plan.ID]) > 0; leased != tt.wantLeased {
+				t.Fatalf("expected leasable action=%v, got %v", tt.wantLeased, leased)
+			}
+		})
+	}
+}
+
 func TestMemoryRepoSweepOfflineAgentsUpdatesHostState(t *testing.T) {
 	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
 	agent := newAgent(t, repo, tenantID, siteID, "host-a")
@@ -105,12 +568,12 @@ func TestMemoryRepoSweepOfflineAgentsUpdatesHostState(t *testing.T) {
 	stale.LastHeartbeatAt = &old
 	repo.agents[agent.ID] = stale
 
-	updated, err := repo.SweepOfflineAgents(context.Background(), time.Now().UTC().Add(-60*time.Second))
+	marked, err := repo.SweepOfflineAgents(context.Background(), time.Now().UTC().Add(-60*time.Second))
 	if err != nil {
 		t.Fatalf("sweep: %v", err)
 	}
-	if updated != 1 {
-		t.Fatalf("expected 1 updated agent, got %d", updated)
+	if len(marked) != 1 || marked[0].ID != agent.ID || marked[0].State != "ONLINE" {
+		t.Fatalf("expected the agent returned with its previous state, got %+v", marked)
 	}
 
 	hosts, err := repo.ListHosts(context.Background(), tenantID, siteID)
@@ -125,6 +588,123 @@ func TestMemoryRepoSweepOfflineAgentsUpdatesHostState(t *testing.T) {
 	}
 }
 
+func TestMemoryRepoIngestHeartbeatDropsStaleSequence(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	vmID := uuid.NewString()
+	heartbeat := func(seq int64, hostname, state string) error {
+		return repo.IngestHeartbeat(ctx, Heartbeat{
+			AgentID:      agent.ID,
+			HeartbeatSeq: seq,
+			Hostname:     hostname,
+			MicroVMs:     []MicroVMHeartbeat{{ID: vmID, Name: "web", State: state, VCPUCount: 1, MemoryMiB: 256}},
+		})
+	}
+	if err := heartbeat(2, "host-new", "RUNNING"); err != nil {
+		t.Fatalf("heartbeat 2: %v", err)
+	}
+	// Heartbeat 1 was delayed in transit and arrives last.
+	if err := heartbeat(1, "host-old", "CREATING"); !errors.Is(err, ErrStaleHeartbeat) {
+		t.Fatalf("expected ErrStaleHeartbeat, got %v", err)
+	}
+	if err := heartbeat(2, "host-old", "CREATING"); !errors.Is(err, ErrStaleHeartbeat) {
+		t.Fatalf("expected duplicate heartbeat to be stale, got %v", err)
+	}
+
+	hosts, err := repo.ListHosts(ctx, tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list hosts: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "host-new" {
+		t.Fatalf("expected newer facts to be kept, got %+v", hosts)
+	}
+	vms, err := repo.ListVMs(ctx, tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list vms: %v", err)
+	}
+	if len(vms) != 1 || vms[0].State != "RUNNING" {
+		t.Fatalf("expected newer VM state to be kept, got %+v", vms)
+	}
+
+	// Agents that do not number heartbeats are never dropped.
+	if err := heartbeat(0, "host-unsequenced", "STOPPED"); err != nil {
+		t.Fatalf("unsequenced heartbeat: %v", err)
+	}
+	if err := heartbeat(3, "host-next", "RUNNING"); err != nil {
+		t.Fatalf("heartbeat 3: %v", err)
+	}
+}
+
+func TestMemoryRepoGetCapacity(t *testing.T) {
+	repo, tenantID, siteA := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	siteB := uuid.NewString()
+	if _, err := repo.CreateSite(ctx, Site{ID: siteB, TenantID: tenantID, Name: "site-b"}); err != nil {
+		t.Fatalf("create site: %v", err)
+	}
+
+	const gib = int64(1024 * 1024 * 1024)
+	heartbeat := func(agent Agent, cores int, memBytes int64, vms ...MicroVMHeartbeat) {
+		t.Helper()
+		if err := repo.IngestHeartbeat(ctx, Heartbeat{
+			AgentID:          agent.ID,
+			Hostname:         "host-" + agent.ID[:8],
+			CPUCoresTotal:    cores,
+			MemoryBytesTotal: memBytes,
+			MicroVMs:         vms,
+		}); err != nil {
+			t.Fatalf("heartbeat: %v", err)
+		}
+	}
+	heartbeat(newAgent(t, repo, tenantID, siteA, "a1"), 4, 8*gib,
+		MicroVMHeartbeat{ID: uuid.NewString(), Name: "web", State: "RUNNING", VCPUCount: 2, MemoryMiB: 1024},
+		MicroVMHeartbeat{ID: uuid.NewString(), Name: "batch", State: "STOPPED", VCPUCount: 1, MemoryMiB: 512},
+	)
+	heartbeat(newAgent(t, repo, tenantID, siteA, "a2"), 8, 16*gib,
+		MicroVMHeartbeat{ID: uuid.NewString(), Name: "old", State: "DELETING", VCPUCount: 4, MemoryMiB: 4096},
+	)
+	heartbeat(newAgent(t, repo, tenantID, siteB, "b1"), 2, 4*gib,
+		MicroVMHeartbeat{ID: uuid.NewString(), Name: "big", State: "RUNNING", VCPUCount: 4, MemoryMiB: 2048},
+	)
+
+	site, err := repo.GetCapacity(ctx, tenantID, siteA)
+	if err != nil {
+		t.Fatalf("site capacity: %v", err)
+	}
+	want := Capacity{
+		Hosts:                2,
+		VCPUTotal:            12,
+		VCPUUsed:             3,
+		VCPUAvailable:        9,
+		MemoryBytesTotal:     24 * gib,
+		MemoryBytesUsed:      1536 * 1024 * 1024,
+		MemoryBytesAvailable: 24*gib - 1536*1024*1024,
+	}
+	if site != want {
+		t.Fatalf("site capacity = %+v, want %+v", site, want)
+	}
+
+	overcommitted, err := repo.GetCapacity(ctx, tenantID, siteB)
+	if err != nil {
+		t.Fatalf("site b capacity: %v", err)
+	}
+	if overcommitted.VCPUUsed != 4 || overcommitted.VCPUAvailable != 0 || overcommitted.MemoryBytesAvailable != 2*gib {
+		t.Fatalf("unexpected overcommitted capacity: %+v", overcommitted)
+	}
+
+	tenant, err := repo.GetCapacity(ctx, tenantID, "")
+	if err != nil {
+		t.Fatalf("tenant capacity: %v", err)
+	}
+	if tenant.Hosts != 3 || tenant.VCPUTotal != 14 || tenant.VCPUUsed != 7 || tenant.VCPUAvailable != 7 {
+		t.Fatalf("unexpected tenant vcpu capacity: %+v", tenant)
+	}
+	if tenant.MemoryBytesTotal != 28*gib || tenant.MemoryBytesUsed != 3584*1024*1024 {
+		t.Fatalf("unexpected tenant memory capacity: %+v", tenant)
+	}
+}
+
 func newMemoryRepoWithTenantSite(t *testing.T) (*MemoryRepo, string, string) {
 	t.Helper()
 	repo := NewMemoryRepo()
@@ -167,3 +747,147 @@ func newAgent(t *testing.T, repo *MemoryRepo, tenantID, siteID, hostname string)
 	}
 	return agent
 }
+
+func TestMemoryRepoReportPlanResultRequiresLeaseOwner(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	owner := newAgent(t, repo, tenantID, siteID, "owner")
+	other := newAgent(t, repo, tenantID, siteID, "other")
+
+	applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "lease-owner",
+		Actions:        []ApplyPlanAction{{OperationID: "create-1", Operation: "CREATE", VMID: "vm-1", Name: "vm-1"}},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	leased, err := repo.LeasePendingPlans(ctx, owner.ID, 1, time.Minute)
+	if err != nil || len(leased) != 1 {
+		t.Fatalf("lease plan: %v (leased %d)", err, len(leased))
+	}
+
+	report := PlanResultReport{
+		PlanID:  applied.Plan.ID,
+		Results: []PlanActionResultItem{{ActionID: "create-1", OK: true}},
+	}
+	if err := repo.ReportPlanResult(ctx, other.ID, report); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("non-owner report: expected ErrUnauthorized, got %v", err)
+	}
+	strangerTenant, otherSite := uuid.NewString(), uuid.NewString()
+	if _, err := repo.CreateTenant(ctx, Tenant{ID: strangerTenant, Slug: "other-" + strangerTenant[:8], Name: "Other", PrimaryRegion: "us-east-1", RetentionDays: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateSite(ctx, Site{ID: otherSite, TenantID: strangerTenant, Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	stranger := newAgent(t, repo, strangerTenant, otherSite, "stranger")
+	if err := repo.ReportPlanResult(ctx, stranger.ID, report); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("cross-tenant report: expected ErrNotFound, got %v", err)
+	}
+	plan, err := repo.GetPlan(ctx, tenantID, applied.Plan.ID)
+	if err != nil {
+		t.Fatalf("get plan: %v", err)
+	}
+	if plan.Status == "SUCCEEDED" {
+		t.Fatalf("non-owner report must not change the plan")
+	}
+
+	if err := repo.ReportPlanResult(ctx, owner.ID, report); err != nil {
+		t.Fatalf("owner report: %v", err)
+	}
+	plan, _ = repo.GetPlan(ctx, tenantID, applied.Plan.ID)
+	if plan.Status != "SUCCEEDED" {
+		t.Fatalf("expected plan SUCCEEDED after owner report, got %s", plan.Status)
+	}
+}
+
+func TestMemoryRepoReportPlanResultAfterLeaseExpiry(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	owner := newAgent(t, repo, tenantID, siteID, "owner")
+	other := newAgent(t, repo, tenantID, siteID, "other")
+
+	applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "lease-expired",
+		Actions:        []ApplyPlanAction{{OperationID: "create-1", Operation: "CREATE", VMID: "vm-1", Name: "vm-1"}},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	if _, err := repo.LeasePendingPlans(ctx, owner.ID, 1, time.Nanosecond); err != nil {
+		t.Fatalf("lease plan: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	err = repo.ReportPlanResult(ctx, other.ID, PlanResultReport{
+		PlanID:  applied.Plan.ID,
+		Results: []PlanActionResultItem{{ActionID: "create-1", OK: true}},
+	})
+	if err != nil {
+		t.Fatalf("report after lease expiry: %v", err)
+	}
+}
+
+func TestMemoryRepoRetryPlanKeepsGeneratedVMIdentity(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	ctx := context.Background()
+
+	applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "retry-create",
+		NameTemplate:   "web-{index}",
+		Actions: []ApplyPlanAction{
+			{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256},
+			{Operation: "CREATE", VCPUCount: 1, MemoryMiB: 256},
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+	if _, err := repo.LeasePendingPlans(ctx, agent.ID, 1, time.Minute); err != nil {
+		t.Fatalf("lease plans: %v", err)
+	}
+	created, failed := applied.Executions[0], applied.Executions[1]
+	if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{
+		PlanID:      applied.Plan.ID,
+		ExecutionID: applied.Plan.ID,
+		Results: []PlanActionResultItem{
+			{ActionID: created.OperationID, OK: true, FinishedAt: time.Now().UTC()},
+			{ActionID: failed.OperationID, OK: false, ErrorCode: "CREATE_FAILED", Message: "failed", FinishedAt: time.Now().UTC()},
+		},
+	}); err != nil {
+		t.Fatalf("report result: %v", err)
+	}
+
+	vmCount := len(repo.microVMs)
+	retried, err := repo.RetryPlan(ctx, tenantID, applied.Plan.ID, true)
+	if err != nil {
+		t.Fatalf("retry failed CREATE: %v", err)
+	}
+	if len(retried.Executions) != 1 || retried.Executions[0].VMID != failed.VMID {
+		t.Fatalf("expected the retry to target vm %s, got %+v", failed.VMID, retried.Executions)
+	}
+	if len(repo.microVMs) != vmCount {
+		t.Fatalf("retry must not create a new vm, have %d vms, want %d", len(repo.microVMs), vmCount)
+	}
+	if got := repo.microVMs[failed.VMID].Name; got != "web-2" {
+		t.Fatalf("expected the retried vm to keep its name web-2, got %q", got)
+	}
+
+	full, err := repo.RetryPlan(ctx, tenantID, applied.Plan.ID, false)
+	if err != nil {
+		t.Fatalf("full retry: %v", err)
+	}
+	if len(full.Executions) != 2 || full.Executions[0].VMID != created.VMID || full.Executions[1].VMID != failed.VMID {
+		t.Fatalf("expected the full retry to target the original vms, got %+v", full.Executions)
+	}
+	if len(repo.microVMs) != vmCount {
+		t.Fatalf("full retry must not create new vms, have %d vms, want %d", len(repo.microVMs), vmCount)
+	}
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MaxPlanMetadataBytes bounds the free-form metadata attached to a plan.
+const MaxPlanMetadataBytes = 8 << 10
+
+// MaxAgentMetadataBytes bounds the operator-set metadata of an agent.
+const MaxAgentMetadataBytes = 8 << 10
+
+// ValidatePlanMetadata checks that plan metadata is absent or a JSON object
+// no larger than MaxPlanMetadataBytes.
+func ValidatePlanMetadata(raw json.RawMessage) error {
+	return validateMetadataObject(raw, MaxPlanMetadataBytes)
+}
+
+// ValidateAgentMetadata checks that agent metadata is absent or a JSON
+// object no larger than MaxAgentMetadataBytes.
+func ValidateAgentMetadata(raw json.RawMessage) error {
+	return validateMetadataObject(raw, MaxAgentMetadataBytes)
+}
+
+func validateMetadataObject(raw json.RawMessage, maxBytes int) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	if len(raw) > maxBytes {
+		return fmt.Errorf("%w: exceeds %d bytes", ErrInvalidMetadata, maxBytes)
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return fmt.Errorf("%w: must be a JSON object", ErrInvalidMetadata)
+	}
+	return nil
+}
+
+// normalizePlanMetadata returns nil for absent or null metadata so it is
+// stored as NULL rather than the JSON literal.
+func normalizePlanMetadata(raw json.RawMessage) json.RawMessage {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	return raw
+}
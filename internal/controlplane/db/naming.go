@@ -0,0 +1,182 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxTemplateIndex bounds the search for a free {index} value.
+const maxTemplateIndex = 10000
+
+var (
+	namePlaceholderRE = regexp.MustCompile(`\{([a-z_]*)\}`)
+	nameSlugRE        = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// ValidateNameTemplate checks that a VM naming template only uses the
+// supported placeholders: {index}, {site}, {plan} and {id}.
+func ValidateNameTemplate(tmpl string) error {
+	if strings.TrimSpace(tmpl) == "" {
+		return fmt.Errorf("%w: template is empty", ErrInvalidNameTemplate)
+	}
+	for _, m := range namePlaceholderRE.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "index", "site", "plan", "id":
+		default:
+			return fmt.Errorf("%w: unknown placeholder %s", ErrInvalidNameTemplate, m[0])
+		}
+	}
+	if strings.ContainsAny(namePlaceholderRE.ReplaceAllString(tmpl, ""), "{}") {
+		return fmt.Errorf("%w: unbalanced braces", ErrInvalidNameTemplate)
+	}
+	return nil
+}
+
+// vmNamer renders names for CREATE actions that omit one. Templates with
+// {index} take the lowest index whose name is free in the site; any other
+// template must render a name that is not already taken.
+type vmNamer struct {
+	template    string
+	site        string
+	planVersion int64
+	taken       map[string]bool
+	next        int
+}
+
+func newVMNamer(tmpl, siteName string, planVersion int64, existing []string) *vmNamer {
+	taken := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		if name != "" {
+			taken[name] = true
+		}
+	}
+	return &vmNamer{
+		template:    tmpl,
+		site:        nameSlug(siteName),
+		planVersion: planVersion,
+		taken:       taken,
+		next:        1,
+	}
+}
+
+// prepareActions returns a copy of actions as ApplyPlan stores them: every
+// action gets an operation ID and every CREATE a VM ID, and CREATEs without
+// a name are named by namer, or vm-<id[:8]> when namer is nil. Plans record
+// these actions, so their operations show the IDs and names the executions
+// and VMs get.
+func prepareActions(actions []ApplyPlanAction, namer *vmNamer, newID func() string) ([]ApplyPlanAction, error) {
+	out := append([]ApplyPlanAction(nil), actions...)
+	if namer != nil {
+		for _, action := range out {
+			if name := strings.TrimSpace(action.Name); name != "" {
+				namer.taken[name] = true
+			}
+		}
+	}
+	for i := range out {
+		if out[i].OperationID == "" {
+			out[i].OperationID = newID()
+		}
+		if strings.ToUpper(strings.TrimSpace(out[i].Operation)) != "CREATE" {
+			continue
+		}
+		if out[i].VMID == "" {
+			out[i].VMID = newID()
+		}
+		if strings.TrimSpace(out[i].Name) != "" {
+			continue
+		}
+		if namer == nil {
+			out[i].Name = "vm-" + shortID(out[i].VMID)
+			continue
+		}
+		name, err := namer.name(out[i].VMID)
+		if err != nil {
+			return nil, err
+		}
+		out[i].Name = name
+	}
+	return out, nil
+}
+
+func (n *vmNamer) name(vmID string) (string, error) {
+	if !strings.Contains(n.template, "{index}") {
+		name := n.render(vmID, 0)
+		if n.taken[name] {
+			return "", fmt.Errorf("%w: vm name %q already exists in site", ErrConflict, name)
+		}
+		n.taken[name] = true
+		return name, nil
+	}
+	for i := n.next; i <= maxTemplateIndex; i++ {
+		name := n.render(vmID, i)
+		if n.taken[name] {
+			continue
+		}
+		n.taken[name] = true
+		n.next = i + 1
+		return name, nil
+	}
+	return "", fmt.Errorf("%w: no free index for template %q", ErrConflict, n.template)
+}
+
+func (n *vmNamer) render(vmID string, index int) string {
+	short := shortID(vmID)
+	return namePlaceholderRE.ReplaceAllStringFunc(n.template, func(ph string) string {
+		switch ph {
+		case "{index}":
+			return strconv.Itoa(index)
+		case "{site}":
+			return n.site
+		case "{plan}":
+			return strconv.FormatInt(n.planVersion, 10)
+		case "{id}":
+			return short
+		}
+		return ph
+	})
+}
+
+// shortID returns the first 8 characters of id.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func nameSlug(s string) string {
+	return strings.Trim(nameSlugRE.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// checkUniqueVMNames rejects a CREATE whose name is used by an existing VM
+// of the site or by another CREATE of the plan. existing maps the site's
+// VM IDs to their names; VMs the plan deletes give up their names, so a
+// VM can be recreated under the same name.
+func checkUniqueVMNames(actions []ApplyPlanAction, existing map[string]string) error {
+	deleted := make(map[string]bool)
+	for _, action := range actions {
+		if strings.ToUpper(strings.TrimSpace(action.Operation)) == "DELETE" && action.VMID != "" {
+			deleted[action.VMID] = true
+		}
+	}
+	taken := make(map[string]bool, len(existing))
+	for vmID, name := range existing {
+		if name != "" && !deleted[vmID] {
+			taken[name] = true
+		}
+	}
+	for _, action := range actions {
+		name := strings.TrimSpace(action.Name)
+		if strings.ToUpper(strings.TrimSpace(action.Operation)) != "CREATE" || name == "" {
+			continue
+		}
+		if taken[name] {
+			return fmt.Errorf("%w: vm name %q already exists in site", ErrConflict, name)
+		}
+		taken[name] = true
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateNameTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl    string
+		wantErr bool
+	}{
+		{"web-{index}-{site}", false},
+		{"db-{plan}-{id}", false},
+		{"static-name", false},
+		{"", true},
+		{"web-{host}", true},
+		{"web-{index", true},
+		{"web-index}", true},
+	}
+	for _, tt := range tests {
+		err := ValidateNameTemplate(tt.tmpl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateNameTemplate(%q) error = %v, wantErr %v", tt.tmpl, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidNameTemplate) {
+			t.Errorf("ValidateNameTemplate(%q) error = %v, want ErrInvalidNameTemplate", tt.tmpl, err)
+		}
+	}
+}
+
+func TestVMNamerExpandsPlaceholders(t *testing.T) {
+	namer := newVMNamer("web-{index}-{site}-p{plan}-{id}", "Edge Site #1", 7, nil)
+	got, err := namer.name("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("name: %v", err)
+	}
+	if want := "web-1-edge-site-1-p7-01234567"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestVMNamerSkipsTakenIndexes(t *testing.T) {
+	namer := newVMNamer("web-{index}", "site", 1, []string{"web-1", "web-3"})
+	var got []string
+	for i := 0; i < 3; i++ {
+		name, err := namer.name("id")
+		if err != nil {
+			t.Fatalf("name: %v", err)
+		}
+		got = append(got, name)
+	}
+	want := []string{"web-2", "web-4", "web-5"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestVMNamerRejectsDuplicateWithoutIndex(t *testing.T) {
+	namer := newVMNamer("web-{site}", "site-a", 1, []string{"web-site-a"})
+	if _, err := namer.name("id"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
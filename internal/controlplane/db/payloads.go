@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultMaxActionPayloadBytes bounds the encoded size of one plan action
+// when the control plane is not configured otherwise.
+const DefaultMaxActionPayloadBytes = 256 << 10
+
+// CheckActionPayloads returns ErrPayloadTooLarge for the first action whose
+// encoded size exceeds limit bytes, or DefaultMaxActionPayloadBytes when
+// limit is not positive. The encoded size is dominated by the cloud-init
+// files of a CREATE.
+func CheckActionPayloads(actions []ApplyPlanAction, limit int) error {
+	if limit <= 0 {
+		limit = DefaultMaxActionPayloadBytes
+	}
+	for _, action := range actions {
+		payload, err := json.Marshal(action)
+		if err != nil {
+			return fmt.Errorf("action %s: %w", action.OperationID, err)
+		}
+		if len(payload) > limit {
+			return fmt.Errorf("%w: action %s: payload is %d bytes, at most %d allowed", ErrPayloadTooLarge, action.OperationID, len(payload), limit)
+		}
+	}
+	return nil
+}
+
+// FileBlobThreshold is the size above which the content of a file in a
+// CREATE action, typically cloud-init user-data, is stored once by content
+// address instead of inside the action's payload. The payload keeps a
+// ContentRef and the content is put back when the plan is leased, so
+// identical user-data sent to many VMs is stored once.
+const FileBlobThreshold = 4 << 10
+
+// ContentRef returns the content address of content: "sha256:" followed
+// by the hex digest.
+func ContentRef(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// offloadFileContents moves the file contents of action larger than
+// FileBlobThreshold out of it. It returns the action to store, whose files
+// carry ContentRefs instead, and the contents by reference.
+func offloadFileContents(action ApplyPlanAction) (ApplyPlanAction, map[string]string) {
+	var contents map[string]string
+	for i, f := range action.Files {
+		if len(f.Content) <= FileBlobThreshold {
+			continue
+		}
+		if contents == nil {
+			contents = make(map[string]string)
+			action.Files = append([]FileSpec(nil), action.Files...)
+		}
+		ref := ContentRef(f.Content)
+		contents[ref] = f.Content
+		action.Files[i].Content = ""
+		action.Files[i].ContentRef = ref
+	}
+	return action, contents
+}
+
+// fileContentRefs returns the content addresses a stored payload refers to.
+func fileContentRefs(payload []byte) []string {
+	if !bytes.Contains(payload, []byte(`"content_ref"`)) {
+		return nil
+	}
+	var action ApplyPlanAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return nil
+	}
+	var refs []string
+	for _, f := range action.Files {
+		if f.ContentRef != "" {
+			refs = append(refs, f.ContentRef)
+		}
+	}
+	return refs
+}
+
+// resolveFileContents returns payload with the file contents it refers to
+// put back from contents, as the agent expects them.
+func resolveFileContents(payload []byte, contents map[string]string) ([]byte, error) {
+	if !bytes.Contains(payload, []byte(`"content_ref"`)) {
+		return payload, nil
+	}
+	var action ApplyPlanAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return nil, err
+	}
+	for i, f := range action.Files {
+		if f.ContentRef == "" {
+			continue
+		}
+		content, ok := contents[f.ContentRef]
+		if !ok {
+			return nil, fmt.Errorf("file %s: content %s not found", f.Path, f.ContentRef)
+		}
+		action.Files[i].Content = content
+		action.Files[i].ContentRef = ""
+	}
+	return json.Marshal(action)
+}
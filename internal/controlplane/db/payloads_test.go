@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLargeFileContentsAreContentAddressed(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	agent := newAgent(t, repo, tenantID, siteID, "agent-1")
+	userData := FileSpec{Path: "/var/lib/cloud/user-data", Content: strings.Repeat("x", FileBlobThreshold+1)}
+	motd := FileSpec{Path: "/etc/motd", Content: "hello"}
+
+	for _, key := range []string{"plan-a", "plan-b"} {
+		if _, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: "CREATE", Name: "vm", Files: []FileSpec{userData, motd}}},
+		}); err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+	}
+
+	// The user-data of both plans is stored once; small files stay inline.
+	if len(repo.fileContents) != 1 || repo.fileContents[ContentRef(userData.Content)] != userData.Content {
+		t.Fatalf("expected the user-data stored once by content address, got %d contents", len(repo.fileContents))
+	}
+	for _, actions := range repo.planActions {
+		var stored ApplyPlanAction
+		if err := json.Unmarshal(actions[0].PayloadJSON, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.Files[0].Content != "" || stored.Files[0].ContentRef != ContentRef(userData.Content) {
+			t.Fatalf("expected the stored payload to reference the user-data, got %+v", stored.Files[0].ContentRef)
+		}
+		if stored.Files[1] != motd {
+			t.Fatalf("expected the small file inline, got %+v", stored.Files[1])
+		}
+	}
+
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, 0)
+	if err != nil || len(leased) != 2 {
+		t.Fatalf("lease: %d plans (%v)", len(leased), err)
+	}
+	for _, plan := range leased {
+		var payload ApplyPlanAction
+		if err := json.Unmarshal(plan.Actions[0].PayloadJSON, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Files) != 2 || payload.Files[0] != userData || payload.Files[1] != motd {
+			t.Fatalf("expected the leased action to carry the full files, got %d files", len(payload.Files))
+		}
+	}
+}
+
+func TestPurgePlansPrunesUnreferencedContents(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	apply := func(key, content string) ApplyPlanResult {
+		res, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: "CREATE", Name: key, Files: []FileSpec{{Path: "/var/lib/cloud/user-data", Content: content}}}},
+		})
+		if err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		return res
+	}
+	shared := strings.Repeat("s", FileBlobThreshold+1)
+	own := strings.Repeat("o", FileBlobThreshold+1)
+	old := apply("old", own)
+	apply("old-shared", shared)
+	apply("pending", shared)
+	for _, key := range []string{"old", "old-shared"} {
+		planID := repo.planByIdempotency[tenantID+":"+key]
+		plan := repo.plans[planID]
+		plan.Status = "SUCCEEDED"
+		plan.CreatedAt = plan.CreatedAt.Add(-48 * time.Hour)
+		repo.plans[planID] = plan
+	}
+
+	purged, err := repo.PurgePlans(ctx, time.Now().UTC().Add(-24*time.Hour))
+	if err != nil || purged != 2 {
+		t.Fatalf("expected 2 plans purged, got %d (%v)", purged, err)
+	}
+	if _, ok := repo.plans[old.Plan.ID]; ok {
+		t.Fatal("expected the ended plan to be deleted")
+	}
+	if _, ok := repo.executions[old.Executions[0].ID]; ok {
+		t.Fatal("expected the executions of the ended plan to be deleted")
+	}
+	if _, ok := repo.fileContents[ContentRef(own)]; ok {
+		t.Fatal("expected a content only purged plans referred to to be deleted")
+	}
+	if _, ok := repo.fileContents[ContentRef(shared)]; !ok {
+		t.Fatal("expected a content a remaining plan refers to to be kept")
+	}
+}
+
+func TestApplyPlanBoundsActionPayloads(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	repo.SetMaxActionPayload(FileBlobThreshold)
+	_, err := repo.ApplyPlan(context.Background(), ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "big",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", Name: "vm", Files: []FileSpec{{Path: "/var/lib/cloud/user-data", Content: strings.Repeat("x", FileBlobThreshold)}}}},
+	})
+	if !errors.Is(err, ErrPayloadTooLarge) || len(repo.plans) != 0 {
+		t.Fatalf("expected the oversized action to be refused, got %v", err)
+	}
+}
+
+func TestLeaseFailsOnMissingFileContent(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	agent := newAgent(t, repo, tenantID, siteID, "agent-1")
+	content := strings.Repeat("x", FileBlobThreshold+1)
+	if _, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "missing",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", Name: "vm", Files: []FileSpec{{Path: "/var/lib/cloud/user-data", Content: content}}}},
+	}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	delete(repo.fileContents, ContentRef(content))
+	if _, err := repo.LeasePendingPlans(ctx, agent.ID, 10, time.Minute); err == nil {
+		t.Fatal("expected a lease whose file content is missing to fail")
+	}
+}
+
+func TestClientsCannotSetContentRef(t *testing.T) {
+	err := ValidateFileSpecs([]FileSpec{{Path: "/etc/motd", ContentRef: ContentRef("other tenant's data")}})
+	if err == nil {
+		t.Fatal("expected a client content_ref to be refused")
+	}
+}
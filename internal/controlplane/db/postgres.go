@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,7 +34,17 @@ const (
 )
 
 type PostgresRepo struct {
-	db *sql.DB
+	db         *sql.DB
+	cipher     *TenantCipher
+	leaseSteal LeaseStealPolicy
+	// idempotencyWindow is how long a plan's idempotency key deduplicates;
+	// zero keeps keys taken forever.
+	idempotencyWindow time.Duration
+	// vmDNSHostnames is the VMDNSHostname mode; empty registers no records.
+	vmDNSHostnames string
+	// maxActionPayload bounds the encoded size of an action; zero means
+	// DefaultMaxActionPayloadBytes.
+	maxActionPayload int
 }
 
 // NewPostgresRepo creates a new PostgresRepo with the given database connection.
@@ -41,6 +52,39 @@ func NewPostgresRepo(db *sql.DB) *PostgresRepo {
 	return &PostgresRepo{db: db}
 }
 
+// SetTenantCipher enables per-tenant encryption of plan and audit
+// metadata and of stored secrets. Values written before it was set stay readable; a nil cipher
+// writes plaintext.
+func (r *PostgresRepo) SetTenantCipher(c *TenantCipher) {
+	r.cipher = c
+}
+
+// SetLeaseStealPolicy sets when another agent may take over a plan whose
+// lease expired.
+func (r *PostgresRepo) SetLeaseStealPolicy(p LeaseStealPolicy) {
+	r.leaseSteal = p
+}
+
+// SetIdempotencyWindow sets how long a plan's idempotency key keeps
+// deduplicating; once it passed, the key applies a new plan. Zero never
+// frees keys.
+func (r *PostgresRepo) SetIdempotencyWindow(window time.Duration) {
+	r.idempotencyWindow = window
+}
+
+// SetMaxActionPayload bounds the encoded size of each action ApplyPlan
+// accepts; zero means DefaultMaxActionPayloadBytes.
+func (r *PostgresRepo) SetMaxActionPayload(limit int) {
+	r.maxActionPayload = limit
+}
+
+// SetVMDNSHostnames sets how VMs are named in the DNS records registered
+// when their CREATE succeeds; see VMDNSHostname. An empty mode registers
+// none.
+func (r *PostgresRepo) SetVMDNSHostnames(mode string) {
+	r.vmDNSHostnames = mode
+}
+
 // Close closes the database connection pool.
 func (r *PostgresRepo) Close() error {
 	if r.db != nil {
@@ -107,14 +151,22 @@ func queryTimeout(parent context.Context, timeout time.Duration) (context.Contex
 }
 
 func (r *PostgresRepo) CreateTenant(ctx context.Context, t Tenant) (Tenant, error) {
+	if t.QuotaTemplate != "" {
+		if _, err := r.GetQuotaTemplate(ctx, t.QuotaTemplate); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return Tenant{}, fmt.Errorf("%w: unknown quota template %q", ErrInvalidQuotaTemplate, t.QuotaTemplate)
+			}
+			return Tenant{}, err
+		}
+	}
 	row := r.db.QueryRowContext(ctx, `
-INSERT INTO tenants (id, slug, name, primary_region, data_retention_days)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING id, slug, name, primary_region, data_retention_days, created_at, updated_at`,
-		t.ID, t.Slug, t.Name, t.PrimaryRegion, t.RetentionDays,
+INSERT INTO tenants (id, slug, name, primary_region, data_retention_days, quota_template)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, slug, name, primary_region, data_retention_days, COALESCE(quota_template, ''), min_log_severity, created_at, updated_at`,
+		t.ID, t.Slug, t.Name, t.PrimaryRegion, t.RetentionDays, nullable(t.QuotaTemplate),
 	)
 	var out Tenant
-	if err := row.Scan(&out.ID, &out.Slug, &out.Name, &out.PrimaryRegion, &out.RetentionDays, &out.CreatedAt, &out.UpdatedAt); err != nil {
+	if err := row.Scan(&out.ID, &out.Slug, &out.Name, &out.PrimaryRegion, &out.RetentionDays, &out.QuotaTemplate, &out.MinLogSeverity, &out.CreatedAt, &out.UpdatedAt); err != nil {
 		if isUniqueViolation(err) {
 			return Tenant{}, ErrConflict
 		}
@@ -125,7 +177,7 @@ RETURNING id, slug, name, primary_region, data_retention_days, created_at, updat
 
 func (r *PostgresRepo) ListTenants(ctx context.Context) ([]Tenant, error) {
 	rows, err := r.db.QueryContext(ctx, `
-SELECT id, slug, name, primary_region, data_retention_days, created_at, updated_at
+SELECT id, slug, name, primary_region, data_retention_days, COALESCE(quota_template, ''), min_log_severity, created_at, updated_at
 FROM tenants
 ORDER BY created_at DESC`)
 	if err != nil {
@@ -136,7 +188,7 @@ ORDER BY created_at DESC`)
 	var tenants []Tenant
 	for rows.Next() {
 		var t Tenant
-		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.PrimaryRegion, &t.RetentionDays, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.PrimaryRegion, &t.RetentionDays, &t.QuotaTemplate, &t.MinLogSeverity, &t.CreatedAt, &t.UpdatedAt); err != nil {
 			return nil, err
 		}
 		tenants = append(tenants, t)
@@ -146,11 +198,29 @@ ORDER BY created_at DESC`)
 
 func (r *PostgresRepo) GetTenantByID(ctx context.Context, tenantID string) (Tenant, error) {
 	row := r.db.QueryRowContext(ctx, `
-SELECT id, slug, name, primary_region, data_retention_days, created_at, updated_at
+SELECT id, slug, name, primary_region, data_retention_days, COALESCE(quota_template, ''), min_log_severity, created_at, updated_at
 FROM tenants
 WHERE id = $1`, tenantID)
 	var out Tenant
-	if err := row.Scan(&out.ID, &out.Slug, &out.Name, &out.PrimaryRegion, &out.RetentionDays, &out.CreatedAt, &out.UpdatedAt); err != nil {
+	if err := row.Scan(&out.ID, &out.Slug, &out.Name, &out.PrimaryRegion, &out.RetentionDays, &out.QuotaTemplate, &out.MinLogSeverity, &out.CreatedAt, &out.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return Tenant{}, ErrNotFound
+		}
+		return Tenant{}, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) SetTenantLogSeverity(ctx context.Context, tenantID, severity string) (Tenant, error) {
+	if err := ValidateLogSeverity(severity); err != nil {
+		return Tenant{}, err
+	}
+	row := r.db.QueryRowContext(ctx, `
+UPDATE tenants SET min_log_severity = $2, updated_at = now()
+WHERE id = $1
+RETURNING id, slug, name, primary_region, data_retention_days, COALESCE(quota_template, ''), min_log_severity, created_at, updated_at`, tenantID, severity)
+	var out Tenant
+	if err := row.Scan(&out.ID, &out.Slug, &out.Name, &out.PrimaryRegion, &out.RetentionDays, &out.QuotaTemplate, &out.MinLogSeverity, &out.CreatedAt, &out.UpdatedAt); err != nil {
 		if err == sql.ErrNoRows {
 			return Tenant{}, ErrNotFound
 		}
@@ -160,11 +230,15 @@ WHERE id = $1`, tenantID)
 }
 
 func (r *PostgresRepo) CreateUser(ctx context.Context, user User) (User, error) {
+	passwordHash, err := r.cipher.sealString(user.TenantID, user.PasswordHash)
+	if err != nil {
+		return User{}, err
+	}
 	row := r.db.QueryRowContext(ctx, `
 INSERT INTO users (id, tenant_id, email, display_name, role, password_hash, is_active, email_verified)
 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 RETURNING id, tenant_id, email, display_name, role, is_active, email_verified, last_login_at, password_changed_at, created_at, updated_at`,
-		user.ID, user.TenantID, user.Email, user.DisplayName, user.Role, user.PasswordHash, user.IsActive, user.EmailVerified,
+		user.ID, user.TenantID, user.Email, user.DisplayName, user.Role, passwordHash, user.IsActive, user.EmailVerified,
 	)
 	var out User
 	if err := row.Scan(&out.ID, &out.TenantID, &out.Email, &out.DisplayName, &out.Role, &out.IsActive, &out.EmailVerified,
@@ -190,6 +264,9 @@ WHERE email = $1 AND is_active = TRUE`, email)
 		}
 		return User{}, err
 	}
+	if err := r.cipher.openUser(&out); err != nil {
+		return User{}, err
+	}
 	return out, nil
 }
 
@@ -206,6 +283,9 @@ WHERE email = $1 AND tenant_id = $2 AND is_active = TRUE`, email, tenantID)
 		}
 		return User{}, err
 	}
+	if err := r.cipher.openUser(&out); err != nil {
+		return User{}, err
+	}
 	return out, nil
 }
 
@@ -222,6 +302,9 @@ WHERE id = $1 AND tenant_id = $2`, userID, tenantID)
 		}
 		return User{}, err
 	}
+	if err := r.cipher.openUser(&out); err != nil {
+		return User{}, err
+	}
 	return out, nil
 }
 
@@ -233,7 +316,11 @@ WHERE id = $1 AND tenant_id = $2`, userID, tenantID)
 }
 
 func (r *PostgresRepo) UpdateUserPassword(ctx context.Context, tenantID, userID, passwordHash string) error {
-	_, err := r.db.ExecContext(ctx, `
+	passwordHash, err := r.cipher.sealString(tenantID, passwordHash)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
 UPDATE users SET password_hash = $1, password_changed_at = now(), updated_at = now()
 WHERE id = $2 AND tenant_id = $3`, passwordHash, userID, tenantID)
 	return err
@@ -315,10 +402,10 @@ RETURNING tenant_id`, keyHash).Scan(&tenantID)
 
 func (r *PostgresRepo) CreateSite(ctx context.Context, site Site) (Site, error) {
 	row := r.db.QueryRowContext(ctx, `
-INSERT INTO sites (id, tenant_id, name, external_key, location_country_code)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_country_code,''), connectivity_state, last_heartbeat_at, created_at`,
-		site.ID, site.TenantID, site.Name, nullable(site.ExternalKey), nullable(site.LocationCountry),
+INSERT INTO sites (id, tenant_id, name, external_key, location_country_code, unique_vm_names, vm_name_template)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_country_code,''), connectivity_state, last_heartbeat_at, unique_vm_names, COALESCE(vm_name_template,''), created_at`,
+		site.ID, site.TenantID, site.Name, nullable(site.ExternalKey), nullable(site.LocationCountry), site.UniqueVMNames, nullable(site.NameTemplate),
 	)
 	var out Site
 	if err := row.Scan(
@@ -329,6 +416,8 @@ RETURNING id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_coun
 		&out.LocationCountry,
 		&out.ConnectivityState,
 		&out.LastHeartbeatAt,
+		&out.UniqueVMNames,
+		&out.NameTemplate,
 		&out.CreatedAt,
 	); err != nil {
 		if isUniqueViolation(err) {
@@ -341,7 +430,7 @@ RETURNING id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_coun
 
 func (r *PostgresRepo) ListSites(ctx context.Context, tenantID string) ([]Site, error) {
 	rows, err := r.db.QueryContext(ctx, `
-SELECT id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_country_code,''), connectivity_state, last_heartbeat_at, created_at
+SELECT id, tenant_id, name, COALESCE(external_key,''), COALESCE(location_country_code,''), connectivity_state, last_heartbeat_at, unique_vm_names, COALESCE(vm_name_template,''), created_at
 FROM sites
 WHERE tenant_id = $1
 ORDER BY created_at DESC`, tenantID)
@@ -352,7 +441,7 @@ ORDER BY created_at DESC`, tenantID)
 	out := make([]Site, 0)
 	for rows.Next() {
 		var s Site
-		if err := rows.Scan(&s.ID, &s.TenantID, &s.Name, &s.ExternalKey, &s.LocationCountry, &s.ConnectivityState, &s.LastHeartbeatAt, &s.CreatedAt); err != nil {
+		if err := rows.Scan(&s.ID, &s.TenantID, &s.Name, &s.ExternalKey, &s.LocationCountry, &s.ConnectivityState, &s.LastHeartbeatAt, &s.UniqueVMNames, &s.NameTemplate, &s.CreatedAt); err != nil {
 			return nil, err
 		}
 		out = append(out, s)
@@ -362,17 +451,31 @@ ORDER BY created_at DESC`, tenantID)
 
 func (r *PostgresRepo) IssueEnrollmentToken(ctx context.Context, token EnrollmentToken) (EnrollmentToken, error) {
 	row := r.db.QueryRowContext(ctx, `
-INSERT INTO enrollment_tokens (id, tenant_id, site_id, token_hash, expires_at)
-VALUES ($1, $2, $3, $4, $5)
+INSERT INTO enrollment_tokens (id, tenant_id, site_id, token_hash, expires_at, scope)
+VALUES ($1, $2, $3, $4, $5, $6)
 RETURNING id, tenant_id, site_id, token_hash, expires_at`,
-		token.ID, token.TenantID, token.SiteID, token.TokenHash, token.ExpiresAt)
-	var out EnrollmentToken
+		token.ID, token.TenantID, token.SiteID, token.TokenHash, token.ExpiresAt, scopeJSON(token.Scope))
+	out := EnrollmentToken{Scope: token.Scope}
 	if err := row.Scan(&out.ID, &out.TenantID, &out.SiteID, &out.TokenHash, &out.ExpiresAt); err != nil {
 		return EnrollmentToken{}, err
 	}
 	return out, nil
 }
 
+func (r *PostgresRepo) EnrollmentTokenSite(ctx context.Context, tokenHash string, now time.Time) (string, error) {
+	var siteID string
+	err := r.db.QueryRowContext(ctx, `
+SELECT site_id::text
+FROM enrollment_tokens
+WHERE token_hash = $1
+  AND used_at IS NULL
+  AND expires_at > $2`, tokenHash, now).Scan(&siteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrTokenInvalid
+	}
+	return siteID, err
+}
+
 func (r *PostgresRepo) ConsumeEnrollmentToken(ctx context.Context, tokenHash string, now time.Time) (TokenConsumeResult, error) {
 	row := r.db.QueryRowContext(ctx, `
 UPDATE enrollment_tokens
@@ -380,14 +483,19 @@ SET used_at = $2
 WHERE token_hash = $1
   AND used_at IS NULL
   AND expires_at > $2
-RETURNING id, tenant_id, site_id`, tokenHash, now)
+RETURNING id, tenant_id, site_id, scope`, tokenHash, now)
 	var out TokenConsumeResult
-	if err := row.Scan(&out.TokenID, &out.TenantID, &out.SiteID); err != nil {
+	var scope []byte
+	if err := row.Scan(&out.TokenID, &out.TenantID, &out.SiteID, &scope); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return TokenConsumeResult{}, ErrTokenInvalid
 		}
 		return TokenConsumeResult{}, err
 	}
+	var err error
+	if out.Scope, err = parseScopeJSON(scope); err != nil {
+		return TokenConsumeResult{}, err
+	}
 	return out, nil
 }
 
@@ -410,24 +518,36 @@ RETURNING id`, agent.HostID, agent.TenantID, agent.SiteID, hostname).Scan(&hostI
 	}
 	agent.HostID = hostID
 
+	var bootstrap json.RawMessage
+	if agent.Bootstrap != nil {
+		if bootstrap, err = json.Marshal(agent.Bootstrap); err != nil {
+			return Agent{}, err
+		}
+	}
+	refreshTokenHash, err := r.cipher.sealString(agent.TenantID, agent.RefreshTokenHash)
+	if err != nil {
+		return Agent{}, err
+	}
 	err = tx.QueryRowContext(ctx, `
 INSERT INTO agents (
-  id, tenant_id, site_id, host_id, enrollment_token_hash, refresh_token_hash,
-  cert_serial, agent_version, os, arch, kernel_version, state, enrolled_at, last_heartbeat_at
+  id, tenant_id, site_id, host_id, enrollment_token_id, enrollment_token_hash, refresh_token_hash,
+  cert_serial, agent_version, os, arch, kernel_version, enrollment_bootstrap, scope, state, enrolled_at, last_heartbeat_at
 )
-VALUES ($1, $2, $3, $4, (SELECT token_hash FROM enrollment_tokens WHERE id=$5), $6, $7, $8, $9, $10, $11, 'ONLINE', now(), now())
+VALUES ($1, $2, $3, $4, $5, (SELECT token_hash FROM enrollment_tokens WHERE id=$5), $6, $7, $8, $9, $10, $11, $12, $13, 'ONLINE', now(), now())
 RETURNING id, tenant_id, site_id, host_id, cert_serial, refresh_token_hash, agent_version, os, arch, COALESCE(kernel_version, ''), state::text, last_heartbeat_at`,
 		agent.ID,
 		agent.TenantID,
 		agent.SiteID,
 		agent.HostID,
 		tokenID,
-		agent.RefreshTokenHash,
+		refreshTokenHash,
 		agent.CertSerial,
 		agent.AgentVersion,
 		agent.OS,
 		agent.Arch,
 		nullable(agent.KernelVersion),
+		nullableJSON(bootstrap),
+		scopeJSON(agent.Scope),
 	).Scan(
 		&agent.ID,
 		&agent.TenantID,
@@ -448,6 +568,9 @@ RETURNING id, tenant_id, site_id, host_id, cert_serial, refresh_token_hash, agen
 		}
 		return Agent{}, err
 	}
+	if err := r.cipher.openAgent(&agent); err != nil {
+		return Agent{}, err
+	}
 
 	if _, err := tx.ExecContext(ctx, `
 UPDATE sites SET connectivity_state='ONLINE', last_heartbeat_at=now(), updated_at=now()
@@ -463,19 +586,55 @@ WHERE id=$1 AND tenant_id=$2`, agent.SiteID, agent.TenantID); err != nil {
 
 func (r *PostgresRepo) GetAgentByID(ctx context.Context, agentID string) (Agent, error) {
 	row := r.db.QueryRowContext(ctx, `
-SELECT id, tenant_id, site_id, host_id, cert_serial, refresh_token_hash, agent_version, os, arch, COALESCE(kernel_version, ''), state::text, last_heartbeat_at
+SELECT id, tenant_id, site_id, host_id, cert_serial, refresh_token_hash, agent_version, os, arch, COALESCE(kernel_version, ''), state::text, last_heartbeat_at, agent_metadata, scope
 FROM agents
 WHERE id = $1`, agentID)
 	var a Agent
-	if err := row.Scan(&a.ID, &a.TenantID, &a.SiteID, &a.HostID, &a.CertSerial, &a.RefreshTokenHash, &a.AgentVersion, &a.OS, &a.Arch, &a.KernelVersion, &a.State, &a.LastHeartbeatAt); err != nil {
+	var metadata, scope []byte
+	if err := row.Scan(&a.ID, &a.TenantID, &a.SiteID, &a.HostID, &a.CertSerial, &a.RefreshTokenHash, &a.AgentVersion, &a.OS, &a.Arch, &a.KernelVersion, &a.State, &a.LastHeartbeatAt, &metadata, &scope); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Agent{}, ErrNotFound
 		}
 		return Agent{}, err
 	}
+	a.Metadata = metadata
+	var err error
+	if a.Scope, err = parseScopeJSON(scope); err != nil {
+		return Agent{}, err
+	}
+	if err := r.cipher.openAgent(&a); err != nil {
+		return Agent{}, err
+	}
 	return a, nil
 }
 
+func (r *PostgresRepo) GetAgentEnrollment(ctx context.Context, agentID string) (AgentEnrollment, error) {
+	row := r.db.QueryRowContext(ctx, `
+SELECT a.id, a.tenant_id, a.site_id, COALESCE(a.enrollment_token_id::text, ''), t.used_at, a.enrolled_at, a.enrollment_bootstrap
+FROM agents a
+LEFT JOIN enrollment_tokens t ON t.id = a.enrollment_token_id
+WHERE a.id = $1`, agentID)
+	var e AgentEnrollment
+	var usedAt sql.NullTime
+	var bootstrap []byte
+	if err := row.Scan(&e.AgentID, &e.TenantID, &e.SiteID, &e.TokenID, &usedAt, &e.EnrolledAt, &bootstrap); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AgentEnrollment{}, ErrNotFound
+		}
+		return AgentEnrollment{}, err
+	}
+	if usedAt.Valid {
+		e.TokenConsumedAt = &usedAt.Time
+	}
+	if len(bootstrap) > 0 {
+		e.Bootstrap = &EnrollmentBootstrap{}
+		if err := json.Unmarshal(bootstrap, e.Bootstrap); err != nil {
+			return AgentEnrollment{}, err
+		}
+	}
+	return e, nil
+}
+
 func (r *PostgresRepo) IngestHeartbeat(ctx context.Context, hb Heartbeat) error {
 	agent, err := r.GetAgentByID(ctx, hb.AgentID)
 	if err != nil {
@@ -488,6 +647,19 @@ func (r *PostgresRepo) IngestHeartbeat(ctx context.Context, hb Heartbeat) error
 	}
 	defer tx.Rollback()
 
+	// Lock the agent row so concurrent heartbeats are ordered, and drop one
+	// that arrives after a newer heartbeat was applied.
+	var lastSeq int64
+	if err := tx.QueryRowContext(ctx, `SELECT heartbeat_seq FROM agents WHERE id = $1 AND tenant_id = $2 FOR UPDATE`, agent.ID, agent.TenantID).Scan(&lastSeq); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if hb.HeartbeatSeq > 0 && hb.HeartbeatSeq <= lastSeq {
+		return ErrStaleHeartbeat
+	}
+
 	now := time.Now().UTC()
 	if _, err := tx.ExecContext(ctx, `
 UPDATE agents
@@ -498,10 +670,18 @@ SET heartbeat_seq = GREATEST(heartbeat_seq, $1),
     kernel_version = $5,
     state = 'ONLINE',
     last_heartbeat_at = $6,
-    updated_at = $6
-WHERE id = $7 AND tenant_id = $8`, hb.HeartbeatSeq, hb.AgentVersion, hb.OS, hb.Arch, nullable(hb.KernelVersion), now, agent.ID, agent.TenantID); err != nil {
+    updated_at = $6,
+    metrics_addr = $9
+WHERE id = $7 AND tenant_id = $8`, hb.HeartbeatSeq, hb.AgentVersion, hb.OS, hb.Arch, nullable(hb.KernelVersion), now, agent.ID, agent.TenantID, nullable(hb.MetricsAddr)); err != nil {
 		return err
 	}
+	if hb.ShutdownReason != "" {
+		if _, err := tx.ExecContext(ctx, `
+UPDATE agents SET last_shutdown_reason = $1, last_shutdown_at = $2
+WHERE id = $3 AND tenant_id = $4`, hb.ShutdownReason, now, agent.ID, agent.TenantID); err != nil {
+			return err
+		}
+	}
 
 	if _, err := tx.ExecContext(ctx, `
 UPDATE hosts
@@ -512,8 +692,9 @@ SET hostname = $1,
     kvm_available = $5,
     cloud_hypervisor_available = $6,
     last_facts_at = $7,
-    updated_at = $7
-WHERE id = $8 AND tenant_id = $9`, hb.Hostname, hb.CPUCoresTotal, hb.MemoryBytesTotal, hb.StorageBytesTotal, hb.KVMAvailable, hb.CloudHypervisorAvailable, now, agent.HostID, agent.TenantID); err != nil {
+    updated_at = $7,
+    facts_error = $10
+WHERE id = $8 AND tenant_id = $9`, hb.Hostname, hb.CPUCoresTotal, hb.MemoryBytesTotal, hb.StorageBytesTotal, hb.KVMAvailable, hb.CloudHypervisorAvailable, now, agent.HostID, agent.TenantID, nullable(hb.FactsError)); err != nil {
 		return err
 	}
 
@@ -526,6 +707,63 @@ WHERE id = $2 AND tenant_id = $3`, now, agent.SiteID, agent.TenantID); err != ni
 		return err
 	}
 
+	if nb := hb.NetBird; nb != nil {
+		// The agent row lock taken above orders this read with concurrent
+		// heartbeats of the agent.
+		var prev *AgentNetworkStatus
+		var last AgentNetworkStatus
+		err := tx.QueryRowContext(ctx, `SELECT connected, COALESCE(state,'') FROM agent_network_status WHERE agent_id = $1`, agent.ID).Scan(&last.Connected, &last.State)
+		switch {
+		case err == nil:
+			prev = &last
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+		if connectivityChanged(prev, *nb) {
+			if _, err := tx.ExecContext(ctx, `
+INSERT INTO agent_connectivity_history (agent_id, tenant_id, site_id, connected, state, reason, at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				agent.ID, agent.TenantID, agent.SiteID, nb.Connected, nullable(nb.State), nullable(nb.Reason), now); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO agent_network_status (
+  agent_id, tenant_id, site_id, connected, state, reason, peer_id, peer_ip, network_id, last_handshake_at, route_status, updated_at
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT (agent_id)
+DO UPDATE SET
+  site_id = EXCLUDED.site_id,
+  connected = EXCLUDED.connected,
+  state = EXCLUDED.state,
+  reason = EXCLUDED.reason,
+  peer_id = EXCLUDED.peer_id,
+  peer_ip = EXCLUDED.peer_ip,
+  network_id = EXCLUDED.network_id,
+  last_handshake_at = EXCLUDED.last_handshake_at,
+  route_status = EXCLUDED.route_status,
+  updated_at = EXCLUDED.updated_at`,
+			agent.ID, agent.TenantID, agent.SiteID, nb.Connected, nullable(nb.State), nullable(nb.Reason), nullable(nb.PeerID), nullable(nb.PeerIP), nullable(nb.NetworkID), nb.LastHandshakeAt, nullable(nb.RouteStatus), now); err != nil {
+			return err
+		}
+	}
+
+	if hb.Metrics != nil {
+		pushed, err := json.Marshal(hb.Metrics)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO agent_metrics (agent_id, tenant_id, site_id, metrics, reported_at)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (agent_id)
+DO UPDATE SET site_id = EXCLUDED.site_id, metrics = EXCLUDED.metrics, reported_at = EXCLUDED.reported_at`,
+			agent.ID, agent.TenantID, agent.SiteID, pushed, now); err != nil {
+			return err
+		}
+	}
+
 	for _, vm := range hb.MicroVMs {
 		vmID := vm.ID
 		if vmID == "" {
@@ -590,7 +828,120 @@ RETURNING plan_id`, state, nullable(upd.ErrorCode), nullable(upd.ErrorMessage),
 	return tx.Commit()
 }
 
+func (r *PostgresRepo) ListPrometheusTargets(ctx context.Context, tenantID, siteID string) ([]PrometheusTarget, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT a.id, a.host_id, COALESCE(h.hostname, ''), COALESCE(n.peer_ip, ''), a.metrics_addr
+FROM agents a
+LEFT JOIN hosts h ON h.id = a.host_id AND h.tenant_id = a.tenant_id
+LEFT JOIN agent_network_status n ON n.agent_id = a.id AND n.tenant_id = a.tenant_id
+WHERE a.tenant_id = $1
+  AND a.site_id = $2
+  AND a.state = 'ONLINE'
+  AND COALESCE(a.metrics_addr, '') <> ''
+ORDER BY a.id`, tenantID, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]PrometheusTarget, 0)
+	for rows.Next() {
+		var t PrometheusTarget
+		if err := rows.Scan(&t.AgentID, &t.HostID, &t.Hostname, &t.PeerIP, &t.MetricsAddr); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) ListAgentMetrics(ctx context.Context, tenantID, siteID string) ([]AgentMetrics, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT agent_id, tenant_id, site_id, metrics, reported_at
+FROM agent_metrics
+WHERE tenant_id = $1 AND site_id = $2
+ORDER BY agent_id`, tenantID, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]AgentMetrics, 0)
+	for rows.Next() {
+		var snapshot AgentMetrics
+		var pushed []byte
+		if err := rows.Scan(&snapshot.AgentID, &snapshot.TenantID, &snapshot.SiteID, &pushed, &snapshot.ReportedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(pushed, &snapshot.Metrics); err != nil {
+			return nil, err
+		}
+		out = append(out, snapshot)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) ListAgentConnectivityHistory(ctx context.Context, tenantID, agentID string, from, to time.Time, limit int) ([]ConnectivityTransition, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT agent_id, tenant_id, site_id, connected, COALESCE(state,''), COALESCE(reason,''), at
+FROM agent_connectivity_history
+WHERE tenant_id = $1 AND agent_id = $2 AND at >= $3 AND at < $4
+ORDER BY at, id
+LIMIT NULLIF($5, 0)`, tenantID, agentID, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]ConnectivityTransition, 0)
+	for rows.Next() {
+		var t ConnectivityTransition
+		if err := rows.Scan(&t.AgentID, &t.TenantID, &t.SiteID, &t.Connected, &t.State, &t.Reason, &t.At); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) GetAgentNetworkStatus(ctx context.Context, tenantID, agentID string) (AgentNetworkStatus, error) {
+	var out AgentNetworkStatus
+	var state, reason, peerID, peerIP, networkID, routeStatus sql.NullString
+	var lastHandshake sql.NullTime
+	err := r.db.QueryRowContext(ctx, `
+SELECT agent_id, tenant_id, site_id, connected, state, reason, peer_id, peer_ip, network_id, last_handshake_at, route_status, updated_at
+FROM agent_network_status
+WHERE agent_id = $1 AND tenant_id = $2`, agentID, tenantID).Scan(
+		&out.AgentID, &out.TenantID, &out.SiteID, &out.Connected, &state, &reason, &peerID, &peerIP, &networkID, &lastHandshake, &routeStatus, &out.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AgentNetworkStatus{}, ErrNotFound
+		}
+		return AgentNetworkStatus{}, err
+	}
+	out.State = state.String
+	out.Reason = reason.String
+	out.PeerID = peerID.String
+	out.PeerIP = peerIP.String
+	out.NetworkID = networkID.String
+	out.RouteStatus = routeStatus.String
+	if lastHandshake.Valid {
+		t := lastHandshake.Time
+		out.LastHandshakeAt = &t
+	}
+	return out, nil
+}
+
 func (r *PostgresRepo) ApplyPlan(ctx context.Context, input ApplyPlanInput) (ApplyPlanResult, error) {
+	if err := ValidatePlanMetadata(input.Metadata); err != nil {
+		return ApplyPlanResult{}, err
+	}
+	if err := CheckActionPayloads(input.Actions, r.maxActionPayload); err != nil {
+		return ApplyPlanResult{}, err
+	}
+	resolved, err := ResolveResources(input.Actions)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	input.Actions = resolved
+
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return ApplyPlanResult{}, err
@@ -605,6 +956,17 @@ func (r *PostgresRepo) ApplyPlan(ctx context.Context, input ApplyPlanInput) (App
 		return ApplyPlanResult{}, ErrUnauthorized
 	}
 
+	if r.idempotencyWindow > 0 {
+		// Release the key from a plan applied before the window so it
+		// can be reused; the old plan keeps it for reference.
+		if _, err := tx.ExecContext(ctx, `
+UPDATE plans SET idempotency_released_at = now()
+WHERE tenant_id = $1 AND idempotency_key = $2
+  AND idempotency_released_at IS NULL
+  AND created_at < $3`, input.TenantID, input.IdempotencyKey, time.Now().UTC().Add(-r.idempotencyWindow)); err != nil {
+			return ApplyPlanResult{}, err
+		}
+	}
 	if existing, ok, err := r.getPlanByIdempotencyTx(ctx, tx, input.TenantID, input.IdempotencyKey); err != nil {
 		return ApplyPlanResult{}, err
 	} else if ok {
@@ -615,7 +977,11 @@ func (r *PostgresRepo) ApplyPlan(ctx context.Context, input ApplyPlanInput) (App
 		return existing, nil
 	}
 
-	if _, err := tx.ExecContext(ctx, `SELECT id FROM sites WHERE id=$1 AND tenant_id=$2 FOR UPDATE`, input.SiteID, input.TenantID); err != nil {
+	// The site lock also serializes the naming and unique name checks below
+	// with concurrent plans of the site.
+	var uniqueNames bool
+	var siteName, siteTemplate string
+	if err := tx.QueryRowContext(ctx, `SELECT unique_vm_names, name, COALESCE(vm_name_template,'') FROM sites WHERE id=$1 AND tenant_id=$2 FOR UPDATE`, input.SiteID, input.TenantID).Scan(&uniqueNames, &siteName, &siteTemplate); err != nil {
 		return ApplyPlanResult{}, err
 	}
 
@@ -624,7 +990,30 @@ func (r *PostgresRepo) ApplyPlan(ctx context.Context, input ApplyPlanInput) (App
 		return ApplyPlanResult{}, err
 	}
 
-	operationsJSON, err := json.Marshal(input.Actions)
+	tmpl := input.NameTemplate
+	if tmpl == "" {
+		tmpl = siteTemplate
+	}
+	var namer *vmNamer
+	if tmpl != "" {
+		if err := ValidateNameTemplate(tmpl); err != nil {
+			return ApplyPlanResult{}, err
+		}
+		if namer, err = r.vmNamerTx(ctx, tx, input, tmpl, siteName, planVersion); err != nil {
+			return ApplyPlanResult{}, err
+		}
+	}
+	inputActions, err := prepareActions(input.Actions, namer, newUUID)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	if uniqueNames {
+		if err := r.checkUniqueVMNamesTx(ctx, tx, input, inputActions); err != nil {
+			return ApplyPlanResult{}, err
+		}
+	}
+
+	operationsJSON, err := json.Marshal(inputActions)
 	if err != nil {
 		return ApplyPlanResult{}, err
 	}
@@ -637,12 +1026,19 @@ func (r *PostgresRepo) ApplyPlan(ctx context.Context, input ApplyPlanInput) (App
 		PlanVersion:    planVersion,
 		Status:         "PENDING",
 		OperationsJSON: operationsJSON,
+		RetriedFrom:    input.RetriedFrom,
+		Metadata:       normalizePlanMetadata(input.Metadata),
+		Sequential:     input.Sequential,
 	}
 
+	storedMetadata, err := r.cipher.sealJSON(plan.TenantID, plan.Metadata)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
 	if err := tx.QueryRowContext(ctx, `
-INSERT INTO plans (id, tenant_id, site_id, idempotency_key, client_request_id, plan_version, status, operations_json)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
-RETURNING created_at`, plan.ID, plan.TenantID, plan.SiteID, plan.IdempotencyKey, nullable(input.ClientRequestID), plan.PlanVersion, plan.Status, plan.OperationsJSON).Scan(&plan.CreatedAt); err != nil {
+INSERT INTO plans (id, tenant_id, site_id, idempotency_key, client_request_id, plan_version, status, operations_json, retried_from, metadata, sequential)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+RETURNING created_at`, plan.ID, plan.TenantID, plan.SiteID, plan.IdempotencyKey, nullable(input.ClientRequestID), plan.PlanVersion, plan.Status, plan.OperationsJSON, nullable(plan.RetriedFrom), nullableJSON(storedMetadata), plan.Sequential).Scan(&plan.CreatedAt); err != nil {
 		if isUniqueViolation(err) {
 			if existing, ok, err2 := r.getPlanByIdempotencyTx(ctx, tx, input.TenantID, input.IdempotencyKey); err2 == nil && ok {
 				if err := tx.Commit(); err != nil {
@@ -656,43 +1052,78 @@ RETURNING created_at`, plan.ID, plan.TenantID, plan.SiteID, plan.IdempotencyKey,
 		return ApplyPlanResult{}, err
 	}
 
-	execs := make([]Execution, 0, len(input.Actions))
-	for _, action := range input.Actions {
+	execs := make([]Execution, 0, len(inputActions))
+	skipped := false
+	for i, action := range inputActions {
 		opType := normalizeOperation(action.Operation)
 		actionID := action.OperationID
-		if actionID == "" {
-			actionID = newUUID()
-		}
 		vmID := action.VMID
-		if opType == "CREATE" {
-			if vmID == "" {
-				vmID = newUUID()
+		if strings.TrimSpace(action.WhenState) != "" {
+			currentState, err := r.vmStateTx(ctx, tx, input.TenantID, input.SiteID, vmID)
+			if err != nil {
+				return ApplyPlanResult{}, err
 			}
-			name := action.Name
-			if strings.TrimSpace(name) == "" {
-				name = "vm-" + vmID[:8]
+			if reason := whenStateMismatch(action, currentState); reason != "" {
+				exec := Execution{
+					ID:            newUUID(),
+					TenantID:      input.TenantID,
+					SiteID:        input.SiteID,
+					PlanID:        plan.ID,
+					VMID:          vmID,
+					OperationID:   actionID,
+					OperationType: opType,
+					State:         "SKIPPED",
+					ErrorMessage:  reason,
+				}
+				if err := tx.QueryRowContext(ctx, `
+INSERT INTO executions (id, tenant_id, site_id, plan_id, vm_id, operation_id, operation_type, state, error_message, completed_at)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,now())
+RETURNING updated_at, completed_at`, exec.ID, exec.TenantID, exec.SiteID, exec.PlanID, nullable(exec.VMID), exec.OperationID, exec.OperationType, exec.State, exec.ErrorMessage).Scan(&exec.UpdatedAt, &exec.CompletedAt); err != nil {
+					return ApplyPlanResult{}, err
+				}
+				execs = append(execs, exec)
+				skipped = true
+				continue
 			}
+		}
+		if opType == "CREATE" {
 			if _, err := tx.ExecContext(ctx, `
-INSERT INTO microvms (id, tenant_id, site_id, host_id, name, state, vcpu_count, memory_mib, last_transition_at, updated_at)
-VALUES ($1,$2,$3,NULL,$4,'CREATING',$5,$6,now(),now())
+INSERT INTO microvms (id, tenant_id, site_id, host_id, name, state, vcpu_count, memory_mib,
+  vcpu_request, vcpu_limit, memory_request_mib, memory_limit_mib, last_transition_at, updated_at)
+VALUES ($1,$2,$3,NULL,$4,'CREATING',$5,$6,$7,$8,$9,$10,now(),now())
 ON CONFLICT (id)
 DO UPDATE SET
   name = EXCLUDED.name,
   vcpu_count = EXCLUDED.vcpu_count,
   memory_mib = EXCLUDED.memory_mib,
-  updated_at = now()`, vmID, input.TenantID, input.SiteID, name, max(action.VCPUCount, 1), max64(action.MemoryMiB, 128)); err != nil {
+  vcpu_request = EXCLUDED.vcpu_request,
+  vcpu_limit = EXCLUDED.vcpu_limit,
+  memory_request_mib = EXCLUDED.memory_request_mib,
+  memory_limit_mib = EXCLUDED.memory_limit_mib,
+  updated_at = now()`, vmID, input.TenantID, input.SiteID, action.Name, max(action.VCPUCount, 1), max64(action.MemoryMiB, 128),
+				nullableInt64(int64(action.VCPURequest)), nullableInt64(int64(action.VCPULimit)),
+				nullableInt64(action.MemoryRequestMiB), nullableInt64(action.MemoryLimitMiB)); err != nil {
 				return ApplyPlanResult{}, err
 			}
 		}
 
-		payloadJSON, err := json.Marshal(action)
+		stored, contents := offloadFileContents(action)
+		for ref, content := range contents {
+			if _, err := tx.ExecContext(ctx, `
+INSERT INTO plan_file_contents (hash, content, size_bytes)
+VALUES ($1,$2,$3)
+ON CONFLICT (hash) DO UPDATE SET created_at = now()`, ref, content, len(content)); err != nil {
+				return ApplyPlanResult{}, err
+			}
+		}
+		payloadJSON, err := json.Marshal(stored)
 		if err != nil {
 			return ApplyPlanResult{}, err
 		}
 
 		if _, err := tx.ExecContext(ctx, `
-INSERT INTO plan_actions (id, tenant_id, plan_id, operation_id, operation_type, vm_id, payload_json)
-VALUES ($1,$2,$3,$4,$5,$6,$7)`, newUUID(), input.TenantID, plan.ID, actionID, opType, nullable(vmID), payloadJSON); err != nil {
+INSERT INTO plan_actions (id, tenant_id, plan_id, operation_id, operation_type, vm_id, payload_json, action_index)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`, newUUID(), input.TenantID, plan.ID, actionID, opType, nullable(vmID), payloadJSON, i); err != nil {
 			return ApplyPlanResult{}, err
 		}
 
@@ -715,76 +1146,683 @@ RETURNING updated_at`, exec.ID, exec.TenantID, exec.SiteID, exec.PlanID, nullabl
 		execs = append(execs, exec)
 	}
 
+	if skipped {
+		if err := r.rollupPlanStatusTx(ctx, tx, plan.ID); err != nil {
+			return ApplyPlanResult{}, err
+		}
+		if err := tx.QueryRowContext(ctx, `SELECT status::text FROM plans WHERE id=$1`, plan.ID).Scan(&plan.Status); err != nil {
+			return ApplyPlanResult{}, err
+		}
+	}
+
 	if err := tx.Commit(); err != nil {
 		return ApplyPlanResult{}, err
 	}
 	return ApplyPlanResult{Plan: plan, Executions: execs}, nil
 }
 
-func (r *PostgresRepo) LeasePendingPlans(ctx context.Context, agentID string, limit int, leaseTTL time.Duration) ([]LeasedPlan, error) {
-	agent, err := r.GetAgentByID(ctx, agentID)
-	if err != nil {
-		return nil, err
-	}
-	if limit <= 0 {
-		limit = 1
-	}
-	if leaseTTL <= 0 {
-		leaseTTL = 30 * time.Second
+// vmStateTx returns the current state of a VM in the site, or "" if the VM
+// is unknown.
+func (r *PostgresRepo) vmStateTx(ctx context.Context, tx *sql.Tx, tenantID, siteID, vmID string) (string, error) {
+	if strings.TrimSpace(vmID) == "" {
+		return "", nil
 	}
-
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, err
+	var state string
+	err := tx.QueryRowContext(ctx, `
+SELECT state::text FROM microvms WHERE id = $1 AND tenant_id = $2 AND site_id = $3`, vmID, tenantID, siteID).Scan(&state)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
 	}
-	defer tx.Rollback()
+	return state, err
+}
 
-	now := time.Now().UTC()
-	leaseUntil := now.Add(leaseTTL)
-	rows, err := tx.QueryContext(ctx, `
-WITH candidate AS (
-  SELECT id
-  FROM plans
-  WHERE tenant_id = $2
-    AND site_id = $3
-    AND status IN ('PENDING','IN_PROGRESS')
-    AND (leased_by_agent_id = $1 OR lease_expires_at IS NULL OR lease_expires_at <= $4)
-  ORDER BY created_at ASC
-  LIMIT $5
-  FOR UPDATE SKIP LOCKED
-)
-UPDATE plans p
-SET leased_by_agent_id = $1,
-    lease_expires_at = $6,
-    status = CASE WHEN p.status = 'PENDING' THEN 'IN_PROGRESS' ELSE p.status END,
-    started_at = CASE WHEN p.started_at IS NULL THEN $4 ELSE p.started_at END,
-    updated_at = $4
-FROM candidate c
-WHERE p.id = c.id
-RETURNING p.id`,
-		agent.ID, agent.TenantID, agent.SiteID, now, limit, leaseUntil)
+// vmNamerTx returns a namer expanding tmpl against the VM names already
+// used in the site.
+func (r *PostgresRepo) vmNamerTx(ctx context.Context, tx *sql.Tx, input ApplyPlanInput, tmpl, siteName string, planVersion int64) (*vmNamer, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT name FROM microvms WHERE site_id=$1 AND tenant_id=$2`, input.SiteID, input.TenantID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-
-	planIDs := make([]string, 0)
+	existing := make([]string, 0)
 	for rows.Next() {
-		var planID string
-		if err := rows.Scan(&planID); err != nil {
+		var name string
+		if err := rows.Scan(&name); err != nil {
 			return nil, err
 		}
-		planIDs = append(planIDs, planID)
+		existing = append(existing, name)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	return newVMNamer(tmpl, siteName, planVersion, existing), nil
+}
 
-	out := make([]LeasedPlan, 0, len(planIDs))
-	for _, planID := range planIDs {
-		actionRows, err := tx.QueryContext(ctx, `
-SELECT pa.id, pa.plan_id, pa.operation_id, pa.operation_type, COALESCE(pa.vm_id::text,''), pa.payload_json
-FROM plan_actions pa
+func (r *PostgresRepo) checkUniqueVMNamesTx(ctx context.Context, tx *sql.Tx, input ApplyPlanInput, actions []ApplyPlanAction) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, name FROM microvms WHERE site_id=$1 AND tenant_id=$2`, input.SiteID, input.TenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		existing[id] = name
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return checkUniqueVMNames(actions, existing)
+}
+
+func (r *PostgresRepo) GetPlanStats(ctx context.Context, tenantID, siteID string, from, to time.Time) (PlanStats, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT status, COUNT(*)
+FROM plans
+WHERE tenant_id = $1 AND site_id = $2 AND created_at >= $3 AND created_at < $4
+GROUP BY status`, tenantID, siteID, from, to)
+	if err != nil {
+		return PlanStats{}, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return PlanStats{}, err
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return PlanStats{}, err
+	}
+	return NewPlanStats(counts), nil
+}
+
+func (r *PostgresRepo) GetPlan(ctx context.Context, tenantID, planID string) (Plan, error) {
+	var plan Plan
+	var countsJSON, metadata []byte
+	err := r.db.QueryRowContext(ctx, `
+SELECT p.id, p.tenant_id, p.site_id, p.idempotency_key, p.plan_version, p.status, p.operations_json, p.created_at,
+  COALESCE(p.retried_from::text, ''), COALESCE(p.host_id::text, ''), p.metadata, p.sequential,
+  COALESCE((
+    SELECT jsonb_object_agg(c.state, c.n)
+    FROM (SELECT state, COUNT(*) AS n FROM executions WHERE plan_id = p.id GROUP BY state) c
+  ), '{}'::jsonb)
+FROM plans p
+WHERE p.id = $1 AND p.tenant_id = $2`, planID, tenantID).Scan(
+		&plan.ID, &plan.TenantID, &plan.SiteID, &plan.IdempotencyKey, &plan.PlanVersion, &plan.Status, &plan.OperationsJSON, &plan.CreatedAt, &plan.RetriedFrom, &plan.HostID, &metadata, &plan.Sequential, &countsJSON)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Plan{}, ErrNotFound
+		}
+		return Plan{}, err
+	}
+	counts := map[string]int{}
+	if err := json.Unmarshal(countsJSON, &counts); err != nil {
+		return Plan{}, err
+	}
+	progress := NewPlanProgress(counts)
+	plan.Progress = &progress
+	if plan.Metadata, err = r.cipher.openJSON(plan.TenantID, metadata); err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+func (r *PostgresRepo) RetryPlan(ctx context.Context, tenantID, planID string, failedOnly bool) (ApplyPlanResult, error) {
+	plan, err := r.GetPlan(ctx, tenantID, planID)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	rows, err := r.db.QueryContext(ctx, `
+SELECT operation_id, operation_type, COALESCE(vm_id::text,''), state::text
+FROM executions
+WHERE plan_id = $1 AND tenant_id = $2
+ORDER BY created_at ASC`, planID, tenantID)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	defer rows.Close()
+	execs := make([]Execution, 0)
+	for rows.Next() {
+		e := Execution{PlanID: planID}
+		if err := rows.Scan(&e.OperationID, &e.OperationType, &e.VMID, &e.State); err != nil {
+			return ApplyPlanResult{}, err
+		}
+		execs = append(execs, e)
+	}
+	if err := rows.Err(); err != nil {
+		return ApplyPlanResult{}, err
+	}
+	rows.Close()
+
+	actions, err := planActionsForRetry(ctx, r.db, tenantID, planID)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	input, err := retryPlanInput(plan, actions, execs, failedOnly)
+	if err != nil {
+		return ApplyPlanResult{}, err
+	}
+	return r.ApplyPlan(ctx, input)
+}
+
+func (r *PostgresRepo) MigrateVM(ctx context.Context, tenantID, siteID, vmID, targetHostID string) (VMMigration, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return VMMigration{}, err
+	}
+	defer tx.Rollback()
+
+	var siteExists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sites WHERE id=$1 AND tenant_id=$2)`, siteID, tenantID).Scan(&siteExists); err != nil {
+		return VMMigration{}, err
+	}
+	if !siteExists {
+		return VMMigration{}, ErrUnauthorized
+	}
+
+	var vm MicroVM
+	err = tx.QueryRowContext(ctx, `
+SELECT id, COALESCE(host_id::text,''), state::text, vcpu_count, memory_mib, COALESCE(vcpu_request, 0), COALESCE(memory_request_mib, 0)
+FROM microvms
+WHERE id = $1 AND tenant_id = $2 AND site_id = $3
+FOR UPDATE`, vmID, tenantID, siteID).Scan(&vm.ID, &vm.HostID, &vm.State, &vm.VCPUCount, &vm.MemoryMiB, &vm.VCPURequest, &vm.MemoryRequestMiB)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VMMigration{}, ErrNotFound
+		}
+		return VMMigration{}, err
+	}
+
+	var target Host
+	err = tx.QueryRowContext(ctx, `
+SELECT id, hostname, cpu_cores_total, memory_bytes_total, maintenance
+FROM hosts
+WHERE id = $1 AND tenant_id = $2 AND site_id = $3
+FOR UPDATE`, targetHostID, tenantID, siteID).Scan(&target.ID, &target.Hostname, &target.CPUCoresTotal, &target.MemoryBytesTotal, &target.Maintenance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VMMigration{}, fmt.Errorf("%w: target host %s", ErrNotFound, targetHostID)
+		}
+		return VMMigration{}, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT id, state::text, vcpu_count, memory_mib, COALESCE(vcpu_request, 0), COALESCE(memory_request_mib, 0)
+FROM microvms
+WHERE tenant_id = $1 AND host_id = $2`, tenantID, targetHostID)
+	if err != nil {
+		return VMMigration{}, err
+	}
+	placed := make([]MicroVM, 0)
+	for rows.Next() {
+		var p MicroVM
+		if err := rows.Scan(&p.ID, &p.State, &p.VCPUCount, &p.MemoryMiB, &p.VCPURequest, &p.MemoryRequestMiB); err != nil {
+			rows.Close()
+			return VMMigration{}, err
+		}
+		placed = append(placed, p)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return VMMigration{}, err
+	}
+	rows.Close()
+	if err := validateVMMigration(vm, target, placed); err != nil {
+		return VMMigration{}, err
+	}
+
+	mig := VMMigration{
+		ID:           newUUID(),
+		TenantID:     tenantID,
+		SiteID:       siteID,
+		VMID:         vmID,
+		SourceHostID: vm.HostID,
+		TargetHostID: targetHostID,
+		State:        MigrationStateMigrating,
+		Step:         MigrationStepSnapshot,
+	}
+	if err := tx.QueryRowContext(ctx, `
+INSERT INTO vm_migrations (id, tenant_id, site_id, vm_id, source_host_id, target_host_id, state, step)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8)
+RETURNING created_at, updated_at`, mig.ID, mig.TenantID, mig.SiteID, mig.VMID, mig.SourceHostID, mig.TargetHostID, mig.State, mig.Step).Scan(&mig.CreatedAt, &mig.UpdatedAt); err != nil {
+		if isUniqueViolation(err) {
+			return VMMigration{}, ErrConflict
+		}
+		return VMMigration{}, err
+	}
+	if mig.PlanID, err = r.scheduleMigrationStepTx(ctx, tx, mig, target.Hostname); err != nil {
+		return VMMigration{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return VMMigration{}, err
+	}
+	return mig, nil
+}
+
+func (r *PostgresRepo) GetVMMigration(ctx context.Context, tenantID, migrationID string) (VMMigration, error) {
+	var mig VMMigration
+	err := r.db.QueryRowContext(ctx, `
+SELECT id, tenant_id, site_id, vm_id, source_host_id, target_host_id, state, COALESCE(step, ''),
+       COALESCE(plan_id::text, ''), COALESCE(error, ''), created_at, updated_at
+FROM vm_migrations
+WHERE id = $1 AND tenant_id = $2`, migrationID, tenantID).Scan(
+		&mig.ID, &mig.TenantID, &mig.SiteID, &mig.VMID, &mig.SourceHostID, &mig.TargetHostID, &mig.State, &mig.Step,
+		&mig.PlanID, &mig.Error, &mig.CreatedAt, &mig.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VMMigration{}, ErrNotFound
+		}
+		return VMMigration{}, err
+	}
+	return mig, nil
+}
+
+// scheduleMigrationStepTx inserts a plan, pinned to the host that runs it,
+// for the current step of mig and links the migration to it.
+func (r *PostgresRepo) scheduleMigrationStepTx(ctx context.Context, tx *sql.Tx, mig VMMigration, targetHostname string) (string, error) {
+	action := mig.stepAction(targetHostname)
+	operationsJSON, err := json.Marshal([]ApplyPlanAction{action})
+	if err != nil {
+		return "", err
+	}
+	payloadJSON, err := json.Marshal(action)
+	if err != nil {
+		return "", err
+	}
+
+	planID := newUUID()
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO plans (id, tenant_id, site_id, idempotency_key, plan_version, status, operations_json, host_id)
+VALUES ($1,$2,$3,$4,(SELECT COALESCE(MAX(plan_version), 0) + 1 FROM plans WHERE site_id=$3),'PENDING',$5,$6)`,
+		planID, mig.TenantID, mig.SiteID, mig.stepIdempotencyKey(), operationsJSON, mig.stepHostID()); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO plan_actions (id, tenant_id, plan_id, operation_id, operation_type, vm_id, payload_json)
+VALUES ($1,$2,$3,$4,$5,$6,$7)`, newUUID(), mig.TenantID, planID, action.OperationID, action.Operation, mig.VMID, payloadJSON); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO executions (id, tenant_id, site_id, plan_id, vm_id, operation_id, operation_type, state)
+VALUES ($1,$2,$3,$4,$5,$6,$7,'PENDING')`, newUUID(), mig.TenantID, mig.SiteID, planID, mig.VMID, action.OperationID, action.Operation); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE vm_migrations SET plan_id = $2, updated_at = now() WHERE id = $1`, mig.ID, planID); err != nil {
+		return "", err
+	}
+	return planID, nil
+}
+
+// advanceVMMigrationTx moves on the migration whose current step ran as
+// planID once that plan has finished, and schedules its next step.
+func (r *PostgresRepo) advanceVMMigrationTx(ctx context.Context, tx *sql.Tx, planID string) error {
+	var (
+		mig            VMMigration
+		planStatus     string
+		targetHostname string
+	)
+	err := tx.QueryRowContext(ctx, `
+SELECT m.id, m.tenant_id, m.site_id, m.vm_id, m.source_host_id, m.target_host_id, m.state, COALESCE(m.step, ''),
+       COALESCE(m.error, ''), p.status::text, h.hostname
+FROM vm_migrations m
+JOIN plans p ON p.id = m.plan_id
+JOIN hosts h ON h.id = m.target_host_id
+WHERE m.plan_id = $1 AND m.state IN ('MIGRATING', 'ROLLING_BACK')
+FOR UPDATE OF m`, planID).Scan(&mig.ID, &mig.TenantID, &mig.SiteID, &mig.VMID, &mig.SourceHostID, &mig.TargetHostID, &mig.State, &mig.Step,
+		&mig.Error, &planStatus, &targetHostname)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if planStatus != "SUCCEEDED" && planStatus != "FAILED" {
+		return nil
+	}
+
+	var message string
+	if err := tx.QueryRowContext(ctx, `
+SELECT COALESCE(MAX(error_message), '') FROM executions WHERE plan_id = $1 AND state = 'FAILED'`, planID).Scan(&message); err != nil {
+		return err
+	}
+	ok := planStatus == "SUCCEEDED"
+	if ok && mig.Step == MigrationStepRestore {
+		if _, err := tx.ExecContext(ctx, `UPDATE microvms SET host_id = $3, updated_at = now() WHERE id = $1 AND tenant_id = $2`, mig.VMID, mig.TenantID, mig.TargetHostID); err != nil {
+			return err
+		}
+	}
+	mig = advanceVMMigration(mig, ok, message)
+	if _, err := tx.ExecContext(ctx, `
+UPDATE vm_migrations SET state = $2, step = $3, plan_id = NULL, error = $4, updated_at = now() WHERE id = $1`,
+		mig.ID, mig.State, nullable(mig.Step), nullable(mig.Error)); err != nil {
+		return err
+	}
+	if !mig.Active() {
+		return nil
+	}
+	_, err = r.scheduleMigrationStepTx(ctx, tx, mig, targetHostname)
+	return err
+}
+
+func (r *PostgresRepo) ReleaseIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+UPDATE plans SET idempotency_released_at = now()
+WHERE idempotency_released_at IS NULL
+  AND created_at < $1`, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *PostgresRepo) PurgePlans(ctx context.Context, createdBefore time.Time) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Actions, executions, logs and result tokens go with their plan.
+	res, err := tx.ExecContext(ctx, `
+DELETE FROM plans
+WHERE status NOT IN ('PENDING', 'IN_PROGRESS') AND created_at < $1`, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	purged, _ := res.RowsAffected()
+
+	// ApplyPlan bumps created_at of the contents it stores or reuses, under
+	// a row lock, so a content a plan still being applied refers to is
+	// newer than createdBefore and kept.
+	if _, err := tx.ExecContext(ctx, `
+DELETE FROM plan_file_contents c
+WHERE c.created_at < $1
+  AND NOT EXISTS (
+    SELECT 1 FROM plan_actions a
+    WHERE a.payload_json->'files' @> jsonb_build_array(jsonb_build_object('content_ref', c.hash)))`, createdBefore); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (r *PostgresRepo) ExpirePendingPlans(ctx context.Context, createdBefore time.Time) ([]Plan, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+UPDATE plans
+SET status = 'EXPIRED',
+    leased_by_agent_id = NULL,
+    lease_expires_at = NULL,
+    completed_at = now(),
+    updated_at = now()
+WHERE status = 'PENDING'
+  AND created_at < $1
+RETURNING id, tenant_id, site_id, idempotency_key, plan_version, status::text, created_at`, createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Plan, 0)
+	planIDs := make([]string, 0)
+	for rows.Next() {
+		var p Plan
+		if err := rows.Scan(&p.ID, &p.TenantID, &p.SiteID, &p.IdempotencyKey, &p.PlanVersion, &p.Status, &p.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, p)
+		planIDs = append(planIDs, p.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(planIDs) == 0 {
+		return out, nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+UPDATE executions
+SET state = 'EXPIRED',
+    error_message = $2,
+    completed_at = now(),
+    updated_at = now()
+WHERE plan_id = ANY($1::uuid[])
+  AND state = 'PENDING'`, pq.Array(planIDs), planExpiredMessage); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) LeasePendingPlans(ctx context.Context, agentID string, limit int, leaseTTL time.Duration) ([]LeasedPlan, error) {
+	agent, err := r.GetAgentByID(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	if leaseTTL <= 0 {
+		leaseTTL = 30 * time.Second
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	leaseUntil := now.Add(leaseTTL)
+	rows, err := tx.QueryContext(ctx, `
+WITH eligible AS (
+  SELECT id, created_at, COALESCE(leased_by_agent_id = $1, false) AS held, (
+    SELECT COUNT(*) FROM executions e
+    WHERE e.plan_id = plans.id AND e.state::text IN ('PENDING','IN_PROGRESS') AND e.operation_type::text = 'CREATE'
+  ) AS creates
+  FROM plans
+  WHERE tenant_id = $2
+    AND site_id = $3
+    AND status IN ('PENDING','IN_PROGRESS')
+    AND (leased_by_agent_id = $1 OR lease_expires_at IS NULL OR lease_expires_at + make_interval(secs => COALESCE((
+      SELECT MAX(($8::jsonb ->> e.operation_type::text)::double precision)
+      FROM executions e
+      WHERE e.plan_id = plans.id AND e.state::text IN ('PENDING','IN_PROGRESS')
+    ), 0)) <= $4)
+    AND (host_id IS NULL OR host_id = $7)
+    AND (host_id IS NOT NULL OR NOT EXISTS (
+      SELECT 1 FROM agents a JOIN hosts h ON h.id = a.host_id
+      WHERE a.id = $1 AND h.maintenance
+    ))
+    -- A scoped agent leaves plans outside its scope to other agents.
+    AND ($9::jsonb IS NULL OR NOT EXISTS (
+      SELECT 1 FROM executions e
+      WHERE e.plan_id = plans.id AND e.state::text IN ('PENDING','IN_PROGRESS')
+        AND NOT jsonb_exists($9::jsonb, e.operation_type::text)
+    ))
+  ORDER BY created_at ASC
+  LIMIT CASE WHEN $10::int = 0 THEN $5 END
+  FOR UPDATE SKIP LOCKED
+),
+-- Under max_vms the CREATEs of plans the agent already holds count
+-- against its host, and the CREATEs of the plans leased here are added in
+-- lease order so one call cannot overshoot the cap. A plan that does not
+-- fit holds back the CREATEs queued behind it.
+host_vms AS (
+  SELECT COUNT(*) AS n FROM (
+    SELECT m.id FROM microvms m WHERE $10::int > 0 AND m.host_id = $7
+    UNION
+    SELECT e.vm_id FROM executions e JOIN plans p ON p.id = e.plan_id
+    WHERE $10::int > 0 AND p.leased_by_agent_id = $1 AND e.vm_id IS NOT NULL
+      AND e.state::text IN ('PENDING','IN_PROGRESS') AND e.operation_type::text = 'CREATE'
+  ) vms
+),
+ranked AS (
+  SELECT id, created_at, held, creates,
+    SUM(CASE WHEN held THEN 0 ELSE creates END) OVER (ORDER BY created_at, id ROWS UNBOUNDED PRECEDING) AS leased_creates
+  FROM eligible
+),
+candidate AS (
+  SELECT r.id
+  FROM ranked r, host_vms h
+  WHERE $10::int = 0 OR r.held OR r.creates = 0 OR h.n + r.leased_creates <= $10
+  ORDER BY r.created_at ASC
+  LIMIT $5
+)
+UPDATE plans p
+SET leased_by_agent_id = $1,
+    lease_expires_at = $6,
+    status = CASE WHEN p.status = 'PENDING' THEN 'IN_PROGRESS' ELSE p.status END,
+    started_at = CASE WHEN p.started_at IS NULL THEN $4 ELSE p.started_at END,
+    updated_at = $4
+FROM candidate c
+WHERE p.id = c.id
+RETURNING p.id, p.sequential`,
+		agent.ID, agent.TenantID, agent.SiteID, now, limit, leaseUntil, nullable(agent.HostID), r.leaseSteal.graceSecondsJSON(leaseTTL),
+		scopeOperationsJSON(agent.Scope), scopeMaxVMs(agent.Scope))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	planIDs := make([]string, 0)
+	sequential := make(map[string]bool)
+	for rows.Next() {
+		var planID string
+		var seq bool
+		if err := rows.Scan(&planID, &seq); err != nil {
+			return nil, err
+		}
+		planIDs = append(planIDs, planID)
+		sequential[planID] = seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]LeasedPlan, 0, len(planIDs))
+	for _, planID := range planIDs {
+		actions, err := leasedPlanActions(ctx, tx, agent.TenantID, planID)
+		if err != nil {
+			return nil, err
+		}
+		if len(actions) == 0 {
+			continue
+		}
+		out = append(out, LeasedPlan{
+			PlanID:         planID,
+			ExecutionID:    planID,
+			Actions:        actions,
+			Sequential:     sequential[planID],
+			LeaseExpiresAt: leaseUntil,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) ListPlanExecutions(ctx context.Context, tenantID, planID string) ([]Execution, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT id, tenant_id, site_id, COALESCE(host_id::text,''), COALESCE(agent_id::text,''), plan_id,
+       COALESCE(vm_id::text,''), operation_id, operation_type, state::text,
+       COALESCE(error_code,''), COALESCE(error_message,''), updated_at, started_at, completed_at
+FROM executions
+WHERE plan_id = $1 AND tenant_id = $2
+ORDER BY created_at ASC`, planID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]Execution, 0)
+	for rows.Next() {
+		var e Execution
+		if err := rows.Scan(&e.ID, &e.TenantID, &e.SiteID, &e.HostID, &e.AgentID, &e.PlanID, &e.VMID, &e.OperationID, &e.OperationType, &e.State, &e.ErrorCode, &e.ErrorMessage, &e.UpdatedAt, &e.StartedAt, &e.CompletedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) ListLeasedPlans(ctx context.Context, tenantID, agentID string) ([]LeasedPlan, error) {
+	var exists bool
+	if err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM agents WHERE id = $1 AND tenant_id = $2)`, agentID, tenantID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	rows, err := r.db.QueryContext(ctx, `
+SELECT id, sequential, lease_expires_at
+FROM plans
+WHERE tenant_id = $1
+  AND leased_by_agent_id = $2
+  AND lease_expires_at > $3
+  AND status IN ('PENDING','IN_PROGRESS')
+ORDER BY created_at ASC`, tenantID, agentID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]LeasedPlan, 0)
+	for rows.Next() {
+		var plan LeasedPlan
+		if err := rows.Scan(&plan.PlanID, &plan.Sequential, &plan.LeaseExpiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		plan.ExecutionID = plan.PlanID
+		plans = append(plans, plan)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	out := make([]LeasedPlan, 0, len(plans))
+	for _, plan := range plans {
+		actions, err := leasedPlanActions(ctx, r.db, tenantID, plan.PlanID)
+		if err != nil {
+			return nil, err
+		}
+		if len(actions) == 0 {
+			continue
+		}
+		plan.Actions = actions
+		out = append(out, plan)
+	}
+	return out, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// leasedPlanActions loads the plan's actions whose executions are still
+// PENDING or IN_PROGRESS, in plan order, with stored file contents put
+// back into their payloads.
+func leasedPlanActions(ctx context.Context, q queryer, tenantID, planID string) ([]PlanAction, error) {
+	rows, err := q.QueryContext(ctx, `
+SELECT pa.id, pa.plan_id, pa.operation_id, pa.operation_type, COALESCE(pa.vm_id::text,''), pa.payload_json
+FROM plan_actions pa
 JOIN executions e
   ON e.tenant_id = pa.tenant_id
  AND e.plan_id = pa.plan_id
@@ -792,38 +1830,100 @@ JOIN executions e
 WHERE pa.tenant_id = $1
   AND pa.plan_id = $2
   AND e.state IN ('PENDING','IN_PROGRESS')
-ORDER BY pa.created_at ASC`, agent.TenantID, planID)
-		if err != nil {
+ORDER BY pa.action_index ASC, pa.created_at ASC`, tenantID, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actions := make([]PlanAction, 0)
+	for rows.Next() {
+		var action PlanAction
+		if err := rows.Scan(&action.ID, &action.PlanID, &action.OperationID, &action.OperationType, &action.VMID, &action.PayloadJSON); err != nil {
 			return nil, err
 		}
-		actions := make([]PlanAction, 0)
-		for actionRows.Next() {
-			var action PlanAction
-			if err := actionRows.Scan(&action.ID, &action.PlanID, &action.OperationID, &action.OperationType, &action.VMID, &action.PayloadJSON); err != nil {
-				actionRows.Close()
-				return nil, err
-			}
-			actions = append(actions, action)
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var refs []string
+	for _, action := range actions {
+		refs = append(refs, fileContentRefs(action.PayloadJSON)...)
+	}
+	if len(refs) == 0 {
+		return actions, nil
+	}
+	contents, err := loadFileContents(ctx, q, refs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range actions {
+		if actions[i].PayloadJSON, err = resolveFileContents(actions[i].PayloadJSON, contents); err != nil {
+			return nil, err
 		}
-		if err := actionRows.Err(); err != nil {
-			actionRows.Close()
+	}
+	return actions, nil
+}
+
+// planActionsForRetry loads all of the plan's persisted actions, in plan
+// order, with stored file contents put back into their payloads.
+func planActionsForRetry(ctx context.Context, q queryer, tenantID, planID string) ([]PlanAction, error) {
+	rows, err := q.QueryContext(ctx, `
+SELECT id, plan_id, operation_id, operation_type, COALESCE(vm_id::text,''), payload_json
+FROM plan_actions
+WHERE tenant_id = $1 AND plan_id = $2
+ORDER BY action_index ASC, created_at ASC`, tenantID, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actions := make([]PlanAction, 0)
+	var refs []string
+	for rows.Next() {
+		var action PlanAction
+		if err := rows.Scan(&action.ID, &action.PlanID, &action.OperationID, &action.OperationType, &action.VMID, &action.PayloadJSON); err != nil {
 			return nil, err
 		}
-		actionRows.Close()
-		if len(actions) == 0 {
-			continue
+		refs = append(refs, fileContentRefs(action.PayloadJSON)...)
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(refs) == 0 {
+		return actions, nil
+	}
+	contents, err := loadFileContents(ctx, q, refs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range actions {
+		if actions[i].PayloadJSON, err = resolveFileContents(actions[i].PayloadJSON, contents); err != nil {
+			return nil, err
 		}
-		out = append(out, LeasedPlan{
-			PlanID:      planID,
-			ExecutionID: planID,
-			Actions:     actions,
-		})
 	}
+	return actions, nil
+}
 
-	if err := tx.Commit(); err != nil {
+// loadFileContents loads stored plan file contents by reference.
+func loadFileContents(ctx context.Context, q queryer, refs []string) (map[string]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT hash, content FROM plan_file_contents WHERE hash = ANY($1)`, pq.Array(refs))
+	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	defer rows.Close()
+	contents := make(map[string]string, len(refs))
+	for rows.Next() {
+		var ref, content string
+		if err := rows.Scan(&ref, &content); err != nil {
+			return nil, err
+		}
+		contents[ref] = content
+	}
+	return contents, rows.Err()
 }
 
 func (r *PostgresRepo) ReportPlanResult(ctx context.Context, agentID string, report PlanResultReport) error {
@@ -849,23 +1949,47 @@ func (r *PostgresRepo) ReportPlanResult(ctx context.Context, agentID string, rep
 		return ErrNotFound
 	}
 
-	var exists bool
+	var (
+		planTenantID, planSiteID, leasedBy string
+		leaseExpiresAt                     sql.NullTime
+	)
 	if err := tx.QueryRowContext(ctx, `
-SELECT EXISTS(
-  SELECT 1
-  FROM plans
-  WHERE id = $1
-    AND tenant_id = $2
-    AND site_id = $3
-)`, planID, agent.TenantID, agent.SiteID).Scan(&exists); err != nil {
+SELECT tenant_id::text, site_id::text, COALESCE(leased_by_agent_id::text, ''), lease_expires_at
+FROM plans
+WHERE id = $1
+FOR UPDATE`, planID).Scan(&planTenantID, &planSiteID, &leasedBy, &leaseExpiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
 		return err
 	}
-	if !exists {
+	// A plan of another tenant or site is not found, so its existence is
+	// not revealed.
+	if planTenantID != agent.TenantID || planSiteID != agent.SiteID {
 		return ErrNotFound
 	}
 
 	now := time.Now().UTC()
+	// Only the agent holding the lease may report, unless the lease expired.
+	if leasedBy != "" && leasedBy != agent.ID && leaseExpiresAt.Valid && leaseExpiresAt.Time.After(now) {
+		return ErrUnauthorized
+	}
+	applied, duplicates := 0, 0
 	for _, result := range report.Results {
+		if token := strings.TrimSpace(result.IdempotencyToken); token != "" {
+			res, err := tx.ExecContext(ctx, `
+INSERT INTO plan_result_tokens (plan_id, token, applied_at)
+VALUES ($1, $2, $3)
+ON CONFLICT (plan_id, token) DO NOTHING`, planID, token, now)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				duplicates++
+				continue
+			}
+		}
+		applied++
 		actionID := strings.TrimSpace(result.ActionID)
 		if actionID == "" {
 			continue
@@ -900,6 +2024,7 @@ WHERE tenant_id = $7
   AND site_id = $8
   AND plan_id = $9
   AND operation_id = $10
+  AND ($11::jsonb IS NULL OR jsonb_exists($11::jsonb, operation_type::text))
 RETURNING COALESCE(vm_id::text, ''), operation_type`,
 			state,
 			errorCode,
@@ -911,6 +2036,7 @@ RETURNING COALESCE(vm_id::text, ''), operation_type`,
 			agent.SiteID,
 			planID,
 			actionID,
+			scopeOperationsJSON(agent.Scope),
 		).Scan(&vmID, &operationType)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -918,14 +2044,25 @@ RETURNING COALESCE(vm_id::text, ''), operation_type`,
 			}
 			return err
 		}
-		if err := r.applyExecutionVMStateTx(ctx, tx, agent.TenantID, agent.SiteID, nullable(agent.HostID), vmID, operationType, state, completedAt); err != nil {
+		if err := r.applyExecutionVMStateTx(ctx, tx, agent.TenantID, agent.SiteID, nullable(agent.HostID), vmID, planID, actionID, operationType, state, completedAt); err != nil {
 			return err
 		}
+		if state == "SUCCEEDED" && strings.EqualFold(operationType, "CREATE") {
+			if err := r.registerVMDNSTx(ctx, tx, agent.TenantID, vmID, completedAt); err != nil {
+				return err
+			}
+		}
+	}
+	if applied == 0 && duplicates > 0 {
+		return ErrDuplicateReport
 	}
 
 	if err := r.rollupPlanStatusTx(ctx, tx, planID); err != nil {
 		return err
 	}
+	if err := r.advanceVMMigrationTx(ctx, tx, planID); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -934,7 +2071,14 @@ func (r *PostgresRepo) IngestLogs(ctx context.Context, req LogIngest) (accepted
 	if err != nil {
 		return 0, 0, err
 	}
+	var minSeverity string
+	if err := r.db.QueryRowContext(ctx, `SELECT min_log_severity FROM tenants WHERE id = $1`, agent.TenantID).Scan(&minSeverity); err != nil {
+		return 0, 0, err
+	}
 	for _, entry := range req.Entries {
+		if belowMinSeverity(entry.Severity, minSeverity) {
+			continue
+		}
 		sev := normalizeSeverity(entry.Severity)
 		if entry.EmittedAt.IsZero() {
 			entry.EmittedAt = time.Now().UTC()
@@ -962,24 +2106,50 @@ ON CONFLICT (tenant_id, execution_id, sequence) DO NOTHING`,
 	return accepted, dropped, nil
 }
 
-func (r *PostgresRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) (int64, error) {
+func (r *PostgresRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) ([]Agent, error) {
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	res, err := tx.ExecContext(ctx, `
-UPDATE agents
+	// The locked subquery yields the state each agent had, so the agents
+	// returned are exactly the ones this statement marked.
+	rows, err := tx.QueryContext(ctx, `
+UPDATE agents a
 SET state = 'OFFLINE',
     updated_at = now()
-WHERE state <> 'OFFLINE'
-  AND last_heartbeat_at IS NOT NULL
-  AND last_heartbeat_at < $1`, staleBefore)
+FROM (
+  SELECT id, state
+  FROM agents
+  WHERE state <> 'OFFLINE'
+    AND last_heartbeat_at IS NOT NULL
+    AND last_heartbeat_at < $1
+  FOR UPDATE
+) prev
+WHERE a.id = prev.id
+RETURNING a.id, a.tenant_id, a.site_id, a.host_id, a.cert_serial, a.refresh_token_hash, a.agent_version, a.os, a.arch, COALESCE(a.kernel_version, ''), prev.state::text, a.last_heartbeat_at`, staleBefore)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	marked := make([]Agent, 0)
+	for rows.Next() {
+		var a Agent
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.SiteID, &a.HostID, &a.CertSerial, &a.RefreshTokenHash, &a.AgentVersion, &a.OS, &a.Arch, &a.KernelVersion, &a.State, &a.LastHeartbeatAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := r.cipher.openAgent(&a); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		marked = append(marked, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	updated, _ := res.RowsAffected()
+	sort.Slice(marked, func(i, j int) bool { return marked[i].ID < marked[j].ID })
 
 	if _, err := tx.ExecContext(ctx, `
 UPDATE sites s
@@ -1000,20 +2170,21 @@ SET connectivity_state = CASE
         AND a.site_id = s.id
     ),
     updated_at = now()`); err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return 0, err
+		return nil, err
 	}
-	return updated, nil
+	return marked, nil
 }
 
 func (r *PostgresRepo) ListHosts(ctx context.Context, tenantID, siteID string) ([]Host, error) {
 	rows, err := r.db.QueryContext(ctx, `
 SELECT h.id, h.tenant_id, h.site_id, h.hostname, h.cpu_cores_total, h.memory_bytes_total,
        h.storage_bytes_total, h.kvm_available, h.cloud_hypervisor_available, h.last_facts_at,
-       COALESCE(a.state::text, 'OFFLINE') as agent_state, a.last_heartbeat_at
+       COALESCE(h.facts_error, ''), h.maintenance, COALESCE(a.state::text, 'OFFLINE') as agent_state, a.last_heartbeat_at,
+       a.agent_metadata
 FROM hosts h
 LEFT JOIN agents a ON a.host_id = h.id AND a.tenant_id = h.tenant_id
 WHERE h.tenant_id = $1 AND h.site_id = $2
@@ -1025,17 +2196,118 @@ ORDER BY h.hostname ASC`, tenantID, siteID)
 	out := make([]Host, 0)
 	for rows.Next() {
 		var h Host
-		if err := rows.Scan(&h.ID, &h.TenantID, &h.SiteID, &h.Hostname, &h.CPUCoresTotal, &h.MemoryBytesTotal, &h.StorageBytesTotal, &h.KVMAvailable, &h.CloudHypervisorAvailable, &h.LastFactsAt, &h.AgentState, &h.AgentLastHeartbeatAt); err != nil {
+		var agentMetadata []byte
+		if err := rows.Scan(&h.ID, &h.TenantID, &h.SiteID, &h.Hostname, &h.CPUCoresTotal, &h.MemoryBytesTotal, &h.StorageBytesTotal, &h.KVMAvailable, &h.CloudHypervisorAvailable, &h.LastFactsAt, &h.FactsError, &h.Maintenance, &h.AgentState, &h.AgentLastHeartbeatAt, &agentMetadata); err != nil {
 			return nil, err
 		}
+		h.AgentMetadata = agentMetadata
+		h.FactsDegraded = h.FactsError != ""
 		out = append(out, h)
 	}
 	return out, rows.Err()
 }
 
+// ListTenantAgents lists agents across all of a tenant's sites. The expiry
+// comes from the newest history entry for the agent's current serial.
+func (r *PostgresRepo) ListTenantAgents(ctx context.Context, tenantID string, query TenantAgentQuery) ([]TenantAgent, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := r.db.QueryContext(ctx, `
+SELECT a.id, a.site_id, s.name, a.host_id, COALESCE(h.hostname, ''), a.state::text,
+       a.agent_version, a.os, a.arch, a.last_heartbeat_at, ch.expires_at, a.agent_metadata,
+       COALESCE(a.last_shutdown_reason, ''), a.last_shutdown_at
+FROM agents a
+JOIN sites s ON s.id = a.site_id AND s.tenant_id = a.tenant_id
+LEFT JOIN hosts h ON h.id = a.host_id AND h.tenant_id = a.tenant_id
+LEFT JOIN LATERAL (
+  SELECT expires_at
+  FROM certificate_history
+  WHERE agent_id = a.id AND serial = a.cert_serial
+  ORDER BY issued_at DESC
+  LIMIT 1
+) ch ON true
+WHERE a.tenant_id = $1
+  AND ($2::text IS NULL OR a.state::text = $2)
+  AND ($3::uuid IS NULL OR a.id > $3::uuid)
+ORDER BY a.id ASC
+LIMIT $4`, tenantID, nullable(query.State), nullable(query.Cursor), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]TenantAgent, 0)
+	for rows.Next() {
+		var a TenantAgent
+		var metadata []byte
+		if err := rows.Scan(&a.ID, &a.SiteID, &a.SiteName, &a.HostID, &a.Hostname, &a.State, &a.AgentVersion, &a.OS, &a.Arch, &a.LastHeartbeatAt, &a.CertExpiresAt, &metadata, &a.LastShutdownReason, &a.LastShutdownAt); err != nil {
+			return nil, err
+		}
+		a.Metadata = metadata
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) SetHostMaintenance(ctx context.Context, tenantID, siteID, hostID string, maintenance bool) (Host, error) {
+	var h Host
+	err := r.db.QueryRowContext(ctx, `
+UPDATE hosts
+SET maintenance = $4, updated_at = now()
+WHERE id = $1 AND tenant_id = $2 AND site_id = $3
+RETURNING id, tenant_id, site_id, hostname, cpu_cores_total, memory_bytes_total, storage_bytes_total,
+          kvm_available, cloud_hypervisor_available, last_facts_at, COALESCE(facts_error, ''), maintenance`,
+		hostID, tenantID, siteID, maintenance).Scan(&h.ID, &h.TenantID, &h.SiteID, &h.Hostname, &h.CPUCoresTotal, &h.MemoryBytesTotal, &h.StorageBytesTotal, &h.KVMAvailable, &h.CloudHypervisorAvailable, &h.LastFactsAt, &h.FactsError, &h.Maintenance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Host{}, ErrNotFound
+		}
+		return Host{}, err
+	}
+	h.FactsDegraded = h.FactsError != ""
+	return h, nil
+}
+
+func (r *PostgresRepo) SetAgentMetadata(ctx context.Context, tenantID, siteID, agentID string, metadata json.RawMessage) error {
+	if err := ValidateAgentMetadata(metadata); err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `
+UPDATE agents
+SET agent_metadata = $4, updated_at = now()
+WHERE id = $1 AND tenant_id = $2 AND site_id = $3`,
+		agentID, tenantID, siteID, nullableJSON(normalizePlanMetadata(metadata)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) AgentHostInMaintenance(ctx context.Context, agentID string) (bool, error) {
+	var maintenance bool
+	err := r.db.QueryRowContext(ctx, `
+SELECT COALESCE(h.maintenance, false)
+FROM agents a
+LEFT JOIN hosts h ON h.id = a.host_id
+WHERE a.id = $1`, agentID).Scan(&maintenance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNotFound
+		}
+		return false, err
+	}
+	return maintenance, nil
+}
+
 func (r *PostgresRepo) ListVMs(ctx context.Context, tenantID, siteID string) ([]MicroVM, error) {
 	rows, err := r.db.QueryContext(ctx, `
-SELECT id, tenant_id, site_id, COALESCE(host_id::text,''), name, state::text, vcpu_count, memory_mib, last_transition_at, updated_at
+SELECT id, tenant_id, site_id, COALESCE(host_id::text,''), name, state::text, vcpu_count, memory_mib,
+       COALESCE(vcpu_request, 0), COALESCE(vcpu_limit, 0), COALESCE(memory_request_mib, 0), COALESCE(memory_limit_mib, 0),
+       last_transition_at, updated_at, COALESCE(last_plan_id::text, ''), COALESCE(last_operation_id, '')
 FROM microvms
 WHERE tenant_id = $1 AND site_id = $2
 ORDER BY updated_at DESC`, tenantID, siteID)
@@ -1046,7 +2318,7 @@ ORDER BY updated_at DESC`, tenantID, siteID)
 	out := make([]MicroVM, 0)
 	for rows.Next() {
 		var vm MicroVM
-		if err := rows.Scan(&vm.ID, &vm.TenantID, &vm.SiteID, &vm.HostID, &vm.Name, &vm.State, &vm.VCPUCount, &vm.MemoryMiB, &vm.LastTransitionAt, &vm.UpdatedAt); err != nil {
+		if err := rows.Scan(&vm.ID, &vm.TenantID, &vm.SiteID, &vm.HostID, &vm.Name, &vm.State, &vm.VCPUCount, &vm.MemoryMiB, &vm.VCPURequest, &vm.VCPULimit, &vm.MemoryRequestMiB, &vm.MemoryLimitMiB, &vm.LastTransitionAt, &vm.UpdatedAt, &vm.LastPlanID, &vm.LastOperationID); err != nil {
 			return nil, err
 		}
 		out = append(out, vm)
@@ -1054,6 +2326,95 @@ ORDER BY updated_at DESC`, tenantID, siteID)
 	return out, rows.Err()
 }
 
+func (r *PostgresRepo) PutExecutionConsoleLog(ctx context.Context, agentID string, upload ConsoleLogUpload) (ExecutionConsoleLog, error) {
+	agent, err := r.GetAgentByID(ctx, agentID)
+	if err != nil {
+		return ExecutionConsoleLog{}, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ExecutionConsoleLog{}, err
+	}
+	defer tx.Rollback()
+
+	// resolvePlanIDTx only matches plans in the agent's tenant and site.
+	planID, err := r.resolvePlanIDTx(ctx, tx, agent.TenantID, agent.SiteID, upload.ExecutionID)
+	if err != nil {
+		return ExecutionConsoleLog{}, err
+	}
+	if planID == "" {
+		return ExecutionConsoleLog{}, ErrNotFound
+	}
+	// Only the agent holding the lease may upload, unless the lease expired.
+	var leasedByOther bool
+	if err := tx.QueryRowContext(ctx, `
+SELECT COALESCE(COALESCE(leased_by_agent_id::text, '') NOT IN ('', $2) AND lease_expires_at > now(), false)
+FROM plans
+WHERE id = $1`, planID, agent.ID).Scan(&leasedByOther); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ExecutionConsoleLog{}, ErrNotFound
+		}
+		return ExecutionConsoleLog{}, err
+	}
+	if leasedByOther {
+		return ExecutionConsoleLog{}, ErrUnauthorized
+	}
+	var execID string
+	if err := tx.QueryRowContext(ctx, `
+SELECT id
+FROM executions
+WHERE plan_id = $1 AND operation_id = $2`, planID, strings.TrimSpace(upload.ActionID)).Scan(&execID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ExecutionConsoleLog{}, ErrNotFound
+		}
+		return ExecutionConsoleLog{}, err
+	}
+
+	content, truncated := truncateConsoleLog(upload.Content, upload.Truncated)
+	out := ExecutionConsoleLog{
+		ExecutionID: execID,
+		TenantID:    agent.TenantID,
+		AgentID:     agent.ID,
+		VMID:        upload.VMID,
+		Content:     content,
+		Truncated:   truncated,
+	}
+	if err := tx.QueryRowContext(ctx, `
+INSERT INTO execution_console_logs (execution_id, tenant_id, agent_id, vm_id, content, truncated, captured_at)
+VALUES ($1,$2,$3,$4,$5,$6,now())
+ON CONFLICT (execution_id)
+DO UPDATE SET
+  agent_id = EXCLUDED.agent_id,
+  vm_id = EXCLUDED.vm_id,
+  content = EXCLUDED.content,
+  truncated = EXCLUDED.truncated,
+  captured_at = EXCLUDED.captured_at
+RETURNING captured_at`, out.ExecutionID, out.TenantID, out.AgentID, nullable(out.VMID), out.Content, out.Truncated).Scan(&out.CapturedAt); err != nil {
+		return ExecutionConsoleLog{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ExecutionConsoleLog{}, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) GetExecutionConsoleLog(ctx context.Context, tenantID, executionID string) (ExecutionConsoleLog, error) {
+	var out ExecutionConsoleLog
+	err := r.db.QueryRowContext(ctx, `
+SELECT execution_id, tenant_id, agent_id, COALESCE(vm_id, ''), content, truncated, captured_at
+FROM execution_console_logs
+WHERE execution_id = $1 AND tenant_id = $2`, executionID, tenantID).Scan(
+		&out.ExecutionID, &out.TenantID, &out.AgentID, &out.VMID, &out.Content, &out.Truncated, &out.CapturedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ExecutionConsoleLog{}, ErrNotFound
+		}
+		return ExecutionConsoleLog{}, err
+	}
+	return out, nil
+}
+
 func (r *PostgresRepo) ListExecutionLogs(ctx context.Context, tenantID, executionID string, limit int) ([]ExecutionLog, error) {
 	if limit <= 0 || limit > 2000 {
 		limit = 500
@@ -1079,10 +2440,36 @@ LIMIT $3`, tenantID, executionID, limit)
 	return out, rows.Err()
 }
 
+// GetExecutionLogStats counts an execution's log entries with a single
+// aggregate over execution_logs.
+func (r *PostgresRepo) GetExecutionLogStats(ctx context.Context, tenantID, executionID string) (ExecutionLogStats, error) {
+	var total, debug, info, warn, errorCount int64
+	err := r.db.QueryRowContext(ctx, `
+SELECT count(*),
+       count(*) FILTER (WHERE severity = 'DEBUG'),
+       count(*) FILTER (WHERE severity = 'INFO'),
+       count(*) FILTER (WHERE severity = 'WARN'),
+       count(*) FILTER (WHERE severity = 'ERROR')
+FROM execution_logs
+WHERE tenant_id = $1 AND execution_id = $2`, tenantID, executionID).Scan(&total, &debug, &info, &warn, &errorCount)
+	if err != nil {
+		return ExecutionLogStats{}, err
+	}
+	return ExecutionLogStats{
+		ExecutionID: executionID,
+		Total:       total,
+		BySeverity:  map[string]int64{"DEBUG": debug, "INFO": info, "WARN": warn, "ERROR": errorCount},
+	}, nil
+}
+
 func (r *PostgresRepo) WriteAudit(ctx context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error {
 	if len(metadata) == 0 {
 		metadata = []byte(`{}`)
 	}
+	metadata, err := r.cipher.sealJSON(tenantID, metadata)
+	if err != nil {
+		return err
+	}
 	var actorUserID any
 	var actorAgentID any
 	switch actorType {
@@ -1091,33 +2478,290 @@ func (r *PostgresRepo) WriteAudit(ctx context.Context, tenantID, siteID, actorTy
 	case "AGENT":
 		actorAgentID = nullable(actorID)
 	}
-	if _, err := r.db.ExecContext(ctx, `
-INSERT INTO audit_events (
-  tenant_id, site_id, actor_type, actor_user_id, actor_agent_id,
-  action, resource_type, resource_id, request_id, source_ip, metadata_json
-)
-VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11::jsonb)`,
-		tenantID,
-		nullable(siteID),
-		actorType,
-		actorUserID,
-		actorAgentID,
-		action,
-		resourceType,
-		resourceID,
-		nullable(requestID),
-		nullable(sourceIP),
-		string(metadata),
-	); err != nil {
+	if _, err := r.db.ExecContext(ctx, `
+INSERT INTO audit_events (
+  tenant_id, site_id, actor_type, actor_user_id, actor_agent_id,
+  action, resource_type, resource_id, request_id, source_ip, metadata_json
+)
+VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11::jsonb)`,
+		tenantID,
+		nullable(siteID),
+		actorType,
+		actorUserID,
+		actorAgentID,
+		action,
+		resourceType,
+		resourceID,
+		nullable(requestID),
+		nullable(sourceIP),
+		string(metadata),
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *PostgresRepo) SiteBelongsToTenant(ctx context.Context, siteID, tenantID string) (bool, error) {
+	var ok bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sites WHERE id=$1 AND tenant_id=$2)`, siteID, tenantID).Scan(&ok)
+	return ok, err
+}
+
+func (r *PostgresRepo) GetSiteImageDefaults(ctx context.Context, tenantID, siteID string) (map[string]VMImage, error) {
+	var raw []byte
+	err := r.db.QueryRowContext(ctx, `SELECT image_defaults FROM sites WHERE id=$1 AND tenant_id=$2`, siteID, tenantID).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	out := map[string]VMImage{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) SetSiteImageDefaults(ctx context.Context, tenantID, siteID string, images map[string]VMImage) error {
+	if images == nil {
+		images = map[string]VMImage{}
+	}
+	raw, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `UPDATE sites SET image_defaults = $3 WHERE id=$1 AND tenant_id=$2`, siteID, tenantID, raw)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) SetSiteVMNamePolicy(ctx context.Context, tenantID, siteID string, uniqueNames bool, nameTemplate string) error {
+	res, err := r.db.ExecContext(ctx, `UPDATE sites SET unique_vm_names = $3, vm_name_template = $4 WHERE id=$1 AND tenant_id=$2`, siteID, tenantID, uniqueNames, nullable(nameTemplate))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) GetSiteDesiredState(ctx context.Context, tenantID, siteID string) (DesiredState, error) {
+	var raw []byte
+	err := r.db.QueryRowContext(ctx, `SELECT desired_state FROM sites WHERE id=$1 AND tenant_id=$2`, siteID, tenantID).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DesiredState{}, ErrNotFound
+		}
+		return DesiredState{}, err
+	}
+	var out DesiredState
+	if len(raw) == 0 {
+		return out, nil
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return DesiredState{}, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) SetSiteDesiredState(ctx context.Context, tenantID, siteID string, state DesiredState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `UPDATE sites SET desired_state = $3 WHERE id=$1 AND tenant_id=$2`, siteID, tenantID, raw)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) GetSiteAgentRollout(ctx context.Context, tenantID, siteID string) (AgentRollout, error) {
+	var raw []byte
+	err := r.db.QueryRowContext(ctx, `SELECT agent_rollout FROM sites WHERE id=$1 AND tenant_id=$2`, siteID, tenantID).Scan(&raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AgentRollout{}, ErrNotFound
+		}
+		return AgentRollout{}, err
+	}
+	var out AgentRollout
+	if len(raw) == 0 {
+		return out, nil
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return AgentRollout{}, err
+	}
+	return out, nil
+}
+
+func (r *PostgresRepo) SetSiteAgentRollout(ctx context.Context, tenantID, siteID string, rollout AgentRollout) error {
+	raw, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE sites SET agent_rollout = $3 WHERE id=$1 AND tenant_id=$2`, siteID, tenantID, raw)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM agent_upgrades WHERE site_id=$1 AND state=$2`, siteID, AgentUpgradeFailed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimAgentUpgrade locks the agent's site row so that concurrent heartbeats
+// from one site see each other's claims when counting upgrades in flight.
+func (r *PostgresRepo) ClaimAgentUpgrade(ctx context.Context, agentID, version string) (string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var siteID string
+	var raw []byte
+	err = tx.QueryRowContext(ctx, `
+SELECT s.id, s.agent_rollout
+FROM agents a
+JOIN sites s ON s.id = a.site_id
+WHERE a.id = $1
+FOR UPDATE OF s`, agentID).Scan(&siteID, &raw)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	var rollout AgentRollout
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &rollout); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+UPDATE agent_upgrades
+SET state = $3, updated_at = now()
+WHERE agent_id = $1 AND target_version = $2 AND state <> $3`, agentID, version, AgentUpgradeSucceeded); err != nil {
+		return "", err
+	}
+	if rollout.TargetVersion == "" || rollout.TargetVersion == version {
+		return "", tx.Commit()
+	}
+
+	versions := map[string]string{}
+	rows, err := tx.QueryContext(ctx, `SELECT id, agent_version FROM agents WHERE site_id=$1 AND state::text <> 'UNENROLLED'`, siteID)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var id, v string
+		if err := rows.Scan(&id, &v); err != nil {
+			rows.Close()
+			return "", err
+		}
+		versions[id] = v
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	versions[agentID] = version
+	upgrades, err := listAgentUpgrades(ctx, tx, siteID)
+	if err != nil {
+		return "", err
+	}
+	byAgent := make(map[string]AgentUpgrade, len(upgrades))
+	for _, u := range upgrades {
+		byAgent[u.AgentID] = u
+	}
+	if !ShouldSignalUpgrade(rollout, agentID, version, versions, byAgent) {
+		return "", tx.Commit()
+	}
+	if u, ok := byAgent[agentID]; !ok || u.TargetVersion != rollout.TargetVersion {
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO agent_upgrades (agent_id, site_id, from_version, target_version, state, message, updated_at)
+VALUES ($1, $2, $3, $4, $5, '', now())
+ON CONFLICT (agent_id) DO UPDATE
+SET site_id = EXCLUDED.site_id,
+    from_version = EXCLUDED.from_version,
+    target_version = EXCLUDED.target_version,
+    state = EXCLUDED.state,
+    message = '',
+    updated_at = now()`, agentID, siteID, version, rollout.TargetVersion, AgentUpgradeSignaled)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return rollout.TargetVersion, nil
+}
+
+func (r *PostgresRepo) ReportAgentUpgrade(ctx context.Context, agentID string, report AgentUpgradeReport) error {
+	state := AgentUpgradeFailed
+	if report.OK {
+		state = AgentUpgradeSucceeded
+	}
+	res, err := r.db.ExecContext(ctx, `
+UPDATE agent_upgrades
+SET state = $3, message = $4, updated_at = now()
+WHERE agent_id = $1 AND target_version = $2`, agentID, report.TargetVersion, state, report.Message)
+	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-func (r *PostgresRepo) SiteBelongsToTenant(ctx context.Context, siteID, tenantID string) (bool, error) {
-	var ok bool
-	err := r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sites WHERE id=$1 AND tenant_id=$2)`, siteID, tenantID).Scan(&ok)
-	return ok, err
+func (r *PostgresRepo) ListSiteAgentUpgrades(ctx context.Context, tenantID, siteID string) ([]AgentUpgrade, error) {
+	ok, err := r.SiteBelongsToTenant(ctx, siteID, tenantID)
+	if err != nil || !ok {
+		return []AgentUpgrade{}, err
+	}
+	return listAgentUpgrades(ctx, r.db, siteID)
+}
+
+func listAgentUpgrades(ctx context.Context, q queryer, siteID string) ([]AgentUpgrade, error) {
+	rows, err := q.QueryContext(ctx, `
+SELECT agent_id, site_id, from_version, target_version, state, message, updated_at
+FROM agent_upgrades
+WHERE site_id = $1
+ORDER BY agent_id`, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]AgentUpgrade, 0)
+	for rows.Next() {
+		var u AgentUpgrade
+		if err := rows.Scan(&u.AgentID, &u.SiteID, &u.FromVersion, &u.TargetVersion, &u.State, &u.Message, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
 }
 
 func (r *PostgresRepo) ExecutionBelongsToTenant(ctx context.Context, executionID, tenantID string) (bool, error) {
@@ -1168,7 +2812,9 @@ SELECT
     t.created_at, t.expires_at,
     t.used_at IS NOT NULL as consumed,
     t.used_at as consumed_at,
-    a.id as consumed_by_agent_id
+    a.id as consumed_by_agent_id,
+    t.scope,
+    t.token_hash
 FROM enrollment_tokens t
 JOIN sites s ON t.site_id = s.id
 LEFT JOIN agents a ON t.id = a.enrollment_token_id
@@ -1184,7 +2830,12 @@ ORDER BY t.created_at DESC`, tenantID)
 		var t EnrollmentTokenWithStatus
 		var consumedAt sql.NullTime
 		var consumedByAgentID sql.NullString
-		if err := rows.Scan(&t.ID, &t.SiteID, &t.SiteName, &t.CreatedAt, &t.ExpiresAt, &t.Consumed, &consumedAt, &consumedByAgentID); err != nil {
+		var scope []byte
+		if err := rows.Scan(&t.ID, &t.SiteID, &t.SiteName, &t.CreatedAt, &t.ExpiresAt, &t.Consumed, &consumedAt, &consumedByAgentID, &scope, &t.TokenHash); err != nil {
+			return nil, err
+		}
+		var err error
+		if t.Scope, err = parseScopeJSON(scope); err != nil {
 			return nil, err
 		}
 		if consumedAt.Valid {
@@ -1240,16 +2891,21 @@ WHERE id = $1 AND tenant_id = $2`, keyID, tenantID)
 
 func (r *PostgresRepo) getPlanByIdempotencyTx(ctx context.Context, tx *sql.Tx, tenantID, idempotency string) (ApplyPlanResult, bool, error) {
 	row := tx.QueryRowContext(ctx, `
-SELECT id, tenant_id, site_id, idempotency_key, plan_version, status, operations_json, created_at
+SELECT id, tenant_id, site_id, idempotency_key, plan_version, status, operations_json, created_at, COALESCE(retried_from::text, ''), metadata, sequential
 FROM plans
-WHERE tenant_id = $1 AND idempotency_key = $2`, tenantID, idempotency)
+WHERE tenant_id = $1 AND idempotency_key = $2 AND idempotency_released_at IS NULL`, tenantID, idempotency)
 	var plan Plan
-	if err := row.Scan(&plan.ID, &plan.TenantID, &plan.SiteID, &plan.IdempotencyKey, &plan.PlanVersion, &plan.Status, &plan.OperationsJSON, &plan.CreatedAt); err != nil {
+	var metadata []byte
+	if err := row.Scan(&plan.ID, &plan.TenantID, &plan.SiteID, &plan.IdempotencyKey, &plan.PlanVersion, &plan.Status, &plan.OperationsJSON, &plan.CreatedAt, &plan.RetriedFrom, &metadata, &plan.Sequential); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return ApplyPlanResult{}, false, nil
 		}
 		return ApplyPlanResult{}, false, err
 	}
+	var err error
+	if plan.Metadata, err = r.cipher.openJSON(plan.TenantID, metadata); err != nil {
+		return ApplyPlanResult{}, false, err
+	}
 
 	rows, err := tx.QueryContext(ctx, `
 SELECT id, tenant_id, site_id, COALESCE(host_id::text,''), COALESCE(agent_id::text,''), plan_id,
@@ -1318,7 +2974,7 @@ WITH rollup AS (
     SUM(CASE WHEN state = 'FAILED' THEN 1 ELSE 0 END) AS failed,
     SUM(CASE WHEN state IN ('PENDING','IN_PROGRESS') THEN 1 ELSE 0 END) AS active,
     SUM(CASE WHEN state = 'IN_PROGRESS' THEN 1 ELSE 0 END) AS in_progress,
-    SUM(CASE WHEN state = 'SUCCEEDED' THEN 1 ELSE 0 END) AS completed
+    SUM(CASE WHEN state IN ('SUCCEEDED','SKIPPED') THEN 1 ELSE 0 END) AS completed
   FROM executions
   WHERE plan_id = $1
 )
@@ -1351,11 +3007,18 @@ WHERE id = $1`, planID)
 	return err
 }
 
-func (r *PostgresRepo) applyExecutionVMStateTx(ctx context.Context, tx *sql.Tx, tenantID, siteID string, hostID any, vmID, operationType, executionState string, at time.Time) error {
+// applyExecutionVMStateTx moves a VM to the state an execution result
+// implies. A successful CREATE, START or STOP also records planID and
+// operationID as the action that last changed the VM.
+func (r *PostgresRepo) applyExecutionVMStateTx(ctx context.Context, tx *sql.Tx, tenantID, siteID string, hostID any, vmID, planID, operationID, operationType, executionState string, at time.Time) error {
 	vmID = strings.TrimSpace(vmID)
 	if vmID == "" {
 		return nil
 	}
+	// Migration steps move the VM through advanceVMMigrationTx.
+	if strings.EqualFold(operationType, "MIGRATE") {
+		return nil
+	}
 
 	if strings.EqualFold(executionState, "FAILED") {
 		_, err := tx.ExecContext(ctx, `
@@ -1381,20 +3044,104 @@ WHERE id = $1
 			nextState = "RUNNING"
 		}
 		_, err := tx.ExecContext(ctx, `
-INSERT INTO microvms (id, tenant_id, site_id, host_id, name, state, vcpu_count, memory_mib, last_transition_at, updated_at)
-VALUES ($1, $2, $3, $4, $1, $5, 1, 128, $6, $6)
+INSERT INTO microvms (id, tenant_id, site_id, host_id, name, state, vcpu_count, memory_mib, last_transition_at, updated_at, last_plan_id, last_operation_id)
+VALUES ($1, $2, $3, $4, $1, $5, 1, 128, $6, $6, $7, $8)
 ON CONFLICT (id)
 DO UPDATE SET
   host_id = COALESCE(EXCLUDED.host_id, microvms.host_id),
   state = EXCLUDED.state,
   last_transition_at = EXCLUDED.last_transition_at,
-  updated_at = EXCLUDED.updated_at`, vmID, tenantID, siteID, hostID, nextState, at)
+  updated_at = EXCLUDED.updated_at,
+  last_plan_id = EXCLUDED.last_plan_id,
+  last_operation_id = EXCLUDED.last_operation_id`, vmID, tenantID, siteID, hostID, nextState, at, planID, operationID)
 		return err
 	default:
 		return nil
 	}
 }
 
+// registerVMDNSTx records the DNS records of a VM whose CREATE succeeded,
+// keeping hostnames unique per network. Records of deleted VMs go with
+// their microvms row.
+func (r *PostgresRepo) registerVMDNSTx(ctx context.Context, tx *sql.Tx, tenantID, vmID string, at time.Time) error {
+	if r.vmDNSHostnames == "" || strings.TrimSpace(vmID) == "" {
+		return nil
+	}
+	var vm MicroVM
+	if err := tx.QueryRowContext(ctx, `
+SELECT id::text, site_id::text, name
+FROM microvms
+WHERE id = $1 AND tenant_id = $2 AND last_operation_id IS NOT NULL`, vmID, tenantID).Scan(&vm.ID, &vm.SiteID, &vm.Name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `
+SELECT network_id::text, COALESCE(host(ip_address), '')
+FROM vm_network_attachments
+WHERE vm_id = $1`, vmID)
+	if err != nil {
+		return err
+	}
+	var attachments []VMNetworkAttachment
+	for rows.Next() {
+		var a VMNetworkAttachment
+		if err := rows.Scan(&a.NetworkID, &a.IPAddress); err != nil {
+			rows.Close()
+			return err
+		}
+		attachments = append(attachments, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Locking the networks serializes the hostname checks on them.
+	var lockErr error
+	taken := func(networkID, hostname string) bool {
+		var exists bool
+		if lockErr == nil {
+			_, lockErr = tx.ExecContext(ctx, `SELECT 1 FROM vxlan_networks WHERE id = $1 FOR UPDATE`, networkID)
+		}
+		if lockErr == nil {
+			lockErr = tx.QueryRowContext(ctx, `
+SELECT EXISTS (SELECT 1 FROM vm_dns_records WHERE network_id = $1 AND hostname = $2 AND vm_id <> $3)`,
+				networkID, hostname, vmID).Scan(&exists)
+		}
+		return exists || lockErr != nil
+	}
+	records := vmDNSRecords(r.vmDNSHostnames, vm, attachments, at, taken)
+	if lockErr != nil {
+		return lockErr
+	}
+	for _, rec := range records {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO vm_dns_records (network_id, vm_id, site_id, hostname, ip_address, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (network_id, vm_id)
+DO UPDATE SET hostname = EXCLUDED.hostname, ip_address = EXCLUDED.ip_address, created_at = EXCLUDED.created_at`,
+			rec.NetworkID, rec.VMID, rec.SiteID, rec.Hostname, rec.IPAddress, rec.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullableJSON(raw json.RawMessage) any {
+	if len(raw) == 0 {
+		return nil
+	}
+	return []byte(raw)
+}
+
+func nullableInt64(v int64) any {
+	if v <= 0 {
+		return nil
+	}
+	return v
+}
+
 func nullable(s string) any {
 	if strings.TrimSpace(s) == "" {
 		return nil
@@ -1416,7 +3163,7 @@ func isUniqueViolation(err error) bool {
 func normalizeOperation(s string) string {
 	s = strings.ToUpper(strings.TrimSpace(s))
 	switch s {
-	case "CREATE", "START", "STOP", "DELETE":
+	case "CREATE", "START", "STOP", "DELETE", "MIGRATE":
 		return s
 	default:
 		return "CREATE"
@@ -1426,7 +3173,7 @@ func normalizeOperation(s string) string {
 func normalizeExecutionState(s string) string {
 	s = strings.ToUpper(strings.TrimSpace(s))
 	switch s {
-	case "PENDING", "IN_PROGRESS", "SUCCEEDED", "FAILED":
+	case "PENDING", "IN_PROGRESS", "SUCCEEDED", "FAILED", "SKIPPED":
 		return s
 	default:
 		return "IN_PROGRESS"
@@ -1444,7 +3191,8 @@ func normalizeMicroVMState(s string) string {
 }
 
 func normalizeSeverity(s string) string {
-	s = strings.ToUpper(strings.TrimSpace(s))
+	// gRPC frames carry the enum name, e.g. LOG_SEVERITY_WARN.
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "LOG_SEVERITY_")
 	switch s {
 	case "DEBUG", "INFO", "WARN", "ERROR":
 		return s
@@ -1486,8 +3234,174 @@ WHERE id = $1`, agentID)
 	return err
 }
 
+func (r *PostgresRepo) ReleaseAgentPlans(ctx context.Context, agentID string) ([]string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+UPDATE plans
+SET leased_by_agent_id = NULL,
+    lease_expires_at = NULL,
+    updated_at = now()
+WHERE leased_by_agent_id = $1
+RETURNING id::text`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	planIDs := map[string]struct{}{}
+	var released []string
+	for rows.Next() {
+		var planID string
+		if err := rows.Scan(&planID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		planIDs[planID] = struct{}{}
+		released = append(released, planID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Leasing leaves a plan's executions PENDING, so every unfinished
+	// execution of a released plan fails: handing the plan to another agent
+	// could run a CREATE twice. Executions of a plan another agent now holds
+	// are its to finish.
+	now := time.Now().UTC()
+	rows, err = tx.QueryContext(ctx, `
+UPDATE executions e
+SET state = 'FAILED',
+    error_code = $2,
+    error_message = 'agent unenrolled before the action completed',
+    completed_at = $3,
+    updated_at = $3
+FROM plans p
+WHERE p.id = e.plan_id
+  AND ((e.state IN ('PENDING', 'IN_PROGRESS') AND e.plan_id = ANY($4::uuid[]))
+    OR (e.state = 'IN_PROGRESS' AND e.agent_id = $1))
+  AND (p.leased_by_agent_id IS NULL OR p.leased_by_agent_id = $1)
+RETURNING e.tenant_id::text, e.site_id::text, e.host_id, COALESCE(e.vm_id::text, ''), e.plan_id::text, e.operation_id, e.operation_type`,
+		agentID, ErrorCodeAgentUnenrolled, now, pq.Array(released))
+	if err != nil {
+		return nil, err
+	}
+	type failedExec struct {
+		tenantID, siteID, vmID, planID, operationID, operationType string
+		hostID                                                     sql.NullString
+	}
+	var failed []failedExec
+	for rows.Next() {
+		var f failedExec
+		if err := rows.Scan(&f.tenantID, &f.siteID, &f.hostID, &f.vmID, &f.planID, &f.operationID, &f.operationType); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		failed = append(failed, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, f := range failed {
+		var hostID any
+		if f.hostID.Valid {
+			hostID = f.hostID.String
+		}
+		if err := r.applyExecutionVMStateTx(ctx, tx, f.tenantID, f.siteID, hostID, f.vmID, f.planID, f.operationID, f.operationType, "FAILED", now); err != nil {
+			return nil, err
+		}
+		planIDs[f.planID] = struct{}{}
+	}
+
+	out := make([]string, 0, len(planIDs))
+	for planID := range planIDs {
+		if err := r.rollupPlanStatusTx(ctx, tx, planID); err != nil {
+			return nil, err
+		}
+		if err := r.advanceVMMigrationTx(ctx, tx, planID); err != nil {
+			return nil, err
+		}
+		out = append(out, planID)
+	}
+	sort.Strings(out)
+	return out, tx.Commit()
+}
+
+// RevokeTenantAgentCertificates revokes the certificate of every enrolled
+// agent in the tenant and unenrolls it in a single transaction.
+func (r *PostgresRepo) RevokeTenantAgentCertificates(ctx context.Context, tenantID string, reason int) ([]Agent, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT id, tenant_id, site_id, host_id, cert_serial
+FROM agents
+WHERE tenant_id = $1
+  AND cert_serial <> ''
+  AND state <> 'UNENROLLED'
+ORDER BY id
+FOR UPDATE`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Agent, 0)
+	for rows.Next() {
+		var a Agent
+		if err := rows.Scan(&a.ID, &a.TenantID, &a.SiteID, &a.HostID, &a.CertSerial); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	for _, a := range out {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO crl_entries (serial, revoked_at, reason, agent_id)
+VALUES ($1, now(), $2, $3)
+ON CONFLICT (serial) DO NOTHING`, a.CertSerial, reason, a.ID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, `
+UPDATE agents
+SET state = 'UNENROLLED',
+    refresh_token_hash = '',
+    cert_serial = '',
+    updated_at = now()
+WHERE id = $1`, a.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (r *PostgresRepo) UpdateAgentCertificate(ctx context.Context, agentID, certSerial, refreshTokenHash string) error {
-	_, err := r.db.ExecContext(ctx, `
+	var tenantID string
+	err := r.db.QueryRowContext(ctx, `SELECT tenant_id::text FROM agents WHERE id = $1`, agentID).Scan(&tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if refreshTokenHash, err = r.cipher.sealString(tenantID, refreshTokenHash); err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, `
 UPDATE agents
 SET cert_serial = $2,
     refresh_token_hash = $3,
@@ -1545,11 +3459,19 @@ FROM audit_events
 ORDER BY id DESC
 LIMIT 1`)
 
-	return scanAuditEvent(row)
+	event, err := scanAuditEvent(row)
+	if err != nil || event == nil {
+		return event, err
+	}
+	return event, r.openAuditEvent(event)
 }
 
 // WriteAuditEvent creates a new audit event with chain integrity fields.
 func (r *PostgresRepo) WriteAuditEvent(ctx context.Context, event *AuditEvent) error {
+	metadata, err := r.cipher.sealJSON(event.TenantID, event.MetadataJSON)
+	if err != nil {
+		return err
+	}
 	return r.db.QueryRowContext(ctx, `
 INSERT INTO audit_events (
   tenant_id, site_id, actor_type, actor_user_id, actor_agent_id,
@@ -1568,7 +3490,7 @@ RETURNING id`,
 		event.ResourceID,
 		nullString(event.RequestID),
 		nullString(event.SourceIP),
-		string(event.MetadataJSON),
+		string(metadata),
 		event.OccurredAt,
 		event.PrevHash,
 		event.EntryHash,
@@ -1603,26 +3525,248 @@ FROM audit_events`
 
 	query += ` ORDER BY id ASC`
 
-	if limit > 0 {
-		query += ` LIMIT $` + string(rune('0'+len(args)+1))
-		args = append(args, limit)
+	if limit > 0 {
+		query += ` LIMIT $` + string(rune('0'+len(args)+1))
+		args = append(args, limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]AuditEvent, 0)
+	for rows.Next() {
+		event, err := scanAuditEventRows(rows)
+		if err == nil {
+			err = r.openAuditEvent(event)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *event)
+	}
+	return out, rows.Err()
+}
+
+// ListAuditEventsAfter returns audit events with ID greater than afterID.
+func (r *PostgresRepo) ListAuditEventsAfter(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	query := `
+SELECT id, tenant_id, COALESCE(site_id::text,''), actor_type,
+       actor_user_id, actor_agent_id, action, resource_type, resource_id,
+       request_id, COALESCE(source_ip::text,''), metadata_json, occurred_at,
+       prev_hash, entry_hash, chain_valid
+FROM audit_events
+WHERE id > $1
+ORDER BY id ASC`
+	args := []interface{}{afterID}
+	if limit > 0 {
+		query += ` LIMIT $2`
+		args = append(args, limit)
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]AuditEvent, 0)
+	for rows.Next() {
+		event, err := scanAuditEventRows(rows)
+		if err == nil {
+			err = r.openAuditEvent(event)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *event)
+	}
+	return out, rows.Err()
+}
+
+// GetAuditCheckpoint returns the audit verification checkpoint.
+func (r *PostgresRepo) GetAuditCheckpoint(ctx context.Context) (AuditCheckpoint, error) {
+	var cp AuditCheckpoint
+	err := r.db.QueryRowContext(ctx, `
+SELECT event_id, entry_hash, verified_at
+FROM audit_chain_checkpoint
+WHERE id = TRUE`).Scan(&cp.EventID, &cp.EntryHash, &cp.VerifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuditCheckpoint{}, nil
+	}
+	return cp, err
+}
+
+// SetAuditCheckpoint stores the audit verification checkpoint.
+func (r *PostgresRepo) SetAuditCheckpoint(ctx context.Context, checkpoint AuditCheckpoint) error {
+	_, err := r.db.ExecContext(ctx, `
+INSERT INTO audit_chain_checkpoint (id, event_id, entry_hash, verified_at)
+VALUES (TRUE, $1, $2, $3)
+ON CONFLICT (id) DO UPDATE
+SET event_id = EXCLUDED.event_id,
+    entry_hash = EXCLUDED.entry_hash,
+    verified_at = EXCLUDED.verified_at`,
+		checkpoint.EventID, checkpoint.EntryHash, checkpoint.VerifiedAt)
+	return err
+}
+
+// rotationBatchSize is the number of rows re-encrypted per query by
+// RotateTenantEncryption.
+const rotationBatchSize = 500
+
+// RotateTenantEncryption re-encrypts plan and audit metadata and the
+// stored secrets (agent refresh token hashes, user password hashes and
+// webhook secrets) that are not sealed with the active key, including rows
+// written before encryption was enabled. It is safe to rerun and to run
+// while the server takes writes.
+func (r *PostgresRepo) RotateTenantEncryption(ctx context.Context) (int64, error) {
+	if r.cipher == nil {
+		return 0, ErrNoCipher
+	}
+	var total int64
+	for _, t := range []struct{ table, idColumn, column string }{
+		{"plans", "id::text", "metadata"},
+		{"audit_events", "id::text", "metadata_json"},
+	} {
+		n, err := r.rotateColumn(ctx, t.table, t.idColumn, t.column)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("rotate %s.%s: %w", t.table, t.column, err)
+		}
 	}
+	for _, t := range []struct{ table, column string }{
+		{"agents", "refresh_token_hash"},
+		{"users", "password_hash"},
+		{"webhooks", "secret"},
+	} {
+		n, err := r.rotateTextColumn(ctx, t.table, t.column)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("rotate %s.%s: %w", t.table, t.column, err)
+		}
+	}
+	return total, nil
+}
 
-	rows, err := r.db.QueryContext(ctx, query, args...)
-	if err != nil {
-		return nil, err
+// rotateTextColumn re-encrypts the values of a text secret column not
+// sealed with the active key. Secrets are text, not JSON, so rotateColumn
+// does not apply; empty values are left alone.
+func (r *PostgresRepo) rotateTextColumn(ctx context.Context, table, column string) (int64, error) {
+	activePrefix := encryptedPrefix + r.cipher.ActiveKeyID() + ":%"
+	var total int64
+	for {
+		rows, err := r.db.QueryContext(ctx, `
+SELECT id::text, tenant_id::text, `+column+`
+FROM `+table+`
+WHERE `+column+` <> '' AND `+column+` NOT LIKE $1
+ORDER BY id
+LIMIT $2`, activePrefix, rotationBatchSize)
+		if err != nil {
+			return total, err
+		}
+		type row struct{ id, tenantID, value string }
+		var batch []row
+		for rows.Next() {
+			var rw row
+			if err := rows.Scan(&rw.id, &rw.tenantID, &rw.value); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, rw)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		for _, rw := range batch {
+			plaintext, err := r.cipher.openString(rw.tenantID, rw.value)
+			if err != nil {
+				return total, err
+			}
+			sealed, err := r.cipher.sealString(rw.tenantID, plaintext)
+			if err != nil {
+				return total, err
+			}
+			// A value changed since it was read, such as a refresh token
+			// renewed meanwhile, was sealed with the active key already.
+			res, err := r.db.ExecContext(ctx, `UPDATE `+table+` SET `+column+` = $2 WHERE id = $1 AND `+column+` = $3`, rw.id, sealed, rw.value)
+			if err != nil {
+				return total, err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+		if len(batch) < rotationBatchSize {
+			return total, nil
+		}
 	}
-	defer rows.Close()
+}
 
-	out := make([]AuditEvent, 0)
-	for rows.Next() {
-		event, err := scanAuditEventRows(rows)
+func (r *PostgresRepo) rotateColumn(ctx context.Context, table, idColumn, column string) (int64, error) {
+	activePrefix := encryptedPrefix + r.cipher.ActiveKeyID() + ":%"
+	var total int64
+	for {
+		rows, err := r.db.QueryContext(ctx, `
+SELECT `+idColumn+`, tenant_id::text, `+column+`
+FROM `+table+`
+WHERE `+column+` IS NOT NULL AND tenant_id IS NOT NULL
+  AND NOT (jsonb_typeof(`+column+`) = 'string' AND `+column+` #>> '{}' LIKE $1)
+ORDER BY `+idColumn+`
+LIMIT $2`, activePrefix, rotationBatchSize)
 		if err != nil {
-			return nil, err
+			return total, err
+		}
+		type row struct {
+			id, tenantID string
+			value        []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var rw row
+			if err := rows.Scan(&rw.id, &rw.tenantID, &rw.value); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, rw)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		for _, rw := range batch {
+			plaintext, err := r.cipher.openJSON(rw.tenantID, rw.value)
+			if err != nil {
+				return total, err
+			}
+			sealed, err := r.cipher.sealJSON(rw.tenantID, plaintext)
+			if err != nil {
+				return total, err
+			}
+			if _, err := r.db.ExecContext(ctx, `UPDATE `+table+` SET `+column+` = $2 WHERE `+idColumn+` = $1`, rw.id, sealed); err != nil {
+				return total, err
+			}
+			total++
+		}
+		if len(batch) < rotationBatchSize {
+			return total, nil
 		}
-		out = append(out, *event)
 	}
-	return out, rows.Err()
+}
+
+// openAuditEvent decrypts the metadata of a scanned audit event. The chain
+// hash covers the plaintext, so verification is unaffected by encryption.
+func (r *PostgresRepo) openAuditEvent(e *AuditEvent) error {
+	metadata, err := r.cipher.openJSON(e.TenantID, e.MetadataJSON)
+	if err != nil {
+		return err
+	}
+	e.MetadataJSON = metadata
+	return nil
 }
 
 // scanAuditEvent scans a single audit event from a row.
@@ -1758,12 +3902,35 @@ SELECT EXISTS(SELECT 1 FROM crl_entries WHERE serial = $1)`, serial).Scan(&exist
 	return exists, err
 }
 
-// ListRevokedCertificates returns all revoked certificates
-func (r *PostgresRepo) ListRevokedCertificates(ctx context.Context) ([]CRLEntry, error) {
+// ListRevokedCertificates returns the revoked certificates matching query,
+// newest first.
+func (r *PostgresRepo) ListRevokedCertificates(ctx context.Context, query RevokedCertificateQuery) ([]CRLEntry, error) {
+	var afterAt, afterSerial, from, to, limit any
+	if query.Cursor != "" {
+		at, serial, err := ParseCRLCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		afterAt, afterSerial = at, serial
+	}
+	if !query.From.IsZero() {
+		from = query.From
+	}
+	if !query.To.IsZero() {
+		to = query.To
+	}
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
 	rows, err := r.db.QueryContext(ctx, `
 SELECT serial, revoked_at, reason, COALESCE(agent_id::text,'')
 FROM crl_entries
-ORDER BY revoked_at DESC`)
+WHERE ($1::uuid IS NULL OR agent_id = $1::uuid)
+  AND ($2::timestamptz IS NULL OR revoked_at >= $2)
+  AND ($3::timestamptz IS NULL OR revoked_at < $3)
+  AND ($4::timestamptz IS NULL OR (revoked_at, serial) < ($4::timestamptz, $5::text))
+ORDER BY revoked_at DESC, serial DESC
+LIMIT $6`, nullable(query.AgentID), from, to, afterAt, afterSerial, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -1784,6 +3951,29 @@ ORDER BY revoked_at DESC`)
 	return out, rows.Err()
 }
 
+func (r *PostgresRepo) GetCapacity(ctx context.Context, tenantID, siteID string) (Capacity, error) {
+	var out Capacity
+	err := r.db.QueryRowContext(ctx, `
+SELECT h.hosts, h.vcpu_total, h.memory_bytes_total, v.vcpu_used, v.memory_bytes_used
+FROM (
+  SELECT COUNT(*) AS hosts,
+         COALESCE(SUM(cpu_cores_total), 0) AS vcpu_total,
+         COALESCE(SUM(memory_bytes_total), 0) AS memory_bytes_total
+  FROM hosts
+  WHERE tenant_id = $1 AND ($2::uuid IS NULL OR site_id = $2::uuid)
+) h, (
+  SELECT COALESCE(SUM(COALESCE(vcpu_request, vcpu_count)), 0) AS vcpu_used,
+         COALESCE(SUM(COALESCE(memory_request_mib, memory_mib)), 0) * 1048576 AS memory_bytes_used
+  FROM microvms
+  WHERE tenant_id = $1 AND ($2::uuid IS NULL OR site_id = $2::uuid) AND state <> 'DELETING'
+) v`, tenantID, nullable(siteID)).Scan(&out.Hosts, &out.VCPUTotal, &out.MemoryBytesTotal, &out.VCPUUsed, &out.MemoryBytesUsed)
+	if err != nil {
+		return Capacity{}, fmt.Errorf("failed to aggregate capacity: %w", err)
+	}
+	out.finalize()
+	return out, nil
+}
+
 // GetTenantUsage returns current resource usage counts for a tenant
 func (r *PostgresRepo) GetTenantUsage(ctx context.Context, tenantID string) (*TenantUsage, error) {
 	usage := &TenantUsage{}
@@ -1826,6 +4016,54 @@ SELECT COUNT(*) FROM api_keys WHERE tenant_id = $1 AND revoked_at IS NULL`, tena
 	return usage, nil
 }
 
+func (r *PostgresRepo) RecordTenantUsage(ctx context.Context, tenantID string, at time.Time, usage TenantUsage) error {
+	_, err := r.db.ExecContext(ctx, `
+INSERT INTO tenant_usage_history (tenant_id, day, sites, agents, vms, active_plans, api_keys, recorded_at)
+VALUES ($1, $2::date, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (tenant_id, day) DO UPDATE
+SET sites = EXCLUDED.sites,
+    agents = EXCLUDED.agents,
+    vms = EXCLUDED.vms,
+    active_plans = EXCLUDED.active_plans,
+    api_keys = EXCLUDED.api_keys,
+    recorded_at = EXCLUDED.recorded_at`,
+		tenantID, UsageDay(at).Format(time.DateOnly), usage.Sites, usage.Agents, usage.VMs, usage.ActivePlans, usage.APIKeys, at.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to record tenant usage: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresRepo) ListTenantUsageHistory(ctx context.Context, tenantID string, from, to time.Time) ([]TenantUsageSnapshot, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT tenant_id::text, day, sites, agents, vms, active_plans, api_keys, recorded_at
+FROM tenant_usage_history
+WHERE tenant_id = $1 AND day BETWEEN $2::date AND $3::date
+ORDER BY day`, tenantID, UsageDay(from).Format(time.DateOnly), UsageDay(to).Format(time.DateOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenant usage history: %w", err)
+	}
+	defer rows.Close()
+	out := make([]TenantUsageSnapshot, 0)
+	for rows.Next() {
+		var snap TenantUsageSnapshot
+		if err := rows.Scan(&snap.TenantID, &snap.Day, &snap.Sites, &snap.Agents, &snap.VMs, &snap.ActivePlans, &snap.APIKeys, &snap.RecordedAt); err != nil {
+			return nil, err
+		}
+		snap.Day = UsageDay(snap.Day)
+		out = append(out, snap)
+	}
+	return out, rows.Err()
+}
+
+func (r *PostgresRepo) PruneTenantUsageHistory(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM tenant_usage_history WHERE day < $1::date`, UsageDay(cutoff).Format(time.DateOnly))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune tenant usage history: %w", err)
+	}
+	return res.RowsAffected()
+}
+
 // tenantLimitsCache is a simple in-memory cache for tenant quota limits
 // In production, this should be backed by the database
 var (
@@ -1834,7 +4072,8 @@ var (
 )
 
 // GetTenantLimits returns quota limits for a tenant
-// Currently uses in-memory cache with defaults; could be extended to use database
+// Limits set with SetTenantLimits come from the in-memory cache; otherwise
+// the tenant's quota template applies, then DefaultQuotaLimits.
 func (r *PostgresRepo) GetTenantLimits(ctx context.Context, tenantID string) (*QuotaLimits, error) {
 	tenantLimitsCacheMu.RLock()
 	limits, ok := tenantLimitsCache[tenantID]
@@ -1844,14 +4083,21 @@ func (r *PostgresRepo) GetTenantLimits(ctx context.Context, tenantID string) (*Q
 		return &limits, nil
 	}
 
+	err := r.db.QueryRowContext(ctx, `
+SELECT q.max_sites, q.max_agents_per_site, q.max_vms_per_agent, q.max_concurrent_plans, q.max_api_keys
+FROM tenants t
+JOIN quota_templates q ON q.name = t.quota_template
+WHERE t.id = $1`, tenantID).Scan(&limits.MaxSites, &limits.MaxAgentsPerSite, &limits.MaxVMsPerAgent, &limits.MaxConcurrentPlans, &limits.MaxAPIKeys)
+	if err == nil {
+		return &limits, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
 	// Return default limits
-	return &QuotaLimits{
-		MaxSites:           10,
-		MaxAgentsPerSite:   100,
-		MaxVMsPerAgent:     50,
-		MaxConcurrentPlans: 100,
-		MaxAPIKeys:         20,
-	}, nil
+	limits = DefaultQuotaLimits
+	return &limits, nil
 }
 
 // SetTenantLimits sets quota limits for a tenant
@@ -1863,6 +4109,157 @@ func (r *PostgresRepo) SetTenantLimits(ctx context.Context, tenantID string, lim
 	return nil
 }
 
+func (r *PostgresRepo) PutQuotaTemplate(ctx context.Context, template QuotaTemplate) (QuotaTemplate, error) {
+	if err := ValidateQuotaTemplate(template); err != nil {
+		return QuotaTemplate{}, err
+	}
+	l := template.Limits
+	err := r.db.QueryRowContext(ctx, `
+INSERT INTO quota_templates (name, max_sites, max_agents_per_site, max_vms_per_agent, max_concurrent_plans, max_api_keys)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (name)
+DO UPDATE SET
+  max_sites = EXCLUDED.max_sites,
+  max_agents_per_site = EXCLUDED.max_agents_per_site,
+  max_vms_per_agent = EXCLUDED.max_vms_per_agent,
+  max_concurrent_plans = EXCLUDED.max_concurrent_plans,
+  max_api_keys = EXCLUDED.max_api_keys,
+  updated_at = now()
+RETURNING created_at, updated_at`, template.Name, l.MaxSites, l.MaxAgentsPerSite, l.MaxVMsPerAgent, l.MaxConcurrentPlans, l.MaxAPIKeys).Scan(&template.CreatedAt, &template.UpdatedAt)
+	if err != nil {
+		return QuotaTemplate{}, err
+	}
+	return template, nil
+}
+
+func (r *PostgresRepo) GetQuotaTemplate(ctx context.Context, name string) (QuotaTemplate, error) {
+	var t QuotaTemplate
+	err := r.db.QueryRowContext(ctx, `
+SELECT name, max_sites, max_agents_per_site, max_vms_per_agent, max_concurrent_plans, max_api_keys, created_at, updated_at
+FROM quota_templates
+WHERE name = $1`, name).Scan(&t.Name, &t.Limits.MaxSites, &t.Limits.MaxAgentsPerSite, &t.Limits.MaxVMsPerAgent, &t.Limits.MaxConcurrentPlans, &t.Limits.MaxAPIKeys, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return QuotaTemplate{}, ErrNotFound
+		}
+		return QuotaTemplate{}, err
+	}
+	return t, nil
+}
+
+func (r *PostgresRepo) ListQuotaTemplates(ctx context.Context) ([]QuotaTemplate, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT name, max_sites, max_agents_per_site, max_vms_per_agent, max_concurrent_plans, max_api_keys, created_at, updated_at
+FROM quota_templates
+ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []QuotaTemplate{}
+	for rows.Next() {
+		var t QuotaTemplate
+		if err := rows.Scan(&t.Name, &t.Limits.MaxSites, &t.Limits.MaxAgentsPerSite, &t.Limits.MaxVMsPerAgent, &t.Limits.MaxConcurrentPlans, &t.Limits.MaxAPIKeys, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// DeleteQuotaTemplate returns ErrConflict while a tenant references the
+// template.
+func (r *PostgresRepo) DeleteQuotaTemplate(ctx context.Context, name string) error {
+	var inUse bool
+	if err := r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM tenants WHERE quota_template = $1)`, name).Scan(&inUse); err != nil {
+		return err
+	}
+	if inUse {
+		return ErrConflict
+	}
+	result, err := r.db.ExecContext(ctx, `DELETE FROM quota_templates WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	if err := ValidateWebhook(webhook); err != nil {
+		return Webhook{}, err
+	}
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = []string{}
+	}
+	secret, err := r.cipher.sealString(webhook.TenantID, webhook.Secret)
+	if err != nil {
+		return Webhook{}, err
+	}
+	err = r.db.QueryRowContext(ctx, `
+INSERT INTO webhooks (id, tenant_id, url, secret, event_types)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING created_at`, webhook.ID, webhook.TenantID, webhook.URL, secret, pq.Array(webhook.EventTypes)).Scan(&webhook.CreatedAt)
+	if err != nil {
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+func (r *PostgresRepo) ListWebhooks(ctx context.Context, tenantID string) ([]Webhook, error) {
+	return r.queryWebhooks(ctx, `
+SELECT id, tenant_id, url, secret, event_types, created_at
+FROM webhooks
+WHERE tenant_id = $1
+ORDER BY created_at`, tenantID)
+}
+
+func (r *PostgresRepo) DeleteWebhook(ctx context.Context, tenantID, webhookID string) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1 AND tenant_id = $2`, webhookID, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *PostgresRepo) ListSiteWebhooks(ctx context.Context, siteID string) ([]Webhook, error) {
+	return r.queryWebhooks(ctx, `
+SELECT w.id, w.tenant_id, w.url, w.secret, w.event_types, w.created_at
+FROM webhooks w
+JOIN sites s ON s.tenant_id = w.tenant_id
+WHERE s.id = $1
+ORDER BY w.created_at`, siteID)
+}
+
+func (r *PostgresRepo) queryWebhooks(ctx context.Context, query string, args ...any) ([]Webhook, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.TenantID, &w.URL, &w.Secret, pq.Array(&w.EventTypes), &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		secret, err := r.cipher.openString(w.TenantID, w.Secret)
+		if err != nil {
+			return nil, err
+		}
+		w.Secret = secret
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
 // ============================================
 // Team Invitation Methods
 // ============================================
@@ -2160,24 +4557,82 @@ func (r *PostgresRepo) DeleteVXLANTunnel(ctx context.Context, tunnelID string) e
 // VM Network Attachment Methods
 
 func (r *PostgresRepo) AttachVMToNetwork(ctx context.Context, attachment VMNetworkAttachment) (VMNetworkAttachment, error) {
-	row := r.db.QueryRowContext(ctx, `
-INSERT INTO vm_network_attachments (id, vm_id, network_id, ip_address, mac_address)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING id, vm_id, network_id, ip_address, mac_address, created_at`,
-		attachment.ID, attachment.VMID, attachment.NetworkID, attachment.IPAddress, attachment.MACAddress,
-	)
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return VMNetworkAttachment{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the network serializes allocations from its CIDR.
+	var network VXLANNetwork
+	err = tx.QueryRowContext(ctx, `
+SELECT id, tenant_id, cidr::text, COALESCE(host(gateway), '')
+FROM vxlan_networks
+WHERE id = $1
+FOR UPDATE`, attachment.NetworkID).Scan(&network.ID, &network.TenantID, &network.CIDR, &network.Gateway)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return VMNetworkAttachment{}, ErrNotFound
+		}
+		return VMNetworkAttachment{}, err
+	}
+	rows, err := tx.QueryContext(ctx, `
+SELECT vm_id, COALESCE(host(ip_address), '')
+FROM vm_network_attachments
+WHERE network_id = $1`, attachment.NetworkID)
+	if err != nil {
+		return VMNetworkAttachment{}, err
+	}
+	var used []string
+	for rows.Next() {
+		var vmID, ip string
+		if err := rows.Scan(&vmID, &ip); err != nil {
+			rows.Close()
+			return VMNetworkAttachment{}, err
+		}
+		if vmID == attachment.VMID {
+			rows.Close()
+			return VMNetworkAttachment{}, ErrConflict
+		}
+		used = append(used, ip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return VMNetworkAttachment{}, err
+	}
+	ip, err := allocateAddress(network, attachment.IPAddress, used)
+	if err != nil {
+		return VMNetworkAttachment{}, err
+	}
+
 	var out VMNetworkAttachment
-	if err := row.Scan(&out.ID, &out.VMID, &out.NetworkID, &out.IPAddress, &out.MACAddress, &out.CreatedAt); err != nil {
+	err = tx.QueryRowContext(ctx, `
+INSERT INTO vm_network_attachments (id, vm_id, network_id, ip_address, mac_address)
+VALUES ($1, $2, $3, $4, NULLIF($5, '')::macaddr)
+RETURNING id, vm_id, network_id, host(ip_address), COALESCE(mac_address::text, ''), created_at`,
+		attachment.ID, attachment.VMID, attachment.NetworkID, ip, attachment.MACAddress,
+	).Scan(&out.ID, &out.VMID, &out.NetworkID, &out.IPAddress, &out.MACAddress, &out.CreatedAt)
+	if err != nil {
 		if isUniqueViolation(err) {
 			return VMNetworkAttachment{}, ErrConflict
 		}
 		return VMNetworkAttachment{}, err
 	}
-	return out, nil
+	// A VM attached after its CREATE succeeded is registered right away.
+	if err := r.registerVMDNSTx(ctx, tx, network.TenantID, out.VMID, out.CreatedAt); err != nil {
+		return VMNetworkAttachment{}, err
+	}
+	return out, tx.Commit()
 }
 
 func (r *PostgresRepo) DetachVMFromNetwork(ctx context.Context, vmID, networkID string) error {
-	result, err := r.db.ExecContext(ctx, `
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
 DELETE FROM vm_network_attachments
 WHERE vm_id = $1 AND network_id = $2`, vmID, networkID)
 	if err != nil {
@@ -2187,7 +4642,32 @@ WHERE vm_id = $1 AND network_id = $2`, vmID, networkID)
 	if rowsAffected == 0 {
 		return ErrNotFound
 	}
-	return nil
+	if _, err := tx.ExecContext(ctx, `DELETE FROM vm_dns_records WHERE vm_id = $1 AND network_id = $2`, vmID, networkID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresRepo) ListVMDNSRecords(ctx context.Context, siteID, networkID string) ([]VMDNSRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT network_id::text, site_id::text, vm_id::text, hostname, host(ip_address), created_at
+FROM vm_dns_records
+WHERE ($1 = '' OR site_id::text = $1) AND ($2 = '' OR network_id::text = $2)
+ORDER BY network_id, hostname`, siteID, networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []VMDNSRecord{}
+	for rows.Next() {
+		var rec VMDNSRecord
+		if err := rows.Scan(&rec.NetworkID, &rec.SiteID, &rec.VMID, &rec.Hostname, &rec.IPAddress, &rec.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
 }
 
 func (r *PostgresRepo) ListVMNetworkAttachments(ctx context.Context, vmID string) ([]VMNetworkAttachment, error) {
@@ -2212,6 +4692,39 @@ ORDER BY a.created_at DESC`, vmID)
 	return attachments, rows.Err()
 }
 
+func (r *PostgresRepo) ListVMNetworks(ctx context.Context, tenantID, vmID string) ([]VMNetworkAttachmentWithNetwork, error) {
+	var exists bool
+	if err := r.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM microvms WHERE id = $1 AND tenant_id = $2)`, vmID, tenantID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+SELECT a.id, a.vm_id, a.network_id, COALESCE(host(a.ip_address), ''), COALESCE(a.mac_address::text, ''), a.created_at,
+       n.name, n.vni, n.cidr::text, COALESCE(host(n.gateway), ''), COALESCE(n.mtu, 0)
+FROM vm_network_attachments a
+JOIN vxlan_networks n ON n.id = a.network_id
+WHERE a.vm_id = $1 AND n.tenant_id = $2
+ORDER BY a.created_at DESC`, vmID, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []VMNetworkAttachmentWithNetwork{}
+	for rows.Next() {
+		var a VMNetworkAttachmentWithNetwork
+		if err := rows.Scan(&a.ID, &a.VMID, &a.NetworkID, &a.IPAddress, &a.MACAddress, &a.CreatedAt,
+			&a.NetworkName, &a.VNI, &a.CIDR, &a.Gateway, &a.MTU); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
 func (r *PostgresRepo) ListNetworkVMAttachments(ctx context.Context, networkID string) ([]VMNetworkAttachment, error) {
 	rows, err := r.db.QueryContext(ctx, `
 SELECT a.id, a.vm_id, a.network_id, a.ip_address, a.mac_address, a.created_at
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Statement timeout and slow query defaults
+const (
+	// DefaultStatementTimeout is the server-side limit on a single
+	// statement, so a pathological query is cancelled by Postgres even
+	// when the caller's context has no deadline.
+	DefaultStatementTimeout = LongQueryTimeout
+	// DefaultSlowQueryThreshold is the duration above which a query is
+	// logged as slow.
+	DefaultSlowQueryThreshold = 500 * time.Millisecond
+	// slowQueryTextLimit bounds the logged query text.
+	slowQueryTextLimit = 300
+)
+
+// OpenPostgres opens a Postgres connection pool whose sessions run with
+// statement_timeout set from DB_STATEMENT_TIMEOUT and which logs queries
+// slower than DB_SLOW_QUERY_THRESHOLD. Either set to 0 turns it off.
+func OpenPostgres(dsn string) (*sql.DB, error) {
+	dsn, err := withStatementTimeout(dsn, envDurationAllowZero("DB_STATEMENT_TIMEOUT", DefaultStatementTimeout))
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	threshold := envDurationAllowZero("DB_SLOW_QUERY_THRESHOLD", DefaultSlowQueryThreshold)
+	if threshold <= 0 {
+		return sql.OpenDB(connector), nil
+	}
+	return sql.OpenDB(newSlowQueryConnector(connector, threshold, log.Printf)), nil
+}
+
+// envDurationAllowZero is getEnvDuration for settings where 0 disables
+// the feature.
+func envDurationAllowZero(key string, defaultVal time.Duration) time.Duration {
+	if val := os.Getenv(key); val != "" {
+		if val == "0" {
+			return 0
+		}
+		if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return defaultVal
+}
+
+// withStatementTimeout adds statement_timeout to a URL or key=value DSN;
+// lib/pq sends it to the server as a run-time parameter of each session.
+func withStatementTimeout(dsn string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dsn, nil
+	}
+	ms := strconv.FormatInt(timeout.Milliseconds(), 10)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("parse database url: %w", err)
+		}
+		q := u.Query()
+		q.Set("statement_timeout", ms)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	return strings.TrimSpace(dsn + " statement_timeout=" + ms), nil
+}
+
+// slowQueryConnector wraps a driver connector to time queries and
+// statements run on its connections. Only the SQL text is logged, never
+// the arguments, which may hold secrets.
+type slowQueryConnector struct {
+	driver.Connector
+	threshold time.Duration
+	logf      func(format string, args ...any)
+}
+
+func newSlowQueryConnector(c driver.Connector, threshold time.Duration, logf func(format string, args ...any)) *slowQueryConnector {
+	return &slowQueryConnector{Connector: c, threshold: threshold, logf: logf}
+}
+
+func (c *slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryConn{Conn: conn, c: c}, nil
+}
+
+func (c *slowQueryConnector) observe(query string, start time.Time) {
+	if d := time.Since(start); d >= c.threshold {
+		c.logf("slow query (%s): %s", d.Round(time.Millisecond), slowQueryText(query))
+	}
+}
+
+// slowQueryText collapses whitespace and truncates a query for logging.
+func slowQueryText(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > slowQueryTextLimit {
+		query = query[:slowQueryTextLimit] + "..."
+	}
+	return query
+}
+
+type slowQueryConn struct {
+	driver.Conn
+	c *slowQueryConnector
+}
+
+func (sc *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := sc.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer sc.c.observe(query, time.Now())
+	return q.QueryContext(ctx, query, args)
+}
+
+func (sc *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := sc.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer sc.c.observe(query, time.Now())
+	return e.ExecContext(ctx, query, args)
+}
+
+func (sc *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := sc.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return sc.Conn.Begin()
+}
+
+func (sc *slowQueryConn) Ping(ctx context.Context) error {
+	if p, ok := sc.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sleepDriver runs no SQL; a query containing pg_sleep takes 50ms.
+type sleepDriver struct{}
+
+func (sleepDriver) Open(string) (driver.Conn, error) { return sleepConn{}, nil }
+
+type sleepConnector struct{}
+
+func (sleepConnector) Connect(context.Context) (driver.Conn, error) { return sleepConn{}, nil }
+func (sleepConnector) Driver() driver.Driver                        { return sleepDriver{} }
+
+type sleepConn struct{}
+
+func (sleepConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (sleepConn) Close() error                        { return nil }
+func (sleepConn) Begin() (driver.Tx, error)           { return nil, fmt.Errorf("not supported") }
+
+func (sleepConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "pg_sleep") {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string         { return []string{"x"} }
+func (emptyRows) Close() error              { return nil }
+func (emptyRows) Next([]driver.Value) error { return io.EOF }
+
+func TestSlowQueryLogging(t *testing.T) {
+	var mu sync.Mutex
+	var logged []string
+	logf := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	db := sql.OpenDB(newSlowQueryConnector(sleepConnector{}, 20*time.Millisecond, logf))
+	defer db.Close()
+
+	ctx := context.Background()
+	for _, q := range []string{
+		"SELECT 1 WHERE id = $1",
+		"SELECT pg_sleep(0.05)\n  WHERE token_hash = $1",
+	} {
+		rows, err := db.QueryContext(ctx, q, "secret-token")
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		rows.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(logged) != 1 {
+		t.Fatalf("expected only the slow query to be logged, got %q", logged)
+	}
+	if !strings.Contains(logged[0], "slow query") || !strings.Contains(logged[0], "SELECT pg_sleep(0.05) WHERE token_hash = $1") {
+		t.Fatalf("unexpected log line: %q", logged[0])
+	}
+	if strings.Contains(logged[0], "secret-token") {
+		t.Fatalf("query arguments must not be logged: %q", logged[0])
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	got, err := withStatementTimeout("postgres://u:p@localhost:5432/nkudo?sslmode=disable", 5*time.Second)
+	if err != nil {
+		t.Fatalf("url dsn: %v", err)
+	}
+	if !strings.Contains(got, "statement_timeout=5000") || !strings.Contains(got, "sslmode=disable") {
+		t.Fatalf("unexpected url dsn: %s", got)
+	}
+	got, err = withStatementTimeout("host=localhost dbname=nkudo", 1500*time.Millisecond)
+	if err != nil || got != "host=localhost dbname=nkudo statement_timeout=1500" {
+		t.Fatalf("unexpected key=value dsn: %q, %v", got, err)
+	}
+	if got, _ := withStatementTimeout("host=localhost", 0); got != "host=localhost" {
+		t.Fatalf("expected a zero timeout to leave the dsn alone, got %q", got)
+	}
+}
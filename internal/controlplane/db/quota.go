@@ -0,0 +1,42 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// DefaultQuotaLimits are the limits of a tenant with neither its own limits
+// nor a quota template.
+var DefaultQuotaLimits = QuotaLimits{
+	MaxSites:           10,
+	MaxAgentsPerSite:   100,
+	MaxVMsPerAgent:     50,
+	MaxConcurrentPlans: 100,
+	MaxAPIKeys:         20,
+}
+
+// QuotaTemplate is a named set of quota limits, such as "small" or
+// "enterprise", that tenants reference at creation. A tenant's limits
+// follow its template until limits are set for the tenant directly.
+type QuotaTemplate struct {
+	Name      string      `json:"name"`
+	Limits    QuotaLimits `json:"limits"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+var quotaTemplateNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidateQuotaTemplate checks the template name and that no limit is
+// negative.
+func ValidateQuotaTemplate(t QuotaTemplate) error {
+	if !quotaTemplateNameRE.MatchString(t.Name) {
+		return fmt.Errorf("%w: name must be lowercase letters, digits and dashes", ErrInvalidQuotaTemplate)
+	}
+	l := t.Limits
+	if l.MaxSites < 0 || l.MaxAgentsPerSite < 0 || l.MaxVMsPerAgent < 0 || l.MaxConcurrentPlans < 0 || l.MaxAPIKeys < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidQuotaTemplate)
+	}
+	return nil
+}
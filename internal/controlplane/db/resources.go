@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResolveResources fills in the resource requests and limits of CREATE
+// actions. A missing request falls back to the legacy vcpu_count/memory_mib
+// value, then to the limit; a missing limit defaults to the request. The
+// VM itself is sized by the limit, which is also written back to
+// VCPUCount/MemoryMiB. A request above its limit is an error wrapping
+// ErrInvalidResources.
+func ResolveResources(actions []ApplyPlanAction) ([]ApplyPlanAction, error) {
+	out := make([]ApplyPlanAction, len(actions))
+	for i, action := range actions {
+		if strings.EqualFold(strings.TrimSpace(action.Operation), "CREATE") {
+			resolved, err := resolveActionResources(action)
+			if err != nil {
+				return nil, fmt.Errorf("action %s: %w", actionLabel(action, i), err)
+			}
+			action = resolved
+		}
+		out[i] = action
+	}
+	return out, nil
+}
+
+func resolveActionResources(action ApplyPlanAction) (ApplyPlanAction, error) {
+	if action.VCPUCount < 0 || action.VCPURequest < 0 || action.VCPULimit < 0 {
+		return action, fmt.Errorf("%w: vcpu values must not be negative", ErrInvalidResources)
+	}
+	if action.MemoryMiB < 0 || action.MemoryRequestMiB < 0 || action.MemoryLimitMiB < 0 {
+		return action, fmt.Errorf("%w: memory values must not be negative", ErrInvalidResources)
+	}
+
+	action.VCPURequest = firstPositive(action.VCPURequest, action.VCPUCount, action.VCPULimit)
+	action.VCPULimit = firstPositive(action.VCPULimit, action.VCPURequest)
+	if action.VCPURequest > action.VCPULimit {
+		return action, fmt.Errorf("%w: vcpu_request %d exceeds vcpu_limit %d", ErrInvalidResources, action.VCPURequest, action.VCPULimit)
+	}
+	action.VCPUCount = action.VCPULimit
+
+	action.MemoryRequestMiB = firstPositive(action.MemoryRequestMiB, action.MemoryMiB, action.MemoryLimitMiB)
+	action.MemoryLimitMiB = firstPositive(action.MemoryLimitMiB, action.MemoryRequestMiB)
+	if action.MemoryRequestMiB > action.MemoryLimitMiB {
+		return action, fmt.Errorf("%w: memory_request %d exceeds memory_limit %d", ErrInvalidResources, action.MemoryRequestMiB, action.MemoryLimitMiB)
+	}
+	action.MemoryMiB = action.MemoryLimitMiB
+	return action, nil
+}
+
+func actionLabel(action ApplyPlanAction, index int) string {
+	if action.OperationID != "" {
+		return action.OperationID
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+func firstPositive[T int | int64](values ...T) T {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestResolveResourcesDefaults(t *testing.T) {
+	actions, err := ResolveResources([]ApplyPlanAction{
+		{OperationID: "legacy", Operation: "CREATE", VCPUCount: 2, MemoryMiB: 512},
+		{OperationID: "request-only", Operation: "create", VCPURequest: 1, MemoryRequestMiB: 256},
+		{OperationID: "burstable", Operation: "CREATE", VCPURequest: 1, VCPULimit: 4, MemoryRequestMiB: 256, MemoryLimitMiB: 1024},
+		{OperationID: "stop", Operation: "STOP", VMID: "vm-1"},
+	})
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	tests := []struct {
+		idx                    int
+		vcpuRequest, vcpuLimit int
+		memRequest, memLimit   int64
+		wantVCPUCount          int
+		wantMemoryMiB          int64
+	}{
+		{0, 2, 2, 512, 512, 2, 512},
+		{1, 1, 1, 256, 256, 1, 256},
+		{2, 1, 4, 256, 1024, 4, 1024},
+		{3, 0, 0, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		got := actions[tt.idx]
+		if got.VCPURequest != tt.vcpuRequest || got.VCPULimit != tt.vcpuLimit ||
+			got.MemoryRequestMiB != tt.memRequest || got.MemoryLimitMiB != tt.memLimit {
+			t.Errorf("%s: requests/limits = %d/%d %d/%d, want %d/%d %d/%d", got.OperationID,
+				got.VCPURequest, got.VCPULimit, got.MemoryRequestMiB, got.MemoryLimitMiB,
+				tt.vcpuRequest, tt.vcpuLimit, tt.memRequest, tt.memLimit)
+		}
+		if got.VCPUCount != tt.wantVCPUCount || got.MemoryMiB != tt.wantMemoryMiB {
+			t.Errorf("%s: size = %d vcpu/%d MiB, want %d/%d", got.OperationID, got.VCPUCount, got.MemoryMiB, tt.wantVCPUCount, tt.wantMemoryMiB)
+		}
+	}
+}
+
+func TestResolveResourcesRejectsInvalid(t *testing.T) {
+	tests := []ApplyPlanAction{
+		{Operation: "CREATE", VCPURequest: 4, VCPULimit: 2},
+		{Operation: "CREATE", MemoryRequestMiB: 2048, MemoryLimitMiB: 1024},
+		{Operation: "CREATE", VCPUCount: 4, VCPULimit: 2},
+		{Operation: "CREATE", VCPURequest: -1},
+	}
+	for _, action := range tests {
+		if _, err := ResolveResources([]ApplyPlanAction{action}); !errors.Is(err, ErrInvalidResources) {
+			t.Errorf("ResolveResources(%+v) error = %v, want ErrInvalidResources", action, err)
+		}
+	}
+}
+
+func TestMemoryRepoCapacityUsesRequests(t *testing.T) {
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+
+	_, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "burstable",
+		Actions: []ApplyPlanAction{
+			{OperationID: "create-1", Operation: "CREATE", VMID: "vm-1", Name: "vm-1", VCPURequest: 1, VCPULimit: 4, MemoryRequestMiB: 256, MemoryLimitMiB: 1024},
+		},
+	})
+	if err != nil {
+		t.Fatalf("apply plan: %v", err)
+	}
+
+	vms, err := repo.ListVMs(ctx, tenantID, siteID)
+	if err != nil {
+		t.Fatalf("list vms: %v", err)
+	}
+	if len(vms) != 1 || vms[0].VCPUCount != 4 || vms[0].MemoryMiB != 1024 || vms[0].VCPURequest != 1 || vms[0].MemoryLimitMiB != 1024 {
+		t.Fatalf("unexpected vms: %+v", vms)
+	}
+
+	capacity, err := repo.GetCapacity(ctx, tenantID, siteID)
+	if err != nil {
+		t.Fatalf("capacity: %v", err)
+	}
+	if capacity.VCPUUsed != 1 || capacity.MemoryBytesUsed != 256*1024*1024 {
+		t.Fatalf("capacity should count requests, got %+v", capacity)
+	}
+
+	_, err = repo.ApplyPlan(ctx, ApplyPlanInput{
+		TenantID:       tenantID,
+		SiteID:         siteID,
+		IdempotencyKey: "invalid",
+		Actions:        []ApplyPlanAction{{Operation: "CREATE", VMID: "vm-2", VCPURequest: 2, VCPULimit: 1}},
+	})
+	if !errors.Is(err, ErrInvalidResources) {
+		t.Fatalf("expected ErrInvalidResources, got %v", err)
+	}
+}
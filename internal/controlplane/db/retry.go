@@ -0,0 +1,56 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// retryPlanInput builds the ApplyPlanInput that re-drives a failed plan
+// from its persisted actions, whose payloads must have their file contents
+// resolved. Each action keeps the VM ID and name it was given when the
+// plan was applied, so retrying a CREATE targets the same VM. With
+// failedOnly set only the actions whose executions failed are kept;
+// actions are matched to executions by operation_id. The idempotency key
+// is derived from the original plan so retrying the same plan twice
+// returns the first retry.
+func retryPlanInput(plan Plan, planActions []PlanAction, execs []Execution, failedOnly bool) (ApplyPlanInput, error) {
+	if plan.Status != "FAILED" {
+		return ApplyPlanInput{}, ErrPlanNotFailed
+	}
+
+	byOperationID := make(map[string]Execution, len(execs))
+	for _, e := range execs {
+		byOperationID[e.OperationID] = e
+	}
+
+	out := make([]ApplyPlanAction, 0, len(planActions))
+	for _, pa := range planActions {
+		exec, ok := byOperationID[pa.OperationID]
+		if failedOnly && (!ok || exec.State != "FAILED") {
+			continue
+		}
+		var action ApplyPlanAction
+		if err := json.Unmarshal(pa.PayloadJSON, &action); err != nil {
+			return ApplyPlanInput{}, fmt.Errorf("decode plan action %s: %w", pa.OperationID, err)
+		}
+		// Target the VM the original action was applied to.
+		action.VMID = pa.VMID
+		out = append(out, action)
+	}
+	if len(out) == 0 {
+		return ApplyPlanInput{}, fmt.Errorf("%w: no failed actions to retry", ErrPlanNotFailed)
+	}
+
+	key := plan.IdempotencyKey + ":retry"
+	if failedOnly {
+		key += "-failed"
+	}
+	return ApplyPlanInput{
+		TenantID:       plan.TenantID,
+		SiteID:         plan.SiteID,
+		IdempotencyKey: key,
+		RetriedFrom:    plan.ID,
+		Sequential:     plan.Sequential,
+		Actions:        out,
+	}, nil
+}
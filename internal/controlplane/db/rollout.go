@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Agent upgrade states. An agent is SIGNALED when a heartbeat response first
+// tells it to move to the target version, and SUCCEEDED or FAILED once it
+// reports the outcome of its upgrade hook or heartbeats with the target.
+const (
+	AgentUpgradeSignaled  = "SIGNALED"
+	AgentUpgradeSucceeded = "SUCCEEDED"
+	AgentUpgradeFailed    = "FAILED"
+)
+
+// DefaultRolloutCanaryCount is the number of agents upgraded first when a
+// rollout does not set one.
+const DefaultRolloutCanaryCount = 1
+
+// AgentRollout is the agent version a site should run and how quickly its
+// agents are moved to it.
+type AgentRollout struct {
+	TargetVersion string `json:"target_version"`
+	// CanaryCount agents upgrade first; the others are held back until that
+	// many agents report the target version.
+	CanaryCount int `json:"canary_count"`
+	// MaxInFlight bounds the agents upgrading at once after the canaries; 0
+	// lets every remaining agent go.
+	MaxInFlight int       `json:"max_in_flight"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// AgentUpgrade is the latest upgrade an agent was signaled for.
+type AgentUpgrade struct {
+	AgentID       string    `json:"agent_id"`
+	SiteID        string    `json:"site_id"`
+	FromVersion   string    `json:"from_version"`
+	TargetVersion string    `json:"target_version"`
+	State         string    `json:"state"`
+	Message       string    `json:"message,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// AgentUpgradeReport is an agent's outcome of running its upgrade hook.
+type AgentUpgradeReport struct {
+	TargetVersion string
+	OK            bool
+	Message       string
+}
+
+// ValidateAgentRollout trims and checks a rollout, filling defaults. An
+// empty target version clears the rollout.
+func ValidateAgentRollout(r AgentRollout) (AgentRollout, error) {
+	r.TargetVersion = strings.TrimSpace(r.TargetVersion)
+	if len(r.TargetVersion) > 128 {
+		return AgentRollout{}, fmt.Errorf("target_version must be at most 128 characters")
+	}
+	if r.CanaryCount < 0 || r.MaxInFlight < 0 {
+		return AgentRollout{}, fmt.Errorf("canary_count and max_in_flight must not be negative")
+	}
+	if r.CanaryCount == 0 {
+		r.CanaryCount = DefaultRolloutCanaryCount
+	}
+	return r, nil
+}
+
+// RolloutHalted reports whether an agent failed to upgrade to the rollout's
+// target, which stops further agents from being signaled.
+func RolloutHalted(rollout AgentRollout, upgrades map[string]AgentUpgrade) bool {
+	for _, u := range upgrades {
+		if u.TargetVersion == rollout.TargetVersion && u.State == AgentUpgradeFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldSignalUpgrade decides whether agentID, running version, is told to
+// upgrade to the rollout's target. versions holds the last reported version
+// of every agent in the site and upgrades their latest upgrade records.
+//
+// An agent already signaled for the target keeps being signaled until it
+// runs it. Otherwise a new agent is signaled only while the rollout is not
+// halted and the agents still upgrading stay under the current limit:
+// CanaryCount minus the agents already on the target while the canaries
+// are out, MaxInFlight afterwards.
+func ShouldSignalUpgrade(rollout AgentRollout, agentID, version string, versions map[string]string, upgrades map[string]AgentUpgrade) bool {
+	target := rollout.TargetVersion
+	if target == "" || version == target {
+		return false
+	}
+	if u, ok := upgrades[agentID]; ok && u.TargetVersion == target {
+		return u.State == AgentUpgradeSignaled
+	}
+	if RolloutHalted(rollout, upgrades) {
+		return false
+	}
+	upgraded, inFlight := 0, 0
+	for id, v := range versions {
+		if v == target {
+			upgraded++
+			continue
+		}
+		if u, ok := upgrades[id]; ok && u.TargetVersion == target && u.State != AgentUpgradeFailed {
+			inFlight++
+		}
+	}
+	canaries := max(rollout.CanaryCount, 1)
+	switch {
+	case upgraded < canaries:
+		return inFlight < canaries-upgraded
+	case rollout.MaxInFlight > 0:
+		return inFlight < rollout.MaxInFlight
+	}
+	return true
+}
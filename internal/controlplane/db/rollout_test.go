@@ -0,0 +1,120 @@
+package store
+
+import "testing"
+
+func TestShouldSignalUpgrade(t *testing.T) {
+	rollout := AgentRollout{TargetVersion: "2.0", CanaryCount: 1, MaxInFlight: 2}
+	signaled := func(id string) AgentUpgrade {
+		return AgentUpgrade{AgentID: id, TargetVersion: "2.0", State: AgentUpgradeSignaled}
+	}
+	failed := func(id string) AgentUpgrade {
+		return AgentUpgrade{AgentID: id, TargetVersion: "2.0", State: AgentUpgradeFailed}
+	}
+	tests := []struct {
+		name     string
+		rollout  AgentRollout
+		agent    string
+		versions map[string]string
+		upgrades map[string]AgentUpgrade
+		want     bool
+	}{
+		{
+			name:     "no target",
+			rollout:  AgentRollout{},
+			agent:    "a",
+			versions: map[string]string{"a": "1.0"},
+			want:     false,
+		},
+		{
+			name:     "already on target",
+			rollout:  rollout,
+			agent:    "a",
+			versions: map[string]string{"a": "2.0"},
+			want:     false,
+		},
+		{
+			name:     "first canary",
+			rollout:  rollout,
+			agent:    "a",
+			versions: map[string]string{"a": "1.0", "b": "1.0", "c": "1.0"},
+			want:     true,
+		},
+		{
+			name:     "waits for canary",
+			rollout:  rollout,
+			agent:    "b",
+			versions: map[string]string{"a": "1.0", "b": "1.0", "c": "1.0"},
+			upgrades: map[string]AgentUpgrade{"a": signaled("a")},
+			want:     false,
+		},
+		{
+			name:     "signaled agent is signaled again",
+			rollout:  rollout,
+			agent:    "a",
+			versions: map[string]string{"a": "1.0", "b": "1.0"},
+			upgrades: map[string]AgentUpgrade{"a": signaled("a"), "b": failed("b")},
+			want:     true,
+		},
+		{
+			name:     "after canary up to max in flight",
+			rollout:  rollout,
+			agent:    "c",
+			versions: map[string]string{"a": "2.0", "b": "1.0", "c": "1.0", "d": "1.0"},
+			upgrades: map[string]AgentUpgrade{"b": signaled("b")},
+			want:     true,
+		},
+		{
+			name:     "max in flight reached",
+			rollout:  rollout,
+			agent:    "d",
+			versions: map[string]string{"a": "2.0", "b": "1.0", "c": "1.0", "d": "1.0"},
+			upgrades: map[string]AgentUpgrade{"b": signaled("b"), "c": signaled("c")},
+			want:     false,
+		},
+		{
+			name:     "unbounded after canary",
+			rollout:  AgentRollout{TargetVersion: "2.0", CanaryCount: 1},
+			agent:    "d",
+			versions: map[string]string{"a": "2.0", "b": "1.0", "c": "1.0", "d": "1.0"},
+			upgrades: map[string]AgentUpgrade{"b": signaled("b"), "c": signaled("c")},
+			want:     true,
+		},
+		{
+			name:     "failure halts rollout",
+			rollout:  rollout,
+			agent:    "c",
+			versions: map[string]string{"a": "2.0", "b": "1.0", "c": "1.0"},
+			upgrades: map[string]AgentUpgrade{"b": failed("b")},
+			want:     false,
+		},
+		{
+			name:     "failure for an older target does not halt",
+			rollout:  rollout,
+			agent:    "c",
+			versions: map[string]string{"a": "2.0", "b": "1.0", "c": "1.0"},
+			upgrades: map[string]AgentUpgrade{"b": {AgentID: "b", TargetVersion: "1.5", State: AgentUpgradeFailed}},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.versions[tt.agent]
+			if got := ShouldSignalUpgrade(tt.rollout, tt.agent, version, tt.versions, tt.upgrades); got != tt.want {
+				t.Fatalf("ShouldSignalUpgrade() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAgentRollout(t *testing.T) {
+	r, err := ValidateAgentRollout(AgentRollout{TargetVersion: " 2.0 "})
+	if err != nil {
+		t.Fatalf("ValidateAgentRollout: %v", err)
+	}
+	if r.TargetVersion != "2.0" || r.CanaryCount != DefaultRolloutCanaryCount {
+		t.Fatalf("unexpected rollout %+v", r)
+	}
+	if _, err := ValidateAgentRollout(AgentRollout{TargetVersion: "2.0", CanaryCount: -1}); err == nil {
+		t.Fatal("expected error for negative canary_count")
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// scopeOperations are the plan operations an AgentScope can allow.
+var scopeOperations = []string{"CREATE", "START", "STOP", "DELETE", "MIGRATE"}
+
+// AgentScope limits what an agent may run. It is recorded on an enrollment
+// token when the token is issued and copied to the agent that enrolls with
+// it; an agent without a scope runs any plan of its site.
+type AgentScope struct {
+	// Operations lists the plan operations the agent may run; empty
+	// allows all of them.
+	Operations []string `json:"operations,omitempty"`
+	// MaxVMs caps the VMs on the agent's host: plans whose CREATEs would
+	// exceed it are left to other agents. Zero is unlimited.
+	MaxVMs int `json:"max_vms,omitempty"`
+}
+
+// NormalizeAgentScope validates s and returns it with upper-cased,
+// deduplicated operations. A nil or empty scope normalizes to nil.
+func NormalizeAgentScope(s *AgentScope) (*AgentScope, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if s.MaxVMs < 0 {
+		return nil, fmt.Errorf("max_vms must not be negative")
+	}
+	var ops []string
+	for _, op := range s.Operations {
+		op = strings.ToUpper(strings.TrimSpace(op))
+		if !slices.Contains(scopeOperations, op) {
+			return nil, fmt.Errorf("unknown operation %q; allowed: %s", op, strings.Join(scopeOperations, ", "))
+		}
+		if !slices.Contains(ops, op) {
+			ops = append(ops, op)
+		}
+	}
+	if len(ops) == 0 && s.MaxVMs == 0 {
+		return nil, nil
+	}
+	return &AgentScope{Operations: ops, MaxVMs: s.MaxVMs}, nil
+}
+
+// AllowsOperation reports whether the scope lets the agent run op.
+func (s *AgentScope) AllowsOperation(op string) bool {
+	if s == nil || len(s.Operations) == 0 {
+		return true
+	}
+	return slices.Contains(s.Operations, strings.ToUpper(op))
+}
+
+// allowsOperations reports whether the scope lets the agent run every
+// operation in ops.
+func (s *AgentScope) allowsOperations(ops []string) bool {
+	for _, op := range ops {
+		if !s.AllowsOperation(op) {
+			return false
+		}
+	}
+	return true
+}
+
+// fitsVMs reports whether the agent's host may hold hostVMs VMs.
+func (s *AgentScope) fitsVMs(hostVMs int) bool {
+	return s == nil || s.MaxVMs == 0 || hostVMs <= s.MaxVMs
+}
+
+// countCreates returns how many of ops are CREATEs.
+func countCreates(ops []string) int {
+	creates := 0
+	for _, op := range ops {
+		if strings.EqualFold(op, "CREATE") {
+			creates++
+		}
+	}
+	return creates
+}
+
+// scopeJSON encodes s for a JSONB column; a nil scope is NULL.
+func scopeJSON(s *AgentScope) any {
+	if s == nil {
+		return nil
+	}
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// scopeOperationsJSON encodes the operations of s as a JSONB array; NULL
+// allows all of them.
+func scopeOperationsJSON(s *AgentScope) any {
+	if s == nil || len(s.Operations) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(s.Operations)
+	return b
+}
+
+func scopeMaxVMs(s *AgentScope) int {
+	if s == nil {
+		return 0
+	}
+	return s.MaxVMs
+}
+
+// parseScopeJSON decodes a JSONB scope column; NULL is no scope.
+func parseScopeJSON(raw []byte) (*AgentScope, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var s AgentScope
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepoScopedAgentIsDeniedOutOfScopeOperations(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+
+	scope, err := NormalizeAgentScope(&AgentScope{Operations: []string{"create", "start", "CREATE"}, MaxVMs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.IssueEnrollmentToken(ctx, EnrollmentToken{ID: "tok-1", TenantID: tenantID, SiteID: siteID, TokenHash: "hash-1", ExpiresAt: time.Now().Add(time.Hour), Scope: scope}); err != nil {
+		t.Fatal(err)
+	}
+	consumed, err := repo.ConsumeEnrollmentToken(ctx, "hash-1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolled := newAgent(t, repo, tenantID, siteID, "scoped")
+	scoped := repo.agents[enrolled.ID]
+	scoped.Scope = consumed.Scope
+	repo.agents[enrolled.ID] = scoped
+
+	apply := func(key, op, vmID string) string {
+		t.Helper()
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: op, VMID: vmID, Name: vmID, VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		return applied.Plan.ID
+	}
+	leased := func(agentID string) []string {
+		t.Helper()
+		plans, err := repo.LeasePendingPlans(ctx, agentID, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, p := range plans {
+			ids = append(ids, p.PlanID)
+		}
+		return ids
+	}
+
+	stopPlan := apply("stop-1", "STOP", "vm-old")
+	createPlan := apply("create-1", "CREATE", "vm-1")
+	if got := leased(scoped.ID); len(got) != 1 || got[0] != createPlan {
+		t.Fatalf("expected the scoped agent to lease only the CREATE plan, got %v", got)
+	}
+
+	// A STOP result from the scoped agent is ignored.
+	if err := repo.ReportPlanResult(ctx, scoped.ID, PlanResultReport{
+		PlanID:  stopPlan,
+		Results: []PlanActionResultItem{{ActionID: "stop-1", OK: true, FinishedAt: time.Now().UTC()}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.planHasPendingExecutionsLocked(stopPlan) {
+		t.Fatal("expected the out-of-scope STOP to stay pending")
+	}
+
+	// Its host now runs max_vms VMs, so a second CREATE is left to others.
+	if err := repo.ReportPlanResult(ctx, scoped.ID, PlanResultReport{
+		PlanID:  createPlan,
+		Results: []PlanActionResultItem{{ActionID: "create-1", OK: true, FinishedAt: time.Now().UTC()}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	secondCreate := apply("create-2", "CREATE", "vm-2")
+	if got := leased(scoped.ID); len(got) != 0 {
+		t.Fatalf("expected the scoped agent at max_vms to lease nothing, got %v", got)
+	}
+
+	full := newAgent(t, repo, tenantID, siteID, "full")
+	if got := leased(full.ID); len(got) != 2 {
+		t.Fatalf("expected an unscoped agent to lease the STOP and the second CREATE, got %v (stop %s, create %s)", got, stopPlan, secondCreate)
+	}
+}
+
+func TestMemoryRepoMaxVMsCountsCreatesLeasedTogether(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	enrolled := newAgent(t, repo, tenantID, siteID, "scoped")
+	scoped := repo.agents[enrolled.ID]
+	scoped.Scope = &AgentScope{MaxVMs: 1}
+	repo.agents[enrolled.ID] = scoped
+
+	for _, key := range []string{"create-a", "create-b"} {
+		if _, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: "CREATE", VMID: key, Name: key, VCPUCount: 1, MemoryMiB: 128}},
+		}); err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	plans, err := repo.LeasePendingPlans(ctx, scoped.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 {
+		t.Fatalf("expected one CREATE plan under max_vms=1, got %d", len(plans))
+	}
+	first := plans[0].PlanID
+
+	// The held CREATE is still in progress, so the second stays queued while
+	// the first lease can be renewed.
+	plans, err = repo.LeasePendingPlans(ctx, scoped.ID, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 || plans[0].PlanID != first {
+		t.Fatalf("expected only the held plan %s to be renewed, got %+v", first, plans)
+	}
+}
+
+func TestNormalizeAgentScope(t *testing.T) {
+	if s, err := NormalizeAgentScope(&AgentScope{}); err != nil || s != nil {
+		t.Fatalf("expected an empty scope to normalize to nil, got %+v, %v", s, err)
+	}
+	if _, err := NormalizeAgentScope(&AgentScope{Operations: []string{"REBOOT"}}); err == nil {
+		t.Fatal("expected an unknown operation to be rejected")
+	}
+	if _, err := NormalizeAgentScope(&AgentScope{MaxVMs: -1}); err == nil {
+		t.Fatal("expected a negative max_vms to be rejected")
+	}
+	var unscoped *AgentScope
+	if !unscoped.AllowsOperation("DELETE") {
+		t.Fatal("expected a nil scope to allow every operation")
+	}
+}
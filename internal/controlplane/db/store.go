@@ -2,17 +2,22 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
 type Tenant struct {
-	ID            string    `json:"id"`
-	Slug          string    `json:"slug"`
-	Name          string    `json:"name"`
-	PrimaryRegion string    `json:"primary_region"`
-	RetentionDays int       `json:"data_retention_days"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID             string    `json:"id"`
+	Slug           string    `json:"slug"`
+	Name           string    `json:"name"`
+	PrimaryRegion  string    `json:"primary_region"`
+	RetentionDays  int       `json:"data_retention_days"`
+	QuotaTemplate  string    `json:"quota_template,omitempty"`   // limits fall back to this template
+	MinLogSeverity string    `json:"min_log_severity,omitempty"` // log entries below it are filtered at ingest
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
 }
 
 // User represents a tenant user with authentication
@@ -39,22 +44,32 @@ type Site struct {
 	LocationCountry   string     `json:"location_country_code,omitempty"`
 	ConnectivityState string     `json:"connectivity_state"`
 	LastHeartbeatAt   *time.Time `json:"last_heartbeat_at,omitempty"`
-	CreatedAt         time.Time  `json:"created_at"`
+	// UniqueVMNames makes ApplyPlan reject a CREATE whose name is already
+	// used by a VM of the site.
+	UniqueVMNames bool `json:"unique_vm_names"`
+	// NameTemplate names CREATE actions that omit a name in plans that do
+	// not bring their own template.
+	NameTemplate string    `json:"vm_name_template,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type Host struct {
-	ID                       string     `json:"id"`
-	TenantID                 string     `json:"tenant_id"`
-	SiteID                   string     `json:"site_id"`
-	Hostname                 string     `json:"hostname"`
-	CPUCoresTotal            int        `json:"cpu_cores_total"`
-	MemoryBytesTotal         int64      `json:"memory_bytes_total"`
-	StorageBytesTotal        int64      `json:"storage_bytes_total"`
-	KVMAvailable             bool       `json:"kvm_available"`
-	CloudHypervisorAvailable bool       `json:"cloud_hypervisor_available"`
-	LastFactsAt              *time.Time `json:"last_facts_at,omitempty"`
-	AgentState               string     `json:"agent_state,omitempty"`
-	AgentLastHeartbeatAt     *time.Time `json:"agent_last_heartbeat_at,omitempty"`
+	ID                       string          `json:"id"`
+	TenantID                 string          `json:"tenant_id"`
+	SiteID                   string          `json:"site_id"`
+	Hostname                 string          `json:"hostname"`
+	CPUCoresTotal            int             `json:"cpu_cores_total"`
+	MemoryBytesTotal         int64           `json:"memory_bytes_total"`
+	StorageBytesTotal        int64           `json:"storage_bytes_total"`
+	KVMAvailable             bool            `json:"kvm_available"`
+	CloudHypervisorAvailable bool            `json:"cloud_hypervisor_available"`
+	LastFactsAt              *time.Time      `json:"last_facts_at,omitempty"`
+	FactsDegraded            bool            `json:"facts_degraded"`
+	FactsError               string          `json:"facts_error,omitempty"`
+	Maintenance              bool            `json:"maintenance"`
+	AgentState               string          `json:"agent_state,omitempty"`
+	AgentLastHeartbeatAt     *time.Time      `json:"agent_last_heartbeat_at,omitempty"`
+	AgentMetadata            json.RawMessage `json:"agent_metadata,omitempty"`
 }
 
 type MicroVM struct {
@@ -66,8 +81,16 @@ type MicroVM struct {
 	State            string     `json:"state"`
 	VCPUCount        int        `json:"vcpu_count"`
 	MemoryMiB        int64      `json:"memory_mib"`
+	VCPURequest      int        `json:"vcpu_request,omitempty"`
+	VCPULimit        int        `json:"vcpu_limit,omitempty"`
+	MemoryRequestMiB int64      `json:"memory_request_mib,omitempty"`
+	MemoryLimitMiB   int64      `json:"memory_limit_mib,omitempty"`
 	LastTransitionAt *time.Time `json:"last_transition_at,omitempty"`
 	UpdatedAt        time.Time  `json:"updated_at"`
+	// LastPlanID and LastOperationID are the plan action whose success
+	// last changed the VM's state.
+	LastPlanID      string `json:"last_plan_id,omitempty"`
+	LastOperationID string `json:"last_operation_id,omitempty"`
 }
 
 type APIKey struct {
@@ -86,17 +109,22 @@ type EnrollmentToken struct {
 	SiteID    string
 	TokenHash string
 	ExpiresAt time.Time
+	// Scope is copied to the agent that enrolls with the token; nil
+	// enrolls a full agent.
+	Scope *AgentScope
 }
 
 type EnrollmentTokenWithStatus struct {
-	ID                string     `json:"id"`
-	SiteID            string     `json:"site_id"`
-	SiteName          string     `json:"site_name"`
-	CreatedAt         time.Time  `json:"created_at"`
-	ExpiresAt         time.Time  `json:"expires_at"`
-	Consumed          bool       `json:"consumed"`
-	ConsumedAt        *time.Time `json:"consumed_at,omitempty"`
-	ConsumedByAgentID *string    `json:"consumed_by_agent_id,omitempty"`
+	ID                string      `json:"id"`
+	SiteID            string      `json:"site_id"`
+	SiteName          string      `json:"site_name"`
+	CreatedAt         time.Time   `json:"created_at"`
+	ExpiresAt         time.Time   `json:"expires_at"`
+	Consumed          bool        `json:"consumed"`
+	ConsumedAt        *time.Time  `json:"consumed_at,omitempty"`
+	ConsumedByAgentID *string     `json:"consumed_by_agent_id,omitempty"`
+	Scope             *AgentScope `json:"scope,omitempty"`
+	TokenHash         string      `json:"-"`
 }
 
 type Agent struct {
@@ -112,19 +140,125 @@ type Agent struct {
 	KernelVersion    string
 	State            string
 	LastHeartbeatAt  *time.Time
+	MetricsAddr      string
+	// Metadata is set by operators (rack, datacenter, role), unlike the
+	// facts the agent reports in heartbeats.
+	Metadata json.RawMessage
+	// Bootstrap is what the agent sent when it enrolled; only
+	// CreateAgentFromEnrollment stores it.
+	Bootstrap *EnrollmentBootstrap
+	// Scope is the scope of the agent's enrollment token; nil is a full
+	// agent.
+	Scope *AgentScope
+}
+
+// EnrollmentBootstrap is what an agent reported when it enrolled.
+type EnrollmentBootstrap struct {
+	Hostname          string `json:"hostname"`
+	RequestedHostname string `json:"requested_hostname,omitempty"`
+	AgentVersion      string `json:"agent_version,omitempty"`
+	OS                string `json:"os,omitempty"`
+	Arch              string `json:"arch,omitempty"`
+	KernelVersion     string `json:"kernel_version,omitempty"`
+	BootstrapNonce    string `json:"bootstrap_nonce,omitempty"`
+	SchemaVersion     int    `json:"schema_version,omitempty"`
+	SourceIP          string `json:"source_ip,omitempty"`
+}
+
+// AgentEnrollment links an agent to the enrollment token it consumed.
+// TokenID is empty for agents whose token was deleted, and Bootstrap is
+// nil for agents enrolled before it was recorded.
+type AgentEnrollment struct {
+	AgentID         string               `json:"agent_id"`
+	TenantID        string               `json:"-"`
+	SiteID          string               `json:"site_id"`
+	TokenID         string               `json:"token_id,omitempty"`
+	TokenConsumedAt *time.Time           `json:"token_consumed_at,omitempty"`
+	EnrolledAt      time.Time            `json:"enrolled_at"`
+	Bootstrap       *EnrollmentBootstrap `json:"bootstrap,omitempty"`
 }
 
 type Plan struct {
-	ID             string      `json:"id"`
-	TenantID       string      `json:"tenant_id"`
-	SiteID         string      `json:"site_id"`
-	IdempotencyKey string      `json:"idempotency_key"`
-	PlanVersion    int64       `json:"plan_version"`
-	Status         string      `json:"status"`
-	OperationsJSON []byte      `json:"operations_json"`
-	CreatedAt      time.Time   `json:"created_at"`
-	Executions     []Execution `json:"executions,omitempty"`
-	Deduplicated   bool        `json:"deduplicated,omitempty"`
+	ID             string          `json:"id"`
+	TenantID       string          `json:"tenant_id"`
+	SiteID         string          `json:"site_id"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	PlanVersion    int64           `json:"plan_version"`
+	Status         string          `json:"status"`
+	OperationsJSON []byte          `json:"operations_json"`
+	CreatedAt      time.Time       `json:"created_at"`
+	RetriedFrom    string          `json:"retried_from,omitempty"`
+	HostID         string          `json:"host_id,omitempty"`
+	Metadata       json.RawMessage `json:"metadata,omitempty"`
+	Sequential     bool            `json:"sequential,omitempty"`
+	Executions     []Execution     `json:"executions,omitempty"`
+	Deduplicated   bool            `json:"deduplicated,omitempty"`
+	Progress       *PlanProgress   `json:"progress,omitempty"`
+}
+
+// planExpiredMessage is the error message of executions expired along with
+// their plan by ExpirePendingPlans.
+const planExpiredMessage = "plan expired before an agent leased it"
+
+// PlanProgress summarises how far a plan's executions have got.
+type PlanProgress struct {
+	Total       int            `json:"total"`
+	Succeeded   int            `json:"succeeded"`
+	Skipped     int            `json:"skipped"`
+	Percent     float64        `json:"percent"`
+	StateCounts map[string]int `json:"state_counts"`
+}
+
+// NewPlanProgress builds a PlanProgress from per-state execution counts.
+func NewPlanProgress(stateCounts map[string]int) PlanProgress {
+	out := PlanProgress{StateCounts: map[string]int{}}
+	for state, n := range stateCounts {
+		out.StateCounts[state] = n
+		out.Total += n
+	}
+	out.Succeeded = out.StateCounts["SUCCEEDED"]
+	out.Skipped = out.StateCounts["SKIPPED"]
+	if out.Total > 0 {
+		out.Percent = float64(out.Succeeded+out.Skipped) * 100 / float64(out.Total)
+	}
+	return out
+}
+
+// PlanProgressFromExecutions counts executions by state and builds a PlanProgress.
+func PlanProgressFromExecutions(executions []Execution) PlanProgress {
+	counts := make(map[string]int)
+	for _, e := range executions {
+		counts[strings.ToUpper(e.State)]++
+	}
+	return NewPlanProgress(counts)
+}
+
+// PlanStats counts a site's plans by outcome. SuccessPercent is the share
+// of finished plans, SUCCEEDED or FAILED, that succeeded; plans in any
+// other status count as Other and do not move it.
+type PlanStats struct {
+	Total          int64            `json:"total"`
+	Succeeded      int64            `json:"succeeded"`
+	Failed         int64            `json:"failed"`
+	Other          int64            `json:"other"`
+	SuccessPercent float64          `json:"success_percent"`
+	StatusCounts   map[string]int64 `json:"status_counts"`
+}
+
+// NewPlanStats builds a PlanStats from per-status plan counts.
+func NewPlanStats(statusCounts map[string]int64) PlanStats {
+	out := PlanStats{StatusCounts: map[string]int64{}}
+	for status, n := range statusCounts {
+		out.StatusCounts[status] = n
+		out.Total += n
+	}
+	out.Succeeded = out.StatusCounts["SUCCEEDED"]
+	out.Failed = out.StatusCounts["FAILED"]
+	out.Other = out.Total - out.Succeeded - out.Failed
+	if finished := out.Succeeded + out.Failed; finished > 0 {
+		out.SuccessPercent = float64(out.Succeeded) * 100 / float64(finished)
+	}
+	return out
 }
 
 type PlanAction struct {
@@ -137,9 +271,11 @@ type PlanAction struct {
 }
 
 type LeasedPlan struct {
-	PlanID      string       `json:"plan_id"`
-	ExecutionID string       `json:"execution_id"`
-	Actions     []PlanAction `json:"actions"`
+	PlanID         string       `json:"plan_id"`
+	ExecutionID    string       `json:"execution_id"`
+	Actions        []PlanAction `json:"actions"`
+	Sequential     bool         `json:"sequential,omitempty"`
+	LeaseExpiresAt time.Time    `json:"lease_expires_at"`
 }
 
 type Execution struct {
@@ -184,6 +320,14 @@ type ExecutionLog struct {
 	IngestedAt  time.Time `json:"ingested_at"`
 }
 
+// ExecutionLogStats counts the log entries of an execution, in total and
+// by severity; every severity is present, with zero if it has no entries.
+type ExecutionLogStats struct {
+	ExecutionID string           `json:"execution_id"`
+	Total       int64            `json:"total"`
+	BySeverity  map[string]int64 `json:"by_severity"`
+}
+
 type Heartbeat struct {
 	AgentID                  string
 	HeartbeatSeq             int64
@@ -197,8 +341,60 @@ type Heartbeat struct {
 	StorageBytesTotal        int64
 	KVMAvailable             bool
 	CloudHypervisorAvailable bool
+	FactsError               string
+	MetricsAddr              string
 	MicroVMs                 []MicroVMHeartbeat
 	ExecutionUpdates         []ExecutionUpdate
+	NetBird                  *AgentNetworkStatus
+	// Metrics replaces the agent's stored metrics snapshot when set; see
+	// FilterAgentMetrics.
+	Metrics map[string]float64
+	// ShutdownReason, one of the model.Shutdown reasons, is recorded on the
+	// agent as its last shutdown when set.
+	ShutdownReason string
+}
+
+// PrometheusTarget is an online agent that exposes a metrics endpoint.
+type PrometheusTarget struct {
+	AgentID     string
+	HostID      string
+	Hostname    string
+	PeerIP      string
+	MetricsAddr string
+}
+
+// AgentNetworkStatus is the latest NetBird mesh status reported by an agent.
+type AgentNetworkStatus struct {
+	AgentID         string     `json:"agent_id"`
+	TenantID        string     `json:"tenant_id"`
+	SiteID          string     `json:"site_id"`
+	Connected       bool       `json:"connected"`
+	State           string     `json:"state,omitempty"`
+	Reason          string     `json:"reason,omitempty"`
+	PeerID          string     `json:"peer_id,omitempty"`
+	PeerIP          string     `json:"peer_ip,omitempty"`
+	NetworkID       string     `json:"network_id,omitempty"`
+	LastHandshakeAt *time.Time `json:"last_handshake_at,omitempty"`
+	RouteStatus     string     `json:"route_status,omitempty"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// ConnectivityTransition is a change of an agent's NetBird status between
+// heartbeats. Heartbeats that repeat the last status are not recorded.
+type ConnectivityTransition struct {
+	AgentID   string    `json:"agent_id"`
+	TenantID  string    `json:"-"`
+	SiteID    string    `json:"site_id"`
+	Connected bool      `json:"connected"`
+	State     string    `json:"state,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// connectivityChanged reports whether next is a transition from prev, the
+// last status of the agent; a first status is one.
+func connectivityChanged(prev *AgentNetworkStatus, next AgentNetworkStatus) bool {
+	return prev == nil || prev.Connected != next.Connected || prev.State != next.State
 }
 
 type MicroVMHeartbeat struct {
@@ -249,7 +445,18 @@ type ApplyPlanInput struct {
 	SiteID          string
 	IdempotencyKey  string
 	ClientRequestID string
-	Actions         []ApplyPlanAction
+	// NameTemplate names CREATE actions that omit a name, e.g.
+	// "web-{index}-{site}". See ValidateNameTemplate.
+	NameTemplate string
+	// RetriedFrom links the new plan to the failed plan it retries.
+	RetriedFrom string
+	// Metadata is free-form operator data (ticket, author, reason), a JSON
+	// object of at most MaxPlanMetadataBytes.
+	Metadata json.RawMessage
+	// Sequential makes the agent run the actions strictly in order and
+	// stop at the first failure instead of running them best-effort.
+	Sequential bool
+	Actions    []ApplyPlanAction
 }
 
 type ApplyPlanAction struct {
@@ -259,6 +466,68 @@ type ApplyPlanAction struct {
 	Name        string `json:"name,omitempty"`
 	VCPUCount   int    `json:"vcpu_count,omitempty"`
 	MemoryMiB   int64  `json:"memory_mib,omitempty"`
+	// Requests are what capacity accounting reserves; limits size the VM.
+	// See ResolveResources for the defaults. Memory values are in MiB.
+	VCPURequest      int               `json:"vcpu_request,omitempty"`
+	VCPULimit        int               `json:"vcpu_limit,omitempty"`
+	MemoryRequestMiB int64             `json:"memory_request,omitempty"`
+	MemoryLimitMiB   int64             `json:"memory_limit,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	// Files are written into the VM by cloud-init; CREATE only.
+	Files []FileSpec `json:"files,omitempty"`
+	// KernelPath and RootfsPath pin the image of a CREATE. Without them,
+	// ImageDefaults carries the site's per-arch defaults and the agent
+	// picks the one for its host.
+	KernelPath    string             `json:"kernel_path,omitempty"`
+	RootfsPath    string             `json:"rootfs_path,omitempty"`
+	ImageDefaults map[string]VMImage `json:"image_defaults,omitempty"`
+	// Disks and Networks are the VM's extra data disks and NICs; CREATE
+	// only, capped by the control plane's MaxDisksPerVM and MaxNICsPerVM.
+	Disks    []VMDiskSpec    `json:"disks,omitempty"`
+	Networks []VMNetworkSpec `json:"networks,omitempty"`
+	// WhenState guards START/STOP/DELETE: the action is SKIPPED unless the
+	// VM is currently in this state.
+	WhenState string `json:"when_state,omitempty"`
+	// DependsOn lists operation IDs of earlier actions of the plan that
+	// must succeed first; the agent skips the action when one did not.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// BootOrder and BootDelaySeconds sequence the boots of a plan; CREATE
+	// and START only. See BootSequence and ValidateBootOrder.
+	BootOrder        int `json:"boot_order,omitempty"`
+	BootDelaySeconds int `json:"boot_delay_seconds,omitempty"`
+	// StopMethod (acpi, signal or force) and GracePeriod, in seconds,
+	// override how the agent shuts the VM down; STOP only.
+	StopMethod  string `json:"stop_method,omitempty"`
+	GracePeriod int    `json:"grace_period,omitempty"`
+	// Migration is set on the MIGRATE actions the control plane schedules
+	// for a VMMigration; clients cannot submit MIGRATE actions.
+	Migration *MigrationStep `json:"migration,omitempty"`
+}
+
+// StopMethods lists the methods accepted by ApplyPlanAction.StopMethod.
+var StopMethods = []string{"acpi", "signal", "force"}
+
+// MaxStopGracePeriod is the longest ApplyPlanAction.GracePeriod, in
+// seconds; the agent enforces the same bound.
+const MaxStopGracePeriod = 600
+
+// VMStates lists the MicroVM states accepted by ApplyPlanAction.WhenState.
+var VMStates = []string{"CREATING", "STOPPED", "RUNNING", "DELETING", "ERROR"}
+
+// whenStateMismatch reports why a guarded action must be skipped, or "" if
+// it may run. currentState is "" when the VM is unknown.
+func whenStateMismatch(action ApplyPlanAction, currentState string) string {
+	want := strings.ToUpper(strings.TrimSpace(action.WhenState))
+	if want == "" {
+		return ""
+	}
+	if currentState == "" {
+		return fmt.Sprintf("vm not found, expected state %s", want)
+	}
+	if !strings.EqualFold(currentState, want) {
+		return fmt.Sprintf("vm state %s does not match when_state %s", strings.ToUpper(currentState), want)
+	}
+	return ""
 }
 
 type ApplyPlanResult struct {
@@ -279,12 +548,16 @@ type PlanActionResultItem struct {
 	ErrorCode  string    `json:"error_code,omitempty"`
 	Message    string    `json:"message,omitempty"`
 	FinishedAt time.Time `json:"finished_at,omitempty"`
+	// IdempotencyToken is generated by the agent per result and kept when
+	// the report is resent; a token already applied to the plan is ignored.
+	IdempotencyToken string `json:"idempotency_token,omitempty"`
 }
 
 type TokenConsumeResult struct {
 	TokenID  string
 	TenantID string
 	SiteID   string
+	Scope    *AgentScope
 }
 
 // AuditEvent represents an audit log entry with chain integrity support
@@ -308,6 +581,14 @@ type AuditEvent struct {
 	ChainValid bool   `json:"chain_valid"`
 }
 
+// AuditCheckpoint records the newest audit event known to chain correctly
+// from genesis, so that verification can resume from it.
+type AuditCheckpoint struct {
+	EventID    int64     `json:"event_id"`
+	EntryHash  string    `json:"entry_hash"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
 // TenantUsage represents current resource usage for a tenant
 type TenantUsage struct {
 	Sites       int `json:"sites"`
@@ -317,6 +598,45 @@ type TenantUsage struct {
 	APIKeys     int `json:"api_keys"`
 }
 
+// TenantUsageSnapshot is a tenant's usage as last recorded on one UTC day.
+type TenantUsageSnapshot struct {
+	TenantID string    `json:"tenant_id"`
+	Day      time.Time `json:"day"`
+	TenantUsage
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// UsageDay returns the UTC day t falls on, the key of usage snapshots.
+func UsageDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Capacity sums host resources for a tenant or site against the resources
+// allocated to its VMs.
+type Capacity struct {
+	Hosts                int   `json:"hosts"`
+	VCPUTotal            int64 `json:"vcpu_total"`
+	VCPUUsed             int64 `json:"vcpu_used"`
+	VCPUAvailable        int64 `json:"vcpu_available"`
+	MemoryBytesTotal     int64 `json:"memory_bytes_total"`
+	MemoryBytesUsed      int64 `json:"memory_bytes_used"`
+	MemoryBytesAvailable int64 `json:"memory_bytes_available"`
+}
+
+// finalize derives the available headroom. Overcommitted resources report
+// zero rather than a negative value.
+func (c *Capacity) finalize() {
+	c.VCPUAvailable = c.VCPUTotal - c.VCPUUsed
+	if c.VCPUAvailable < 0 {
+		c.VCPUAvailable = 0
+	}
+	c.MemoryBytesAvailable = c.MemoryBytesTotal - c.MemoryBytesUsed
+	if c.MemoryBytesAvailable < 0 {
+		c.MemoryBytesAvailable = 0
+	}
+}
+
 // ProjectInvitation represents an invitation to join a project
 type ProjectInvitation struct {
 	ID               string     `json:"id"`
@@ -376,6 +696,9 @@ type Repo interface {
 	Close() error
 	CreateTenant(ctx context.Context, t Tenant) (Tenant, error)
 	ListTenants(ctx context.Context) ([]Tenant, error)
+	// SetTenantLogSeverity sets the tenant's MinLogSeverity; empty clears
+	// it.
+	SetTenantLogSeverity(ctx context.Context, tenantID, severity string) (Tenant, error)
 	GetTenantByID(ctx context.Context, tenantID string) (Tenant, error)
 
 	// User authentication methods
@@ -397,26 +720,113 @@ type Repo interface {
 	CreateSite(ctx context.Context, site Site) (Site, error)
 	ListSites(ctx context.Context, tenantID string) ([]Site, error)
 	IssueEnrollmentToken(ctx context.Context, token EnrollmentToken) (EnrollmentToken, error)
+	// EnrollmentTokenSite returns the site of a usable enrollment token
+	// without consuming it, or ErrTokenInvalid.
+	EnrollmentTokenSite(ctx context.Context, tokenHash string, now time.Time) (string, error)
 	ConsumeEnrollmentToken(ctx context.Context, tokenHash string, now time.Time) (TokenConsumeResult, error)
 	CreateAgentFromEnrollment(ctx context.Context, tokenID string, agent Agent, hostname string) (Agent, error)
 	GetAgentByID(ctx context.Context, agentID string) (Agent, error)
+	// GetAgentEnrollment returns the enrollment provenance of an agent.
+	GetAgentEnrollment(ctx context.Context, agentID string) (AgentEnrollment, error)
+	// IngestHeartbeat applies a heartbeat, or returns ErrStaleHeartbeat when
+	// hb.HeartbeatSeq is set but not above the agent's last applied one. A
+	// zero HeartbeatSeq (agents that do not number heartbeats) always applies.
 	IngestHeartbeat(ctx context.Context, hb Heartbeat) error
+	GetAgentNetworkStatus(ctx context.Context, tenantID, agentID string) (AgentNetworkStatus, error)
+	// ListAgentMetrics returns the latest metrics snapshots pushed by the
+	// agents of a site.
+	ListAgentMetrics(ctx context.Context, tenantID, siteID string) ([]AgentMetrics, error)
+	// ListAgentConnectivityHistory returns up to limit NetBird transitions
+	// of the agent at or after from and before to, oldest first.
+	ListAgentConnectivityHistory(ctx context.Context, tenantID, agentID string, from, to time.Time, limit int) ([]ConnectivityTransition, error)
+	ListPrometheusTargets(ctx context.Context, tenantID, siteID string) ([]PrometheusTarget, error)
 	ApplyPlan(ctx context.Context, input ApplyPlanInput) (ApplyPlanResult, error)
+	GetPlan(ctx context.Context, tenantID, planID string) (Plan, error)
+	// GetPlanStats counts the site's plans created at or after from and
+	// before to by status.
+	GetPlanStats(ctx context.Context, tenantID, siteID string, from, to time.Time) (PlanStats, error)
+	RetryPlan(ctx context.Context, tenantID, planID string, failedOnly bool) (ApplyPlanResult, error)
+	// ListPlanExecutions returns the executions of planID in creation order.
+	ListPlanExecutions(ctx context.Context, tenantID, planID string) ([]Execution, error)
+	// MigrateVM validates and starts moving a VM to another host in its
+	// site. Steps are scheduled as plans pinned to the source or target
+	// host and advance as their results are reported.
+	MigrateVM(ctx context.Context, tenantID, siteID, vmID, targetHostID string) (VMMigration, error)
+	GetVMMigration(ctx context.Context, tenantID, migrationID string) (VMMigration, error)
 	LeasePendingPlans(ctx context.Context, agentID string, limit int, leaseTTL time.Duration) ([]LeasedPlan, error)
+	// ListLeasedPlans returns the plans agentID holds an unexpired lease on,
+	// with the actions still to run, without touching the leases.
+	ListLeasedPlans(ctx context.Context, tenantID, agentID string) ([]LeasedPlan, error)
 	ReportPlanResult(ctx context.Context, agentID string, report PlanResultReport) error
+	// ExpirePendingPlans marks plans still PENDING that were created before
+	// createdBefore as EXPIRED, along with their pending executions, and
+	// returns the expired plans.
+	ExpirePendingPlans(ctx context.Context, createdBefore time.Time) ([]Plan, error)
+	// PurgePlans deletes the plans that ended, created before createdBefore,
+	// with their actions, executions and logs, and the stored file contents
+	// no remaining plan refers to. It returns the number of plans deleted.
+	PurgePlans(ctx context.Context, createdBefore time.Time) (int64, error)
+	// ReleaseIdempotencyKeys releases the idempotency keys of plans created
+	// before createdBefore, so the keys no longer deduplicate and their
+	// mappings are dropped. It returns the number of keys released.
+	ReleaseIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int64, error)
+	// IngestLogs stores the entries of req. Entries below the tenant's
+	// MinLogSeverity are filtered: counted neither accepted nor dropped.
 	IngestLogs(ctx context.Context, req LogIngest) (accepted int64, dropped int64, err error)
-	SweepOfflineAgents(ctx context.Context, staleBefore time.Time) (int64, error)
+	// SweepOfflineAgents marks agents whose last heartbeat is before
+	// staleBefore offline and returns them, in one step, with the state
+	// they had.
+	SweepOfflineAgents(ctx context.Context, staleBefore time.Time) ([]Agent, error)
 	ListHosts(ctx context.Context, tenantID, siteID string) ([]Host, error)
+	ListTenantAgents(ctx context.Context, tenantID string, query TenantAgentQuery) ([]TenantAgent, error)
+	SetHostMaintenance(ctx context.Context, tenantID, siteID, hostID string, maintenance bool) (Host, error)
+	// SetAgentMetadata replaces the operator-set metadata of an agent in
+	// siteID; nil clears it.
+	SetAgentMetadata(ctx context.Context, tenantID, siteID, agentID string, metadata json.RawMessage) error
+	AgentHostInMaintenance(ctx context.Context, agentID string) (bool, error)
 	ListVMs(ctx context.Context, tenantID, siteID string) ([]MicroVM, error)
 	ListExecutionLogs(ctx context.Context, tenantID, executionID string, limit int) ([]ExecutionLog, error)
+	GetExecutionLogStats(ctx context.Context, tenantID, executionID string) (ExecutionLogStats, error)
+	PutExecutionConsoleLog(ctx context.Context, agentID string, upload ConsoleLogUpload) (ExecutionConsoleLog, error)
+	GetExecutionConsoleLog(ctx context.Context, tenantID, executionID string) (ExecutionConsoleLog, error)
 	WriteAudit(ctx context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error
 	SiteBelongsToTenant(ctx context.Context, siteID, tenantID string) (bool, error)
+	// GetSiteImageDefaults returns the site's default VM images keyed by
+	// host arch; SetSiteImageDefaults replaces them.
+	GetSiteImageDefaults(ctx context.Context, tenantID, siteID string) (map[string]VMImage, error)
+	SetSiteImageDefaults(ctx context.Context, tenantID, siteID string, images map[string]VMImage) error
+	// SetSiteVMNamePolicy turns unique VM name enforcement of the site on
+	// or off, leaving names already duplicated alone, and sets the site's
+	// default name template ("" for none).
+	SetSiteVMNamePolicy(ctx context.Context, tenantID, siteID string, uniqueNames bool, nameTemplate string) error
+	// GetSiteDesiredState returns the VM set declared for the site, zero if
+	// none was; SetSiteDesiredState records a new declaration.
+	GetSiteDesiredState(ctx context.Context, tenantID, siteID string) (DesiredState, error)
+	SetSiteDesiredState(ctx context.Context, tenantID, siteID string, state DesiredState) error
+	// GetSiteAgentRollout returns the site's agent rollout, zero if none was
+	// set. SetSiteAgentRollout replaces it and clears recorded upgrade
+	// failures, so a halted rollout resumes.
+	GetSiteAgentRollout(ctx context.Context, tenantID, siteID string) (AgentRollout, error)
+	SetSiteAgentRollout(ctx context.Context, tenantID, siteID string, rollout AgentRollout) error
+	// ClaimAgentUpgrade records that agentID runs version and returns the
+	// version it should upgrade to, or "" if it should not upgrade now.
+	ClaimAgentUpgrade(ctx context.Context, agentID, version string) (string, error)
+	// ReportAgentUpgrade records the outcome of an agent's upgrade hook. It
+	// returns ErrNotFound unless the agent was signaled for that version.
+	ReportAgentUpgrade(ctx context.Context, agentID string, report AgentUpgradeReport) error
+	ListSiteAgentUpgrades(ctx context.Context, tenantID, siteID string) ([]AgentUpgrade, error)
 	ExecutionBelongsToTenant(ctx context.Context, executionID, tenantID string) (bool, error)
 	ListEnrollmentTokens(ctx context.Context, tenantID string) ([]EnrollmentTokenWithStatus, error)
 	ListExecutions(ctx context.Context, tenantID, siteID string, statuses []string, limit int) ([]ExecutionWithTimestamps, error)
 	ListAPIKeys(ctx context.Context, tenantID string) ([]APIKey, error)
 	DeleteAPIKey(ctx context.Context, tenantID, keyID string) error
 	UnenrollAgent(ctx context.Context, agentID string) error
+	// ReleaseAgentPlans drops the plan leases agentID holds and fails, with
+	// ErrorCodeAgentUnenrolled, the PENDING and IN_PROGRESS executions of
+	// those plans and any other IN_PROGRESS executions of the agent,
+	// returning the IDs of the plans it touched.
+	ReleaseAgentPlans(ctx context.Context, agentID string) ([]string, error)
+	RevokeTenantAgentCertificates(ctx context.Context, tenantID string, reason int) ([]Agent, error)
 	UpdateAgentCertificate(ctx context.Context, agentID, certSerial, refreshTokenHash string) error
 	ListCertificateHistory(ctx context.Context, agentID string, limit int) ([]CertificateHistory, error)
 	RecordCertificateIssuance(ctx context.Context, history CertificateHistory) error
@@ -426,16 +836,48 @@ type Repo interface {
 	WriteAuditEvent(ctx context.Context, event *AuditEvent) error
 	UpdateAuditEventValidity(ctx context.Context, id int64, valid bool) error
 	ListAuditEvents(ctx context.Context, tenantID string, limit int) ([]AuditEvent, error)
+	// ListAuditEventsAfter returns events with ID greater than afterID in ID
+	// order, across all tenants. A limit of 0 returns all of them.
+	ListAuditEventsAfter(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error)
+	// RotateTenantEncryption re-encrypts stored plan and audit metadata
+	// and secrets with the active tenant encryption key and
+	// returns the rows rewritten.
+	RotateTenantEncryption(ctx context.Context) (int64, error)
+	// GetAuditCheckpoint returns the zero checkpoint until one is set.
+	GetAuditCheckpoint(ctx context.Context) (AuditCheckpoint, error)
+	SetAuditCheckpoint(ctx context.Context, checkpoint AuditCheckpoint) error
 
 	// CRL methods
 	RevokeCertificate(ctx context.Context, serial string, reason int, agentID string) error
 	IsCertificateRevoked(ctx context.Context, serial string) (bool, error)
-	ListRevokedCertificates(ctx context.Context) ([]CRLEntry, error)
+	ListRevokedCertificates(ctx context.Context, query RevokedCertificateQuery) ([]CRLEntry, error)
 
 	// Tenant quota and usage methods
 	GetTenantUsage(ctx context.Context, tenantID string) (*TenantUsage, error)
+	// RecordTenantUsage stores usage as the tenant's snapshot for the UTC
+	// day of at, replacing one recorded earlier that day.
+	RecordTenantUsage(ctx context.Context, tenantID string, at time.Time, usage TenantUsage) error
+	// ListTenantUsageHistory returns the snapshots of the days from through
+	// to, oldest first.
+	ListTenantUsageHistory(ctx context.Context, tenantID string, from, to time.Time) ([]TenantUsageSnapshot, error)
+	// PruneTenantUsageHistory deletes the snapshots of days before cutoff.
+	PruneTenantUsageHistory(ctx context.Context, cutoff time.Time) (int64, error)
+	// GetCapacity aggregates capacity for a tenant, or for one of its sites
+	// when siteID is not empty.
+	GetCapacity(ctx context.Context, tenantID, siteID string) (Capacity, error)
 	GetTenantLimits(ctx context.Context, tenantID string) (*QuotaLimits, error)
 	SetTenantLimits(ctx context.Context, tenantID string, limits QuotaLimits) error
+	PutQuotaTemplate(ctx context.Context, template QuotaTemplate) (QuotaTemplate, error)
+	GetQuotaTemplate(ctx context.Context, name string) (QuotaTemplate, error)
+	ListQuotaTemplates(ctx context.Context) ([]QuotaTemplate, error)
+	DeleteQuotaTemplate(ctx context.Context, name string) error
+
+	// Webhook methods
+	CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error)
+	ListWebhooks(ctx context.Context, tenantID string) ([]Webhook, error)
+	DeleteWebhook(ctx context.Context, tenantID, webhookID string) error
+	// ListSiteWebhooks returns the webhooks of the tenant owning siteID.
+	ListSiteWebhooks(ctx context.Context, siteID string) ([]Webhook, error)
 
 	// Team invitation methods
 	CreateInvitation(ctx context.Context, invitation ProjectInvitation) error
@@ -467,6 +909,11 @@ type Repo interface {
 	DetachVMFromNetwork(ctx context.Context, vmID, networkID string) error
 	ListVMNetworkAttachments(ctx context.Context, vmID string) ([]VMNetworkAttachment, error)
 	ListNetworkVMAttachments(ctx context.Context, networkID string) ([]VMNetworkAttachment, error)
+	ListVMNetworks(ctx context.Context, tenantID, vmID string) ([]VMNetworkAttachmentWithNetwork, error)
+
+	// ListVMDNSRecords returns VM DNS records by network and hostname,
+	// limited to the site and the VXLAN network whose IDs are not empty.
+	ListVMDNSRecords(ctx context.Context, siteID, networkID string) ([]VMDNSRecord, error)
 }
 
 // VXLANNetwork represents a VXLAN network
@@ -504,3 +951,26 @@ type VMNetworkAttachment struct {
 	MACAddress string    `json:"mac_address,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 }
+
+// VMDNSRecord maps the hostname of a VM to its address on a VXLAN network.
+// Records are registered when a VM's CREATE succeeds and removed when it
+// is deleted or detached from the network.
+type VMDNSRecord struct {
+	NetworkID string    `json:"network_id"`
+	SiteID    string    `json:"site_id"`
+	VMID      string    `json:"vm_id"`
+	Hostname  string    `json:"hostname"`
+	IPAddress string    `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VMNetworkAttachmentWithNetwork is a VM network attachment together with
+// the network it attaches to.
+type VMNetworkAttachmentWithNetwork struct {
+	VMNetworkAttachment
+	NetworkName string `json:"network_name"`
+	VNI         int    `json:"vni"`
+	CIDR        string `json:"cidr"`
+	Gateway     string `json:"gateway,omitempty"`
+	MTU         int    `json:"mtu"`
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// VM DNS hostname modes. VMDNSHostnameName derives a VM's hostname from its
+// name, VMDNSHostnameID from its ID; an empty mode registers no records.
+const (
+	VMDNSHostnameName = "name"
+	VMDNSHostnameID   = "id"
+)
+
+// maxDNSLabel is the longest DNS label, RFC 1035 section 2.3.4.
+const maxDNSLabel = 63
+
+// ValidVMDNSHostnameMode reports whether mode is empty or a known mode.
+func ValidVMDNSHostnameMode(mode string) bool {
+	switch mode {
+	case "", VMDNSHostnameName, VMDNSHostnameID:
+		return true
+	default:
+		return false
+	}
+}
+
+// VMDNSHostname derives the hostname vm is registered under: a DNS label
+// made of the VM's name or ID, lowercased, with runs of other characters
+// turned into hyphens. A name that leaves no label falls back to the ID.
+func VMDNSHostname(mode string, vm MicroVM) string {
+	label := ""
+	if mode == VMDNSHostnameName {
+		label = dnsLabel(vm.Name)
+	}
+	if label == "" {
+		label = dnsLabel(vm.ID)
+	}
+	return label
+}
+
+func dnsLabel(s string) string {
+	label := nameSlug(s)
+	if len(label) > maxDNSLabel {
+		label = strings.TrimRight(label[:maxDNSLabel], "-")
+	}
+	return label
+}
+
+// vmDNSRecords returns the records of vm on the networks it is attached to
+// with an address. taken reports whether another VM already holds a
+// hostname on a network; a hostname that is taken gets a suffix made of
+// the VM's ID, see uniqueDNSLabel.
+func vmDNSRecords(mode string, vm MicroVM, attachments []VMNetworkAttachment, at time.Time, taken func(networkID, hostname string) bool) []VMDNSRecord {
+	hostname := VMDNSHostname(mode, vm)
+	var out []VMDNSRecord
+	for _, a := range attachments {
+		ip, _, _ := strings.Cut(a.IPAddress, "/")
+		if ip == "" || hostname == "" {
+			continue
+		}
+		networkID := a.NetworkID
+		out = append(out, VMDNSRecord{
+			NetworkID: networkID,
+			SiteID:    vm.SiteID,
+			VMID:      vm.ID,
+			Hostname:  uniqueDNSLabel(hostname, vm.ID, func(h string) bool { return taken(networkID, h) }),
+			IPAddress: ip,
+			CreatedAt: at,
+		})
+	}
+	return out
+}
+
+// uniqueDNSLabel returns label if it is not taken, otherwise label followed
+// by the first eight characters of the VM's ID and, should that be taken
+// too, a counter, shortened to stay a valid DNS label.
+func uniqueDNSLabel(label, vmID string, taken func(string) bool) string {
+	if !taken(label) {
+		return label
+	}
+	id := dnsLabel(vmID)
+	if len(id) > 8 {
+		id = strings.Trim(id[:8], "-")
+	}
+	for n := 1; ; n++ {
+		suffix := id
+		if n > 1 {
+			suffix = fmt.Sprintf("%s-%d", id, n)
+		}
+		base := label
+		if len(base)+1+len(suffix) > maxDNSLabel {
+			base = strings.TrimRight(base[:maxDNSLabel-1-len(suffix)], "-")
+		}
+		if candidate := base + "-" + suffix; !taken(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRepoRegistersVMDNSOnCreateAndRemovesOnDelete(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	repo.SetVMDNSHostnames(VMDNSHostnameName)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	network, err := repo.CreateVXLANNetwork(ctx, tenantID, siteID, VXLANNetwork{ID: "net-1", Name: "backend", VNI: 4300, CIDR: "10.40.0.0/24", Gateway: "10.40.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(key, op, vmID, name string, ok bool) {
+		t.Helper()
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: op, VMID: vmID, Name: name, VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{
+			PlanID:  applied.Plan.ID,
+			Results: []PlanActionResultItem{{ActionID: key, OK: ok, FinishedAt: time.Now().UTC()}},
+		}); err != nil {
+			t.Fatalf("report %s: %v", key, err)
+		}
+	}
+	attach := func(vmID, ip string) {
+		t.Helper()
+		if _, err := repo.AttachVMToNetwork(ctx, VMNetworkAttachment{ID: "att-" + vmID, VMID: vmID, NetworkID: network.ID, IPAddress: ip}); err != nil {
+			t.Fatalf("attach %s: %v", vmID, err)
+		}
+	}
+	records := func() []VMDNSRecord {
+		t.Helper()
+		out, err := repo.ListVMDNSRecords(ctx, siteID, network.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	attach("vm-web", "10.40.0.10")
+	attach("vm-db", "10.40.0.11")
+	run("create-web", "CREATE", "vm-web", "Web_Frontend", true)
+	run("create-db", "CREATE", "vm-db", "db", false)
+	got := records()
+	if len(got) != 1 || got[0].VMID != "vm-web" || got[0].Hostname != "web-frontend" || got[0].IPAddress != "10.40.0.10" {
+		t.Fatalf("expected only the created VM to be registered, got %+v", got)
+	}
+
+	run("delete-web", "DELETE", "vm-web", "", true)
+	if got := records(); len(got) != 0 {
+		t.Fatalf("expected the deleted VM to be deregistered, got %+v", got)
+	}
+
+	run("recreate-db", "CREATE", "vm-db", "db", true)
+	if got := records(); len(got) != 1 || got[0].Hostname != "db" {
+		t.Fatalf("expected the recreated VM to be registered, got %+v", got)
+	}
+	if err := repo.DetachVMFromNetwork(ctx, "vm-db", network.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := records(); len(got) != 0 {
+		t.Fatalf("expected a detached VM to be deregistered, got %+v", got)
+	}
+}
+
+func TestVMDNSHostname(t *testing.T) {
+	vm := MicroVM{ID: "0b5c-VM", Name: "--Build Agent #3--"}
+	if got := VMDNSHostname(VMDNSHostnameName, vm); got != "build-agent-3" {
+		t.Fatalf("name mode: got %q", got)
+	}
+	if got := VMDNSHostname(VMDNSHostnameID, vm); got != "0b5c-vm" {
+		t.Fatalf("id mode: got %q", got)
+	}
+	if got := VMDNSHostname(VMDNSHostnameName, MicroVM{ID: "vm-9", Name: "%%%"}); got != "vm-9" {
+		t.Fatalf("expected a name without a label to fall back to the ID, got %q", got)
+	}
+}
+
+func TestMemoryRepoVMDNSKeepsHostnamesUniqueAndRegistersLateAttachments(t *testing.T) {
+	ctx := context.Background()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	repo.SetVMDNSHostnames(VMDNSHostnameName)
+	agent := newAgent(t, repo, tenantID, siteID, "host-a")
+	network, err := repo.CreateVXLANNetwork(ctx, tenantID, siteID, VXLANNetwork{ID: "net-1", Name: "backend", VNI: 4301, CIDR: "10.41.0.0/24", Gateway: "10.41.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(key, vmID string) {
+		t.Helper()
+		applied, err := repo.ApplyPlan(ctx, ApplyPlanInput{
+			TenantID:       tenantID,
+			SiteID:         siteID,
+			IdempotencyKey: key,
+			Actions:        []ApplyPlanAction{{OperationID: key, Operation: "CREATE", VMID: vmID, Name: "web", VCPUCount: 1, MemoryMiB: 128}},
+		})
+		if err != nil {
+			t.Fatalf("apply %s: %v", key, err)
+		}
+		if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{
+			PlanID:  applied.Plan.ID,
+			Results: []PlanActionResultItem{{ActionID: key, OK: true, FinishedAt: time.Now().UTC()}},
+		}); err != nil {
+			t.Fatalf("report %s: %v", key, err)
+		}
+	}
+
+	if _, err := repo.AttachVMToNetwork(ctx, VMNetworkAttachment{ID: "att-1", VMID: "vm-aaaa1111", NetworkID: network.ID, IPAddress: "10.41.0.10"}); err != nil {
+		t.Fatal(err)
+	}
+	create("create-1", "vm-aaaa1111")
+	create("create-2", "vm-bbbb2222")
+	if _, err := repo.AttachVMToNetwork(ctx, VMNetworkAttachment{ID: "att-2", VMID: "vm-bbbb2222", NetworkID: network.ID, IPAddress: "10.41.0.11"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.ListVMDNSRecords(ctx, siteID, network.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Hostname != "web" || got[0].VMID != "vm-aaaa1111" || got[1].Hostname != "web-vm-bbbb2" || got[1].VMID != "vm-bbbb2222" {
+		t.Fatalf("expected the late attachment to be registered under a suffixed hostname, got %+v", got)
+	}
+}
+
+func TestUniqueDNSLabel(t *testing.T) {
+	taken := map[string]bool{"web": true, "web-0b5c": true}
+	isTaken := func(h string) bool { return taken[h] }
+	if got := uniqueDNSLabel("db", "0b5c", isTaken); got != "db" {
+		t.Fatalf("free label: got %q", got)
+	}
+	if got := uniqueDNSLabel("web", "0b5c", isTaken); got != "web-0b5c-2" {
+		t.Fatalf("expected a counter when the suffixed label is taken too, got %q", got)
+	}
+	long := strings.Repeat("a", maxDNSLabel)
+	taken[long] = true
+	if got := uniqueDNSLabel(long, "0b5c", isTaken); len(got) > maxDNSLabel || !strings.HasSuffix(got, "-0b5c") {
+		t.Fatalf("expected a suffixed label within %d characters, got %q", maxDNSLabel, got)
+	}
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// VM migration states. MIGRATING and ROLLING_BACK are active; the others
+// are terminal.
+const (
+	MigrationStateMigrating   = "MIGRATING"
+	MigrationStateRollingBack = "ROLLING_BACK"
+	MigrationStateSucceeded   = "SUCCEEDED"
+	MigrationStateRolledBack  = "ROLLED_BACK"
+	MigrationStateFailed      = "FAILED"
+)
+
+// VM migration steps. Each step runs as a single MIGRATE action in a plan
+// pinned to the host that performs it.
+const (
+	MigrationStepSnapshot       = "SNAPSHOT"
+	MigrationStepTransfer       = "TRANSFER"
+	MigrationStepRestore        = "RESTORE"
+	MigrationStepCleanup        = "CLEANUP"
+	MigrationStepRollbackTarget = "ROLLBACK_TARGET"
+	MigrationStepRollbackSource = "ROLLBACK_SOURCE"
+)
+
+// VMMigration moves a VM to another host in the same site: snapshot on the
+// source, transfer, restore on the target, then delete the source copy. A
+// failure before the restore succeeds rolls back by removing any partial
+// copy on the target and restarting the VM on the source.
+type VMMigration struct {
+	ID           string    `json:"id"`
+	TenantID     string    `json:"tenant_id"`
+	SiteID       string    `json:"site_id"`
+	VMID         string    `json:"vm_id"`
+	SourceHostID string    `json:"source_host_id"`
+	TargetHostID string    `json:"target_host_id"`
+	State        string    `json:"state"`
+	Step         string    `json:"step,omitempty"`
+	PlanID       string    `json:"plan_id,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// MigrationStep is the payload of a MIGRATE action. TargetHost is the
+// target's hostname and is only set for the TRANSFER step.
+type MigrationStep struct {
+	MigrationID  string `json:"migration_id"`
+	Step         string `json:"step"`
+	SnapshotName string `json:"snapshot_name"`
+	TargetHost   string `json:"target_host,omitempty"`
+}
+
+// Active reports whether the migration still has a step to run.
+func (m VMMigration) Active() bool {
+	return m.State == MigrationStateMigrating || m.State == MigrationStateRollingBack
+}
+
+// SnapshotName is the name of the snapshot the migration moves.
+func (m VMMigration) SnapshotName() string {
+	return "migrate-" + m.ID
+}
+
+// stepHostID returns the host that runs the current step.
+func (m VMMigration) stepHostID() string {
+	switch m.Step {
+	case MigrationStepRestore, MigrationStepRollbackTarget:
+		return m.TargetHostID
+	default:
+		return m.SourceHostID
+	}
+}
+
+// stepAction builds the MIGRATE action for the current step.
+func (m VMMigration) stepAction(targetHostname string) ApplyPlanAction {
+	step := &MigrationStep{
+		MigrationID:  m.ID,
+		Step:         m.Step,
+		SnapshotName: m.SnapshotName(),
+	}
+	if m.Step == MigrationStepTransfer {
+		step.TargetHost = targetHostname
+	}
+	return ApplyPlanAction{
+		OperationID: m.ID + ":" + m.Step,
+		Operation:   "MIGRATE",
+		VMID:        m.VMID,
+		Migration:   step,
+	}
+}
+
+// stepIdempotencyKey keys the plan that runs the current step.
+func (m VMMigration) stepIdempotencyKey() string {
+	return "migration:" + m.ID + ":" + m.Step
+}
+
+// advanceVMMigration returns m moved past its current step. ok reports
+// whether the step succeeded and message is the failure reason. Rollback
+// steps always run to the end: a failed target cleanup still restarts the
+// VM on the source.
+func advanceVMMigration(m VMMigration, ok bool, message string) VMMigration {
+	fail := func(step, reason string) VMMigration {
+		if m.Error == "" {
+			m.Error = reason
+		}
+		m.State = MigrationStateRollingBack
+		m.Step = step
+		return m
+	}
+	finish := func(state string) VMMigration {
+		m.State = state
+		m.Step = ""
+		m.PlanID = ""
+		return m
+	}
+	reason := fmt.Sprintf("%s failed: %s", m.Step, chooseString(message, "step failed"))
+
+	switch m.Step {
+	case MigrationStepSnapshot:
+		if !ok {
+			return fail(MigrationStepRollbackSource, reason)
+		}
+		m.Step = MigrationStepTransfer
+	case MigrationStepTransfer:
+		if !ok {
+			return fail(MigrationStepRollbackSource, reason)
+		}
+		m.Step = MigrationStepRestore
+	case MigrationStepRestore:
+		if !ok {
+			return fail(MigrationStepRollbackTarget, reason)
+		}
+		m.Step = MigrationStepCleanup
+	case MigrationStepCleanup:
+		// The VM already runs on the target, so there is nothing to roll
+		// back; the source copy needs manual cleanup.
+		if !ok {
+			m.Error = reason
+			return finish(MigrationStateFailed)
+		}
+		return finish(MigrationStateSucceeded)
+	case MigrationStepRollbackTarget:
+		if !ok {
+			m.Error += "; " + reason
+		}
+		m.Step = MigrationStepRollbackSource
+	case MigrationStepRollbackSource:
+		if !ok {
+			m.Error += "; " + reason
+			return finish(MigrationStateFailed)
+		}
+		return finish(MigrationStateRolledBack)
+	default:
+		return finish(MigrationStateFailed)
+	}
+	return m
+}
+
+// checkHostCapacity returns ErrInsufficientCapacity unless vm fits on host
+// next to the VMs already placed there. Capacity is counted by request,
+// like GetCapacity.
+func checkHostCapacity(host Host, placed []MicroVM, vm MicroVM) error {
+	var vcpuUsed, memUsed int64
+	for _, p := range placed {
+		if p.ID == vm.ID || p.State == "DELETING" {
+			continue
+		}
+		vcpuUsed += int64(firstPositive(p.VCPURequest, p.VCPUCount))
+		memUsed += firstPositive(p.MemoryRequestMiB, p.MemoryMiB) << 20
+	}
+	vcpuNeeded := int64(firstPositive(vm.VCPURequest, vm.VCPUCount))
+	memNeeded := firstPositive(vm.MemoryRequestMiB, vm.MemoryMiB) << 20
+	if vcpuUsed+vcpuNeeded > int64(host.CPUCoresTotal) {
+		return fmt.Errorf("%w: host %s has %d of %d vCPUs free, VM needs %d", ErrInsufficientCapacity, host.ID, max64(int64(host.CPUCoresTotal)-vcpuUsed, 0), host.CPUCoresTotal, vcpuNeeded)
+	}
+	if memUsed+memNeeded > host.MemoryBytesTotal {
+		return fmt.Errorf("%w: host %s has %d of %d memory bytes free, VM needs %d", ErrInsufficientCapacity, host.ID, max64(host.MemoryBytesTotal-memUsed, 0), host.MemoryBytesTotal, memNeeded)
+	}
+	return nil
+}
+
+// validateVMMigration checks a migration request against the VM and the
+// two hosts before any step is scheduled.
+func validateVMMigration(vm MicroVM, target Host, placed []MicroVM) error {
+	switch {
+	case vm.HostID == "":
+		return fmt.Errorf("%w: vm %s is not placed on a host", ErrInvalidMigration, vm.ID)
+	case vm.HostID == target.ID:
+		return fmt.Errorf("%w: vm %s already runs on host %s", ErrInvalidMigration, vm.ID, target.ID)
+	case target.Maintenance:
+		return fmt.Errorf("%w: target host %s is in maintenance", ErrInvalidMigration, target.ID)
+	}
+	return checkHostCapacity(target, placed, vm)
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestAdvanceVMMigration(t *testing.T) {
+	tests := []struct {
+		name      string
+		step      string
+		state     string
+		ok        bool
+		wantState string
+		wantStep  string
+	}{
+		{"snapshot ok", MigrationStepSnapshot, MigrationStateMigrating, true, MigrationStateMigrating, MigrationStepTransfer},
+		{"snapshot failed", MigrationStepSnapshot, MigrationStateMigrating, false, MigrationStateRollingBack, MigrationStepRollbackSource},
+		{"transfer ok", MigrationStepTransfer, MigrationStateMigrating, true, MigrationStateMigrating, MigrationStepRestore},
+		{"transfer failed", MigrationStepTransfer, MigrationStateMigrating, false, MigrationStateRollingBack, MigrationStepRollbackSource},
+		{"restore ok", MigrationStepRestore, MigrationStateMigrating, true, MigrationStateMigrating, MigrationStepCleanup},
+		{"restore failed", MigrationStepRestore, MigrationStateMigrating, false, MigrationStateRollingBack, MigrationStepRollbackTarget},
+		{"cleanup ok", MigrationStepCleanup, MigrationStateMigrating, true, MigrationStateSucceeded, ""},
+		{"cleanup failed", MigrationStepCleanup, MigrationStateMigrating, false, MigrationStateFailed, ""},
+		{"rollback target ok", MigrationStepRollbackTarget, MigrationStateRollingBack, true, MigrationStateRollingBack, MigrationStepRollbackSource},
+		{"rollback target failed", MigrationStepRollbackTarget, MigrationStateRollingBack, false, MigrationStateRollingBack, MigrationStepRollbackSource},
+		{"rollback source ok", MigrationStepRollbackSource, MigrationStateRollingBack, true, MigrationStateRolledBack, ""},
+		{"rollback source failed", MigrationStepRollbackSource, MigrationStateRollingBack, false, MigrationStateFailed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := advanceVMMigration(VMMigration{State: tt.state, Step: tt.step}, tt.ok, "boom")
+			if got.State != tt.wantState || got.Step != tt.wantStep {
+				t.Fatalf("got %s/%s, want %s/%s", got.State, got.Step, tt.wantState, tt.wantStep)
+			}
+			if !tt.ok && got.Error == "" {
+				t.Fatal("expected the failure to be recorded")
+			}
+		})
+	}
+}
+
+func TestCheckHostCapacity(t *testing.T) {
+	host := Host{ID: "h1", CPUCoresTotal: 4, MemoryBytesTotal: 4 << 30}
+	placed := []MicroVM{{ID: "a", VCPUCount: 2, MemoryMiB: 2048}}
+	if err := checkHostCapacity(host, placed, MicroVM{ID: "b", VCPUCount: 2, MemoryMiB: 2048}); err != nil {
+		t.Fatalf("expected VM to fit: %v", err)
+	}
+	if err := checkHostCapacity(host, placed, MicroVM{ID: "b", VCPUCount: 3, MemoryMiB: 1024}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Fatalf("expected ErrInsufficientCapacity for vCPU, got %v", err)
+	}
+	if err := checkHostCapacity(host, placed, MicroVM{ID: "b", VCPUCount: 1, MemoryMiB: 4096}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Fatalf("expected ErrInsufficientCapacity for memory, got %v", err)
+	}
+	// Requests, not limits, are what a VM reserves.
+	if err := checkHostCapacity(host, placed, MicroVM{ID: "b", VCPUCount: 4, VCPURequest: 2, MemoryMiB: 2048}); err != nil {
+		t.Fatalf("expected VM to fit by request: %v", err)
+	}
+}
+
+// newMigrationFixture returns a repo with a running VM on the source
+// agent's host and an empty target host with room for it.
+func newMigrationFixture(t *testing.T) (*MemoryRepo, string, string, Agent, Agent) {
+	t.Helper()
+	repo, tenantID, siteID := newMemoryRepoWithTenantSite(t)
+	ctx := context.Background()
+	source := newAgent(t, repo, tenantID, siteID, "source")
+	target := newAgent(t, repo, tenantID, siteID, "target")
+	for _, agent := range []Agent{source, target} {
+		hb := Heartbeat{AgentID: agent.ID, Hostname: agent.ID, CPUCoresTotal: 4, MemoryBytesTotal: 8 << 30}
+		if agent.ID == source.ID {
+			hb.MicroVMs = []MicroVMHeartbeat{{ID: "vm-1", Name: "vm-1", State: "RUNNING", VCPUCount: 2, MemoryMiB: 1024}}
+		}
+		if err := repo.IngestHeartbeat(ctx, hb); err != nil {
+			t.Fatalf("heartbeat: %v", err)
+		}
+	}
+	return repo, tenantID, siteID, source, target
+}
+
+// runMigrationStep leases the next plan as agent, checks it is the wanted
+// migration step and reports ok for it.
+func runMigrationStep(t *testing.T, repo *MemoryRepo, agent Agent, wantStep string, ok bool) {
+	t.Helper()
+	ctx := context.Background()
+	leased, err := repo.LeasePendingPlans(ctx, agent.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("lease: %v", err)
+	}
+	if len(leased) != 1 || len(leased[0].Actions) != 1 {
+		t.Fatalf("expected one leased migration action for %s, got %+v", wantStep, leased)
+	}
+	action := leased[0].Actions[0]
+	var payload ApplyPlanAction
+	if err := json.Unmarshal(action.PayloadJSON, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if action.OperationType != "MIGRATE" || payload.Migration == nil || payload.Migration.Step != wantStep {
+		t.Fatalf("expected MIGRATE %s, got %s %+v", wantStep, action.OperationType, payload.Migration)
+	}
+	result := PlanActionResultItem{ActionID: action.OperationID, OK: ok}
+	if !ok {
+		result.Message = wantStep + " broke"
+	}
+	if err := repo.ReportPlanResult(ctx, agent.ID, PlanResultReport{PlanID: leased[0].PlanID, Results: []PlanActionResultItem{result}}); err != nil {
+		t.Fatalf("report %s: %v", wantStep, err)
+	}
+}
+
+func TestMemoryRepoVMMigrationSucceeds(t *testing.T) {
+	repo, tenantID, siteID, source, target := newMigrationFixture(t)
+	ctx := context.Background()
+
+	mig, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", target.HostID)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if mig.SourceHostID != source.HostID || mig.Step != MigrationStepSnapshot {
+		t.Fatalf("unexpected migration: %+v", mig)
+	}
+	if _, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", target.HostID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a second migration, got %v", err)
+	}
+
+	// The snapshot step is pinned to the source host.
+	if leased, _ := repo.LeasePendingPlans(ctx, target.ID, 10, 0); len(leased) != 0 {
+		t.Fatalf("target leased a source step: %+v", leased)
+	}
+	runMigrationStep(t, repo, source, MigrationStepSnapshot, true)
+	runMigrationStep(t, repo, source, MigrationStepTransfer, true)
+	runMigrationStep(t, repo, target, MigrationStepRestore, true)
+	runMigrationStep(t, repo, source, MigrationStepCleanup, true)
+
+	got, err := repo.GetVMMigration(ctx, tenantID, mig.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != MigrationStateSucceeded || got.Step != "" || got.Error != "" {
+		t.Fatalf("unexpected final migration: %+v", got)
+	}
+	vms, _ := repo.ListVMs(ctx, tenantID, siteID)
+	if len(vms) != 1 || vms[0].HostID != target.HostID || vms[0].State != "RUNNING" {
+		t.Fatalf("expected vm on target host, got %+v", vms)
+	}
+}
+
+func TestMemoryRepoVMMigrationRollsBackOnRestoreFailure(t *testing.T) {
+	repo, tenantID, siteID, source, target := newMigrationFixture(t)
+	ctx := context.Background()
+
+	mig, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", target.HostID)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	runMigrationStep(t, repo, source, MigrationStepSnapshot, true)
+	runMigrationStep(t, repo, source, MigrationStepTransfer, true)
+	runMigrationStep(t, repo, target, MigrationStepRestore, false)
+
+	got, _ := repo.GetVMMigration(ctx, tenantID, mig.ID)
+	if got.State != MigrationStateRollingBack || got.Step != MigrationStepRollbackTarget {
+		t.Fatalf("expected target rollback, got %+v", got)
+	}
+	runMigrationStep(t, repo, target, MigrationStepRollbackTarget, true)
+	runMigrationStep(t, repo, source, MigrationStepRollbackSource, true)
+
+	got, _ = repo.GetVMMigration(ctx, tenantID, mig.ID)
+	if got.State != MigrationStateRolledBack || got.Error != "RESTORE failed: RESTORE broke" {
+		t.Fatalf("unexpected final migration: %+v", got)
+	}
+	vms, _ := repo.ListVMs(ctx, tenantID, siteID)
+	if len(vms) != 1 || vms[0].HostID != source.HostID {
+		t.Fatalf("expected vm to stay on source host, got %+v", vms)
+	}
+	if _, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", target.HostID); err != nil {
+		t.Fatalf("expected a new migration after rollback: %v", err)
+	}
+}
+
+func TestMemoryRepoMigrateVMValidatesTarget(t *testing.T) {
+	repo, tenantID, siteID, source, target := newMigrationFixture(t)
+	ctx := context.Background()
+
+	if _, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", source.HostID); !errors.Is(err, ErrInvalidMigration) {
+		t.Fatalf("expected ErrInvalidMigration for the source host, got %v", err)
+	}
+	if _, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", "missing-host"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for an unknown host, got %v", err)
+	}
+	if _, err := repo.MigrateVM(ctx, tenantID, siteID, "vm-1", target.HostID); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	repo2, tenantID2, siteID2, _, target2 := newMigrationFixture(t)
+	if err := repo2.IngestHeartbeat(ctx, Heartbeat{AgentID: target2.ID, Hostname: target2.ID, CPUCoresTotal: 1, MemoryBytesTotal: 8 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo2.MigrateVM(ctx, tenantID2, siteID2, "vm-1", target2.HostID); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Fatalf("expected ErrInsufficientCapacity, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Webhook event types a webhook can subscribe to.
+const (
+	WebhookEventPlanSucceeded = "plan.succeeded"
+	WebhookEventPlanFailed    = "plan.failed"
+	WebhookEventAgentOffline  = "agent.offline"
+	WebhookEventVMError       = "vm.error"
+)
+
+// WebhookEventTypes lists the event types in the order they are documented.
+var WebhookEventTypes = []string{
+	WebhookEventPlanSucceeded,
+	WebhookEventPlanFailed,
+	WebhookEventAgentOffline,
+	WebhookEventVMError,
+}
+
+// Webhook is an HTTP endpoint that receives a tenant's events. EventTypes
+// filters the events delivered; empty means all of them.
+type Webhook struct {
+	ID         string    `json:"id"`
+	TenantID   string    `json:"tenant_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"`
+	EventTypes []string  `json:"event_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Wants reports whether the webhook subscribed to eventType.
+func (w Webhook) Wants(eventType string) bool {
+	return len(w.EventTypes) == 0 || slices.Contains(w.EventTypes, eventType)
+}
+
+// ValidateWebhook checks the webhook URL and that every event type in the
+// filter is known.
+func ValidateWebhook(w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidWebhook)
+	}
+	for _, t := range w.EventTypes {
+		if !slices.Contains(WebhookEventTypes, t) {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidWebhook, t)
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"io"
 	"strings"
 	"time"
@@ -60,11 +61,12 @@ func (s *Server) Heartbeat(ctx context.Context, req *controlplanev1.HeartbeatReq
 	// Convert execution updates
 	execUpdates := make([]store.ExecutionUpdate, 0, len(req.ExecutionUpdates))
 	for _, update := range req.ExecutionUpdates {
+		errorCode, errorMessage := store.NormalizeFailure(update.ErrorCode, update.ErrorMessage)
 		execUpdates = append(execUpdates, store.ExecutionUpdate{
 			ExecutionID:  update.ExecutionId,
 			State:        update.State.String(),
-			ErrorCode:    update.ErrorCode,
-			ErrorMessage: update.ErrorMessage,
+			ErrorCode:    errorCode,
+			ErrorMessage: errorMessage,
 			UpdatedAt:    time.Now().UTC(),
 		})
 	}
@@ -89,6 +91,17 @@ func (s *Server) Heartbeat(ctx context.Context, req *controlplanev1.HeartbeatReq
 		hostname = valueOr(hostname, "unknown")
 	}
 
+	// Calculate next heartbeat interval
+	nextHeartbeatSeconds := int32(15)
+	if s.heartbeatInterval > 0 {
+		nextHeartbeatSeconds = int32(s.heartbeatInterval.Seconds())
+	}
+
+	if s.isReadOnly() {
+		// Nothing is recorded or leased; the agent keeps its cadence.
+		return &controlplanev1.HeartbeatResponse{NextHeartbeatSeconds: nextHeartbeatSeconds}, nil
+	}
+
 	// Ingest heartbeat
 	err := s.repo.IngestHeartbeat(ctx, store.Heartbeat{
 		AgentID:                  agent.ID,
@@ -107,6 +120,10 @@ func (s *Server) Heartbeat(ctx context.Context, req *controlplanev1.HeartbeatReq
 		ExecutionUpdates:         execUpdates,
 	})
 
+	if errors.Is(err, store.ErrStaleHeartbeat) {
+		// A newer heartbeat was already applied and leased the plans.
+		return &controlplanev1.HeartbeatResponse{NextHeartbeatSeconds: nextHeartbeatSeconds}, nil
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to ingest heartbeat: %v", err)
 	}
@@ -166,12 +183,6 @@ func (s *Server) Heartbeat(ctx context.Context, req *controlplanev1.HeartbeatReq
 		protoPlans = append(protoPlans, protoPlan)
 	}
 
-	// Calculate next heartbeat interval
-	nextHeartbeatSeconds := int32(15)
-	if s.heartbeatInterval > 0 {
-		nextHeartbeatSeconds = int32(s.heartbeatInterval.Seconds())
-	}
-
 	return &controlplanev1.HeartbeatResponse{
 		NextHeartbeatSeconds: nextHeartbeatSeconds,
 		PendingPlans:         protoPlans,
@@ -58,6 +58,12 @@ func (s *Server) Enroll(ctx context.Context, req *controlplanev1.EnrollRequest)
 		OS:               "linux",  // Extract from host facts if available
 		Arch:             "amd64",  // Extract from host facts if available
 		KernelVersion:    "",       // Extract from host facts if available
+		Bootstrap: &store.EnrollmentBootstrap{
+			Hostname:          hostname,
+			RequestedHostname: req.RequestedHostname,
+			AgentVersion:      req.AgentVersion,
+			BootstrapNonce:    req.BootstrapNonce,
+		},
 	}, hostname)
 
 	if err != nil {
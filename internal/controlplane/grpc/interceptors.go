@@ -189,6 +189,45 @@ func extractAgentIDFromCert(ctx context.Context) (string, error) {
 	return "", status.Errorf(codes.Unauthenticated, "mTLS not configured")
 }
 
+// ReadOnlyInterceptor refuses unary RPCs that change state with
+// Unavailable while readOnly reports true. Heartbeats pass: the handler
+// answers them without side effects.
+func ReadOnlyInterceptor(readOnly func() bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isWriteMethod(info.FullMethod) && readOnly() {
+			return nil, errReadOnly
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamReadOnlyInterceptor refuses streaming RPCs that change state, such
+// as log uploads, with Unavailable while readOnly reports true.
+func StreamReadOnlyInterceptor(readOnly func() bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isWriteMethod(info.FullMethod) && readOnly() {
+			return errReadOnly
+		}
+		return handler(srv, stream)
+	}
+}
+
+// errReadOnly is returned for writes refused in read-only mode.
+var errReadOnly = status.Error(codes.Unavailable, "control plane is in read-only mode")
+
+// isWriteMethod reports whether method may change state. Status queries
+// only read, and heartbeats are answered without side effects in
+// read-only mode.
+func isWriteMethod(method string) bool {
+	switch method {
+	case "/nkudo.controlplane.v1.AgentControlService/Heartbeat",
+		"/nkudo.controlplane.v1.TenantControlService/GetStatus",
+		"/grpc.health.v1.Health/Check":
+		return false
+	}
+	return true
+}
+
 func isPublicEndpoint(method string) bool {
 	publicMethods := []string{
 		"/nkudo.controlplane.v1.EnrollmentService/Enroll",
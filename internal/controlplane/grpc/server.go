@@ -41,6 +41,9 @@ type Server struct {
 	maxPlansPerHeartbeat  int
 	agentCertTTL          time.Duration
 
+	// readOnly reports whether the control plane refuses writes
+	readOnly func() bool
+
 	grpcServer *grpc.Server
 	listener   net.Listener
 	mu         sync.RWMutex
@@ -60,6 +63,24 @@ func NewServer(cfg Config, repo store.Repo, ca CAInterface, heartbeatInterval ti
 	}
 }
 
+// SetReadOnlyFunc makes the server follow the control plane's read-only
+// mode: while readOnly reports true, RPCs that change state are refused
+// with Unavailable and heartbeats are answered without recording or
+// leasing anything.
+func (s *Server) SetReadOnlyFunc(readOnly func() bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readOnly = readOnly
+}
+
+// isReadOnly reports whether the control plane currently refuses writes.
+func (s *Server) isReadOnly() bool {
+	s.mu.RLock()
+	readOnly := s.readOnly
+	s.mu.RUnlock()
+	return readOnly != nil && readOnly()
+}
+
 // Start starts the gRPC server
 func (s *Server) Start() error {
 	s.mu.Lock()
@@ -153,11 +174,13 @@ func (s *Server) buildServerOptions() []grpc.ServerOption {
 		grpc.ChainUnaryInterceptor(
 			LoggingInterceptor(),
 			RecoveryInterceptor(),
+			ReadOnlyInterceptor(s.isReadOnly),
 		),
 		// Stream interceptors
 		grpc.ChainStreamInterceptor(
 			StreamLoggingInterceptor(),
 			StreamRecoveryInterceptor(),
+			StreamReadOnlyInterceptor(s.isReadOnly),
 		),
 	}
 
@@ -197,15 +220,21 @@ func (s *Server) buildTLSConfig() *tls.Config {
 		}
 	}
 
-	// Build CA pool
-	pool := s.ca.CertPool()
-
-	return &tls.Config{
+	base := &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		ClientCAs:    pool,
+		ClientCAs:    s.ca.CertPool(),
 		ClientAuth:   tls.VerifyClientCertIfGiven,
 		MinVersion:   tls.VersionTLS13,
 	}
+
+	// Rebuild the CA pool per handshake so a CA rotation applies at once
+	tlsConfig := base.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = s.ca.CertPool()
+		return c, nil
+	}
+	return tlsConfig
 }
 
 // generateServerCert generates a server certificate using the internal CA
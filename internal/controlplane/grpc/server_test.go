@@ -5,7 +5,11 @@ import (
 	"testing"
 	"time"
 
+	controlplanev1 "github.com/kubedoio/n-kudo/api/proto/controlplane/v1"
 	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // mockCA implements CAInterface for testing
@@ -175,3 +179,48 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Default ListenAddr should be :50051, got %s", cfg.ListenAddr)
 	}
 }
+
+func TestReadOnlyModeRefusesWrites(t *testing.T) {
+	readOnly := true
+	server := NewServer(Config{ListenAddr: ":0"}, nil, nil, 15*time.Second, 45*time.Second, 2, 24*time.Hour)
+	server.SetReadOnlyFunc(func() bool { return readOnly })
+
+	unary := ReadOnlyInterceptor(server.isReadOnly)
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	for _, method := range []string{
+		"/nkudo.controlplane.v1.TenantControlService/ApplyPlan",
+		"/nkudo.controlplane.v1.EnrollmentService/Enroll",
+	} {
+		_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		if status.Code(err) != codes.Unavailable || called {
+			t.Fatalf("%s: expected Unavailable without calling the handler, got %v", method, err)
+		}
+	}
+	if _, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/nkudo.controlplane.v1.TenantControlService/GetStatus"}, handler); err != nil || !called {
+		t.Fatalf("expected status queries to be served, got %v", err)
+	}
+
+	stream := StreamReadOnlyInterceptor(server.isReadOnly)
+	streamHandler := func(srv interface{}, stream grpc.ServerStream) error { return nil }
+	info := &grpc.StreamServerInfo{FullMethod: "/nkudo.controlplane.v1.AgentControlService/StreamLogs"}
+	if err := stream(nil, nil, info, streamHandler); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected log uploads to be refused, got %v", err)
+	}
+
+	// The heartbeat is answered before the (nil) repository is touched,
+	// so nothing is recorded and no plan is leased.
+	ctx := context.WithValue(context.Background(), ctxAgentIDKey, store.Agent{ID: "agent-1"})
+	resp, err := server.Heartbeat(ctx, &controlplanev1.HeartbeatRequest{AgentId: "agent-1"})
+	if err != nil || resp.NextHeartbeatSeconds != 15 || len(resp.PendingPlans) != 0 {
+		t.Fatalf("expected a read-only heartbeat without plans, got %v, %v", resp, err)
+	}
+
+	readOnly = false
+	if err := stream(nil, nil, info, streamHandler); err != nil {
+		t.Fatalf("expected log uploads after leaving read-only mode, got %v", err)
+	}
+}
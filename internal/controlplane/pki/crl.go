@@ -215,6 +215,39 @@ func (m *CRLManager) GenerateCRL() error {
 	return m.generateCRLLocked()
 }
 
+// SetIssuer switches the CA that signs the CRL, as after a CA rotation,
+// and regenerates the CRL.
+func (m *CRLManager) SetIssuer(caCert *x509.Certificate, caKey *rsa.PrivateKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.caCert = caCert
+	m.caKey = caKey
+	return m.generateCRLLocked()
+}
+
+// Load replaces the revocation list with entries, as read from the
+// database, and regenerates the CRL. Unlike Revoke it keeps the given
+// revocation times. Entries revoked here since keepSince, which the read
+// may have missed, are kept.
+func (m *CRLManager) Load(entries []RevokedCertificate, keepSince time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revoked := make(map[string]*RevokedCertificate, len(entries))
+	for _, entry := range entries {
+		entry := entry
+		revoked[entry.SerialNumber] = &entry
+	}
+	for serial, entry := range m.revoked {
+		if _, ok := revoked[serial]; !ok && !entry.RevokedAt.Before(keepSince) {
+			revoked[serial] = entry
+		}
+	}
+	m.revoked = revoked
+	return m.generateCRLLocked()
+}
+
 // RemoveRevocation removes a certificate from the revocation list (for testing/admin)
 func (m *CRLManager) RemoveRevocation(serial string) error {
 	m.mu.Lock()
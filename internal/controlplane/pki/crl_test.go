@@ -223,6 +223,43 @@ func TestCRLManager_RemoveRevocation(t *testing.T) {
 	}
 }
 
+func TestCRLManager_Load(t *testing.T) {
+	caCert, caKey := createTestCA(t)
+	manager := NewCRLManager(caCert, caKey, "")
+
+	if err := manager.Revoke("111", ReasonKeyCompromise, "agent-1"); err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+	loadStarted := time.Now().UTC()
+	if err := manager.Revoke("222", ReasonSuperseded, "agent-2"); err != nil {
+		t.Fatalf("failed to revoke certificate: %v", err)
+	}
+
+	revokedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	err := manager.Load([]RevokedCertificate{{SerialNumber: "333", RevokedAt: revokedAt, Reason: ReasonKeyCompromise, AgentID: "agent-3"}}, loadStarted)
+	if err != nil {
+		t.Fatalf("failed to load revocations: %v", err)
+	}
+
+	if manager.IsRevoked("111") {
+		t.Error("expected a revocation missing from the load to be dropped")
+	}
+	if !manager.IsRevoked("222") {
+		t.Error("expected a revocation made during the load to be kept")
+	}
+	entry, ok := manager.GetRevokedCertificate("333")
+	if !ok || !entry.RevokedAt.Equal(revokedAt) {
+		t.Fatalf("expected the loaded revocation with its time, got %+v", entry)
+	}
+	crl, err := x509.ParseRevocationList(manager.GetCRL())
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("expected 2 CRL entries, got %d", len(crl.RevokedCertificateEntries))
+	}
+}
+
 func TestCRLManager_GetLastUpdated(t *testing.T) {
 	caCert, caKey := createTestCA(t)
 	manager := NewCRLManager(caCert, caKey, "http://example.com/crl")
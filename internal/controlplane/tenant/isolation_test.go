@@ -2,6 +2,7 @@ package tenant
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
@@ -48,24 +49,28 @@ func (m *mockRepo) ValidateAPIKey(ctx context.Context, keyHash string) (store.AP
 func (m *mockRepo) CreateSite(ctx context.Context, site store.Site) (store.Site, error) { return site, nil }
 func (m *mockRepo) ListSites(ctx context.Context, tenantID string) ([]store.Site, error) { return nil, nil }
 func (m *mockRepo) IssueEnrollmentToken(ctx context.Context, token store.EnrollmentToken) (store.EnrollmentToken, error) { return token, nil }
+func (m *mockRepo) EnrollmentTokenSite(ctx context.Context, tokenHash string, now time.Time) (string, error) { return "", nil }
 func (m *mockRepo) ConsumeEnrollmentToken(ctx context.Context, tokenHash string, now time.Time) (store.TokenConsumeResult, error) { return store.TokenConsumeResult{}, nil }
 func (m *mockRepo) CreateAgentFromEnrollment(ctx context.Context, tokenID string, agent store.Agent, hostname string) (store.Agent, error) { return agent, nil }
 func (m *mockRepo) GetAgentByID(ctx context.Context, agentID string) (store.Agent, error) { return store.Agent{}, nil }
+func (m *mockRepo) GetAgentEnrollment(ctx context.Context, agentID string) (store.AgentEnrollment, error) { return store.AgentEnrollment{}, nil }
 func (m *mockRepo) IngestHeartbeat(ctx context.Context, hb store.Heartbeat) error { return nil }
 func (m *mockRepo) ApplyPlan(ctx context.Context, input store.ApplyPlanInput) (store.ApplyPlanResult, error) { return store.ApplyPlanResult{}, nil }
 func (m *mockRepo) LeasePendingPlans(ctx context.Context, agentID string, limit int, leaseTTL time.Duration) ([]store.LeasedPlan, error) { return nil, nil }
 func (m *mockRepo) ReportPlanResult(ctx context.Context, agentID string, report store.PlanResultReport) error { return nil }
 func (m *mockRepo) IngestLogs(ctx context.Context, req store.LogIngest) (accepted int64, dropped int64, err error) { return 0, 0, nil }
-func (m *mockRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) (int64, error) { return 0, nil }
+func (m *mockRepo) SweepOfflineAgents(ctx context.Context, staleBefore time.Time) ([]store.Agent, error) { return nil, nil }
 func (m *mockRepo) ListHosts(ctx context.Context, tenantID, siteID string) ([]store.Host, error) { return nil, nil }
 func (m *mockRepo) ListVMs(ctx context.Context, tenantID, siteID string) ([]store.MicroVM, error) { return nil, nil }
 func (m *mockRepo) ListExecutionLogs(ctx context.Context, tenantID, executionID string, limit int) ([]store.ExecutionLog, error) { return nil, nil }
+func (m *mockRepo) GetExecutionLogStats(ctx context.Context, tenantID, executionID string) (store.ExecutionLogStats, error) { return store.ExecutionLogStats{}, nil }
 func (m *mockRepo) WriteAudit(ctx context.Context, tenantID, siteID, actorType, actorID, action, resourceType, resourceID, requestID, sourceIP string, metadata []byte) error { return nil }
 func (m *mockRepo) ListEnrollmentTokens(ctx context.Context, tenantID string) ([]store.EnrollmentTokenWithStatus, error) { return nil, nil }
 func (m *mockRepo) ListExecutions(ctx context.Context, tenantID, siteID string, statuses []string, limit int) ([]store.ExecutionWithTimestamps, error) { return nil, nil }
 func (m *mockRepo) ListAPIKeys(ctx context.Context, tenantID string) ([]store.APIKey, error) { return nil, nil }
 func (m *mockRepo) DeleteAPIKey(ctx context.Context, tenantID, keyID string) error { return nil }
 func (m *mockRepo) UnenrollAgent(ctx context.Context, agentID string) error { return nil }
+func (m *mockRepo) ReleaseAgentPlans(ctx context.Context, agentID string) ([]string, error) { return nil, nil }
 func (m *mockRepo) UpdateAgentCertificate(ctx context.Context, agentID, certSerial, refreshTokenHash string) error { return nil }
 func (m *mockRepo) ListCertificateHistory(ctx context.Context, agentID string, limit int) ([]store.CertificateHistory, error) { return nil, nil }
 func (m *mockRepo) RecordCertificateIssuance(ctx context.Context, history store.CertificateHistory) error { return nil }
@@ -75,7 +80,7 @@ func (m *mockRepo) UpdateAuditEventValidity(ctx context.Context, id int64, valid
 func (m *mockRepo) ListAuditEvents(ctx context.Context, tenantID string, limit int) ([]store.AuditEvent, error) { return nil, nil }
 func (m *mockRepo) RevokeCertificate(ctx context.Context, serial string, reason int, agentID string) error { return nil }
 func (m *mockRepo) IsCertificateRevoked(ctx context.Context, serial string) (bool, error) { return false, nil }
-func (m *mockRepo) ListRevokedCertificates(ctx context.Context) ([]store.CRLEntry, error) { return nil, nil }
+func (m *mockRepo) ListRevokedCertificates(ctx context.Context, query store.RevokedCertificateQuery) ([]store.CRLEntry, error) { return nil, nil }
 func (m *mockRepo) GetTenantUsage(ctx context.Context, tenantID string) (*store.TenantUsage, error) { return nil, nil }
 func (m *mockRepo) GetTenantLimits(ctx context.Context, tenantID string) (*store.QuotaLimits, error) { return nil, nil }
 func (m *mockRepo) SetTenantLimits(ctx context.Context, tenantID string, limits store.QuotaLimits) error { return nil }
@@ -102,6 +107,56 @@ func (m *mockRepo) AttachVMToNetwork(ctx context.Context, attachment store.VMNet
 func (m *mockRepo) DetachVMFromNetwork(ctx context.Context, vmID, networkID string) error { return nil }
 func (m *mockRepo) ListVMNetworkAttachments(ctx context.Context, vmID string) ([]store.VMNetworkAttachment, error) { return nil, nil }
 func (m *mockRepo) ListNetworkVMAttachments(ctx context.Context, networkID string) ([]store.VMNetworkAttachment, error) { return nil, nil }
+func (m *mockRepo) GetAgentNetworkStatus(ctx context.Context, tenantID, agentID string) (store.AgentNetworkStatus, error) { return store.AgentNetworkStatus{}, store.ErrNotFound }
+func (m *mockRepo) ListAgentMetrics(ctx context.Context, tenantID, siteID string) ([]store.AgentMetrics, error) { return nil, nil }
+func (m *mockRepo) ListAgentConnectivityHistory(ctx context.Context, tenantID, agentID string, from, to time.Time, limit int) ([]store.ConnectivityTransition, error) { return nil, nil }
+func (m *mockRepo) GetPlan(ctx context.Context, tenantID, planID string) (store.Plan, error) { return store.Plan{}, store.ErrNotFound }
+func (m *mockRepo) GetPlanStats(ctx context.Context, tenantID, siteID string, from, to time.Time) (store.PlanStats, error) { return store.PlanStats{}, nil }
+func (m *mockRepo) RevokeTenantAgentCertificates(ctx context.Context, tenantID string, reason int) ([]store.Agent, error) { return nil, nil }
+func (m *mockRepo) ListPrometheusTargets(ctx context.Context, tenantID, siteID string) ([]store.PrometheusTarget, error) { return nil, nil }
+func (m *mockRepo) SetHostMaintenance(ctx context.Context, tenantID, siteID, hostID string, maintenance bool) (store.Host, error) { return store.Host{}, nil }
+func (m *mockRepo) SetAgentMetadata(ctx context.Context, tenantID, siteID, agentID string, metadata json.RawMessage) error { return nil }
+func (m *mockRepo) AgentHostInMaintenance(ctx context.Context, agentID string) (bool, error) { return false, nil }
+func (m *mockRepo) GetCapacity(ctx context.Context, tenantID, siteID string) (store.Capacity, error) { return store.Capacity{}, nil }
+func (m *mockRepo) SetTenantLogSeverity(ctx context.Context, tenantID, severity string) (store.Tenant, error) { return store.Tenant{}, nil }
+func (m *mockRepo) RecordTenantUsage(ctx context.Context, tenantID string, at time.Time, usage store.TenantUsage) error { return nil }
+func (m *mockRepo) ListTenantUsageHistory(ctx context.Context, tenantID string, from, to time.Time) ([]store.TenantUsageSnapshot, error) { return nil, nil }
+func (m *mockRepo) PruneTenantUsageHistory(ctx context.Context, cutoff time.Time) (int64, error) { return 0, nil }
+func (m *mockRepo) RetryPlan(ctx context.Context, tenantID, planID string, failedOnly bool) (store.ApplyPlanResult, error) { return store.ApplyPlanResult{}, nil }
+func (m *mockRepo) MigrateVM(ctx context.Context, tenantID, siteID, vmID, targetHostID string) (store.VMMigration, error) { return store.VMMigration{}, nil }
+func (m *mockRepo) GetVMMigration(ctx context.Context, tenantID, migrationID string) (store.VMMigration, error) { return store.VMMigration{}, nil }
+func (m *mockRepo) ListVMNetworks(ctx context.Context, tenantID, vmID string) ([]store.VMNetworkAttachmentWithNetwork, error) { return nil, nil }
+func (m *mockRepo) ListVMDNSRecords(ctx context.Context, siteID, networkID string) ([]store.VMDNSRecord, error) { return nil, nil }
+func (m *mockRepo) PutExecutionConsoleLog(ctx context.Context, agentID string, upload store.ConsoleLogUpload) (store.ExecutionConsoleLog, error) { return store.ExecutionConsoleLog{}, nil }
+func (m *mockRepo) GetExecutionConsoleLog(ctx context.Context, tenantID, executionID string) (store.ExecutionConsoleLog, error) { return store.ExecutionConsoleLog{}, nil }
+func (m *mockRepo) PutQuotaTemplate(ctx context.Context, template store.QuotaTemplate) (store.QuotaTemplate, error) { return template, nil }
+func (m *mockRepo) GetQuotaTemplate(ctx context.Context, name string) (store.QuotaTemplate, error) { return store.QuotaTemplate{}, nil }
+func (m *mockRepo) ListQuotaTemplates(ctx context.Context) ([]store.QuotaTemplate, error) { return nil, nil }
+func (m *mockRepo) DeleteQuotaTemplate(ctx context.Context, name string) error { return nil }
+func (m *mockRepo) CreateWebhook(ctx context.Context, webhook store.Webhook) (store.Webhook, error) { return webhook, nil }
+func (m *mockRepo) ListWebhooks(ctx context.Context, tenantID string) ([]store.Webhook, error) { return nil, nil }
+func (m *mockRepo) DeleteWebhook(ctx context.Context, tenantID, webhookID string) error { return nil }
+func (m *mockRepo) ListSiteWebhooks(ctx context.Context, siteID string) ([]store.Webhook, error) { return nil, nil }
+func (m *mockRepo) ListTenantAgents(ctx context.Context, tenantID string, query store.TenantAgentQuery) ([]store.TenantAgent, error) { return nil, nil }
+func (m *mockRepo) ListLeasedPlans(ctx context.Context, tenantID, agentID string) ([]store.LeasedPlan, error) { return nil, nil }
+func (m *mockRepo) ListPlanExecutions(ctx context.Context, tenantID, planID string) ([]store.Execution, error) { return nil, nil }
+func (m *mockRepo) GetSiteImageDefaults(ctx context.Context, tenantID, siteID string) (map[string]store.VMImage, error) { return nil, nil }
+func (m *mockRepo) SetSiteImageDefaults(ctx context.Context, tenantID, siteID string, images map[string]store.VMImage) error { return nil }
+func (m *mockRepo) SetSiteVMNamePolicy(ctx context.Context, tenantID, siteID string, uniqueNames bool, nameTemplate string) error { return nil }
+func (m *mockRepo) GetSiteDesiredState(ctx context.Context, tenantID, siteID string) (store.DesiredState, error) { return store.DesiredState{}, nil }
+func (m *mockRepo) SetSiteDesiredState(ctx context.Context, tenantID, siteID string, state store.DesiredState) error { return nil }
+func (m *mockRepo) ListAuditEventsAfter(ctx context.Context, afterID int64, limit int) ([]store.AuditEvent, error) { return nil, nil }
+func (m *mockRepo) GetAuditCheckpoint(ctx context.Context) (store.AuditCheckpoint, error) { return store.AuditCheckpoint{}, nil }
+func (m *mockRepo) SetAuditCheckpoint(ctx context.Context, checkpoint store.AuditCheckpoint) error { return nil }
+func (m *mockRepo) GetSiteAgentRollout(ctx context.Context, tenantID, siteID string) (store.AgentRollout, error) { return store.AgentRollout{}, nil }
+func (m *mockRepo) SetSiteAgentRollout(ctx context.Context, tenantID, siteID string, rollout store.AgentRollout) error { return nil }
+func (m *mockRepo) ClaimAgentUpgrade(ctx context.Context, agentID, version string) (string, error) { return "", nil }
+func (m *mockRepo) ReportAgentUpgrade(ctx context.Context, agentID string, report store.AgentUpgradeReport) error { return nil }
+func (m *mockRepo) ListSiteAgentUpgrades(ctx context.Context, tenantID, siteID string) ([]store.AgentUpgrade, error) { return nil, nil }
+func (m *mockRepo) RotateTenantEncryption(ctx context.Context) (int64, error) { return 0, nil }
+func (m *mockRepo) ExpirePendingPlans(ctx context.Context, createdBefore time.Time) ([]store.Plan, error) { return nil, nil }
+func (m *mockRepo) PurgePlans(ctx context.Context, createdBefore time.Time) (int64, error) { return 0, nil }
+func (m *mockRepo) ReleaseIdempotencyKeys(ctx context.Context, createdBefore time.Time) (int64, error) { return 0, nil }
 
 func TestEnforceTenantAccess(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,219 @@
+// Package cgroup places VMM processes in cgroup v2 groups limited to the
+// resources of their VM, so a runaway VMM cannot starve the host.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// DefaultRoot is the cgroup under which each VM gets its own group.
+	DefaultRoot = "/sys/fs/cgroup/nkudo"
+	// DefaultMemoryOverheadMiB is the memory a VMM needs beyond the guest's
+	// for its own heap, device emulation and page tables.
+	DefaultMemoryOverheadMiB = 128
+
+	// cpuPeriod is the cpu.max period in microseconds.
+	cpuPeriod = 100000
+	// cpuWeightPerVCPU is the cpu.weight of one vCPU; the kernel default
+	// weight of a group is 100.
+	cpuWeightPerVCPU = 100
+	maxCPUWeight     = 10000
+)
+
+// Limits are the cgroup v2 settings of one VM. The guest's size is both
+// its request, a share of contended CPU and memory protected from reclaim,
+// and its limit, the CPU time and memory it may never exceed.
+type Limits struct {
+	// CPUWeight is cpu.weight, the VM's share of contended CPU.
+	CPUWeight int
+	// CPUQuota is the cpu.max quota per cpuPeriod; zero leaves CPU
+	// unlimited.
+	CPUQuota int64
+	// MemoryLow is memory.low in bytes, memory protected from reclaim.
+	MemoryLow int64
+	// MemoryMax is memory.max in bytes; the VMM is OOM-killed above it.
+	// Zero leaves memory unlimited.
+	MemoryMax int64
+}
+
+// files renders l as cgroup interface files and their contents, in the
+// order they are written.
+func (l Limits) files() [][2]string {
+	var files [][2]string
+	if l.CPUWeight > 0 {
+		files = append(files, [2]string{"cpu.weight", strconv.Itoa(l.CPUWeight)})
+	}
+	cpuMax := "max"
+	if l.CPUQuota > 0 {
+		cpuMax = strconv.FormatInt(l.CPUQuota, 10)
+	}
+	files = append(files, [2]string{"cpu.max", cpuMax + " " + strconv.Itoa(cpuPeriod)})
+	if l.MemoryLow > 0 {
+		files = append(files, [2]string{"memory.low", strconv.FormatInt(l.MemoryLow, 10)})
+	}
+	memMax := "max"
+	if l.MemoryMax > 0 {
+		memMax = strconv.FormatInt(l.MemoryMax, 10)
+	}
+	files = append(files, [2]string{"memory.max", memMax})
+	return files
+}
+
+// FS is the cgroup filesystem. It is stubbed in tests.
+type FS interface {
+	Mkdir(path string) error
+	WriteFile(path string, data []byte) error
+	// Remove removes an empty cgroup directory.
+	Remove(path string) error
+	Exists(path string) bool
+}
+
+type osFS struct{}
+
+func (osFS) Mkdir(path string) error {
+	if err := os.Mkdir(path, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (osFS) WriteFile(path string, data []byte) error {
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (osFS) Remove(path string) error { return os.Remove(path) }
+
+func (osFS) Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Manager creates one cgroup per VM under Root. A nil Manager does
+// nothing, so providers call it unconditionally.
+type Manager struct {
+	// Root is the parent cgroup of the VM groups; empty uses DefaultRoot.
+	Root string
+	// MemoryOverheadMiB is added to the guest memory for memory.max; zero
+	// uses DefaultMemoryOverheadMiB.
+	MemoryOverheadMiB int
+	// FS is the cgroup filesystem; nil uses the host's.
+	FS FS
+}
+
+func (m *Manager) fs() FS {
+	if m.FS == nil {
+		return osFS{}
+	}
+	return m.FS
+}
+
+func (m *Manager) root() string {
+	if m.Root == "" {
+		return DefaultRoot
+	}
+	return m.Root
+}
+
+// Available reports whether the parent of Root is on a cgroup v2
+// hierarchy, which is the only one Manager supports.
+func (m *Manager) Available() error {
+	parent := filepath.Dir(m.root())
+	if !m.fs().Exists(filepath.Join(parent, "cgroup.controllers")) {
+		return fmt.Errorf("%s is not a cgroup v2 hierarchy", parent)
+	}
+	return nil
+}
+
+// LimitsFor derives the limits of a VM with vcpu vCPUs and memMiB MiB of
+// guest memory.
+func (m *Manager) LimitsFor(vcpu, memMiB int) Limits {
+	overhead := m.MemoryOverheadMiB
+	if overhead <= 0 {
+		overhead = DefaultMemoryOverheadMiB
+	}
+	var l Limits
+	if vcpu > 0 {
+		l.CPUWeight = min(vcpu*cpuWeightPerVCPU, maxCPUWeight)
+		l.CPUQuota = int64(vcpu) * cpuPeriod
+	}
+	if memMiB > 0 {
+		l.MemoryLow = int64(memMiB) << 20
+		l.MemoryMax = int64(memMiB+overhead) << 20
+	}
+	return l
+}
+
+// Path returns the cgroup directory of vmID.
+func (m *Manager) Path(vmID string) string {
+	return filepath.Join(m.root(), "vm-"+vmID)
+}
+
+// Prepare creates the cgroup of vmID and writes limits, returning its
+// directory. The VMM is then started in it with Attach, so the limits hold
+// from its first instruction.
+func (m *Manager) Prepare(vmID string, limits Limits) (string, error) {
+	fs := m.fs()
+	root := m.root()
+	if err := fs.Mkdir(root); err != nil {
+		return "", fmt.Errorf("create %s: %w", root, err)
+	}
+	// Children of root can only use controllers enabled in its subtree.
+	if err := fs.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory")); err != nil {
+		return "", fmt.Errorf("enable cpu and memory controllers in %s: %w", root, err)
+	}
+	dir := m.Path(vmID)
+	if err := fs.Mkdir(dir); err != nil {
+		return "", fmt.Errorf("create %s: %w", dir, err)
+	}
+	for _, f := range limits.files() {
+		if err := fs.WriteFile(filepath.Join(dir, f[0]), []byte(f[1])); err != nil {
+			return "", fmt.Errorf("write %s: %w", filepath.Join(dir, f[0]), err)
+		}
+	}
+	return dir, nil
+}
+
+// Attach prepares the cgroup of vmID with limits and sets cmd to start
+// inside it (clone3 with CLONE_INTO_CGROUP), so the process never runs
+// outside its limits, not even between its start and a move into the
+// group. release closes the group's descriptor and must be called once
+// cmd has been started. On error cmd is left unchanged. A nil Manager
+// does nothing.
+func (m *Manager) Attach(cmd *exec.Cmd, vmID string, limits Limits) (release func(), err error) {
+	if m == nil {
+		return func() {}, nil
+	}
+	dir, err := m.Prepare(vmID, limits)
+	if err != nil {
+		return func() {}, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return func() {}, fmt.Errorf("open %s: %w", dir, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(f.Fd())
+	return func() { _ = f.Close() }, nil
+}
+
+// Remove deletes the cgroup of vmID. The group must have no processes
+// left; a missing group is not an error.
+func (m *Manager) Remove(vmID string) error {
+	if m == nil {
+		return nil
+	}
+	if err := m.fs().Remove(m.Path(vmID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+type fakeFS struct {
+	dirs   map[string]bool
+	writes [][2]string
+	fail   string
+}
+
+func (f *fakeFS) Mkdir(path string) error {
+	if f.dirs == nil {
+		f.dirs = map[string]bool{}
+	}
+	f.dirs[path] = true
+	return nil
+}
+
+func (f *fakeFS) WriteFile(path string, data []byte) error {
+	if path == f.fail {
+		return errors.New("permission denied")
+	}
+	f.writes = append(f.writes, [2]string{path, string(data)})
+	return nil
+}
+
+func (f *fakeFS) Remove(path string) error {
+	if !f.dirs[path] {
+		return os.ErrNotExist
+	}
+	delete(f.dirs, path)
+	return nil
+}
+
+func (f *fakeFS) Exists(path string) bool { return f.dirs[path] }
+
+func TestPrepareWritesLimits(t *testing.T) {
+	fs := &fakeFS{}
+	m := &Manager{Root: "/cg/nkudo", MemoryOverheadMiB: 64, FS: fs}
+	dir, err := m.Prepare("vm-1", m.LimitsFor(2, 1024))
+	if err != nil || dir != "/cg/nkudo/vm-vm-1" {
+		t.Fatalf("prepare: %q, %v", dir, err)
+	}
+	want := [][2]string{
+		{"/cg/nkudo/cgroup.subtree_control", "+cpu +memory"},
+		{"/cg/nkudo/vm-vm-1/cpu.weight", "200"},
+		{"/cg/nkudo/vm-vm-1/cpu.max", "200000 100000"},
+		{"/cg/nkudo/vm-vm-1/memory.low", "1073741824"},
+		{"/cg/nkudo/vm-vm-1/memory.max", "1140850688"},
+	}
+	if len(fs.writes) != len(want) {
+		t.Fatalf("got writes %v, want %v", fs.writes, want)
+	}
+	for i := range want {
+		if fs.writes[i] != want[i] {
+			t.Fatalf("write %d: got %v, want %v", i, fs.writes[i], want[i])
+		}
+	}
+
+	if err := m.Remove("vm-1"); err != nil || fs.dirs["/cg/nkudo/vm-vm-1"] {
+		t.Fatalf("expected the group to be removed, got %v", err)
+	}
+	if err := m.Remove("vm-1"); err != nil {
+		t.Fatalf("expected removing a missing group to succeed, got %v", err)
+	}
+}
+
+func TestLimitsForUnsizedVMLeaveResourcesUnlimited(t *testing.T) {
+	fs := &fakeFS{}
+	m := &Manager{Root: "/cg/nkudo", FS: fs}
+	if _, err := m.Prepare("vm-2", m.LimitsFor(0, 0)); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	got := map[string]string{}
+	for _, w := range fs.writes {
+		got[w[0]] = w[1]
+	}
+	if got["/cg/nkudo/vm-vm-2/cpu.max"] != "max 100000" || got["/cg/nkudo/vm-vm-2/memory.max"] != "max" {
+		t.Fatalf("expected unlimited cpu and memory, got %v", got)
+	}
+	if l := m.LimitsFor(1, 512); l.MemoryMax != int64(512+DefaultMemoryOverheadMiB)<<20 {
+		t.Fatalf("expected the default overhead, got memory.max %d", l.MemoryMax)
+	}
+	if l := m.LimitsFor(500, 0); l.CPUWeight != maxCPUWeight {
+		t.Fatalf("expected cpu.weight to be capped, got %d", l.CPUWeight)
+	}
+}
+
+func TestPrepareFailuresAndAvailability(t *testing.T) {
+	fs := &fakeFS{fail: "/cg/nkudo/vm-vm-3/memory.max"}
+	m := &Manager{Root: "/cg/nkudo", FS: fs}
+	if _, err := m.Prepare("vm-3", m.LimitsFor(1, 256)); err == nil {
+		t.Fatal("expected a failed limit write to be reported")
+	}
+
+	if err := m.Available(); err == nil {
+		t.Fatal("expected a hierarchy without cgroup.controllers to be unavailable")
+	}
+	fs.dirs["/cg/cgroup.controllers"] = true
+	if err := m.Available(); err != nil {
+		t.Fatalf("expected cgroup v2 to be available: %v", err)
+	}
+}
+
+func TestAttachStartsTheCommandInTheGroup(t *testing.T) {
+	m := &Manager{Root: filepath.Join(t.TempDir(), "nkudo")}
+	cmd := exec.Command("true")
+	release, err := m.Attach(cmd, "vm-5", m.LimitsFor(1, 256))
+	if err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	defer release()
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.UseCgroupFD || cmd.SysProcAttr.CgroupFD <= 0 {
+		t.Fatalf("expected the command to start in the group, got %+v", cmd.SysProcAttr)
+	}
+	if data, err := os.ReadFile(filepath.Join(m.Path("vm-5"), "cpu.max")); err != nil || string(data) != "100000 100000" {
+		t.Fatalf("expected limits written before the start, got %q, %v", data, err)
+	}
+
+	failing := &Manager{Root: "/cg/nkudo", FS: &fakeFS{fail: "/cg/nkudo/vm-vm-6/cpu.max"}}
+	cmd = exec.Command("true")
+	if _, err := failing.Attach(cmd, "vm-6", failing.LimitsFor(1, 256)); err == nil || cmd.SysProcAttr != nil {
+		t.Fatalf("expected a group without its limits not to be used, got %v, %+v", err, cmd.SysProcAttr)
+	}
+
+	var nilManager *Manager
+	cmd = exec.Command("true")
+	if _, err := nilManager.Attach(cmd, "vm-7", Limits{}); err != nil || cmd.SysProcAttr != nil {
+		t.Fatalf("expected a nil manager to do nothing, got %v", err)
+	}
+}
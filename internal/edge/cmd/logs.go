@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/execlog"
+)
+
+const logsUsage = `Usage: edge logs --execution <id> [options]
+
+Print the locally recorded logs for a plan execution. Works without a
+connection to the control plane.
+
+Options:
+  --execution string     Execution ID (required)
+  --runtime-dir string   Runtime directory (default "/var/lib/nkudo-edge/vms")
+  --follow               Keep printing new log lines until interrupted
+`
+
+// LogsOptions holds the configuration for the logs command
+type LogsOptions struct {
+	ExecutionID string
+	RuntimeDir  string
+	Follow      bool
+}
+
+// RunLogs executes the logs command
+func RunLogs(args []string) error {
+	opts := LogsOptions{}
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.StringVar(&opts.ExecutionID, "execution", "", "Execution ID")
+	fs.StringVar(&opts.RuntimeDir, "runtime-dir", "/var/lib/nkudo-edge/vms", "Runtime directory")
+	fs.BoolVar(&opts.Follow, "follow", false, "Keep printing new log lines until interrupted")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(opts.ExecutionID) == "" {
+		return errors.New("--execution is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := streamLogs(ctx, os.Stdout, opts)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no local logs for execution %s", opts.ExecutionID)
+	}
+	return err
+}
+
+func streamLogs(ctx context.Context, out io.Writer, opts LogsOptions) error {
+	store := execlog.New(execlog.DirFor(opts.RuntimeDir))
+	return store.Follow(ctx, opts.ExecutionID, opts.Follow, func(rec execlog.Record) error {
+		_, err := fmt.Fprintln(out, formatLogRecord(rec))
+		return err
+	})
+}
+
+func formatLogRecord(rec execlog.Record) string {
+	ts := rec.Timestamp.Local().Format(time.RFC3339)
+	if rec.ActionID != "" {
+		return fmt.Sprintf("%s %-5s [%s] %s", ts, rec.Level, rec.ActionID, rec.Message)
+	}
+	return fmt.Sprintf("%s %-5s %s", ts, rec.Level, rec.Message)
+}
+
+// LogsHelp returns the help text for the logs command
+func LogsHelp() string {
+	return logsUsage
+}
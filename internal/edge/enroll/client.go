@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync/atomic"
@@ -18,10 +21,17 @@ import (
 type Client struct {
 	BaseURL string
 	HTTP    *http.Client
-	seq     atomic.Uint64
+	// HeartbeatGzipThreshold gzips heartbeat bodies of at least this many
+	// bytes; zero sends them uncompressed.
+	HeartbeatGzipThreshold int
+	seq                    atomic.Uint64
 }
 
+// EnrollSchemaVersion is the enroll payload schema this agent sends.
+const EnrollSchemaVersion = 1
+
 type EnrollRequest struct {
+	SchemaVersion   int               `json:"schema_version"`
 	EnrollmentToken string            `json:"enrollment_token"`
 	AgentVersion    string            `json:"agent_version"`
 	RequestedHost   string            `json:"requested_hostname"`
@@ -46,9 +56,13 @@ type EnrollResponse struct {
 	RefreshToken         string `json:"refresh_token"`
 	HeartbeatEndpoint    string `json:"heartbeat_endpoint"`
 	HeartbeatIntervalSec int    `json:"heartbeat_interval_seconds"`
+	ServerVersion        string `json:"server_version,omitempty"`
 }
 
 func (c *Client) Enroll(ctx context.Context, req EnrollRequest) (EnrollResponse, error) {
+	if req.SchemaVersion == 0 {
+		req.SchemaVersion = EnrollSchemaVersion
+	}
 	payload, err := json.Marshal(req)
 	if err != nil {
 		return EnrollResponse{}, fmt.Errorf("marshal enroll request: %w", err)
@@ -67,7 +81,7 @@ func (c *Client) Enroll(ctx context.Context, req EnrollRequest) (EnrollResponse,
 
 	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return EnrollResponse{}, fmt.Errorf("enroll failed status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return EnrollResponse{}, &EnrollError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
 	}
 
 	var out EnrollResponse
@@ -80,6 +94,41 @@ func (c *Client) Enroll(ctx context.Context, req EnrollRequest) (EnrollResponse,
 	return out, nil
 }
 
+// EnrollError is an enrollment the control plane answered with a non-2xx
+// status.
+type EnrollError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *EnrollError) Error() string {
+	return fmt.Sprintf("enroll failed status=%d body=%s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether an Enroll error is transient: the control
+// plane was unreachable, timed out or failed with 5xx, 408 or 429.
+// Rejections such as an invalid or spent token (401), a bad CSR (400) or
+// an untrusted server certificate are permanent; retrying them cannot
+// succeed.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var enrollErr *EnrollError
+	if errors.As(err, &enrollErr) {
+		code := enrollErr.StatusCode
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
 func BuildFingerprint() HostFingerprint {
 	f := HostFingerprint{}
 	if machineID, err := os.ReadFile("/etc/machine-id"); err == nil {
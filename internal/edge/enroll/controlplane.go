@@ -2,8 +2,10 @@ package enroll
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -16,21 +18,65 @@ import (
 	"github.com/kubedoio/n-kudo/internal/edge/state"
 )
 
+// HeartbeatSchemaVersion is the heartbeat payload schema this agent sends:
+// host facts nested under host_facts and VM state in "status".
+const HeartbeatSchemaVersion = 2
+
+// HeartbeatRequest is the agent's heartbeat. HeartbeatSeq numbers the
+// agent's heartbeats; the control plane drops one that is not above the last
+// it applied, and never drops a zero one.
 type HeartbeatRequest struct {
+	SchemaVersion int             `json:"schema_version"`
 	TenantID      string          `json:"tenant_id"`
 	SiteID        string          `json:"site_id"`
 	HostID        string          `json:"host_id"`
 	AgentID       string          `json:"agent_id"`
+	AgentVersion  string          `json:"agent_version,omitempty"`
+	HeartbeatSeq  int64           `json:"heartbeat_seq,omitempty"`
 	SentAt        time.Time       `json:"sent_at"`
 	HostFacts     hostfacts.Facts `json:"host_facts"`
+	FactsError    string          `json:"facts_error,omitempty"`
+	MetricsAddr   string          `json:"metrics_addr,omitempty"`
 	NetBirdStatus netbird.Status  `json:"netbird_status"`
 	MicroVMs      []state.MicroVM `json:"microvms"`
 	Shutdown      bool            `json:"shutdown,omitempty"`
+	// ShutdownReason says why the agent stopped: one of the model.Shutdown
+	// reasons.
+	ShutdownReason string `json:"shutdown_reason,omitempty"`
+	// Metrics is a compact metrics snapshot pushed for hosts the control
+	// plane cannot scrape; see metrics.Snapshot.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
 }
 
 type HeartbeatResponse struct {
 	NextHeartbeatSeconds int             `json:"next_heartbeat_seconds"`
 	PendingPlans         []executor.Plan `json:"pending_plans"`
+	Maintenance          bool            `json:"maintenance,omitempty"`
+	// Stale is set when the control plane dropped the heartbeat because it
+	// already applied a newer one.
+	Stale bool `json:"stale,omitempty"`
+	// TargetAgentVersion is set when the site's rollout wants this agent
+	// on another version.
+	TargetAgentVersion string `json:"target_agent_version,omitempty"`
+	// DNSRecords are the hostnames of the site's VMs on their VXLAN
+	// networks. It is nil unless the control plane registers VM DNS.
+	DNSRecords []DNSRecord `json:"dns_records,omitempty"`
+}
+
+// DNSRecord maps the hostname of a VM to its address on a VXLAN network.
+type DNSRecord struct {
+	NetworkID string `json:"network_id"`
+	VMID      string `json:"vm_id"`
+	Hostname  string `json:"hostname"`
+	IPAddress string `json:"ip_address"`
+}
+
+// AgentUpgradeReport is the outcome of running the upgrade hook for a
+// target agent version.
+type AgentUpgradeReport struct {
+	TargetVersion string `json:"target_version"`
+	OK            bool   `json:"ok"`
+	Message       string `json:"message,omitempty"`
 }
 
 type LogEntry struct {
@@ -50,12 +96,73 @@ func (c *Client) Heartbeat(ctx context.Context, req HeartbeatRequest) (Heartbeat
 	if req.SentAt.IsZero() {
 		req.SentAt = time.Now().UTC()
 	}
-	if err := c.postJSON(ctx, "/v1/heartbeat", req, &out); err != nil {
+	if req.SchemaVersion == 0 {
+		req.SchemaVersion = HeartbeatSchemaVersion
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return HeartbeatResponse{}, err
+	}
+	encoding := ""
+	if c.HeartbeatGzipThreshold > 0 && len(payload) >= c.HeartbeatGzipThreshold {
+		if payload, err = gzipBytes(payload); err != nil {
+			return HeartbeatResponse{}, err
+		}
+		encoding = "gzip"
+	}
+	if err := c.post(ctx, "/v1/heartbeat", payload, encoding, &out); err != nil {
 		return HeartbeatResponse{}, err
 	}
 	return out, nil
 }
 
+// BusyError is returned when the control plane sheds a request under load
+// and names how long to wait before the next attempt.
+type BusyError struct {
+	Path       string
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("request %s shed by busy control plane, retry in %s", e.Path, e.RetryAfter)
+}
+
+// StatusError is returned when the control plane answers a request with a
+// status other than 2xx.
+type StatusError struct {
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request %s failed status=%d body=%s", e.Path, e.StatusCode, e.Body)
+}
+
+// Rejected reports whether err is a 4xx answer other than 408 and 429: the
+// control plane refused the request itself, so resending it cannot
+// succeed.
+func Rejected(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	code := statusErr.StatusCode
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (c *Client) FetchPlans(ctx context.Context, siteID, agentID string) ([]executor.Plan, error) {
 	var out struct {
 		Plans []executor.Plan `json:"plans"`
@@ -71,6 +178,17 @@ func (c *Client) ReportPlanResult(ctx context.Context, result executor.PlanResul
 	return c.postJSON(ctx, "/v1/executions/result", result, nil)
 }
 
+// UploadConsoleLog stores the console log of a VM whose action failed.
+func (c *Client) UploadConsoleLog(ctx context.Context, log executor.ConsoleLog) error {
+	return c.postJSON(ctx, "/v1/executions/console", log, nil)
+}
+
+// ReportAgentUpgrade tells the control plane whether the upgrade hook
+// succeeded; a failure halts the site's rollout.
+func (c *Client) ReportAgentUpgrade(ctx context.Context, report AgentUpgradeReport) error {
+	return c.postJSON(ctx, "/v1/agent-upgrade", report, nil)
+}
+
 func (c *Client) NextSequence() uint64 {
 	return c.seq.Add(1)
 }
@@ -93,19 +211,36 @@ func (c *Client) postJSON(ctx context.Context, path string, reqBody any, out any
 	if err != nil {
 		return err
 	}
+	return c.post(ctx, path, payload, "", out)
+}
+
+// post sends a JSON payload, already encoded with contentEncoding when set,
+// and decodes the response into out.
+func (c *Client) post(ctx context.Context, path string, payload []byte, contentEncoding string, out any) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(c.BaseURL, "/")+path, bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
 	resp, err := c.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	body, _ := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		var busy struct {
+			NextHeartbeatSeconds int `json:"next_heartbeat_seconds"`
+		}
+		if json.Unmarshal(body, &busy) == nil && busy.NextHeartbeatSeconds > 0 {
+			return &BusyError{Path: path, RetryAfter: time.Duration(busy.NextHeartbeatSeconds) * time.Second}
+		}
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("request %s failed status=%d body=%s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+		return &StatusError{Path: path, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
 	}
 	if out == nil || len(body) == 0 {
 		return nil
@@ -125,7 +260,7 @@ func (c *Client) getJSON(ctx context.Context, path string, out any) error {
 	defer resp.Body.Close()
 	body, _ := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("request %s failed status=%d body=%s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+		return &StatusError{Path: path, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
 	}
 	if out == nil {
 		return nil
@@ -2,6 +2,7 @@ package enroll
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -9,7 +10,9 @@ import (
 	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -214,6 +217,57 @@ func TestClientHeartbeat(t *testing.T) {
 	}
 }
 
+func TestClientHeartbeatGzipAboveThreshold(t *testing.T) {
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatalf("gzip reader: %v", err)
+			}
+			body = zr
+		}
+		var req HeartbeatRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		if req.AgentID != "agent-1" {
+			t.Errorf("expected agent-1, got %s", req.AgentID)
+		}
+		json.NewEncoder(w).Encode(HeartbeatResponse{NextHeartbeatSeconds: 30})
+	}))
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL, HTTP: &http.Client{Timeout: 5 * time.Second}, HeartbeatGzipThreshold: 1024}
+	small := HeartbeatRequest{AgentID: "agent-1"}
+	large := HeartbeatRequest{AgentID: "agent-1", FactsError: strings.Repeat("x", 2048)}
+	for _, req := range []HeartbeatRequest{small, large} {
+		if _, err := client.Heartbeat(context.Background(), req); err != nil {
+			t.Fatalf("heartbeat failed: %v", err)
+		}
+	}
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "gzip" {
+		t.Fatalf("expected only the large heartbeat to be gzipped, got %q", encodings)
+	}
+}
+
+func TestClientHeartbeatBusy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]any{"error": "busy", "next_heartbeat_seconds": 4})
+	}))
+	defer server.Close()
+
+	client := &Client{BaseURL: server.URL, HTTP: &http.Client{Timeout: 5 * time.Second}}
+	_, err := client.Heartbeat(context.Background(), HeartbeatRequest{AgentID: "agent-1"})
+	var busy *BusyError
+	if !errors.As(err, &busy) || busy.RetryAfter != 4*time.Second {
+		t.Fatalf("expected a busy error asking for 4s, got %v", err)
+	}
+}
+
 func TestClientFetchPlans(t *testing.T) {
 	expectedSiteID := "site-1"
 	expectedAgentID := "agent-1"
@@ -470,3 +524,45 @@ func TestClientNextSequence(t *testing.T) {
 		t.Errorf("expected third sequence to be 3, got %d", seq3)
 	}
 }
+
+func TestEnrollErrorsRetryableVersusTerminal(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"error":"nope"}`))
+	}))
+	client := &Client{BaseURL: server.URL, HTTP: server.Client()}
+	enrollWith := func() error {
+		_, err := client.Enroll(context.Background(), EnrollRequest{EnrollmentToken: "tok"})
+		return err
+	}
+
+	for code, retryable := range map[int]bool{
+		http.StatusServiceUnavailable:  true,
+		http.StatusBadGateway:          true,
+		http.StatusTooManyRequests:     true,
+		http.StatusUnauthorized:        false,
+		http.StatusBadRequest:          false,
+		http.StatusConflict:            false,
+		http.StatusInternalServerError: true,
+	} {
+		status = code
+		err := enrollWith()
+		var enrollErr *EnrollError
+		if !errors.As(err, &enrollErr) || enrollErr.StatusCode != code {
+			t.Fatalf("status %d: expected an EnrollError, got %v", code, err)
+		}
+		if Retryable(err) != retryable {
+			t.Fatalf("status %d: Retryable = %v, want %v", code, !retryable, retryable)
+		}
+	}
+
+	// An unreachable control plane is transient.
+	server.Close()
+	if err := enrollWith(); err == nil || !Retryable(err) {
+		t.Fatalf("expected a connection error to be retryable, got %v", err)
+	}
+	if Retryable(context.Canceled) || Retryable(errors.New("invalid enroll response: missing identifiers")) {
+		t.Fatal("expected cancellation and bad responses to be terminal")
+	}
+}
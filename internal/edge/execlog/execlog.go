@@ -0,0 +1,168 @@
+package execlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+)
+
+// DefaultPollInterval is how often Follow checks for new entries.
+const DefaultPollInterval = 250 * time.Millisecond
+
+var ErrInvalidExecutionID = errors.New("invalid execution id")
+
+// Record is a single log line persisted for an execution.
+type Record struct {
+	Timestamp   time.Time `json:"ts"`
+	ExecutionID string    `json:"execution_id"`
+	ActionID    string    `json:"action_id,omitempty"`
+	Level       string    `json:"level"`
+	Message     string    `json:"message"`
+}
+
+// Store keeps one JSON-lines log file per execution so logs can be read on
+// the host without the control plane.
+type Store struct {
+	Dir          string
+	PollInterval time.Duration
+
+	mu sync.Mutex
+}
+
+var _ executor.LogSink = (*Store)(nil)
+
+// New returns a Store rooted at dir.
+func New(dir string) *Store {
+	return &Store{Dir: dir}
+}
+
+// DirFor returns the default log directory under an agent runtime dir.
+func DirFor(runtimeDir string) string {
+	return filepath.Join(runtimeDir, "logs")
+}
+
+// Write implements executor.LogSink. Failures are ignored so local logging
+// never interrupts plan execution.
+func (s *Store) Write(_ context.Context, entry executor.LogEntry) {
+	_ = s.Append(Record{
+		Timestamp:   time.Now().UTC(),
+		ExecutionID: entry.ExecutionID,
+		ActionID:    entry.ActionID,
+		Level:       strings.ToUpper(entry.Level),
+		Message:     entry.Message,
+	})
+}
+
+// Append persists a record to its execution's log file.
+func (s *Store) Append(rec Record) error {
+	path, err := s.path(rec.ExecutionID)
+	if err != nil {
+		return err
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Follow calls fn for every record of the execution in write order. When
+// follow is true it keeps waiting for new records until ctx is cancelled;
+// otherwise it returns once the existing records have been read.
+func (s *Store) Follow(ctx context.Context, executionID string, follow bool, fn func(Record) error) error {
+	path, err := s.path(executionID)
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+	for f == nil {
+		f, err = os.Open(path)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || !follow {
+			return err
+		}
+		if err := s.wait(ctx); err != nil {
+			return nil
+		}
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var pending []byte
+	for {
+		chunk, err := reader.ReadBytes('\n')
+		pending = append(pending, chunk...)
+		if err == nil {
+			var rec Record
+			if jsonErr := json.Unmarshal(pending, &rec); jsonErr != nil {
+				return fmt.Errorf("decode log record: %w", jsonErr)
+			}
+			pending = pending[:0]
+			if err := fn(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		// Partial lines stay in pending until the writer finishes them.
+		if !follow {
+			return nil
+		}
+		if err := s.wait(ctx); err != nil {
+			return nil
+		}
+	}
+}
+
+func (s *Store) wait(ctx context.Context) error {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Store) path(executionID string) (string, error) {
+	id := strings.TrimSpace(executionID)
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", ErrInvalidExecutionID
+	}
+	return filepath.Join(s.Dir, id+".log"), nil
+}
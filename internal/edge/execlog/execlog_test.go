@@ -0,0 +1,90 @@
+package execlog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+)
+
+func TestFollowEmitsEntriesInOrder(t *testing.T) {
+	store := New(t.TempDir())
+	store.PollInterval = 5 * time.Millisecond
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		store.Write(ctx, executor.LogEntry{ExecutionID: "exec-1", ActionID: "a1", Level: "info", Message: fmt.Sprintf("msg-%d", i)})
+	}
+	store.Write(ctx, executor.LogEntry{ExecutionID: "exec-2", Level: "INFO", Message: "other execution"})
+
+	followCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	got := make(chan Record, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Follow(followCtx, "exec-1", true, func(rec Record) error {
+			got <- rec
+			return nil
+		})
+	}()
+
+	for i := 3; i < 6; i++ {
+		store.Write(ctx, executor.LogEntry{ExecutionID: "exec-1", Level: "INFO", Message: fmt.Sprintf("msg-%d", i)})
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case rec := <-got:
+			if want := fmt.Sprintf("msg-%d", i); rec.Message != want {
+				t.Fatalf("record %d: got %q, want %q", i, rec.Message, want)
+			}
+			if rec.ExecutionID != "exec-1" || rec.Level != "INFO" {
+				t.Fatalf("unexpected record: %+v", rec)
+			}
+		case <-followCtx.Done():
+			t.Fatalf("timed out waiting for record %d", i)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("follow returned error: %v", err)
+	}
+}
+
+func TestFollowWithoutFollowReturnsAtEOF(t *testing.T) {
+	store := New(t.TempDir())
+	ctx := context.Background()
+	store.Write(ctx, executor.LogEntry{ExecutionID: "exec-1", Level: "INFO", Message: "only"})
+
+	var messages []string
+	err := store.Follow(ctx, "exec-1", false, func(rec Record) error {
+		messages = append(messages, rec.Message)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	if len(messages) != 1 || messages[0] != "only" {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+
+	err = store.Follow(ctx, "missing", false, func(Record) error { return nil })
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestAppendRejectsPathTraversal(t *testing.T) {
+	store := New(t.TempDir())
+	for _, id := range []string{"", "..", "../escape", `a\b`} {
+		if err := store.Append(Record{ExecutionID: id, Message: "x"}); !errors.Is(err, ErrInvalidExecutionID) {
+			t.Errorf("execution id %q: expected ErrInvalidExecutionID, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxBootDelay is the longest delay, in seconds, a CREATE or START may ask
+// for before it boots its VM.
+const MaxBootDelay = model.MaxBootDelay
+
+// bootSequence returns the actions in the order the plan runs them. Actions
+// with a BootOrder are run by ascending BootOrder, ties in plan order, in
+// the positions the plan gave them; the others keep their place.
+func bootSequence(actions []Action) []Action {
+	orders := make([]int, len(actions))
+	for i, a := range actions {
+		orders[i] = a.BootOrder
+	}
+	out := make([]Action, 0, len(actions))
+	for _, i := range model.BootSequence(orders) {
+		out = append(out, actions[i])
+	}
+	return out
+}
+
+// waitBootDelay waits the BootDelaySeconds of a CREATE or START before it
+// runs; the wait ends early with an error when ctx is done.
+func (e *Executor) waitBootDelay(ctx context.Context, action Action) error {
+	if action.BootDelaySeconds <= 0 {
+		return nil
+	}
+	if action.Type != ActionMicroVMCreate && action.Type != ActionMicroVMStart {
+		return nil
+	}
+	// A replayed action is answered from its record without booting again.
+	if _, found, err := e.Store.GetActionRecord(action.ActionID); err == nil && found {
+		return nil
+	}
+	if action.BootDelaySeconds > MaxBootDelay {
+		return Categorize(FailureInvalidParams, fmt.Errorf("boot_delay_seconds must be between 0 and %d", MaxBootDelay))
+	}
+	sleep := e.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	return sleep(ctx, time.Duration(action.BootDelaySeconds)*time.Second)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
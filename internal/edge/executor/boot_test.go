@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// bootRecorder logs the starts of a fakeProvider and the boot delays the
+// executor sleeps, in the order they happen.
+type bootRecorder struct {
+	fakeProvider
+	events []string
+}
+
+func (b *bootRecorder) Start(_ context.Context, vmID string) error {
+	b.events = append(b.events, "start "+vmID)
+	return nil
+}
+
+func TestExecutorStartsVMsInBootOrderWithDelays(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &bootRecorder{}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}}
+	exec.sleep = func(_ context.Context, d time.Duration) error {
+		provider.events = append(provider.events, fmt.Sprintf("wait %s", d))
+		return nil
+	}
+	start := func(vmID string, order, delay int) Action {
+		params, _ := json.Marshal(MicroVMParams{VMID: vmID})
+		return Action{ActionID: "start-" + vmID, Type: ActionMicroVMStart, Params: params, BootOrder: order, BootDelaySeconds: delay}
+	}
+	plan := Plan{
+		ExecutionID: "exec-boot",
+		Actions: []Action{
+			start("web", 3, 5),
+			start("cache", 0, 0),
+			start("db", 1, 0),
+			start("api", 2, 10),
+		},
+	}
+
+	result, err := exec.ExecutePlan(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	// The boot-ordered actions take the plan's first, third and fourth
+	// slots by boot order; cache keeps its place.
+	want := []string{"start db", "start cache", "wait 10s", "start api", "wait 5s", "start web"}
+	if fmt.Sprint(provider.events) != fmt.Sprint(want) {
+		t.Fatalf("expected %v, got %v", want, provider.events)
+	}
+	if len(result.Results) != 4 || result.Results[0].ActionID != "start-db" {
+		t.Fatalf("expected results in run order, got %+v", result.Results)
+	}
+
+	// A replayed plan answers from the action records without waiting.
+	provider.events = nil
+	if _, err := exec.ExecutePlan(context.Background(), plan); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(provider.events) != 0 {
+		t.Fatalf("expected a replay to neither wait nor start, got %v", provider.events)
+	}
+}
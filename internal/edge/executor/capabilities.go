@@ -0,0 +1,44 @@
+package executor
+
+import (
+	"fmt"
+	"slices"
+)
+
+// providerActions are the action types run by the MicroVMProvider, which
+// must list them in Capabilities. CommandExecute runs on the host and
+// needs no provider support.
+var providerActions = []ActionType{
+	ActionMicroVMCreate,
+	ActionMicroVMStart,
+	ActionMicroVMStop,
+	ActionMicroVMDelete,
+	ActionMicroVMPause,
+	ActionMicroVMResume,
+	ActionMicroVMSnapshot,
+	ActionMicroVMMigrate,
+}
+
+// Capabilities returns the capability names of the given action types, for
+// providers to return from MicroVMProvider.Capabilities.
+func Capabilities(types ...ActionType) []string {
+	out := make([]string, 0, len(types))
+	for _, t := range types {
+		out = append(out, string(t))
+	}
+	return out
+}
+
+// AllCapabilities returns every capability a provider can declare.
+func AllCapabilities() []string {
+	return Capabilities(providerActions...)
+}
+
+// checkCapability fails with UNSUPPORTED_OPERATION when the provider does
+// not declare the action type it would have to run.
+func (e *Executor) checkCapability(t ActionType) error {
+	if !slices.Contains(providerActions, t) || slices.Contains(e.Provider.Capabilities(), string(t)) {
+		return nil
+	}
+	return Categorize(FailureUnsupportedOperation, fmt.Errorf("%s is not supported by this host's VM provider", t))
+}
@@ -0,0 +1,46 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestExecutor_RejectsUnsupportedOperations(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &fakeProvider{disabled: []ActionType{ActionMicroVMSnapshot}}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}}
+
+	createParams, _ := json.Marshal(MicroVMParams{VMID: "vm-1", Name: "vm-1", RootfsPath: "/images/rootfs.raw"})
+	snapshotParams, _ := json.Marshal(SnapshotParams{VMID: "vm-1", SnapshotName: "snap-1"})
+	commandParams, _ := json.Marshal(CommandParams{Command: "true"})
+	result, _ := exec.ExecutePlan(context.Background(), Plan{
+		ExecutionID: "exec-1",
+		Actions: []Action{
+			{ActionID: "act-create", Type: ActionMicroVMCreate, Params: createParams},
+			{ActionID: "act-snapshot", Type: ActionMicroVMSnapshot, Params: snapshotParams},
+			{ActionID: "act-command", Type: ActionCommandExecute, Params: commandParams},
+		},
+	})
+	if len(result.Results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(result.Results))
+	}
+
+	if r := result.Results[0]; !r.OK || provider.create != 1 {
+		t.Fatalf("expected supported create to run, got %+v (creates=%d)", r, provider.create)
+	}
+	if r := result.Results[1]; r.OK || r.ErrorCode != FailureUnsupportedOperation {
+		t.Fatalf("expected snapshot to be rejected as unsupported, got %+v", r)
+	}
+	if r := result.Results[2]; r.ErrorCode == FailureUnsupportedOperation {
+		t.Fatalf("commands do not need provider support, got %+v", r)
+	}
+}
@@ -6,9 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"sort"
+	"strings"
 	"time"
 )
 
+// defaultCommandPath is the PATH given to commands that do not set their own.
+const defaultCommandPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 type CommandResult struct {
 	ExitCode int    `json:"exit_code"`
 	Stdout   string `json:"stdout"`
@@ -18,12 +23,16 @@ type CommandResult struct {
 func (e *Executor) executeCommand(ctx context.Context, action Action) (*CommandResult, error) {
 	var params CommandParams
 	if err := json.Unmarshal(action.Params, &params); err != nil {
-		return nil, fmt.Errorf("unmarshal command params: %w", err)
+		return nil, Categorize(FailureInvalidParams, fmt.Errorf("unmarshal command params: %w", err))
 	}
 
 	if params.Command == "" {
 		return nil, fmt.Errorf("command is required")
 	}
+	env, err := commandEnv(params.Env, params.AllowPathOverride)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set timeout (default 30 seconds)
 	timeout := time.Duration(params.Timeout) * time.Second
@@ -38,12 +47,13 @@ func (e *Executor) executeCommand(ctx context.Context, action Action) (*CommandR
 	if params.Dir != "" {
 		cmd.Dir = params.Dir
 	}
+	cmd.Env = env
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 
 	exitCode := 0
 	if err != nil {
@@ -60,3 +70,42 @@ func (e *Executor) executeCommand(ctx context.Context, action Action) (*CommandR
 		Stderr:   stderr.String(),
 	}, nil
 }
+
+// commandEnv builds the environment for a command: a minimal base with the
+// action's variables layered on top. Keys that would change how binaries are
+// resolved or loaded are rejected unless allowPathOverride is set.
+func commandEnv(vars map[string]string, allowPathOverride bool) ([]string, error) {
+	merged := map[string]string{
+		"PATH": defaultCommandPath,
+		"HOME": "/",
+		"LANG": "C",
+	}
+	for key, value := range vars {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return nil, fmt.Errorf("invalid env key %q", key)
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("invalid value for env key %q", key)
+		}
+		if isPathOverrideKey(key) && !allowPathOverride {
+			return nil, fmt.Errorf("env key %q overrides the command search path; set allow_path_override to permit it", key)
+		}
+		merged[key] = value
+	}
+
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, key+"="+merged[key])
+	}
+	return env, nil
+}
+
+func isPathOverrideKey(key string) bool {
+	upper := strings.ToUpper(key)
+	return upper == "PATH" || strings.HasPrefix(upper, "LD_")
+}
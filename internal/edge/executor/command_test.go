@@ -236,3 +236,49 @@ func TestExecutor_CommandExecute_InvalidCommand(t *testing.T) {
 		t.Errorf("expected action to fail with ACTION_FAILED, got: %v", result.Results[0])
 	}
 }
+
+func TestExecutor_CommandExecute_Env(t *testing.T) {
+	exec := &Executor{Logs: &noOpSink{}}
+
+	params, _ := json.Marshal(CommandParams{
+		Command: "sh",
+		Args:    []string{"-c", `printf '%s|%s' "$GREETING" "$PATH"`},
+		Env:     map[string]string{"GREETING": "hello from env"},
+		Timeout: 10,
+	})
+	result, err := exec.executeCommand(context.Background(), Action{ActionID: "act-1", Type: ActionCommandExecute, Params: params})
+	if err != nil {
+		t.Fatalf("execute command: %v", err)
+	}
+	if want := "hello from env|" + defaultCommandPath; result.Stdout != want {
+		t.Fatalf("stdout=%q, want %q", result.Stdout, want)
+	}
+}
+
+func TestExecutor_CommandExecute_RejectsPathOverride(t *testing.T) {
+	exec := &Executor{Logs: &noOpSink{}}
+
+	for _, key := range []string{"PATH", "path", "LD_PRELOAD"} {
+		params, _ := json.Marshal(CommandParams{
+			Command: "true",
+			Env:     map[string]string{key: "/tmp/evil"},
+		})
+		if _, err := exec.executeCommand(context.Background(), Action{ActionID: "act-1", Type: ActionCommandExecute, Params: params}); err == nil {
+			t.Fatalf("expected env key %s to be rejected", key)
+		}
+	}
+
+	params, _ := json.Marshal(CommandParams{
+		Command:           "sh",
+		Args:              []string{"-c", `printf '%s' "$PATH"`},
+		Env:               map[string]string{"PATH": "/opt/tools/bin:/usr/bin:/bin"},
+		AllowPathOverride: true,
+	})
+	result, err := exec.executeCommand(context.Background(), Action{ActionID: "act-1", Type: ActionCommandExecute, Params: params})
+	if err != nil {
+		t.Fatalf("execute command with allowed PATH override: %v", err)
+	}
+	if result.Stdout != "/opt/tools/bin:/usr/bin:/bin" {
+		t.Fatalf("expected overridden PATH, got %q", result.Stdout)
+	}
+}
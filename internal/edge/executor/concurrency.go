@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConcurrencyLimits caps how many actions of each type run at once across
+// the plans an executor runs, so cheap actions such as stops are not queued
+// behind expensive creates. Types without a limit use Default; a zero
+// Default leaves them unlimited.
+type ConcurrencyLimits struct {
+	PerType map[ActionType]int
+	Default int
+}
+
+// ParseConcurrencyLimits parses a comma-separated list of type=limit, where
+// type is an action type such as MicroVMCreate, or * for the default.
+func ParseConcurrencyLimits(spec string) (ConcurrencyLimits, error) {
+	limits := ConcurrencyLimits{PerType: make(map[ActionType]int)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return ConcurrencyLimits{}, fmt.Errorf("invalid action concurrency %q: want type=limit", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || n <= 0 {
+			return ConcurrencyLimits{}, fmt.Errorf("invalid action concurrency %q: limit must be a positive integer", entry)
+		}
+		if name == "*" {
+			limits.Default = n
+			continue
+		}
+		if !knownActionType(ActionType(name)) {
+			return ConcurrencyLimits{}, fmt.Errorf("invalid action concurrency %q: unknown action type %s", entry, name)
+		}
+		limits.PerType[ActionType(name)] = n
+	}
+	return limits, nil
+}
+
+func knownActionType(t ActionType) bool {
+	return t == ActionCommandExecute || slices.Contains(providerActions, t)
+}
+
+func (l ConcurrencyLimits) limit(t ActionType) int {
+	if n, ok := l.PerType[t]; ok {
+		return n
+	}
+	return l.Default
+}
+
+// acquireSlot waits for a free slot of the action type. The returned
+// release must be called once the action is done. It fails when ctx ends
+// first.
+func (e *Executor) acquireSlot(ctx context.Context, t ActionType) (func(), error) {
+	n := e.Concurrency.limit(t)
+	if n <= 0 {
+		return func() {}, nil
+	}
+	e.slotsMu.Lock()
+	if e.slots == nil {
+		e.slots = make(map[ActionType]chan struct{})
+	}
+	slots, ok := e.slots[t]
+	if !ok {
+		slots = make(chan struct{}, n)
+		e.slots[t] = slots
+	}
+	e.slotsMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a %s slot: %w", t, ctx.Err())
+	}
+}
+
+// ExecutePlans runs plans concurrently through ExecutePlan and calls done
+// with each result as its plan finishes. A plan first waits for the earlier
+// plans that touch one of its VMs, so the actions on a VM keep their order;
+// beyond that, actions are only held back by Concurrency. Actions without a
+// VM count as touching the host, which serializes them the same way.
+func (e *Executor) ExecutePlans(ctx context.Context, plans []Plan, done func(Plan, PlanResult, error)) {
+	var wg sync.WaitGroup
+	lastByVM := make(map[string]chan struct{})
+	for _, plan := range plans {
+		finished := make(chan struct{})
+		var deps []chan struct{}
+		for _, vmID := range planVMIDs(plan) {
+			if prev, ok := lastByVM[vmID]; ok {
+				deps = append(deps, prev)
+			}
+			lastByVM[vmID] = finished
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(finished)
+			for _, dep := range deps {
+				<-dep
+			}
+			res, err := e.ExecutePlan(ctx, plan)
+			done(plan, res, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// planVMIDs returns the distinct vm_id params of the plan's actions, with
+// "" standing for actions that have none.
+func planVMIDs(plan Plan) []string {
+	var ids []string
+	for _, action := range plan.Actions {
+		var params struct {
+			VMID string `json:"vm_id"`
+		}
+		_ = json.Unmarshal(action.Params, &params)
+		if !slices.Contains(ids, params.VMID) {
+			ids = append(ids, params.VMID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,167 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// blockingCreateProvider holds every Create until release is closed and
+// records the most creates seen running at once.
+type blockingCreateProvider struct {
+	fakeProvider
+	release chan struct{}
+
+	running     int
+	peakRunning int
+	order       []string
+}
+
+func (p *blockingCreateProvider) Create(ctx context.Context, params MicroVMParams) error {
+	p.mu.Lock()
+	p.running++
+	p.peakRunning = max(p.peakRunning, p.running)
+	p.mu.Unlock()
+	<-p.release
+	p.mu.Lock()
+	p.running--
+	p.create++
+	p.order = append(p.order, "create "+params.VMID)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *blockingCreateProvider) Stop(ctx context.Context, vmID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop++
+	p.order = append(p.order, "stop "+vmID)
+	return nil
+}
+
+func (p *blockingCreateProvider) snapshot() (running, peak, stops int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.peakRunning, p.stop
+}
+
+func vmPlan(executionID string, actionType ActionType, vmID string) Plan {
+	params, _ := json.Marshal(MicroVMParams{VMID: vmID})
+	return Plan{ExecutionID: executionID, Actions: []Action{{ActionID: executionID + "-act", Type: actionType, Params: params}}}
+}
+
+func TestExecutePlansCapsCreateIndependentlyOfStop(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &blockingCreateProvider{release: make(chan struct{})}
+	exec := &Executor{
+		Store:    st,
+		Provider: provider,
+		Logs:     &noOpSink{},
+		Concurrency: ConcurrencyLimits{PerType: map[ActionType]int{
+			ActionMicroVMCreate: 2,
+			ActionMicroVMStop:   10,
+		}},
+	}
+	var plans []Plan
+	for i := 0; i < 4; i++ {
+		plans = append(plans, vmPlan(fmt.Sprintf("create-%d", i), ActionMicroVMCreate, fmt.Sprintf("vm-new-%d", i)))
+	}
+	for i := 0; i < 3; i++ {
+		plans = append(plans, vmPlan(fmt.Sprintf("stop-%d", i), ActionMicroVMStop, fmt.Sprintf("vm-old-%d", i)))
+	}
+
+	var mu sync.Mutex
+	failed := 0
+	finished := make(chan struct{})
+	go func() {
+		exec.ExecutePlans(context.Background(), plans, func(plan Plan, res PlanResult, err error) {
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		})
+		close(finished)
+	}()
+
+	// The stops finish while two creates hold every CREATE slot.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		running, _, stops := provider.snapshot()
+		if running == 2 && stops == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 running creates and 3 stops, got %d and %d", running, stops)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if running, _, _ := provider.snapshot(); running != 2 {
+		t.Fatalf("expected creates to be capped at 2, got %d running", running)
+	}
+
+	close(provider.release)
+	<-finished
+	if _, peak, _ := provider.snapshot(); peak != 2 {
+		t.Fatalf("expected at most 2 concurrent creates, peak was %d", peak)
+	}
+	if provider.create != 4 || failed != 0 {
+		t.Fatalf("expected every create to run, got %d creates and %d failed plans", provider.create, failed)
+	}
+}
+
+func TestExecutePlansKeepsOrderPerVM(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &blockingCreateProvider{release: make(chan struct{})}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}}
+	plans := []Plan{
+		vmPlan("create", ActionMicroVMCreate, "vm-1"),
+		vmPlan("stop", ActionMicroVMStop, "vm-1"),
+	}
+	finished := make(chan struct{})
+	go func() {
+		exec.ExecutePlans(context.Background(), plans, func(Plan, PlanResult, error) {})
+		close(finished)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, _, stops := provider.snapshot(); stops != 0 {
+		t.Fatal("expected the stop to wait for the create of the same VM")
+	}
+	close(provider.release)
+	<-finished
+	if len(provider.order) != 2 || provider.order[0] != "create vm-1" || provider.order[1] != "stop vm-1" {
+		t.Fatalf("expected create then stop, got %v", provider.order)
+	}
+}
+
+func TestParseConcurrencyLimits(t *testing.T) {
+	limits, err := ParseConcurrencyLimits("MicroVMCreate=2, MicroVMStop=10,*=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.limit(ActionMicroVMCreate) != 2 || limits.limit(ActionMicroVMStop) != 10 || limits.limit(ActionMicroVMStart) != 4 {
+		t.Fatalf("unexpected limits %+v", limits)
+	}
+	for _, spec := range []string{"MicroVMCreate", "MicroVMCreate=0", "Reboot=1", "=2"} {
+		if _, err := ParseConcurrencyLimits(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package executor
+
+import (
+	"context"
+
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxConsoleLogBytes bounds the console log uploaded for a failed action.
+// The tail is kept since boot failures are reported last.
+const MaxConsoleLogBytes = model.MaxConsoleLogBytes
+
+// ConsoleLogCollector is implemented by providers that keep a VM's console
+// output on disk.
+type ConsoleLogCollector interface {
+	CollectConsoleLog(ctx context.Context, vmID string) ([]byte, error)
+}
+
+// ConsoleLog is the console output of a VM whose action failed.
+type ConsoleLog struct {
+	ExecutionID string `json:"execution_id"`
+	ActionID    string `json:"action_id"`
+	VMID        string `json:"vm_id"`
+	Content     string `json:"content"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+// ConsoleLogUploader sends console logs to the control plane.
+type ConsoleLogUploader interface {
+	UploadConsoleLog(ctx context.Context, log ConsoleLog) error
+}
+
+// uploadConsoleLog collects and uploads the console log of vmID after a
+// failed CREATE or START. It is best-effort: errors are logged and the
+// action result is unchanged.
+func (e *Executor) uploadConsoleLog(ctx context.Context, executionID, actionID, vmID string) {
+	if e.Consoles == nil || vmID == "" {
+		return
+	}
+	collector, ok := e.Provider.(ConsoleLogCollector)
+	if !ok {
+		return
+	}
+	fields := map[string]interface{}{
+		"action_id":    actionID,
+		"execution_id": executionID,
+		"vm_id":        vmID,
+	}
+	content, err := collector.CollectConsoleLog(ctx, vmID)
+	if err != nil {
+		fields["error"] = err.Error()
+		logger.WithComponent("executor").WithFields(fields).Warn("failed to collect console log")
+		return
+	}
+	if len(content) == 0 {
+		return
+	}
+	log := ConsoleLog{ExecutionID: executionID, ActionID: actionID, VMID: vmID}
+	content, log.Truncated = model.TruncateConsoleLog(content)
+	log.Content = string(content)
+	if err := e.Consoles.UploadConsoleLog(ctx, log); err != nil {
+		fields["error"] = err.Error()
+		logger.WithComponent("executor").WithFields(fields).Warn("failed to upload console log")
+	}
+}
@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+type consoleProvider struct {
+	fakeFailingProvider
+	console []byte
+}
+
+func (p *consoleProvider) CollectConsoleLog(context.Context, string) ([]byte, error) {
+	return p.console, nil
+}
+
+type recordingUploader struct {
+	logs []ConsoleLog
+}
+
+func (u *recordingUploader) UploadConsoleLog(_ context.Context, log ConsoleLog) error {
+	u.logs = append(u.logs, log)
+	return nil
+}
+
+func TestExecutor_UploadsConsoleLogOnFailedCreate(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &consoleProvider{console: []byte("kernel panic: no rootfs\n")}
+	uploader := &recordingUploader{}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, Consoles: uploader}
+
+	okParams, _ := json.Marshal(MicroVMParams{VMID: "vm-1", Name: "ok"})
+	badParams, _ := json.Marshal(MicroVMParams{VMID: "vm-bad", Name: "bad"})
+	plan := Plan{
+		ExecutionID: "exec-1",
+		Actions: []Action{
+			{ActionID: "act-1", Type: ActionMicroVMCreate, Params: okParams},
+			{ActionID: "act-2", Type: ActionMicroVMCreate, Params: badParams},
+		},
+	}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err == nil {
+		t.Fatal("expected the second create to fail")
+	}
+
+	if len(uploader.logs) != 1 {
+		t.Fatalf("expected one console log upload, got %+v", uploader.logs)
+	}
+	got := uploader.logs[0]
+	if got.ExecutionID != "exec-1" || got.ActionID != "act-2" || got.VMID != "vm-bad" {
+		t.Fatalf("unexpected upload: %+v", got)
+	}
+	if got.Content != "kernel panic: no rootfs\n" || got.Truncated {
+		t.Fatalf("unexpected console content: %+v", got)
+	}
+}
+
+func TestExecutor_TruncatesConsoleLog(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	console := strings.Repeat("x", MaxConsoleLogBytes) + "last line\n"
+	provider := &consoleProvider{console: []byte(console)}
+	uploader := &recordingUploader{}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, Consoles: uploader}
+
+	params, _ := json.Marshal(MicroVMParams{VMID: "vm-bad"})
+	plan := Plan{ExecutionID: "exec-1", Actions: []Action{{ActionID: "act-1", Type: ActionMicroVMCreate, Params: params}}}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err == nil {
+		t.Fatal("expected create to fail")
+	}
+
+	if len(uploader.logs) != 1 {
+		t.Fatalf("expected one console log upload, got %d", len(uploader.logs))
+	}
+	got := uploader.logs[0]
+	if !got.Truncated || len(got.Content) != MaxConsoleLogBytes || !strings.HasSuffix(got.Content, "last line\n") {
+		t.Fatalf("expected the tail to be kept, truncated=%v len=%d", got.Truncated, len(got.Content))
+	}
+}
+
+func TestExecutor_NoConsoleLogForOtherFailures(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	uploader := &recordingUploader{}
+	exec := &Executor{Store: st, Provider: &consoleProvider{console: []byte("boot ok\n")}, Logs: &noOpSink{}, Consoles: uploader}
+
+	params, _ := json.Marshal(MicroVMParams{VMID: "vm-2"})
+	plan := Plan{ExecutionID: "exec-1", Actions: []Action{{ActionID: "act-1", Type: ActionMicroVMStop, Params: params}}}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err == nil {
+		t.Fatal("expected stop to fail")
+	}
+	if len(uploader.logs) != 0 {
+		t.Fatalf("stop failures should not upload console logs: %+v", uploader.logs)
+	}
+}
@@ -0,0 +1,25 @@
+package executor
+
+import "github.com/kubedoio/n-kudo/internal/shared/model"
+
+// Default caps on the extra devices of one VM; the control plane applies
+// the same defaults when the plan is submitted.
+const (
+	DefaultMaxDisksPerVM = model.DefaultMaxDisksPerVM
+	DefaultMaxNICsPerVM  = model.DefaultMaxNICsPerVM
+)
+
+// DiskSpec is an extra data disk created empty alongside the root disk.
+type DiskSpec = model.DiskSpec
+
+// DeviceLimits caps the extra disks and network interfaces of a CREATE.
+// Zero fields use the defaults.
+type DeviceLimits struct {
+	MaxDisks int
+	MaxNICs  int
+}
+
+// Validate checks params against the limits with model.ValidateDevices.
+func (l DeviceLimits) Validate(params MicroVMParams) error {
+	return model.ValidateDevices(params.Disks, len(params.GetNetworks()), l.MaxDisks, l.MaxNICs)
+}
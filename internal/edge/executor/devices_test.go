@@ -0,0 +1,66 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestExecutor_RejectsCreateOverDeviceLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		params  MicroVMParams
+		wantErr string
+	}{
+		{"too many disks", MicroVMParams{VMID: "vm-1", Disks: []DiskSpec{{SizeMiB: 64}, {SizeMiB: 64}, {SizeMiB: 64}}}, "3 disks requested, at most 2 per VM"},
+		{"too many nics", MicroVMParams{VMID: "vm-1", Networks: []NetworkInterface{{ID: "eth0"}, {ID: "eth1"}}}, "2 network interfaces requested, at most 1 per VM"},
+		{"zero size disk", MicroVMParams{VMID: "vm-1", Disks: []DiskSpec{{}}}, "size_mib must be > 0"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			provider := &fakeProvider{}
+			exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, DeviceLimits: DeviceLimits{MaxDisks: 2, MaxNICs: 1}}
+
+			params, _ := json.Marshal(tc.params)
+			result, _ := exec.ExecutePlan(context.Background(), Plan{
+				ExecutionID: "exec-1",
+				Actions:     []Action{{ActionID: "act-1", Type: ActionMicroVMCreate, Params: params}},
+			})
+			if len(result.Results) != 1 || result.Results[0].OK {
+				t.Fatalf("expected one failed result, got %+v", result.Results)
+			}
+			if got := result.Results[0].ErrorCode; got != FailureInvalidParams {
+				t.Fatalf("expected error code %s, got %s", FailureInvalidParams, got)
+			}
+			if !strings.Contains(result.Results[0].Message, tc.wantErr) {
+				t.Fatalf("expected message containing %q, got %q", tc.wantErr, result.Results[0].Message)
+			}
+			if provider.create != 0 {
+				t.Fatalf("provider create called %d times", provider.create)
+			}
+		})
+	}
+}
+
+func TestDeviceLimitsDefaults(t *testing.T) {
+	params := MicroVMParams{Disks: make([]DiskSpec, DefaultMaxDisksPerVM)}
+	for i := range params.Disks {
+		params.Disks[i].SizeMiB = 1
+	}
+	if err := (DeviceLimits{}).Validate(params); err != nil {
+		t.Fatalf("expected default limit to allow %d disks: %v", DefaultMaxDisksPerVM, err)
+	}
+	params.Disks = append(params.Disks, DiskSpec{SizeMiB: 1})
+	if err := (DeviceLimits{}).Validate(params); err == nil {
+		t.Fatal("expected default limit to reject an extra disk")
+	}
+}
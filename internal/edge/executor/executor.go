@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kubedoio/n-kudo/internal/edge/logger"
@@ -21,10 +22,48 @@ type StateStore interface {
 	PutActionRecord(record state.ActionRecord) error
 }
 
+// ActionRecordTTLSetter is implemented by stores that prune old action
+// records.
+type ActionRecordTTLSetter interface {
+	SetActionRecordTTL(ttl time.Duration)
+}
+
 type Executor struct {
 	Store    StateStore
 	Provider MicroVMProvider
 	Logs     LogSink
+	// Migrations handles MicroVMMigrate actions; nil rejects them.
+	Migrations MigrationDriver
+	// SnapshotDir holds the snapshots of MicroVMSnapshot actions; empty
+	// uses /var/lib/nkudo-edge/snapshots.
+	SnapshotDir string
+	// Consoles receives the console log of VMs whose CREATE or START
+	// failed; nil keeps the logs on the host only.
+	Consoles ConsoleLogUploader
+	// DeviceLimits caps the extra disks and NICs of a CREATE.
+	DeviceLimits DeviceLimits
+	// HostArch selects among site image defaults; empty uses the arch the
+	// agent runs on, as reported in host facts.
+	HostArch string
+	// Concurrency caps the actions of each type running at once when
+	// plans are executed concurrently.
+	Concurrency ConcurrencyLimits
+	// Reserve is the memory and CPU a CREATE must leave free, as reported
+	// by HostResources; CREATEs that would dip into it fail with
+	// INSUFFICIENT_RESOURCES. A nil HostResources disables the check.
+	Reserve       ResourceReserve
+	HostResources func() (HostResources, error)
+	// Hooks are run before and after each action.
+	Hooks ActionHooks
+
+	// sleep waits out boot delays; nil sleeps on a timer.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	slotsMu sync.Mutex
+	slots   map[ActionType]chan struct{}
+
+	admitMu  sync.Mutex
+	admitted HostResources
 }
 
 func (e *Executor) ExecutePlan(ctx context.Context, plan Plan) (PlanResult, error) {
@@ -32,15 +71,91 @@ func (e *Executor) ExecutePlan(ctx context.Context, plan Plan) (PlanResult, erro
 		return PlanResult{}, errors.New("execution_id required")
 	}
 	result := PlanResult{PlanID: plan.PlanID, ExecutionID: plan.ExecutionID, Results: make([]ActionResult, 0, len(plan.Actions))}
+	if plan.ResultTTL > 0 {
+		if setter, ok := e.Store.(ActionRecordTTLSetter); ok {
+			setter.SetActionRecordTTL(time.Duration(plan.ResultTTL) * time.Second)
+		}
+	}
 
-	for _, action := range plan.Actions {
-		r := e.executeAction(ctx, plan.ExecutionID, action)
+	// Best-effort plans run every action and report the first failure.
+	// Sequential plans stop at the first failure and report the remaining
+	// actions as skipped so the control plane does not lease them again.
+	// Either way, actions whose dependencies did not succeed are skipped.
+	// Boot-ordered actions run by boot order, each after its boot delay.
+	actions := bootSequence(plan.Actions)
+	var firstErr error
+	failed := make(map[string]bool)
+	for i, action := range actions {
+		var r ActionResult
+		if dep := failedDependency(action, failed); dep != "" {
+			now := time.Now().UTC()
+			r = ActionResult{
+				ExecutionID: plan.ExecutionID,
+				ActionID:    action.ActionID,
+				ErrorCode:   FailureSkipped,
+				Message:     fmt.Sprintf("skipped: dependency %s did not succeed", dep),
+				StartedAt:   now,
+				FinishedAt:  now,
+			}
+		} else if params, err := expandLabels(action.Params, plan.Labels); err != nil {
+			now := time.Now().UTC()
+			r = ActionResult{
+				ExecutionID: plan.ExecutionID,
+				ActionID:    action.ActionID,
+				ErrorCode:   FailureInvalidParams,
+				Message:     err.Error(),
+				StartedAt:   now,
+				FinishedAt:  now,
+			}
+		} else if err := e.waitBootDelay(ctx, action); err != nil {
+			now := time.Now().UTC()
+			r = ActionResult{
+				ExecutionID: plan.ExecutionID,
+				ActionID:    action.ActionID,
+				ErrorCode:   FailureCategory(err),
+				Message:     fmt.Sprintf("boot delay: %v", err),
+				StartedAt:   now,
+				FinishedAt:  now,
+			}
+		} else {
+			action.Params = params
+			r = e.executeAction(ctx, plan.ExecutionID, action)
+		}
 		result.Results = append(result.Results, r)
 		if !r.OK {
-			return result, fmt.Errorf("action %s failed: %s", action.ActionID, r.Message)
+			failed[action.ActionID] = true
+		}
+		if r.OK || r.ErrorCode == FailureSkipped || firstErr != nil {
+			continue
+		}
+		firstErr = fmt.Errorf("action %s failed: %s", action.ActionID, r.Message)
+		if plan.Sequential {
+			now := time.Now().UTC()
+			for _, rest := range actions[i+1:] {
+				result.Results = append(result.Results, ActionResult{
+					ExecutionID: plan.ExecutionID,
+					ActionID:    rest.ActionID,
+					ErrorCode:   FailureSkipped,
+					Message:     fmt.Sprintf("skipped: action %s failed", action.ActionID),
+					StartedAt:   now,
+					FinishedAt:  now,
+				})
+			}
+			break
 		}
 	}
-	return result, nil
+	return result, firstErr
+}
+
+// failedDependency returns the first dependency of action that failed or
+// was skipped, or "" if it may run.
+func failedDependency(action Action, failed map[string]bool) string {
+	for _, dep := range action.DependsOn {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
 }
 
 func (e *Executor) executeAction(parent context.Context, executionID string, action Action) ActionResult {
@@ -77,6 +192,12 @@ func (e *Executor) executeAction(parent context.Context, executionID string, act
 		}
 	}
 
+	// Queueing for a slot does not count against the action timeout.
+	release, slotErr := e.acquireSlot(parent, action.Type)
+	if slotErr == nil {
+		defer release()
+	}
+
 	ctx := parent
 	if action.TimeoutSecond > 0 {
 		var cancel context.CancelFunc
@@ -91,43 +212,99 @@ func (e *Executor) executeAction(parent context.Context, executionID string, act
 		FinishedAt:  time.Now().UTC(),
 	}
 
-	var err error
+	err := slotErr
+	if err == nil {
+		err = e.checkCapability(action.Type)
+	}
+	if err == nil {
+		err = e.hookFailure(e.runHook(ctx, "pre", executionID, action, nil), log)
+	}
+	// The post-hook runs for every action the pre-hook let through.
+	ran := err == nil
 	var cmdResult *CommandResult
-	switch action.Type {
-	case ActionMicroVMCreate:
-		var params MicroVMParams
-		err = json.Unmarshal(action.Params, &params)
-		if err == nil {
-			err = e.Provider.Create(ctx, params)
-		}
-	case ActionMicroVMStart:
-		var params MicroVMParams
-		err = json.Unmarshal(action.Params, &params)
-		if err == nil {
-			err = e.Provider.Start(ctx, params.VMID)
+	// bootVMID is the VM of a CREATE or START, whose console log is
+	// uploaded if the action fails.
+	var bootVMID string
+	if err == nil {
+		switch action.Type {
+		case ActionMicroVMCreate:
+			var params MicroVMParams
+			err = decodeParams(action.Params, &params)
+			if err == nil {
+				err = Categorize(FailureInvalidParams, ValidateFiles(params.Files))
+			}
+			if err == nil {
+				err = Categorize(FailureInvalidParams, e.DeviceLimits.Validate(params))
+			}
+			if err == nil {
+				err = Categorize(FailureInvalidParams, ResolveImage(&params, e.hostArch()))
+			}
+			var release func()
+			if err == nil {
+				release, err = e.admit(params)
+			}
+			if err == nil {
+				bootVMID = params.VMID
+				err = e.Provider.Create(ctx, params)
+				release()
+			}
+		case ActionMicroVMStart:
+			var params MicroVMParams
+			err = decodeParams(action.Params, &params)
+			if err == nil {
+				bootVMID = params.VMID
+				err = e.Provider.Start(ctx, params.VMID)
+			}
+			if err == nil {
+				e.setDesiredStatus(params.VMID, "RUNNING")
+			}
+		case ActionMicroVMStop:
+			var params MicroVMParams
+			var opts StopOptions
+			err = decodeParams(action.Params, &params)
+			if err == nil {
+				err = decodeParams(action.Params, &opts)
+			}
+			if err == nil {
+				err = Categorize(FailureInvalidParams, opts.Validate())
+			}
+			if err == nil {
+				err = e.stopVM(ctx, params.VMID, opts)
+			}
+			if err == nil {
+				e.setDesiredStatus(params.VMID, "STOPPED")
+			}
+		case ActionMicroVMDelete:
+			var params MicroVMParams
+			err = decodeParams(action.Params, &params)
+			if err == nil {
+				err = e.Provider.Delete(ctx, params.VMID)
+			}
+			if err == nil {
+				e.removeVMSnapshots(params.VMID)
+			}
+		case ActionMicroVMPause:
+			err = e.executePause(ctx, action)
+		case ActionMicroVMResume:
+			err = e.executeResume(ctx, action)
+		case ActionMicroVMSnapshot:
+			err = e.executeSnapshot(ctx, action)
+		case ActionMicroVMMigrate:
+			err = e.executeMigrate(ctx, action)
+		case ActionCommandExecute:
+			cmdResult, err = e.executeCommand(ctx, action)
+		default:
+			err = fmt.Errorf("unknown action type: %s", action.Type)
 		}
-	case ActionMicroVMStop:
-		var params MicroVMParams
-		err = json.Unmarshal(action.Params, &params)
-		if err == nil {
-			err = e.Provider.Stop(ctx, params.VMID)
+	}
+	if ran {
+		outcome := ActionResult{OK: err == nil}
+		if err != nil {
+			outcome.ErrorCode, outcome.Message = FailureCategory(err), err.Error()
 		}
-	case ActionMicroVMDelete:
-		var params MicroVMParams
-		err = json.Unmarshal(action.Params, &params)
-		if err == nil {
-			err = e.Provider.Delete(ctx, params.VMID)
+		if hookErr := e.hookFailure(e.runHook(parent, "post", executionID, action, &outcome), log); err == nil {
+			err = hookErr
 		}
-	case ActionMicroVMPause:
-		err = e.executePause(ctx, action)
-	case ActionMicroVMResume:
-		err = e.executeResume(ctx, action)
-	case ActionMicroVMSnapshot:
-		err = e.executeSnapshot(ctx, action)
-	case ActionCommandExecute:
-		cmdResult, err = e.executeCommand(ctx, action)
-	default:
-		err = fmt.Errorf("unknown action type: %s", action.Type)
 	}
 
 	res.FinishedAt = time.Now().UTC()
@@ -137,10 +314,16 @@ func (e *Executor) executeAction(parent context.Context, executionID string, act
 	status := "success"
 	if err != nil {
 		res.OK = false
-		res.ErrorCode = "ACTION_FAILED"
+		res.ErrorCode = FailureCategory(err)
+		if res.ErrorCode == FailureActionFailed && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+			// The action timeout killed a command or request whose error
+			// does not wrap the deadline.
+			res.ErrorCode = FailureTimeout
+		}
 		res.Message = err.Error()
 		status = "failure"
 		log("ERROR", "action failed: "+err.Error())
+		e.uploadConsoleLog(parent, executionID, action.ActionID, bootVMID)
 	} else {
 		res.OK = true
 		if cmdResult != nil {
@@ -186,3 +369,20 @@ func (e *Executor) executeAction(parent context.Context, executionID string, act
 	}
 	return res
 }
+
+// decodeParams unmarshals action params; a malformed payload is an
+// INVALID_PARAMS failure.
+func decodeParams(raw json.RawMessage, v any) error {
+	return Categorize(FailureInvalidParams, json.Unmarshal(raw, v))
+}
+
+// setDesiredStatus records the state a start or stop action asked for, so
+// the VM watchdog can tell a crash from an intentional stop.
+func (e *Executor) setDesiredStatus(vmID, status string) {
+	vm, ok, err := e.Store.GetMicroVM(vmID)
+	if err != nil || !ok {
+		return
+	}
+	vm.DesiredStatus = status
+	_ = e.Store.UpsertMicroVM(vm)
+}
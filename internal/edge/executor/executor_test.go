@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"slices"
 	"sync"
 	"testing"
 
@@ -20,12 +21,15 @@ type fakeProvider struct {
 	pause    int
 	resume   int
 	pid      int
+	disabled []ActionType
+	created  MicroVMParams
 }
 
-func (f *fakeProvider) Create(context.Context, MicroVMParams) error {
+func (f *fakeProvider) Create(_ context.Context, params MicroVMParams) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.create++
+	f.created = params
 	return nil
 }
 func (f *fakeProvider) Start(context.Context, string) error {
@@ -54,6 +58,15 @@ func (f *fakeProvider) GetProcessID(ctx context.Context, vmID string) (int, erro
 	}
 	return 0, fmt.Errorf("VM not running: %s", vmID)
 }
+func (f *fakeProvider) Capabilities() []string {
+	caps := make([]string, 0)
+	for _, t := range providerActions {
+		if !slices.Contains(f.disabled, t) {
+			caps = append(caps, string(t))
+		}
+	}
+	return caps
+}
 
 type noOpSink struct{}
 
@@ -373,6 +386,97 @@ func TestExecutor_ActionFailureStopsPlan(t *testing.T) {
 	}
 }
 
+func failingMiddlePlan(sequential bool) Plan {
+	createParams, _ := json.Marshal(MicroVMParams{VMID: "vm-1", Name: "test"})
+	stopParams, _ := json.Marshal(MicroVMParams{VMID: "vm-2"})
+	startParams, _ := json.Marshal(MicroVMParams{VMID: "vm-3"})
+	return Plan{
+		ExecutionID: "exec-1",
+		Sequential:  sequential,
+		Actions: []Action{
+			{ActionID: "act-1", Type: ActionMicroVMCreate, Params: createParams},
+			{ActionID: "act-2", Type: ActionMicroVMStop, Params: stopParams},
+			{ActionID: "act-3", Type: ActionMicroVMStart, Params: startParams},
+		},
+	}
+}
+
+func TestExecutor_BestEffortContinuesOnFailure(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	exec := &Executor{Store: st, Provider: &fakeFailingProvider{}, Logs: &noOpSink{}}
+	result, err := exec.ExecutePlan(context.Background(), failingMiddlePlan(false))
+	if err == nil || err.Error() != "action act-2 failed: stop failed" {
+		t.Fatalf("expected the first failure to be reported, got %v", err)
+	}
+	if len(result.Results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(result.Results))
+	}
+	if !result.Results[0].OK || result.Results[1].OK || !result.Results[2].OK {
+		t.Fatalf("expected only the second action to fail: %+v", result.Results)
+	}
+}
+
+func TestExecutor_SequentialStopsOnFailure(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	exec := &Executor{Store: st, Provider: &fakeFailingProvider{}, Logs: &noOpSink{}}
+	result, err := exec.ExecutePlan(context.Background(), failingMiddlePlan(true))
+	if err == nil {
+		t.Fatal("expected error when action fails")
+	}
+	if len(result.Results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(result.Results))
+	}
+	if !result.Results[0].OK || result.Results[1].OK {
+		t.Fatalf("expected the first action to succeed and the second to fail: %+v", result.Results)
+	}
+	skipped := result.Results[2]
+	if skipped.OK || skipped.ErrorCode != "SKIPPED" || skipped.ActionID != "act-3" {
+		t.Fatalf("expected act-3 to be skipped, got %+v", skipped)
+	}
+	if _, found, _ := st.GetActionRecord("act-3"); found {
+		t.Fatal("skipped action should not be recorded as run")
+	}
+}
+
+func TestExecutor_SkipsActionsWithFailedDependencies(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	plan := failingMiddlePlan(false)
+	deleteParams, _ := json.Marshal(MicroVMParams{VMID: "vm-2"})
+	plan.Actions[2].DependsOn = []string{"act-1"}
+	plan.Actions = append(plan.Actions, Action{ActionID: "act-4", Type: ActionMicroVMDelete, Params: deleteParams, DependsOn: []string{"act-2"}})
+
+	exec := &Executor{Store: st, Provider: &fakeFailingProvider{}, Logs: &noOpSink{}}
+	result, err := exec.ExecutePlan(context.Background(), plan)
+	if err == nil || err.Error() != "action act-2 failed: stop failed" {
+		t.Fatalf("expected the failed stop to be reported, got %v", err)
+	}
+	if !result.Results[2].OK {
+		t.Fatalf("expected act-3 to run after its dependency succeeded: %+v", result.Results[2])
+	}
+	skipped := result.Results[3]
+	if skipped.OK || skipped.ErrorCode != FailureSkipped || skipped.ActionID != "act-4" {
+		t.Fatalf("expected act-4 to be skipped after act-2 failed, got %+v", skipped)
+	}
+	if _, found, _ := st.GetActionRecord("act-4"); found {
+		t.Fatal("skipped action should not be recorded as run")
+	}
+}
+
 type fakeFailingProvider struct{}
 
 func (f *fakeFailingProvider) Create(ctx context.Context, params MicroVMParams) error {
@@ -401,6 +505,10 @@ func (f *fakeFailingProvider) GetProcessID(ctx context.Context, vmID string) (in
 	return 0, fmt.Errorf("VM not running: %s", vmID)
 }
 
+func (f *fakeFailingProvider) Capabilities() []string {
+	return AllCapabilities()
+}
+
 func TestExecutor_ActionTimeout(t *testing.T) {
 	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
 	if err != nil {
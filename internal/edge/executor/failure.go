@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// Failure categories reported as ActionResult.ErrorCode. The control plane
+// accepts only these codes; dashboards and failure aggregation group by
+// them. ACTION_FAILED is the category of last resort.
+const (
+	FailureImagePull             = "IMAGE_PULL"
+	FailureKVMUnavailable        = "KVM_UNAVAILABLE"
+	FailureHypervisor            = "HYPERVISOR_UNAVAILABLE"
+	FailureNetworkSetup          = "NETWORK_SETUP"
+	FailureTimeout               = "TIMEOUT"
+	FailureInvalidParams         = "INVALID_PARAMS"
+	FailureVMNotFound            = "VM_NOT_FOUND"
+	FailureUnsupportedOperation  = "UNSUPPORTED_OPERATION"
+	FailureInsufficientResources = "INSUFFICIENT_RESOURCES"
+	FailureHook                  = "HOOK_FAILED"
+	FailureSkipped               = "SKIPPED"
+	FailureActionFailed          = "ACTION_FAILED"
+)
+
+// kvmDevice is opened by the hypervisors; errors on it mean KVM is missing
+// or not accessible to the agent.
+const kvmDevice = "/dev/kvm"
+
+type categorizedError struct {
+	category string
+	err      error
+}
+
+func (e *categorizedError) Error() string { return e.err.Error() }
+
+func (e *categorizedError) Unwrap() error { return e.err }
+
+// Categorize tags err with a failure category. Providers use it where they
+// know the cause of a failure. A nil err stays nil.
+func Categorize(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// FailureCategory maps err to a failure category. The outermost Categorize
+// tag wins; untagged deadline and /dev/kvm errors are recognised, and
+// anything else is ACTION_FAILED.
+func FailureCategory(err error) string {
+	var ce *categorizedError
+	if errors.As(err, &ce) {
+		return ce.category
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return FailureTimeout
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Path == kvmDevice {
+		return FailureKVMUnavailable
+	}
+	return FailureActionFailed
+}
+
+// CheckKVM reports whether /dev/kvm can be opened for reading and writing.
+func CheckKVM() error {
+	f, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err != nil {
+		return Categorize(FailureKVMUnavailable, err)
+	}
+	return f.Close()
+}
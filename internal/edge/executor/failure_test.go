@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestFailureCategory(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"tagged", Categorize(FailureImagePull, errors.New("stat source disk: no such file")), FailureImagePull},
+		{"tagged and wrapped", fmt.Errorf("create: %w", Categorize(FailureNetworkSetup, errors.New("setup tap: exit status 2"))), FailureNetworkSetup},
+		{"outermost tag wins", Categorize(FailureHypervisor, Categorize(FailureKVMUnavailable, errors.New("x"))), FailureHypervisor},
+		{"deadline", fmt.Errorf("set boot source: %w", context.DeadlineExceeded), FailureTimeout},
+		{"kvm device", &fs.PathError{Op: "open", Path: "/dev/kvm", Err: fs.ErrPermission}, FailureKVMUnavailable},
+		{"other path", &fs.PathError{Op: "open", Path: "/var/lib/disk.raw", Err: fs.ErrNotExist}, FailureActionFailed},
+		{"untagged", errors.New("mock create failure"), FailureActionFailed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FailureCategory(tc.err); got != tc.want {
+				t.Fatalf("FailureCategory(%v) = %s, want %s", tc.err, got, tc.want)
+			}
+		})
+	}
+	if Categorize(FailureTimeout, nil) != nil {
+		t.Fatalf("expected Categorize to keep a nil error nil")
+	}
+}
+
+type erroringProvider struct {
+	fakeProvider
+	createErr error
+	// block makes Create wait for the context before returning createErr.
+	block bool
+}
+
+func (p *erroringProvider) Create(ctx context.Context, _ MicroVMParams) error {
+	if p.block {
+		<-ctx.Done()
+	}
+	return p.createErr
+}
+
+func TestExecutor_ReportsFailureCategory(t *testing.T) {
+	validParams, _ := json.Marshal(MicroVMParams{VMID: "vm-1"})
+	cases := []struct {
+		name     string
+		provider *erroringProvider
+		params   json.RawMessage
+		timeout  int
+		want     string
+	}{
+		{"provider category", &erroringProvider{createErr: fmt.Errorf("create: %w", Categorize(FailureImagePull, errors.New("cache base image")))}, validParams, 0, FailureImagePull},
+		{"malformed params", &erroringProvider{}, json.RawMessage(`{"vm_id":1}`), 0, FailureInvalidParams},
+		{"invalid files", &erroringProvider{}, json.RawMessage(`{"vm_id":"vm-1","files":[{"path":"relative"}]}`), 0, FailureInvalidParams},
+		{"timeout without deadline error", &erroringProvider{createErr: errors.New("signal: killed"), block: true}, validParams, 1, FailureTimeout},
+		{"uncategorized", &erroringProvider{createErr: errors.New("mock create failure")}, validParams, 0, FailureActionFailed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+			exec := &Executor{Store: st, Provider: tc.provider, Logs: &noOpSink{}}
+
+			start := time.Now()
+			result, _ := exec.ExecutePlan(context.Background(), Plan{
+				ExecutionID: "exec-1",
+				Actions: []Action{{
+					ActionID:      "act-1",
+					Type:          ActionMicroVMCreate,
+					Params:        tc.params,
+					TimeoutSecond: tc.timeout,
+				}},
+			})
+			if len(result.Results) != 1 || result.Results[0].OK {
+				t.Fatalf("expected one failed result, got %+v", result.Results)
+			}
+			if got := result.Results[0].ErrorCode; got != tc.want {
+				t.Fatalf("expected error code %s, got %s (%s)", tc.want, got, result.Results[0].Message)
+			}
+			if tc.timeout > 0 && time.Since(start) > 5*time.Second {
+				t.Fatalf("action outlived its timeout")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package executor
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// MaxFilesBytes bounds the total content of the files in a CREATE action.
+const MaxFilesBytes = model.MaxFilesBytes
+
+// FileSpec is a file written into the VM at first boot through cloud-init
+// write_files.
+type FileSpec = model.FileSpec
+
+// ValidateFiles checks files with the rules the control plane applied when
+// the plan was submitted; see model.ValidateFiles.
+func ValidateFiles(files []FileSpec) error {
+	return model.ValidateFiles(files)
+}
+
+// RenderWriteFiles renders files as a cloud-config write_files section.
+// Text content is written as a quoted string; anything else is base64
+// encoded with encoding: b64.
+func RenderWriteFiles(files []FileSpec) string {
+	if len(files) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("write_files:\n")
+	for _, f := range files {
+		b.WriteString("  - path: ")
+		b.WriteString(strconv.Quote(f.Path))
+		b.WriteByte('\n')
+		if isText(f.Content) {
+			b.WriteString("    content: ")
+			b.WriteString(strconv.Quote(f.Content))
+			b.WriteByte('\n')
+		} else {
+			b.WriteString("    encoding: b64\n")
+			b.WriteString("    content: ")
+			b.WriteString(base64.StdEncoding.EncodeToString([]byte(f.Content)))
+			b.WriteByte('\n')
+		}
+		if f.Permissions != "" {
+			b.WriteString("    permissions: '")
+			b.WriteString(f.Permissions)
+			b.WriteString("'\n")
+		}
+		if f.Owner != "" {
+			b.WriteString("    owner: ")
+			b.WriteString(f.Owner)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// isText reports whether s is valid UTF-8 without control characters other
+// than tab, newline and carriage return, so that it survives YAML quoting.
+func isText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout bounds a hook run when ActionHooks.Timeout is unset.
+const DefaultHookTimeout = 30 * time.Second
+
+// hookOutputLimit bounds the hook output kept in execution logs and errors.
+const hookOutputLimit = 512
+
+// ActionHooks are host commands run before and after every action, for
+// instance to take a VM out of a load balancer before it stops. A hook is
+// an executable path run without a shell; it gets the action in NKUDO_*
+// environment variables and must be listed in Allowed.
+type ActionHooks struct {
+	Pre  string
+	Post string
+	// Allowed are the absolute paths hooks may run.
+	Allowed []string
+	// FailAction makes a failing hook fail the action with HOOK_FAILED: a
+	// failing pre-hook keeps the action from running, a failing post-hook
+	// fails an action that succeeded. Otherwise hook failures are logged.
+	FailAction bool
+	Timeout    time.Duration
+}
+
+// Validate checks that each configured hook is an absolute path on the
+// allowlist.
+func (h ActionHooks) Validate() error {
+	for _, hook := range []string{h.Pre, h.Post} {
+		if hook == "" {
+			continue
+		}
+		if !filepath.IsAbs(hook) || filepath.Clean(hook) != hook {
+			return fmt.Errorf("hook %q must be a clean absolute path", hook)
+		}
+		if !slices.Contains(h.Allowed, hook) {
+			return fmt.Errorf("hook %q is not in the hook allowlist", hook)
+		}
+	}
+	return nil
+}
+
+// hookEnv is the environment of a hook run for action: the action, its
+// execution and VM, and for post-hooks the outcome.
+func hookEnv(phase, executionID string, action Action, outcome *ActionResult) ([]string, error) {
+	var params struct {
+		VMID string `json:"vm_id"`
+	}
+	_ = json.Unmarshal(action.Params, &params)
+	vars := map[string]string{
+		"NKUDO_HOOK_PHASE":   phase,
+		"NKUDO_EXECUTION_ID": executionID,
+		"NKUDO_ACTION_ID":    action.ActionID,
+		"NKUDO_ACTION_TYPE":  string(action.Type),
+		"NKUDO_VM_ID":        params.VMID,
+	}
+	if outcome != nil {
+		vars["NKUDO_ACTION_OK"] = strconv.FormatBool(outcome.OK)
+		vars["NKUDO_ACTION_ERROR_CODE"] = outcome.ErrorCode
+		vars["NKUDO_ACTION_MESSAGE"] = outcome.Message
+	}
+	return commandEnv(vars, false)
+}
+
+// runHook runs the pre or post hook for action. It returns nil when no
+// hook is configured for phase; a hook outside the allowlist is an error
+// and is not run.
+func (e *Executor) runHook(ctx context.Context, phase, executionID string, action Action, outcome *ActionResult) error {
+	hook := e.Hooks.Pre
+	if phase == "post" {
+		hook = e.Hooks.Post
+	}
+	if hook == "" {
+		return nil
+	}
+	if err := e.Hooks.Validate(); err != nil {
+		return err
+	}
+	env, err := hookEnv(phase, executionID, action, outcome)
+	if err != nil {
+		return err
+	}
+	timeout := e.Hooks.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = env
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(out.String())
+		if len(output) > hookOutputLimit {
+			output = output[len(output)-hookOutputLimit:]
+		}
+		if output != "" {
+			return fmt.Errorf("%s-hook %s: %w: %s", phase, hook, err, output)
+		}
+		return fmt.Errorf("%s-hook %s: %w", phase, hook, err)
+	}
+	return nil
+}
+
+// hookFailure turns a hook error into the action's error when hooks fail
+// actions, and otherwise logs it and lets the action go on.
+func (e *Executor) hookFailure(err error, log func(level, msg string)) error {
+	if err == nil {
+		return nil
+	}
+	if e.Hooks.FailAction {
+		return Categorize(FailureHook, err)
+	}
+	log("WARN", "hook failed: "+err.Error())
+	return nil
+}
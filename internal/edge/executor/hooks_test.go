@@ -0,0 +1,144 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// writeHook writes an executable shell script to dir.
+func writeHook(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readEnvFile(t *testing.T, path string) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("hook did not run: %v", err)
+	}
+	env := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func newHookedExecutor(t *testing.T, provider *fakeProvider, hooks ActionHooks) *Executor {
+	t.Helper()
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, Hooks: hooks}
+}
+
+func createPlan() Plan {
+	params, _ := json.Marshal(MicroVMParams{VMID: "vm-1", Name: "web"})
+	return Plan{
+		ExecutionID: "exec-1",
+		Actions:     []Action{{ActionID: "act-1", Type: ActionMicroVMCreate, Params: params}},
+	}
+}
+
+func TestExecutor_HooksRunWithActionEnv(t *testing.T) {
+	dir := t.TempDir()
+	pre := writeHook(t, dir, "pre.sh", "env > "+filepath.Join(dir, "pre.env"))
+	post := writeHook(t, dir, "post.sh", "env > "+filepath.Join(dir, "post.env"))
+	provider := &fakeProvider{}
+	exec := newHookedExecutor(t, provider, ActionHooks{Pre: pre, Post: post, Allowed: []string{pre, post}})
+
+	result, err := exec.ExecutePlan(context.Background(), createPlan())
+	if err != nil || !result.Results[0].OK || provider.create != 1 {
+		t.Fatalf("expected the action to succeed, got %+v (%v)", result.Results, err)
+	}
+
+	want := map[string]string{
+		"NKUDO_EXECUTION_ID": "exec-1",
+		"NKUDO_ACTION_ID":    "act-1",
+		"NKUDO_ACTION_TYPE":  string(ActionMicroVMCreate),
+		"NKUDO_VM_ID":        "vm-1",
+	}
+	preEnv, postEnv := readEnvFile(t, filepath.Join(dir, "pre.env")), readEnvFile(t, filepath.Join(dir, "post.env"))
+	for k, v := range want {
+		if preEnv[k] != v || postEnv[k] != v {
+			t.Fatalf("%s: pre=%q post=%q, want %q", k, preEnv[k], postEnv[k], v)
+		}
+	}
+	if preEnv["NKUDO_HOOK_PHASE"] != "pre" || postEnv["NKUDO_HOOK_PHASE"] != "post" {
+		t.Fatalf("unexpected phases pre=%q post=%q", preEnv["NKUDO_HOOK_PHASE"], postEnv["NKUDO_HOOK_PHASE"])
+	}
+	if _, ok := preEnv["NKUDO_ACTION_OK"]; ok {
+		t.Fatal("pre-hook should not get an outcome")
+	}
+	if postEnv["NKUDO_ACTION_OK"] != "true" {
+		t.Fatalf("expected the post-hook to see success, got %q", postEnv["NKUDO_ACTION_OK"])
+	}
+}
+
+func TestExecutor_FailingPreHookAbortsAction(t *testing.T) {
+	dir := t.TempDir()
+	pre := writeHook(t, dir, "pre.sh", "echo lb drain failed; exit 3")
+	post := writeHook(t, dir, "post.sh", "touch "+filepath.Join(dir, "post.ran"))
+	provider := &fakeProvider{}
+	exec := newHookedExecutor(t, provider, ActionHooks{Pre: pre, Post: post, Allowed: []string{pre, post}, FailAction: true})
+
+	result, _ := exec.ExecutePlan(context.Background(), createPlan())
+	res := result.Results[0]
+	if res.OK || res.ErrorCode != FailureHook || !strings.Contains(res.Message, "lb drain failed") {
+		t.Fatalf("expected a HOOK_FAILED result with the hook output, got %+v", res)
+	}
+	if provider.create != 0 {
+		t.Fatalf("expected the action not to run, provider saw %d creates", provider.create)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "post.ran")); err == nil {
+		t.Fatal("expected no post-hook for an action that did not run")
+	}
+
+	// Without FailAction the failure is only logged.
+	provider = &fakeProvider{}
+	exec = newHookedExecutor(t, provider, ActionHooks{Pre: pre, Allowed: []string{pre}})
+	result, _ = exec.ExecutePlan(context.Background(), createPlan())
+	if !result.Results[0].OK || provider.create != 1 {
+		t.Fatalf("expected the action to run despite the hook, got %+v", result.Results[0])
+	}
+}
+
+func TestActionHooksMustBeAllowlisted(t *testing.T) {
+	dir := t.TempDir()
+	pre := writeHook(t, dir, "pre.sh", "exit 0")
+	cases := []ActionHooks{
+		{Pre: pre},
+		{Post: pre, Allowed: []string{filepath.Join(dir, "other.sh")}},
+		{Pre: "pre.sh", Allowed: []string{"pre.sh"}},
+		{Pre: dir + "/../" + filepath.Base(dir) + "/pre.sh", Allowed: []string{pre}},
+	}
+	for _, hooks := range cases {
+		if err := hooks.Validate(); err == nil {
+			t.Fatalf("expected %+v to be refused", hooks)
+		}
+	}
+	if err := (ActionHooks{Pre: pre, Allowed: []string{pre}}).Validate(); err != nil {
+		t.Fatalf("expected an allowlisted hook to pass: %v", err)
+	}
+
+	provider := &fakeProvider{}
+	exec := newHookedExecutor(t, provider, ActionHooks{Pre: pre, FailAction: true})
+	result, _ := exec.ExecutePlan(context.Background(), createPlan())
+	if result.Results[0].OK || provider.create != 0 {
+		t.Fatalf("expected a hook outside the allowlist to fail the action, got %+v", result.Results[0])
+	}
+}
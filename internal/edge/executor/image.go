@@ -0,0 +1,46 @@
+package executor
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/shared/model"
+)
+
+// ImageRef is a kernel and root filesystem on the host.
+type ImageRef = model.Image
+
+// ResolveImage fills in the image of a CREATE that did not pin one from the
+// site defaults for arch. It fails when the site has defaults but none for
+// this host's arch; with no defaults at all params are left as they are.
+func ResolveImage(params *MicroVMParams, arch string) error {
+	if params.RootfsPath != "" || len(params.ImageDefaults) == 0 {
+		return nil
+	}
+	arch = model.NormalizeArch(arch)
+	for key, img := range params.ImageDefaults {
+		if model.NormalizeArch(key) != arch {
+			continue
+		}
+		params.RootfsPath = img.RootfsPath
+		if params.KernelPath == "" {
+			params.KernelPath = img.KernelPath
+		}
+		return nil
+	}
+	available := make([]string, 0, len(params.ImageDefaults))
+	for key := range params.ImageDefaults {
+		available = append(available, key)
+	}
+	sort.Strings(available)
+	return fmt.Errorf("no default image for host arch %s (site defaults cover %s)", arch, strings.Join(available, ", "))
+}
+
+func (e *Executor) hostArch() string {
+	if e.HostArch != "" {
+		return e.HostArch
+	}
+	return runtime.GOARCH
+}
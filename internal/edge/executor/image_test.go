@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestResolveImageByArch(t *testing.T) {
+	defaults := map[string]ImageRef{
+		"amd64": {KernelPath: "/images/amd64/vmlinux", RootfsPath: "/images/amd64/rootfs.ext4"},
+		"arm64": {KernelPath: "/images/arm64/Image", RootfsPath: "/images/arm64/rootfs.ext4"},
+	}
+	cases := []struct {
+		arch       string
+		wantKernel string
+		wantRootfs string
+	}{
+		{"amd64", "/images/amd64/vmlinux", "/images/amd64/rootfs.ext4"},
+		{"x86_64", "/images/amd64/vmlinux", "/images/amd64/rootfs.ext4"},
+		{"arm64", "/images/arm64/Image", "/images/arm64/rootfs.ext4"},
+		{"aarch64", "/images/arm64/Image", "/images/arm64/rootfs.ext4"},
+	}
+	for _, tc := range cases {
+		params := MicroVMParams{VMID: "vm-1", ImageDefaults: defaults}
+		if err := ResolveImage(&params, tc.arch); err != nil {
+			t.Fatalf("%s: %v", tc.arch, err)
+		}
+		if params.KernelPath != tc.wantKernel || params.RootfsPath != tc.wantRootfs {
+			t.Fatalf("%s: got kernel=%s rootfs=%s", tc.arch, params.KernelPath, params.RootfsPath)
+		}
+	}
+
+	pinned := MicroVMParams{RootfsPath: "/custom/rootfs.ext4", ImageDefaults: defaults}
+	if err := ResolveImage(&pinned, "arm64"); err != nil || pinned.RootfsPath != "/custom/rootfs.ext4" || pinned.KernelPath != "" {
+		t.Fatalf("pinned image should be kept, got %+v (%v)", pinned, err)
+	}
+
+	none := MicroVMParams{}
+	if err := ResolveImage(&none, "riscv64"); err != nil || none.RootfsPath != "" {
+		t.Fatalf("no defaults should leave params unchanged, got %+v (%v)", none, err)
+	}
+
+	amdOnly := MicroVMParams{ImageDefaults: map[string]ImageRef{"amd64": defaults["amd64"]}}
+	err := ResolveImage(&amdOnly, "arm64")
+	if err == nil || !strings.Contains(err.Error(), "no default image for host arch arm64") {
+		t.Fatalf("expected missing arch error, got %v", err)
+	}
+}
+
+type recordingProvider struct {
+	fakeProvider
+	created MicroVMParams
+}
+
+func (p *recordingProvider) Create(_ context.Context, params MicroVMParams) error {
+	p.created = params
+	return nil
+}
+
+func TestExecutor_CreateUsesArchDefaultImage(t *testing.T) {
+	params, _ := json.Marshal(MicroVMParams{VMID: "vm-1", ImageDefaults: map[string]ImageRef{
+		"amd64": {RootfsPath: "/images/amd64.ext4"},
+		"arm64": {RootfsPath: "/images/arm64.ext4"},
+	}})
+	for _, tc := range []struct {
+		arch     string
+		wantOK   bool
+		wantDisk string
+	}{
+		{"arm64", true, "/images/arm64.ext4"},
+		{"amd64", true, "/images/amd64.ext4"},
+		{"riscv64", false, ""},
+	} {
+		st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		provider := &recordingProvider{}
+		exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, HostArch: tc.arch}
+		result, _ := exec.ExecutePlan(context.Background(), Plan{
+			ExecutionID: "exec-" + tc.arch,
+			Actions:     []Action{{ActionID: "act-1", Type: ActionMicroVMCreate, Params: params}},
+		})
+		st.Close()
+		if len(result.Results) != 1 || result.Results[0].OK != tc.wantOK {
+			t.Fatalf("%s: unexpected results %+v", tc.arch, result.Results)
+		}
+		if !tc.wantOK {
+			if result.Results[0].ErrorCode != FailureInvalidParams {
+				t.Fatalf("%s: expected %s, got %s", tc.arch, FailureInvalidParams, result.Results[0].ErrorCode)
+			}
+			continue
+		}
+		if provider.created.RootfsPath != tc.wantDisk {
+			t.Fatalf("%s: expected rootfs %s, got %s", tc.arch, tc.wantDisk, provider.created.RootfsPath)
+		}
+	}
+}
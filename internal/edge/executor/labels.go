@@ -0,0 +1,53 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+var labelPlaceholderRE = regexp.MustCompile(`\{label\.([A-Za-z0-9_.-]+)\}`)
+
+// expandLabels replaces {label.NAME} placeholders in the string values of
+// params, for instance a rootfs_path of "/images/{label.arch}/rootfs.ext4",
+// with the plan's agent labels. A placeholder naming an unknown label is an
+// error rather than being left in place.
+func expandLabels(params json.RawMessage, labels map[string]string) (json.RawMessage, error) {
+	if !bytes.Contains(params, []byte("{label.")) {
+		return params, nil
+	}
+	var v any
+	if err := json.Unmarshal(params, &v); err != nil {
+		return nil, err
+	}
+	var missing string
+	var expand func(any) any
+	expand = func(v any) any {
+		switch v := v.(type) {
+		case string:
+			return labelPlaceholderRE.ReplaceAllStringFunc(v, func(m string) string {
+				name := labelPlaceholderRE.FindStringSubmatch(m)[1]
+				value, ok := labels[name]
+				if !ok && missing == "" {
+					missing = name
+				}
+				return value
+			})
+		case []any:
+			for i := range v {
+				v[i] = expand(v[i])
+			}
+		case map[string]any:
+			for k := range v {
+				v[k] = expand(v[k])
+			}
+		}
+		return v
+	}
+	v = expand(v)
+	if missing != "" {
+		return nil, fmt.Errorf("unknown label %q", missing)
+	}
+	return json.Marshal(v)
+}
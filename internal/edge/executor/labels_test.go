@@ -0,0 +1,42 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestExecutor_ExpandsAgentLabelsInParams(t *testing.T) {
+	provider := &fakeProvider{}
+	exec := newHookedExecutor(t, provider, ActionHooks{})
+	params, _ := json.Marshal(MicroVMParams{
+		VMID:       "vm-1",
+		Name:       "web-{label.rack}",
+		KernelPath: "/images/{label.arch}/vmlinux",
+		RootfsPath: "/images/{label.arch}/rootfs.ext4",
+		Labels:     map[string]string{"placed-on": "{label.os}/{label.arch}"},
+	})
+	plan := Plan{
+		ExecutionID: "exec-1",
+		Labels:      map[string]string{"arch": "arm64", "os": "linux", "rack": "r12"},
+		Actions:     []Action{{ActionID: "act-1", Type: ActionMicroVMCreate, Params: params}},
+	}
+
+	result, err := exec.ExecutePlan(context.Background(), plan)
+	if err != nil || !result.Results[0].OK {
+		t.Fatalf("expected the action to succeed, got %+v (%v)", result.Results, err)
+	}
+	got := provider.created
+	if got.Name != "web-r12" || got.KernelPath != "/images/arm64/vmlinux" || got.RootfsPath != "/images/arm64/rootfs.ext4" || got.Labels["placed-on"] != "linux/arm64" {
+		t.Fatalf("labels not expanded: %+v", got)
+	}
+
+	// A placeholder for a label the agent does not have fails the action.
+	provider = &fakeProvider{}
+	exec = newHookedExecutor(t, provider, ActionHooks{})
+	plan.Labels = map[string]string{"os": "linux"}
+	result, _ = exec.ExecutePlan(context.Background(), plan)
+	if res := result.Results[0]; res.OK || res.ErrorCode != FailureInvalidParams || provider.create != 0 {
+		t.Fatalf("expected INVALID_PARAMS for an unknown label, got %+v", res)
+	}
+}
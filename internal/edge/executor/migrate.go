@@ -0,0 +1,169 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
+)
+
+// Migration steps. The control plane runs SNAPSHOT, TRANSFER, CLEANUP and
+// ROLLBACK_SOURCE on the source host, RESTORE and ROLLBACK_TARGET on the
+// target host.
+const (
+	MigrationStepSnapshot       = "SNAPSHOT"
+	MigrationStepTransfer       = "TRANSFER"
+	MigrationStepRestore        = "RESTORE"
+	MigrationStepCleanup        = "CLEANUP"
+	MigrationStepRollbackTarget = "ROLLBACK_TARGET"
+	MigrationStepRollbackSource = "ROLLBACK_SOURCE"
+)
+
+// MigrationDriver moves a VM's on-disk state between hosts. Export runs on
+// the source host, Transfer pushes the export from the source to the target
+// host and Import runs on the target host. Remove deletes a host's copy of
+// the export once the step that needed it is done.
+type MigrationDriver interface {
+	Export(ctx context.Context, vmID, snapshotName string) error
+	Transfer(ctx context.Context, snapshotName, targetHost string) error
+	Import(ctx context.Context, vmID, snapshotName string) error
+	Remove(ctx context.Context, snapshotName string) error
+}
+
+func (e *Executor) executeMigrate(ctx context.Context, action Action) error {
+	var params MigrateParams
+	if err := json.Unmarshal(action.Params, &params); err != nil {
+		return Categorize(FailureInvalidParams, fmt.Errorf("unmarshal migrate params: %w", err))
+	}
+	if params.VMID == "" {
+		return fmt.Errorf("vm_id is required")
+	}
+	if params.SnapshotName == "" {
+		return fmt.Errorf("snapshot_name is required")
+	}
+	if e.Migrations == nil {
+		return fmt.Errorf("migration is not supported on this host")
+	}
+
+	switch params.Step {
+	case MigrationStepSnapshot:
+		// The VM is stopped, not paused, so the disk cannot change once
+		// the snapshot is taken.
+		if err := e.Provider.Stop(ctx, params.VMID); err != nil {
+			return fmt.Errorf("failed to stop VM: %w", err)
+		}
+		return e.Migrations.Export(ctx, params.VMID, params.SnapshotName)
+	case MigrationStepTransfer:
+		if params.TargetHost == "" {
+			return fmt.Errorf("target_host is required")
+		}
+		return e.Migrations.Transfer(ctx, params.SnapshotName, params.TargetHost)
+	case MigrationStepRestore:
+		if err := e.Migrations.Import(ctx, params.VMID, params.SnapshotName); err != nil {
+			return err
+		}
+		e.removeMigrationSnapshot(ctx, params)
+		if err := e.Provider.Start(ctx, params.VMID); err != nil {
+			return fmt.Errorf("failed to start restored VM: %w", err)
+		}
+		e.setDesiredStatus(params.VMID, "RUNNING")
+		return nil
+	case MigrationStepCleanup, MigrationStepRollbackTarget:
+		if err := e.Provider.Delete(ctx, params.VMID); err != nil {
+			return err
+		}
+		e.removeMigrationSnapshot(ctx, params)
+		return nil
+	case MigrationStepRollbackSource:
+		if err := e.Provider.Start(ctx, params.VMID); err != nil {
+			return fmt.Errorf("failed to restart VM: %w", err)
+		}
+		e.setDesiredStatus(params.VMID, "RUNNING")
+		e.removeMigrationSnapshot(ctx, params)
+		return nil
+	default:
+		return fmt.Errorf("unknown migration step: %q", params.Step)
+	}
+}
+
+// removeMigrationSnapshot removes this host's copy of the migration
+// snapshot. It is best-effort: the step has done its work, so errors are
+// logged.
+func (e *Executor) removeMigrationSnapshot(ctx context.Context, params MigrateParams) {
+	if err := e.Migrations.Remove(ctx, params.SnapshotName); err != nil {
+		logger.WithComponent("executor").WithFields(map[string]interface{}{
+			"vm_id":    params.VMID,
+			"snapshot": params.SnapshotName,
+			"error":    err.Error(),
+		}).Warn("failed to remove migration snapshot")
+	}
+}
+
+// DirMigrationDriver migrates a VM by copying its runtime directory. Both
+// hosts must use the same RuntimeDir and SnapshotDir, and Transfer needs
+// rsync with SSH access from the source to the target host.
+type DirMigrationDriver struct {
+	RuntimeDir  string
+	SnapshotDir string
+	RsyncBinary string
+}
+
+// Export copies the VM's runtime directory into SnapshotDir/snapshotName.
+func (d *DirMigrationDriver) Export(_ context.Context, vmID, snapshotName string) error {
+	return copyDir(filepath.Join(d.RuntimeDir, vmID), filepath.Join(d.SnapshotDir, snapshotName))
+}
+
+// Transfer pushes SnapshotDir/snapshotName to the same path on targetHost.
+func (d *DirMigrationDriver) Transfer(ctx context.Context, snapshotName, targetHost string) error {
+	bin := d.RsyncBinary
+	if bin == "" {
+		bin = "rsync"
+	}
+	dir := filepath.Join(d.SnapshotDir, snapshotName)
+	out, err := exec.CommandContext(ctx, bin, "-a", "--mkpath", dir+"/", targetHost+":"+dir+"/").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("transfer snapshot to %s: %w: %s", targetHost, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Import copies SnapshotDir/snapshotName into the VM's runtime directory.
+func (d *DirMigrationDriver) Import(_ context.Context, vmID, snapshotName string) error {
+	src := filepath.Join(d.SnapshotDir, snapshotName)
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("snapshot not found: %w", err)
+	}
+	return copyDir(src, filepath.Join(d.RuntimeDir, vmID))
+}
+
+// Remove deletes SnapshotDir/snapshotName.
+func (d *DirMigrationDriver) Remove(_ context.Context, snapshotName string) error {
+	return os.RemoveAll(filepath.Join(d.SnapshotDir, snapshotName))
+}
+
+// copyDir copies the regular files under src into dst. Sockets and other
+// special files, such as a stale API socket, are skipped.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return copyFileSnapshot(path, target)
+	})
+}
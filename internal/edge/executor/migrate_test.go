@@ -0,0 +1,171 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+type stubMigrationDriver struct {
+	calls     []string
+	importErr error
+}
+
+func (d *stubMigrationDriver) Export(_ context.Context, vmID, snapshotName string) error {
+	d.calls = append(d.calls, "export:"+vmID+":"+snapshotName)
+	return nil
+}
+
+func (d *stubMigrationDriver) Transfer(_ context.Context, snapshotName, targetHost string) error {
+	d.calls = append(d.calls, "transfer:"+snapshotName+":"+targetHost)
+	return nil
+}
+
+func (d *stubMigrationDriver) Import(_ context.Context, vmID, snapshotName string) error {
+	d.calls = append(d.calls, "import:"+vmID+":"+snapshotName)
+	return d.importErr
+}
+
+func (d *stubMigrationDriver) Remove(_ context.Context, snapshotName string) error {
+	d.calls = append(d.calls, "remove:"+snapshotName)
+	return nil
+}
+
+func migrateAction(t *testing.T, id, step string) Action {
+	t.Helper()
+	params, err := json.Marshal(MigrateParams{
+		VMID:         "vm-1",
+		MigrationID:  "mig-1",
+		Step:         step,
+		SnapshotName: "migrate-mig-1",
+		TargetHost:   "host-b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Action{ActionID: id, Type: ActionMicroVMMigrate, Params: params}
+}
+
+func TestExecutor_MicroVMMigrateSteps(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.UpsertMicroVM(state.MicroVM{ID: "vm-1", Status: "RUNNING"}); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &fakeProvider{}
+	driver := &stubMigrationDriver{}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, Migrations: driver}
+
+	steps := []string{MigrationStepSnapshot, MigrationStepTransfer, MigrationStepRestore, MigrationStepCleanup}
+	for i, step := range steps {
+		plan := Plan{ExecutionID: "exec-1", Actions: []Action{migrateAction(t, "act-"+step, step)}}
+		if _, err := exec.ExecutePlan(context.Background(), plan); err != nil {
+			t.Fatalf("step %d (%s): %v", i, step, err)
+		}
+	}
+
+	want := []string{"export:vm-1:migrate-mig-1", "transfer:migrate-mig-1:host-b", "import:vm-1:migrate-mig-1", "remove:migrate-mig-1", "remove:migrate-mig-1"}
+	if len(driver.calls) != len(want) {
+		t.Fatalf("driver calls = %v, want %v", driver.calls, want)
+	}
+	for i := range want {
+		if driver.calls[i] != want[i] {
+			t.Fatalf("driver calls = %v, want %v", driver.calls, want)
+		}
+	}
+	if provider.stop != 1 || provider.start != 1 || provider.delete != 1 {
+		t.Fatalf("provider calls: stop=%d start=%d delete=%d", provider.stop, provider.start, provider.delete)
+	}
+}
+
+func TestExecutor_MicroVMMigrateRestoreFailure(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	provider := &fakeProvider{}
+	driver := &stubMigrationDriver{importErr: errors.New("disk corrupt")}
+	exec := &Executor{Store: st, Provider: provider, Logs: &noOpSink{}, Migrations: driver}
+
+	plan := Plan{ExecutionID: "exec-1", Actions: []Action{migrateAction(t, "act-restore", MigrationStepRestore)}}
+	result, err := exec.ExecutePlan(context.Background(), plan)
+	if err == nil {
+		t.Fatal("expected restore to fail")
+	}
+	if result.Results[0].OK || result.Results[0].Message != "disk corrupt" {
+		t.Fatalf("unexpected result: %+v", result.Results[0])
+	}
+	if provider.start != 0 {
+		t.Fatalf("restored VM should not be started, start=%d", provider.start)
+	}
+
+	plan = Plan{ExecutionID: "exec-2", Actions: []Action{migrateAction(t, "act-rollback", MigrationStepRollbackSource)}}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if provider.start != 1 {
+		t.Fatalf("rollback should restart the source VM, start=%d", provider.start)
+	}
+}
+
+func TestExecutor_MicroVMMigrateWithoutDriver(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	exec := &Executor{Store: st, Provider: &fakeProvider{}, Logs: &noOpSink{}}
+	plan := Plan{ExecutionID: "exec-1", Actions: []Action{migrateAction(t, "act-1", MigrationStepSnapshot)}}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err == nil {
+		t.Fatal("expected migrate to fail without a migration driver")
+	}
+}
+
+func TestDirMigrationDriverExportImport(t *testing.T) {
+	root := t.TempDir()
+	src := &DirMigrationDriver{RuntimeDir: filepath.Join(root, "a", "vms"), SnapshotDir: filepath.Join(root, "snapshots")}
+	dst := &DirMigrationDriver{RuntimeDir: filepath.Join(root, "b", "vms"), SnapshotDir: src.SnapshotDir}
+
+	vmDir := filepath.Join(src.RuntimeDir, "vm-1")
+	if err := os.MkdirAll(vmDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(vmDir, "disk.raw"), []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(vmDir, "meta.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Export(context.Background(), "vm-1", "snap"); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if err := dst.Import(context.Background(), "vm-1", "snap"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst.RuntimeDir, "vm-1", "disk.raw"))
+	if err != nil || string(data) != "disk" {
+		t.Fatalf("imported disk = %q, %v", data, err)
+	}
+	if err := dst.Import(context.Background(), "vm-2", "missing"); err == nil {
+		t.Fatal("expected import of a missing snapshot to fail")
+	}
+	if err := dst.Remove(context.Background(), "snap"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst.SnapshotDir, "snap")); !os.IsNotExist(err) {
+		t.Fatalf("expected the snapshot to be removed, stat err = %v", err)
+	}
+}
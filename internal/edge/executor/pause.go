@@ -11,7 +11,7 @@ import (
 func (e *Executor) executePause(ctx context.Context, action Action) error {
 	var params PauseParams
 	if err := json.Unmarshal(action.Params, &params); err != nil {
-		return fmt.Errorf("unmarshal pause params: %w", err)
+		return Categorize(FailureInvalidParams, fmt.Errorf("unmarshal pause params: %w", err))
 	}
 
 	if params.VMID == "" {
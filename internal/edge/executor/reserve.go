@@ -0,0 +1,62 @@
+package executor
+
+import "fmt"
+
+// Sizes providers give a VM whose CREATE leaves vcpu or memory_mib unset.
+const (
+	defaultVMVCPU      = 1
+	defaultVMMemoryMiB = 256
+)
+
+// ResourceReserve is the memory and CPU a CREATE must leave free on the
+// host, so VMs cannot push it into OOM. Zero fields are not enforced.
+type ResourceReserve struct {
+	MemoryMiB int
+	CPUCores  int
+}
+
+// HostResources is what the host has left for new VMs.
+type HostResources struct {
+	FreeMemoryMiB int
+	FreeCPUCores  int
+}
+
+// admit checks a CREATE against the reserve. Admitted VMs count against
+// the free resources until release is called, which the caller does once
+// the VM is created and shows up in HostResources.
+func (e *Executor) admit(params MicroVMParams) (release func(), err error) {
+	noop := func() {}
+	if e.HostResources == nil || (e.Reserve.MemoryMiB <= 0 && e.Reserve.CPUCores <= 0) {
+		return noop, nil
+	}
+	memory, vcpu := params.MemoryMiB, params.VCPU
+	if memory <= 0 {
+		memory = defaultVMMemoryMiB
+	}
+	if vcpu <= 0 {
+		vcpu = defaultVMVCPU
+	}
+
+	e.admitMu.Lock()
+	defer e.admitMu.Unlock()
+	free, err := e.HostResources()
+	if err != nil {
+		return noop, fmt.Errorf("read host resources: %w", err)
+	}
+	freeMemory := free.FreeMemoryMiB - e.admitted.FreeMemoryMiB - memory
+	freeCPU := free.FreeCPUCores - e.admitted.FreeCPUCores - vcpu
+	if e.Reserve.MemoryMiB > 0 && freeMemory < e.Reserve.MemoryMiB {
+		return noop, Categorize(FailureInsufficientResources, fmt.Errorf("%d MiB memory requested, leaving %d MiB free, below the %d MiB reserve", memory, freeMemory, e.Reserve.MemoryMiB))
+	}
+	if e.Reserve.CPUCores > 0 && freeCPU < e.Reserve.CPUCores {
+		return noop, Categorize(FailureInsufficientResources, fmt.Errorf("%d vCPUs requested, leaving %d cores free, below the %d core reserve", vcpu, freeCPU, e.Reserve.CPUCores))
+	}
+	e.admitted.FreeMemoryMiB += memory
+	e.admitted.FreeCPUCores += vcpu
+	return func() {
+		e.admitMu.Lock()
+		defer e.admitMu.Unlock()
+		e.admitted.FreeMemoryMiB -= memory
+		e.admitted.FreeCPUCores -= vcpu
+	}, nil
+}
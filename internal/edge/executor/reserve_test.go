@@ -0,0 +1,65 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+func TestExecutor_CreateStopsAtResourceReserve(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	provider := &fakeProvider{}
+	// 4 GiB and 8 cores free before any VM; each VM takes 1 GiB and 2 cores.
+	exec := &Executor{
+		Store:    st,
+		Provider: provider,
+		Logs:     &noOpSink{},
+		Reserve:  ResourceReserve{MemoryMiB: 1024, CPUCores: 1},
+		HostResources: func() (HostResources, error) {
+			provider.mu.Lock()
+			defer provider.mu.Unlock()
+			return HostResources{FreeMemoryMiB: 4096 - provider.create*1024, FreeCPUCores: 8 - provider.create*2}, nil
+		},
+	}
+
+	create := func(i int) ActionResult {
+		params, _ := json.Marshal(MicroVMParams{VMID: fmt.Sprintf("vm-%d", i), VCPU: 2, MemoryMiB: 1024})
+		result, _ := exec.ExecutePlan(context.Background(), Plan{
+			ExecutionID: fmt.Sprintf("exec-%d", i),
+			Actions:     []Action{{ActionID: fmt.Sprintf("act-%d", i), Type: ActionMicroVMCreate, Params: params}},
+		})
+		return result.Results[0]
+	}
+	// The third VM leaves exactly the 1 GiB reserve.
+	for i := 1; i <= 3; i++ {
+		if res := create(i); !res.OK {
+			t.Fatalf("create %d: expected success, got %+v", i, res)
+		}
+	}
+	res := create(4)
+	if res.OK || res.ErrorCode != FailureInsufficientResources {
+		t.Fatalf("expected the fourth create to fail with %s, got %+v", FailureInsufficientResources, res)
+	}
+	if provider.create != 3 {
+		t.Fatalf("expected 3 provider creates, got %d", provider.create)
+	}
+
+	// The CPU reserve applies on its own: 2 cores are left, a 2 vCPU VM
+	// would leave none.
+	exec.Reserve = ResourceReserve{CPUCores: 1}
+	if res := create(5); res.OK || res.ErrorCode != FailureInsufficientResources {
+		t.Fatalf("expected the CPU reserve to reject the create, got %+v", res)
+	}
+	exec.Reserve = ResourceReserve{}
+	if res := create(6); !res.OK {
+		t.Fatalf("expected no reserve to admit the create, got %+v", res)
+	}
+}
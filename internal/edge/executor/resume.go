@@ -11,7 +11,7 @@ import (
 func (e *Executor) executeResume(ctx context.Context, action Action) error {
 	var params ResumeParams
 	if err := json.Unmarshal(action.Params, &params); err != nil {
-		return fmt.Errorf("unmarshal resume params: %w", err)
+		return Categorize(FailureInvalidParams, fmt.Errorf("unmarshal resume params: %w", err))
 	}
 
 	if params.VMID == "" {
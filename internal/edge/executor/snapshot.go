@@ -7,12 +7,14 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
 )
 
 func (e *Executor) executeSnapshot(ctx context.Context, action Action) error {
 	var params SnapshotParams
 	if err := json.Unmarshal(action.Params, &params); err != nil {
-		return fmt.Errorf("unmarshal snapshot params: %w", err)
+		return Categorize(FailureInvalidParams, fmt.Errorf("unmarshal snapshot params: %w", err))
 	}
 
 	if params.VMID == "" {
@@ -32,7 +34,7 @@ func (e *Executor) executeSnapshot(ctx context.Context, action Action) error {
 	}
 
 	// Determine snapshot directory
-	snapshotDir := filepath.Join("/var/lib/nkudo-edge/snapshots", params.SnapshotName)
+	snapshotDir := filepath.Join(e.snapshotDir(), params.SnapshotName)
 	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
 		return fmt.Errorf("failed to create snapshot dir: %w", err)
 	}
@@ -82,6 +84,50 @@ func (e *Executor) executeSnapshot(ctx context.Context, action Action) error {
 	return nil
 }
 
+// defaultSnapshotDir is where snapshots go when Executor.SnapshotDir is
+// empty.
+const defaultSnapshotDir = "/var/lib/nkudo-edge/snapshots"
+
+func (e *Executor) snapshotDir() string {
+	if e.SnapshotDir != "" {
+		return e.SnapshotDir
+	}
+	return defaultSnapshotDir
+}
+
+// removeVMSnapshots removes the snapshots taken of vmID once the VM is
+// deleted, found by the vm_id in their config.json. It is best-effort:
+// errors are logged.
+func (e *Executor) removeVMSnapshots(vmID string) {
+	entries, err := os.ReadDir(e.snapshotDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(e.snapshotDir(), entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+		if err != nil {
+			continue
+		}
+		var config struct {
+			VMID string `json:"vm_id"`
+		}
+		if json.Unmarshal(data, &config) != nil || config.VMID != vmID {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logger.WithComponent("executor").WithFields(map[string]interface{}{
+				"vm_id":    vmID,
+				"snapshot": entry.Name(),
+				"error":    err.Error(),
+			}).Warn("failed to remove snapshot of deleted VM")
+		}
+	}
+}
+
 // copyFileSnapshot copies a file from src to dst
 func copyFileSnapshot(src, dst string) error {
 	srcFile, err := os.Open(src)
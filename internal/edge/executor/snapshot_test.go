@@ -181,3 +181,38 @@ func TestExecutor_MicroVMSnapshot_VMNotFound(t *testing.T) {
 		t.Error("expected action to fail when VM not found")
 	}
 }
+
+func TestExecutor_DeleteRemovesSnapshotsOfTheVM(t *testing.T) {
+	st, err := state.Open(filepath.Join(t.TempDir(), "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	snapshots := t.TempDir()
+	for name, vmID := range map[string]string{"snap-a": "vm-1", "snap-b": "vm-1", "snap-c": "vm-2"} {
+		dir := filepath.Join(snapshots, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		config, _ := json.Marshal(map[string]string{"vm_id": vmID})
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), config, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec := &Executor{Store: st, Provider: &fakeProvider{}, Logs: &noOpSink{}, SnapshotDir: snapshots}
+	params, _ := json.Marshal(MicroVMParams{VMID: "vm-1"})
+	plan := Plan{ExecutionID: "exec-1", Actions: []Action{{ActionID: "act-1", Type: ActionMicroVMDelete, Params: params}}}
+	if _, err := exec.ExecutePlan(context.Background(), plan); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	entries, err := os.ReadDir(snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "snap-c" {
+		t.Fatalf("expected only the other VM's snapshot to remain, got %v", entries)
+	}
+}
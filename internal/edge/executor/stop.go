@@ -0,0 +1,59 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+)
+
+// Stop methods of a MicroVMStop action. Each one starts the provider's
+// shutdown cascade at a later step: acpi asks the guest to shut down, then
+// falls back to SIGTERM and SIGKILL; signal starts at SIGTERM; force kills
+// the hypervisor process right away.
+const (
+	StopMethodACPI   = "acpi"
+	StopMethodSignal = "signal"
+	StopMethodForce  = "force"
+)
+
+// MaxStopGracePeriod is the longest grace period, in seconds, a stop may
+// give the first step of its method.
+const MaxStopGracePeriod = 600
+
+// StopOptions are the optional shutdown settings of a MicroVMStop action.
+// The zero value is the provider's default cascade and timeouts.
+type StopOptions struct {
+	Method string `json:"method,omitempty"`
+	// GracePeriod is how long, in seconds, the first step of the method
+	// may take before the next one runs.
+	GracePeriod int `json:"grace_period,omitempty"`
+}
+
+// Validate checks the method and the grace period bounds.
+func (o StopOptions) Validate() error {
+	switch o.Method {
+	case "", StopMethodACPI, StopMethodSignal, StopMethodForce:
+	default:
+		return fmt.Errorf("invalid stop method %q: want %s, %s or %s", o.Method, StopMethodACPI, StopMethodSignal, StopMethodForce)
+	}
+	if o.GracePeriod < 0 || o.GracePeriod > MaxStopGracePeriod {
+		return fmt.Errorf("grace_period must be between 0 and %d seconds", MaxStopGracePeriod)
+	}
+	return nil
+}
+
+// GracefulStopper is implemented by providers that honor StopOptions.
+type GracefulStopper interface {
+	StopWithOptions(ctx context.Context, vmID string, opts StopOptions) error
+}
+
+// stopVM stops a VM with the default cascade, or with opts when set.
+func (e *Executor) stopVM(ctx context.Context, vmID string, opts StopOptions) error {
+	if opts == (StopOptions{}) {
+		return e.Provider.Stop(ctx, vmID)
+	}
+	s, ok := e.Provider.(GracefulStopper)
+	if !ok {
+		return Categorize(FailureUnsupportedOperation, fmt.Errorf("this host's VM provider does not support stop options"))
+	}
+	return s.StopWithOptions(ctx, vmID, opts)
+}
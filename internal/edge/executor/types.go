@@ -16,6 +16,7 @@ const (
 	ActionMicroVMPause     ActionType = "MicroVMPause"
 	ActionMicroVMResume    ActionType = "MicroVMResume"
 	ActionMicroVMSnapshot  ActionType = "MicroVMSnapshot"
+	ActionMicroVMMigrate   ActionType = "MicroVMMigrate"
 	ActionCommandExecute   ActionType = "CommandExecute"
 )
 
@@ -23,6 +24,16 @@ type Plan struct {
 	PlanID      string   `json:"plan_id,omitempty"`
 	ExecutionID string   `json:"execution_id"`
 	Actions     []Action `json:"actions"`
+	// ResultTTL is how long, in seconds, the agent should keep action
+	// records for this plan. Zero means the agent default.
+	ResultTTL int64 `json:"result_ttl,omitempty"`
+	// Sequential runs actions strictly in order and stops at the first
+	// failure. By default every action runs even if an earlier one failed.
+	Sequential bool `json:"sequential,omitempty"`
+	// Labels are the agent's labels as resolved by the control plane (os,
+	// arch, operator metadata). Action params reference them as
+	// {label.NAME}.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Action struct {
@@ -31,6 +42,14 @@ type Action struct {
 	Params        json.RawMessage `json:"params"`
 	DesiredState  string          `json:"desired_state,omitempty"`
 	TimeoutSecond int             `json:"timeout"`
+	// DependsOn lists action IDs of earlier actions of the plan; the action
+	// is skipped unless all of them succeeded.
+	DependsOn []string `json:"depends_on,omitempty"`
+	// BootOrder runs the CREATE and START actions that set it by ascending
+	// order, and BootDelaySeconds is how long to wait before running one.
+	// See bootSequence.
+	BootOrder        int `json:"boot_order,omitempty"`
+	BootDelaySeconds int `json:"boot_delay_seconds,omitempty"`
 }
 
 // IPConfig represents static IP configuration for a network interface
@@ -58,6 +77,12 @@ type MicroVMParams struct {
 	VCPU       int                `json:"vcpu"`
 	MemoryMiB  int                `json:"memory_mib"`
 	ExtraArgs  []string           `json:"extra_args,omitempty"`
+	Labels     map[string]string  `json:"labels,omitempty"`
+	Files      []FileSpec         `json:"files,omitempty"` // Written by cloud-init on first boot
+	Disks      []DiskSpec         `json:"disks,omitempty"` // Extra data disks, created empty
+	// ImageDefaults are the site's images by host arch, used when
+	// RootfsPath is empty. See ResolveImage.
+	ImageDefaults map[string]ImageRef `json:"image_defaults,omitempty"`
 }
 
 // GetNetworks returns the list of network interfaces for the VM.
@@ -100,11 +125,25 @@ type SnapshotParams struct {
 	SnapshotName string `json:"snapshot_name"`
 }
 
+// MigrateParams runs one step of a VM migration. TargetHost is only set
+// for the TRANSFER step.
+type MigrateParams struct {
+	VMID         string `json:"vm_id"`
+	MigrationID  string `json:"migration_id"`
+	Step         string `json:"step"`
+	SnapshotName string `json:"snapshot_name"`
+	TargetHost   string `json:"target_host,omitempty"`
+}
+
 type CommandParams struct {
-	Command string   `json:"command"`
-	Args    []string `json:"args"`
-	Timeout int      `json:"timeout_seconds"`
-	Dir     string   `json:"working_dir,omitempty"`
+	Command string            `json:"command"`
+	Args    []string          `json:"args"`
+	Timeout int               `json:"timeout_seconds"`
+	Dir     string            `json:"working_dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// AllowPathOverride permits Env to set PATH and dynamic loader
+	// variables such as LD_PRELOAD.
+	AllowPathOverride bool `json:"allow_path_override,omitempty"`
 }
 
 type ActionResult struct {
@@ -115,6 +154,9 @@ type ActionResult struct {
 	Message     string    `json:"message"`
 	StartedAt   time.Time `json:"started_at"`
 	FinishedAt  time.Time `json:"finished_at"`
+	// IdempotencyToken identifies this result across resends of its
+	// report, so the control plane applies it once.
+	IdempotencyToken string `json:"idempotency_token,omitempty"`
 }
 
 type PlanResult struct {
@@ -129,6 +171,9 @@ type MicroVMProvider interface {
 	Stop(context.Context, string) error
 	Delete(context.Context, string) error
 	GetProcessID(context.Context, string) (int, error)
+	// Capabilities lists the MicroVM action types the provider can run.
+	// The executor rejects the others with UNSUPPORTED_OPERATION.
+	Capabilities() []string
 }
 
 type LogEntry struct {
@@ -0,0 +1,259 @@
+package metadata
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// DefaultAddr is the link-local address cloud-init's EC2 datasource queries.
+// It must be assigned on the host side of the VM bridge.
+const DefaultAddr = "169.254.169.254:80"
+
+// VMLister lists the VMs of the host.
+type VMLister interface {
+	ListMicroVMs() ([]state.MicroVM, error)
+}
+
+// Server serves EC2-style instance metadata (/latest/meta-data/...) and
+// user-data (/latest/user-data) to guests. Each request is answered for
+// the VM it came from: the VM whose NIC has the MAC the host's neighbor
+// table holds for the source IP. A source IP alone can be spoofed by any
+// guest on the bridge, so a request whose IP is statically assigned to
+// another VM, or has no neighbor entry, is refused.
+type Server struct {
+	VMs VMLister
+	// UserData returns the user-data injected into a VM at create; nil
+	// serves none.
+	UserData func(vmID string) ([]byte, error)
+	// Neighbors returns the host's neighbor table as IP to MAC; nil reads
+	// /proc/net/arp.
+	Neighbors func() (map[string]string, error)
+	// Peers returns the site's VM DNS records; nil serves no hosts.
+	Peers func() []Peer
+}
+
+// Peer maps the hostname of a VM to its address on a VXLAN network.
+type Peer struct {
+	NetworkID string
+	VMID      string
+	Hostname  string
+	IPAddress string
+}
+
+// PeerTable holds the peers the control plane last sent. It is safe for
+// concurrent use.
+type PeerTable struct {
+	mu    sync.RWMutex
+	peers []Peer
+}
+
+// Set replaces the peers.
+func (t *PeerTable) Set(peers []Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = peers
+}
+
+// Peers returns the peers last set.
+func (t *PeerTable) Peers() []Peer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.peers
+}
+
+// Handler returns the metadata HTTP handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /latest/meta-data/{path...}", s.handleMetaData)
+	mux.HandleFunc("GET /latest/user-data", s.handleUserData)
+	return mux
+}
+
+func (s *Server) handleMetaData(w http.ResponseWriter, r *http.Request) {
+	vm, ok := s.requestVM(w, r)
+	if !ok {
+		return
+	}
+	path := strings.TrimSuffix(r.PathValue("path"), "/")
+	switch {
+	case path == "":
+		writeLines(w, "instance-id", "local-hostname", "hostname", "hosts", "tags/")
+	case path == "instance-id":
+		writeLines(w, vm.ID)
+	case path == "local-hostname" || path == "hostname":
+		writeLines(w, vmHostname(vm))
+	case path == "hosts":
+		writeLines(w, s.hosts(vm)...)
+	case path == "tags":
+		writeLines(w, "instance/")
+	case path == "tags/instance":
+		keys := make([]string, 0, len(vm.Labels))
+		for k := range vm.Labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		writeLines(w, keys...)
+	case strings.HasPrefix(path, "tags/instance/"):
+		value, ok := vm.Labels[strings.TrimPrefix(path, "tags/instance/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeLines(w, value)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleUserData(w http.ResponseWriter, r *http.Request) {
+	vm, ok := s.requestVM(w, r)
+	if !ok {
+		return
+	}
+	if s.UserData == nil {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := s.UserData(vm.ID)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "user-data unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
+
+// requestVM resolves the VM a request came from, answering 403 for
+// sources that are not a VM of this host.
+func (s *Server) requestVM(w http.ResponseWriter, r *http.Request) (state.MicroVM, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	vms, err := s.VMs.ListMicroVMs()
+	if err != nil || ip == nil {
+		http.Error(w, "metadata unavailable", http.StatusInternalServerError)
+		return state.MicroVM{}, false
+	}
+	neighbors := s.Neighbors
+	if neighbors == nil {
+		neighbors = readProcARP
+	}
+	table, err := neighbors()
+	if err != nil {
+		http.Error(w, "metadata unavailable", http.StatusInternalServerError)
+		return state.MicroVM{}, false
+	}
+	vm, ok := vmByMAC(vms, table[ip.String()])
+	if ok {
+		// The source IP must not belong to another VM.
+		if owner, static := vmByIP(vms, ip); !static || owner.ID == vm.ID {
+			return vm, true
+		}
+	}
+	http.Error(w, "unknown instance", http.StatusForbidden)
+	return state.MicroVM{}, false
+}
+
+// hosts returns /etc/hosts lines for the peers on the VXLAN networks vm
+// is registered on, so guests resolve each other by hostname.
+func (s *Server) hosts(vm state.MicroVM) []string {
+	if s.Peers == nil {
+		return nil
+	}
+	peers := s.Peers()
+	networks := make(map[string]bool)
+	for _, p := range peers {
+		if p.VMID == vm.ID {
+			networks[p.NetworkID] = true
+		}
+	}
+	var lines []string
+	for _, p := range peers {
+		if networks[p.NetworkID] {
+			lines = append(lines, p.IPAddress+" "+p.Hostname)
+		}
+	}
+	return lines
+}
+
+func vmByIP(vms []state.MicroVM, ip net.IP) (state.MicroVM, bool) {
+	for _, vm := range vms {
+		for _, n := range vm.GetNetworks() {
+			addr, _, err := net.ParseCIDR(n.IPAddr)
+			if err != nil {
+				addr = net.ParseIP(n.IPAddr)
+			}
+			if addr != nil && addr.Equal(ip) {
+				return vm, true
+			}
+		}
+	}
+	return state.MicroVM{}, false
+}
+
+func vmByMAC(vms []state.MicroVM, mac string) (state.MicroVM, bool) {
+	if mac == "" {
+		return state.MicroVM{}, false
+	}
+	for _, vm := range vms {
+		for _, n := range vm.GetNetworks() {
+			if n.MacAddr != "" && strings.EqualFold(n.MacAddr, mac) {
+				return vm, true
+			}
+		}
+	}
+	return state.MicroVM{}, false
+}
+
+func vmHostname(vm state.MicroVM) string {
+	if vm.Name != "" {
+		return vm.Name
+	}
+	return vm.ID
+}
+
+func writeLines(w http.ResponseWriter, lines ...string) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, strings.Join(lines, "\n"))
+}
+
+// readProcARP reads the IPv4 neighbor table from /proc/net/arp.
+func readProcARP() (map[string]string, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseARP(f)
+}
+
+// parseARP parses /proc/net/arp: a header line, then "IP HW-type Flags
+// HW-address Mask Device" per entry.
+func parseARP(r io.Reader) (map[string]string, error) {
+	table := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] == "00:00:00:00:00:00" {
+			continue
+		}
+		table[fields[0]] = fields[3]
+	}
+	return table, scanner.Err()
+}
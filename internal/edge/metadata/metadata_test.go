@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+type fakeVMs []state.MicroVM
+
+func (f fakeVMs) ListMicroVMs() ([]state.MicroVM, error) { return f, nil }
+
+func newTestServer() *Server {
+	return &Server{
+		VMs: fakeVMs{
+			{ID: "vm-web", Name: "web-1", Labels: map[string]string{"role": "web", "env": "prod"},
+				Networks: []state.NetworkConfig{{ID: "eth0", TapName: "tap-web", IPAddr: "10.0.0.10/24", MacAddr: "02:fc:00:00:00:01"}}},
+			{ID: "vm-db", Name: "db-1", Labels: map[string]string{"role": "db"},
+				Networks: []state.NetworkConfig{{ID: "eth0", TapName: "tap-db", MacAddr: "02:fc:00:00:00:02"}}},
+		},
+		UserData: func(vmID string) ([]byte, error) {
+			if vmID == "vm-web" {
+				return []byte("#cloud-config\nhostname: web-1\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+		Neighbors: func() (map[string]string, error) {
+			return map[string]string{
+				"10.0.0.10": "02:fc:00:00:00:01",
+				"10.0.0.20": "02:FC:00:00:00:02",
+			}, nil
+		},
+	}
+}
+
+func get(t *testing.T, h http.Handler, remoteAddr, path string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestMetadataIsScopedToTheRequestingVM(t *testing.T) {
+	h := newTestServer().Handler()
+
+	cases := []struct {
+		remote, path, want string
+	}{
+		{"10.0.0.10:40000", "/latest/meta-data/instance-id", "vm-web"},
+		{"10.0.0.10:40000", "/latest/meta-data/local-hostname", "web-1"},
+		{"10.0.0.10:40000", "/latest/meta-data/tags/instance", "env\nrole"},
+		{"10.0.0.10:40000", "/latest/meta-data/tags/instance/role", "web"},
+		{"10.0.0.10:40000", "/latest/user-data", "#cloud-config\nhostname: web-1\n"},
+		// Guests are found through the MAC of their source IP.
+		{"10.0.0.20:40000", "/latest/meta-data/instance-id", "vm-db"},
+		{"10.0.0.20:40000", "/latest/meta-data/tags/instance/role", "db"},
+	}
+	for _, c := range cases {
+		code, body := get(t, h, c.remote, c.path)
+		if code != http.StatusOK || body != c.want {
+			t.Fatalf("GET %s from %s = %d %q, want %q", c.path, c.remote, code, body, c.want)
+		}
+	}
+
+	if code, _ := get(t, h, "10.0.0.20:40000", "/latest/user-data"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a VM without user-data, got %d", code)
+	}
+	if code, _ := get(t, h, "10.0.0.10:40000", "/latest/meta-data/tags/instance/missing"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing tag, got %d", code)
+	}
+	if code, body := get(t, h, "10.0.0.99:40000", "/latest/meta-data/instance-id"); code != http.StatusForbidden || strings.Contains(body, "vm-") {
+		t.Fatalf("expected an unknown source to be refused, got %d %q", code, body)
+	}
+}
+
+func TestMetadataRefusesSpoofedSourceAddresses(t *testing.T) {
+	s := newTestServer()
+	s.Neighbors = func() (map[string]string, error) {
+		// vm-db's MAC answers for vm-web's static address.
+		return map[string]string{"10.0.0.10": "02:fc:00:00:00:02"}, nil
+	}
+	h := s.Handler()
+	if code, body := get(t, h, "10.0.0.10:40000", "/latest/user-data"); code != http.StatusForbidden || strings.Contains(body, "cloud-config") {
+		t.Fatalf("expected a spoofed static address to be refused, got %d %q", code, body)
+	}
+
+	s.Neighbors = func() (map[string]string, error) { return map[string]string{}, nil }
+	if code, _ := get(t, h, "10.0.0.10:40000", "/latest/meta-data/instance-id"); code != http.StatusForbidden {
+		t.Fatalf("expected a source without a neighbor entry to be refused, got %d", code)
+	}
+}
+
+func TestParseARP(t *testing.T) {
+	table, err := parseARP(strings.NewReader(`IP address       HW type     Flags       HW address            Mask     Device
+10.0.0.20        0x1         0x2         02:fc:00:00:00:02     *        br0
+10.0.0.30        0x1         0x0         00:00:00:00:00:00     *        br0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 1 || table["10.0.0.20"] != "02:fc:00:00:00:02" {
+		t.Fatalf("unexpected neighbor table %v", table)
+	}
+}
+
+func TestHostsListPeersOnTheVMNetworks(t *testing.T) {
+	s := newTestServer()
+	peers := &PeerTable{}
+	s.Peers = peers.Peers
+	h := s.Handler()
+
+	if code, body := get(t, h, "10.0.0.10:40000", "/latest/meta-data/hosts"); code != http.StatusOK || body != "" {
+		t.Fatalf("expected no hosts before records arrive, got %d %q", code, body)
+	}
+	peers.Set([]Peer{
+		{NetworkID: "net-a", VMID: "vm-web", Hostname: "web-1", IPAddress: "10.0.0.10"},
+		{NetworkID: "net-a", VMID: "vm-api", Hostname: "api-1", IPAddress: "10.0.0.11"},
+		{NetworkID: "net-b", VMID: "vm-db", Hostname: "db-1", IPAddress: "10.0.1.20"},
+	})
+	if _, body := get(t, h, "10.0.0.10:40000", "/latest/meta-data/hosts"); body != "10.0.0.10 web-1\n10.0.0.11 api-1" {
+		t.Fatalf("expected the peers of net-a, got %q", body)
+	}
+	if _, body := get(t, h, "10.0.0.20:40000", "/latest/meta-data/hosts"); body != "10.0.1.20 db-1" {
+		t.Fatalf("expected only the peers of net-b, got %q", body)
+	}
+}
@@ -39,6 +39,12 @@ var (
 		Buckets: prometheus.DefBuckets,
 	}, []string{"action_type"})
 
+	// VMRestarts tracks VMs restarted by the watchdog after a crash
+	VMRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nkudo_vm_restarts_total",
+		Help: "Total VM restarts performed by the watchdog",
+	}, []string{"vm_id", "status"})
+
 	// HeartbeatsSent tracks total heartbeats sent
 	HeartbeatsSent = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "nkudo_heartbeats_sent_total",
@@ -90,6 +96,7 @@ func init() {
 		VMMemoryBytes,
 		ActionsExecuted,
 		ActionDuration,
+		VMRestarts,
 		HeartbeatsSent,
 		HeartbeatDuration,
 		HeartbeatFailures,
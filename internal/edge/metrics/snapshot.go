@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// snapshotSeries maps the registered metrics pushed to the control plane
+// to their snapshot names. Labelled metrics are summed, except VM counts,
+// which are split by state.
+var snapshotSeries = map[string]string{
+	"nkudo_heartbeats_sent_total":      "heartbeats_sent_total",
+	"nkudo_heartbeat_failures_total":   "heartbeat_failures_total",
+	"nkudo_heartbeat_duration_seconds": "heartbeat_duration_seconds",
+	"nkudo_actions_executed_total":     "actions_executed_total",
+	"nkudo_vm_restarts_total":          "vm_restarts_total",
+	"nkudo_host_memory_usage_bytes":    "host_memory_usage_bytes",
+	"nkudo_vms_total":                  "vms",
+}
+
+// Snapshot returns a compact, fixed set of the agent's metrics for pushing
+// with heartbeats from hosts the control plane cannot scrape. Histograms
+// contribute their _sum and _count.
+func Snapshot(g prometheus.Gatherer) (map[string]float64, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]float64{}
+	for _, family := range families {
+		name, ok := snapshotSeries[family.GetName()]
+		if !ok {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			switch {
+			case name == "vms":
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "state" {
+						out["vms_"+label.GetValue()] += m.GetGauge().GetValue()
+					}
+				}
+			case m.Histogram != nil:
+				out[name+"_sum"] += m.GetHistogram().GetSampleSum()
+				out[name+"_count"] += float64(m.GetHistogram().GetSampleCount())
+			default:
+				out[name] += metricValue(m)
+			}
+		}
+	}
+	return out, nil
+}
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.GetCounter().GetValue()
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue()
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSnapshotIsCompactAndBounded(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	vms := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nkudo_vms_total"}, []string{"state"})
+	sent := prometheus.NewCounter(prometheus.CounterOpts{Name: "nkudo_heartbeats_sent_total"})
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "nkudo_heartbeat_duration_seconds"})
+	actions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "nkudo_actions_executed_total"}, []string{"type", "status"})
+	perVM := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "nkudo_vm_cpu_cores"}, []string{"vm_id"})
+	reg.MustRegister(vms, sent, duration, actions, perVM)
+
+	vms.WithLabelValues("running").Set(3)
+	vms.WithLabelValues("stopped").Set(1)
+	sent.Add(7)
+	duration.Observe(0.25)
+	duration.Observe(0.75)
+	actions.WithLabelValues("create", "success").Add(2)
+	actions.WithLabelValues("stop", "failure").Add(1)
+	perVM.WithLabelValues("vm-1").Set(2)
+
+	got, err := Snapshot(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"vms_running":                      3,
+		"vms_stopped":                      1,
+		"heartbeats_sent_total":            7,
+		"heartbeat_duration_seconds_sum":   1,
+		"heartbeat_duration_seconds_count": 2,
+		"actions_executed_total":           3,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("%s = %v, want %v (snapshot %v)", k, got[k], v, got)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -77,10 +78,73 @@ func WritePKI(paths PKIPaths, keyPEM, certPEM, caPEM []byte) error {
 	return nil
 }
 
-func NewMutualTLSClient(paths PKIPaths, insecureSkipVerify bool) (*http.Client, error) {
-	cert, err := tls.LoadX509KeyPair(paths.ClientCert, paths.ClientKey)
+// ClientOption customises the control-plane clients.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	proxy             func(*http.Request) (*url.URL, error)
+	certs             *CertificateReloader
+	certCheckInterval time.Duration
+}
+
+// WithProxy sends requests through a fixed proxy URL instead of the
+// HTTPS_PROXY/NO_PROXY environment. An empty value keeps the environment
+// behaviour. HTTPS requests are tunnelled with CONNECT, so client
+// certificates still reach the control plane end to end.
+func WithProxy(rawURL string) (ClientOption, error) {
+	if rawURL == "" {
+		return func(*clientConfig) {}, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, fmt.Errorf("load client keypair: %w", err)
+		return nil, fmt.Errorf("parse proxy url: %w", err)
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("parse proxy url: %q must include scheme and host", rawURL)
+	}
+	return func(cfg *clientConfig) {
+		cfg.proxy = http.ProxyURL(proxyURL)
+	}, nil
+}
+
+// WithCertificateReloader makes the mutual TLS client take its certificate
+// from r, so callers such as CertRotator can share the same holder.
+func WithCertificateReloader(r *CertificateReloader) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.certs = r
+	}
+}
+
+// WithCertificateCheckInterval limits how often the mutual TLS client checks
+// the certificate files for changes. Zero checks before every request.
+func WithCertificateCheckInterval(d time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.certCheckInterval = d
+	}
+}
+
+func newClientConfig(opts []ClientOption) clientConfig {
+	cfg := clientConfig{proxy: http.ProxyFromEnvironment}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	return cfg
+}
+
+// NewMutualTLSClient returns a client that authenticates with the keypair in
+// paths. The keypair is re-read when the files change, so certificates
+// renewed on disk are used without recreating the client.
+func NewMutualTLSClient(paths PKIPaths, insecureSkipVerify bool, opts ...ClientOption) (*http.Client, error) {
+	cfg := newClientConfig(opts)
+	certs := cfg.certs
+	if certs == nil {
+		var err error
+		certs, err = NewCertificateReloader(paths, cfg.certCheckInterval)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	caPEM, err := os.ReadFile(paths.CACert)
@@ -93,18 +157,19 @@ func NewMutualTLSClient(paths PKIPaths, insecureSkipVerify bool) (*http.Client,
 	}
 
 	tr := &http.Transport{
+		Proxy: cfg.proxy,
 		TLSClientConfig: &tls.Config{
-			MinVersion:         tls.VersionTLS13,
-			Certificates:       []tls.Certificate{cert},
-			RootCAs:            pool,
-			InsecureSkipVerify: insecureSkipVerify,
+			MinVersion:           tls.VersionTLS13,
+			GetClientCertificate: certs.GetClientCertificate,
+			RootCAs:              pool,
+			InsecureSkipVerify:   insecureSkipVerify,
 		},
 	}
 
-	return &http.Client{Transport: tr, Timeout: 20 * time.Second}, nil
+	return &http.Client{Transport: &reloadingTransport{Transport: tr, certs: certs}, Timeout: 20 * time.Second}, nil
 }
 
-func NewBootstrapTLSClient(caPEM []byte, insecureSkipVerify bool) (*http.Client, error) {
+func NewBootstrapTLSClient(caPEM []byte, insecureSkipVerify bool, opts ...ClientOption) (*http.Client, error) {
 	pool := x509.NewCertPool()
 	if len(caPEM) > 0 {
 		if !pool.AppendCertsFromPEM(caPEM) {
@@ -117,7 +182,10 @@ func NewBootstrapTLSClient(caPEM []byte, insecureSkipVerify bool) (*http.Client,
 		cfg.RootCAs = pool
 	}
 
-	tr := &http.Transport{TLSClientConfig: cfg}
+	tr := &http.Transport{
+		Proxy:           newClientConfig(opts).proxy,
+		TLSClientConfig: cfg,
+	}
 	return &http.Client{Transport: tr, Timeout: 20 * time.Second}, nil
 }
 
@@ -0,0 +1,170 @@
+package mtls
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestPKI(t *testing.T) PKIPaths {
+	t.Helper()
+	caPEM, caKeyPEM, err := SelfSignedCA("test-ca")
+	if err != nil {
+		t.Fatalf("self-signed ca: %v", err)
+	}
+	paths := DefaultPKIPaths(t.TempDir())
+	if err := WritePKI(paths, caKeyPEM, caPEM, caPEM); err != nil {
+		t.Fatalf("write pki: %v", err)
+	}
+	return paths
+}
+
+func transportOf(t *testing.T, client *http.Client) *http.Transport {
+	t.Helper()
+	if rt, ok := client.Transport.(*reloadingTransport); ok {
+		return rt.Transport
+	}
+	tr, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("unexpected transport type %T", client.Transport)
+	}
+	return tr
+}
+
+func TestMutualTLSClientUsesConfiguredProxy(t *testing.T) {
+	paths := writeTestPKI(t)
+	opt, err := WithProxy("http://proxy.internal:3128")
+	if err != nil {
+		t.Fatalf("with proxy: %v", err)
+	}
+	client, err := NewMutualTLSClient(paths, false, opt)
+	if err != nil {
+		t.Fatalf("new mtls client: %v", err)
+	}
+	tr := transportOf(t, client)
+	if tr.Proxy == nil {
+		t.Fatal("expected proxy func to be set")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://cp.example.com/v1/heartbeat", nil)
+	proxyURL, err := tr.Proxy(req)
+	if err != nil {
+		t.Fatalf("proxy func: %v", err)
+	}
+	if proxyURL == nil || proxyURL.Host != "proxy.internal:3128" {
+		t.Fatalf("expected configured proxy, got %v", proxyURL)
+	}
+	if tr.TLSClientConfig.GetClientCertificate == nil {
+		t.Fatal("expected client certificate to be preserved")
+	}
+}
+
+func TestBootstrapTLSClientDefaultsToEnvironmentProxy(t *testing.T) {
+	client, err := NewBootstrapTLSClient(nil, true)
+	if err != nil {
+		t.Fatalf("new bootstrap client: %v", err)
+	}
+	if transportOf(t, client).Proxy == nil {
+		t.Fatal("expected environment proxy func to be set")
+	}
+}
+
+func TestWithProxyRejectsInvalidURL(t *testing.T) {
+	for _, raw := range []string{"proxy.internal:3128", "://bad"} {
+		if _, err := WithProxy(raw); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+	if _, err := WithProxy(""); err != nil {
+		t.Fatalf("empty proxy should be allowed: %v", err)
+	}
+}
+
+// writeClientCert replaces the client keypair the way CertRotator does:
+// write temp files, then rename them over the originals.
+func writeClientCert(t *testing.T, paths PKIPaths, commonName string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	now := time.Now().UTC()
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	files := map[string][]byte{
+		paths.ClientKey:  EncodePrivateKeyPEM(key),
+		paths.ClientCert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path+".tmp", data, PrivateKeyMode); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("rename %s: %v", path, err)
+		}
+	}
+}
+
+func TestMutualTLSClientPicksUpRenewedCertificate(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client cert", http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	paths := DefaultPKIPaths(t.TempDir())
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(paths.CACert, caPEM, CertMode); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	writeClientCert(t, paths, "agent-old")
+
+	client, err := NewMutualTLSClient(paths, false)
+	if err != nil {
+		t.Fatalf("new mtls client: %v", err)
+	}
+	get := func() string {
+		t.Helper()
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status=%d body=%s", resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	if cn := get(); cn != "agent-old" {
+		t.Fatalf("expected original certificate, server saw %q", cn)
+	}
+	writeClientCert(t, paths, "agent-new")
+	if cn := get(); cn != "agent-new" {
+		t.Fatalf("expected renewed certificate on next request, server saw %q", cn)
+	}
+}
@@ -0,0 +1,129 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateReloader serves the client keypair from disk and reloads it
+// when the files change, so a renewed certificate is used for new
+// connections without restarting the agent.
+type CertificateReloader struct {
+	certPath      string
+	keyPath       string
+	checkInterval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certInfo  os.FileInfo
+	keyInfo   os.FileInfo
+	lastCheck time.Time
+}
+
+// NewCertificateReloader loads the client keypair from paths. The files are
+// checked for changes at most once per checkInterval; zero checks on every
+// request.
+func NewCertificateReloader(paths PKIPaths, checkInterval time.Duration) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certPath:      paths.ClientCert,
+		keyPath:       paths.ClientKey,
+		checkInterval: checkInterval,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, _ = r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// Reload reads the keypair from disk unconditionally.
+func (r *CertificateReloader) Reload() error {
+	certInfo, keyInfo, err := r.stat()
+	if err != nil {
+		return err
+	}
+	return r.load(certInfo, keyInfo)
+}
+
+// refresh reloads the keypair if the files changed since the last load and
+// reports whether a new certificate is now in use. A keypair that fails to
+// load, for example mid-rotation when only one file has been replaced,
+// keeps the previous certificate and is retried on the next check.
+func (r *CertificateReloader) refresh() (bool, error) {
+	r.mu.Lock()
+	now := time.Now()
+	if r.checkInterval > 0 && now.Sub(r.lastCheck) < r.checkInterval {
+		r.mu.Unlock()
+		return false, nil
+	}
+	r.lastCheck = now
+	prevCert, prevKey := r.certInfo, r.keyInfo
+	r.mu.Unlock()
+
+	certInfo, keyInfo, err := r.stat()
+	if err != nil {
+		return false, err
+	}
+	if prevCert != nil && prevKey != nil && sameFile(prevCert, certInfo) && sameFile(prevKey, keyInfo) {
+		return false, nil
+	}
+	if err := r.load(certInfo, keyInfo); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *CertificateReloader) stat() (os.FileInfo, os.FileInfo, error) {
+	certInfo, err := os.Stat(r.certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat client cert: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat client key: %w", err)
+	}
+	return certInfo, keyInfo, nil
+}
+
+func (r *CertificateReloader) load(certInfo, keyInfo os.FileInfo) error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("load client keypair: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certInfo = certInfo
+	r.keyInfo = keyInfo
+	return nil
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// reloadingTransport closes idle connections when the client certificate
+// changes so the next request handshakes with the new certificate instead
+// of reusing a connection authenticated with the old one.
+type reloadingTransport struct {
+	*http.Transport
+	certs *CertificateReloader
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if changed, _ := t.certs.refresh(); changed {
+		t.Transport.CloseIdleConnections()
+	}
+	return t.Transport.RoundTrip(req)
+}
@@ -45,6 +45,7 @@ type CertRotator struct {
 	identity    state.Identity
 	client      RenewClient
 	certManager CertificateManager
+	reloader    *CertificateReloader
 	
 	// State
 	mu           sync.RWMutex
@@ -85,6 +86,14 @@ func WithCertificateManager(cm CertificateManager) CertRotatorOption {
 	}
 }
 
+// WithReloader makes the rotator push renewed certificates into r as soon
+// as they are written, instead of waiting for r to notice the file change.
+func WithReloader(r *CertificateReloader) CertRotatorOption {
+	return func(cr *CertRotator) {
+		cr.reloader = r
+	}
+}
+
 // NewCertRotator creates a new certificate rotator
 func NewCertRotator(pkiPaths PKIPaths, identity state.Identity, client RenewClient, opts ...CertRotatorOption) *CertRotator {
 	cr := &CertRotator{
@@ -265,6 +274,14 @@ func (cr *CertRotator) rotate(ctx context.Context) error {
 		return fmt.Errorf("atomic replace: %w", err)
 	}
 	
+	if cr.reloader != nil {
+		if err := cr.reloader.Reload(); err != nil {
+			logger.WithFields(map[string]interface{}{
+				"error": err.Error(),
+			}).Warn("Failed to reload rotated certificate")
+		}
+	}
+
 	// 6. Update refresh token if provided
 	if resp.RefreshToken != "" {
 		cr.identity.RefreshToken = resp.RefreshToken
@@ -26,14 +26,16 @@ const (
 )
 
 type Status struct {
-	Connected     bool   `json:"connected"`
-	State         string `json:"state,omitempty"`
-	Reason        string `json:"reason,omitempty"`
-	PeerID        string `json:"peer_id,omitempty"`
-	IPv4          string `json:"ipv4,omitempty"`
-	ManagementURL string `json:"management_url,omitempty"`
-	NetworkID     string `json:"network_id,omitempty"`
-	Raw           string `json:"raw,omitempty"`
+	Connected     bool       `json:"connected"`
+	State         string     `json:"state,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	PeerID        string     `json:"peer_id,omitempty"`
+	IPv4          string     `json:"ipv4,omitempty"`
+	ManagementURL string     `json:"management_url,omitempty"`
+	NetworkID     string     `json:"network_id,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake_at,omitempty"`
+	RouteStatus   string     `json:"route_status,omitempty"`
+	Raw           string     `json:"raw,omitempty"`
 }
 
 type ProbeType string
@@ -432,6 +434,15 @@ func parseJSONStatus(raw string, parsed map[string]any) Status {
 	if v, ok := lookupString(parsed, "network_id", "networkID"); ok {
 		status.NetworkID = v
 	}
+	if v, ok := lookupString(parsed, "last_handshake", "lastHandshake", "last_wireguard_handshake", "lastWireguardHandshake"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil && !t.IsZero() {
+			t = t.UTC()
+			status.LastHandshake = &t
+		}
+	}
+	if v, ok := lookupString(parsed, "route_status", "routeStatus", "routes_status", "routesStatus"); ok {
+		status.RouteStatus = v
+	}
 	return status
 }
 
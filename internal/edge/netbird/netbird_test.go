@@ -2,6 +2,7 @@ package netbird
 
 import (
 	"testing"
+	"time"
 )
 
 func TestParseJSONStatusConnected(t *testing.T) {
@@ -47,6 +48,22 @@ func TestParseJSONStatusDisconnected(t *testing.T) {
 	}
 }
 
+func TestParseJSONStatusPeerDetails(t *testing.T) {
+	parsed := map[string]any{
+		"connected":     true,
+		"lastHandshake": "2026-01-02T03:04:05Z",
+		"routeStatus":   "2/2 routes active",
+	}
+
+	st := parseJSONStatus("{}", parsed)
+	if st.LastHandshake == nil || !st.LastHandshake.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected last handshake: %v", st.LastHandshake)
+	}
+	if st.RouteStatus != "2/2 routes active" {
+		t.Fatalf("unexpected route status: %s", st.RouteStatus)
+	}
+}
+
 func TestNormalizeURL(t *testing.T) {
 	u, err := normalizeURL("10.10.0.5:8080/healthz")
 	if err != nil {
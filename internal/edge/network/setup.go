@@ -148,6 +148,25 @@ func ValidateMAC(mac string) error {
 	return nil
 }
 
+// ValidateLocalMAC checks that mac is a well-formed 48-bit unicast address with
+// the locally administered bit set, so it cannot clash with vendor-assigned MACs.
+func ValidateLocalMAC(mac string) error {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %s: %w", mac, err)
+	}
+	if len(hw) != 6 {
+		return fmt.Errorf("invalid MAC address %s: must be 48 bits", mac)
+	}
+	if hw[0]&0x01 != 0 {
+		return fmt.Errorf("invalid MAC address %s: multicast bit is set", mac)
+	}
+	if hw[0]&0x02 == 0 {
+		return fmt.Errorf("invalid MAC address %s: not locally administered", mac)
+	}
+	return nil
+}
+
 // GenerateTAPName generates a TAP device name based on VM ID and interface index
 func GenerateTAPName(vmID string, ifaceIdx int) string {
 	h := sha256.New()
@@ -196,6 +196,31 @@ func TestValidateMAC(t *testing.T) {
 	}
 }
 
+func TestValidateLocalMAC(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		wantErr bool
+	}{
+		{name: "locally administered", mac: "52:54:00:12:34:56"},
+		{name: "generated", mac: GenerateMAC("vm-1", 0)},
+		{name: "globally administered", mac: "00:16:3e:12:34:56", wantErr: true},
+		{name: "multicast", mac: "03:00:00:12:34:56", wantErr: true},
+		{name: "eui-64", mac: "02:00:00:00:00:00:00:01", wantErr: true},
+		{name: "malformed", mac: "invalid", wantErr: true},
+		{name: "empty", mac: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLocalMAC(tt.mac)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLocalMAC(%q) error = %v, wantErr %v", tt.mac, err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestFormatCHNetArg(t *testing.T) {
 	tests := []struct {
 		name string
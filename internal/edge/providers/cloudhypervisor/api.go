@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/network"
 )
 
-var ErrVMNotFound = errors.New("vm not found")
+var ErrVMNotFound = executor.Categorize(executor.FailureVMNotFound, errors.New("vm not found"))
 
 type VMStatus string
 
@@ -28,6 +31,9 @@ type NetworkInterface struct {
 	IPAddr   string `json:"ip,omitempty" yaml:"ip,omitempty"`   // IP address in CIDR notation
 }
 
+// FileSpec is a file written into the VM by cloud-init write_files.
+type FileSpec = executor.FileSpec
+
 // VMSpec is the provider-facing schema for microVM lifecycle operations.
 type VMSpec struct {
 	Name              string             `json:"name" yaml:"name"`
@@ -43,6 +49,9 @@ type VMSpec struct {
 	UserData          string             `json:"user_data,omitempty" yaml:"user_data,omitempty"`
 	DiskSizeMB        int                `json:"disk_size_mb,omitempty" yaml:"disk_size_mb,omitempty"`
 	Networks          []NetworkInterface `json:"networks,omitempty" yaml:"networks,omitempty"` // Multiple network interfaces
+	Labels            map[string]string  `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Files             []FileSpec         `json:"files,omitempty" yaml:"files,omitempty"`
+	DataDisksMB       []int64            `json:"data_disks_mb,omitempty" yaml:"data_disks_mb,omitempty"`
 }
 
 func (s *VMSpec) normalize() {
@@ -97,6 +106,21 @@ func (s VMSpec) GetNetworks() []NetworkInterface {
 	return nil
 }
 
+// assignMACs fills in deterministic MAC addresses for interfaces without one.
+func (s *VMSpec) assignMACs(vmID string) {
+	if len(s.Networks) == 0 {
+		if s.MACAddress == "" {
+			s.MACAddress = network.GenerateMAC(vmID, 0)
+		}
+		return
+	}
+	for i := range s.Networks {
+		if s.Networks[i].MacAddr == "" {
+			s.Networks[i].MacAddr = network.GenerateMAC(vmID, i)
+		}
+	}
+}
+
 // PrimaryNetwork returns the primary (first) network interface, or nil if none.
 func (s VMSpec) PrimaryNetwork() *NetworkInterface {
 	networks := s.GetNetworks()
@@ -116,6 +140,11 @@ func (s VMSpec) Validate() error {
 	if s.MemMB <= 0 {
 		return errors.New("mem_mb must be > 0")
 	}
+	for i, size := range s.DataDisksMB {
+		if size <= 0 {
+			return fmt.Errorf("data_disks_mb[%d]: size must be > 0", i)
+		}
+	}
 
 	// Validate network configuration (either Networks or deprecated TapName)
 	networks := s.GetNetworks()
@@ -132,7 +161,7 @@ func (s VMSpec) Validate() error {
 			return fmt.Errorf("network[%d]: bridge is required", i)
 		}
 		if iface.MacAddr != "" {
-			if _, err := net.ParseMAC(iface.MacAddr); err != nil {
+			if err := network.ValidateLocalMAC(iface.MacAddr); err != nil {
 				return fmt.Errorf("network[%d]: invalid mac: %w", i, err)
 			}
 		}
@@ -145,10 +174,13 @@ func (s VMSpec) Validate() error {
 
 	// Validate deprecated MACAddress field if specified
 	if s.MACAddress != "" {
-		if _, err := net.ParseMAC(s.MACAddress); err != nil {
+		if err := network.ValidateLocalMAC(s.MACAddress); err != nil {
 			return fmt.Errorf("invalid mac: %w", err)
 		}
 	}
+	if err := executor.ValidateFiles(s.Files); err != nil {
+		return fmt.Errorf("invalid files: %w", err)
+	}
 	return nil
 }
 
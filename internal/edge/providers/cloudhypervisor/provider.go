@@ -21,8 +21,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/kubedoio/n-kudo/internal/edge/cgroup"
 	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
 	"github.com/kubedoio/n-kudo/internal/edge/network"
+	"github.com/kubedoio/n-kudo/internal/edge/providers/vmlock"
+	"github.com/kubedoio/n-kudo/internal/edge/redact"
 	"github.com/kubedoio/n-kudo/internal/edge/state"
 )
 
@@ -35,6 +39,10 @@ const (
 	defaultCloudLocalDSBin = "cloud-localds"
 	defaultGenISOImageBin  = "genisoimage"
 
+	// defaultAPITimeout bounds one call to the VMM API socket. VMs are
+	// configured on the command line, so only quick calls go through it.
+	defaultAPITimeout = 3 * time.Second
+
 	stateFileName    = "state.json"
 	pidFileName      = "ch.pid"
 	commandsFileName = "commands.log"
@@ -57,21 +65,38 @@ type Provider struct {
 	DefaultBridgeName string
 	DryRun            bool
 	StopTimeout       time.Duration
+	// APITimeout bounds one call to the VMM API socket; zero uses the
+	// default.
+	APITimeout time.Duration
+	// DisableCommandLog turns off commands.log entirely.
+	DisableCommandLog bool
+	// RedactArgs lists flag or key names masked in commands.log in
+	// addition to redact.DefaultKeys.
+	RedactArgs []string
+	// Cgroups, when set, places each VM's VMM process in a cgroup v2
+	// group limited to the VM's vCPUs and memory. Nil leaves VMMs
+	// unlimited.
+	Cgroups *cgroup.Manager
 
 	mu         sync.Mutex
 	nextDryPID int
+	// vmLocks serializes the operations on each VM, which read, change
+	// and write its meta.
+	vmLocks vmlock.Keyed
 }
 
 type vmMeta struct {
 	VMID             string    `json:"vm_id"`
 	Spec             VMSpec    `json:"spec"`
 	DiskPath         string    `json:"disk_path"`
+	DataDiskPaths    []string  `json:"data_disk_paths,omitempty"`
 	CachedBaseImage  string    `json:"cached_base_image,omitempty"`
 	CloudInitISOPath string    `json:"cloud_init_iso_path"`
 	APISocketPath    string    `json:"api_socket_path"`
 	StdoutPath       string    `json:"stdout_path"`
 	StderrPath       string    `json:"stderr_path"`
 	ConsolePath      string    `json:"console_path"`
+	MACAddress       string    `json:"mac_address,omitempty"`
 	PID              int       `json:"pid"`
 	Status           VMStatus  `json:"status"`
 	CreatedAt        time.Time `json:"created_at"`
@@ -89,6 +114,7 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		return err
@@ -101,7 +127,7 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	}
 
 	args := p.renderCHArgs(meta)
-	if err := p.appendCommand(vmID, renderCommand(p.Binary, args...)); err != nil {
+	if err := p.appendCommand(vmID, p.Binary, args...); err != nil {
 		return err
 	}
 
@@ -128,7 +154,10 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	}
 
 	if _, err := exec.LookPath(p.Binary); err != nil {
-		return fmt.Errorf("cloud-hypervisor binary not found (%s): %w", p.Binary, err)
+		return executor.Categorize(executor.FailureHypervisor, fmt.Errorf("cloud-hypervisor binary not found (%s): %w", p.Binary, err))
+	}
+	if err := executor.CheckKVM(); err != nil {
+		return err
 	}
 
 	stdout, err := os.OpenFile(meta.StdoutPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
@@ -142,10 +171,13 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	}
 	defer stderr.Close()
 
-	cmd := exec.CommandContext(ctx, p.Binary, args...)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Start(); err != nil {
+	cmd, err := p.startInCgroup(meta, func() *exec.Cmd {
+		cmd := exec.CommandContext(ctx, p.Binary, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd
+	})
+	if err != nil {
 		return fmt.Errorf("start cloud-hypervisor: %w", err)
 	}
 	pid := cmd.Process.Pid
@@ -166,6 +198,23 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 }
 
 func (p *Provider) StopVM(ctx context.Context, vmID string) error {
+	defer p.vmLocks.Lock(vmID)()
+	return p.stopVM(ctx, vmID, executor.StopOptions{})
+}
+
+// StopWithOptions implements executor.GracefulStopper: it stops the VM
+// with the given method, giving its first step opts.GracePeriod instead of
+// StopTimeout.
+func (p *Provider) StopWithOptions(ctx context.Context, vmID string, opts executor.StopOptions) error {
+	if err := opts.Validate(); err != nil {
+		return executor.Categorize(executor.FailureInvalidParams, err)
+	}
+	defer p.vmLocks.Lock(vmID)()
+	return p.stopVM(ctx, vmID, opts)
+}
+
+// stopVM stops vmID; the caller holds its lock.
+func (p *Provider) stopVM(ctx context.Context, vmID string, opts executor.StopOptions) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
@@ -190,22 +239,33 @@ func (p *Provider) StopVM(ctx context.Context, vmID string) error {
 		return p.syncStateStore(meta)
 	}
 
-	_ = p.appendCommand(vmID, renderCommand("PUT", "unix://"+meta.APISocketPath, "/api/v1/vm.shutdown"))
-	_ = p.shutdownViaAPISocket(ctx, meta.APISocketPath)
-
-	dead := waitUntilDead(meta.PID, p.StopTimeout)
-	if !dead {
+	method := opts.Method
+	if method == "" {
+		method = executor.StopMethodACPI
+	}
+	grace := p.StopTimeout
+	if opts.GracePeriod > 0 {
+		grace = time.Duration(opts.GracePeriod) * time.Second
+	}
+	dead := false
+	if method == executor.StopMethodACPI {
+		_ = p.appendCommand(vmID, "PUT", "unix://"+meta.APISocketPath, "/api/v1/vm.shutdown")
+		_ = p.shutdownViaAPISocket(ctx, meta.APISocketPath)
+		dead = waitUntilDead(meta.PID, grace)
+		grace = 5 * time.Second
+	}
+	if !dead && method != executor.StopMethodForce {
 		proc, _ := os.FindProcess(meta.PID)
 		if proc != nil {
-			_ = p.appendCommand(vmID, fmt.Sprintf("kill -TERM %d", meta.PID))
+			_ = p.appendCommand(vmID, "kill", "-TERM", strconv.Itoa(meta.PID))
 			_ = proc.Signal(syscall.SIGTERM)
-			dead = waitUntilDead(meta.PID, 5*time.Second)
+			dead = waitUntilDead(meta.PID, grace)
 		}
 	}
 	if !dead {
 		proc, _ := os.FindProcess(meta.PID)
 		if proc != nil {
-			_ = p.appendCommand(vmID, fmt.Sprintf("kill -KILL %d", meta.PID))
+			_ = p.appendCommand(vmID, "kill", "-KILL", strconv.Itoa(meta.PID))
 			_ = proc.Signal(syscall.SIGKILL)
 		}
 	}
@@ -222,6 +282,7 @@ func (p *Provider) DeleteVM(ctx context.Context, vmID string) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		if errors.Is(err, ErrVMNotFound) {
@@ -234,22 +295,50 @@ func (p *Provider) DeleteVM(ctx context.Context, vmID string) error {
 		return err
 	}
 
-	_ = p.StopVM(ctx, vmID)
+	_ = p.stopVM(ctx, vmID, executor.StopOptions{})
 	_ = p.cleanupNetworks(ctx, vmID, meta.Spec.GetNetworks())
 
 	if err := os.RemoveAll(p.vmDir(vmID)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("remove vm dir: %w", err)
 	}
+	_ = p.Cgroups.Remove(vmID)
 	if p.State != nil {
 		_ = p.State.DeleteMicroVM(vmID)
 	}
 	return nil
 }
 
+// startInCgroup starts the VMM command built by newCmd inside the cgroup
+// limiting it to the VM's vCPUs and memory, so it never runs unlimited.
+// Where cgroups are unusable the VM is started without them and a warning
+// is logged.
+func (p *Provider) startInCgroup(meta vmMeta, newCmd func() *exec.Cmd) (*exec.Cmd, error) {
+	cmd := newCmd()
+	if p.Cgroups == nil {
+		return cmd, cmd.Start()
+	}
+	release, err := p.Cgroups.Attach(cmd, meta.VMID, p.Cgroups.LimitsFor(meta.Spec.VCPU, meta.Spec.MemMB))
+	if err == nil {
+		err = cmd.Start()
+		release()
+		if err == nil {
+			return cmd, nil
+		}
+		// A command that failed to start cannot be started again.
+		cmd = newCmd()
+	}
+	logger.WithComponent("cloud-hypervisor").WithFields(map[string]interface{}{
+		"vm_id": meta.VMID,
+		"error": err.Error(),
+	}).Warn("VM runs without cgroup limits")
+	return cmd, cmd.Start()
+}
+
 func (p *Provider) GetVMStatus(_ context.Context, vmID string) (VMStatus, error) {
 	if err := p.ensureDefaults(); err != nil {
 		return "", err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		return "", err
@@ -292,6 +381,15 @@ func (p *Provider) CollectConsoleLog(_ context.Context, vmID string) ([]byte, er
 	return out.Bytes(), nil
 }
 
+// UserData returns the cloud-init user-data written into the VM's seed
+// image at create.
+func (p *Provider) UserData(vmID string) ([]byte, error) {
+	if err := p.ensureDefaults(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(p.vmDir(vmID), "seed", "user-data"))
+}
+
 // Create keeps executor.MicroVMProvider compatibility.
 func (p *Provider) Create(ctx context.Context, params executor.MicroVMParams) error {
 	spec := VMSpec{
@@ -301,6 +399,11 @@ func (p *Provider) Create(ctx context.Context, params executor.MicroVMParams) er
 		DiskPath:   params.RootfsPath,
 		TapName:    params.TapIface,
 		BridgeName: firstNonEmpty(p.DefaultBridgeName, "br0"),
+		Labels:     params.Labels,
+		Files:      params.Files,
+	}
+	for _, d := range params.Disks {
+		spec.DataDisksMB = append(spec.DataDisksMB, d.SizeMiB)
 	}
 
 	// Convert executor network interfaces to provider network interfaces
@@ -334,6 +437,22 @@ func (p *Provider) Stop(ctx context.Context, vmID string) error { return p.StopV
 // Delete keeps executor.MicroVMProvider compatibility.
 func (p *Provider) Delete(ctx context.Context, vmID string) error { return p.DeleteVM(ctx, vmID) }
 
+// Capabilities keeps executor.MicroVMProvider compatibility. Dry-run VMs have no
+// process to signal, so they cannot be paused, resumed or snapshotted.
+func (p *Provider) Capabilities() []string {
+	if p.DryRun {
+		return executor.Capabilities(
+			executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop,
+			executor.ActionMicroVMDelete, executor.ActionMicroVMMigrate,
+		)
+	}
+	return executor.Capabilities(
+		executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop,
+		executor.ActionMicroVMDelete, executor.ActionMicroVMPause, executor.ActionMicroVMResume,
+		executor.ActionMicroVMSnapshot, executor.ActionMicroVMMigrate,
+	)
+}
+
 // GetProcessID keeps executor.MicroVMProvider compatibility.
 func (p *Provider) GetProcessID(ctx context.Context, vmID string) (int, error) {
 	if err := p.ensureDefaults(); err != nil {
@@ -401,7 +520,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	}
 	spec.normalize()
 	if err := spec.Validate(); err != nil {
-		return "", err
+		return "", executor.Categorize(executor.FailureInvalidParams, err)
 	}
 	if requestedID == "" {
 		requestedID, err = generateVMID(spec.Name)
@@ -410,6 +529,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 		}
 	}
 	vmID = requestedID
+	defer p.vmLocks.Lock(vmID)()
 	vmDir := p.vmDir(vmID)
 	if err := os.MkdirAll(vmDir, 0o755); err != nil {
 		return "", err
@@ -417,6 +537,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	if _, statErr := os.Stat(filepath.Join(vmDir, stateFileName)); statErr == nil {
 		return vmID, nil
 	}
+	spec.assignMACs(vmID)
 
 	networksCreated := false
 	defer func() {
@@ -430,6 +551,11 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	}()
 
 	diskPath, cachedPath, err := p.prepareDisk(vmDir, spec.DiskPath, spec.DiskSizeMB)
+	if err != nil {
+		return "", executor.Categorize(executor.FailureImagePull, err)
+	}
+
+	dataDiskPaths, err := prepareDataDisks(vmDir, spec.DataDisksMB)
 	if err != nil {
 		return "", err
 	}
@@ -441,20 +567,26 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 
 	// Setup all network interfaces
 	if err := p.setupNetworks(ctx, vmID, spec.GetNetworks()); err != nil {
-		return "", err
+		return "", executor.Categorize(executor.FailureNetworkSetup, err)
 	}
 	networksCreated = true
 
+	var primaryMAC string
+	if primary := spec.PrimaryNetwork(); primary != nil {
+		primaryMAC = primary.MacAddr
+	}
 	meta := vmMeta{
 		VMID:             vmID,
 		Spec:             spec,
 		DiskPath:         diskPath,
+		DataDiskPaths:    dataDiskPaths,
 		CachedBaseImage:  cachedPath,
 		CloudInitISOPath: isoPath,
 		APISocketPath:    filepath.Join(vmDir, "api.sock"),
 		StdoutPath:       filepath.Join(vmDir, "stdout.log"),
 		StderrPath:       filepath.Join(vmDir, "stderr.log"),
 		ConsolePath:      filepath.Join(vmDir, "console.log"),
+		MACAddress:       primaryMAC,
 		Status:           VMStatusCreated,
 		CreatedAt:        time.Now().UTC(),
 		UpdatedAt:        time.Now().UTC(),
@@ -499,6 +631,19 @@ func (p *Provider) ensureDefaults() error {
 	return os.MkdirAll(p.ImagesDir, 0o755)
 }
 
+// prepareDataDisks creates the extra data disks as empty sparse files.
+func prepareDataDisks(vmDir string, sizesMB []int64) ([]string, error) {
+	paths := make([]string, 0, len(sizesMB))
+	for i, size := range sizesMB {
+		path := filepath.Join(vmDir, fmt.Sprintf("data%d.raw", i))
+		if err := createSparseFile(path, size*1024*1024); err != nil {
+			return nil, fmt.Errorf("create data disk %d: %w", i, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
 func (p *Provider) prepareDisk(vmDir, sourcePath string, diskSizeMB int) (diskPath string, cachePath string, err error) {
 	sourcePath = strings.TrimSpace(sourcePath)
 	ext := ".raw"
@@ -570,7 +715,7 @@ func (p *Provider) prepareCloudInitISO(ctx context.Context, vmID, vmDir string,
 		if err := os.WriteFile(isoPath, []byte("dry-run cloud-init seed"), 0o644); err != nil {
 			return "", err
 		}
-		if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+		if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 			return "", err
 		}
 		return isoPath, nil
@@ -602,7 +747,7 @@ func (p *Provider) prepareCloudInitISO(ctx context.Context, vmID, vmDir string,
 		return "", errors.New("cloud-init ISO builder not found (need cloud-localds, genisoimage, or mkisofs)")
 	}
 
-	if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+	if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 		return "", err
 	}
 	if err := runCmd(ctx, cmd[0], cmd[1:]...); err != nil {
@@ -672,7 +817,7 @@ func (p *Provider) cleanupNetworks(ctx context.Context, vmID string, networks []
 func (p *Provider) setupTap(ctx context.Context, vmID, tapName, bridgeName string) error {
 	cmds := renderTapSetupCommands(p.IPBinary, tapName, bridgeName)
 	for _, cmd := range cmds {
-		if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+		if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 			return err
 		}
 		if p.DryRun {
@@ -693,7 +838,7 @@ func (p *Provider) cleanupTap(ctx context.Context, vmID, tapName string) error {
 		return nil
 	}
 	cmd := []string{p.IPBinary, "link", "del", tapName}
-	if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+	if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 		return err
 	}
 	if p.DryRun {
@@ -719,6 +864,10 @@ func (p *Provider) renderCHArgs(meta vmMeta) []string {
 		"--serial", fmt.Sprintf("file=%s", meta.ConsolePath),
 		"--console", "off",
 	}
+	// Data disks follow the cloud-init ISO so existing device names stay put.
+	for _, path := range meta.DataDiskPaths {
+		args = append(args, "--disk", fmt.Sprintf("path=%s", path))
+	}
 
 	// Add network interfaces
 	networks := meta.Spec.GetNetworks()
@@ -765,7 +914,13 @@ func (p *Provider) saveMeta(meta vmMeta) error {
 	return os.WriteFile(filepath.Join(p.vmDir(meta.VMID), stateFileName), b, 0o600)
 }
 
-func (p *Provider) appendCommand(vmID, command string) error {
+// appendCommand records a command line in the VM's commands.log with
+// sensitive arguments masked. It is a no-op when DisableCommandLog is set.
+func (p *Provider) appendCommand(vmID, name string, args ...string) error {
+	if p.DisableCommandLog {
+		return nil
+	}
+	command := renderCommand(name, redact.Args(args, p.RedactArgs...)...)
 	path := filepath.Join(p.vmDir(vmID), commandsFileName)
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
@@ -777,8 +932,7 @@ func (p *Provider) appendCommand(vmID, command string) error {
 }
 
 func (p *Provider) markStoppedIfCurrent(vmID string, pid int) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.vmLocks.Lock(vmID)()
 
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
@@ -821,6 +975,9 @@ func (p *Provider) syncStateStore(meta vmMeta) error {
 		Networks:   networkConfigs,
 		CHPID:      meta.PID,
 		Status:     strings.ToUpper(string(meta.Status)),
+		VCPU:       meta.Spec.VCPU,
+		MemoryMiB:  meta.Spec.MemMB,
+		Labels:     meta.Spec.Labels,
 	})
 }
 
@@ -835,7 +992,7 @@ func (p *Provider) shutdownViaAPISocket(ctx context.Context, socketPath string)
 	}
 	client := &http.Client{
 		Transport: transport,
-		Timeout:   3 * time.Second,
+		Timeout:   p.apiTimeout(),
 	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost/api/v1/vm.shutdown", nil)
 	if err != nil {
@@ -852,6 +1009,13 @@ func (p *Provider) shutdownViaAPISocket(ctx context.Context, socketPath string)
 	return nil
 }
 
+func (p *Provider) apiTimeout() time.Duration {
+	if p.APITimeout > 0 {
+		return p.APITimeout
+	}
+	return defaultAPITimeout
+}
+
 func generateVMID(name string) (string, error) {
 	slug := slugify(name)
 	if slug == "" {
@@ -914,6 +1078,7 @@ func renderUserData(spec VMSpec) string {
 			b.WriteByte('\n')
 		}
 	}
+	b.WriteString(executor.RenderWriteFiles(spec.Files))
 	b.WriteString("package_update: false\n")
 	return b.String()
 }
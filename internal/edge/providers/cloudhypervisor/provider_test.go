@@ -2,10 +2,18 @@ package cloudhypervisor
 
 import (
 	"context"
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/network"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
 )
 
 func TestVMSpecValidate(t *testing.T) {
@@ -37,6 +45,137 @@ func TestVMSpecValidate(t *testing.T) {
 	if err := bad.Validate(); err == nil {
 		t.Fatal("expected invalid mac validation error")
 	}
+
+	bad = base
+	bad.MACAddress = "00:16:3e:00:00:01"
+	if err := bad.Validate(); err == nil {
+		t.Fatal("expected globally administered mac to be rejected")
+	}
+
+	bad = base
+	bad.Files = []FileSpec{{Path: "etc/app.conf", Content: "x"}}
+	if err := bad.Validate(); err == nil {
+		t.Fatal("expected relative file path to be rejected")
+	}
+
+	bad = base
+	bad.Files = []FileSpec{{Path: "/etc/app.conf", Content: "x", Permissions: "0666"}}
+	if err := bad.Validate(); err == nil {
+		t.Fatal("expected world-writable permissions to be rejected")
+	}
+}
+
+func TestDryRunCreateRendersWriteFiles(t *testing.T) {
+	root := t.TempDir()
+	provider := &Provider{
+		RuntimeDir:        filepath.Join(root, "vms"),
+		ImagesDir:         filepath.Join(root, "images"),
+		DryRun:            true,
+		DefaultBridgeName: "br-test0",
+	}
+	vmID, err := provider.CreateVM(context.Background(), VMSpec{
+		Name:       "files-vm",
+		VCPU:       1,
+		MemMB:      256,
+		TapName:    "tap-files0",
+		BridgeName: "br-test0",
+		Files: []FileSpec{
+			{Path: "/etc/app/config.yaml", Content: "listen: :8080\nname: \"demo\"\n", Permissions: "0640", Owner: "root:app"},
+			{Path: "/opt/app/blob.bin", Content: "\x00\x01\xff"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVM failed: %v", err)
+	}
+
+	userData, err := os.ReadFile(filepath.Join(provider.RuntimeDir, vmID, "seed", "user-data"))
+	if err != nil {
+		t.Fatalf("read user-data: %v", err)
+	}
+	want := strings.Join([]string{
+		"write_files:",
+		`  - path: "/etc/app/config.yaml"`,
+		`    content: "listen: :8080\nname: \"demo\"\n"`,
+		"    permissions: '0640'",
+		"    owner: root:app",
+		`  - path: "/opt/app/blob.bin"`,
+		"    encoding: b64",
+		"    content: AAH/",
+	}, "\n") + "\n"
+	if !strings.Contains(string(userData), want) {
+		t.Fatalf("expected write_files entries in user-data:\n%s", userData)
+	}
+}
+
+func TestCreateFailureCategories(t *testing.T) {
+	root := t.TempDir()
+	provider := &Provider{
+		RuntimeDir:        filepath.Join(root, "vms"),
+		ImagesDir:         filepath.Join(root, "images"),
+		DryRun:            true,
+		DefaultBridgeName: "br-test0",
+	}
+	ctx := context.Background()
+
+	err := provider.Create(ctx, executor.MicroVMParams{VMID: "vm-image", RootfsPath: filepath.Join(root, "missing.raw")})
+	if got := executor.FailureCategory(err); got != executor.FailureImagePull {
+		t.Fatalf("missing base image: expected %s, got %s (%v)", executor.FailureImagePull, got, err)
+	}
+
+	err = provider.Create(ctx, executor.MicroVMParams{VMID: "vm-files", Files: []executor.FileSpec{{Path: "relative"}}})
+	if got := executor.FailureCategory(err); got != executor.FailureInvalidParams {
+		t.Fatalf("invalid spec: expected %s, got %s (%v)", executor.FailureInvalidParams, got, err)
+	}
+
+	err = provider.Start(ctx, "vm-unknown")
+	if got := executor.FailureCategory(err); got != executor.FailureVMNotFound {
+		t.Fatalf("unknown vm: expected %s, got %s (%v)", executor.FailureVMNotFound, got, err)
+	}
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("expected ErrVMNotFound, got %v", err)
+	}
+}
+
+func TestDryRunCreateAssignsDistinctMACs(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	provider := &Provider{
+		RuntimeDir:        filepath.Join(root, "vms"),
+		ImagesDir:         filepath.Join(root, "images"),
+		DryRun:            true,
+		DefaultBridgeName: "br-test0",
+	}
+
+	macs := make(map[string]string)
+	for _, name := range []string{"vm-a", "vm-b"} {
+		vmID, err := provider.CreateVM(ctx, VMSpec{
+			Name:       name,
+			VCPU:       1,
+			MemMB:      256,
+			TapName:    "tap-" + name,
+			BridgeName: "br-test0",
+		})
+		if err != nil {
+			t.Fatalf("CreateVM(%s) failed: %v", name, err)
+		}
+		meta, err := provider.loadMeta(vmID)
+		if err != nil {
+			t.Fatalf("loadMeta(%s) failed: %v", vmID, err)
+		}
+		if err := network.ValidateLocalMAC(meta.MACAddress); err != nil {
+			t.Fatalf("allocated MAC for %s is not valid: %v", name, err)
+		}
+		if meta.Spec.MACAddress != meta.MACAddress {
+			t.Fatalf("spec MAC %q does not match persisted MAC %q", meta.Spec.MACAddress, meta.MACAddress)
+		}
+		if !strings.Contains(strings.Join(provider.renderCHArgs(meta), " "), "mac="+meta.MACAddress) {
+			t.Fatalf("expected allocated MAC in cloud-hypervisor args for %s", name)
+		}
+		macs[name] = meta.MACAddress
+	}
+	if macs["vm-a"] == macs["vm-b"] {
+		t.Fatalf("expected distinct MACs, both got %s", macs["vm-a"])
+	}
 }
 
 func TestRenderCHArgs(t *testing.T) {
@@ -72,6 +211,49 @@ func TestRenderCHArgs(t *testing.T) {
 	}
 }
 
+func TestDryRunCreateAttachesDataDisks(t *testing.T) {
+	root := t.TempDir()
+	provider := &Provider{
+		RuntimeDir:        filepath.Join(root, "vms"),
+		ImagesDir:         filepath.Join(root, "images"),
+		DryRun:            true,
+		DefaultBridgeName: "br-test0",
+	}
+	vmID, err := provider.CreateVM(context.Background(), VMSpec{
+		Name:        "disks-vm",
+		VCPU:        1,
+		MemMB:       256,
+		TapName:     "tap-disks0",
+		BridgeName:  "br-test0",
+		DataDisksMB: []int64{64, 128},
+	})
+	if err != nil {
+		t.Fatalf("CreateVM failed: %v", err)
+	}
+	meta, err := provider.loadMeta(vmID)
+	if err != nil {
+		t.Fatalf("loadMeta failed: %v", err)
+	}
+	if len(meta.DataDiskPaths) != 2 {
+		t.Fatalf("expected 2 data disks, got %v", meta.DataDiskPaths)
+	}
+	for i, size := range []int64{64, 128} {
+		fi, err := os.Stat(meta.DataDiskPaths[i])
+		if err != nil {
+			t.Fatalf("stat data disk %d: %v", i, err)
+		}
+		if fi.Size() != size*1024*1024 {
+			t.Fatalf("data disk %d: expected %d MiB, got %d bytes", i, size, fi.Size())
+		}
+	}
+	full := strings.Join(provider.renderCHArgs(meta), " ")
+	iso := strings.Index(full, "cloud-init")
+	data := strings.Index(full, "--disk path="+meta.DataDiskPaths[0])
+	if data < 0 || data < iso {
+		t.Fatalf("expected data disks after the cloud-init disk, got: %s", full)
+	}
+}
+
 func TestDryRunLifecycle(t *testing.T) {
 	ctx := context.Background()
 	root := t.TempDir()
@@ -179,3 +361,199 @@ func TestDryRunLifecycle(t *testing.T) {
 		t.Fatalf("expected vm dir removed, stat err=%v", err)
 	}
 }
+
+func TestCapabilities(t *testing.T) {
+	supports := func(p *Provider, action executor.ActionType) bool {
+		for _, c := range p.Capabilities() {
+			if c == string(action) {
+				return true
+			}
+		}
+		return false
+	}
+	p := &Provider{}
+	for _, action := range []executor.ActionType{
+		executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop, executor.ActionMicroVMDelete,
+		executor.ActionMicroVMPause, executor.ActionMicroVMResume, executor.ActionMicroVMSnapshot, executor.ActionMicroVMMigrate,
+	} {
+		if !supports(p, action) {
+			t.Errorf("expected %s to be supported", action)
+		}
+	}
+	if supports(p, executor.ActionCommandExecute) {
+		t.Error("commands run on the host, not through the provider")
+	}
+
+	dry := &Provider{DryRun: true}
+	if !supports(dry, executor.ActionMicroVMCreate) {
+		t.Error("expected dry-run create to be supported")
+	}
+	for _, action := range []executor.ActionType{executor.ActionMicroVMPause, executor.ActionMicroVMResume, executor.ActionMicroVMSnapshot} {
+		if supports(dry, action) {
+			t.Errorf("expected %s to be unsupported in dry-run mode", action)
+		}
+	}
+}
+
+// runningVM records a VM whose hypervisor process is a sleep, so stops can
+// be observed without a real hypervisor.
+func runningVM(t *testing.T, p *Provider, vmID string) {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-exited
+	})
+	if err := os.MkdirAll(p.vmDir(vmID), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	meta := vmMeta{
+		VMID:          vmID,
+		APISocketPath: filepath.Join(p.vmDir(vmID), "missing.sock"),
+		PID:           cmd.Process.Pid,
+		Status:        VMStatusRunning,
+	}
+	if err := p.saveMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopWithOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     executor.StopOptions
+		logged   []string
+		unlogged []string
+		minWait  time.Duration
+	}{
+		{name: "acpi waits the grace period before SIGTERM", opts: executor.StopOptions{Method: executor.StopMethodACPI, GracePeriod: 1}, logged: []string{"PUT", "kill -TERM"}, unlogged: []string{"kill -KILL"}, minWait: time.Second},
+		{name: "signal skips acpi", opts: executor.StopOptions{Method: executor.StopMethodSignal, GracePeriod: 1}, logged: []string{"kill -TERM"}, unlogged: []string{"PUT", "kill -KILL"}},
+		{name: "force kills right away", opts: executor.StopOptions{Method: executor.StopMethodForce}, logged: []string{"kill -KILL"}, unlogged: []string{"PUT", "kill -TERM"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			p := &Provider{RuntimeDir: filepath.Join(root, "vms"), ImagesDir: filepath.Join(root, "images")}
+			if err := p.ensureDefaults(); err != nil {
+				t.Fatal(err)
+			}
+			runningVM(t, p, "vm-1")
+
+			start := time.Now()
+			if err := p.StopWithOptions(context.Background(), "vm-1", tc.opts); err != nil {
+				t.Fatalf("StopWithOptions: %v", err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tc.minWait || elapsed >= p.StopTimeout {
+				t.Fatalf("expected the stop to take the grace period, took %s", elapsed)
+			}
+			log, err := os.ReadFile(filepath.Join(p.vmDir("vm-1"), commandsFileName))
+			if err != nil {
+				t.Fatalf("read commands.log: %v", err)
+			}
+			for _, want := range tc.logged {
+				if !strings.Contains(string(log), want) {
+					t.Errorf("expected %q in commands.log:\n%s", want, log)
+				}
+			}
+			for _, unwanted := range tc.unlogged {
+				if strings.Contains(string(log), unwanted) {
+					t.Errorf("unexpected %q in commands.log:\n%s", unwanted, log)
+				}
+			}
+			meta, err := p.loadMeta("vm-1")
+			if err != nil || meta.Status != VMStatusStopped {
+				t.Fatalf("expected the VM to be stopped, got %+v, %v", meta, err)
+			}
+		})
+	}
+
+	p := &Provider{RuntimeDir: t.TempDir(), ImagesDir: t.TempDir()}
+	err := p.StopWithOptions(context.Background(), "vm-1", executor.StopOptions{Method: "reboot"})
+	if executor.FailureCategory(err) != executor.FailureInvalidParams {
+		t.Fatalf("expected an invalid method to be rejected, got %v", err)
+	}
+	err = p.StopWithOptions(context.Background(), "vm-1", executor.StopOptions{GracePeriod: executor.MaxStopGracePeriod + 1})
+	if executor.FailureCategory(err) != executor.FailureInvalidParams {
+		t.Fatalf("expected an out of bounds grace period to be rejected, got %v", err)
+	}
+}
+
+// lastStatusStore records the status of the last upsert of each VM. Its
+// upserts are slow, so that an operation interleaving with another
+// between writing the meta and syncing the store is likely.
+type lastStatusStore struct {
+	mu     sync.Mutex
+	status map[string]string
+}
+
+func (s *lastStatusStore) UpsertMicroVM(vm state.MicroVM) error {
+	time.Sleep(time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[vm.ID] = vm.Status
+	return nil
+}
+
+func (s *lastStatusStore) DeleteMicroVM(vmID string) error { return nil }
+
+func TestConcurrentStartStopOnOneVMKeepsMetaConsistent(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	baseDisk := filepath.Join(root, "base.raw")
+	if err := os.WriteFile(baseDisk, []byte("base-image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := &lastStatusStore{status: map[string]string{}}
+	provider := &Provider{
+		State:             store,
+		RuntimeDir:        filepath.Join(root, "vms"),
+		ImagesDir:         filepath.Join(root, "images"),
+		DryRun:            true,
+		DefaultBridgeName: "br-test0",
+	}
+	vmID, err := provider.CreateVM(ctx, VMSpec{Name: "busy-vm", VCPU: 1, MemMB: 256, DiskPath: baseDisk, TapName: "tap-busy0", BridgeName: "br-test0"})
+	if err != nil {
+		t.Fatalf("CreateVM failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(start bool) {
+			defer wg.Done()
+			op := provider.StopVM
+			if start {
+				op = provider.StartVM
+			}
+			if err := op(ctx, vmID); err != nil {
+				errs <- err
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent operation failed: %v", err)
+	}
+
+	meta, err := provider.loadMeta(vmID)
+	if err != nil {
+		t.Fatalf("meta is unreadable after concurrent operations: %v", err)
+	}
+	if (meta.Status == VMStatusRunning) != (meta.PID > 0) {
+		t.Fatalf("meta is inconsistent: status %s with pid %d", meta.Status, meta.PID)
+	}
+	if got := store.status[vmID]; got != strings.ToUpper(string(meta.Status)) {
+		t.Fatalf("state store says %s, meta says %s", got, meta.Status)
+	}
+}
@@ -3,11 +3,13 @@ package firecracker
 import (
 	"context"
 	"errors"
-	"net"
 	"strings"
+
+	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/network"
 )
 
-var ErrVMNotFound = errors.New("vm not found")
+var ErrVMNotFound = executor.Categorize(executor.FailureVMNotFound, errors.New("vm not found"))
 
 type VMStatus string
 
@@ -18,22 +20,27 @@ const (
 	VMStatusDeleted VMStatus = "deleted"
 )
 
+// FileSpec is a file written into the VM by cloud-init write_files.
+type FileSpec = executor.FileSpec
+
 // VMSpec is the provider-facing schema for microVM lifecycle operations.
 type VMSpec struct {
-	Name              string   `json:"name" yaml:"name"`
-	VCPU              int      `json:"vcpu" yaml:"vcpu"`
-	MemMB             int      `json:"mem_mb" yaml:"mem_mb"`
-	KernelPath        string   `json:"kernel_path" yaml:"kernel_path"`
-	DiskPath          string   `json:"disk_path" yaml:"disk_path"`
-	CloudInitISOPath  string   `json:"cloud_init_iso_path" yaml:"cloud_init_iso_path"`
-	TapName           string   `json:"tap_name" yaml:"tap_name"`
-	BridgeName        string   `json:"bridge_name" yaml:"bridge_name"`
-	MACAddress        string   `json:"mac,omitempty" yaml:"mac,omitempty"`
-	Hostname          string   `json:"hostname,omitempty" yaml:"hostname,omitempty"`
-	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty" yaml:"ssh_authorized_keys,omitempty"`
-	UserData          string   `json:"user_data,omitempty" yaml:"user_data,omitempty"`
-	DiskSizeMB        int      `json:"disk_size_mb,omitempty" yaml:"disk_size_mb,omitempty"`
-	KernelArgs        string   `json:"kernel_args,omitempty" yaml:"kernel_args,omitempty"`
+	Name              string            `json:"name" yaml:"name"`
+	VCPU              int               `json:"vcpu" yaml:"vcpu"`
+	MemMB             int               `json:"mem_mb" yaml:"mem_mb"`
+	KernelPath        string            `json:"kernel_path" yaml:"kernel_path"`
+	DiskPath          string            `json:"disk_path" yaml:"disk_path"`
+	CloudInitISOPath  string            `json:"cloud_init_iso_path" yaml:"cloud_init_iso_path"`
+	TapName           string            `json:"tap_name" yaml:"tap_name"`
+	BridgeName        string            `json:"bridge_name" yaml:"bridge_name"`
+	MACAddress        string            `json:"mac,omitempty" yaml:"mac,omitempty"`
+	Hostname          string            `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	SSHAuthorizedKeys []string          `json:"ssh_authorized_keys,omitempty" yaml:"ssh_authorized_keys,omitempty"`
+	UserData          string            `json:"user_data,omitempty" yaml:"user_data,omitempty"`
+	DiskSizeMB        int               `json:"disk_size_mb,omitempty" yaml:"disk_size_mb,omitempty"`
+	KernelArgs        string            `json:"kernel_args,omitempty" yaml:"kernel_args,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Files             []FileSpec        `json:"files,omitempty" yaml:"files,omitempty"`
 }
 
 func (s *VMSpec) normalize() {
@@ -76,10 +83,13 @@ func (s VMSpec) Validate() error {
 		return errors.New("bridge_name is required")
 	}
 	if s.MACAddress != "" {
-		if _, err := net.ParseMAC(s.MACAddress); err != nil {
+		if err := network.ValidateLocalMAC(s.MACAddress); err != nil {
 			return errors.New("invalid mac: " + err.Error())
 		}
 	}
+	if err := executor.ValidateFiles(s.Files); err != nil {
+		return errors.New("invalid files: " + err.Error())
+	}
 	return nil
 }
 
@@ -21,7 +21,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/kubedoio/n-kudo/internal/edge/cgroup"
 	"github.com/kubedoio/n-kudo/internal/edge/executor"
+	"github.com/kubedoio/n-kudo/internal/edge/logger"
+	"github.com/kubedoio/n-kudo/internal/edge/network"
+	"github.com/kubedoio/n-kudo/internal/edge/providers/vmlock"
+	"github.com/kubedoio/n-kudo/internal/edge/redact"
 	"github.com/kubedoio/n-kudo/internal/edge/state"
 )
 
@@ -34,6 +39,18 @@ const (
 	defaultCloudLocalDSBin = "cloud-localds"
 	defaultGenISOImageBin  = "genisoimage"
 
+	// defaultAPITimeout bounds quick Firecracker API calls such as
+	// instance actions; defaultConfigureTimeout bounds the wait for the API
+	// socket and the machine, boot-source, drive and network setup, which
+	// touch storage and are slow on loaded hosts.
+	defaultAPITimeout       = 5 * time.Second
+	defaultConfigureTimeout = 30 * time.Second
+
+	// defaultAPIRetries is how often a configuration call is retried after
+	// a transient socket error, waiting apiRetryBackoff, doubled each time.
+	defaultAPIRetries = 3
+	apiRetryBackoff   = 100 * time.Millisecond
+
 	stateFileName    = "state.json"
 	pidFileName      = "fc.pid"
 	commandsFileName = "commands.log"
@@ -57,9 +74,31 @@ type Provider struct {
 	DefaultBridgeName string
 	DryRun            bool
 	StopTimeout       time.Duration
+	// APITimeout bounds one Firecracker API call for instance actions;
+	// ConfigureTimeout bounds the wait for the API socket and each
+	// configuration call made while creating a VM. Zero uses the defaults.
+	APITimeout       time.Duration
+	ConfigureTimeout time.Duration
+	// APIRetries is how often a VM configuration call is retried when the
+	// API socket refuses or drops the connection, as it can right after
+	// Firecracker starts. API errors are never retried. Zero uses the
+	// default; a negative value disables retries.
+	APIRetries int
+	// DisableCommandLog turns off commands.log entirely.
+	DisableCommandLog bool
+	// RedactArgs lists flag or key names masked in commands.log in
+	// addition to redact.DefaultKeys.
+	RedactArgs []string
+	// Cgroups, when set, places each VM's VMM process in a cgroup v2
+	// group limited to the VM's vCPUs and memory. Nil leaves VMMs
+	// unlimited.
+	Cgroups *cgroup.Manager
 
 	mu         sync.Mutex
 	nextDryPID int
+	// vmLocks serializes the operations on each VM, which read, change
+	// and write its meta.
+	vmLocks vmlock.Keyed
 }
 
 // vmMeta holds metadata for a VM instance.
@@ -73,6 +112,7 @@ type vmMeta struct {
 	StdoutPath       string    `json:"stdout_path"`
 	StderrPath       string    `json:"stderr_path"`
 	ConsolePath      string    `json:"console_path"`
+	MACAddress       string    `json:"mac_address,omitempty"`
 	PID              int       `json:"pid"`
 	Status           VMStatus  `json:"status"`
 	CreatedAt        time.Time `json:"created_at"`
@@ -92,6 +132,7 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		return err
@@ -115,7 +156,7 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 		args = append(args, "--log-path", meta.ConsolePath)
 	}
 
-	if err := p.appendCommand(vmID, renderCommand(p.Binary, args...)); err != nil {
+	if err := p.appendCommand(vmID, p.Binary, args...); err != nil {
 		return err
 	}
 
@@ -143,7 +184,10 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	}
 
 	if _, err := exec.LookPath(p.Binary); err != nil {
-		return fmt.Errorf("firecracker binary not found (%s): %w", p.Binary, err)
+		return executor.Categorize(executor.FailureHypervisor, fmt.Errorf("firecracker binary not found (%s): %w", p.Binary, err))
+	}
+	if err := executor.CheckKVM(); err != nil {
+		return err
 	}
 
 	// Ensure socket doesn't exist from previous run
@@ -161,10 +205,13 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	}
 	defer stderr.Close()
 
-	cmd := exec.CommandContext(ctx, p.Binary, args...)
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	if err := cmd.Start(); err != nil {
+	cmd, err := p.startInCgroup(meta, func() *exec.Cmd {
+		cmd := exec.CommandContext(ctx, p.Binary, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd
+	})
+	if err != nil {
 		return fmt.Errorf("start firecracker: %w", err)
 	}
 
@@ -173,7 +220,7 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 	meta.APISocketPath = socketPath
 
 	// Wait for API socket to be ready
-	if err := waitForSocket(socketPath, 5*time.Second); err != nil {
+	if err := waitForSocket(socketPath, p.configureTimeout()); err != nil {
 		_ = cmd.Process.Kill()
 		return fmt.Errorf("firecracker API socket not ready: %w", err)
 	}
@@ -208,6 +255,23 @@ func (p *Provider) StartVM(ctx context.Context, vmID string) error {
 
 // StopVM stops a running VM.
 func (p *Provider) StopVM(ctx context.Context, vmID string) error {
+	defer p.vmLocks.Lock(vmID)()
+	return p.stopVM(ctx, vmID, executor.StopOptions{})
+}
+
+// StopWithOptions implements executor.GracefulStopper: it stops the VM
+// with the given method, giving its first step opts.GracePeriod instead of
+// StopTimeout.
+func (p *Provider) StopWithOptions(ctx context.Context, vmID string, opts executor.StopOptions) error {
+	if err := opts.Validate(); err != nil {
+		return executor.Categorize(executor.FailureInvalidParams, err)
+	}
+	defer p.vmLocks.Lock(vmID)()
+	return p.stopVM(ctx, vmID, opts)
+}
+
+// stopVM stops vmID; the caller holds its lock.
+func (p *Provider) stopVM(ctx context.Context, vmID string, opts executor.StopOptions) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
@@ -234,24 +298,33 @@ func (p *Provider) StopVM(ctx context.Context, vmID string) error {
 		return p.syncStateStore(meta)
 	}
 
-	// Try graceful shutdown via API
-	_ = p.appendCommand(vmID, renderCommand("PUT", "unix://"+meta.APISocketPath, "/actions", "SendCtrlAltDel"))
-	_ = p.shutdownViaAPISocket(ctx, meta.APISocketPath)
-
-	// Wait for process to exit
-	dead := waitUntilDead(meta.PID, p.StopTimeout)
-	if !dead {
+	method := opts.Method
+	if method == "" {
+		method = executor.StopMethodACPI
+	}
+	grace := p.StopTimeout
+	if opts.GracePeriod > 0 {
+		grace = time.Duration(opts.GracePeriod) * time.Second
+	}
+	dead := false
+	if method == executor.StopMethodACPI {
+		_ = p.appendCommand(vmID, "PUT", "unix://"+meta.APISocketPath, "/actions", "SendCtrlAltDel")
+		_ = p.shutdownViaAPISocket(ctx, meta.APISocketPath)
+		dead = waitUntilDead(meta.PID, grace)
+		grace = 5 * time.Second
+	}
+	if !dead && method != executor.StopMethodForce {
 		proc, _ := os.FindProcess(meta.PID)
 		if proc != nil {
-			_ = p.appendCommand(vmID, fmt.Sprintf("kill -TERM %d", meta.PID))
+			_ = p.appendCommand(vmID, "kill", "-TERM", strconv.Itoa(meta.PID))
 			_ = proc.Signal(syscall.SIGTERM)
-			dead = waitUntilDead(meta.PID, 5*time.Second)
+			dead = waitUntilDead(meta.PID, grace)
 		}
 	}
 	if !dead {
 		proc, _ := os.FindProcess(meta.PID)
 		if proc != nil {
-			_ = p.appendCommand(vmID, fmt.Sprintf("kill -KILL %d", meta.PID))
+			_ = p.appendCommand(vmID, "kill", "-KILL", strconv.Itoa(meta.PID))
 			_ = proc.Signal(syscall.SIGKILL)
 		}
 	}
@@ -269,6 +342,7 @@ func (p *Provider) DeleteVM(ctx context.Context, vmID string) error {
 	if err := p.ensureDefaults(); err != nil {
 		return err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		if errors.Is(err, ErrVMNotFound) {
@@ -281,23 +355,51 @@ func (p *Provider) DeleteVM(ctx context.Context, vmID string) error {
 		return err
 	}
 
-	_ = p.StopVM(ctx, vmID)
+	_ = p.stopVM(ctx, vmID, executor.StopOptions{})
 	_ = p.cleanupTap(ctx, vmID, meta.Spec.TapName)
 
 	if err := os.RemoveAll(p.vmDir(vmID)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("remove vm dir: %w", err)
 	}
+	_ = p.Cgroups.Remove(vmID)
 	if p.State != nil {
 		_ = p.State.DeleteMicroVM(vmID)
 	}
 	return nil
 }
 
+// startInCgroup starts the VMM command built by newCmd inside the cgroup
+// limiting it to the VM's vCPUs and memory, so it never runs unlimited.
+// Where cgroups are unusable the VM is started without them and a warning
+// is logged.
+func (p *Provider) startInCgroup(meta vmMeta, newCmd func() *exec.Cmd) (*exec.Cmd, error) {
+	cmd := newCmd()
+	if p.Cgroups == nil {
+		return cmd, cmd.Start()
+	}
+	release, err := p.Cgroups.Attach(cmd, meta.VMID, p.Cgroups.LimitsFor(meta.Spec.VCPU, meta.Spec.MemMB))
+	if err == nil {
+		err = cmd.Start()
+		release()
+		if err == nil {
+			return cmd, nil
+		}
+		// A command that failed to start cannot be started again.
+		cmd = newCmd()
+	}
+	logger.WithComponent("firecracker").WithFields(map[string]interface{}{
+		"vm_id": meta.VMID,
+		"error": err.Error(),
+	}).Warn("VM runs without cgroup limits")
+	return cmd, cmd.Start()
+}
+
 // GetVMStatus returns the current status of a VM.
 func (p *Provider) GetVMStatus(_ context.Context, vmID string) (VMStatus, error) {
 	if err := p.ensureDefaults(); err != nil {
 		return "", err
 	}
+	defer p.vmLocks.Lock(vmID)()
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
 		return "", err
@@ -341,8 +443,20 @@ func (p *Provider) CollectConsoleLog(_ context.Context, vmID string) ([]byte, er
 	return out.Bytes(), nil
 }
 
+// UserData returns the cloud-init user-data written into the VM's seed
+// image at create.
+func (p *Provider) UserData(vmID string) ([]byte, error) {
+	if err := p.ensureDefaults(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(p.vmDir(vmID), "seed", "user-data"))
+}
+
 // Create implements executor.MicroVMProvider.
 func (p *Provider) Create(ctx context.Context, params executor.MicroVMParams) error {
+	if len(params.Disks) > 0 {
+		return executor.Categorize(executor.FailureInvalidParams, errors.New("firecracker provider does not support extra data disks"))
+	}
 	spec := VMSpec{
 		Name:       firstNonEmpty(params.Name, params.VMID, "vm"),
 		VCPU:       firstPositive(params.VCPU, 1),
@@ -351,6 +465,8 @@ func (p *Provider) Create(ctx context.Context, params executor.MicroVMParams) er
 		DiskPath:   params.RootfsPath,
 		TapName:    firstNonEmpty(params.TapIface, defaultTapName(params.VMID)),
 		BridgeName: firstNonEmpty(p.DefaultBridgeName, "br0"),
+		Labels:     params.Labels,
+		Files:      params.Files,
 	}
 	_, err := p.createVM(ctx, spec, params.VMID)
 	return err
@@ -365,6 +481,22 @@ func (p *Provider) Stop(ctx context.Context, vmID string) error { return p.StopV
 // Delete implements executor.MicroVMProvider.
 func (p *Provider) Delete(ctx context.Context, vmID string) error { return p.DeleteVM(ctx, vmID) }
 
+// Capabilities implements executor.MicroVMProvider. Dry-run VMs have no
+// process to signal, so they cannot be paused, resumed or snapshotted.
+func (p *Provider) Capabilities() []string {
+	if p.DryRun {
+		return executor.Capabilities(
+			executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop,
+			executor.ActionMicroVMDelete, executor.ActionMicroVMMigrate,
+		)
+	}
+	return executor.Capabilities(
+		executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop,
+		executor.ActionMicroVMDelete, executor.ActionMicroVMPause, executor.ActionMicroVMResume,
+		executor.ActionMicroVMSnapshot, executor.ActionMicroVMMigrate,
+	)
+}
+
 // GetProcessID implements executor.MicroVMProvider.
 func (p *Provider) GetProcessID(ctx context.Context, vmID string) (int, error) {
 	if err := p.ensureDefaults(); err != nil {
@@ -413,7 +545,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	}
 	spec.normalize()
 	if err := spec.Validate(); err != nil {
-		return "", err
+		return "", executor.Categorize(executor.FailureInvalidParams, err)
 	}
 	if requestedID == "" {
 		requestedID, err = generateVMID(spec.Name)
@@ -422,6 +554,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 		}
 	}
 	vmID = requestedID
+	defer p.vmLocks.Lock(vmID)()
 	vmDir := p.vmDir(vmID)
 	if err := os.MkdirAll(vmDir, 0o755); err != nil {
 		return "", err
@@ -429,6 +562,9 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	if _, statErr := os.Stat(filepath.Join(vmDir, stateFileName)); statErr == nil {
 		return vmID, nil
 	}
+	if spec.MACAddress == "" {
+		spec.MACAddress = network.GenerateMAC(vmID, 0)
+	}
 
 	tapCreated := false
 	defer func() {
@@ -443,7 +579,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 
 	diskPath, cachedPath, err := p.prepareDisk(vmDir, spec.DiskPath, spec.DiskSizeMB)
 	if err != nil {
-		return "", err
+		return "", executor.Categorize(executor.FailureImagePull, err)
 	}
 
 	isoPath, err := p.prepareCloudInitISO(ctx, vmID, vmDir, spec)
@@ -452,7 +588,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 	}
 
 	if err := p.setupTap(ctx, vmID, spec.TapName, spec.BridgeName); err != nil {
-		return "", err
+		return "", executor.Categorize(executor.FailureNetworkSetup, err)
 	}
 	tapCreated = true
 
@@ -466,6 +602,7 @@ func (p *Provider) createVM(ctx context.Context, spec VMSpec, requestedID string
 		StdoutPath:       filepath.Join(vmDir, "stdout.log"),
 		StderrPath:       filepath.Join(vmDir, "stderr.log"),
 		ConsolePath:      filepath.Join(vmDir, "console.log"),
+		MACAddress:       spec.MACAddress,
 		Status:           VMStatusCreated,
 		CreatedAt:        time.Now().UTC(),
 		UpdatedAt:        time.Now().UTC(),
@@ -581,7 +718,7 @@ func (p *Provider) prepareCloudInitISO(ctx context.Context, vmID, vmDir string,
 		if err := os.WriteFile(isoPath, []byte("dry-run cloud-init seed"), 0o644); err != nil {
 			return "", err
 		}
-		if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+		if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 			return "", err
 		}
 		return isoPath, nil
@@ -613,7 +750,7 @@ func (p *Provider) prepareCloudInitISO(ctx context.Context, vmID, vmDir string,
 		return "", errors.New("cloud-init ISO builder not found (need cloud-localds, genisoimage, or mkisofs)")
 	}
 
-	if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+	if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 		return "", err
 	}
 	if err := runCmd(ctx, cmd[0], cmd[1:]...); err != nil {
@@ -625,7 +762,7 @@ func (p *Provider) prepareCloudInitISO(ctx context.Context, vmID, vmDir string,
 func (p *Provider) setupTap(ctx context.Context, vmID, tapName, bridgeName string) error {
 	cmds := renderTapSetupCommands(p.IPBinary, tapName, bridgeName)
 	for _, cmd := range cmds {
-		if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+		if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 			return err
 		}
 		if p.DryRun {
@@ -646,7 +783,7 @@ func (p *Provider) cleanupTap(ctx context.Context, vmID, tapName string) error {
 		return nil
 	}
 	cmd := []string{p.IPBinary, "link", "del", tapName}
-	if err := p.appendCommand(vmID, renderCommand(cmd[0], cmd[1:]...)); err != nil {
+	if err := p.appendCommand(vmID, cmd[0], cmd[1:]...); err != nil {
 		return err
 	}
 	if p.DryRun {
@@ -665,7 +802,8 @@ func (p *Provider) cleanupTap(ctx context.Context, vmID, tapName string) error {
 // Firecracker API methods
 
 func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
-	client := newFCClient(meta.APISocketPath)
+	client := newFCClient(meta.APISocketPath, p.configureTimeout())
+	client.retries = p.apiRetries()
 
 	// Configure machine
 	machineCfg := MachineConfig{
@@ -673,7 +811,7 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 		MemSizeMiB: meta.Spec.MemMB,
 		Smt:        false,
 	}
-	if err := client.put(ctx, "/machine-config", machineCfg); err != nil {
+	if err := client.putConfig(ctx, "/machine-config", machineCfg); err != nil {
 		return fmt.Errorf("set machine config: %w", err)
 	}
 
@@ -682,7 +820,7 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 		KernelImagePath: meta.Spec.KernelPath,
 		BootArgs:        meta.Spec.KernelArgs,
 	}
-	if err := client.put(ctx, "/boot-source", bootSource); err != nil {
+	if err := client.putConfig(ctx, "/boot-source", bootSource); err != nil {
 		return fmt.Errorf("set boot source: %w", err)
 	}
 
@@ -693,7 +831,7 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 		IsRootDevice: true,
 		IsReadOnly:   false,
 	}
-	if err := client.put(ctx, "/drives/rootfs", rootDrive); err != nil {
+	if err := client.putConfig(ctx, "/drives/rootfs", rootDrive); err != nil {
 		return fmt.Errorf("set root drive: %w", err)
 	}
 
@@ -705,7 +843,7 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 			IsRootDevice: false,
 			IsReadOnly:   true,
 		}
-		if err := client.put(ctx, "/drives/cloudinit", cloudInitDrive); err != nil {
+		if err := client.putConfig(ctx, "/drives/cloudinit", cloudInitDrive); err != nil {
 			return fmt.Errorf("set cloud-init drive: %w", err)
 		}
 	}
@@ -719,7 +857,7 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 		if meta.Spec.MACAddress != "" {
 			iface.GuestMac = meta.Spec.MACAddress
 		}
-		if err := client.put(ctx, "/network-interfaces/eth0", iface); err != nil {
+		if err := client.putConfig(ctx, "/network-interfaces/eth0", iface); err != nil {
 			return fmt.Errorf("set network interface: %w", err)
 		}
 	}
@@ -728,24 +866,50 @@ func (p *Provider) configureVM(ctx context.Context, meta vmMeta) error {
 }
 
 func (p *Provider) startInstance(ctx context.Context, socketPath string) error {
-	client := newFCClient(socketPath)
+	client := newFCClient(socketPath, p.apiTimeout())
 	action := Action{ActionType: ActionTypeInstanceStart}
 	return client.put(ctx, "/actions", action)
 }
 
 func (p *Provider) shutdownViaAPISocket(ctx context.Context, socketPath string) error {
-	client := newFCClient(socketPath)
+	client := newFCClient(socketPath, p.apiTimeout())
 	action := Action{ActionType: ActionTypeInstanceHalt}
 	return client.put(ctx, "/actions", action)
 }
 
+func (p *Provider) apiTimeout() time.Duration {
+	if p.APITimeout > 0 {
+		return p.APITimeout
+	}
+	return defaultAPITimeout
+}
+
+func (p *Provider) apiRetries() int {
+	switch {
+	case p.APIRetries < 0:
+		return 0
+	case p.APIRetries == 0:
+		return defaultAPIRetries
+	}
+	return p.APIRetries
+}
+
+func (p *Provider) configureTimeout() time.Duration {
+	if p.ConfigureTimeout > 0 {
+		return p.ConfigureTimeout
+	}
+	return defaultConfigureTimeout
+}
+
 // fcClient is a Firecracker API client.
 type fcClient struct {
 	socketPath string
 	httpClient *http.Client
+	// retries bounds the extra attempts of putConfig.
+	retries int
 }
 
-func newFCClient(socketPath string) *fcClient {
+func newFCClient(socketPath string, timeout time.Duration) *fcClient {
 	transport := &http.Transport{
 		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 			return net.Dial("unix", socketPath)
@@ -755,7 +919,7 @@ func newFCClient(socketPath string) *fcClient {
 		socketPath: socketPath,
 		httpClient: &http.Client{
 			Transport: transport,
-			Timeout:   5 * time.Second,
+			Timeout:   timeout,
 		},
 	}
 }
@@ -787,6 +951,38 @@ func (c *fcClient) put(ctx context.Context, path string, body interface{}) error
 	return nil
 }
 
+// putConfig is put for idempotent configuration calls: it retries up to
+// c.retries times with a doubling backoff when the connection to the
+// socket fails. An error response from the API is returned at once.
+func (c *fcClient) putConfig(ctx context.Context, path string, body interface{}) error {
+	backoff := apiRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.put(ctx, path, body)
+		if err == nil || attempt >= c.retries || !transientSocketError(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// transientSocketError reports whether err is a failure to reach the API
+// socket, such as a refused or dropped connection, rather than an API
+// error or a timeout.
+func transientSocketError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 // File and process utilities
 
 func (p *Provider) vmDir(vmID string) string { return filepath.Join(p.RuntimeDir, vmID) }
@@ -815,7 +1011,13 @@ func (p *Provider) saveMeta(meta vmMeta) error {
 	return os.WriteFile(filepath.Join(p.vmDir(meta.VMID), stateFileName), b, 0o600)
 }
 
-func (p *Provider) appendCommand(vmID, command string) error {
+// appendCommand records a command line in the VM's commands.log with
+// sensitive arguments masked. It is a no-op when DisableCommandLog is set.
+func (p *Provider) appendCommand(vmID, name string, args ...string) error {
+	if p.DisableCommandLog {
+		return nil
+	}
+	command := renderCommand(name, redact.Args(args, p.RedactArgs...)...)
 	path := filepath.Join(p.vmDir(vmID), commandsFileName)
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
@@ -827,8 +1029,7 @@ func (p *Provider) appendCommand(vmID, command string) error {
 }
 
 func (p *Provider) markStoppedIfCurrent(vmID string, pid int) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	defer p.vmLocks.Lock(vmID)()
 
 	meta, err := p.loadMeta(vmID)
 	if err != nil {
@@ -855,8 +1056,17 @@ func (p *Provider) syncStateStore(meta vmMeta) error {
 		KernelPath: meta.Spec.KernelPath,
 		RootfsPath: meta.DiskPath,
 		TapIface:   meta.Spec.TapName,
-		CHPID:      meta.PID,
-		Status:     strings.ToUpper(string(meta.Status)),
+		Networks: []state.NetworkConfig{{
+			ID:      "eth0",
+			TapName: meta.Spec.TapName,
+			MacAddr: meta.Spec.MACAddress,
+			Bridge:  meta.Spec.BridgeName,
+		}},
+		CHPID:     meta.PID,
+		Status:    strings.ToUpper(string(meta.Status)),
+		VCPU:      meta.Spec.VCPU,
+		MemoryMiB: meta.Spec.MemMB,
+		Labels:    meta.Spec.Labels,
 	})
 }
 
@@ -992,6 +1202,7 @@ func renderUserData(spec VMSpec) string {
 			b.WriteByte('\n')
 		}
 	}
+	b.WriteString(executor.RenderWriteFiles(spec.Files))
 	b.WriteString("package_update: false\n")
 	return b.String()
 }
@@ -7,8 +7,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -374,7 +376,7 @@ func TestFCClient(t *testing.T) {
 	defer server.Close()
 
 	// Create client
-	client := newFCClient(listener.Addr().String())
+	client := newFCClient(listener.Addr().String(), defaultAPITimeout)
 
 	// Test PUT
 	ctx := context.Background()
@@ -400,6 +402,119 @@ func TestFCClient(t *testing.T) {
 	}
 }
 
+func TestAPITimeouts(t *testing.T) {
+	// Every call takes 200ms, longer than the API timeout but well within
+	// the configure timeout.
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "slow.sock"))
+	if err != nil {
+		t.Fatalf("failed to create unix listener: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	p := &Provider{APITimeout: 50 * time.Millisecond, ConfigureTimeout: 5 * time.Second}
+	socketPath := listener.Addr().String()
+	meta := vmMeta{
+		APISocketPath: socketPath,
+		DiskPath:      "/tmp/disk.raw",
+		Spec:          VMSpec{VCPU: 1, MemMB: 256, KernelPath: "/tmp/vmlinux", TapName: "tap0"},
+	}
+	if err := p.configureVM(context.Background(), meta); err != nil {
+		t.Fatalf("expected configuration within the configure timeout, got %v", err)
+	}
+	start := time.Now()
+	if err := p.startInstance(context.Background(), socketPath); err == nil {
+		t.Fatal("expected the start action to exceed the API timeout")
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("expected the start action to give up after the 50ms API timeout, took %v", elapsed)
+	}
+
+	defaults := &Provider{}
+	if defaults.apiTimeout() != defaultAPITimeout || defaults.configureTimeout() != defaultConfigureTimeout {
+		t.Fatalf("unexpected default timeouts %v, %v", defaults.apiTimeout(), defaults.configureTimeout())
+	}
+}
+
+// flakyListener drops the first connections it accepts, like a VMM API
+// socket that is not serving yet.
+type flakyListener struct {
+	net.Listener
+	drop atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.drop.Add(-1) < 0 {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+func TestConfigureCallsRetryTransientSocketErrors(t *testing.T) {
+	inner, err := net.Listen("unix", filepath.Join(t.TempDir(), "flaky.sock"))
+	if err != nil {
+		t.Fatalf("failed to create unix listener: %v", err)
+	}
+	listener := &flakyListener{Listener: inner}
+	var calls atomic.Int32
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/drives/rootfs" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"fault_message":"invalid drive"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// Each client dials afresh, since idle connections are reused.
+	newClient := func() *fcClient {
+		client := newFCClient(inner.Addr().String(), defaultAPITimeout)
+		client.retries = 2
+		return client
+	}
+	client := newClient()
+	listener.drop.Store(1)
+	if err := client.putConfig(context.Background(), "/machine-config", MachineConfig{VcpuCount: 1, MemSizeMiB: 256}); err != nil {
+		t.Fatalf("expected the second attempt to succeed, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one request to reach the API, got %d", calls.Load())
+	}
+
+	// An API error is final.
+	calls.Store(0)
+	if err := client.putConfig(context.Background(), "/drives/rootfs", Drive{DriveID: "rootfs"}); err == nil || !strings.Contains(err.Error(), "invalid drive") {
+		t.Fatalf("expected the API error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a 4xx not to be retried, got %d requests", calls.Load())
+	}
+
+	// Retries are bounded, and instance actions are never retried.
+	listener.drop.Store(3)
+	if err := newClient().putConfig(context.Background(), "/machine-config", MachineConfig{VcpuCount: 1, MemSizeMiB: 256}); err == nil {
+		t.Fatal("expected the call to fail once retries are used up")
+	}
+	listener.drop.Store(1)
+	if err := newClient().put(context.Background(), "/actions", Action{ActionType: ActionTypeInstanceStart}); err == nil {
+		t.Fatal("expected a plain put not to retry")
+	}
+
+	if (&Provider{}).apiRetries() != defaultAPIRetries || (&Provider{APIRetries: -1}).apiRetries() != 0 {
+		t.Fatal("unexpected retry defaults")
+	}
+}
+
 func TestWaitForSocket(t *testing.T) {
 	dir := t.TempDir()
 	socketPath := filepath.Join(dir, "test.sock")
@@ -584,3 +699,160 @@ func TestProviderDuplicateCreate(t *testing.T) {
 
 // Ensure Provider implements executor.MicroVMProvider
 var _ executor.MicroVMProvider = (*Provider)(nil)
+
+func TestAppendCommandRedactsSecrets(t *testing.T) {
+	provider := &Provider{RuntimeDir: t.TempDir(), RedactArgs: []string{"--seed-url"}}
+	vmID := "vm-redact"
+	if err := os.MkdirAll(provider.vmDir(vmID), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.appendCommand(vmID, "netbird", "up", "--setup-key", "SK-SUPER-SECRET", "--seed-url=https://seed.example/abc", "--hostname", "demo"); err != nil {
+		t.Fatalf("appendCommand failed: %v", err)
+	}
+	commands, err := os.ReadFile(filepath.Join(provider.vmDir(vmID), commandsFileName))
+	if err != nil {
+		t.Fatalf("read commands.log failed: %v", err)
+	}
+	log := string(commands)
+	if strings.Contains(log, "SK-SUPER-SECRET") || strings.Contains(log, "seed.example") {
+		t.Fatalf("expected sensitive values to be redacted, got:\n%s", log)
+	}
+	if !strings.Contains(log, "--setup-key *** --seed-url=*** --hostname demo") {
+		t.Fatalf("expected masked command line, got:\n%s", log)
+	}
+
+	provider.DisableCommandLog = true
+	quietID := "vm-quiet"
+	if err := provider.appendCommand(quietID, "ip", "link", "del", "tap0"); err != nil {
+		t.Fatalf("appendCommand with log disabled failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(provider.vmDir(quietID), commandsFileName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no commands.log when disabled, stat err=%v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	supports := func(p *Provider, action executor.ActionType) bool {
+		for _, c := range p.Capabilities() {
+			if c == string(action) {
+				return true
+			}
+		}
+		return false
+	}
+	p := &Provider{}
+	for _, action := range []executor.ActionType{
+		executor.ActionMicroVMCreate, executor.ActionMicroVMStart, executor.ActionMicroVMStop, executor.ActionMicroVMDelete,
+		executor.ActionMicroVMPause, executor.ActionMicroVMResume, executor.ActionMicroVMSnapshot, executor.ActionMicroVMMigrate,
+	} {
+		if !supports(p, action) {
+			t.Errorf("expected %s to be supported", action)
+		}
+	}
+	if supports(p, executor.ActionCommandExecute) {
+		t.Error("commands run on the host, not through the provider")
+	}
+
+	dry := &Provider{DryRun: true}
+	if !supports(dry, executor.ActionMicroVMCreate) {
+		t.Error("expected dry-run create to be supported")
+	}
+	for _, action := range []executor.ActionType{executor.ActionMicroVMPause, executor.ActionMicroVMResume, executor.ActionMicroVMSnapshot} {
+		if supports(dry, action) {
+			t.Errorf("expected %s to be unsupported in dry-run mode", action)
+		}
+	}
+}
+
+// runningVM records a VM whose hypervisor process is a sleep, so stops can
+// be observed without a real hypervisor.
+func runningVM(t *testing.T, p *Provider, vmID string) {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-exited
+	})
+	if err := os.MkdirAll(p.vmDir(vmID), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	meta := vmMeta{
+		VMID:          vmID,
+		APISocketPath: filepath.Join(p.vmDir(vmID), "missing.sock"),
+		PID:           cmd.Process.Pid,
+		Status:        VMStatusRunning,
+	}
+	if err := p.saveMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopWithOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     executor.StopOptions
+		logged   []string
+		unlogged []string
+		minWait  time.Duration
+	}{
+		{name: "acpi waits the grace period before SIGTERM", opts: executor.StopOptions{Method: executor.StopMethodACPI, GracePeriod: 1}, logged: []string{"PUT", "kill -TERM"}, unlogged: []string{"kill -KILL"}, minWait: time.Second},
+		{name: "signal skips acpi", opts: executor.StopOptions{Method: executor.StopMethodSignal, GracePeriod: 1}, logged: []string{"kill -TERM"}, unlogged: []string{"PUT", "kill -KILL"}},
+		{name: "force kills right away", opts: executor.StopOptions{Method: executor.StopMethodForce}, logged: []string{"kill -KILL"}, unlogged: []string{"PUT", "kill -TERM"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			p := &Provider{RuntimeDir: filepath.Join(root, "vms"), ImagesDir: filepath.Join(root, "images")}
+			if err := p.ensureDefaults(); err != nil {
+				t.Fatal(err)
+			}
+			runningVM(t, p, "vm-1")
+
+			start := time.Now()
+			if err := p.StopWithOptions(context.Background(), "vm-1", tc.opts); err != nil {
+				t.Fatalf("StopWithOptions: %v", err)
+			}
+			elapsed := time.Since(start)
+			if elapsed < tc.minWait || elapsed >= p.StopTimeout {
+				t.Fatalf("expected the stop to take the grace period, took %s", elapsed)
+			}
+			log, err := os.ReadFile(filepath.Join(p.vmDir("vm-1"), commandsFileName))
+			if err != nil {
+				t.Fatalf("read commands.log: %v", err)
+			}
+			for _, want := range tc.logged {
+				if !strings.Contains(string(log), want) {
+					t.Errorf("expected %q in commands.log:\n%s", want, log)
+				}
+			}
+			for _, unwanted := range tc.unlogged {
+				if strings.Contains(string(log), unwanted) {
+					t.Errorf("unexpected %q in commands.log:\n%s", unwanted, log)
+				}
+			}
+			meta, err := p.loadMeta("vm-1")
+			if err != nil || meta.Status != VMStatusStopped {
+				t.Fatalf("expected the VM to be stopped, got %+v, %v", meta, err)
+			}
+		})
+	}
+
+	p := &Provider{RuntimeDir: t.TempDir(), ImagesDir: t.TempDir()}
+	err := p.StopWithOptions(context.Background(), "vm-1", executor.StopOptions{Method: "reboot"})
+	if executor.FailureCategory(err) != executor.FailureInvalidParams {
+		t.Fatalf("expected an invalid method to be rejected, got %v", err)
+	}
+	err = p.StopWithOptions(context.Background(), "vm-1", executor.StopOptions{GracePeriod: executor.MaxStopGracePeriod + 1})
+	if executor.FailureCategory(err) != executor.FailureInvalidParams {
+		t.Fatalf("expected an out of bounds grace period to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+// Package vmlock serializes provider operations on the same VM while
+// operations on different VMs run concurrently.
+package vmlock
+
+import "sync"
+
+// Keyed holds one mutex per VM ID. A mutex exists while an operation holds
+// or waits for it, so the set does not grow with the VMs ever seen. The
+// zero value is ready to use.
+type Keyed struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+}
+
+type entry struct {
+	mu sync.Mutex
+	// refs counts the operations holding or waiting for mu.
+	refs int
+}
+
+// Lock blocks until no other operation holds vmID and returns the function
+// that releases it.
+func (k *Keyed) Lock(vmID string) (unlock func()) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*entry)
+	}
+	e, ok := k.locks[vmID]
+	if !ok {
+		e = &entry{}
+		k.locks[vmID] = e
+	}
+	e.refs++
+	k.mu.Unlock()
+
+	e.mu.Lock()
+	return func() {
+		e.mu.Unlock()
+		k.mu.Lock()
+		if e.refs--; e.refs == 0 {
+			delete(k.locks, vmID)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// held returns the number of VM IDs with a live mutex.
+func (k *Keyed) held() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.locks)
+}
@@ -0,0 +1,42 @@
+package vmlock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockSerializesOneVMOnly(t *testing.T) {
+	var k Keyed
+	unlockA := k.Lock("vm-a")
+
+	// Another VM is not held up by vm-a.
+	done := make(chan struct{})
+	go func() {
+		k.Lock("vm-b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected vm-b to lock while vm-a is held")
+	}
+
+	acquired := make(chan func())
+	go func() { acquired <- k.Lock("vm-a") }()
+	select {
+	case <-acquired:
+		t.Fatal("expected a second lock of vm-a to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	select {
+	case unlock := <-acquired:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("expected vm-a to lock once released")
+	}
+
+	if n := k.held(); n != 0 {
+		t.Fatalf("expected released locks to be dropped, %d left", n)
+	}
+}
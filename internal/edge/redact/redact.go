@@ -0,0 +1,93 @@
+// Package redact masks secret values in command lines before they are
+// written to on-host logs such as a provider's commands.log.
+package redact
+
+import "strings"
+
+// Mask replaces redacted values.
+const Mask = "***"
+
+// DefaultKeys are flag and key names whose values are always masked. A name
+// also matches when it ends in one of these after a '-' or '_', so
+// "setup-key" and "api_token" are covered by "key" and "token".
+var DefaultKeys = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"key",
+	"credential",
+	"credentials",
+	"auth",
+}
+
+// Args returns a copy of args with sensitive values masked. It handles
+// "--flag value", "--flag=value" and comma- or space-separated key=value
+// lists such as "path=/disk.img,password=x". extraKeys are matched in
+// addition to DefaultKeys.
+func Args(args []string, extraKeys ...string) []string {
+	out := make([]string, len(args))
+	maskNext := false
+	for i, arg := range args {
+		if maskNext {
+			out[i] = Mask
+			maskNext = false
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+			maskNext = isSensitive(arg, extraKeys)
+			out[i] = arg
+			continue
+		}
+		out[i] = maskPairs(arg, extraKeys)
+	}
+	return out
+}
+
+// maskPairs masks the values of sensitive key=value pairs in s, keeping
+// the separators between pairs intact.
+func maskPairs(s string, extraKeys []string) string {
+	if !strings.Contains(s, "=") {
+		return s
+	}
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != ',' && s[i] != ' ' {
+			continue
+		}
+		b.WriteString(maskPair(s[start:i], extraKeys))
+		if i < len(s) {
+			b.WriteByte(s[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+func maskPair(pair string, extraKeys []string) string {
+	name, _, found := strings.Cut(pair, "=")
+	if !found || !isSensitive(name, extraKeys) {
+		return pair
+	}
+	return name + "=" + Mask
+}
+
+func isSensitive(name string, extraKeys []string) bool {
+	name = strings.ToLower(strings.TrimLeft(strings.TrimSpace(name), "-"))
+	if name == "" {
+		return false
+	}
+	for _, keys := range [][]string{DefaultKeys, extraKeys} {
+		for _, key := range keys {
+			key = strings.ToLower(strings.TrimLeft(strings.TrimSpace(key), "-"))
+			if key == "" {
+				continue
+			}
+			if name == key || strings.HasSuffix(name, "-"+key) || strings.HasSuffix(name, "_"+key) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package redact
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		extra []string
+		want  []string
+	}{
+		{
+			name: "flag followed by value",
+			args: []string{"up", "--setup-key", "abc123", "--hostname", "edge-1"},
+			want: []string{"up", "--setup-key", Mask, "--hostname", "edge-1"},
+		},
+		{
+			name: "flag with equals",
+			args: []string{"--password=hunter2", "--name=vm"},
+			want: []string{"--password=" + Mask, "--name=vm"},
+		},
+		{
+			name: "comma separated pairs",
+			args: []string{"--disk", "path=/var/disk.raw,api_token=t0k,readonly=on"},
+			want: []string{"--disk", "path=/var/disk.raw,api_token=" + Mask + ",readonly=on"},
+		},
+		{
+			name: "space separated pairs",
+			args: []string{"--cmdline", "console=ttyS0 secret=s3cr3t quiet"},
+			want: []string{"--cmdline", "console=ttyS0 secret=" + Mask + " quiet"},
+		},
+		{
+			name:  "extra keys",
+			args:  []string{"--seed-url", "https://seed/x", "--monkey", "bananas"},
+			extra: []string{"seed-url"},
+			want:  []string{"--seed-url", Mask, "--monkey", "bananas"},
+		},
+		{
+			name: "nothing sensitive",
+			args: []string{"link", "set", "tap0", "up"},
+			want: []string{"link", "set", "tap0", "up"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Args(tt.args, tt.extra...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Args(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
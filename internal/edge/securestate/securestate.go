@@ -21,12 +21,17 @@ type Store struct {
 	key       []byte
 	encrypted bool
 	data      diskState
+	actionTTL time.Duration
 }
 
 type diskState struct {
 	Identity *state.Identity               `json:"identity,omitempty"`
 	MicroVMs map[string]state.MicroVM      `json:"microvms"`
 	Actions  map[string]state.ActionRecord `json:"actions"`
+	// PendingResults is keyed by execution ID.
+	PendingResults map[string]state.PendingResult `json:"pending_results,omitempty"`
+	// HeartbeatSeq is the sequence number of the last heartbeat sent.
+	HeartbeatSeq int64 `json:"heartbeat_seq,omitempty"`
 }
 
 // Open opens or creates a secure state store at the given directory.
@@ -150,6 +155,9 @@ func (s *Store) UpsertMicroVM(vm state.MicroVM) error {
 	if vm.ID == "" {
 		return errors.New("vm id required")
 	}
+	if vm.DesiredStatus == "" {
+		vm.DesiredStatus = s.data.MicroVMs[vm.ID].DesiredStatus
+	}
 	vm.UpdatedAt = time.Now().UTC()
 	s.data.MicroVMs[vm.ID] = vm
 	return s.persistLocked()
@@ -212,6 +220,62 @@ func (s *Store) PutActionRecord(record state.ActionRecord) error {
 	}
 	record.UpdatedAt = time.Now().UTC()
 	s.data.Actions[record.ActionID] = record
+	state.PruneActionRecords(s.data.Actions, s.actionTTL, record.UpdatedAt)
+	return s.persistLocked()
+}
+
+// SetActionRecordTTL sets how long action records are retained. Expired
+// records are pruned on the next PutActionRecord.
+func (s *Store) SetActionRecordTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actionTTL = ttl
+}
+
+// NextHeartbeatSeq records and returns the sequence number of the next
+// heartbeat. It keeps increasing across restarts, so the control plane can
+// drop a heartbeat that arrives after a newer one.
+func (s *Store) NextHeartbeatSeq() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.HeartbeatSeq++
+	if err := s.persistLocked(); err != nil {
+		s.data.HeartbeatSeq--
+		return 0, err
+	}
+	return s.data.HeartbeatSeq, nil
+}
+
+// PutPendingResult records or replaces an unacknowledged plan result.
+func (s *Store) PutPendingResult(result state.PendingResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.ExecutionID == "" {
+		return errors.New("execution id required")
+	}
+	if s.data.PendingResults == nil {
+		s.data.PendingResults = map[string]state.PendingResult{}
+	}
+	s.data.PendingResults[result.ExecutionID] = result
+	return s.persistLocked()
+}
+
+// ListPendingResults returns the unacknowledged plan results, oldest first.
+func (s *Store) ListPendingResults() ([]state.PendingResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return state.SortedPendingResults(s.data.PendingResults), nil
+}
+
+// DeletePendingResult forgets a plan result once it was acknowledged.
+func (s *Store) DeletePendingResult(executionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.PendingResults, executionID)
 	return s.persistLocked()
 }
 
@@ -34,11 +34,18 @@ type MicroVM struct {
 	Name       string          `json:"name"`
 	KernelPath string          `json:"kernel_path"`
 	RootfsPath string          `json:"rootfs_path"`
-	TapIface   string          `json:"tap_iface"` // Deprecated: use Networks instead
+	TapIface   string          `json:"tap_iface"`          // Deprecated: use Networks instead
 	Networks   []NetworkConfig `json:"networks,omitempty"` // Multiple network interfaces
 	CHPID      int             `json:"ch_pid"`
 	Status     string          `json:"status"`
-	UpdatedAt  time.Time       `json:"updated_at"`
+	VCPU       int             `json:"vcpu,omitempty"`
+	MemoryMiB  int             `json:"memory_mib,omitempty"`
+	// DesiredStatus is the state the last start/stop action asked for.
+	// Providers only report Status, so upserts keep the stored value when
+	// this is empty.
+	DesiredStatus string            `json:"desired_status,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	UpdatedAt     time.Time         `json:"updated_at"`
 }
 
 // GetNetworks returns the list of network configurations for the VM.
@@ -77,16 +84,52 @@ type ActionRecord struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+// DefaultActionRecordTTL is how long action records are kept for idempotent
+// replays when the control plane does not send a result_ttl hint.
+const DefaultActionRecordTTL = 7 * 24 * time.Hour
+
+// PruneActionRecords deletes records last updated more than ttl before now
+// and returns how many were removed. A ttl <= 0 uses DefaultActionRecordTTL.
+func PruneActionRecords(actions map[string]ActionRecord, ttl time.Duration, now time.Time) int {
+	if ttl <= 0 {
+		ttl = DefaultActionRecordTTL
+	}
+	removed := 0
+	for id, record := range actions {
+		if now.Sub(record.UpdatedAt) > ttl {
+			delete(actions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// PendingResult is a plan result the control plane has not acknowledged
+// yet. Payload is the result as sent; it is resent until delivered.
+type PendingResult struct {
+	ExecutionID   string          `json:"execution_id"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
 type Store struct {
-	mu   sync.Mutex
-	path string
-	data diskState
+	mu        sync.Mutex
+	path      string
+	data      diskState
+	actionTTL time.Duration
 }
 
 type diskState struct {
 	Identity *Identity               `json:"identity,omitempty"`
 	MicroVMs map[string]MicroVM      `json:"microvms"`
 	Actions  map[string]ActionRecord `json:"actions"`
+	// PendingResults is keyed by execution ID.
+	PendingResults map[string]PendingResult `json:"pending_results,omitempty"`
+	// HeartbeatSeq is the sequence number of the last heartbeat sent.
+	HeartbeatSeq int64 `json:"heartbeat_seq,omitempty"`
 }
 
 func Open(dir string) (*Store, error) {
@@ -137,6 +180,9 @@ func (s *Store) UpsertMicroVM(vm MicroVM) error {
 	if vm.ID == "" {
 		return errors.New("vm id required")
 	}
+	if vm.DesiredStatus == "" {
+		vm.DesiredStatus = s.data.MicroVMs[vm.ID].DesiredStatus
+	}
 	vm.UpdatedAt = time.Now().UTC()
 	s.data.MicroVMs[vm.ID] = vm
 	return s.persistLocked()
@@ -187,9 +233,76 @@ func (s *Store) PutActionRecord(record ActionRecord) error {
 	}
 	record.UpdatedAt = time.Now().UTC()
 	s.data.Actions[record.ActionID] = record
+	PruneActionRecords(s.data.Actions, s.actionTTL, record.UpdatedAt)
 	return s.persistLocked()
 }
 
+// SetActionRecordTTL sets how long action records are retained. Expired
+// records are pruned on the next PutActionRecord.
+func (s *Store) SetActionRecordTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actionTTL = ttl
+}
+
+// NextHeartbeatSeq records and returns the sequence number of the next
+// heartbeat. It keeps increasing across restarts, so the control plane can
+// drop a heartbeat that arrives after a newer one.
+func (s *Store) NextHeartbeatSeq() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.HeartbeatSeq++
+	if err := s.persistLocked(); err != nil {
+		s.data.HeartbeatSeq--
+		return 0, err
+	}
+	return s.data.HeartbeatSeq, nil
+}
+
+// PutPendingResult records or replaces an unacknowledged plan result.
+func (s *Store) PutPendingResult(result PendingResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.ExecutionID == "" {
+		return errors.New("execution id required")
+	}
+	if s.data.PendingResults == nil {
+		s.data.PendingResults = map[string]PendingResult{}
+	}
+	s.data.PendingResults[result.ExecutionID] = result
+	return s.persistLocked()
+}
+
+// ListPendingResults returns the unacknowledged plan results, oldest first.
+func (s *Store) ListPendingResults() ([]PendingResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SortedPendingResults(s.data.PendingResults), nil
+}
+
+// DeletePendingResult forgets a plan result once it was acknowledged.
+func (s *Store) DeletePendingResult(executionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data.PendingResults, executionID)
+	return s.persistLocked()
+}
+
+// SortedPendingResults returns the results of a pending result map, oldest
+// first.
+func SortedPendingResults(results map[string]PendingResult) []PendingResult {
+	out := make([]PendingResult, 0, len(results))
+	for _, r := range results {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
 func (s *Store) load() error {
 	b, err := os.ReadFile(s.path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -276,6 +276,45 @@ func TestStateActionRecordWithoutID(t *testing.T) {
 	}
 }
 
+func TestStateActionRecordPruning(t *testing.T) {
+	tmpDir := t.TempDir()
+	statePath := filepath.Join(tmpDir, "state")
+
+	store, err := Open(statePath)
+	if err != nil {
+		t.Fatalf("failed to open state store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.PutActionRecord(ActionRecord{ActionID: "old", OK: true}); err != nil {
+		t.Fatalf("PutActionRecord failed: %v", err)
+	}
+	// Age the record past the TTL.
+	old := store.data.Actions["old"]
+	old.UpdatedAt = time.Now().UTC().Add(-2 * time.Hour)
+	store.data.Actions["old"] = old
+
+	store.SetActionRecordTTL(time.Hour)
+	if err := store.PutActionRecord(ActionRecord{ActionID: "new", OK: true}); err != nil {
+		t.Fatalf("PutActionRecord failed: %v", err)
+	}
+
+	if _, found, _ := store.GetActionRecord("old"); found {
+		t.Error("Expected expired action record to be pruned")
+	}
+	if _, found, _ := store.GetActionRecord("new"); !found {
+		t.Error("Expected fresh action record to be kept")
+	}
+
+	reopened, err := Open(statePath)
+	if err != nil {
+		t.Fatalf("failed to reopen state store: %v", err)
+	}
+	if _, found, _ := reopened.GetActionRecord("old"); found {
+		t.Error("Expected pruned action record to stay deleted after reopen")
+	}
+}
+
 func TestStatePersistence(t *testing.T) {
 	tmpDir := t.TempDir()
 	statePath := filepath.Join(tmpDir, "state")
@@ -503,3 +542,31 @@ func TestStateDirectoryCreation(t *testing.T) {
 		t.Error("expected state directory to be created")
 	}
 }
+
+func TestStateUpsertKeepsDesiredStatus(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open state store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.UpsertMicroVM(MicroVM{ID: "vm-1", Status: "RUNNING", DesiredStatus: "RUNNING"}); err != nil {
+		t.Fatalf("UpsertMicroVM failed: %v", err)
+	}
+	// Providers report status without a desired status.
+	if err := store.UpsertMicroVM(MicroVM{ID: "vm-1", Status: "STOPPED"}); err != nil {
+		t.Fatalf("UpsertMicroVM failed: %v", err)
+	}
+	vm, _, _ := store.GetMicroVM("vm-1")
+	if vm.Status != "STOPPED" || vm.DesiredStatus != "RUNNING" {
+		t.Errorf("got status %q desired %q, want STOPPED/RUNNING", vm.Status, vm.DesiredStatus)
+	}
+
+	if err := store.UpsertMicroVM(MicroVM{ID: "vm-1", Status: "STOPPED", DesiredStatus: "STOPPED"}); err != nil {
+		t.Fatalf("UpsertMicroVM failed: %v", err)
+	}
+	vm, _, _ = store.GetMicroVM("vm-1")
+	if vm.DesiredStatus != "STOPPED" {
+		t.Errorf("expected desired status to be overwritten, got %q", vm.DesiredStatus)
+	}
+}
@@ -0,0 +1,28 @@
+package model
+
+import "sort"
+
+// MaxBootDelay is the longest delay, in seconds, a CREATE or START may ask
+// for before it boots its VM.
+const MaxBootDelay = 600
+
+// BootSequence returns the plan indexes of actions with the given boot
+// orders in the order they run: actions with an order above zero run by
+// ascending order, ties in plan order, in the positions the plan gave
+// them; the others keep their place.
+func BootSequence(orders []int) []int {
+	seq := make([]int, len(orders))
+	var slots []int
+	for i, o := range orders {
+		seq[i] = i
+		if o > 0 {
+			slots = append(slots, i)
+		}
+	}
+	booted := append([]int(nil), slots...)
+	sort.SliceStable(booted, func(i, j int) bool { return orders[booted[i]] < orders[booted[j]] })
+	for i, slot := range slots {
+		seq[slot] = booted[i]
+	}
+	return seq
+}
@@ -0,0 +1,23 @@
+package model
+
+import "unicode/utf8"
+
+// MaxConsoleLogBytes bounds the console log kept for a failed action. The
+// tail is kept since boot failures are reported last.
+const MaxConsoleLogBytes = 64 << 10
+
+// TruncateConsoleLog keeps the last MaxConsoleLogBytes of content, cut on
+// a rune boundary so the kept text stays valid UTF-8. It reports whether
+// anything was cut.
+func TruncateConsoleLog(content []byte) ([]byte, bool) {
+	if len(content) <= MaxConsoleLogBytes {
+		return content, false
+	}
+	tail := content[len(content)-MaxConsoleLogBytes:]
+	// A rune is at most utf8.UTFMax bytes, so at most UTFMax-1 leading
+	// continuation bytes belong to a rune that was cut.
+	for i := 0; i < utf8.UTFMax-1 && len(tail) > 0 && !utf8.RuneStart(tail[0]); i++ {
+		tail = tail[1:]
+	}
+	return tail, true
+}
@@ -0,0 +1,41 @@
+package model
+
+import "fmt"
+
+// Default caps on the extra devices one CREATE may request.
+const (
+	DefaultMaxDisksPerVM = 4
+	DefaultMaxNICsPerVM  = 4
+)
+
+// DiskSpec is an extra, empty data disk attached at CREATE. The root disk
+// is not counted against the disk cap.
+type DiskSpec struct {
+	SizeMiB int64 `json:"size_mib"`
+}
+
+// ValidateDevices checks the extra disks and the number of network
+// interfaces of a CREATE against the per-VM caps and that every disk has a
+// size. A cap of zero or less uses the default. The control plane checks
+// plans with it when they are submitted and agents again so a host is
+// never asked to attach more than it was configured for.
+func ValidateDevices(disks []DiskSpec, nics, maxDisks, maxNICs int) error {
+	if maxDisks <= 0 {
+		maxDisks = DefaultMaxDisksPerVM
+	}
+	if maxNICs <= 0 {
+		maxNICs = DefaultMaxNICsPerVM
+	}
+	if len(disks) > maxDisks {
+		return fmt.Errorf("%d disks requested, at most %d per VM", len(disks), maxDisks)
+	}
+	if nics > maxNICs {
+		return fmt.Errorf("%d network interfaces requested, at most %d per VM", nics, maxNICs)
+	}
+	for i, d := range disks {
+		if d.SizeMiB <= 0 {
+			return fmt.Errorf("disks[%d]: size_mib must be > 0", i)
+		}
+	}
+	return nil
+}
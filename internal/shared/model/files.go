@@ -0,0 +1,65 @@
+package model
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MaxFilesBytes bounds the total content of the files in one CREATE
+// action; they travel in the plan and end up in the cloud-init seed.
+const MaxFilesBytes = 64 << 10
+
+// FileSpec is a file written into a VM at first boot through cloud-init
+// write_files. Permissions is an octal mode such as "0644" and Owner is
+// "user" or "user:group"; both default to cloud-init's defaults.
+type FileSpec struct {
+	Path        string `json:"path"`
+	Content     string `json:"content"`
+	Permissions string `json:"permissions,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	// ContentRef replaces Content in plans the control plane stores when
+	// the content is large; it is put back before agents receive the plan.
+	ContentRef string `json:"content_ref,omitempty"`
+}
+
+var (
+	filePermissionsRE = regexp.MustCompile(`^0?[0-7]{3}$`)
+	fileOwnerRE       = regexp.MustCompile(`^[a-z_][a-z0-9_-]*(:[a-z_][a-z0-9_-]*)?$`)
+)
+
+// ValidateFiles checks that paths are absolute, clean and unique, that
+// permissions are plain modes without setuid/setgid/sticky bits and not
+// world-writable, and that the content fits MaxFilesBytes. The control
+// plane checks plans with it when they are submitted and agents again
+// before writing the files.
+func ValidateFiles(files []FileSpec) error {
+	seen := make(map[string]bool, len(files))
+	total := 0
+	for _, f := range files {
+		if !strings.HasPrefix(f.Path, "/") || path.Clean(f.Path) != f.Path || f.Path == "/" || strings.ContainsAny(f.Path, "\x00\n\r") {
+			return fmt.Errorf("file path %q must be a clean absolute path", f.Path)
+		}
+		if seen[f.Path] {
+			return fmt.Errorf("file path %q is listed more than once", f.Path)
+		}
+		seen[f.Path] = true
+		if f.Permissions != "" {
+			if !filePermissionsRE.MatchString(f.Permissions) {
+				return fmt.Errorf("file %s: permissions must be an octal mode like 0644", f.Path)
+			}
+			if (f.Permissions[len(f.Permissions)-1]-'0')&2 != 0 {
+				return fmt.Errorf("file %s: permissions must not be world-writable", f.Path)
+			}
+		}
+		if f.Owner != "" && !fileOwnerRE.MatchString(f.Owner) {
+			return fmt.Errorf("file %s: owner must be user or user:group", f.Path)
+		}
+		total += len(f.Content)
+	}
+	if total > MaxFilesBytes {
+		return fmt.Errorf("files total %d bytes, limit is %d", total, MaxFilesBytes)
+	}
+	return nil
+}
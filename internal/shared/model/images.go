@@ -0,0 +1,23 @@
+package model
+
+import "strings"
+
+// Image is the kernel and root filesystem a VM boots from, as paths on the
+// host. KernelPath may be empty for providers that boot from the disk.
+type Image struct {
+	KernelPath string `json:"kernel_path,omitempty"`
+	RootfsPath string `json:"rootfs_path"`
+}
+
+// NormalizeArch maps uname-style names to GOARCH, the spelling used in
+// host facts and site image defaults; other values are only lower-cased.
+func NormalizeArch(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	switch arch {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	}
+	return arch
+}
@@ -0,0 +1,25 @@
+// Package model holds domain values shared by the edge agent and the
+// control plane.
+package model
+
+// Shutdown reasons an agent reports: on its final heartbeat, or as
+// ShutdownCrashRecovery on the first heartbeat after a run that ended
+// without one.
+const (
+	ShutdownSignal        = "signal"
+	ShutdownConfigReload  = "config_reload"
+	ShutdownUpgrade       = "upgrade"
+	ShutdownCrashRecovery = "crash_recovery"
+	// ShutdownUnspecified is recorded for final heartbeats of agents that
+	// predate shutdown reasons; agents do not send it.
+	ShutdownUnspecified = "unspecified"
+)
+
+// ValidShutdownReason reports whether reason is one an agent may send.
+func ValidShutdownReason(reason string) bool {
+	switch reason {
+	case ShutdownSignal, ShutdownConfigReload, ShutdownUpgrade, ShutdownCrashRecovery:
+		return true
+	}
+	return false
+}
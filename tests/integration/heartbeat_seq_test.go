@@ -0,0 +1,169 @@
+package integration_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	controlplane "github.com/kubedoio/n-kudo/internal/controlplane/api"
+	store "github.com/kubedoio/n-kudo/internal/controlplane/db"
+	"github.com/kubedoio/n-kudo/internal/edge/enroll"
+	"github.com/kubedoio/n-kudo/internal/edge/hostfacts"
+	"github.com/kubedoio/n-kudo/internal/edge/mtls"
+	"github.com/kubedoio/n-kudo/internal/edge/state"
+)
+
+// TestHeartbeatSeqSurvivesAgentRestart sends heartbeats numbered from the
+// agent's state store to the control plane: a restarted agent keeps being
+// heard, and a heartbeat replayed after a newer one is dropped.
+func TestHeartbeatSeqSurvivesAgentRestart(t *testing.T) {
+	ctx := context.Background()
+	repo := store.NewMemoryRepo()
+	cfg := controlplane.LoadConfig()
+	cfg.AdminKey = "test-admin-key"
+	app, err := controlplane.NewApp(cfg, repo)
+	if err != nil {
+		t.Fatalf("failed to create app: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(app.Handler())
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("skipping integration test: cannot bind local listener: %v", err)
+	}
+	srv.Listener = ln
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tenant, err := repo.CreateTenant(ctx, store.Tenant{ID: uuid.NewString(), Slug: "seq", Name: "Seq", RetentionDays: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, err := repo.CreateSite(ctx, store.Site{ID: uuid.NewString(), TenantID: tenant.ID, Name: "site"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := "seq-token-" + uuid.NewString()
+	tokenHash := sha256.Sum256([]byte(token))
+	if _, err := repo.IssueEnrollmentToken(ctx, store.EnrollmentToken{
+		ID:        uuid.NewString(),
+		TenantID:  tenant.ID,
+		SiteID:    site.ID,
+		TokenHash: hex.EncodeToString(tokenHash[:]),
+		ExpiresAt: time.Now().UTC().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrapHTTP, err := mtls.NewBootstrapTLSClient(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := mtls.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := mtls.GenerateCSRPEM(key, "nkudo-edge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The agent's enroll client is not the subject here, so enroll with the
+	// fields the control plane reads.
+	enrollBody, err := json.Marshal(map[string]any{
+		"enrollment_token":   token,
+		"agent_version":      "test",
+		"requested_hostname": "host",
+		"csr_pem":            string(csr),
+		"bootstrap_nonce":    "nonce",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollResp, err := bootstrapHTTP.Post(srv.URL+"/v1/enroll", "application/json", bytes.NewReader(enrollBody))
+	if err != nil {
+		t.Fatalf("enroll failed: %v", err)
+	}
+	defer enrollResp.Body.Close()
+	if enrollResp.StatusCode != http.StatusOK {
+		t.Fatalf("enroll status=%d", enrollResp.StatusCode)
+	}
+	var resp enroll.EnrollResponse
+	if err := json.NewDecoder(enrollResp.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	pki := mtls.DefaultPKIPaths(filepath.Join(t.TempDir(), "pki"))
+	if err := mtls.WritePKI(pki, mtls.EncodePrivateKeyPEM(key), []byte(resp.ClientCertificatePEM), []byte(resp.CACertificatePEM)); err != nil {
+		t.Fatal(err)
+	}
+	mTLSClient, err := mtls.NewMutualTLSClient(pki, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := enroll.Client{BaseURL: srv.URL, HTTP: mTLSClient}
+
+	stateDir := t.TempDir()
+	heartbeat := func(seq int64, agentVersion string) enroll.HeartbeatResponse {
+		t.Helper()
+		hb, err := cp.Heartbeat(ctx, enroll.HeartbeatRequest{
+			TenantID:     resp.TenantID,
+			SiteID:       resp.SiteID,
+			HostID:       resp.HostID,
+			AgentID:      resp.AgentID,
+			AgentVersion: agentVersion,
+			HeartbeatSeq: seq,
+			HostFacts:    hostfacts.Facts{CPUCores: 2, Arch: "amd64"},
+		})
+		if err != nil {
+			t.Fatalf("heartbeat %d failed: %v", seq, err)
+		}
+		return hb
+	}
+	// nextSeq numbers a heartbeat the way an agent started on stateDir does.
+	nextSeq := func() int64 {
+		t.Helper()
+		st, err := state.Open(stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer st.Close()
+		seq, err := st.NextHeartbeatSeq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seq
+	}
+
+	first := nextSeq()
+	if hb := heartbeat(first, "1.0.0"); hb.Stale {
+		t.Fatal("expected the first heartbeat to apply")
+	}
+	// The agent restarts and numbers on from its state store.
+	restarted := nextSeq()
+	if restarted <= first {
+		t.Fatalf("expected the sequence to increase across restarts, got %d after %d", restarted, first)
+	}
+	if hb := heartbeat(restarted, "1.1.0"); hb.Stale {
+		t.Fatal("expected the restarted agent's heartbeat to apply")
+	}
+	if hb := heartbeat(first, "0.9.0"); !hb.Stale {
+		t.Fatal("expected a replayed heartbeat to be dropped as stale")
+	}
+	agent, err := repo.GetAgentByID(ctx, resp.AgentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.AgentVersion != "1.1.0" {
+		t.Fatalf("expected the newest heartbeat's version, got %q", agent.AgentVersion)
+	}
+}
@@ -140,6 +140,10 @@ func (m *MockCloudHypervisor) GetProcessID(ctx context.Context, vmID string) (in
 	return 0, fmt.Errorf("vm %s is not running", vmID)
 }
 
+func (m *MockCloudHypervisor) Capabilities() []string {
+	return executor.AllCapabilities()
+}
+
 func (m *MockCloudHypervisor) GetStatus(ctx context.Context, vmID string) (string, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()